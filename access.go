@@ -0,0 +1,123 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/js-ojus/flagon/auth"
+)
+
+// Right is a kind of access to the data of a namespace or an entity
+// type.
+type Right uint8
+
+// Rights decided by policies.  Policies decide each right on its own;
+// an administrative right does not imply the others, unless the policy
+// grants them too.
+const (
+	RightRead  Right = iota + 1 // reading and searching entities
+	RightWrite                  // storing and deleting entities
+	RightAdmin                  // administering namespaces, entity types and the database
+)
+
+// String answers the name of this right.
+func (r Right) String() string {
+	switch r {
+	case RightRead:
+		return "read"
+	case RightWrite:
+		return "write"
+	case RightAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("right(%d)", uint8(r))
+	}
+}
+
+// Policy decides the rights of principals.  See `Options.Policy`.
+type Policy interface {
+	// Allow answers `true` if the given principal - `nil` if the
+	// operation carries none - has the given right on the given
+	// entity type in the given namespace.  The entity type is empty
+	// when the right is sought on the namespace as a whole, and both
+	// are empty when it is sought on the database.
+	Allow(p *auth.Principal, r Right, ns, et string) bool
+}
+
+// PolicyFunc adapts a function to `Policy`.
+type PolicyFunc func(p *auth.Principal, r Right, ns, et string) bool
+
+// Allow conforms to `Policy`.
+func (fn PolicyFunc) Allow(p *auth.Principal, r Right, ns, et string) bool {
+	return fn(p, r, ns, et)
+}
+
+// AccessError is answered when the policy denies an operation the
+// right that it needs.
+type AccessError struct {
+	Principal string // name of the principal; empty if none
+	Right     Right  // right denied
+	Namespace string // namespace, if any
+	Type      string // entity type, if any
+}
+
+// Error conforms to `error`.
+func (e *AccessError) Error() string {
+	who := e.Principal
+	if who == "" {
+		who = "anonymous caller"
+	}
+	what := "the database"
+	switch {
+	case e.Type != "":
+		what = fmt.Sprintf("`%s` in namespace `%s`", e.Type, e.Namespace)
+	case e.Namespace != "":
+		what = fmt.Sprintf("namespace `%s`", e.Namespace)
+	}
+	return fmt.Sprintf("%s denied %s access to %s", who, e.Right, what)
+}
+
+// Authorize answers an `*AccessError` if the principal carried by the
+// given context (see package `auth`) lacks the given right on the
+// given entity type in the given namespace, according to the policy of
+// this handle.  Either may be empty, as described by `Policy`.  Without
+// a policy, every right is granted.
+//
+// The operations of `ContextEntityType` authorise themselves.  Servers
+// should authorise other operations - administrative ones, in
+// particular - using this, before running them on behalf of callers.
+func (db *DB) Authorize(ctx context.Context, r Right, ns, et string) error {
+	if db.opts.Policy == nil {
+		return nil
+	}
+
+	p, _ := auth.FromContext(ctx)
+	if db.opts.Policy.Allow(p, r, ns, et) {
+		return nil
+	}
+	e := &AccessError{Right: r, Namespace: ns, Type: et}
+	if p != nil {
+		e.Principal = p.Name
+	}
+	return e
+}
+
+// authorize answers an `*AccessError` if the principal carried by the
+// given context lacks the given right on this entity type.
+func (et *entityType) authorize(ctx context.Context, r Right) error {
+	return et.db.Authorize(ctx, r, et.ns.Name(), et.Name())
+}
@@ -0,0 +1,250 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Administrative actions recorded in the administrative event log.
+const (
+	AdminSchemaChange = "schema_change" // `SaveEntityTypeDefn`
+	AdminEnsureSchema = "ensure_schema" // `EnsureSchema`
+	AdminMigrate      = "migrate"       // `Migrate`, `MigrateContext`
+	AdminCompact      = "compact"       // `Compact`, `CompactEntityType`
+	AdminImport       = "import"        // `Import`, `ImportBatch`
+	AdminRollback     = "rollback"      // `RollbackBatch`, `RollbackSince`
+	AdminCheck        = "check"         // `Check`
+	AdminLoadSnapshot = "load_snapshot" // `LoadSnapshot`
+	AdminFreeze       = "freeze"        // `Freezer.Freeze`
+	AdminUnfreeze     = "unfreeze"      // `Freezer.Unfreeze`
+
+	AdminDeleteNamespace = "delete_namespace" // `DeleteNamespace`
+	AdminRenameNamespace = "rename_namespace" // `RenameNamespace`
+	AdminRebuildIndexes  = "rebuild_indexes"  // `RebuildIndexes`
+	AdminBulkLoad        = "bulk_load"        // `BulkLoad`
+	AdminLoadCatalogue   = "load_catalogue"   // `LoadCatalogue`
+)
+
+// Outcomes of administrative actions.
+const (
+	AdminSucceeded = "succeeded"
+	AdminFailed    = "failed"
+)
+
+// Names of the reserved namespace and entity type holding the
+// administrative event log.  Application namespaces can not begin
+// with an underscore; hence, they can not clash with it.
+const (
+	adminNamespace = "_admin"
+	adminEventType = "admin_event"
+)
+
+var (
+	adminOnce sync.Once
+	adminNS   *Namespace
+	adminDefn *EntityTypeDefn
+)
+
+// adminLog answers the reserved namespace and entity type definition
+// of the administrative event log, defining them on first use.
+func adminLog() (*Namespace, *EntityTypeDefn) {
+	adminOnce.Do(func() {
+		adminNS = &Namespace{name: adminNamespace, buckets: make([]string, 0, 1)}
+		ed, err := NewEntityTypeDefn(adminEventType)
+		if err != nil {
+			panic(err)
+		}
+		for _, f := range []struct {
+			name  string
+			ftype FieldType
+		}{
+			{"action", FieldTypeString},
+			{"namespace", FieldTypeString},
+			{"entity_type", FieldTypeString},
+			{"actor", FieldTypeString},
+			{"params", FieldTypeString},
+			{"started", FieldTypeTime},
+			{"duration", FieldTypeInt64},
+			{"outcome", FieldTypeString},
+			{"error", FieldTypeString},
+		} {
+			if err := ed.AddField(f.name, f.ftype); err != nil {
+				panic(err)
+			}
+		}
+		adminDefn = ed
+	})
+	return adminNS, adminDefn
+}
+
+// AdminLog answers a handle to the administrative event log: an entity
+// type in a reserved namespace, having one entity per administrative
+// action performed using a writable handle.  Use its `Search` to query
+// the log, and `AdminEventOf` to read its entities.  Its fields are:
+//
+//   - `action`: one of the `Admin*` actions, such as `AdminCompact`
+//   - `namespace`, `entity_type`: the target of the action, if any
+//   - `actor`: the actor on whose behalf it was performed, if known
+//   - `params`: a JSON object of its parameters and results
+//   - `started`, `duration` (in nanoseconds): when, and how long
+//   - `outcome`: `AdminSucceeded` or `AdminFailed`
+//   - `error`: the error of a failed action
+//
+// Entities are assigned ascending IDs; hence, a search starting at a
+// known ID answers the later actions.
+func (db *DB) AdminLog() EntityType {
+	ns, ed := adminLog()
+	return db.EntityType(ns, ed)
+}
+
+// AdminEvent describes an administrative action recorded in the
+// administrative event log.  See `DB.AdminLog`.
+type AdminEvent struct {
+	ID        uint64                 // ID of the entity recording the action
+	Action    string                 // one of the `Admin*` actions
+	Namespace string                 // namespace acted upon, if any
+	Type      string                 // entity type acted upon, if any
+	Actor     string                 // actor; empty if unknown
+	Params    map[string]interface{} // parameters and results
+	Started   time.Time              // when the action started
+	Duration  time.Duration          // time taken
+	Outcome   string                 // `AdminSucceeded` or `AdminFailed`
+	Error     string                 // error of a failed action
+}
+
+// AdminEventOf answers the administrative event recorded by the given
+// entity of the administrative event log.
+func AdminEventOf(e Entity) (AdminEvent, error) {
+	d, ok := e.(*Document)
+	if !ok || d.defn.Name() != adminEventType {
+		return AdminEvent{}, ErrEntityTypeMismatch
+	}
+
+	ev := AdminEvent{ID: d.ID()}
+	strs := []struct {
+		name string
+		v    *string
+	}{
+		{"action", &ev.Action},
+		{"namespace", &ev.Namespace},
+		{"entity_type", &ev.Type},
+		{"actor", &ev.Actor},
+		{"outcome", &ev.Outcome},
+		{"error", &ev.Error},
+	}
+	for _, s := range strs {
+		f, err := d.Field(s.name)
+		if err != nil {
+			return AdminEvent{}, err
+		}
+		*s.v = f.(*FieldString).Get()
+	}
+
+	f, err := d.Field("started")
+	if err != nil {
+		return AdminEvent{}, err
+	}
+	ev.Started = f.(*FieldTime).Get()
+	f, err = d.Field("duration")
+	if err != nil {
+		return AdminEvent{}, err
+	}
+	ev.Duration = time.Duration(f.(*FieldInt64).Get())
+	f, err = d.Field("params")
+	if err != nil {
+		return AdminEvent{}, err
+	}
+	if p := f.(*FieldString).Get(); p != "" {
+		err = json.Unmarshal([]byte(p), &ev.Params)
+		if err != nil {
+			return AdminEvent{}, err
+		}
+	}
+
+	return ev, nil
+}
+
+// logAdmin records the given administrative action, begun at the
+// given time and ended with the given error, in the administrative
+// event log.  Read-only handles record nothing.  Since the action
+// itself has been performed, failing to record it is only logged.
+func (db *DB) logAdmin(ctx context.Context, action, ns, et string, params map[string]interface{}, start time.Time, aerr error) {
+	if db.opts.ReadOnly {
+		return
+	}
+	err := db.appendAdmin(ctx, action, ns, et, params, start, aerr)
+	if err != nil {
+		logMsg(LogError, "recording administrative action failed", LogField{"action", action}, LogField{"error", err})
+	}
+}
+
+// appendAdmin stores an entity recording the given administrative
+// action in the administrative event log.  Hooks are not run for it.
+func (db *DB) appendAdmin(ctx context.Context, action, ns, et string, params map[string]interface{}, start time.Time, aerr error) error {
+	ans, ed := adminLog()
+	alog := &entityType{db: db, ns: ans, defn: ed}
+	actor := ActorFrom(ctx)
+
+	d := NewDocument(ed, 0)
+	vals := map[string]interface{}{
+		"action":      action,
+		"namespace":   ns,
+		"entity_type": et,
+		"actor":       actor,
+		"started":     start,
+		"duration":    int64(time.Since(start)),
+		"outcome":     AdminSucceeded,
+	}
+	if aerr != nil {
+		vals["outcome"] = AdminFailed
+		vals["error"] = aerr.Error()
+	}
+	if len(params) > 0 {
+		by, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		vals["params"] = string(by)
+	}
+	for name, v := range vals {
+		f, err := d.Field(name)
+		if err != nil {
+			return err
+		}
+		err = setFieldValue(f, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	by, err := alog.encode(d)
+	if err != nil {
+		return err
+	}
+	return db.sdb.Update(func(tx *storage.Tx) error {
+		id, err := tx.NextSequence(ans.Name(), ed.Name())
+		if err != nil {
+			return err
+		}
+		_, err = alog.store(tx, id, by, d, db.now().UnixNano(), actor)
+		return err
+	})
+}
@@ -0,0 +1,271 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sort"
+)
+
+// AggOp enumerates the aggregate functions that can be computed over
+// the matching entities of a search.  See `Aggregator`.
+type AggOp uint8
+
+const (
+	// AggCount counts the entities in which the field is not null;
+	// all the entities, if no field is given.
+	AggCount AggOp = iota + 1
+	// AggMin answers the least non-null value of the field.
+	AggMin
+	// AggMax answers the greatest non-null value of the field.
+	AggMax
+	// AggSum answers the sum of the non-null values of a numeric
+	// field, as `float64`.
+	AggSum
+	// AggAvg answers the mean of the non-null values of a numeric
+	// field, as `float64`.
+	AggAvg
+)
+
+// Aggregation is an aggregate function over a field.
+type Aggregation struct {
+	Op    AggOp
+	Field string // name of the field; may be empty for `AggCount`
+}
+
+// AggregateSpec specifies the aggregations of a search.
+type AggregateSpec struct {
+	// GroupBy, if not empty, is the name of the field by whose values
+	// the matching entities are grouped.  Otherwise, they form a single
+	// group.
+	GroupBy string
+	// Aggs holds the aggregations computed for every group, in order.
+	Aggs []Aggregation
+}
+
+// AggregateGroup is the result of the aggregations over a group of
+// matching entities.
+type AggregateGroup struct {
+	// Key is the value of the grouping field in the group; `nil` if
+	// it is null, or if the entities are not grouped.
+	Key interface{}
+	// Count is the number of matching entities in the group.
+	Count uint64
+	// Values holds the results of the aggregations, in the order of
+	// `AggregateSpec.Aggs`.  Counts are `uint64`s; minima and maxima
+	// are of the Go types of their fields; sums and means are
+	// `float64`s.  Minima, maxima and means of fields that are null in
+	// all the entities of the group are `nil`.
+	Values []interface{}
+}
+
+// Aggregator is implemented by entity types that can aggregate the
+// values of the fields of their entities.
+type Aggregator interface {
+	// Aggregate computes the given aggregations over the entities
+	// that match the given search.
+	Aggregate(SearchOpts, SearchFn, AggregateSpec) ([]AggregateGroup, error)
+}
+
+// aggregator accumulates an aggregation over a group.
+type aggregator struct {
+	fd    FieldDefn   // aggregated field, if any
+	count uint64      // number of non-null values
+	sum   float64     // sum of the values, for sums and means
+	key   []byte      // encoded value of the extremum, for minima and maxima
+	value interface{} // extremum, for minima and maxima
+}
+
+// aggGroup is a group being aggregated.
+type aggGroup struct {
+	key  []byte // encoded value of the grouping field
+	res  AggregateGroup
+	aggs []aggregator
+}
+
+// aggGroupsByKey sorts groups by the values of their grouping fields.
+type aggGroupsByKey []*aggGroup
+
+func (s aggGroupsByKey) Len() int           { return len(s) }
+func (s aggGroupsByKey) Less(i, j int) bool { return string(s[i].key) < string(s[j].key) }
+func (s aggGroupsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Aggregate computes the given aggregations over the documents that
+// match the given search, in a single scan, and answers a group per
+// distinct value of the grouping field, in the ascending order of
+// those values; null values first.  A `nil` predicate matches all the
+// documents.  Documents are searched as by `Search`; ordering is not
+// applicable, and is ignored.
+//
+// Only the fields that are needed are decoded: those aggregated and
+// grouped by, and those listed in `opts.Fields`.  If the predicate is
+// not `nil`, and `opts.Fields` is `nil`, entire documents are decoded
+// for it.
+func (et *entityType) Aggregate(opts SearchOpts, fn SearchFn, spec AggregateSpec) ([]AggregateGroup, error) {
+	var gfd FieldDefn
+	var ids []int
+	if spec.GroupBy != "" {
+		var err error
+		gfd, err = et.defn.Field(spec.GroupBy)
+		if err != nil {
+			return nil, err
+		}
+		if gfd.Ftype == FieldTypeLink || gfd.Ftype == FieldTypeCollection {
+			return nil, ErrFieldTypeUnsupported
+		}
+		ids = append(ids, int(gfd.ID))
+	}
+	fds, aids, err := aggregatedFields(et.defn, spec.Aggs)
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, aids...)
+
+	if fn == nil {
+		fn = func(uint64, Entity) bool { return true }
+		if opts.Fields == nil {
+			opts.Fields = []int{}
+		}
+	}
+	if opts.Fields != nil {
+		opts.Fields = append(opts.Fields[:len(opts.Fields):len(opts.Fields)], ids...)
+	}
+	opts.orderBy = ""
+
+	groups := make(map[string]*aggGroup)
+	_, err = et.search(context.Background(), opts, func(id uint64, e Entity) bool {
+		if !fn(id, e) {
+			return false
+		}
+		d := e.(*Document)
+
+		var key []byte
+		if spec.GroupBy != "" {
+			key = appendIndexValue(nil, d.fields[gfd.ID])
+		}
+		g, ok := groups[string(key)]
+		if !ok {
+			g = &aggGroup{key: key, aggs: make([]aggregator, len(spec.Aggs))}
+			if f := d.fields[gfd.ID]; spec.GroupBy != "" && f != nil {
+				g.res.Key = fieldValue(f)
+			}
+			for i := range g.aggs {
+				g.aggs[i].fd = fds[i]
+			}
+			groups[string(key)] = g
+		}
+		g.res.Count++
+		for i, a := range spec.Aggs {
+			g.aggs[i].add(a.Op, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*aggGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Sort(aggGroupsByKey(sorted))
+	res := make([]AggregateGroup, len(sorted))
+	for i, g := range sorted {
+		g.res.Values = make([]interface{}, len(spec.Aggs))
+		for j, a := range spec.Aggs {
+			g.res.Values[j] = g.aggs[j].result(a.Op)
+		}
+		res[i] = g.res
+	}
+	return res, nil
+}
+
+// aggregatedFields answers the definitions of the fields of the given
+// aggregations, in order - zero for counts of entities - and their
+// IDs, after verifying that the aggregations apply to them.
+func aggregatedFields(ed *EntityTypeDefn, aggs []Aggregation) ([]FieldDefn, []int, error) {
+	fds := make([]FieldDefn, len(aggs))
+	var ids []int
+	for i, a := range aggs {
+		if a.Field == "" {
+			if a.Op != AggCount {
+				return nil, nil, ErrAggregateInvalid
+			}
+			continue
+		}
+		fd, err := ed.Field(a.Field)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch a.Op {
+		case AggCount, AggMin, AggMax:
+			if fd.Ftype == FieldTypeLink || fd.Ftype == FieldTypeCollection {
+				return nil, nil, ErrFieldTypeUnsupported
+			}
+		case AggSum, AggAvg:
+			if fd.Ftype < FieldTypeInt8 || fd.Ftype > FieldTypeFloat64 {
+				return nil, nil, ErrFieldValueType
+			}
+		default:
+			return nil, nil, ErrAggregateInvalid
+		}
+		fds[i] = fd
+		ids = append(ids, int(fd.ID))
+	}
+	return fds, ids, nil
+}
+
+// add accumulates the value of the aggregated field of the given
+// document.
+func (ag *aggregator) add(op AggOp, d *Document) {
+	if ag.fd.ID == 0 {
+		ag.count++
+		return
+	}
+	f := d.fields[ag.fd.ID]
+	if f == nil || !f.IsSet() {
+		return
+	}
+	ag.count++
+
+	switch op {
+	case AggMin, AggMax:
+		key := appendIndexValue(nil, f)
+		if ag.key == nil || op == AggMin && string(key) < string(ag.key) ||
+			op == AggMax && string(key) > string(ag.key) {
+			ag.key, ag.value = key, fieldValue(f)
+		}
+	case AggSum, AggAvg:
+		x, _ := toFloat64(fieldValue(f))
+		ag.sum += x
+	}
+}
+
+// result answers the result of this aggregation.
+func (ag *aggregator) result(op AggOp) interface{} {
+	switch op {
+	case AggCount:
+		return ag.count
+	case AggMin, AggMax:
+		return ag.value
+	case AggSum:
+		return ag.sum
+	default:
+		if ag.count == 0 {
+			return nil
+		}
+		return ag.sum / float64(ag.count)
+	}
+}
@@ -0,0 +1,288 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// AsyncOpts are the options of an `AsyncWriter`.
+type AsyncOpts struct {
+	// MaxPending is the number of buffered puts that triggers a flush;
+	// `1000` if zero.
+	MaxPending int
+
+	// MaxDelay is the longest time for which a put is buffered before
+	// it is flushed; `10ms` if zero.
+	MaxDelay time.Duration
+}
+
+// PendingPut is the result of a put made using an `AsyncWriter`,
+// available once the put is flushed.
+type PendingPut struct {
+	done chan struct{} // closed once the put is flushed
+	id   uint64        // ID of the stored document
+	err  error         // error answered by the put, if any
+}
+
+// Done answers a channel that is closed once the put is flushed.
+func (p *PendingPut) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits until the put is flushed, and answers the ID of the
+// stored document, or the error that prevented storing it.
+func (p *PendingPut) Wait() (uint64, error) {
+	<-p.done
+	return p.id, p.err
+}
+
+// resolve records the given outcome of the put, and releases its
+// waiters.
+func (p *PendingPut) resolve(id uint64, err error) {
+	p.id, p.err = id, err
+	close(p.done)
+}
+
+// asyncPut is a put buffered by an `AsyncWriter`.
+type asyncPut struct {
+	et *entityType
+	d  *Document
+	by []byte // stored form of the document
+	p  *PendingPut
+}
+
+// AsyncWriter buffers puts, and stores them in the background, many
+// in each transaction, once enough of them are buffered or the oldest
+// has waited long enough.  Concurrent flushes share transactions, as
+// well.  It trades the latency and the durability of individual puts
+// for throughput, in high-ingest scenarios such as event logging: a
+// put is durable only once its `PendingPut` is done, and buffered puts
+// are lost if the process stops before then.
+//
+// Documents are checked - their `BeforePut` hooks called, derived
+// fields computed, validated and encoded - when they are put, in the
+// calling goroutine; failures are answered immediately, through their
+// `PendingPut`s.  Conflicts with immutable fields are detected when
+// they are flushed, and fail only the puts concerned.  Other failures
+// fail all the puts flushed together.  `AfterPut` hooks are called in
+// the flushing goroutine.  Documents must not be modified until their
+// puts are done.
+//
+// Puts are stored as `Put` stores them.  An `AsyncWriter` is safe for
+// concurrent use.  It should be closed after use.
+type AsyncWriter struct {
+	db   *DB
+	opts AsyncOpts
+
+	mutex    sync.Mutex
+	pending  []asyncPut  // buffered puts, in order
+	timer    *time.Timer // flushes the buffered puts; nil if none
+	closed   bool
+	inflight int        // flushes in progress in the background
+	idle     *sync.Cond // signalled when none is in progress
+}
+
+// NewAsyncWriter answers a new writer that buffers puts to the entity
+// types of this database, and stores them in the background.
+func (db *DB) NewAsyncWriter(opts AsyncOpts) *AsyncWriter {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 1000
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 10 * time.Millisecond
+	}
+	w := &AsyncWriter{db: db, opts: opts}
+	w.idle = sync.NewCond(&w.mutex)
+	return w
+}
+
+// Put buffers the given document for storing in the given entity type,
+// which should be a handle answered by `DB.EntityType`, and answers
+// its pending result.
+func (w *AsyncWriter) Put(et EntityType, e Entity) *PendingPut {
+	p := &PendingPut{done: make(chan struct{})}
+	t, ok := et.(*entityType)
+	d, dok := e.(*Document)
+	if !ok || !dok || d.defn.Name() != t.Name() {
+		p.resolve(0, ErrEntityTypeMismatch)
+		return p
+	}
+	by, err := t.prepare(context.Background(), d)
+	if err != nil {
+		p.resolve(0, err)
+		return p
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		p.resolve(0, ErrWriterClosed)
+		return p
+	}
+	w.pending = append(w.pending, asyncPut{et: t, d: d, by: by, p: p})
+	switch {
+	case len(w.pending) >= w.opts.MaxPending:
+		w.start()
+	case w.timer == nil:
+		w.timer = time.AfterFunc(w.opts.MaxDelay, func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			w.start()
+		})
+	}
+	return p
+}
+
+// Flush stores the buffered puts, and waits until all the flushes in
+// progress complete.  It answers the error that failed the buffered
+// puts together, if any.
+func (w *AsyncWriter) Flush() error {
+	w.mutex.Lock()
+	ps := w.take()
+	w.mutex.Unlock()
+
+	err := w.flush(ps)
+
+	w.mutex.Lock()
+	for w.inflight > 0 {
+		w.idle.Wait()
+	}
+	w.mutex.Unlock()
+	return err
+}
+
+// Close flushes the buffered puts, as `Flush` does, and makes later
+// puts fail with `ErrWriterClosed`.
+func (w *AsyncWriter) Close() error {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+
+	return w.Flush()
+}
+
+// take answers the buffered puts, and empties the buffer.  The caller
+// should hold the mutex.
+func (w *AsyncWriter) take() []asyncPut {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	ps := w.pending
+	w.pending = nil
+	return ps
+}
+
+// start flushes the buffered puts in a new goroutine.  The caller
+// should hold the mutex.
+func (w *AsyncWriter) start() {
+	ps := w.take()
+	if len(ps) == 0 {
+		return
+	}
+	w.inflight++
+	go func() {
+		w.flush(ps)
+
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.inflight--
+		if w.inflight == 0 {
+			w.idle.Broadcast()
+		}
+	}()
+}
+
+// flush stores the given puts in a shared transaction, resolves their
+// results, and calls their `AfterPut` hooks.
+func (w *AsyncWriter) flush(ps []asyncPut) error {
+	if len(ps) == 0 {
+		return nil
+	}
+
+	ids := make([]uint64, len(ps))
+	revs := make([]uint64, len(ps))
+	errs := make([]error, len(ps))
+	schemas := make([]uint32, len(ps))
+	for i, el := range ps {
+		schemas[i] = el.d.schema
+		el.d.schema = el.et.defn.SchemaVersion()
+	}
+	now := w.db.now().UnixNano()
+	err := w.db.batch(context.Background(), func(tx *storage.Tx) error {
+		// This is called again if the shared transaction fails.
+		for i, el := range ps {
+			var err error
+			ids[i], revs[i], err = el.et.storeAsync(tx, el.d, el.by, now)
+			errs[i] = nil
+			if _, ok := err.(*ImmutableFieldError); ok {
+				errs[i] = err
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for i, el := range ps {
+		d := el.d
+		perr := err
+		if perr == nil {
+			perr = errs[i]
+		}
+		if perr != nil {
+			d.schema = schemas[i]
+			el.p.resolve(0, perr)
+			continue
+		}
+		d.id, d.version = ids[i], revs[i]
+		d.prov, d.expires = nil, 0
+		el.p.resolve(ids[i], nil)
+		el.et.runHooks(context.Background(), AfterPut, ids[i], d)
+	}
+	return err
+}
+
+// storeAsync stores the given document, whose stored form is given,
+// within the given transaction, as `Put` does, and answers its ID and
+// its new version.
+func (et *entityType) storeAsync(tx *storage.Tx, d *Document, by []byte, now int64) (uint64, uint64, error) {
+	id := d.ID()
+	var err error
+	if id == 0 {
+		id, err = et.newID(tx, now, nil)
+	} else {
+		err = et.checkImmutable(tx, id, d)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rev, err := et.store(tx, id, by, d, now, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	err = tx.SetExpiry(et.ns.Name(), et.Name(), id, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return id, rev, tx.ClearProvenance(et.ns.Name(), et.Name(), id)
+}
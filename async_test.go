@@ -0,0 +1,122 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncWriter(t *testing.T) {
+	ns := testNamespace(t, "async_ns")
+	ed := testDefn(t, "async_event", []testField{{"seq", FieldTypeUint32}, {"kind", FieldTypeString}}, func(ed *EntityTypeDefn) {
+		ed.SetImmutable("kind")
+	})
+	et := testDB.EntityType(ns, ed)
+
+	var mu sync.Mutex
+	after := 0
+	remove, err := testDB.RegisterHook(ed, AfterPut, func(HookEvent) error {
+		mu.Lock()
+		after++
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+
+	w := testDB.NewAsyncWriter(AsyncOpts{MaxPending: 8, MaxDelay: time.Hour})
+	var ps []*PendingPut
+	for i := 0; i < 20; i++ {
+		ps = append(ps, w.Put(et, testDoc(t, ed, 0, map[string]interface{}{"seq": uint32(i), "kind": "click"})))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint64]bool)
+	for i, p := range ps {
+		id, err := p.Wait()
+		if err != nil || id == 0 || seen[id] {
+			t.Fatalf("put %d: %d, %v", i, id, err)
+		}
+		seen[id] = true
+		e, err := et.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, _ := e.(*Document).Field("seq"); f.(*FieldUint32).Get() != uint32(i) {
+			t.Errorf("put %d: stored %d", i, f.(*FieldUint32).Get())
+		}
+	}
+	mu.Lock()
+	if after != 20 {
+		t.Errorf("%d hooks called", after)
+	}
+	mu.Unlock()
+
+	// Immutable fields fail only the puts concerned.
+	bad := w.Put(et, testDoc(t, ed, 1, map[string]interface{}{"seq": uint32(0), "kind": "view"}))
+	good := w.Put(et, testDoc(t, ed, 2, map[string]interface{}{"seq": uint32(99), "kind": "click"}))
+	w.Flush()
+	if _, err := bad.Wait(); err == nil {
+		t.Error("immutable field changed")
+	} else if _, ok := err.(*ImmutableFieldError); !ok {
+		t.Errorf("immutable field: %v", err)
+	}
+	if id, err := good.Wait(); id != 2 || err != nil {
+		t.Errorf("put beside a failure: %d, %v", id, err)
+	}
+
+	// Invalid puts fail at once.
+	other := testDefn(t, "async_other", []testField{{"seq", FieldTypeUint32}}, nil)
+	p := w.Put(et, NewDocument(other, 0))
+	select {
+	case <-p.Done():
+	default:
+		t.Error("mismatched put buffered")
+	}
+	if _, err := p.Wait(); err != ErrEntityTypeMismatch {
+		t.Errorf("mismatched type: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Put(et, NewDocument(ed, 0)).Wait(); err != ErrWriterClosed {
+		t.Errorf("put after closing: %v", err)
+	}
+}
+
+func TestAsyncWriterDelay(t *testing.T) {
+	ns := testNamespace(t, "async_delay_ns")
+	ed := testDefn(t, "async_delay_event", []testField{{"seq", FieldTypeUint32}}, nil)
+	et := testDB.EntityType(ns, ed)
+
+	// Buffered puts are flushed once they have waited long enough.
+	w := testDB.NewAsyncWriter(AsyncOpts{MaxDelay: time.Millisecond})
+	defer w.Close()
+	p := w.Put(et, NewDocument(ed, 0))
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("put not flushed")
+	}
+	if id, err := p.Wait(); id != 1 || err != nil {
+		t.Errorf("delayed put: %d, %v", id, err)
+	}
+}
@@ -0,0 +1,100 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+
+	"github.com/js-ojus/flagon/auth"
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// actorKey is the context key of the actor.
+type actorKey struct{}
+
+// WithActor answers a copy of the given context carrying the given
+// actor, to be recorded in the audit log by the modifications made
+// using it.  See `ContextEntityType`.  Actors longer than 255 bytes are
+// truncated.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom answers the actor carried by the given context: the one
+// given to `WithActor`, or else the name of the authenticated
+// principal (see package `auth`), if any.
+func ActorFrom(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey{}).(string); ok {
+		return a
+	}
+	if p, ok := auth.FromContext(ctx); ok {
+		return p.Name
+	}
+	return ""
+}
+
+// audit appends a record of the given operation on the entity having
+// the given ID to the audit log, within the given transaction, if
+// auditing is enabled.
+func (et *entityType) audit(tx *storage.Tx, op ChangeOp, id, rev uint64, now int64, actor string) error {
+	if !et.db.opts.Audit {
+		return nil
+	}
+	if len(actor) > 255 {
+		actor = actor[:255]
+	}
+	return tx.Audit(et.ns.Name(), et.Name(), id, storage.AuditRecord{Time: now, Op: uint8(op), Rev: rev, Actor: actor})
+}
+
+// AuditEntry describes a recorded modification of an entity.
+type AuditEntry struct {
+	Time    time.Time // time of the modification
+	Actor   string    // actor that made it; empty if unknown
+	Op      ChangeOp  // `ChangePut` or `ChangeDelete`
+	Version uint64    // version of the entity after the modification
+}
+
+// AuditHistory answers the recorded modifications of the entity
+// having the given ID, of the given entity type in the given
+// namespace, in the order in which they were made.  Records are
+// retained after the entity is deleted.
+//
+// Modifications are recorded by handles opened with `Options.Audit`.
+// Those made by `Put` and `Delete` have no actor; so do those made on
+// behalf of none, such as rollbacks, purges and expiry.
+func (db *DB) AuditHistory(ns *Namespace, ed *EntityTypeDefn, id uint64) ([]AuditEntry, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+
+	var res []AuditEntry
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		return tx.AuditHistory(ns.Name(), ed.Name(), id, func(r storage.AuditRecord) (bool, error) {
+			res = append(res, AuditEntry{
+				Time:    time.Unix(0, r.Time),
+				Actor:   r.Actor,
+				Op:      ChangeOp(r.Op),
+				Version: r.Rev,
+			})
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
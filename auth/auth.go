@@ -0,0 +1,114 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth is the plug point through which the remote access
+// layers of `flagon` authenticate their callers.
+//
+// An `Authenticator` examines an incoming request, and answers the
+// `Principal` making it.  The principal is placed in the request's
+// context, from where authorisation and auditing read it.  API keys,
+// mapping of verified TLS client certificates, and validation of
+// bearer tokens (such as OIDC ID tokens) by a user-supplied callback
+// are provided.  Authenticators can be combined using `Chain`.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is answered by an authenticator when the
+	// request does not carry the credentials that it understands.
+	// `Chain` then tries the next authenticator.
+	ErrNoCredentials = errors.New("no credentials presented")
+
+	// ErrUnauthenticated is answered when the credentials carried by
+	// the request are invalid.
+	ErrUnauthenticated = errors.New("invalid credentials")
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name   string   // unique name of the caller
+	Method string   // authentication method that identified the caller
+	Groups []string // groups that the caller belongs to, if known
+
+	// Claims holds any additional attributes established during
+	// authentication, such as the claims of a validated token.
+	Claims map[string]interface{}
+}
+
+// Authenticator identifies the callers of the remote access layers.
+type Authenticator interface {
+	// Authenticate answers the principal making the given request.  It
+	// answers `ErrNoCredentials` if the request carries no credentials
+	// of the kind that this authenticator understands.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to `Authenticator`.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+// Authenticate conforms to `Authenticator`.
+func (fn AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return fn(r)
+}
+
+// Chain tries its authenticators in order, until one of them answers
+// other than `ErrNoCredentials`.
+type Chain []Authenticator
+
+// Authenticate conforms to `Authenticator`.
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if err != ErrNoCredentials {
+			return p, err
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// principalKey is the context key of the principal.
+type principalKey struct{}
+
+// NewContext answers a copy of the given context carrying the given
+// principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext answers the principal carried by the given context, if
+// any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Middleware authenticates every request using the given
+// authenticator, before passing it - with its principal in its
+// context - to the given handler.  Requests that fail authentication
+// are answered with `401 Unauthorized`.
+func Middleware(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+	})
+}
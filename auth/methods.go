@@ -0,0 +1,155 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Names of the authentication methods, as recorded in principals.
+const (
+	MethodAPIKey     = "apikey"
+	MethodClientCert = "mtls"
+	MethodToken      = "token"
+)
+
+// APIKeys authenticates requests carrying a static API key in a
+// header.  Keys are held only as their SHA-256 digests.
+type APIKeys struct {
+	header string
+	mutex  sync.RWMutex
+	keys   map[[sha256.Size]byte]Principal
+}
+
+// NewAPIKeys answers an authenticator reading API keys from the given
+// header; `X-API-Key` if empty.
+func NewAPIKeys(header string) *APIKeys {
+	if header == "" {
+		header = "X-API-Key"
+	}
+	return &APIKeys{header: header, keys: make(map[[sha256.Size]byte]Principal)}
+}
+
+// Add registers the given key as identifying the given principal.
+func (ak *APIKeys) Add(key string, p Principal) {
+	p.Method = MethodAPIKey
+	ak.mutex.Lock()
+	defer ak.mutex.Unlock()
+
+	ak.keys[sha256.Sum256([]byte(key))] = p
+}
+
+// Remove revokes the given key.
+func (ak *APIKeys) Remove(key string) {
+	ak.mutex.Lock()
+	defer ak.mutex.Unlock()
+
+	delete(ak.keys, sha256.Sum256([]byte(key)))
+}
+
+// Authenticate conforms to `Authenticator`.
+func (ak *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(ak.header)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	ak.mutex.RLock()
+	defer ak.mutex.RUnlock()
+
+	p, ok := ak.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return &p, nil
+}
+
+// ClientCerts authenticates requests made over TLS connections whose
+// client certificates were verified by the server.  The server should
+// be configured with `tls.RequireAndVerifyClientCert` or
+// `tls.VerifyClientCertIfGiven`.
+type ClientCerts struct {
+	// Map answers the principal identified by the given verified
+	// client certificate.  If `nil`, the certificate's subject common
+	// name is used as the principal's name, and its organisational
+	// units as the principal's groups.
+	Map func(cert *x509.Certificate) (*Principal, error)
+}
+
+// Authenticate conforms to `Authenticator`.
+func (cc ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	if cc.Map == nil {
+		if cert.Subject.CommonName == "" {
+			return nil, ErrUnauthenticated
+		}
+		return &Principal{
+			Name:   cert.Subject.CommonName,
+			Method: MethodClientCert,
+			Groups: cert.Subject.OrganizationalUnit,
+		}, nil
+	}
+
+	p, err := cc.Map(cert)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrUnauthenticated
+	}
+	p.Method = MethodClientCert
+	return p, nil
+}
+
+// BearerTokens authenticates requests carrying a bearer token in
+// their `Authorization` header, by way of a validation callback.  For
+// OIDC, the callback should verify the ID token's signature against
+// the provider's keys, and its issuer, audience and expiry.
+type BearerTokens struct {
+	// Validate answers the principal identified by the given token,
+	// or `ErrUnauthenticated` if the token is invalid.
+	Validate func(ctx context.Context, token string) (*Principal, error)
+}
+
+// Authenticate conforms to `Authenticator`.
+func (bt BearerTokens) Authenticate(r *http.Request) (*Principal, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return nil, ErrNoCredentials
+	}
+	tok := strings.TrimSpace(h[7:])
+	if tok == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	p, err := bt.Validate(r.Context(), tok)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrUnauthenticated
+	}
+	p.Method = MethodToken
+	return p, nil
+}
@@ -0,0 +1,163 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// BulkSource supplies the entities loaded by `DB.BulkLoad`.
+type BulkSource interface {
+	// Next answers the next entity, or `io.EOF` when there are no
+	// more.  Entities should be answered in the strictly ascending
+	// order of their IDs, which should not be zero.
+	Next() (Entity, error)
+}
+
+// BulkOpts are the options of `DB.BulkLoad`.
+type BulkOpts struct {
+	// ChunkSize is the number of entities stored in each transaction;
+	// `10000` if not positive.
+	ChunkSize int
+
+	// NoSync makes the transactions not be synced to disk as they
+	// commit; the database is synced once, at the end.  See
+	// `Durability` for the risks.
+	NoSync bool
+}
+
+// defaultBulkChunk is the number of entities stored in each
+// transaction of a bulk load, when none is given.
+const defaultBulkChunk = 10000
+
+// BulkLoad stores the entities answered by the given source in the
+// given entity type in the given namespace, many in each transaction,
+// and answers the number stored.  Since the entities arrive in the
+// ascending order of their IDs, the pages of the entity type are
+// filled fully: initial imports are much faster, and the database file
+// smaller, than when the entities are put one by one.  Entities having
+// IDs above those already stored load best.  The sequence of new IDs
+// is raised past the largest ID loaded.
+//
+// Entities are computed, validated and verified against the maximum
+// size of the entity type, as by `Put`, and are then stored, indexed,
+// audited and so on.  Unlike `Put`, hooks are not called, and - since
+// no context is given - no outbox messages are written; their expiry
+// times and provenance are cleared.  An entity answered out of order
+// fails the load with `ErrBulkOrder`.  Chunks stored before a failure
+// remain stored.
+//
+// Bulk loads are recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) BulkLoad(ns *Namespace, ed *EntityTypeDefn, src BulkSource, opts BulkOpts) (uint64, error) {
+	start := time.Now()
+	n, err := db.bulkLoad(ns, ed, src, opts)
+	quotas.reset(ns.Name(), ed.Name())
+	db.logAdmin(context.Background(), AdminBulkLoad, ns.Name(), ed.Name(), map[string]interface{}{"entities": n}, start, err)
+	return n, err
+}
+
+// bulkLoad implements `BulkLoad`.
+func (db *DB) bulkLoad(ns *Namespace, ed *EntityTypeDefn, src BulkSource, opts BulkOpts) (uint64, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultBulkChunk
+	}
+	et := &entityType{db: db, ns: ns, defn: ed}
+
+	var n, last uint64
+	docs := make([]*Document, 0, opts.ChunkSize)
+	vals := make([][]byte, 0, opts.ChunkSize)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		now := db.now().UnixNano()
+		err := db.sdb.UpdateSync(!opts.NoSync && !db.sdb.NoSync(), func(tx *storage.Tx) error {
+			err := tx.SetFillPercent(ns.Name(), ed.Name(), 1.0)
+			if err != nil {
+				return err
+			}
+			for i, d := range docs {
+				err = et.checkImmutable(tx, d.ID(), d)
+				if err != nil {
+					return err
+				}
+				_, err = et.store(tx, d.ID(), vals[i], d, now, "")
+				if err != nil {
+					return err
+				}
+				err = tx.SetExpiry(ns.Name(), ed.Name(), d.ID(), 0)
+				if err != nil {
+					return err
+				}
+				err = tx.ClearProvenance(ns.Name(), ed.Name(), d.ID())
+				if err != nil {
+					return err
+				}
+			}
+			return tx.RaiseSequence(ns.Name(), ed.Name(), last)
+		})
+		if err != nil {
+			return err
+		}
+		n += uint64(len(docs))
+		docs, vals = docs[:0], vals[:0]
+		return nil
+	}
+
+	for {
+		e, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		d, ok := e.(*Document)
+		if !ok || d.defn.Name() != ed.Name() {
+			return n, ErrEntityTypeMismatch
+		}
+		if d.ID() == 0 {
+			return n, ErrIdentifierZero
+		}
+		if d.ID() <= last {
+			return n, ErrBulkOrder
+		}
+		last = d.ID()
+
+		d.schema = ed.SchemaVersion()
+		by, err := et.encodeValid(d)
+		if err != nil {
+			return n, err
+		}
+		docs, vals = append(docs, d), append(vals, by)
+		if len(docs) == opts.ChunkSize {
+			err = flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	err := flush()
+	if err == nil && opts.NoSync {
+		err = db.sdb.Sync()
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// sliceSource is a `BulkSource` of the given documents.
+type sliceSource []*Document
+
+func (s *sliceSource) Next() (Entity, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	d := (*s)[0]
+	*s = (*s)[1:]
+	return d, nil
+}
+
+func TestBulkLoad(t *testing.T) {
+	ns := testNamespace(t, "bulk_ns")
+	ed := testDefn(t, "bulk_item", []testField{{"label", FieldTypeString}}, func(ed *EntityTypeDefn) {
+		ed.SetMaxSize(64)
+	})
+	et := testDB.EntityType(ns, ed)
+
+	src := sliceSource{}
+	for id := uint64(1); id <= 5; id++ {
+		src = append(src, testDoc(t, ed, id*10, map[string]interface{}{"label": "item"}))
+	}
+	n, err := testDB.BulkLoad(ns, ed, &src, BulkOpts{ChunkSize: 2})
+	if n != 5 || err != nil {
+		t.Fatalf("load: %d, %v", n, err)
+	}
+	e, err := et.Get(30)
+	if err != nil || e.(*Document).Version() != 1 {
+		t.Fatalf("get: %v", err)
+	}
+	d := testDoc(t, ed, 0, nil)
+	if err := et.Put(d); err != nil || d.ID() <= 50 {
+		t.Fatalf("put after load: %d, %v", d.ID(), err)
+	}
+
+	src = sliceSource{testDoc(t, ed, 70, nil), testDoc(t, ed, 60, nil)}
+	if n, err := testDB.BulkLoad(ns, ed, &src, BulkOpts{}); n != 0 || !errors.Is(err, ErrBulkOrder) {
+		t.Errorf("out of order: %d, %v", n, err)
+	}
+
+	// Entities exceeding the maximum size fail the load.
+	src = sliceSource{
+		testDoc(t, ed, 80, nil),
+		testDoc(t, ed, 90, map[string]interface{}{"label": strings.Repeat("x", 100)}),
+	}
+	var serr *EntitySizeError
+	if n, err := testDB.BulkLoad(ns, ed, &src, BulkOpts{ChunkSize: 1}); n != 1 || !errors.As(err, &serr) {
+		t.Errorf("oversized: %d, %v", n, err)
+	}
+	if _, err := et.Get(90); !errors.Is(err, ErrIdentifierUnknown) {
+		t.Errorf("oversized stored: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Frequently read entities can be cached in-process, so that reading
+// them repeatedly does not decode them each time.  Caches hold the
+// decoded fields of entities, together with their revisions and
+// schema versions when cached.  Cached fields are used only if the
+// stored entity still has the same revision and schema version, and
+// cached entities are discarded when they are stored or deleted, or
+// when changes to them are applied by `ApplyChanges`.  Metadata -
+// labels, expiry times, soft-deletion marks and provenance - are
+// always read afresh.  See `EntityTypeDefn.SetCacheSize`.
+
+// CacheSize answers the maximum number of instances of this entity
+// type that are cached in-process, per namespace; `0` if they are not
+// cached.
+func (ed *EntityTypeDefn) CacheSize() int {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.csize
+}
+
+// SetCacheSize enables an in-process cache of up to the given number
+// of the most recently read instances of this entity type, per
+// namespace, in front of `Get`.  `0` disables the cache, discarding
+// the cached instances.  Documents answered from the cache are copies,
+// and may be modified freely.
+//
+// The setting is not stored with the definition, and should be made
+// by every process that reads the entity type.
+func (ed *EntityTypeDefn) SetCacheSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.csize = n
+}
+
+// cacheEntry holds the decoded fields of a cached entity.
+type cacheEntry struct {
+	id     uint64
+	rev    uint64          // revision of the entity when cached
+	schema uint32          // schema version of its stored fields
+	fields map[uint8]Field // NOT to be modified
+}
+
+// entityCache is a size-bounded, least recently used cache of the
+// instances of an entity type in a namespace.
+type entityCache struct {
+	mutex sync.Mutex
+	size  int                      // maximum number of entries
+	lru   *list.List               // most recently used at the front
+	items map[uint64]*list.Element // by entity ID
+}
+
+// newEntityCache creates an empty cache of the given size.
+func newEntityCache(size int) *entityCache {
+	return &entityCache{size: size, lru: list.New(), items: make(map[uint64]*list.Element)}
+}
+
+// load copies the cached fields of the given document into it, if
+// they are cached at the given revision and schema version.  It
+// answers `true` if it did.
+func (c *entityCache) load(d *Document, rev uint64, schema uint32) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[d.ID()]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.rev != rev || e.schema != schema {
+		return false
+	}
+
+	c.lru.MoveToFront(el)
+	for id, f := range e.fields {
+		d.fields[id] = copyField(f)
+	}
+	return true
+}
+
+// store caches the fields of the given document, as read at the given
+// revision and schema version, evicting the least recently used
+// entries beyond the size of this cache.
+func (c *entityCache) store(d *Document, rev uint64, schema uint32) {
+	fields := make(map[uint8]Field, len(d.fields))
+	for id, f := range d.fields {
+		fields[id] = copyField(f)
+	}
+	e := &cacheEntry{id: d.ID(), rev: rev, schema: schema, fields: fields}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[e.id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[e.id] = c.lru.PushFront(e)
+	}
+	c.trim()
+}
+
+// remove discards the cached entity having the given ID, if any.
+func (c *entityCache) remove(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.lru.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// resize sets the size of this cache, evicting the least recently
+// used entries beyond it.
+func (c *entityCache) resize(size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.size = size
+	c.trim()
+}
+
+// trim evicts the least recently used entries beyond the size of this
+// cache.  The caller should hold the lock of this cache.
+func (c *entityCache) trim() {
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).id)
+	}
+}
+
+// cacheHub holds the caches of entities, which all handles share; see
+// `DB`.
+type cacheHub struct {
+	mutex  sync.Mutex
+	caches map[string]*entityCache // by namespace and entity type
+}
+
+var caches = &cacheHub{caches: make(map[string]*entityCache)}
+
+// lookup answers the cache of the given entity type in the given
+// namespace, if one exists.
+func (h *cacheHub) lookup(ns, et string) *entityCache {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.caches[changeKey(ns, et)]
+}
+
+// purge discards all caches.
+func (h *cacheHub) purge() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.caches = make(map[string]*entityCache)
+}
+
+// cache answers the cache of this entity type, creating it if
+// necessary; `nil` if caching is disabled.
+func (et *entityType) cache() *entityCache {
+	size := et.defn.CacheSize()
+	key := changeKey(et.ns.Name(), et.Name())
+
+	caches.mutex.Lock()
+	defer caches.mutex.Unlock()
+
+	c := caches.caches[key]
+	switch {
+	case size == 0:
+		delete(caches.caches, key)
+		return nil
+	case c == nil:
+		c = newEntityCache(size)
+		caches.caches[key] = c
+	case c.size != size:
+		c.resize(size)
+	}
+	return c
+}
+
+// invalidate arranges for the cached copy of the entity having the
+// given ID to be discarded, after the given transaction commits.
+func (et *entityType) invalidate(tx *storage.Tx, id uint64) {
+	c := caches.lookup(et.ns.Name(), et.Name())
+	if c == nil {
+		return
+	}
+	tx.OnCommit(func() {
+		c.remove(id)
+	})
+}
+
+// getCached is like `get`, but answers the fields of the document from
+// the cache of this entity type, if they are cached; otherwise, they
+// are decoded and cached.
+func (et *entityType) getCached(tx *storage.Tx, c *entityCache, id uint64) (*Document, error) {
+	d := NewDocument(et.defn, id)
+	by, err := tx.Get(et.ns.Name(), et.Name(), d.Key())
+	if err != nil {
+		return nil, err
+	}
+	rev := tx.Revision(et.ns.Name(), et.Name(), id)
+	schema := tx.SchemaVersion(et.ns.Name(), et.Name(), id)
+	if !c.load(d, rev, schema) {
+		err = et.decode(by, d)
+		if err != nil {
+			return nil, err
+		}
+		c.store(d, rev, schema)
+	}
+
+	et.readMeta(tx, d)
+	err = et.defn.upgrade(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// copyField answers a copy of the given field.
+func copyField(f Field) Field {
+	switch f := f.(type) {
+	case *FieldBool:
+		c := *f
+		return &c
+	case *FieldInt8:
+		c := *f
+		return &c
+	case *FieldInt16:
+		c := *f
+		return &c
+	case *FieldInt32:
+		c := *f
+		return &c
+	case *FieldInt64:
+		c := *f
+		return &c
+	case *FieldUint8:
+		c := *f
+		return &c
+	case *FieldUint16:
+		c := *f
+		return &c
+	case *FieldUint32:
+		c := *f
+		return &c
+	case *FieldUint64:
+		c := *f
+		return &c
+	case *FieldFloat32:
+		c := *f
+		return &c
+	case *FieldFloat64:
+		c := *f
+		return &c
+	case *FieldTime:
+		c := *f
+		return &c
+	case *FieldString:
+		c := *f
+		return &c
+	case *FieldReference:
+		c := *f
+		return &c
+	default:
+		return f
+	}
+}
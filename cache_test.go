@@ -0,0 +1,129 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+)
+
+// cachedIDs answers the IDs held by the given cache, most recently
+// used first.
+func cachedIDs(c *entityCache) []uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var ids []uint64
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		ids = append(ids, el.Value.(*cacheEntry).id)
+	}
+	return ids
+}
+
+func TestEntityCache(t *testing.T) {
+	ed := testDefn(t, "cache_lru_item", []testField{{"qty", FieldTypeUint32}}, nil)
+	c := newEntityCache(2)
+	for id := uint64(1); id <= 3; id++ {
+		c.store(testDoc(t, ed, id, map[string]interface{}{"qty": uint32(id * 10)}), 1, 1)
+	}
+	if ids := cachedIDs(c); len(ids) != 2 || ids[0] != 3 || ids[1] != 2 {
+		t.Fatalf("cached: %v", ids)
+	}
+
+	d := NewDocument(ed, 2)
+	if !c.load(d, 1, 1) {
+		t.Fatal("not loaded")
+	}
+	if f, _ := d.Field("qty"); f.(*FieldUint32).Get() != 20 {
+		t.Errorf("loaded %d", f.(*FieldUint32).Get())
+	}
+	if ids := cachedIDs(c); ids[0] != 2 {
+		t.Errorf("not most recently used: %v", ids)
+	}
+
+	// Loaded fields are copies.
+	f, _ := d.Field("qty")
+	f.(*FieldUint32).Set(99)
+	d = NewDocument(ed, 2)
+	c.load(d, 1, 1)
+	if f, _ := d.Field("qty"); f.(*FieldUint32).Get() != 20 {
+		t.Errorf("cached field modified: %d", f.(*FieldUint32).Get())
+	}
+
+	if c.load(NewDocument(ed, 2), 2, 1) || c.load(NewDocument(ed, 2), 1, 2) {
+		t.Error("loaded at another revision or schema version")
+	}
+	if c.load(NewDocument(ed, 1), 1, 1) {
+		t.Error("evicted entity loaded")
+	}
+	c.remove(2)
+	c.resize(0)
+	if ids := cachedIDs(c); len(ids) != 0 {
+		t.Errorf("cached after resizing: %v", ids)
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	ns := testNamespace(t, "cache_ns")
+	ed := testDefn(t, "cache_item", []testField{{"qty", FieldTypeUint32}}, nil)
+	ed.SetCacheSize(10)
+	defer ed.SetCacheSize(0)
+	et := testDB.EntityType(ns, ed)
+
+	d := testDoc(t, ed, 0, map[string]interface{}{"qty": uint32(1)})
+	if err := et.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	id := d.ID()
+	qty := func() uint32 {
+		t.Helper()
+		e, err := et.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := e.(*Document).Field("qty")
+		return f.(*FieldUint32).Get()
+	}
+	if n := qty(); n != 1 {
+		t.Errorf("read %d", n)
+	}
+	c := caches.lookup("cache_ns", "cache_item")
+	if c == nil || len(cachedIDs(c)) != 1 {
+		t.Fatal("not cached")
+	}
+
+	// Storing and deleting discard cached entities.
+	if err := et.Put(testDoc(t, ed, id, map[string]interface{}{"qty": uint32(2)})); err != nil {
+		t.Fatal(err)
+	}
+	if len(cachedIDs(c)) != 0 {
+		t.Error("stored entity still cached")
+	}
+	if n := qty(); n != 2 {
+		t.Errorf("read %d after storing", n)
+	}
+	if err := et.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.Get(id); !errors.Is(err, ErrIdentifierUnknown) {
+		t.Errorf("deleted: %v", err)
+	}
+
+	ed.SetCacheSize(0)
+	et.Get(id)
+	if caches.lookup("cache_ns", "cache_item") != nil {
+		t.Error("cache retained once disabled")
+	}
+}
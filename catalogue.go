@@ -0,0 +1,313 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// SaveEntityTypeDefn persists the given entity type definition in the
+// system catalogue.  A new definition is assigned a unique ID when it
+// is saved for the first time.  Saving a definition having the same
+// name as an existing one replaces the latter.
+//
+// Since fields can not be removed from entity types, applications
+// should add new fields to the definition answered by
+// `EntityTypeDefns`, and save it back.
+//
+// Saving is recorded in the administrative event log.  See `AdminLog`.
+func (db *DB) SaveEntityTypeDefn(ed *EntityTypeDefn) error {
+	start := time.Now()
+	err := db.saveEntityTypeDefn(ed)
+	params := map[string]interface{}{"id": ed.ID(), "fields": len(ed.Fields()), "schema_version": ed.SchemaVersion()}
+	db.logAdmin(context.Background(), AdminSchemaChange, "", ed.Name(), params, start, err)
+	return err
+}
+
+// saveEntityTypeDefn persists the given entity type definition in the
+// system catalogue.
+func (db *DB) saveEntityTypeDefn(ed *EntityTypeDefn) error {
+	if ed.ID() == 0 {
+		id, err := db.sdb.NextEntityTypeID()
+		if err != nil {
+			return err
+		}
+		if id > math.MaxUint16 {
+			return ErrIdentifierOverflow
+		}
+
+		ed.mutex.Lock()
+		ed.id = uint16(id)
+		ed.mutex.Unlock()
+	}
+
+	by, err := json.Marshal(ed)
+	if err != nil {
+		return err
+	}
+	return db.sdb.PutEntityTypeDefn(ed.Name(), by)
+}
+
+// EntityTypeDefns answers all the entity type definitions persisted
+// in the system catalogue, in the ascending order of their names.
+func (db *DB) EntityTypeDefns() ([]*EntityTypeDefn, error) {
+	m, err := db.sdb.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]*EntityTypeDefn, 0, len(m))
+	for _, name := range names {
+		ed := &EntityTypeDefn{}
+		err = json.Unmarshal(m[name], ed)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ed)
+	}
+
+	return res, nil
+}
+
+// defnsByName answers the entity type definitions persisted in the
+// system catalogue, by name.
+func (db *DB) defnsByName() (map[string]*EntityTypeDefn, error) {
+	eds, err := db.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*EntityTypeDefn, len(eds))
+	for _, ed := range eds {
+		res[ed.Name()] = ed
+	}
+	return res, nil
+}
+
+// catalogueType answers a handle to the given entity type in the given
+// namespace, using its definition among the given ones.  An entity
+// type not among them gets an empty definition; the references of its
+// instances are, hence, not indexed.
+func (db *DB) catalogueType(ns *Namespace, name string, defns map[string]*EntityTypeDefn) (*entityType, error) {
+	ed, ok := defns[name]
+	if !ok {
+		var err error
+		ed, err = NewEntityTypeDefn(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &entityType{db: db, ns: ns, defn: ed}, nil
+}
+
+// catalogueVersion is the format version of the catalogues written by
+// `DumpCatalogue`.
+const catalogueVersion = 1
+
+// catalogueJSON is the portable form of the system catalogue.
+type catalogueJSON struct {
+	Version     int               `json:"version"`
+	Sequence    uint64            `json:"sequence"`
+	Namespaces  []namespaceJSON   `json:"namespaces"`
+	EntityTypes []json.RawMessage `json:"entity_types"`
+}
+
+// namespaceJSON is the portable form of a namespace: its name, and the
+// names of the entity types having buckets in it.
+type namespaceJSON struct {
+	Name        string   `json:"name"`
+	EntityTypes []string `json:"entity_types"`
+}
+
+// DumpCatalogue writes the system catalogue to the given writer, as a
+// JSON document: the definitions of all the entity types, with their
+// IDs, the last ID assigned to an entity type, and all the namespaces,
+// with the names of their entity types.  Entities are not written;
+// use `Export` or `WriteSnapshot` for them.  The document can be read
+// back using `LoadCatalogue`, in this database or another one.
+func (db *DB) DumpCatalogue(w io.Writer) error {
+	c := catalogueJSON{
+		Version:     catalogueVersion,
+		Namespaces:  make([]namespaceJSON, 0),
+		EntityTypes: make([]json.RawMessage, 0),
+	}
+	err := db.view(context.Background(), func(tx *storage.Tx) error {
+		c.Sequence = tx.EntityTypeSequence()
+
+		m := tx.EntityTypeDefns()
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c.EntityTypes = append(c.EntityTypes, json.RawMessage(m[name]))
+		}
+
+		for _, ns := range tx.Namespaces() {
+			if ns[0] == '_' {
+				continue
+			}
+			ets := tx.EntityTypes(ns)
+			if ets == nil {
+				ets = make([]string, 0)
+			}
+			c.Namespaces = append(c.Namespaces, namespaceJSON{Name: ns, EntityTypes: ets})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(c)
+}
+
+// LoadCatalogue reads a catalogue written by `DumpCatalogue`, and
+// restores it in a single transaction: the definitions in it are
+// saved in the system catalogue, replacing those having the same
+// names, and the buckets of its namespaces and entity types are
+// created, if they do not exist already.  Definitions and buckets not
+// in the catalogue are retained.  The entity type ID sequence is
+// raised to that of the catalogue; hence, IDs assigned later do not
+// clash with those in it.
+//
+// Definitions are validated as by `EntityTypeDefn.UnmarshalJSON`.  It
+// answers `ErrSchemaConflict` if a definition has an ID other than
+// that of the saved definition having its name, or one that a saved
+// definition having another name has, and `ErrCatalogueVersion` if the
+// catalogue is of an unknown format version.  Saved definitions that
+// can not be read are replaced without being checked.
+//
+// Loading is recorded in the administrative event log.  See `AdminLog`.
+func (db *DB) LoadCatalogue(r io.Reader) error {
+	start := time.Now()
+	nn, ne, err := db.loadCatalogue(r)
+	params := map[string]interface{}{"namespaces": nn, "entity_types": ne}
+	db.logAdmin(context.Background(), AdminLoadCatalogue, "", "", params, start, err)
+	return err
+}
+
+// loadCatalogue implements `LoadCatalogue`.  It answers the numbers of
+// namespaces and entity type definitions loaded.
+func (db *DB) loadCatalogue(r io.Reader) (int, int, error) {
+	var c catalogueJSON
+	err := json.NewDecoder(r).Decode(&c)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c.Version != catalogueVersion {
+		return 0, 0, ErrCatalogueVersion
+	}
+
+	eds := make([]*EntityTypeDefn, len(c.EntityTypes))
+	for i, by := range c.EntityTypes {
+		ed := &EntityTypeDefn{}
+		err = json.Unmarshal(by, ed)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ed.ID() == 0 {
+			return 0, 0, ErrIdentifierZero
+		}
+		eds[i] = ed
+	}
+	for _, ns := range c.Namespaces {
+		if err := validName(ns.Name); err != nil {
+			return 0, 0, err
+		}
+		for _, et := range ns.EntityTypes {
+			if err := validName(et); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	err = db.update(context.Background(), func(tx *storage.Tx) error {
+		ids := make(map[string]uint16)
+		names := make(map[uint16]string)
+		for name, by := range tx.EntityTypeDefns() {
+			var v entityTypeDefnJSON
+			if json.Unmarshal(by, &v) != nil {
+				continue
+			}
+			ids[name] = v.ID
+			names[v.ID] = name
+		}
+
+		seq := c.Sequence
+		for _, ed := range eds {
+			id, ok := ids[ed.Name()]
+			if ok && id != ed.ID() {
+				return ErrSchemaConflict
+			}
+			name, ok := names[ed.ID()]
+			if ok && name != ed.Name() {
+				return ErrSchemaConflict
+			}
+			ids[ed.Name()] = ed.ID()
+			names[ed.ID()] = ed.Name()
+
+			by, err := json.Marshal(ed)
+			if err != nil {
+				return err
+			}
+			err = tx.PutEntityTypeDefn(ed.Name(), by)
+			if err != nil {
+				return err
+			}
+			if uint64(ed.ID()) > seq {
+				seq = uint64(ed.ID())
+			}
+		}
+		err := tx.RaiseEntityTypeSequence(seq)
+		if err != nil {
+			return err
+		}
+
+		for _, ns := range c.Namespaces {
+			err = tx.CreateNamespace(ns.Name)
+			if err != nil {
+				return err
+			}
+			for _, et := range ns.EntityTypes {
+				err = tx.CreateEntityType(ns.Name, et)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(c.Namespaces), len(eds), nil
+}
@@ -0,0 +1,140 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// ChangeOp identifies the kind of a change to an entity.
+type ChangeOp uint8
+
+// Kinds of changes.
+const (
+	ChangePut ChangeOp = iota + 1
+	ChangeDelete
+)
+
+// ChangeEvent describes a committed change to an entity.
+type ChangeEvent struct {
+	Op        ChangeOp
+	Namespace string // name of the namespace of the entity
+	Type      string // name of the entity type of the entity
+	ID        uint64 // ID of the entity
+
+	// Version is the version of the entity after the change.  Since
+	// events of different transactions may be delivered concurrently,
+	// versions can be used to order the events of an entity.
+	Version uint64
+
+	// Old is the entity before the change; `nil` if it did not exist.
+	// New is the entity after the change; `nil` if it was deleted.
+	// Their fields are as stored; their other metadata are those
+	// known at the time of the change.
+	Old, New *Document
+
+	// Soft is `true` for soft deletions and restorations.  See
+	// `SoftDeleter`.
+	Soft bool
+}
+
+// ChangeFn receives change events.  It is called in the goroutine
+// that made the change, after the change is committed; it should,
+// hence, return quickly, say, by handing the event over to a channel.
+// It may read and modify the database.  The documents in the event
+// are shared by all subscribers, and should not be modified.
+type ChangeFn func(ChangeEvent)
+
+// changeHub holds the subscriptions to changes made using any handle;
+// see `DB`.
+type changeHub struct {
+	mutex sync.RWMutex
+	next  uint64                         // ID of the next subscription
+	subs  map[string]map[uint64]ChangeFn // by namespace and entity type
+}
+
+var changes = &changeHub{subs: make(map[string]map[uint64]ChangeFn)}
+
+// changeKey answers the key of the subscriptions to the given entity
+// type in the given namespace.
+func changeKey(ns, et string) string {
+	return ns + "/" + et
+}
+
+// Subscribe registers the given function to receive the changes to
+// the instances of the given entity type in the given namespace, made
+// by any handle to the database.  Changes made by `Import` and
+// `ImportBatch` are not reported.  It answers a function that cancels
+// the subscription.
+//
+// Change events enable applications to maintain caches, search indexes
+// and live views without polling.  Events are delivered only to the
+// subscribers present when they occur; use `Watch` for reliable,
+// resumable delivery.
+func (db *DB) Subscribe(ns *Namespace, ed *EntityTypeDefn, fn ChangeFn) func() {
+	key := changeKey(ns.Name(), ed.Name())
+
+	changes.mutex.Lock()
+	defer changes.mutex.Unlock()
+
+	changes.next++
+	id := changes.next
+	if changes.subs[key] == nil {
+		changes.subs[key] = make(map[uint64]ChangeFn)
+	}
+	changes.subs[key][id] = fn
+
+	return func() {
+		changes.mutex.Lock()
+		defer changes.mutex.Unlock()
+
+		delete(changes.subs[key], id)
+		if len(changes.subs[key]) == 0 {
+			delete(changes.subs, key)
+		}
+	}
+}
+
+// watched answers `true` if the changes to this entity type have
+// subscribers.
+func (et *entityType) watched() bool {
+	changes.mutex.RLock()
+	defer changes.mutex.RUnlock()
+
+	return len(changes.subs[changeKey(et.ns.Name(), et.Name())]) > 0
+}
+
+// notify arranges for the given event to be delivered to the
+// subscribers of this entity type, after the given transaction
+// commits.  Subscriptions are looked up at delivery.
+func (et *entityType) notify(tx *storage.Tx, e ChangeEvent) {
+	e.Namespace, e.Type = et.ns.Name(), et.Name()
+	key := changeKey(e.Namespace, e.Type)
+
+	tx.OnCommit(func() {
+		changes.mutex.RLock()
+		fns := make([]ChangeFn, 0, len(changes.subs[key]))
+		for _, fn := range changes.subs[key] {
+			fns = append(fns, fn)
+		}
+		changes.mutex.RUnlock()
+
+		for _, fn := range fns {
+			fn(e)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// CheckOpts are the options of `Check`.
+type CheckOpts struct {
+	// Repair, if `true`, removes the entries of internal buckets that
+	// refer to missing entities.  Other problems are only reported.
+	Repair bool
+}
+
+// ProblemKind enumerates the kinds of problems found by `Check`.
+type ProblemKind uint8
+
+const (
+	// ProblemUndefinedType is an entity type having stored instances,
+	// but no definition in the system catalogue.
+	ProblemUndefinedType ProblemKind = iota + 1
+	// ProblemCorruptRecord is a stored instance that fails its
+	// checksum verification, or can not be decoded.
+	ProblemCorruptRecord
+	// ProblemOrphanEntry is an entry of an internal bucket - such as
+	// the label index or the reference index - that refers to a
+	// missing entity.
+	ProblemOrphanEntry
+	// ProblemDanglingReference is a reference to a missing entity.
+	ProblemDanglingReference
+)
+
+// String answers a description of this kind of problem.
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemUndefinedType:
+		return "undefined entity type"
+	case ProblemCorruptRecord:
+		return "corrupt record"
+	case ProblemOrphanEntry:
+		return "orphan entry"
+	case ProblemDanglingReference:
+		return "dangling reference"
+	default:
+		return fmt.Sprintf("problem(%d)", uint8(k))
+	}
+}
+
+// Problem describes a violation of an invariant of `flagon`, found by
+// `Check`.
+type Problem struct {
+	Kind      ProblemKind
+	Namespace string // namespace of the entity type
+	Type      string // entity type
+	ID        uint64 // entity, if any
+	Detail    string // the internal bucket, the error or the target
+	Repaired  bool   // `true` if the problem has been repaired
+}
+
+// CheckReport describes the outcome of `Check`.
+type CheckReport struct {
+	Namespaces uint64    // number of namespaces checked
+	Types      uint64    // number of entity types checked
+	Entities   uint64    // number of entities checked
+	Problems   []Problem // in the order found
+}
+
+// Check validates the invariants of `flagon` that BoltDB's own checks
+// do not cover, in every namespace: every entity type having stored
+// instances is defined in the system catalogue, every instance of a
+// defined type passes its checksum verification and decodes, every
+// entry of the internal buckets refers to an existing entity, and no
+// reference refers to a missing entity.
+//
+// With `opts.Repair`, the orphan entries of internal buckets are
+// removed, and the check runs in a read-write transaction.  Corrupt
+// records, undefined types and dangling references need decisions
+// that only applications can make, and are only reported.  Running a
+// check is recorded in the administrative event log.  See `AdminLog`.
+func (db *DB) Check(opts CheckOpts) (CheckReport, error) {
+	start := time.Now()
+	rep, err := db.check(opts)
+	params := map[string]interface{}{"repair": opts.Repair, "entities": rep.Entities, "problems": len(rep.Problems)}
+	db.logAdmin(context.Background(), AdminCheck, "", "", params, start, err)
+	return rep, err
+}
+
+// check implements `Check`.
+func (db *DB) check(opts CheckOpts) (CheckReport, error) {
+	defns, err := db.defnsByName()
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	var rep CheckReport
+	fn := func(tx *storage.Tx) error {
+		rep = CheckReport{}
+		now := db.now().UnixNano()
+		for _, ns := range tx.Namespaces() {
+			rep.Namespaces++
+			err := db.checkRecords(tx, ns, defns, &rep)
+			if err != nil {
+				return err
+			}
+			err = checkIndexes(tx, ns, opts.Repair, now, &rep)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if opts.Repair {
+		err = db.sdb.Update(fn)
+	} else {
+		err = db.sdb.View(fn)
+	}
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	return rep, nil
+}
+
+// checkRecords checks the stored instances of the entity types in the
+// given namespace, within the given transaction.  The reserved
+// namespace of the administrative event log is defined internally.
+func (db *DB) checkRecords(tx *storage.Tx, ns string, defns map[string]*EntityTypeDefn, rep *CheckReport) error {
+	for _, name := range tx.EntityTypes(ns) {
+		rep.Types++
+		ed, ok := defns[name]
+		if ns == adminNamespace && name == adminEventType {
+			_, ed = adminLog()
+			ok = true
+		}
+		if !ok {
+			rep.Problems = append(rep.Problems, Problem{Kind: ProblemUndefinedType, Namespace: ns, Type: name})
+		}
+
+		et := &entityType{db: db, ns: &Namespace{name: ns}, defn: ed}
+		err := tx.Scan(ns, name, func(k, v []byte, err error) (bool, error) {
+			rep.Entities++
+			var id uint64
+			if len(k) == 8 {
+				id = binary.BigEndian.Uint64(k)
+			}
+			if err == nil && ok {
+				err = et.decode(v, NewDocument(ed, id))
+			}
+			if err != nil {
+				rep.Problems = append(rep.Problems, Problem{Kind: ProblemCorruptRecord, Namespace: ns, Type: name, ID: id, Detail: err.Error()})
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkIndexes checks the entries of the internal buckets of the given
+// namespace, within the given transaction, removing the orphan ones if
+// so asked.
+func checkIndexes(tx *storage.Tx, ns string, repair bool, now int64, rep *CheckReport) error {
+	var orphans []storage.IndexEntry
+	err := tx.IndexEntries(ns, func(e storage.IndexEntry) (bool, error) {
+		if !tx.Exists(ns, e.Type, EntityKey{id: e.ID}.Key()) {
+			e.Key = append([]byte(nil), e.Key...)
+			orphans = append(orphans, e)
+			return true, nil
+		}
+		if e.Target != "" && !tx.Exists(ns, e.Target, EntityKey{id: e.TargetID}.Key()) {
+			p := Problem{Kind: ProblemDanglingReference, Namespace: ns, Type: e.Type, ID: e.ID}
+			p.Detail = fmt.Sprintf("%s#%d", e.Target, e.TargetID)
+			rep.Problems = append(rep.Problems, p)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range orphans {
+		p := Problem{Kind: ProblemOrphanEntry, Namespace: ns, Type: e.Type, ID: e.ID, Detail: e.Bucket}
+		if repair {
+			if e.Target != "" {
+				err = tx.RemoveRef(ns, e.Target, e.TargetID, e.Type, e.ID, e.Field, now)
+			} else {
+				err = tx.DeleteIndexEntry(ns, e)
+			}
+			if err != nil {
+				return err
+			}
+			p.Repaired = true
+		}
+		rep.Problems = append(rep.Problems, p)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock answers the current time.  A database handle reads the time
+// recorded with modifications - in histories, audit logs, batch logs
+// and the trash - and compared against expiry times, from its clock.
+// See `Options.Clock`.
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock is a clock that moves only when told to.  It makes tests
+// of time-dependent behaviour - such as expiry, purging and reads of
+// past versions - deterministic.
+type ManualClock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+// NewManualClock answers a manual clock showing the given time.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+// Now answers the time shown by this clock.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.t
+}
+
+// Set sets this clock to the given time.
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	c.t = t
+	c.mutex.Unlock()
+}
+
+// Advance moves this clock forward by the given duration.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.t = c.t.Add(d)
+	c.mutex.Unlock()
+}
+
+// now answers the current time, as shown by the clock of this handle.
+func (db *DB) now() time.Time {
+	if db.opts.Clock != nil {
+		return db.opts.Clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,49 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import "github.com/js-ojus/flagon/internal/storage"
+
+// CloneOpts are the options of `CloneStore`.
+type CloneOpts struct {
+	// Overwrite, if `true`, replaces the database at the destination,
+	// if any.  Otherwise, cloning into a storage directory that holds
+	// a database answers `ErrCloneExists`.
+	Overwrite bool
+}
+
+// CloneStore copies the database inside the base storage directory
+// `src` into the base storage directory `dst`, as given to `Open`,
+// creating the latter if necessary.  `opts` may be `nil`.  The clone
+// is an independent, writable database: a branch of the data, to be
+// experimented upon without affecting the source, and thrown away by
+// removing its directory.
+//
+// The clone is a consistent snapshot of the source; writes to the
+// source may continue meanwhile.  If `src` is the directory of the
+// open database, the snapshot is taken using it.  Since BoltDB can not
+// share pages between files, the clone is a full copy, even on file
+// systems that support copy-on-write.
+//
+// Since all of `flagon` uses a single database, a process opens either
+// the source or the clone.  Encrypted payloads remain encrypted in the
+// clone; opening it needs the same keys as the source.
+func CloneStore(src, dst string, opts *CloneOpts) error {
+	var o CloneOpts
+	if opts != nil {
+		o = *opts
+	}
+	return storage.Clone(src, dst, o.Overwrite)
+}
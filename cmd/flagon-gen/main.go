@@ -0,0 +1,64 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command flagon-gen generates typed Go code for the entity types
+// persisted in the catalogue of a `flagon` database.
+//
+// Usage:
+//
+//	flagon-gen -dir /path/to/storage -pkg model [-out model_gen.go]
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/gen"
+)
+
+func main() {
+	dir := flag.String("dir", "", "absolute path of the storage directory")
+	pkg := flag.String("pkg", "", "name of the package to generate")
+	out := flag.String("out", "", "output file; standard output if empty")
+	flag.Parse()
+
+	db, err := flagon.Open(*dir, nil)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	defer db.Close()
+
+	defns, err := db.EntityTypeDefns()
+	if err != nil {
+		log.Fatalf("error reading catalogue: %s", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("error creating output file: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	err = gen.Generate(w, *pkg, defns)
+	if err != nil {
+		log.Fatalf("error generating code: %s", err)
+	}
+}
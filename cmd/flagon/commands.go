@@ -0,0 +1,422 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/js-ojus/flagon"
+)
+
+// runInit creates the database, which opening it already did.
+func runInit(e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	fmt.Printf("initialised %s\n", e.dir)
+	return nil
+}
+
+// runSchema lists the entity type definitions in the catalogue, or
+// applies a schema file to a namespace.
+func runSchema(e *env, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		defns, err := e.db.EntityTypeDefns()
+		if err != nil {
+			return err
+		}
+		by, err := json.MarshalIndent(defns, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", by)
+		return nil
+
+	case len(args) == 3 && args[0] == "apply":
+		ns, err := flagon.NewNamespace(args[1])
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		s, err := flagon.ReadSchema(f)
+		if err != nil {
+			return err
+		}
+		rep, err := e.db.EnsureSchema(ns, s)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("saved %v; seed rows written %d, unchanged %d\n", rep.Saved, rep.Written, rep.Unchanged)
+		return nil
+
+	default:
+		return errUsage
+	}
+}
+
+// runGet prints the entity having the given ID.
+func runGet(e *env, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[2])
+	if err != nil {
+		return err
+	}
+
+	ent, err := e.db.EntityType(ns, ed).Get(id)
+	if err != nil {
+		return err
+	}
+	return printJSON(ent)
+}
+
+// runPut stores the entity read as JSON, printing its ID.  An entity
+// without an ID is created.  The type of the entity may be omitted.
+func runPut(e *env, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	r, err := input(args, 2)
+	if err != nil {
+		return err
+	}
+	by, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(by, &m)
+	if err != nil {
+		return err
+	}
+	if _, ok := m["type"]; !ok {
+		m["type"], _ = json.Marshal(ed.Name())
+		by, _ = json.Marshal(m)
+	}
+	d := flagon.NewDocument(ed, 0)
+	err = json.Unmarshal(by, d)
+	if err != nil {
+		return err
+	}
+
+	err = e.db.EntityType(ns, ed).Put(d)
+	if err != nil {
+		return err
+	}
+	fmt.Println(d.ID())
+	return nil
+}
+
+// runDelete deletes the entity having the given ID.
+func runDelete(e *env, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[2])
+	if err != nil {
+		return err
+	}
+	return e.db.EntityType(ns, ed).Delete(id)
+}
+
+// runSearch prints a page of the entities matching an expression over
+// their fields; all of them, if there is no expression.  The start of
+// the next page, if any, is printed to the standard error.
+func runSearch(e *env, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	where := fs.String("where", "", "expression that matching entities satisfy")
+	start := fs.Uint64("start", 0, "ID at which the search begins")
+	limit := fs.Uint64("limit", 100, "maximum number of entities; 0 for all")
+	if fs.Parse(args) != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	match := func(uint64, flagon.Entity) bool { return true }
+	var f *flagon.Filter
+	if *where != "" {
+		f, err = flagon.NewFilter(*where)
+		if err != nil {
+			return err
+		}
+		match = f.Match
+	}
+
+	et := e.db.EntityType(ns, ed).(flagon.Paginator)
+	pg, err := et.SearchPage(flagon.SearchOpts{StartAt: *start, Limit: *limit}, match)
+	if err == nil && f != nil {
+		err = f.Err()
+	}
+	if err != nil {
+		return err
+	}
+	for _, ent := range pg.Items {
+		err = printJSON(ent)
+		if err != nil {
+			return err
+		}
+	}
+	if pg.Next != 0 {
+		fmt.Fprintf(os.Stderr, "next: %d\n", pg.Next)
+	}
+	return nil
+}
+
+// runExport exports the entities of an entity type.
+func runExport(e *env, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	if _, _, err := e.entityType(args[0], args[1]); err != nil {
+		return err
+	}
+	w, err := output(args, 2)
+	if err != nil {
+		return err
+	}
+	n, err := e.db.ExportFrom(args[0], args[1], 0, w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d entities\n", n)
+	return nil
+}
+
+// runDump prints the entities of an entity type as JSON lines.
+func runDump(e *env, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	w, err := output(args, 2)
+	if err != nil {
+		return err
+	}
+	n, err := e.db.DumpJSON(args[0], args[1], w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d entities\n", n)
+	return nil
+}
+
+// runSQL prints a SQLite script that materialises the entities of a
+// type as a table, or refreshes the table since the given position in
+// the change log.  See `DB.WriteSQLiteScript`.
+func runSQL(e *env, args []string) error {
+	fs := flag.NewFlagSet("sql", flag.ContinueOnError)
+	since := fs.Uint64("since", 0, "change log position of the previous export")
+	if fs.Parse(args) != nil || fs.NArg() != 2 && fs.NArg() != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	w, err := output(fs.Args(), 2)
+	if err != nil {
+		return err
+	}
+	pos, err := e.db.WriteSQLiteScript(ns, ed, w, &flagon.SQLiteOpts{Since: *since})
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported as of change log position %d\n", pos)
+	return nil
+}
+
+// runSQLite writes the entities of a type as a table in a SQLite
+// database file, or refreshes the table there.  See `DB.ExportSQLite`.
+func runSQLite(e *env, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	pos, err := e.db.ExportSQLite(ns, ed, args[2], nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported as of change log position %d\n", pos)
+	return nil
+}
+
+// runParquet writes the entities of a type as a Parquet file.
+func runParquet(e *env, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	ns, ed, err := e.entityType(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	w, err := output(args, 2)
+	if err != nil {
+		return err
+	}
+	n, err := e.db.ExportParquet(ns, ed, w, nil)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d entities\n", n)
+	return nil
+}
+
+// runImport imports an export stream.
+func runImport(e *env, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	r, err := input(args, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := e.db.Import(r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d entities\n", n)
+	return nil
+}
+
+// runBackup copies the database into another storage directory.  The
+// copy is a consistent snapshot, even if another process is writing
+// to the database.
+func runBackup(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return flagon.CloneStore(e.dir, args[0], nil)
+}
+
+// runCompact compacts the database into another storage directory,
+// reporting its progress.
+func runCompact(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	opts := &flagon.CompactDBOpts{
+		Progress: func(p flagon.CompactProgress) {
+			fmt.Fprintf(os.Stderr, "\r%d/%d entries", p.Done, p.Total)
+		},
+	}
+	st, err := e.db.Compact(args[0], opts)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("compacted %d bytes into %d bytes in %s\n", st.BytesBefore, st.BytesAfter, st.Duration)
+	return nil
+}
+
+// runStats prints the space usage of the database, and the number of
+// entities of each entity type in the given namespace, if any.
+func runStats(e *env, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	ss, err := e.db.SpaceStats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "file bytes\t%d\n", ss.FileBytes)
+	fmt.Fprintf(w, "used bytes\t%d\n", ss.UsedBytes)
+	fmt.Fprintf(w, "free bytes\t%d\n", ss.FreeBytes)
+	fmt.Fprintf(w, "garbage ratio\t%.3f\n", ss.GarbageRatio())
+	if ss.DiskFree >= 0 {
+		fmt.Fprintf(w, "disk free\t%d\n", ss.DiskFree)
+	}
+	if len(args) == 0 {
+		return w.Flush()
+	}
+
+	ns, err := flagon.NewNamespace(args[0])
+	if err != nil {
+		return err
+	}
+	defns, err := e.db.EntityTypeDefns()
+	if err != nil {
+		return err
+	}
+	for _, ed := range defns {
+		et := e.db.EntityType(ns, ed).(flagon.Paginator)
+		all := func(uint64, flagon.Entity) bool { return true }
+		pg, err := et.SearchPage(flagon.SearchOpts{Limit: 1, Fields: []int{}}, all)
+		if err != nil {
+			return err
+		}
+		approx := ""
+		if !pg.Exact {
+			approx = "~"
+		}
+		fmt.Fprintf(w, "%s\t%s%d\n", ed.Name(), approx, pg.Total)
+	}
+	return w.Flush()
+}
+
+// printJSON prints the given entity as JSON, on a line of its own.
+func printJSON(ent flagon.Entity) error {
+	by, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", by)
+	return nil
+}
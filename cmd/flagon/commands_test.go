@@ -0,0 +1,192 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/js-ojus/flagon"
+)
+
+// capture runs the given command, with the given standard input, and
+// answers what it wrote to the standard output and error.
+func capture(t *testing.T, e *env, run func(*env, []string) error, stdin string, args ...string) (string, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	files := make([]*os.File, 3)
+	for i, name := range []string{"in", "out", "err"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[i] = f
+	}
+	files[0].WriteString(stdin)
+	files[0].Seek(0, 0)
+
+	in, out, errOut := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	err := run(e, args)
+	os.Stdin, os.Stdout, os.Stderr = in, out, errOut
+
+	ob, _ := ioutil.ReadFile(files[1].Name())
+	eb, _ := ioutil.ReadFile(files[2].Name())
+	return string(ob), string(eb), err
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	e := &env{dir: dir}
+	if err := e.open(false); err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+
+	run := func(fn func(*env, []string) error, stdin string, args ...string) string {
+		t.Helper()
+		out, _, err := capture(t, e, fn, stdin, args...)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out
+	}
+
+	if out := run(runInit, ""); !strings.Contains(out, dir) {
+		t.Errorf("init: %q", out)
+	}
+
+	// A schema file declares the entity type.
+	ed, err := flagon.NewEntityTypeDefn("cli_item")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed.AddField("name", flagon.FieldTypeString)
+	ed.AddField("qty", flagon.FieldTypeUint32)
+	by, err := json.Marshal(&flagon.Schema{EntityTypes: []*flagon.EntityTypeDefn{ed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(schema, by, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out := run(runSchema, "", "apply", "cli_ns", schema); !strings.Contains(out, "saved [cli_item]") {
+		t.Errorf("schema apply: %q", out)
+	}
+	if out := run(runSchema, "", "list"); !strings.Contains(out, `"cli_item"`) {
+		t.Errorf("schema list: %q", out)
+	}
+
+	// Entities are stored from files or the standard input, without
+	// their types.
+	doc := filepath.Join(t.TempDir(), "doc.json")
+	ioutil.WriteFile(doc, []byte(`{"fields": {"name": "bolt", "qty": 3}}`), 0600)
+	if out := run(runPut, "", "cli_ns", "cli_item", doc); out != "1\n" {
+		t.Errorf("put: %q", out)
+	}
+	if out := run(runPut, `{"fields": {"name": "nut", "qty": 7}}`, "cli_ns", "cli_item"); out != "2\n" {
+		t.Errorf("put: %q", out)
+	}
+	if out := run(runGet, "", "cli_ns", "cli_item", "1"); !strings.Contains(out, `"name":"bolt"`) {
+		t.Errorf("get: %q", out)
+	}
+
+	// Searches print a page, and the start of the next one.
+	if out := run(runSearch, "", "-where", "qty > 5 && name != 'bolt'", "cli_ns", "cli_item"); strings.Count(out, "\n") != 1 || !strings.Contains(out, `"nut"`) {
+		t.Errorf("search: %q", out)
+	}
+	out, errOut, err := capture(t, e, runSearch, "", "-limit", "1", "cli_ns", "cli_item")
+	if err != nil || strings.Count(out, "\n") != 1 || errOut != "next: 2\n" {
+		t.Errorf("search page: %q, %q, %v", out, errOut, err)
+	}
+	if _, _, err := capture(t, e, runSearch, "", "-where", "qty >", "cli_ns", "cli_item"); err == nil {
+		t.Error("search: invalid expression accepted")
+	}
+
+	// Exported entities are restored by importing them.
+	export := filepath.Join(t.TempDir(), "export")
+	run(runExport, "", "cli_ns", "cli_item", export)
+	run(runDelete, "", "cli_ns", "cli_item", "1")
+	if _, _, err := capture(t, e, runGet, "", "cli_ns", "cli_item", "1"); !errors.Is(err, flagon.ErrIdentifierUnknown) {
+		t.Errorf("get deleted: %v", err)
+	}
+	if out := run(runImport, "", export); out != "imported 2 entities\n" {
+		t.Errorf("import: %q", out)
+	}
+	run(runGet, "", "cli_ns", "cli_item", "1")
+
+	pq := filepath.Join(t.TempDir(), "items.parquet")
+	run(runParquet, "", "cli_ns", "cli_item", pq)
+	if by, _ := ioutil.ReadFile(pq); !strings.HasPrefix(string(by), "PAR1") || !strings.HasSuffix(string(by), "PAR1") {
+		t.Errorf("parquet: %q", by)
+	}
+
+	lite := filepath.Join(t.TempDir(), "items.db")
+	run(runSQLite, "", "cli_ns", "cli_item", lite)
+	if by, _ := ioutil.ReadFile(lite); !strings.HasPrefix(string(by), "SQLite format 3\x00") {
+		t.Errorf("sqlite: %q", by)
+	}
+
+	if out := run(runStats, "", "cli_ns"); !strings.Contains(out, "cli_item") || !strings.Contains(out, "file bytes") {
+		t.Errorf("stats: %q", out)
+	}
+
+	// Backups and compacted copies are databases of their own.
+	for _, fn := range []func(*env, []string) error{runBackup, runCompact} {
+		dst := t.TempDir()
+		run(fn, "", dst)
+		if ents, _ := ioutil.ReadDir(dst); len(ents) == 0 {
+			t.Errorf("%s: empty", dst)
+		}
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	tests := []struct {
+		run  func(*env, []string) error
+		args []string
+	}{
+		{runInit, []string{"x"}},
+		{runSchema, nil},
+		{runSchema, []string{"apply", "ns"}},
+		{runGet, []string{"ns", "type"}},
+		{runPut, []string{"ns"}},
+		{runDelete, nil},
+		{runSearch, []string{"-nope", "ns", "type"}},
+		{runExport, []string{"ns"}},
+		{runImport, []string{"a", "b"}},
+		{runBackup, nil},
+		{runCompact, nil},
+		{runStats, []string{"a", "b"}},
+	}
+	for i, tc := range tests {
+		if _, _, err := capture(t, &env{}, tc.run, "", tc.args...); err != errUsage {
+			t.Errorf("%d: %v: %v", i, tc.args, err)
+		}
+	}
+
+	for _, s := range []string{"0", "x", "-1"} {
+		if _, err := parseID(s); err == nil {
+			t.Errorf("%q: parsed", s)
+		}
+	}
+}
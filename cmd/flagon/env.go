@@ -0,0 +1,111 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/js-ojus/flagon"
+)
+
+// errUsage is answered by commands given unsuitable arguments.
+var errUsage = errors.New("invalid arguments")
+
+// env holds the database that commands operate upon.
+type env struct {
+	dir string
+	db  *flagon.DB
+}
+
+// open opens the database, for reading only if so asked.
+func (e *env) open(readOnly bool) error {
+	db, err := flagon.Open(e.dir, &flagon.Options{ReadOnly: readOnly})
+	if err != nil {
+		return err
+	}
+	e.db = db
+	return nil
+}
+
+// close closes the database, if open.
+func (e *env) close() error {
+	if e.db == nil {
+		return nil
+	}
+	err := e.db.Close()
+	e.db = nil
+	return err
+}
+
+// entityType answers the namespace having the given name, and the
+// definition of the entity type having the given name in the
+// catalogue.
+func (e *env) entityType(ns, name string) (*flagon.Namespace, *flagon.EntityTypeDefn, error) {
+	n, err := flagon.NewNamespace(ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	defns, err := e.db.EntityTypeDefns()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ed := range defns {
+		if ed.Name() == name {
+			return n, ed, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s: %q", flagon.ErrNameUnknown, name)
+}
+
+// parseID parses the given entity ID.
+func parseID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", s)
+	}
+	if id == 0 {
+		return 0, flagon.ErrIdentifierZero
+	}
+	return id, nil
+}
+
+// input answers the file having the given name, or the standard input
+// if there is no name.
+func input(args []string, i int) (io.ReadCloser, error) {
+	if len(args) <= i || args[i] == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(args[i])
+}
+
+// output answers the file having the given name, created afresh, or
+// the standard output if there is no name.
+func output(args []string, i int) (io.WriteCloser, error) {
+	if len(args) <= i || args[i] == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(args[i])
+}
+
+// nopCloser keeps the standard output open when closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
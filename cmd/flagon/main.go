@@ -0,0 +1,139 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command flagon administers a `flagon` database.
+//
+// Usage:
+//
+//	flagon -dir /path/to/storage <command> [arguments]
+//
+// Commands:
+//
+//	init                                  create the database, if necessary
+//	schema list                           print the entity type definitions
+//	schema apply <ns> <file>              apply a schema file; see `EnsureSchema`
+//	get <ns> <type> <id>                  print an entity as JSON
+//	put <ns> <type> [file]                store an entity read as JSON
+//	delete <ns> <type> <id>               delete an entity
+//	search [flags] <ns> <type>            print the matching entities as JSON
+//	export <ns> <type> [file]             export the entities of a type
+//	import [file]                         import an export stream
+//	dump <ns> <type> [file]               print the entities of a type as JSON lines
+//	sql [-since n] <ns> <type> [file]     print a SQLite script materialising a type
+//	sqlite <ns> <type> <file>             write a type to a SQLite database file
+//	parquet <ns> <type> [file]            write the entities of a type as Parquet
+//	backup <dir>                          copy the database into a directory
+//	compact <dir>                         compact the database into a directory
+//	stats [ns]                            print space usage, and entity counts
+//	serve [-changelog] <network> <address> serve the entities over HTTP
+//	follow <network> <address>            replicate the database served there
+//
+// Entities are read and written in the form answered by
+// `Document.MarshalJSON`.  Files default to the standard input or
+// output.  Commands that only read open the database for reading only.
+//
+// Since BoltDB locks the database file, other processes can not open a
+// database while it is in use.  `serve` runs a daemon that serves the
+// entities - as package `flagonhttp` does - on a Unix socket (network
+// `unix`) or a TCP address (network `tcp`), until interrupted; tools
+// and sidecars can then access live data using `flagonhttp.Client`.
+// With `-changelog`, changes are recorded for followers: `follow`
+// replicates a served database into the database of `-dir`, until
+// interrupted.  See `flagonhttp.Follower`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// command is a subcommand of `flagon`.
+type command struct {
+	usage    string                     // arguments, for the usage message
+	readOnly bool                       // open the database for reading only?
+	noOpen   bool                       // do not open the database at all?
+	run      func(*env, []string) error // implementation
+}
+
+// commands are the subcommands of `flagon`, by name.
+var commands = map[string]command{
+	"init":    {usage: "", run: runInit},
+	"schema":  {usage: "list | apply <ns> <file>", run: runSchema},
+	"get":     {usage: "<ns> <type> <id>", readOnly: true, run: runGet},
+	"put":     {usage: "<ns> <type> [file]", run: runPut},
+	"delete":  {usage: "<ns> <type> <id>", run: runDelete},
+	"search":  {usage: "[-where expr] [-start id] [-limit n] <ns> <type>", readOnly: true, run: runSearch},
+	"export":  {usage: "<ns> <type> [file]", readOnly: true, run: runExport},
+	"import":  {usage: "[file]", run: runImport},
+	"dump":    {usage: "<ns> <type> [file]", readOnly: true, run: runDump},
+	"sql":     {usage: "[-since n] <ns> <type> [file]", readOnly: true, run: runSQL},
+	"sqlite":  {usage: "<ns> <type> <file>", readOnly: true, run: runSQLite},
+	"parquet": {usage: "<ns> <type> [file]", readOnly: true, run: runParquet},
+	"backup":  {usage: "<dir>", noOpen: true, run: runBackup},
+	"compact": {usage: "<dir>", run: runCompact},
+	"stats":   {usage: "[ns]", readOnly: true, run: runStats},
+	"serve":   {usage: "[-changelog] unix <socket> | tcp <address>", noOpen: true, run: runServe},
+	"follow":  {usage: "unix <socket> | tcp <address>", run: runFollow},
+}
+
+// commandNames lists the subcommands in the order of the usage
+// message.
+var commandNames = []string{"init", "schema", "get", "put", "delete", "search", "export", "import", "dump", "sql", "sqlite", "parquet", "backup", "compact", "stats", "serve", "follow"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: flagon -dir /path/to/storage <command> [arguments]\n\ncommands:\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("flagon: ")
+
+	dir := flag.String("dir", "", "absolute path of the storage directory")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 || *dir == "" {
+		usage()
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		log.Printf("unknown command %q", name)
+		usage()
+	}
+
+	e := &env{dir: *dir}
+	if !cmd.noOpen {
+		err := e.open(cmd.readOnly)
+		if err != nil {
+			log.Fatalf("error opening database: %s", err)
+		}
+	}
+	err := cmd.run(e, args)
+	if cerr := e.close(); err == nil {
+		err = cerr
+	}
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: flagon -dir /path/to/storage %s %s\n", name, cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+}
@@ -0,0 +1,108 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/flagonhttp"
+)
+
+// runServe serves the entities of the database on the given network
+// address, until interrupted.  A stale Unix socket is removed first.
+func runServe(e *env, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	changeLog := fs.Bool("changelog", false, "record changes for followers")
+	if fs.Parse(args) != nil || fs.NArg() != 2 || fs.Arg(0) != "unix" && fs.Arg(0) != "tcp" {
+		return errUsage
+	}
+	network, addr := fs.Arg(0), fs.Arg(1)
+	db, err := flagon.Open(e.dir, &flagon.Options{ChangeLog: *changeLog})
+	if err != nil {
+		return err
+	}
+	e.db = db
+
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		defer os.Remove(addr)
+	}
+
+	srv := &http.Server{Handler: flagonhttp.NewHandler(e.db)}
+	go func() {
+		<-interrupted()
+		srv.Close()
+	}()
+
+	log.Printf("serving %s on %s %s", e.dir, network, addr)
+	err = srv.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// runFollow replicates the database served on the given network
+// address into the database, until interrupted.
+func runFollow(e *env, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	c, err := flagonhttp.NewClient(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-interrupted()
+		cancel()
+	}()
+	f := &flagonhttp.Follower{
+		DB:      e.db,
+		Leader:  c,
+		OnApply: func(cur uint64) { log.Printf("applied changes up to %d", cur) },
+		OnError: func(err error) { log.Printf("replication failed: %s", err) },
+	}
+	err = f.Run(ctx)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// interrupted answers a channel that receives interrupts and
+// termination requests.
+func interrupted() <-chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
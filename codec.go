@@ -0,0 +1,228 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// CodecID enumerates the codecs that can be used to serialise
+// entities.
+//
+// Every serialised entity begins with the ID of the codec used to
+// serialise it.  Hence, the codec of an entity type can be changed at
+// any time without having to migrate existing data.  Codec IDs are
+// less than `0x80`; larger values tag envelopes wrapping serialised
+// entities.
+type CodecID uint8
+
+const (
+	codecUnknown CodecID = iota
+
+	// CodecBinary is `flagon`'s compact binary format: a sequence of
+	// (field ID, field data) pairs, where field data is as written by
+	// the field's `WriteTo`.  Decoding requires the entity type
+	// definition.
+	CodecBinary
+
+	// CodecMsgpack serialises an entity as a MessagePack map from
+	// field IDs to field values.  It is self-describing, and can be
+	// read by non-Go programs.  Time values use the MessagePack
+	// timestamp extension.
+	CodecMsgpack
+
+	// CodecFramed is like `CodecBinary`, but each field is framed by
+	// its ID, type and length, so that unknown fields can be skipped
+	// and selected fields decoded.  It is the default codec of new
+	// entity types.
+	CodecFramed
+
+	// CodecCompact is like `CodecFramed`, but uses varints for
+	// integers and lengths, reducing the size of entities holding
+	// small numbers.
+	CodecCompact
+)
+
+// Compressed envelope:
+//
+//	tag (= 0xc1) | Snappy-compressed serialised entity
+//
+// See `EntityTypeDefn.SetCompressAbove`.
+const (
+	envelopeCompressed = 0xc1
+)
+
+// codec specifies the methods that entity codecs should implement.
+type codec interface {
+	// size answers the length of the fields of the given document,
+	// once encoded.
+	size(d *Document) int
+	// encode appends the fields of the given document to the given
+	// slice.
+	encode(by []byte, d *Document) ([]byte, error)
+	// decode reads the fields of the given document.
+	decode(r *fieldReader, d *Document) error
+}
+
+// partialDecoder is implemented by codecs that can decode selected
+// fields, skipping the others.
+type partialDecoder interface {
+	// decodeOnly reads those fields of the given document, whose IDs
+	// are in the given set; all fields if the set is `nil`.
+	decodeOnly(r *fieldReader, d *Document, ids map[uint8]bool) error
+}
+
+// codecs holds the recognised codecs.
+var codecs = map[CodecID]codec{
+	CodecBinary:  binaryCodec{},
+	CodecMsgpack: msgpackCodec{},
+	CodecFramed:  framedCodec{},
+	CodecCompact: compactCodec{},
+}
+
+// MarshalBinary conforms to `encoding.BinaryMarshaler`.  It answers
+// the stored form of this document, serialised using the codec of
+// its entity type, and compressed if so configured.  It is serialised
+// into a single allocation, sized in advance.
+func (d *Document) MarshalBinary() ([]byte, error) {
+	id := d.defn.Codec()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, ErrCodecUnknown
+	}
+
+	by := make([]byte, 1, 1+c.size(d))
+	by[0] = byte(id)
+	by, err := c.encode(by, d)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range encodeStages {
+		by, err = stage(d, by)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return by, nil
+}
+
+// UnmarshalBinary conforms to `encoding.BinaryUnmarshaler`.  The
+// document should have been created using `NewDocument`, so that its
+// entity type definition is available.  All fields of the document
+// are replaced by those read.
+func (d *Document) UnmarshalBinary(by []byte) error {
+	return d.unmarshalFields(by, nil, false)
+}
+
+// unmarshalFields is like `UnmarshalBinary`, but retains only the
+// fields having the given IDs, if any are given.  Codecs that support
+// it skip decoding the other fields altogether.  Strings refer to the
+// given data, rather than to copies of it, if so requested; see
+// `SearchNoCopy`.
+func (d *Document) unmarshalFields(by []byte, ids []int, noCopy bool) error {
+	if d.defn == nil {
+		return ErrNameUnknown
+	}
+	if len(by) == 0 {
+		return ErrPayloadInvalid
+	}
+	if by[0] == envelopeCompressed {
+		var err error
+		by, err = snappy.Decode(nil, by[1:])
+		if err != nil || len(by) == 0 {
+			return ErrPayloadInvalid
+		}
+	}
+	c, ok := codecs[CodecID(by[0])]
+	if !ok {
+		return ErrCodecUnknown
+	}
+
+	for id := range d.fields {
+		delete(d.fields, id)
+	}
+	r := newFieldReader(by[1:], noCopy)
+	if ids == nil {
+		return c.decode(r, d)
+	}
+	if pd, ok := c.(partialDecoder); ok {
+		set := make(map[uint8]bool, len(ids))
+		for _, id := range ids {
+			set[uint8(id)] = true
+		}
+		return pd.decodeOnly(r, d, set)
+	}
+
+	err := c.decode(r, d)
+	if err != nil {
+		return err
+	}
+	d.retain(ids)
+	return nil
+}
+
+// binaryCodec implements `CodecBinary`.
+type binaryCodec struct{}
+
+func (binaryCodec) size(d *Document) int {
+	n := 0
+	for _, f := range d.fields {
+		if f.IsSet() {
+			n += 1 + fieldSize(f)
+		}
+	}
+	return n
+}
+
+func (binaryCodec) encode(by []byte, d *Document) ([]byte, error) {
+	var err error
+	for _, f := range d.setFields() {
+		by = append(by, f.ID())
+		by, err = appendField(by, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+func (binaryCodec) decode(r *fieldReader, d *Document) error {
+	for {
+		id, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+
+		fd, ok := d.defn.fieldByID(id)
+		if !ok {
+			// Without the definition, the length of the field's data
+			// is not known.
+			return ErrPayloadInvalid
+		}
+		f, err := newField(fd)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadFrom(r)
+		if err != nil {
+			return err
+		}
+		d.fields[id] = f
+	}
+}
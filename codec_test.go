@@ -0,0 +1,217 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codecDefn answers an entity type having a field of every type, and
+// enough of them for MessagePack to use its larger map form, together
+// with the values of a document of it.
+func codecDefn(t *testing.T, name string) (*EntityTypeDefn, map[string]interface{}) {
+	t.Helper()
+	vals := map[string]interface{}{
+		"flag":    true,
+		"tiny":    int8(math.MinInt8),
+		"small":   int16(-2),
+		"medium":  int32(math.MaxInt32),
+		"large":   int64(math.MinInt64),
+		"utiny":   uint8(math.MaxUint8),
+		"usmall":  uint16(7),
+		"umedium": uint32(math.MaxUint32),
+		"ularge":  uint64(math.MaxUint64),
+		"single":  float32(-1.5),
+		"double":  math.Inf(-1),
+		"count":   uint32(3),
+		"total":   int64(1 << 40),
+		"ratio":   float32(0.25),
+		"score":   math.MaxFloat64,
+		"delta":   int16(math.MinInt16),
+		"instant": time.Date(1969, 7, 20, 20, 17, 40, 123456789, time.UTC),
+		"short":   "flagon",
+		"medtext": strings.Repeat("m", 200),
+		"longtxt": strings.Repeat("l", 40000),
+		"empty":   "",
+	}
+	types := map[string]FieldType{
+		"flag": FieldTypeBool, "tiny": FieldTypeInt8, "small": FieldTypeInt16,
+		"medium": FieldTypeInt32, "large": FieldTypeInt64, "utiny": FieldTypeUint8,
+		"usmall": FieldTypeUint16, "umedium": FieldTypeUint32, "ularge": FieldTypeUint64,
+		"single": FieldTypeFloat32, "double": FieldTypeFloat64, "count": FieldTypeUint32,
+		"total": FieldTypeInt64, "ratio": FieldTypeFloat32, "score": FieldTypeFloat64,
+		"delta": FieldTypeInt16, "instant": FieldTypeTime,
+		"short": FieldTypeString, "medtext": FieldTypeString, "longtxt": FieldTypeString,
+		"empty": FieldTypeString,
+	}
+
+	ed, err := NewEntityTypeDefn(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"flag", "tiny", "small", "medium", "large", "utiny", "usmall", "umedium", "ularge", "single", "double", "count", "total", "ratio", "score", "delta", "instant", "short", "medtext", "longtxt", "empty"} {
+		if err := ed.AddField(n, types[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ed, vals
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	ed, vals := codecDefn(t, "codec_all")
+	for _, id := range []CodecID{CodecBinary, CodecMsgpack, CodecFramed, CodecCompact} {
+		if err := ed.SetCodec(id); err != nil {
+			t.Fatal(err)
+		}
+		d := NewDocument(ed, 1)
+		for name, v := range vals {
+			f, _ := d.Field(name)
+			if err := setFieldValue(f, v); err != nil {
+				t.Fatalf("codec %d, %s: %v", id, name, err)
+			}
+		}
+		by, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatalf("codec %d: %v", id, err)
+		}
+		if CodecID(by[0]) != id {
+			t.Errorf("codec %d: tag %d", id, by[0])
+		}
+
+		// Serialised entities are read whatever the current codec.
+		ed.SetCodec(CodecBinary)
+		d2 := NewDocument(ed, 1)
+		if err := d2.UnmarshalBinary(by); err != nil {
+			t.Fatalf("codec %d: %v", id, err)
+		}
+		for name, v := range vals {
+			f, _ := d2.Field(name)
+			if got := fieldValue(f); !sameValue(got, v) {
+				t.Errorf("codec %d, %s: %v, want %v", id, name, got, v)
+			}
+		}
+	}
+}
+
+func TestCodecMsgpackForm(t *testing.T) {
+	ed, err := NewEntityTypeDefn("codec_mp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed.AddField("small", FieldTypeInt16)
+	ed.AddField("short", FieldTypeString)
+	ed.AddField("instant", FieldTypeTime)
+	ed.SetCodec(CodecMsgpack)
+
+	d := NewDocument(ed, 1)
+	for name, v := range map[string]interface{}{"small": int16(-2), "short": "ab", "instant": time.Unix(1, 2)} {
+		f, _ := d.Field(name)
+		setFieldValue(f, v)
+	}
+	by, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		byte(CodecMsgpack),
+		0x83,                   // map of three
+		0x01, 0xd1, 0xff, 0xfe, // 1: int16 -2
+		0x02, 0xa2, 'a', 'b', // 2: "ab"
+		0x03, 0xc7, 12, 0xff, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1, // 3: timestamp 96
+	}
+	if !bytes.Equal(by, want) {
+		t.Fatalf("serialised as % x, want % x", by, want)
+	}
+
+	// Other programs may use the smallest forms of values, and
+	// timestamp 32 and 64.
+	other := []byte{
+		byte(CodecMsgpack),
+		0x83,
+		0x01, 0xfe, // negative fixint -2
+		0x02, 0xd9, 2, 'a', 'b', // str 8
+		0x03, 0xd7, 0xff, 0, 0, 0, 0x08, 0, 0, 0, 1, // timestamp 64: 2ns, 1s
+	}
+	d2 := NewDocument(ed, 1)
+	if err := d2.UnmarshalBinary(other); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]interface{}{"small": int16(-2), "short": "ab", "instant": time.Unix(1, 2)} {
+		f, _ := d2.Field(name)
+		if got := fieldValue(f); !sameValue(got, v) {
+			t.Errorf("%s: %v, want %v", name, got, v)
+		}
+	}
+}
+
+func TestCodecInvalid(t *testing.T) {
+	ed, _ := codecDefn(t, "codec_bad")
+	d := NewDocument(ed, 1)
+	tests := []struct {
+		name string
+		by   []byte
+		err  error
+	}{
+		{"empty", nil, ErrPayloadInvalid},
+		{"unknown codec", []byte{0x7f}, ErrCodecUnknown},
+		{"msgpack not a map", []byte{byte(CodecMsgpack), 0x01}, ErrPayloadInvalid},
+		{"msgpack truncated", []byte{byte(CodecMsgpack), 0x81, 0x01, 0xd3, 0x00}, ErrPayloadInvalid},
+	}
+	for _, tc := range tests {
+		if err := d.UnmarshalBinary(tc.by); err != tc.err {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestCodecNull(t *testing.T) {
+	ed, vals := codecDefn(t, "codec_null")
+	for _, id := range []CodecID{CodecBinary, CodecMsgpack, CodecFramed, CodecCompact} {
+		ed.SetCodec(id)
+		d := NewDocument(ed, 1)
+		for _, name := range []string{"flag", "large", "ularge", "double", "instant", "empty"} {
+			f, _ := d.Field(name)
+			if err := setFieldValue(f, reflect.Zero(reflect.TypeOf(vals[name])).Interface()); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		f, _ := d.Field("short")
+		f.(*FieldString).Set("set")
+		f.Clear()
+		by, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatalf("codec %d: %v", id, err)
+		}
+
+		// Zero values survive serialisation, while null fields remain
+		// null.
+		d2 := NewDocument(ed, 1)
+		if err := d2.UnmarshalBinary(by); err != nil {
+			t.Fatalf("codec %d: %v", id, err)
+		}
+		for _, fd := range ed.Fields() {
+			f, _ := d.Field(fd.Name)
+			f2, _ := d2.Field(fd.Name)
+			if f2.IsSet() != f.IsSet() || !sameValue(fieldValue(f2), fieldValue(f)) {
+				t.Errorf("codec %d, %s: read %v, want %v", id, fd.Name, fieldValue(f2), fieldValue(f))
+			}
+		}
+	}
+}
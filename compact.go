@@ -0,0 +1,224 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Entity payload format used by `CodecCompact`.  It follows the
+// framing of `CodecFramed`, but represents integers as varints.
+//
+//	payload : version uint8 | field count uvarint | field...
+//	field   : field ID uint8 | field type uint8 | length uvarint | data
+//
+// Data of signed integer fields are zigzag-encoded varints, and those
+// of unsigned integer and reference fields are unsigned varints.
+// Strings are a uvarint length followed by their bytes.  Other fields
+// are as written by their `WriteTo`.
+//
+// The version identifies the variant of the format, so that it can
+// evolve without a new codec.
+const compactVersion = 1
+
+// compactCodec implements `CodecCompact`.
+type compactCodec struct{}
+
+func (compactCodec) size(d *Document) int {
+	n, cnt := 1, 0
+	for _, f := range d.fields {
+		if f.IsSet() {
+			l := compactSize(f)
+			n += 2 + uvarintLen(uint64(l)) + l
+			cnt++
+		}
+	}
+	return n + uvarintLen(uint64(cnt))
+}
+
+func (compactCodec) encode(by []byte, d *Document) ([]byte, error) {
+	fs := d.setFields()
+	by = append(by, compactVersion)
+	by = binary.AppendUvarint(by, uint64(len(fs)))
+
+	for _, f := range fs {
+		fd, ok := d.defn.fieldByID(f.ID())
+		if !ok {
+			return nil, ErrPayloadInvalid
+		}
+
+		by = append(by, f.ID(), uint8(fd.Ftype))
+		by = binary.AppendUvarint(by, uint64(compactSize(f)))
+		var err error
+		by, err = compactAppend(by, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+func (c compactCodec) decode(r *fieldReader, d *Document) error {
+	return c.decodeOnly(r, d, nil)
+}
+
+// decodeOnly conforms to `partialDecoder`.
+func (compactCodec) decodeOnly(r *fieldReader, d *Document, ids map[uint8]bool) error {
+	v, err := r.ReadByte()
+	if err != nil || v != compactVersion {
+		return ErrPayloadInvalid
+	}
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil || cnt > 255 {
+		return ErrPayloadInvalid
+	}
+
+	hdr := make([]byte, 2)
+	for i := uint64(0); i < cnt; i++ {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			return ErrPayloadInvalid
+		}
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return ErrPayloadInvalid
+		}
+		id, ft := hdr[0], FieldType(hdr[1])
+
+		fd, ok := d.defn.fieldByID(id)
+		if !ok || fd.Ftype != ft || (ids != nil && !ids[id]) {
+			r.Seek(int64(l), io.SeekCurrent)
+			continue
+		}
+
+		f, err := newField(fd)
+		if err != nil {
+			return err
+		}
+		data, _ := r.next(int(l))
+		err = compactRead(data, f, r.noCopy)
+		if err != nil {
+			return err
+		}
+		d.fields[id] = f
+	}
+
+	if r.Len() != 0 {
+		return ErrPayloadInvalid
+	}
+	return nil
+}
+
+// compactSize answers the length of the data of the given field.
+func compactSize(f Field) int {
+	switch f := f.(type) {
+	case *FieldInt8:
+		return varintLen(int64(f.Get()))
+	case *FieldInt16:
+		return varintLen(int64(f.Get()))
+	case *FieldInt32:
+		return varintLen(int64(f.Get()))
+	case *FieldInt64:
+		return varintLen(f.Get())
+	case *FieldUint8:
+		return uvarintLen(uint64(f.Get()))
+	case *FieldUint16:
+		return uvarintLen(uint64(f.Get()))
+	case *FieldUint32:
+		return uvarintLen(uint64(f.Get()))
+	case *FieldUint64:
+		return uvarintLen(f.Get())
+	case *FieldReference:
+		return uvarintLen(f.Get())
+	case *FieldString:
+		return uvarintLen(uint64(len(f.Get()))) + len(f.Get())
+	default:
+		return fieldSize(f)
+	}
+}
+
+// compactAppend appends the data of the given field to the given
+// slice.
+func compactAppend(by []byte, f Field) ([]byte, error) {
+	switch f := f.(type) {
+	case *FieldInt8:
+		return binary.AppendVarint(by, int64(f.Get())), nil
+	case *FieldInt16:
+		return binary.AppendVarint(by, int64(f.Get())), nil
+	case *FieldInt32:
+		return binary.AppendVarint(by, int64(f.Get())), nil
+	case *FieldInt64:
+		return binary.AppendVarint(by, f.Get()), nil
+	case *FieldUint8:
+		return binary.AppendUvarint(by, uint64(f.Get())), nil
+	case *FieldUint16:
+		return binary.AppendUvarint(by, uint64(f.Get())), nil
+	case *FieldUint32:
+		return binary.AppendUvarint(by, uint64(f.Get())), nil
+	case *FieldUint64:
+		return binary.AppendUvarint(by, f.Get()), nil
+	case *FieldReference:
+		return binary.AppendUvarint(by, f.Get()), nil
+	case *FieldString:
+		if len(f.Get()) > 65535 {
+			return nil, ErrStringTooLong
+		}
+		by = binary.AppendUvarint(by, uint64(len(f.Get())))
+		return append(by, f.Get()...), nil
+	default:
+		return appendField(by, f)
+	}
+}
+
+// compactRead reads the given data, which should be consumed
+// entirely, into the given field.  Strings refer to the data, rather
+// than to copies of it, if so requested.
+func compactRead(data []byte, f Field, noCopy bool) error {
+	r := newFieldReader(data, noCopy)
+	var err error
+	switch f.(type) {
+	case *FieldInt8, *FieldInt16, *FieldInt32, *FieldInt64:
+		var n int64
+		n, err = binary.ReadVarint(r)
+		if err == nil {
+			err = setFieldValue(f, n)
+		}
+	case *FieldUint8, *FieldUint16, *FieldUint32, *FieldUint64, *FieldReference:
+		var n uint64
+		n, err = binary.ReadUvarint(r)
+		if err == nil {
+			err = setFieldValue(f, n)
+		}
+	case *FieldString:
+		var l uint64
+		l, err = binary.ReadUvarint(r)
+		if err == nil && l != uint64(r.Len()) {
+			return ErrPayloadInvalid
+		}
+		if err == nil {
+			err = setFieldValue(f, r.string(data[len(data)-int(l):]))
+			r.Seek(0, io.SeekEnd)
+		}
+	default:
+		_, err = f.ReadFrom(r)
+	}
+
+	if err != nil || r.Len() != 0 {
+		return ErrPayloadInvalid
+	}
+	return nil
+}
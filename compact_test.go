@@ -0,0 +1,114 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestCompactForm(t *testing.T) {
+	ed := wireDefn(t, "compact_form", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeString}, {"total", FieldTypeUint64}}, CodecCompact)
+	d := testDoc(t, ed, 1, map[string]interface{}{"count": int16(-2), "label": "hi", "total": uint64(300)})
+	want := []byte{
+		byte(CodecCompact), compactVersion, 3,
+		1, byte(FieldTypeInt16), 1, 0x03,
+		2, byte(FieldTypeString), 3, 2, 'h', 'i',
+		3, byte(FieldTypeUint64), 2, 0xac, 0x02,
+	}
+	if by := marshal(t, d); !bytes.Equal(by, want) {
+		t.Errorf("compact form % x, want % x", by, want)
+	}
+}
+
+func TestCompactVarints(t *testing.T) {
+	ed := wireDefn(t, "compact_int", []testField{{"signed", FieldTypeInt64}, {"unsigned", FieldTypeUint64}}, CodecCompact)
+	tests := []struct {
+		signed   int64
+		unsigned uint64
+		size     int // of the data of both fields
+	}{
+		{0, 0, 2},
+		{-64, 127, 2},
+		{64, 128, 4},
+		{math.MinInt64, math.MaxUint64, 20},
+		{math.MaxInt64, 1 << 35, 16},
+	}
+	for _, tc := range tests {
+		d := testDoc(t, ed, 1, map[string]interface{}{"signed": tc.signed, "unsigned": tc.unsigned})
+		by := marshal(t, d)
+		if len(by) != 3+2*3+tc.size {
+			t.Errorf("%d, %d: length %d", tc.signed, tc.unsigned, len(by))
+		}
+
+		d2 := NewDocument(ed, 1)
+		if err := d2.UnmarshalBinary(by); err != nil {
+			t.Fatalf("%d, %d: %v", tc.signed, tc.unsigned, err)
+		}
+		s, _ := heldValue(t, d2, "signed")
+		u, _ := heldValue(t, d2, "unsigned")
+		if s != tc.signed || u != tc.unsigned {
+			t.Errorf("read %v, %v; want %d, %d", s, u, tc.signed, tc.unsigned)
+		}
+	}
+}
+
+func TestCompactSkip(t *testing.T) {
+	newer := wireDefn(t, "compact_skip", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeString}, {"extra", FieldTypeUint64}}, CodecCompact)
+	older := wireDefn(t, "compact_skip", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeInt32}}, CodecCompact)
+	by := marshal(t, testDoc(t, newer, 1, map[string]interface{}{"count": int16(7), "label": "new", "extra": uint64(1 << 40)}))
+
+	d := NewDocument(older, 1)
+	if err := d.UnmarshalBinary(by); err != nil {
+		t.Fatal(err)
+	}
+	if fs := d.Fields(); len(fs) != 1 || fieldValue(fs[0]) != int16(7) {
+		t.Errorf("read %v", fs)
+	}
+
+	d = NewDocument(newer, 1)
+	if err := d.unmarshalFields(by, []int{2}, false); err != nil {
+		t.Fatal(err)
+	}
+	if fs := d.Fields(); len(fs) != 1 || fieldValue(fs[0]) != "new" {
+		t.Errorf("partial decode: %v", fs)
+	}
+}
+
+func TestCompactInvalid(t *testing.T) {
+	ed := wireDefn(t, "compact_bad", []testField{{"count", FieldTypeInt8}, {"label", FieldTypeString}}, CodecCompact)
+	good := marshal(t, testDoc(t, ed, 1, map[string]interface{}{"count": int8(1)}))
+	tests := []struct {
+		name string
+		by   []byte
+	}{
+		{"no version", good[:1]},
+		{"unknown version", []byte{byte(CodecCompact), compactVersion + 1, 0}},
+		{"too many fields", []byte{byte(CodecCompact), compactVersion, 0x80, 0x02}},
+		{"fields missing", []byte{byte(CodecCompact), compactVersion, 2, 1, byte(FieldTypeInt8), 1, 0x02}},
+		{"length too long", []byte{byte(CodecCompact), compactVersion, 1, 1, byte(FieldTypeInt8), 2, 0x02}},
+		{"out of range", []byte{byte(CodecCompact), compactVersion, 1, 1, byte(FieldTypeInt8), 2, 0x80, 0x02}},
+		{"unterminated varint", []byte{byte(CodecCompact), compactVersion, 1, 1, byte(FieldTypeInt8), 1, 0x80}},
+		{"string length", []byte{byte(CodecCompact), compactVersion, 1, 2, byte(FieldTypeString), 3, 3, 'h', 'i'}},
+		{"trailing bytes", append(append([]byte(nil), good...), 0)},
+	}
+	d := NewDocument(ed, 1)
+	for _, tc := range tests {
+		if err := d.UnmarshalBinary(tc.by); err != ErrPayloadInvalid {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+)
+
+// CompactDBOpts are the options of `Compact`.
+type CompactDBOpts struct {
+	// Overwrite, if `true`, replaces the database at the destination,
+	// if any.  Otherwise, compacting into a storage directory that
+	// holds a database answers `ErrCloneExists`.
+	Overwrite bool
+
+	// Progress, if not `nil`, is called periodically with the
+	// progress of the compaction.  Its counts are of the entries
+	// copied - keys and nested buckets - rather than of entities.
+	Progress func(CompactProgress)
+}
+
+// CompactDBStats describes a compaction of the database.
+type CompactDBStats struct {
+	Entries     uint64        // number of entries copied
+	BytesBefore int64         // size of the database file
+	BytesAfter  int64         // size of the compacted copy
+	Duration    time.Duration // time taken
+}
+
+// Compact copies the entire database into a fresh database file inside
+// the base storage directory `dst`, as given to `Open`, creating the
+// latter if necessary.  `opts` may be `nil`.
+//
+// Deleting entities never shrinks the database file: the pages they
+// occupied are only reused by later writes.  The compacted copy is
+// written key by key, with densely packed pages and no free pages.
+// See `SpaceStats` for deciding when to compact.
+//
+// The copy is a consistent snapshot of the database, taken in a read
+// transaction; writes continue meanwhile, but are not part of the
+// copy.  Hence, to reclaim the space of a live database, stop writing,
+// compact, close the database, and open the copy in its place.  Use
+// `CompactEntityType` to pack the entities of an entity type in place
+// instead.
+//
+// Compactions are recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) Compact(dst string, opts *CompactDBOpts) (CompactDBStats, error) {
+	var o CompactDBOpts
+	if opts != nil {
+		o = *opts
+	}
+
+	start := time.Now()
+	var st CompactDBStats
+	progress := func(done, total uint64) {
+		st.Entries = done
+		if o.Progress != nil {
+			o.Progress(CompactProgress{Done: done, Total: total})
+		}
+	}
+	var err error
+	st.BytesBefore, st.BytesAfter, err = db.sdb.Compact(dst, o.Overwrite, progress)
+	if err != nil {
+		st = CompactDBStats{}
+	}
+	st.Duration = time.Since(start)
+
+	params := map[string]interface{}{
+		"destination":  dst,
+		"entries":      st.Entries,
+		"bytes_before": st.BytesBefore,
+		"bytes_after":  st.BytesAfter,
+	}
+	db.logAdmin(context.Background(), AdminCompact, "", "", params, start, err)
+	return st, err
+}
@@ -0,0 +1,212 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of entities between progress reports of a compaction.
+const compactProgressEvery = 1024
+
+// CompactOpts are the options of `CompactEntityType`.
+type CompactOpts struct {
+	// Reencode, if `true`, serialises every entity afresh, using the
+	// current codec, compression threshold and encryption key of its
+	// entity type.  Use this after changing any of them.
+	Reencode bool
+
+	// Progress, if not `nil`, is called periodically with the
+	// progress of the compaction.
+	Progress func(CompactProgress)
+}
+
+// CompactProgress reports the progress of a compaction.
+type CompactProgress struct {
+	Done  uint64 // number of entities processed
+	Total uint64 // number of entities to process
+}
+
+// BucketSpace describes the space used by the entities of an entity
+// type.
+type BucketSpace struct {
+	Pages      int   // number of database pages
+	InuseBytes int64 // bytes in use in the pages
+	AllocBytes int64 // bytes allocated to the pages
+}
+
+// CompactStats describes a compaction.
+type CompactStats struct {
+	Entities    uint64        // number of entities rewritten
+	Reencoded   uint64        // number of entities serialised afresh
+	RefsAdded   uint64        // references added to the index
+	RefsRemoved uint64        // stale references removed from the index
+	Before      BucketSpace   // space used before the compaction
+	After       BucketSpace   // space used after the compaction
+	Duration    time.Duration // time taken
+}
+
+// refKey identifies a reference in the index of references.
+type refKey struct {
+	target string
+	tid    uint64
+	sid    uint64
+	fid    uint8
+}
+
+// CompactEntityType rewrites the entities of the given entity type in
+// the given namespace, packing them densely.  This reclaims the space
+// left sparse by mass deletions, without compacting the entire
+// database: the space is freed for reuse by later writes, though the
+// database file does not shrink.  Entity versions are not changed.
+//
+// The index of references made by the entity type is rebuilt from the
+// entities, removing stale references and adding missing ones - for
+// instance, those of imported entities.
+//
+// The compaction runs in a single transaction, and holds all the
+// entities of the entity type in memory; writes to the database wait
+// until it completes.  Cancelling the given context abandons the
+// compaction, leaving the entities as they were.
+//
+// Compactions are recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) CompactEntityType(ctx context.Context, ns *Namespace, ed *EntityTypeDefn, opts CompactOpts) (CompactStats, error) {
+	start := time.Now()
+	st, err := db.compactEntityType(ctx, ns, ed, opts, start)
+	params := map[string]interface{}{
+		"reencode":     opts.Reencode,
+		"entities":     st.Entities,
+		"reencoded":    st.Reencoded,
+		"refs_added":   st.RefsAdded,
+		"refs_removed": st.RefsRemoved,
+		"bytes_before": st.Before.AllocBytes,
+		"bytes_after":  st.After.AllocBytes,
+	}
+	db.logAdmin(ctx, AdminCompact, ns.Name(), ed.Name(), params, start, err)
+	return st, err
+}
+
+// compactEntityType rewrites the entities of the given entity type in
+// the given namespace, as described by `CompactEntityType`.
+func (db *DB) compactEntityType(ctx context.Context, ns *Namespace, ed *EntityTypeDefn, opts CompactOpts, start time.Time) (CompactStats, error) {
+	et := &entityType{db: db, ns: ns, defn: ed}
+	var st CompactStats
+
+	err := db.sdb.Update(func(tx *storage.Tx) error {
+		bu, err := tx.BucketUsage(ns.Name(), ed.Name())
+		if err != nil {
+			return err
+		}
+		st.Before = bucketSpace(bu)
+		total := uint64(bu.Keys)
+
+		refs := ed.hasReferences()
+		old := make(map[refKey]bool)
+		err = tx.RefsFrom(ns.Name(), ed.Name(), func(target string, tid, sid uint64, fid uint8) (bool, error) {
+			old[refKey{target, tid, sid, fid}] = true
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		cur := make(map[refKey]bool)
+
+		err = tx.Rewrite(ns.Name(), ed.Name(), func(k, v []byte) ([]byte, error) {
+			if st.Entities%compactProgressEvery == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				if opts.Progress != nil {
+					opts.Progress(CompactProgress{Done: st.Entities, Total: total})
+				}
+			}
+			st.Entities++
+			if !refs && !opts.Reencode {
+				return nil, nil
+			}
+
+			id := binary.BigEndian.Uint64(k)
+			d := NewDocument(ed, id)
+			err := et.decode(v, d)
+			if err != nil {
+				return nil, err
+			}
+			for fid, r := range references(d) {
+				cur[refKey{r.target, r.id, id, fid}] = true
+			}
+			if !opts.Reencode {
+				return nil, nil
+			}
+
+			st.Reencoded++
+			return et.encode(d)
+		})
+		if err != nil {
+			return err
+		}
+
+		now := db.now().UnixNano()
+		for r := range old {
+			if cur[r] {
+				continue
+			}
+			err = tx.RemoveRef(ns.Name(), r.target, r.tid, ed.Name(), r.sid, r.fid, now)
+			if err != nil {
+				return err
+			}
+			st.RefsRemoved++
+		}
+		for r := range cur {
+			if old[r] {
+				continue
+			}
+			err = tx.AddRef(ns.Name(), r.target, r.tid, ed.Name(), r.sid, r.fid, now)
+			if err != nil {
+				return err
+			}
+			st.RefsAdded++
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(CompactProgress{Done: st.Entities, Total: total})
+		}
+		return nil
+	})
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	err = db.sdb.View(func(tx *storage.Tx) error {
+		bu, err := tx.BucketUsage(ns.Name(), ed.Name())
+		st.After = bucketSpace(bu)
+		return err
+	})
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	st.Duration = time.Since(start)
+	return st, nil
+}
+
+// bucketSpace answers the given bucket usage as a `BucketSpace`.
+func bucketSpace(bu storage.BucketUsage) BucketSpace {
+	return BucketSpace{Pages: bu.Pages, InuseBytes: bu.InuseBytes, AllocBytes: bu.AllocBytes}
+}
@@ -0,0 +1,98 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ComputeFn computes the value of a derived field of the given
+// document, from its other fields.  It answers the value in the Go
+// type of the field - or any Go numeric type, for numeric fields - or
+// `nil` to make the field null.  It must not modify the document.
+type ComputeFn func(*Document) (interface{}, error)
+
+// SetComputed makes the field having the given name a derived one,
+// whose value is computed by the given function whenever a document
+// is stored by `Put`, `Update` and their variants, after the
+// `BeforePut` hooks are called, and before the document is validated.
+// The computed value is stored; it can, therefore, be indexed,
+// searched and validated like any other.  Values set by applications
+// are overwritten.  Derived fields are computed in the ascending order
+// of their IDs; later ones may use the values of earlier ones.  A
+// `nil` function makes the field an ordinary one.
+//
+// Like migrations, compute functions are not saved in the system
+// catalogue; applications should set them each time they load the
+// definition.  Documents stored earlier are not recomputed until they
+// are stored again.
+func (ed *EntityTypeDefn) SetComputed(name string, fn ComputeFn) error {
+	fd, err := ed.Field(name)
+	if err != nil {
+		return err
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	if fn == nil {
+		delete(ed.computed, fd.ID)
+		return nil
+	}
+	if ed.computed == nil {
+		ed.computed = make(map[uint8]ComputeFn)
+	}
+	ed.computed[fd.ID] = fn
+	return nil
+}
+
+// compute sets the derived fields of the given document.  An error
+// answered by a compute function is answered, annotated with the name
+// of its field.
+func (ed *EntityTypeDefn) compute(d *Document) error {
+	ed.mutex.RLock()
+	if len(ed.computed) == 0 {
+		ed.mutex.RUnlock()
+		return nil
+	}
+	ids := make([]uint8, 0, len(ed.computed))
+	fns := make(map[uint8]ComputeFn, len(ed.computed))
+	for id, fn := range ed.computed {
+		ids = append(ids, id)
+		fns[id] = fn
+	}
+	ed.mutex.RUnlock()
+	sort.Sort(uint8s(ids))
+
+	for _, id := range ids {
+		fd, ok := ed.fieldByID(id)
+		if !ok {
+			continue
+		}
+		v, err := fns[id](d)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fd.Name, err)
+		}
+		f, err := d.Field(fd.Name)
+		if err != nil {
+			return err
+		}
+		err = setFieldValue(f, v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fd.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"errors"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// AtomicWriter is implemented by entity types that can store and
+// delete their entities conditionally, each in a single transaction,
+// without the caller having to retry or to manage transactions.
+type AtomicWriter interface {
+	// PutIfAbsent stores the given entity only if no entity having
+	// its ID exists, and answers if it did.
+	PutIfAbsent(Entity) (bool, error)
+
+	// Update reads the entity having the given ID, passes it to the
+	// given function for modification, and stores the result, only if
+	// no other writer has modified the entity meanwhile; otherwise, it
+	// retries.
+	Update(uint64, func(Entity) error) error
+
+	// CompareAndDelete deletes the entity having the given ID, only if
+	// its stored version is the given one.
+	CompareAndDelete(uint64, uint64) error
+
+	// DeleteIfExists deletes the entity having the given ID, if it
+	// exists, and answers if it did.
+	DeleteIfExists(uint64) (bool, error)
+}
+
+// PutIfAbsent stores the given document, as `Put` does, only if no
+// document having its ID exists.  It answers `true` if it stored the
+// document, and `false` if another one was present.  Soft-deleted
+// documents count as present.  A document having a zero ID is always
+// stored, under a new ID.
+func (et *entityType) PutIfAbsent(e Entity) (bool, error) {
+	var none uint64
+	err := et.put(e, putOpts{expected: &none})
+	if errors.Is(err, ErrVersionConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Update reads the document having the given ID, calls the given
+// function with it, and stores it as modified by the function, as
+// `Put` does, but only if its stored version is still the one read.
+// Otherwise, another writer has intervened; the document is read
+// again, and the function called again with it, until the update
+// succeeds or the context is done.  The function may hence be called
+// more than once, and should only modify the document.  If the
+// function answers an error, nothing is stored, and that error is
+// answered, wrapped in an `*EntityError`.  Soft-deleted and expired
+// documents are not updated; `ErrIdentifierUnknown` is answered for
+// them.
+//
+// Unlike `Put`, the expiry time of the document is retained.  Its
+// provenance is removed.  The function and the `BeforePut` hooks are
+// called outside the transaction that stores the document, as they
+// are by `Put`; they may use the database.
+func (et *entityType) Update(id uint64, fn func(Entity) error) error {
+	return et.update(context.Background(), id, fn)
+}
+
+// update implements `Update` and `UpdateContext`, in a span.  The
+// outbox messages carried by the given context, if any, are written in
+// the transaction of the update.
+func (et *entityType) update(ctx context.Context, id uint64, fn func(Entity) error) error {
+	if id == 0 {
+		return ErrIdentifierZero
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, sp := et.startSpan(ctx, spanPut)
+	sp.SetAttribute(attrID, id)
+	var d *Document
+	var err error
+	for {
+		var raced bool
+		d, raced, err = et.updateDoc(ctx, id, fn)
+		if err != nil || !raced {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+	}
+	endSpan(sp, err)
+	if err != nil {
+		return et.entityError(opUpdate, id, err)
+	}
+
+	et.runHooks(ctx, AfterPut, id, d)
+	return nil
+}
+
+// updateDoc makes one attempt of `update`: it reads the document
+// having the given ID, calls the given function with it, and prepares
+// it for storing, all outside of transactions.  It then stores the
+// document, only if it is stored as read.  It answers `true` if it
+// was not, and nothing was stored.
+func (et *entityType) updateDoc(ctx context.Context, id uint64, fn func(Entity) error) (*Document, bool, error) {
+	var d *Document
+	err := et.db.view(ctx, func(tx *storage.Tx) error {
+		var err error
+		d, err = et.get(tx, id)
+		return err
+	})
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			err = ErrIdentifierUnknown
+		}
+		return nil, false, err
+	}
+	now := et.db.now().UnixNano()
+	if d.deleted != 0 || d.expired(now) {
+		return nil, false, ErrIdentifierUnknown
+	}
+	version, expires := d.version, d.expires
+
+	err = fn(d)
+	if err != nil {
+		return nil, false, err
+	}
+	if d.ID() != id {
+		return nil, false, ErrIdentifierUnknown
+	}
+	by, err := et.prepare(ctx, d)
+	if err != nil {
+		return nil, false, err
+	}
+
+	raced := false
+	err = et.db.update(ctx, func(tx *storage.Tx) error {
+		// Soft deletion, and changes to the expiry time, do not change
+		// the version.
+		cur, err := et.revision(tx, id)
+		if err != nil {
+			return err
+		}
+		trashed, _ := tx.Trashed(et.ns.Name(), et.Name(), id)
+		exp, _ := tx.Expiry(et.ns.Name(), et.Name(), id)
+		if cur != version || trashed != 0 || exp != expires {
+			raced = true
+			return nil
+		}
+		err = et.checkImmutable(tx, id, d)
+		if err != nil {
+			return err
+		}
+
+		d.schema = et.defn.SchemaVersion()
+		d.version, err = et.store(tx, id, by, d, now, ActorFrom(ctx))
+		if err != nil {
+			return err
+		}
+		err = et.outbox(ctx, tx, ChangePut, id, d.version, now)
+		if err != nil {
+			return err
+		}
+		d.prov = nil
+		return tx.ClearProvenance(et.ns.Name(), et.Name(), id)
+	})
+	return d, raced, err
+}
+
+// CompareAndDelete deletes the document having the given ID, as
+// `Delete` does, only if its stored version is the given one.
+// Otherwise, it answers `ErrVersionConflict`.  The check and the
+// deletion occur in a single transaction.
+func (et *entityType) CompareAndDelete(id, expected uint64) error {
+	if id == 0 {
+		return ErrIdentifierZero
+	}
+
+	ctx, sp := et.startSpan(context.Background(), spanDelete)
+	sp.SetAttribute(attrID, id)
+	err := et.deleteDoc(ctx, id, &expected)
+	endSpan(sp, err)
+	return et.entityError(opDelete, id, err)
+}
+
+// DeleteIfExists is like `Delete`, but does not treat the absence of
+// the document having the given ID as an error.  It answers `true` if
+// it deleted the document, and `false` if none existed.
+func (et *entityType) DeleteIfExists(id uint64) (bool, error) {
+	err := et.Delete(id)
+	if errors.Is(err, ErrIdentifierUnknown) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,88 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+)
+
+// addQty adds the given amount to the field `qty` of the given entity.
+func addQty(e Entity, n int64) error {
+	f, err := e.(*Document).Field("qty")
+	if err != nil {
+		return err
+	}
+	return setFieldValue(f, fieldValue(f).(int64)+n)
+}
+
+func TestUpdate(t *testing.T) {
+	ns := testNamespace(t, "update_ns")
+	ed := testDefn(t, "update_item", []testField{{"qty", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed)
+	aw := et.(AtomicWriter)
+	if err := et.Put(testDoc(t, ed, 1, map[string]interface{}{"qty": int64(1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hooks may write to the database.  The first one races the
+	// update, which is hence retried.
+	raced := false
+	remove, err := testDB.RegisterHook(ed, BeforePut, func(ev HookEvent) error {
+		if ev.ID != 1 || raced {
+			return nil
+		}
+		raced = true
+		e, err := et.Get(1)
+		if err == nil {
+			err = addQty(e, 100)
+		}
+		if err == nil {
+			err = et.Put(e)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+
+	calls := 0
+	err = aw.Update(1, func(e Entity) error {
+		calls++
+		return addQty(e, 10)
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("update: %d calls, %v", calls, err)
+	}
+	e, err := et.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := e.(*Document).Field("qty"); fieldValue(f) != int64(111) {
+		t.Errorf("updated: %v", fieldValue(f))
+	}
+
+	errStop := errors.New("stop")
+	if err := aw.Update(1, func(Entity) error { return errStop }); !errors.Is(err, errStop) {
+		t.Errorf("function error: %v", err)
+	}
+	if err := et.(SoftDeleter).DeleteSoft(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Update(1, func(e Entity) error { return addQty(e, 1) }); !errors.Is(err, ErrIdentifierUnknown) {
+		t.Errorf("soft-deleted: %v", err)
+	}
+}
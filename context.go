@@ -0,0 +1,116 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+)
+
+// ContextEntityType is implemented by entity types whose operations
+// accept a context.  Operations answer the error of the context if it
+// is done before they begin; searches also stop when it is done during
+// them.  The context is passed to hooks (see `HookEvent`), and the
+// actor carried by it (see `WithActor`) is recorded in the audit log,
+// when auditing is enabled (see `Options.Audit`); the outbox messages
+// carried by it (see `WithOutbox`) are written to the outbox by
+// modifications, in their transactions.  When the database has a
+// policy, the principal carried by it should have the right to read or
+// to write, as needed; see `Options.Policy`.
+type ContextEntityType interface {
+	// GetContext is like `Get`, with the given context.
+	GetContext(context.Context, uint64) (Entity, error)
+	// PutContext is like `Put`, with the given context.
+	PutContext(context.Context, Entity) error
+	// PutIfVersionContext is like `PutIfVersion`, with the given
+	// context.
+	PutIfVersionContext(context.Context, Entity, uint64) error
+	// DeleteContext is like `Delete`, with the given context.
+	DeleteContext(context.Context, uint64) error
+	// UpdateContext is like `Update`, with the given context.
+	UpdateContext(context.Context, uint64, func(Entity) error) error
+	// PatchContext is like `Patch`, with the given context.
+	PatchContext(context.Context, uint64, map[string]interface{}) error
+	// IncrementContext is like `Increment`, with the given context.
+	IncrementContext(context.Context, uint64, string, int64) (int64, error)
+	// SearchContext is like `Search`, with the given context.
+	SearchContext(context.Context, SearchOpts, SearchFn) ([]uint64, error)
+}
+
+// GetContext is like `Get`, but answers the error of the given
+// context, if it is done.
+func (et *entityType) GetContext(ctx context.Context, id uint64) (Entity, error) {
+	if err := et.authorize(ctx, RightRead); err != nil {
+		return nil, err
+	}
+	return et.getContext(ctx, id)
+}
+
+// PutContext is like `Put`, but with the given context.
+func (et *entityType) PutContext(ctx context.Context, e Entity) error {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return err
+	}
+	return et.put(e, putOpts{ctx: ctx})
+}
+
+// PutIfVersionContext is like `PutIfVersion`, but with the given
+// context.
+func (et *entityType) PutIfVersionContext(ctx context.Context, e Entity, expected uint64) error {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return err
+	}
+	return et.put(e, putOpts{expected: &expected, ctx: ctx})
+}
+
+// DeleteContext is like `Delete`, but with the given context.
+func (et *entityType) DeleteContext(ctx context.Context, id uint64) error {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return err
+	}
+	return et.delete(ctx, id)
+}
+
+// UpdateContext is like `Update`, but with the given context.
+func (et *entityType) UpdateContext(ctx context.Context, id uint64, fn func(Entity) error) error {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return err
+	}
+	return et.update(ctx, id, fn)
+}
+
+// PatchContext is like `Patch`, but with the given context.
+func (et *entityType) PatchContext(ctx context.Context, id uint64, vals map[string]interface{}) error {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return err
+	}
+	return et.patch(ctx, id, vals)
+}
+
+// IncrementContext is like `Increment`, but with the given context.
+func (et *entityType) IncrementContext(ctx context.Context, id uint64, name string, delta int64) (int64, error) {
+	if err := et.authorize(ctx, RightWrite); err != nil {
+		return 0, err
+	}
+	return et.increment(ctx, id, name, delta)
+}
+
+// SearchContext is like `Search`, but stops when the given context is
+// done, answering its error.
+func (et *entityType) SearchContext(ctx context.Context, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	if err := et.authorize(ctx, RightRead); err != nil {
+		return nil, err
+	}
+	return et.search(ctx, opts, fn)
+}
@@ -0,0 +1,412 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Stored entity payloads may be wrapped in envelopes.  An envelope
+// begins with a tag that does not collide with any codec ID.
+//
+// Encrypted envelope:
+//
+//	tag (= 0xe1) | key ID uint32 | nonce | AES-GCM sealed payload
+//
+// The sealed payload is authenticated together with the name of its
+// entity type.
+const (
+	envelopeEncrypted = 0xe1
+)
+
+// KeyProvider supplies the keys used to encrypt entity payloads.
+//
+// Keys are scoped to namespaces: every namespace can have its own
+// keys, identified by IDs that are unique within the namespace.
+// Destroying all the keys of a namespace renders all its data
+// unreadable -- a practice known as crypto-shredding -- without
+// having to locate and erase the data itself.  Use `ShredReport` to
+// verify that the keys of a namespace are not shared with others
+// before destroying them.
+//
+// Keys should be 16, 24 or 32 bytes long, selecting AES-128, AES-192
+// or AES-256 respectively.
+type KeyProvider interface {
+	// CurrentKey answers the ID and the value of the key to be used
+	// to encrypt new payloads in the given namespace.  A `nil` key
+	// disables encryption of new payloads in the namespace.
+	CurrentKey(ns string) (uint32, []byte, error)
+
+	// Key answers the value of the key having the given ID in the
+	// given namespace.  It should answer an error if the key has been
+	// destroyed.
+	Key(ns string, id uint32) ([]byte, error)
+}
+
+// seal encrypts the given payload of an instance of the given entity
+// type in the given namespace, using the current key of the
+// namespace.  The payload is answered as is if no key is configured.
+func (db *DB) seal(ns, et string, by []byte) ([]byte, error) {
+	kp := db.opts.KeyProvider
+	if kp == nil {
+		return by, nil
+	}
+	id, key, err := kp.CurrentKey(ns)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return by, nil
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 5, 5+aead.NonceSize()+len(by)+aead.Overhead())
+	hdr[0] = envelopeEncrypted
+	binary.BigEndian.PutUint32(hdr[1:], id)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr = append(hdr, nonce...)
+	return aead.Seal(hdr, nonce, by, []byte(et)), nil
+}
+
+// open decrypts the given stored payload of an instance of the given
+// entity type in the given namespace, if it is encrypted.
+func (db *DB) open(ns, et string, by []byte) ([]byte, error) {
+	if len(by) == 0 || by[0] != envelopeEncrypted {
+		return by, nil
+	}
+	if len(by) < 5 {
+		return nil, ErrPayloadInvalid
+	}
+
+	kp := db.opts.KeyProvider
+	if kp == nil {
+		return nil, ErrKeyUnavailable
+	}
+	key, err := kp.Key(ns, binary.BigEndian.Uint32(by[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyUnavailable
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	by = by[5:]
+	if len(by) < aead.NonceSize() {
+		return nil, ErrPayloadInvalid
+	}
+	res, err := aead.Open(nil, by[:aead.NonceSize()], by[aead.NonceSize():], []byte(et))
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+
+	return res, nil
+}
+
+// newAEAD answers an AES-GCM cipher using the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// staticKeys is a `KeyProvider` that answers the same keys for every
+// namespace.
+type staticKeys struct {
+	id   uint32            // ID of the current key
+	keys map[uint32][]byte // all keys, including the current one
+}
+
+// newStaticKeys answers a key provider having the given current key
+// and retired keys.  All keys are validated.
+func newStaticKeys(id uint32, key []byte, old map[uint32][]byte) (*staticKeys, error) {
+	sk := &staticKeys{id: id, keys: make(map[uint32][]byte, len(old)+1)}
+	for oid, k := range old {
+		sk.keys[oid] = k
+	}
+	sk.keys[id] = key
+
+	for _, k := range sk.keys {
+		_, err := newAEAD(k)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sk, nil
+}
+
+// CurrentKey conforms to `KeyProvider`.
+func (sk *staticKeys) CurrentKey(string) (uint32, []byte, error) {
+	return sk.id, sk.keys[sk.id], nil
+}
+
+// Key conforms to `KeyProvider`.
+func (sk *staticKeys) Key(_ string, id uint32) ([]byte, error) {
+	k, ok := sk.keys[id]
+	if !ok {
+		return nil, ErrKeyUnavailable
+	}
+	return k, nil
+}
+
+// Number of records re-encrypted per transaction by `Rekey`.
+const rekeyChunk = 1024
+
+// Rekey re-encrypts every stored entity payload that is not encrypted
+// using the current key of its namespace.  Payloads are decrypted if
+// the namespace no longer has a current key.  This completes a key
+// rotation, after which the retired keys can be destroyed.
+//
+// Payloads are re-encrypted in chunks, each in its own transaction.
+// An interrupted `Rekey` can simply be run again.  It answers the
+// number of payloads re-encrypted.
+func (db *DB) Rekey() (uint64, error) {
+	kp := db.opts.KeyProvider
+	if kp == nil {
+		return 0, ErrKeyUnavailable
+	}
+
+	var nss []string
+	ets := make(map[string][]string)
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		nss = tx.Namespaces()
+		for _, ns := range nss {
+			ets[ns] = tx.EntityTypes(ns)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for _, ns := range nss {
+		cur, key, err := kp.CurrentKey(ns)
+		if err != nil {
+			return n, err
+		}
+		stale := func(v []byte) bool {
+			enc := len(v) >= 5 && v[0] == envelopeEncrypted
+			if key == nil {
+				return enc
+			}
+			return !enc || binary.BigEndian.Uint32(v[1:5]) != cur
+		}
+
+		for _, et := range ets[ns] {
+			var start []byte
+			for {
+				next, cnt, err := db.rekeyChunk(ns, et, start, stale)
+				n += cnt
+				if err != nil {
+					return n, err
+				}
+				if next == nil {
+					break
+				}
+				start = next
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// rekeyChunk re-encrypts up to `rekeyChunk` stale payloads of the
+// given entity type in the given namespace, beginning at the given
+// key.  It answers the key at which to resume, if any, and the number
+// of payloads re-encrypted.
+func (db *DB) rekeyChunk(ns, et string, start []byte, stale func([]byte) bool) ([]byte, uint64, error) {
+	var next []byte
+	var n uint64
+
+	err := db.sdb.Update(func(tx *storage.Tx) error {
+		var keys, vals [][]byte
+		err := tx.ForEach(ns, et, start, func(k, v []byte) (bool, error) {
+			if len(keys) == rekeyChunk {
+				next = append([]byte(nil), k...)
+				return false, nil
+			}
+			if !stale(v) {
+				return true, nil
+			}
+
+			by, err := db.open(ns, et, v)
+			if err != nil {
+				return false, err
+			}
+			by, err = db.seal(ns, et, by)
+			if err != nil {
+				return false, err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			vals = append(vals, by)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range keys {
+			err = tx.Put(ns, et, keys[i], vals[i])
+			if err != nil {
+				return err
+			}
+		}
+		n = uint64(len(keys))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return next, n, nil
+}
+
+// ShredReport describes the encryption of the data of a namespace,
+// so that the consequences of destroying its keys can be verified.
+type ShredReport struct {
+	Namespace string   // the namespace examined
+	KeyIDs    []uint32 // IDs of the keys encrypting its entities
+	Encrypted uint64   // number of its entities that are encrypted
+	Plain     uint64   // number of its entities that are NOT encrypted
+
+	// SharedWith lists the other namespaces having entities encrypted
+	// using any of the keys of this namespace.  Keys are compared by
+	// value, not by ID.  Destroying the keys of this namespace is safe
+	// only when this is empty.
+	SharedWith []string
+
+	// Unresolved lists the namespaces some of whose keys could not be
+	// obtained from the key provider, and hence could not be compared.
+	Unresolved []string
+}
+
+// Safe answers `true` if destroying the keys of the namespace renders
+// all of its data - and only its data - unreadable.
+func (r ShredReport) Safe() bool {
+	return r.Plain == 0 && len(r.SharedWith) == 0 && len(r.Unresolved) == 0
+}
+
+// ShredReport examines every stored entity in the database, and
+// reports whether the given namespace can be crypto-shredded.
+func (db *DB) ShredReport(ns string) (ShredReport, error) {
+	rep := ShredReport{Namespace: ns}
+	used := make(map[string]map[uint32]bool) // namespace -> key IDs
+
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		for _, n := range tx.Namespaces() {
+			ids := make(map[uint32]bool)
+			used[n] = ids
+			for _, et := range tx.EntityTypes(n) {
+				err := tx.ForEach(n, et, nil, func(_, v []byte) (bool, error) {
+					enc := len(v) >= 5 && v[0] == envelopeEncrypted
+					if enc {
+						ids[binary.BigEndian.Uint32(v[1:5])] = true
+					}
+					if n == ns {
+						if enc {
+							rep.Encrypted++
+						} else {
+							rep.Plain++
+						}
+					}
+					return true, nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ShredReport{}, err
+	}
+
+	for id := range used[ns] {
+		rep.KeyIDs = append(rep.KeyIDs, id)
+	}
+	sort.Sort(uint32s(rep.KeyIDs))
+	if len(rep.KeyIDs) == 0 {
+		return rep, nil
+	}
+	kp := db.opts.KeyProvider
+	if kp == nil {
+		return ShredReport{}, ErrKeyUnavailable
+	}
+
+	// Fingerprints of the keys of the namespace being examined.
+	mine := make(map[[sha256.Size]byte]bool)
+	for _, id := range rep.KeyIDs {
+		key, err := kp.Key(ns, id)
+		if err != nil || key == nil {
+			rep.Unresolved = append(rep.Unresolved, ns)
+			break
+		}
+		mine[sha256.Sum256(key)] = true
+	}
+
+	others := make([]string, 0, len(used))
+	for n := range used {
+		if n != ns {
+			others = append(others, n)
+		}
+	}
+	sort.Strings(others)
+	for _, n := range others {
+		for id := range used[n] {
+			key, err := kp.Key(n, id)
+			if err != nil || key == nil {
+				rep.Unresolved = append(rep.Unresolved, n)
+				break
+			}
+			if mine[sha256.Sum256(key)] {
+				rep.SharedWith = append(rep.SharedWith, n)
+				break
+			}
+		}
+	}
+
+	return rep, nil
+}
+
+// uint32s sorts unsigned integers in ascending order.
+type uint32s []uint32
+
+func (s uint32s) Len() int           { return len(s) }
+func (s uint32s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,391 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// errKeyDestroyed is answered by `testKeys` for destroyed keys.
+var errKeyDestroyed = errors.New("key destroyed")
+
+// testKeys is a `KeyProvider` holding keys by namespace and ID.
+type testKeys struct {
+	current map[string]uint32            // ID of the current key, by namespace
+	keys    map[string]map[uint32][]byte // keys, by namespace and ID
+}
+
+// CurrentKey conforms to `KeyProvider`.
+func (tk *testKeys) CurrentKey(ns string) (uint32, []byte, error) {
+	id, ok := tk.current[ns]
+	if !ok {
+		return 0, nil, nil
+	}
+	return id, tk.keys[ns][id], nil
+}
+
+// Key conforms to `KeyProvider`.
+func (tk *testKeys) Key(ns string, id uint32) ([]byte, error) {
+	k, ok := tk.keys[ns][id]
+	if !ok {
+		return nil, errKeyDestroyed
+	}
+	return k, nil
+}
+
+// keyDB answers a handle to the test database that encrypts using the
+// given key provider.
+func keyDB(kp KeyProvider) *DB {
+	return &DB{sdb: testDB.sdb, opts: Options{KeyProvider: kp}}
+}
+
+// dropNamespaces deletes the entities of the given namespaces once the
+// test ends, so that their payloads, encrypted using keys local to the
+// test, do not trip a later `Rekey`.
+func dropNamespaces(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		err := testDB.sdb.Update(func(tx *storage.Tx) error {
+			for _, ns := range names {
+				for _, et := range tx.EntityTypes(ns) {
+					var keys [][]byte
+					err := tx.ForEach(ns, et, nil, func(k, _ []byte) (bool, error) {
+						keys = append(keys, append([]byte(nil), k...))
+						return true, nil
+					})
+					if err != nil {
+						return err
+					}
+					for _, k := range keys {
+						if err := tx.Delete(ns, et, k); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// keyOf answers a key of the given length, filled with the given byte.
+func keyOf(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+// secretDefn answers an entity type, serialised as MessagePack, having
+// a single string field, `secret`.
+func secretDefn(t *testing.T, name string) *EntityTypeDefn {
+	t.Helper()
+	return testDefn(t, name, []testField{{"secret", FieldTypeString}}, func(ed *EntityTypeDefn) {
+		ed.SetCodec(CodecMsgpack)
+	})
+}
+
+func TestEncryptedEnvelope(t *testing.T) {
+	tk := &testKeys{
+		current: map[string]uint32{"crypt_a": 3, "crypt_b": 9},
+		keys: map[string]map[uint32][]byte{
+			"crypt_a": {3: keyOf(1, 32)},
+			"crypt_b": {9: keyOf(2, 16)},
+		},
+	}
+	dropNamespaces(t, "crypt_a", "crypt_b", "crypt_plain")
+	db := keyDB(tk)
+	ed := secretDefn(t, "crypt_env")
+	const secret = "attack at dawn"
+	ids := make(map[string]uint64)
+
+	for _, name := range []string{"crypt_a", "crypt_b", "crypt_plain"} {
+		ns := testNamespace(t, name)
+		et := db.EntityType(ns, ed)
+		d := testDoc(t, ed, 0, map[string]interface{}{"secret": secret})
+		if err := et.Put(d); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ids[name] = d.ID()
+
+		by := storedForm(t, ns, ed, d.ID())
+		id, keyed := tk.current[name]
+		if !keyed {
+			if by[0] == envelopeEncrypted {
+				t.Fatalf("%s: encrypted without a key", name)
+			}
+			continue
+		}
+		if by[0] != envelopeEncrypted || binary.BigEndian.Uint32(by[1:5]) != id || bytes.Contains(by, []byte(secret)) {
+			t.Fatalf("%s: stored form % x", name, by)
+		}
+
+		e, err := et.Get(d.ID())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		f, _ := e.(*Document).Field("secret")
+		if v := fieldValue(f); v != secret {
+			t.Fatalf("%s: read %v", name, v)
+		}
+		if _, err := testDB.EntityType(ns, ed).Get(d.ID()); !errors.Is(err, ErrKeyUnavailable) {
+			t.Errorf("%s: read without keys: %v", name, err)
+		}
+
+		// Payloads are bound to their entity types, and authenticated.
+		if _, err := db.open(name, "crypt_other", by); err != ErrPayloadInvalid {
+			t.Errorf("%s: opened as another type: %v", name, err)
+		}
+		bad := append([]byte(nil), by...)
+		bad[len(bad)-1] ^= 1
+		if _, err := db.open(name, ed.Name(), bad); err != ErrPayloadInvalid {
+			t.Errorf("%s: opened when tampered: %v", name, err)
+		}
+		if _, err := db.open(name, ed.Name(), by[:3]); err != ErrPayloadInvalid {
+			t.Errorf("%s: opened when truncated: %v", name, err)
+		}
+	}
+
+	// Nonces are random; the same payload is sealed differently.
+	s1, _ := db.seal("crypt_a", "crypt_env", []byte(secret))
+	s2, _ := db.seal("crypt_a", "crypt_env", []byte(secret))
+	if bytes.Equal(s1, s2) {
+		t.Error("sealed payloads equal")
+	}
+
+	// Destroying the keys of a namespace shreds its data.
+	delete(tk.keys, "crypt_a")
+	ns, _ := NewNamespace("crypt_a")
+	if _, err := db.EntityType(ns, ed).Get(ids["crypt_a"]); !errors.Is(err, errKeyDestroyed) {
+		t.Errorf("read after shredding: %v", err)
+	}
+}
+
+func TestShredReport(t *testing.T) {
+	shared := keyOf(5, 32)
+	tk := &testKeys{
+		current: map[string]uint32{"crypt_s1": 1, "crypt_s2": 7, "crypt_s3": 1, "crypt_s4": 2},
+		keys: map[string]map[uint32][]byte{
+			"crypt_s1": {1: shared},
+			"crypt_s2": {7: shared},
+			"crypt_s3": {1: keyOf(6, 32)},
+			"crypt_s4": {2: keyOf(7, 24)},
+		},
+	}
+	dropNamespaces(t, "crypt_s1", "crypt_s2", "crypt_s3", "crypt_s4")
+	db := keyDB(tk)
+	ed := secretDefn(t, "crypt_shred")
+	for _, name := range []string{"crypt_s1", "crypt_s2", "crypt_s3", "crypt_s4"} {
+		et := db.EntityType(testNamespace(t, name), ed)
+		if err := et.Put(testDoc(t, ed, 0, map[string]interface{}{"secret": name})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A plain entity, stored before the namespace had a key.
+	delete(tk.current, "crypt_s4")
+	ns4, _ := NewNamespace("crypt_s4")
+	if err := db.EntityType(ns4, ed).Put(testDoc(t, ed, 0, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the namespaces of this test are considered; others may have
+	// been encrypted using keys unknown here.
+	ours := func(nss []string) []string {
+		var res []string
+		for _, ns := range nss {
+			if strings.HasPrefix(ns, "crypt_s") {
+				res = append(res, ns)
+			}
+		}
+		return res
+	}
+	tests := []struct {
+		ns         string
+		keyIDs     []uint32
+		encrypted  uint64
+		plain      uint64
+		sharedWith []string
+	}{
+		{"crypt_s1", []uint32{1}, 1, 0, []string{"crypt_s2"}},
+		{"crypt_s2", []uint32{7}, 1, 0, []string{"crypt_s1"}},
+		{"crypt_s3", []uint32{1}, 1, 0, nil},
+		{"crypt_s4", []uint32{2}, 1, 1, nil},
+	}
+	for _, tc := range tests {
+		rep, err := db.ShredReport(tc.ns)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ns, err)
+		}
+		if !reflect.DeepEqual(rep.KeyIDs, tc.keyIDs) || rep.Encrypted != tc.encrypted || rep.Plain != tc.plain ||
+			!reflect.DeepEqual(ours(rep.SharedWith), tc.sharedWith) || len(ours(rep.Unresolved)) != 0 {
+			t.Errorf("%s: %+v", tc.ns, rep)
+		}
+	}
+
+	// Namespaces whose keys are destroyed can not be compared.
+	delete(tk.keys, "crypt_s2")
+	rep, err := db.ShredReport("crypt_s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Safe() || !reflect.DeepEqual(ours(rep.Unresolved), []string{"crypt_s2"}) {
+		t.Errorf("destroyed keys: %+v", rep)
+	}
+}
+
+// keyIDOf answers the ID of the key that encrypts the stored form of
+// the given entity, or `0` if it is plain.
+func keyIDOf(t *testing.T, ns *Namespace, ed *EntityTypeDefn, id uint64) uint32 {
+	t.Helper()
+	by := storedForm(t, ns, ed, id)
+	if by[0] != envelopeEncrypted {
+		return 0
+	}
+	return binary.BigEndian.Uint32(by[1:5])
+}
+
+func TestStaticKeys(t *testing.T) {
+	if _, err := newStaticKeys(1, keyOf(1, 32), map[uint32][]byte{2: keyOf(2, 7)}); err == nil {
+		t.Error("invalid retired key accepted")
+	}
+
+	static := func(id uint32, key []byte, old map[uint32][]byte) *DB {
+		kp, err := newStaticKeys(id, key, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyDB(kp)
+	}
+	dropNamespaces(t, "crypt_static")
+	ns := testNamespace(t, "crypt_static")
+	ed := secretDefn(t, "crypt_stat")
+	k1, k2 := keyOf(8, 32), keyOf(9, 16)
+
+	d1 := testDoc(t, ed, 0, map[string]interface{}{"secret": "one"})
+	if err := static(1, k1, nil).EntityType(ns, ed).Put(d1); err != nil {
+		t.Fatal(err)
+	}
+	if id := keyIDOf(t, ns, ed, d1.ID()); id != 1 {
+		t.Fatalf("stored using key %d", id)
+	}
+
+	// After rotation, new payloads use the new key, while the old ones
+	// remain readable using the retired key.
+	et := static(2, k2, map[uint32][]byte{1: k1}).EntityType(ns, ed)
+	d2 := testDoc(t, ed, 0, map[string]interface{}{"secret": "two"})
+	if err := et.Put(d2); err != nil {
+		t.Fatal(err)
+	}
+	if id := keyIDOf(t, ns, ed, d2.ID()); id != 2 {
+		t.Fatalf("stored using key %d", id)
+	}
+	for id, want := range map[uint64]string{d1.ID(): "one", d2.ID(): "two"} {
+		e, err := et.Get(id)
+		if err != nil {
+			t.Fatalf("%d: %v", id, err)
+		}
+		f, _ := e.(*Document).Field("secret")
+		if v := fieldValue(f); v != want {
+			t.Errorf("%d: read %v", id, v)
+		}
+	}
+
+	// Without the retired key, only the new payloads are readable.
+	et = static(2, k2, nil).EntityType(ns, ed)
+	if _, err := et.Get(d1.ID()); !errors.Is(err, ErrKeyUnavailable) {
+		t.Errorf("read without retired key: %v", err)
+	}
+	if _, err := et.Get(d2.ID()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	if _, err := testDB.Rekey(); err != ErrKeyUnavailable {
+		t.Errorf("rekey without keys: %v", err)
+	}
+
+	// Keys are scoped to the namespace of this test, so that `Rekey`
+	// leaves the others alone.
+	tk := &testKeys{
+		current: map[string]uint32{},
+		keys:    map[string]map[uint32][]byte{"crypt_rekey": {1: keyOf(3, 32)}},
+	}
+	dropNamespaces(t, "crypt_rekey")
+	db := keyDB(tk)
+	ns := testNamespace(t, "crypt_rekey")
+	ed := secretDefn(t, "crypt_rot")
+	et := db.EntityType(ns, ed)
+
+	var ids []uint64
+	put := func(secret string) {
+		d := testDoc(t, ed, 0, map[string]interface{}{"secret": secret})
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID())
+	}
+	put("plain")
+	tk.current["crypt_rekey"] = 1
+	put("one")
+	put("two")
+
+	tests := []struct {
+		name    string
+		current uint32 // `0` for none
+		destroy uint32 // key destroyed after rekeying, if any
+		n       uint64
+	}{
+		{"rotate", 2, 1, 3},
+		{"again", 2, 0, 0},
+		{"decrypt", 0, 2, 3},
+	}
+	for _, tc := range tests {
+		if tc.current == 0 {
+			delete(tk.current, "crypt_rekey")
+		} else {
+			tk.current["crypt_rekey"] = tc.current
+			tk.keys["crypt_rekey"][tc.current] = keyOf(byte(tc.current), 16)
+		}
+		n, err := db.Rekey()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if n != tc.n {
+			t.Errorf("%s: rekeyed %d, want %d", tc.name, n, tc.n)
+		}
+		delete(tk.keys["crypt_rekey"], tc.destroy)
+
+		for _, id := range ids {
+			if kid := keyIDOf(t, ns, ed, id); kid != tc.current {
+				t.Errorf("%s: %d stored using key %d", tc.name, id, kid)
+			}
+			if _, err := et.Get(id); err != nil {
+				t.Errorf("%s: %d: %v", tc.name, id, err)
+			}
+		}
+	}
+
+	// Decrypted payloads are readable without any keys.
+	if _, err := testDB.EntityType(ns, ed).Get(ids[1]); err != nil {
+		t.Error(err)
+	}
+}
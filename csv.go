@@ -0,0 +1,302 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// CSV files exchange entities with spreadsheets.  A file has a header
+// row naming its columns, followed by a row per entity.  Values are
+// written in their plain textual forms: numbers in decimal, booleans
+// as `true` or `false`, and times in RFC 3339 form, with nanoseconds.
+// Null fields are written as empty cells, and empty cells are read
+// as null fields.
+
+// csvIDColumn is the name of the column holding the IDs of entities,
+// unless mapped otherwise.
+const csvIDColumn = "id"
+
+// defaultTimeLayouts are the layouts in which times are read from
+// CSV cells, by default.
+var defaultTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// CSVError is answered when a CSV file can not be read.  It identifies
+// the row - counting the header row as `1` - and the column of the
+// offending cell, if any, and wraps the error encountered.
+type CSVError struct {
+	Row    int
+	Column string
+	Err    error
+}
+
+// Error conforms to `error`.
+func (e *CSVError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("csv row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("csv row %d, column %q: %v", e.Row, e.Column, e.Err)
+}
+
+// Unwrap answers the wrapped error.
+func (e *CSVError) Unwrap() error {
+	return e.Err
+}
+
+// ExportCSV writes the entities of the given entity type in the given
+// namespace to the given writer as CSV: a header row, and a row per
+// entity, in the ascending order of their IDs.  The first column holds
+// the IDs, and is named `id`; the others hold the given fields, in the
+// given order, or all the fields of the entity type, in the ascending
+// order of their IDs, if none are given.  Soft-deleted and expired
+// entities are not written.
+//
+// The entities are read from a consistent snapshot, in a single read
+// transaction.  It answers the number of entities written, and
+// `ErrNameUnknown` if a given field is not defined.
+func (db *DB) ExportCSV(ns *Namespace, ed *EntityTypeDefn, fields []string, w io.Writer) (uint64, error) {
+	fds, err := projectFields(ed, fields)
+	if err != nil {
+		return 0, err
+	}
+	head := make([]string, 1+len(fds))
+	head[0] = csvIDColumn
+	ids := make([]int, len(fds))
+	for i, fd := range fds {
+		head[1+i] = fd.Name
+		ids[i] = int(fd.ID)
+	}
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(head)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	et := &entityType{db: db, ns: ns, defn: ed}
+	opts := SearchOpts{Fields: ids}
+	now := db.now().UnixNano()
+	row := make([]string, len(head))
+	err = db.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, v []byte) (bool, error) {
+			d, err := et.searchDoc(tx, binary.BigEndian.Uint64(k), v, opts, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			row[0] = strconv.FormatUint(d.ID(), 10)
+			for i, fd := range fds {
+				row[1+i] = ""
+				if f, ok := d.fields[fd.ID]; ok {
+					row[1+i] = csvValue(f)
+				}
+			}
+			err = cw.Write(row)
+			if err != nil {
+				return false, err
+			}
+			n++
+			return true, nil
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// csvValue answers the textual form of the value of the given field;
+// an empty string if it is null.
+func csvValue(f Field) string {
+	switch v := fieldValue(f).(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// CSVImportOpts holds the optional settings of `ImportCSV`.
+type CSVImportOpts struct {
+	// Mapping maps the names of the columns to the names of the fields
+	// that they fill; the name `id` designates the IDs of entities.
+	// Only mapped columns are read.  If `nil`, every column fills the
+	// field having its name, and the column named `id`, if any, holds
+	// the IDs.
+	Mapping map[string]string
+
+	// TimeLayouts are the layouts in which times are read, tried in
+	// order.  By default, RFC 3339 times, `2006-01-02 15:04:05` and
+	// `2006-01-02` are read, the latter two in UTC.
+	TimeLayouts []string
+
+	// Comma is the separator of the cells; `,` if zero.
+	Comma rune
+}
+
+// ImportCSV reads CSV from the given reader, and stores an instance of
+// the given entity type in the given namespace per row, as `Put` does;
+// hooks, validation rules and quotas apply.  The cells are converted
+// to the types of the fields that their columns are mapped to:
+// integral numbers are read from integral floating point forms too,
+// provided that they are in range.  Rows having IDs replace the
+// entities having them, or create them; the others create entities
+// with new IDs.
+//
+// Every row is stored in its own transaction; the rows before one that
+// fails remain stored.  It answers the number of rows stored, and a
+// `*CSVError` identifying the offending row and column, if any.  Use
+// `BulkLoad` to load large volumes of data.
+func (db *DB) ImportCSV(ns *Namespace, ed *EntityTypeDefn, r io.Reader, opts *CSVImportOpts) (uint64, error) {
+	var o CSVImportOpts
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.TimeLayouts) == 0 {
+		o.TimeLayouts = defaultTimeLayouts
+	}
+
+	cr := csv.NewReader(r)
+	if o.Comma != 0 {
+		cr.Comma = o.Comma
+	}
+	cr.ReuseRecord = true
+	head, err := cr.Read()
+	if err != nil {
+		return 0, &CSVError{Row: 1, Err: err}
+	}
+
+	// Resolve the columns.
+	idCol := -1
+	cols := make([]FieldDefn, len(head))
+	read := make([]bool, len(head))
+	for i, name := range head {
+		target := name
+		if o.Mapping != nil {
+			var ok bool
+			if target, ok = o.Mapping[name]; !ok {
+				continue
+			}
+		}
+		if target == csvIDColumn {
+			idCol = i
+			continue
+		}
+		fd, err := ed.Field(target)
+		if err != nil {
+			return 0, &CSVError{Row: 1, Column: name, Err: err}
+		}
+		cols[i] = fd
+		read[i] = true
+	}
+	head = append([]string(nil), head...)
+
+	et := db.EntityType(ns, ed)
+	var n uint64
+	for row := 2; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, &CSVError{Row: row, Err: err}
+		}
+
+		var id uint64
+		if idCol >= 0 && idCol < len(rec) && rec[idCol] != "" {
+			id, err = strconv.ParseUint(rec[idCol], 10, 64)
+			if err != nil {
+				return n, &CSVError{Row: row, Column: head[idCol], Err: ErrFieldValueType}
+			}
+		}
+		d := NewDocument(ed, id)
+		for i, cell := range rec {
+			if i >= len(read) || !read[i] || cell == "" {
+				continue
+			}
+			f, err := d.Field(cols[i].Name)
+			if err == nil {
+				err = setCSVValue(f, cell, o.TimeLayouts)
+			}
+			if err != nil {
+				return n, &CSVError{Row: row, Column: head[i], Err: err}
+			}
+		}
+		err = et.Put(d)
+		if err != nil {
+			return n, &CSVError{Row: row, Err: err}
+		}
+		n++
+	}
+}
+
+// setCSVValue sets the value read from the given cell in the given
+// field, converting it to the field's type.
+func setCSVValue(f Field, cell string, layouts []string) error {
+	switch f.(type) {
+	case *FieldString:
+		return setFieldValue(f, cell)
+	case *FieldBool:
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return ErrFieldValueType
+		}
+		return setFieldValue(f, b)
+	case *FieldTime:
+		for _, l := range layouts {
+			if t, err := time.Parse(l, cell); err == nil {
+				return setFieldValue(f, t)
+			}
+		}
+		return ErrFieldValueType
+	case *FieldFloat32, *FieldFloat64:
+		x, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return ErrFieldValueType
+		}
+		return setFieldValue(f, x)
+	}
+
+	if i, err := strconv.ParseInt(cell, 10, 64); err == nil {
+		return setFieldValue(f, i)
+	}
+	if u, err := strconv.ParseUint(cell, 10, 64); err == nil {
+		return setFieldValue(f, u)
+	}
+	x, err := strconv.ParseFloat(cell, 64)
+	if err != nil {
+		return ErrFieldValueType
+	}
+	return setFieldValue(f, x)
+}
@@ -0,0 +1,295 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// DB is the application's handle to the `flagon` database.
+//
+// All of `flagon` uses a single database.  Hence, all handles answered
+// by `Open` refer to the same underlying database.  For the same
+// reason, the state that the package keeps in memory about the
+// database - registered hooks, subscriptions to changes, caches of
+// entities and quotas - is kept once per process, and is shared by
+// all handles.
+type DB struct {
+	sdb  *storage.DB   // the storage layer's database singleton
+	opts Options       // options given when opening this handle
+	stop chan struct{} // closed to stop the sweeper, if any
+
+	repair *throttle // throttle of read-repair, if enabled
+
+	dmutex     sync.Mutex    // to protect the following
+	durability Durability    // level set using this handle
+	syncStop   chan struct{} // closed to stop the syncer, if any
+}
+
+// Options holds the optional settings of a database handle.  The zero
+// value is a valid, default configuration.
+type Options struct {
+	// KeyProvider, if set, supplies the keys used to encrypt entity
+	// payloads, per namespace.  See `KeyProvider`.
+	KeyProvider KeyProvider
+
+	// Key, if set, encrypts the entity payloads of all namespaces
+	// using AES-GCM.  It is a shorthand for a key provider answering
+	// this key, identified by `KeyID`, for every namespace; hence, it
+	// can not be combined with `KeyProvider`.
+	Key []byte
+
+	// KeyID identifies `Key` in the header of every payload encrypted
+	// using it.
+	KeyID uint32
+
+	// OldKeys holds the retired keys, by ID, so that the payloads
+	// encrypted using them remain readable.  To rotate keys, move the
+	// current key to `OldKeys`, set a new `Key` and `KeyID`, and call
+	// `Rekey`.
+	OldKeys map[uint32][]byte
+
+	// ReadOnly opens an existing database for reading only.  Since
+	// BoltDB locks the database file, this is meant for files that a
+	// writer publishes by atomically renaming complete snapshots or
+	// compacted copies into place.
+	ReadOnly bool
+
+	// Shadow opens an existing database in shadow mode, for testing
+	// migrations and new versions of applications against real data:
+	// a consistent copy of the database - its overlay - is taken when
+	// it is opened, and is opened in its place.  Hence, reads see the
+	// database as of opening, together with the mutations made since,
+	// while the mutations themselves never reach the database.  As
+	// with `ReadOnly`, the database file should not be held open for
+	// writing by another process.  It can not be combined with
+	// `ReadOnly`.
+	Shadow bool
+
+	// ShadowPath, if set, is the absolute path of the file holding the
+	// overlay of a shadow handle; an existing file is replaced.  The
+	// file is retained when the handle is closed, for inspection.
+	// Otherwise, the overlay is a temporary file, removed when the
+	// handle is closed.
+	ShadowPath string
+
+	// WatchInterval, if positive, makes a read-only handle check the
+	// database file for replacement at this interval, and reopen it
+	// when replaced.  Otherwise, reads continue to be served from the
+	// file originally opened.
+	WatchInterval time.Duration
+
+	// SweepInterval, if positive, makes a writable handle remove
+	// expired entities at this interval, until it is closed.  See
+	// `ExpiringEntityType`.
+	SweepInterval time.Duration
+
+	// Audit makes a writable handle record every modification of
+	// entities in an append-only audit log.  See `DB.AuditHistory`.
+	Audit bool
+
+	// ReadRepair, if positive, makes a writable handle store the
+	// documents that it reads at earlier schema versions, once they
+	// are upgraded, at the current schema version; up to this many
+	// documents per second.  Hence, migrations converge for frequently
+	// read data.  See `EntityTypeDefn.AddMigration`.
+	ReadRepair int
+
+	// Logger, if set, receives the messages that `flagon` logs.  By
+	// default, messages at `LogInfo` and above are written using
+	// package `log`.  Since all handles refer to the same database,
+	// the logger of the latest handle opened is used by all of them.
+	Logger Logger
+
+	// Clock, if set, supplies the current time, in place of the system
+	// clock.  Tests can use a `ManualClock` to control time.  Elapsed
+	// times, such as the durations of administrative actions and the
+	// intervals of background work, are still measured by the system
+	// clock.
+	Clock Clock
+
+	// Tracer, if set, receives spans around the operations on
+	// entities and their transactions.  See `Tracer`.
+	Tracer Tracer
+
+	// ChangeLog makes a writable handle record the changes to entities
+	// and to the catalogue in a change log, from which followers
+	// replicate the database.  Since all handles refer to the same
+	// database, recording, once enabled, continues until the database
+	// is closed.  See `Changes`.
+	ChangeLog bool
+
+	// Durability is the durability level of a writable handle; see
+	// `Durability`.  Since all handles refer to the same database,
+	// the level of the latest handle opened applies to all of them.
+	Durability Durability
+
+	// SyncInterval is the interval at which the database is synced
+	// under `DurabilityBatched`; one second if not positive.
+	SyncInterval time.Duration
+
+	// Policy, if set, decides the rights of the principals carried by
+	// the contexts of operations.  The operations of
+	// `ContextEntityType` answer an `*AccessError` when denied; those
+	// without contexts are taken to be made by the application itself,
+	// and are not authorised.  See `DB.Authorize`.
+	Policy Policy
+
+	// Names, if set, is the policy that validates names, in place of
+	// the default `NameRules`.  Since namespaces and definitions are
+	// created independently of handles, the policy of the latest
+	// handle opened applies to all of them.  See `SetNamePolicy`.
+	Names NamePolicy
+}
+
+// Open initialises - if necessary - the database inside the given
+// base storage directory path, and answers a handle to it.  This
+// path should be an absolute path.  `opts` may be `nil`.  The database
+// is opened once per process; later calls answer further handles to
+// it, or `ErrModeChange` if they give another path, or ask for it to
+// be opened for reading only or in shadow mode when it was not, or
+// the other way round.
+func Open(p string, opts *Options) (*DB, error) {
+	var err error
+	switch {
+	case opts != nil && opts.ReadOnly && opts.Shadow:
+		return nil, ErrShadowReadOnly
+	case opts != nil && opts.ReadOnly:
+		err = storage.InitReadOnly(p)
+	case opts != nil && opts.Shadow:
+		err = storage.InitShadow(p, opts.ShadowPath)
+	default:
+		err = storage.InitDB(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sdb, err := storage.DbInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{sdb: sdb}
+	if opts != nil {
+		db.opts = *opts
+	}
+	if db.opts.Logger != nil {
+		setLogger(db.opts.Logger)
+	}
+	if db.opts.Names != nil {
+		SetNamePolicy(db.opts.Names)
+	}
+	if db.opts.Key != nil {
+		if db.opts.KeyProvider != nil {
+			return nil, ErrKeyConflict
+		}
+		kp, err := newStaticKeys(db.opts.KeyID, db.opts.Key, db.opts.OldKeys)
+		if err != nil {
+			return nil, err
+		}
+		db.opts.KeyProvider = kp
+	}
+	if db.opts.ReadOnly && db.opts.WatchInterval > 0 {
+		sdb.Watch(db.opts.WatchInterval)
+	}
+	if !db.opts.ReadOnly && db.opts.ChangeLog {
+		sdb.SetChangeLog(true)
+	}
+	if !db.opts.ReadOnly && db.opts.ReadRepair > 0 {
+		db.repair = newThrottle(db.opts.ReadRepair)
+	}
+	if !db.opts.ReadOnly && db.opts.Durability != DurabilityFull {
+		err = db.SetDurability(db.opts.Durability)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !db.opts.ReadOnly && db.opts.SweepInterval > 0 {
+		db.stop = make(chan struct{})
+		go db.sweep(db.opts.SweepInterval, db.stop)
+	}
+	return db, nil
+}
+
+// Close stops the sweeper and the syncer of this handle, if any, and
+// closes the underlying database, syncing it if its durability is
+// relaxed.
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		db.stop = nil
+	}
+	db.dmutex.Lock()
+	if db.syncStop != nil {
+		close(db.syncStop)
+		db.syncStop = nil
+	}
+	db.dmutex.Unlock()
+	return db.sdb.Close()
+}
+
+// Shadow answers the path of the overlay file of a handle opened in
+// shadow mode, and an empty string otherwise.  See `Options.Shadow`.
+func (db *DB) Shadow() string {
+	return db.sdb.Shadow()
+}
+
+// Reopen reopens a read-only database if its file has been replaced
+// since it was opened.  It answers `true` if the database was
+// reopened.  See `Options.WatchInterval` for doing this periodically.
+func (db *DB) Reopen() (bool, error) {
+	return db.sdb.Reopen()
+}
+
+// Export writes all the entities of the given entity type in the
+// given namespace to the given writer, in `flagon`'s portable export
+// format.  The stream records the namespace and the entity type, and
+// can be read back using `Import`.
+func (db *DB) Export(ns, et string, w io.Writer) error {
+	_, err := db.sdb.Export(ns, et, 0, w)
+	return err
+}
+
+// ExportFrom is similar to `Export`, but writes only those entities
+// whose ID is equal to or greater than the given ID.  Starting at
+// the successor of the last ID of a previous export enables
+// incremental exports.
+//
+// It answers the number of entities written.
+func (db *DB) ExportFrom(ns, et string, startAt uint64, w io.Writer) (uint64, error) {
+	return db.sdb.Export(ns, et, startAt, w)
+}
+
+// Import reads a stream written by `Export` or `ExportFrom`, and
+// stores its entities in the namespace and entity type recorded in
+// the stream.  Existing entities having the same IDs are overwritten,
+// and their recorded provenance is removed.  Use `ImportBatch` to
+// record the provenance of the imported entities instead.
+//
+// It answers the number of entities read.  Imports are recorded in
+// the administrative event log.  See `AdminLog`.
+func (db *DB) Import(r io.Reader) (uint64, error) {
+	start := time.Now()
+	n, err := db.sdb.Import(r, nil)
+	quotas.purge()
+	db.logAdmin(context.Background(), AdminImport, "", "", map[string]interface{}{"entities": n}, start, err)
+	return n, err
+}
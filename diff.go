@@ -0,0 +1,61 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import "sort"
+
+// FieldDiff describes a field whose values differ between two
+// entities.  Null values are `nil`.
+type FieldDiff struct {
+	Field string      // name of the field
+	Old   interface{} // value in the first entity
+	New   interface{} // value in the second entity
+}
+
+// Diff answers the fields whose values differ between the two given
+// entities, in the ascending order of their IDs.  Both should be
+// `*Document`s of the same entity type; otherwise,
+// `ErrEntityTypeMismatch` is answered.  Times are equal if they denote
+// the same instant, and floating point numbers if they have the same
+// representation.  A null field differs from any value.
+func Diff(a, b Entity) ([]FieldDiff, error) {
+	da, ok := a.(*Document)
+	if !ok {
+		return nil, ErrEntityTypeMismatch
+	}
+	db, ok := b.(*Document)
+	if !ok || db.defn.Name() != da.defn.Name() {
+		return nil, ErrEntityTypeMismatch
+	}
+
+	fds := da.defn.Fields()
+	sort.Sort(fieldDefnsByID(fds))
+
+	var res []FieldDiff
+	for _, fd := range fds {
+		var old, cur interface{}
+		if f, ok := da.fields[fd.ID]; ok {
+			old = fieldValue(f)
+		}
+		if f, ok := db.fields[fd.ID]; ok {
+			cur = fieldValue(f)
+		}
+		if old == nil && cur == nil || old != nil && cur != nil && sameValue(old, cur) {
+			continue
+		}
+		res = append(res, FieldDiff{Field: fd.Name, Old: old, New: cur})
+	}
+	return res, nil
+}
@@ -0,0 +1,292 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Document is a generic entity, whose structure is described by an
+// entity type definition.
+//
+// Documents hold only those fields that have been accessed or set.
+// Fields are created on demand, as they are looked up by name.
+type Document struct {
+	EntityKey
+
+	defn    *EntityTypeDefn   // definition of this document's entity type
+	fields  map[uint8]Field   // fields that have been accessed or set
+	version uint64            // stored version, as of when read or stored
+	prov    *Provenance       // provenance of the stored version, if any
+	deleted int64             // time of soft deletion, if soft-deleted
+	expires int64             // expiry time, if any
+	labels  map[string]string // labels, as of when last read
+	schema  uint32            // schema version of the stored version
+}
+
+// NewDocument creates an empty document of the given entity type,
+// having the given ID.
+func NewDocument(ed *EntityTypeDefn, id uint64) *Document {
+	return &Document{
+		EntityKey: EntityKey{id: id},
+		defn:      ed,
+		fields:    make(map[uint8]Field, 4),
+	}
+}
+
+// TypeName answers the name of this document's entity type.
+func (d *Document) TypeName() string {
+	return d.defn.Name()
+}
+
+// Version answers the stored version of this document, as of when it
+// was last read or stored; `0` if it has never been stored.  See
+// `VersionedEntityType`.
+func (d *Document) Version() uint64 {
+	return d.version
+}
+
+// Provenance answers the recorded provenance of the stored version of
+// this document, as of when it was last read or stored, and `true` if
+// one is recorded.  See `ProvenanceRecorder`.
+func (d *Document) Provenance() (Provenance, bool) {
+	if d.prov == nil {
+		return Provenance{}, false
+	}
+	return *d.prov, true
+}
+
+// Deleted answers the time at which this document was soft-deleted,
+// and `true` if it was soft-deleted, as of when it was last read.
+// See `SoftDeleter`.
+func (d *Document) Deleted() (time.Time, bool) {
+	if d.deleted == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d.deleted), true
+}
+
+// Expires answers the time at which this document expires, and `true`
+// if it has an expiry time.  See `ExpiringEntityType`.
+func (d *Document) Expires() (time.Time, bool) {
+	if d.expires == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d.expires), true
+}
+
+// SchemaVersion answers the schema version at which this document
+// was stored.  Migrations applied lazily when reading it do not change
+// this until it is stored again.  See `EntityTypeDefn.AddMigration`.
+func (d *Document) SchemaVersion() uint32 {
+	return d.schema
+}
+
+// Labels answers a copy of the labels of this document, as of when it
+// was last read.  See `Labeller`.
+func (d *Document) Labels() map[string]string {
+	res := make(map[string]string, len(d.labels))
+	for k, v := range d.labels {
+		res[k] = v
+	}
+	return res
+}
+
+// expired answers `true` if this document has expired as of the given
+// time.
+func (d *Document) expired(now int64) bool {
+	return d.expires != 0 && d.expires <= now
+}
+
+// Defn answers the definition of this document's entity type.
+func (d *Document) Defn() *EntityTypeDefn {
+	return d.defn
+}
+
+// Field answers the field having the given name, creating a null one
+// if necessary.  Applications should type-assert the answered
+// field to the concrete type corresponding to the field's definition.
+func (d *Document) Field(name string) (Field, error) {
+	fd, err := d.defn.Field(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := d.fields[fd.ID]; ok {
+		return f, nil
+	}
+
+	f, err := newField(fd)
+	if err != nil {
+		return nil, err
+	}
+	d.fields[fd.ID] = f
+	return f, nil
+}
+
+// Value answers the value of the field having the given name, as its
+// Go type; `nil` if it is null.  Unlike `Field`, it does not create
+// the field.
+func (d *Document) Value(name string) (interface{}, error) {
+	fd, err := d.defn.Field(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := d.fields[fd.ID]
+	if !ok {
+		return nil, nil
+	}
+	return fieldValue(f), nil
+}
+
+// Fields answers the fields held by this document, in the ascending
+// order of their IDs.
+func (d *Document) Fields() []Field {
+	res := make([]Field, 0, len(d.fields))
+	for _, f := range d.fields {
+		res = append(res, f)
+	}
+	sort.Sort(fieldsByID(res))
+
+	return res
+}
+
+// setFields answers the fields of this document that are not null, in
+// the ascending order of their IDs.  Only these are stored.
+func (d *Document) setFields() []Field {
+	res := make([]Field, 0, len(d.fields))
+	for _, f := range d.fields {
+		if f.IsSet() {
+			res = append(res, f)
+		}
+	}
+	sort.Sort(fieldsByID(res))
+
+	return res
+}
+
+// retain discards all the fields of this document, other than those
+// having the given IDs.
+func (d *Document) retain(ids []int) {
+	keep := make(map[uint8]bool, len(ids))
+	for _, id := range ids {
+		keep[uint8(id)] = true
+	}
+	for id := range d.fields {
+		if !keep[id] {
+			delete(d.fields, id)
+		}
+	}
+}
+
+// String answers a human-readable representation of this document,
+// for debugging.
+func (d *Document) String() string {
+	by, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf("%s#%d: %s", d.TypeName(), d.ID(), err)
+	}
+	return string(by)
+}
+
+// documentJSON is the serialisable form of a document.
+type documentJSON struct {
+	ID      uint64                     `json:"id"`
+	Type    string                     `json:"type"`
+	Version uint64                     `json:"version,omitempty"`
+	Fields  map[string]json.RawMessage `json:"fields"`
+}
+
+// MarshalJSON conforms to `json.Marshaler`.  Fields are serialised by
+// name, as defined in the document's entity type.  The version is
+// included once the document has been stored or read.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	fs, err := d.fieldsJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(documentJSON{ID: d.ID(), Type: d.TypeName(), Version: d.version, Fields: fs})
+}
+
+// fieldsJSON answers the serialised fields of this document, by name.
+func (d *Document) fieldsJSON() (map[string]json.RawMessage, error) {
+	names := make(map[uint8]string, len(d.fields))
+	for _, fd := range d.defn.Fields() {
+		names[fd.ID] = fd.Name
+	}
+
+	res := make(map[string]json.RawMessage, len(d.fields))
+	for id, f := range d.fields {
+		by, err := f.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		res[names[id]] = by
+	}
+	return res, nil
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.  The document should
+// have been created using `NewDocument`, so that its entity type
+// definition is available to interpret the serialised fields.  The
+// version, if serialised, is restored too; hence, documents read over
+// remote access layers can be stored conditionally.
+func (d *Document) UnmarshalJSON(by []byte) error {
+	if d.defn == nil {
+		return ErrNameUnknown
+	}
+
+	var v documentJSON
+	err := json.Unmarshal(by, &v)
+	if err != nil {
+		return err
+	}
+	if v.Type != d.TypeName() {
+		return ErrNameUnknown
+	}
+
+	fields := make(map[uint8]Field, len(v.Fields))
+	for name, raw := range v.Fields {
+		fd, err := d.defn.Field(name)
+		if err != nil {
+			return err
+		}
+		f, err := newField(fd)
+		if err != nil {
+			return err
+		}
+		err = f.UnmarshalJSON(raw)
+		if err != nil {
+			return err
+		}
+		fields[fd.ID] = f
+	}
+
+	d.id = v.ID
+	d.version = v.Version
+	d.fields = fields
+	return nil
+}
+
+// fieldsByID sorts fields in the ascending order of their IDs.
+type fieldsByID []Field
+
+func (s fieldsByID) Len() int           { return len(s) }
+func (s fieldsByID) Less(i, j int) bool { return s[i].ID() < s[j].ID() }
+func (s fieldsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
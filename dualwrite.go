@@ -0,0 +1,240 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Divergence describes a difference between the primary and the
+// secondary of a `DualWrite`.
+type Divergence struct {
+	EntityType string // name of the entity type
+	ID         uint64 // ID of the entity
+	Op         string // operation that diverged: "get", "put" or "delete"
+
+	// Primary and Secondary are the JSON forms of the entity as read
+	// from the primary and the secondary; `nil` if not found.
+	Primary, Secondary []byte
+
+	// Err is the error answered by the secondary, if any.
+	Err error
+}
+
+// DualWriteOpts are the options of a `DualWrite`.
+type DualWriteOpts struct {
+	// SampleEvery makes one of every so many reads be compared against
+	// the secondary; `1` or less compares all reads.
+	SampleEvery uint64
+
+	// Queue is the number of pending comparisons; `64` if zero.
+	// Comparisons are dropped rather than slowing reads down, when
+	// the queue is full.
+	Queue int
+
+	// Report receives every divergence detected.  It is called from
+	// the goroutine performing the comparisons, and from writers.
+	Report func(Divergence)
+}
+
+// DualWriteStats are the counters of a `DualWrite`.
+type DualWriteStats struct {
+	Compared  uint64 // reads compared
+	Diverged  uint64 // divergences detected, of reads and writes
+	Dropped   uint64 // comparisons dropped since the queue was full
+	SecErrors uint64 // errors answered by the secondary
+}
+
+// DualWrite is an entity type that writes to two entity types - a
+// primary and a secondary - but reads only from the primary.  Reads
+// are compared against the secondary in the background.  It helps
+// migrate data between stores, or between storage backends, without
+// downtime: the secondary is populated and verified while the primary
+// continues serving, until it can be promoted with confidence.
+//
+// Writes go to the primary first.  Failures of the secondary are
+// reported as divergences, but do not fail the writes.  Entities
+// created in the primary are created in the secondary with the same
+// IDs.  Searches are served by the primary alone.
+type DualWrite struct {
+	// Accessed atomically; first, for alignment on 32-bit platforms.
+	reads uint64    // number of reads, for sampling
+	stats [4]uint64 // see `DualWriteStats`, in order
+
+	primary, secondary EntityType
+	opts               DualWriteOpts
+
+	queue chan dwJob // pending comparisons
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+// dwJob is a pending comparison of a read.
+type dwJob struct {
+	id      uint64
+	primary []byte // JSON form of the primary's entity
+}
+
+// Indices of the counters in `DualWrite.stats`.
+const (
+	dwCompared = iota
+	dwDiverged
+	dwDropped
+	dwSecErrors
+)
+
+// NewDualWrite answers an entity type writing to both the given
+// primary and secondary.  `Close` should be called when it is no
+// longer needed.
+func NewDualWrite(primary, secondary EntityType, opts DualWriteOpts) *DualWrite {
+	if opts.Queue <= 0 {
+		opts.Queue = 64
+	}
+	dw := &DualWrite{
+		primary:   primary,
+		secondary: secondary,
+		opts:      opts,
+		queue:     make(chan dwJob, opts.Queue),
+	}
+
+	dw.wg.Add(1)
+	go dw.compare()
+	return dw
+}
+
+// Name answers the name of the primary.
+func (dw *DualWrite) Name() string {
+	return dw.primary.Name()
+}
+
+// Get answers the entity having the given ID from the primary, and
+// schedules its comparison against the secondary, if sampled.
+func (dw *DualWrite) Get(id uint64) (Entity, error) {
+	e, err := dw.primary.Get(id)
+	if err != nil && !errors.Is(err, ErrIdentifierUnknown) {
+		return nil, err
+	}
+
+	n := atomic.AddUint64(&dw.reads, 1)
+	if dw.opts.SampleEvery <= 1 || n%dw.opts.SampleEvery == 0 {
+		var by []byte
+		if e != nil {
+			by, _ = json.Marshal(e)
+		}
+		select {
+		case dw.queue <- dwJob{id: id, primary: by}:
+		default:
+			atomic.AddUint64(&dw.stats[dwDropped], 1)
+		}
+	}
+
+	return e, err
+}
+
+// Put stores the given entity in the primary, and then in the
+// secondary.
+func (dw *DualWrite) Put(e Entity) error {
+	err := dw.primary.Put(e)
+	if err != nil {
+		return err
+	}
+
+	err = dw.secondary.Put(e)
+	if err != nil {
+		dw.secondaryFailed("put", e.ID(), err)
+	}
+	return nil
+}
+
+// Delete removes the entity having the given ID from the primary, and
+// then from the secondary.
+func (dw *DualWrite) Delete(id uint64) error {
+	err := dw.primary.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	err = dw.secondary.Delete(id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		dw.secondaryFailed("delete", id, err)
+	}
+	return nil
+}
+
+// Search searches the primary.
+func (dw *DualWrite) Search(opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	return dw.primary.Search(opts, fn)
+}
+
+// Stats answers the current counters of this dual writer.
+func (dw *DualWrite) Stats() DualWriteStats {
+	return DualWriteStats{
+		Compared:  atomic.LoadUint64(&dw.stats[dwCompared]),
+		Diverged:  atomic.LoadUint64(&dw.stats[dwDiverged]),
+		Dropped:   atomic.LoadUint64(&dw.stats[dwDropped]),
+		SecErrors: atomic.LoadUint64(&dw.stats[dwSecErrors]),
+	}
+}
+
+// Close waits for the pending comparisons to complete, and stops
+// comparing.  Reads must not be made after closing.
+func (dw *DualWrite) Close() {
+	dw.once.Do(func() {
+		close(dw.queue)
+	})
+	dw.wg.Wait()
+}
+
+// compare performs the queued comparisons.
+func (dw *DualWrite) compare() {
+	defer dw.wg.Done()
+
+	for job := range dw.queue {
+		atomic.AddUint64(&dw.stats[dwCompared], 1)
+
+		e, err := dw.secondary.Get(job.id)
+		if err != nil && !errors.Is(err, ErrIdentifierUnknown) {
+			dw.secondaryFailed("get", job.id, err)
+			continue
+		}
+		var by []byte
+		if e != nil {
+			by, _ = json.Marshal(e)
+		}
+		if bytes.Equal(by, job.primary) {
+			continue
+		}
+
+		atomic.AddUint64(&dw.stats[dwDiverged], 1)
+		dw.report(Divergence{EntityType: dw.Name(), ID: job.id, Op: "get", Primary: job.primary, Secondary: by})
+	}
+}
+
+// secondaryFailed records a failure of the secondary.
+func (dw *DualWrite) secondaryFailed(op string, id uint64, err error) {
+	atomic.AddUint64(&dw.stats[dwSecErrors], 1)
+	atomic.AddUint64(&dw.stats[dwDiverged], 1)
+	dw.report(Divergence{EntityType: dw.Name(), ID: id, Op: op, Err: err})
+}
+
+func (dw *DualWrite) report(d Divergence) {
+	if dw.opts.Report != nil {
+		dw.opts.Report(d)
+	}
+}
@@ -0,0 +1,87 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// DumpJSON writes the entities of the given entity type in the given
+// namespace to the given writer as JSON lines: one object per entity,
+// in the form answered by `Document.MarshalJSON`, in the ascending
+// order of their IDs.  Fields are named as in the definition of the
+// entity type in the system catalogue, and entities are upgraded to
+// its current schema version.  Soft-deleted and expired entities are
+// not written.
+//
+// The entities are read from a consistent snapshot, in a single read
+// transaction; writers are not blocked meanwhile.  Unlike `Export`,
+// whose stream can be imported back, the dump is meant for other
+// tools.  It answers the number of entities written, and
+// `ErrNameUnknown` if the entity type is not defined.
+func (db *DB) DumpJSON(ns, et string, w io.Writer) (uint64, error) {
+	n, err := NewNamespace(ns)
+	if err != nil {
+		return 0, err
+	}
+	if err = validName(et); err != nil {
+		return 0, err
+	}
+
+	var cnt uint64
+	bw := bufio.NewWriter(w)
+	ctx := context.Background()
+	now := db.now().UnixNano()
+	err = db.view(ctx, func(tx *storage.Tx) error {
+		by, ok := tx.EntityTypeDefn(et)
+		if !ok {
+			return ErrNameUnknown
+		}
+		ed := &EntityTypeDefn{}
+		err := json.Unmarshal(by, ed)
+		if err != nil {
+			return err
+		}
+		t := &entityType{db: db, ns: n, defn: ed}
+
+		return tx.ForEach(ns, et, nil, func(k, v []byte) (bool, error) {
+			d, err := t.searchDoc(tx, binary.BigEndian.Uint64(k), v, SearchOpts{}, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			by, err := d.MarshalJSON()
+			if err != nil {
+				return false, err
+			}
+			bw.Write(by)
+			err = bw.WriteByte('\n')
+			if err != nil {
+				return false, err
+			}
+			cnt++
+			return true, nil
+		})
+	})
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, bw.Flush()
+}
@@ -0,0 +1,214 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sort"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// DuplicateOpts are the options of `Duplicator.CloneEntity`.
+type DuplicateOpts struct {
+	// Follow holds the names of the reference fields whose targets are
+	// cloned too, recursively, in whichever entity types they occur.
+	// References of the clones to entities that are cloned are
+	// remapped to the clones; other references are retained.
+	Follow []string
+
+	// Children makes the entities that refer to the cloned ones using
+	// reference fields whose `OnDelete` behaviour is `OnDeleteCascade`
+	// - those that they own - cloned too, recursively, referring to
+	// the clones.
+	Children bool
+}
+
+// EntityRef identifies an entity in a namespace.
+type EntityRef struct {
+	Type string // name of the entity type
+	ID   uint64 // ID of the entity
+}
+
+// Duplicator is implemented by entity types that can clone their
+// entities.
+type Duplicator interface {
+	// CloneEntity clones the entity having the given ID, and answers
+	// the ID of the clone, and the IDs of all the clones, by the
+	// entities that they clone.
+	CloneEntity(uint64, *DuplicateOpts) (uint64, map[EntityRef]uint64, error)
+}
+
+// CloneEntity stores a copy of the document having the given ID, under
+// a new ID, and answers the latter.  The clones of the instances of
+// time series are stored at the times of the originals, in the first
+// free nanoseconds following them.  `opts` may be `nil`; see
+// `DuplicateOpts` for cloning related entities too.  It also answers
+// the IDs of all the clones, by the entities that they clone.
+//
+// All the clones are stored in a single transaction.  They retain the
+// fields, schema versions and labels of the originals, but not their
+// provenance, expiry times or histories.  Soft-deleted and expired
+// entities are not cloned; nor are hooks and validation rules run.
+// The definitions of the other entity types reached are looked up in
+// the system catalogue.
+func (et *entityType) CloneEntity(id uint64, opts *DuplicateOpts) (uint64, map[EntityRef]uint64, error) {
+	if id == 0 {
+		return 0, nil, ErrIdentifierZero
+	}
+	if opts == nil {
+		opts = &DuplicateOpts{}
+	}
+	follow := append([]string(nil), opts.Follow...)
+	sort.Strings(follow)
+
+	now := et.db.now().UnixNano()
+	ids := make(map[EntityRef]uint64)
+	err := et.db.update(context.Background(), func(tx *storage.Tx) error {
+		types := map[string]*entityType{et.Name(): et}
+		typeOf := func(name string) (*entityType, error) {
+			t, ok := types[name]
+			if !ok {
+				ed, err := catalogueDefn(tx, name)
+				if err != nil {
+					return nil, err
+				}
+				t = &entityType{db: et.db, ns: et.ns, defn: ed}
+				types[name] = t
+			}
+			return t, nil
+		}
+
+		// Find the entities to clone, and their documents.
+		var order []EntityRef
+		docs := make(map[EntityRef]*Document)
+		queue := []EntityRef{{Type: et.Name(), ID: id}}
+		for len(queue) > 0 {
+			er := queue[0]
+			queue = queue[1:]
+			if _, ok := docs[er]; ok {
+				continue
+			}
+			t, err := typeOf(er.Type)
+			if err != nil {
+				return err
+			}
+			d, err := t.storedDoc(tx, er.ID, now)
+			if err != nil {
+				return err
+			}
+			if d == nil {
+				if len(order) == 0 {
+					return ErrIdentifierUnknown
+				}
+				continue
+			}
+			order = append(order, er)
+			docs[er] = d
+
+			rs := references(d)
+			for _, fid := range refFieldIDs(rs) {
+				fd, _ := t.defn.fieldByID(fid)
+				i := sort.SearchStrings(follow, fd.Name)
+				if i < len(follow) && follow[i] == fd.Name {
+					queue = append(queue, EntityRef{Type: rs[fid].target, ID: rs[fid].id})
+				}
+			}
+			if !opts.Children {
+				continue
+			}
+			err = tx.Referrers(et.ns.Name(), er.Type, er.ID, func(src string, sid uint64, fid uint8) (bool, error) {
+				st, err := typeOf(src)
+				if err != nil {
+					return false, err
+				}
+				if fd, ok := st.defn.fieldByID(fid); ok && fd.OnDelete == OnDeleteCascade {
+					queue = append(queue, EntityRef{Type: src, ID: sid})
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Assign the IDs of the clones - at the times of the originals,
+		// for time series - and store them.
+		taken := make(map[string]map[uint64]bool)
+		for _, er := range order {
+			if taken[er.Type] == nil {
+				taken[er.Type] = make(map[uint64]bool)
+			}
+			nid, err := types[er.Type].newID(tx, int64(er.ID), taken[er.Type])
+			if err != nil {
+				return err
+			}
+			ids[er] = nid
+			taken[er.Type][nid] = true
+		}
+		for _, er := range order {
+			d := docs[er]
+			for fid, r := range references(d) {
+				if nid, ok := ids[EntityRef{Type: r.target, ID: r.id}]; ok {
+					d.fields[fid].(*FieldReference).Set(nid)
+				}
+			}
+			d.id = ids[er]
+
+			t := types[er.Type]
+			by, err := t.encode(d)
+			if err != nil {
+				return err
+			}
+			_, err = t.store(tx, d.id, by, d, now, "")
+			if err != nil {
+				return err
+			}
+			err = tx.SetLabels(et.ns.Name(), er.Type, d.id, d.labels)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return ids[EntityRef{Type: et.Name(), ID: id}], ids, nil
+}
+
+// storedDoc answers the document having the given ID as stored, within
+// the given transaction, with its metadata, but without upgrading it;
+// `nil` if it does not exist, or is soft-deleted or expired as of the
+// given time.
+func (et *entityType) storedDoc(tx *storage.Tx, id uint64, now int64) (*Document, error) {
+	by, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil, nil
+		}
+		return nil, err
+	}
+	d := NewDocument(et.defn, id)
+	err = et.decode(by, d)
+	if err != nil {
+		return nil, err
+	}
+	et.readMeta(tx, d)
+	if d.deleted != 0 || d.expires != 0 && d.expires <= now {
+		return nil, nil
+	}
+	return d, nil
+}
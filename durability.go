@@ -0,0 +1,130 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+)
+
+// Durability determines when committed modifications are synced to
+// disk.  Until they are, they are lost if the machine - rather than
+// the process - crashes; so are the modifications since the last
+// sync, and the database may be corrupted.  Relaxed durability trades
+// that risk for much faster writes, in, say, bulk loads that can be
+// repeated.
+type Durability uint8
+
+// Durability levels.
+const (
+	// DurabilityFull syncs every transaction when it commits.  This
+	// is the default.
+	DurabilityFull Durability = iota
+	// DurabilityBatched syncs the database periodically, at
+	// `Options.SyncInterval`, rather than every transaction.
+	DurabilityBatched
+	// DurabilityNone syncs the database only when it is closed, or
+	// when durability is raised.
+	DurabilityNone
+)
+
+// defaultSyncInterval is the interval of periodic syncs, when none is
+// given.
+const defaultSyncInterval = time.Second
+
+// durabilityKey is the context key of the durability of operations.
+type durabilityKey struct{}
+
+// WithDurability answers a copy of the given context that makes the
+// modifications using it - such as those of `ContextEntityType` -
+// have the given durability, regardless of the level of the database.
+// Transactions that are not synced under `DurabilityBatched` and
+// `DurabilityNone` become durable when the database is next synced,
+// periodically or by any later transaction that is.
+func WithDurability(ctx context.Context, d Durability) context.Context {
+	return context.WithValue(ctx, durabilityKey{}, d)
+}
+
+// durabilityFrom answers the durability carried by the given context,
+// if any.
+func durabilityFrom(ctx context.Context) (Durability, bool) {
+	d, ok := ctx.Value(durabilityKey{}).(Durability)
+	return d, ok
+}
+
+// Durability answers the durability level set using this handle.
+func (db *DB) Durability() Durability {
+	db.dmutex.Lock()
+	defer db.dmutex.Unlock()
+
+	return db.durability
+}
+
+// SetDurability sets the durability level of the database, so that,
+// say, bulk loads can run with `DurabilityNone` and then switch back
+// to `DurabilityFull`, which syncs the database.  Since all handles
+// refer to the same database, the level set applies to all of them;
+// the periodic syncs of `DurabilityBatched` are made by this handle,
+// until it is closed or the level is changed.
+func (db *DB) SetDurability(d Durability) error {
+	if d > DurabilityNone {
+		return ErrDurabilityUnknown
+	}
+	db.dmutex.Lock()
+	defer db.dmutex.Unlock()
+
+	err := db.sdb.SetNoSync(d != DurabilityFull)
+	if err != nil {
+		return err
+	}
+	if db.syncStop != nil {
+		close(db.syncStop)
+		db.syncStop = nil
+	}
+	if d == DurabilityBatched {
+		interval := db.opts.SyncInterval
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		db.syncStop = make(chan struct{})
+		go db.syncer(interval, db.syncStop)
+	}
+	db.durability = d
+	return nil
+}
+
+// Sync syncs the database to disk, making all the committed
+// modifications durable.
+func (db *DB) Sync() error {
+	return db.sdb.Sync()
+}
+
+// syncer syncs the database at the given interval, until the given
+// channel is closed.  Errors are logged; the next sync retries.
+func (db *DB) syncer(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := db.sdb.Sync()
+			if err != nil {
+				logMsg(LogWarn, "syncing the database failed", LogField{"error", err})
+			}
+		}
+	}
+}
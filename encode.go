@@ -0,0 +1,161 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"io"
+	"math"
+
+	"github.com/golang/snappy"
+)
+
+// Entities are serialised by appending to a single byte slice, whose
+// capacity is the exact length of the serialised entity, computed in
+// advance by the codec.  The serialised entity is then passed through
+// the post-processing stages in `encodeStages`, each of which can
+// transform it, say, by compressing it, or by adding a checksum.
+
+// encodeStage post-processes the given serialised form of the given
+// document, answering its transformed form.  Stages may modify the
+// given slice in place.
+type encodeStage func(d *Document, by []byte) ([]byte, error)
+
+// encodeStages are applied, in order, to serialised entities.
+var encodeStages = []encodeStage{
+	compressStage,
+}
+
+// compressStage wraps the given serialised form in a compressed
+// envelope, if so configured, and if doing so makes it smaller.  See
+// `EntityTypeDefn.SetCompressAbove`.
+func compressStage(d *Document, by []byte) ([]byte, error) {
+	n := d.defn.CompressAbove()
+	if n <= 0 || len(by) <= n {
+		return by, nil
+	}
+
+	z := make([]byte, 1+snappy.MaxEncodedLen(len(by)))
+	z[0] = envelopeCompressed
+	l := len(snappy.Encode(z[1:], by))
+	if 1+l >= len(by) {
+		return by, nil
+	}
+	return z[:1+l], nil
+}
+
+// fieldSize answers the length of the data that the given field's
+// `WriteTo` writes.
+func fieldSize(f Field) int {
+	switch f := f.(type) {
+	case *FieldBool, *FieldInt8, *FieldUint8:
+		return 1
+	case *FieldInt16, *FieldUint16:
+		return 2
+	case *FieldInt32, *FieldUint32, *FieldFloat32:
+		return 4
+	case *FieldInt64, *FieldUint64, *FieldFloat64, *FieldReference:
+		return 8
+	case *FieldTime:
+		return timeLenFixed
+	case *FieldString:
+		return 2 + len(f.Get())
+	default:
+		return 0
+	}
+}
+
+// appendField appends the data of the given field, as its `WriteTo`
+// writes them, to the given slice.
+func appendField(by []byte, f Field) ([]byte, error) {
+	switch f := f.(type) {
+	case *FieldBool:
+		return append(by, f.value), nil
+	case *FieldInt8:
+		return append(by, byte(f.value)), nil
+	case *FieldInt16:
+		return appendUint(by, uint64(f.value), 2), nil
+	case *FieldInt32:
+		return appendUint(by, uint64(f.value), 4), nil
+	case *FieldInt64:
+		return appendUint(by, uint64(f.value), 8), nil
+	case *FieldUint8:
+		return append(by, f.value), nil
+	case *FieldUint16:
+		return appendUint(by, uint64(f.value), 2), nil
+	case *FieldUint32:
+		return appendUint(by, uint64(f.value), 4), nil
+	case *FieldUint64:
+		return appendUint(by, f.value, 8), nil
+	case *FieldFloat32:
+		return appendUint(by, uint64(math.Float32bits(f.value)), 4), nil
+	case *FieldFloat64:
+		return appendUint(by, math.Float64bits(f.value), 8), nil
+	case *FieldTime:
+		_, off := f.value.Zone()
+		by = append(by, timeTagFixed)
+		by = appendUint(by, uint64(f.value.Unix()), 8)
+		by = appendUint(by, uint64(f.value.Nanosecond()), 4)
+		return appendUint(by, uint64(uint32(int32(off))), 4), nil
+	case *FieldString:
+		if len(f.value) > 65535 {
+			return by, ErrStringTooLong
+		}
+		by = appendUint(by, uint64(len(f.value)), 2)
+		return append(by, f.value...), nil
+	case *FieldReference:
+		return appendUint(by, f.value, 8), nil
+	default:
+		return by, ErrFieldTypeUnsupported
+	}
+}
+
+// writeField writes the data of the given field to the given writer.
+// It implements the `WriteTo` methods of fields.
+func writeField(w io.Writer, f Field) (int64, error) {
+	var buf [timeLenFixed]byte
+	by, err := appendField(buf[:0], f)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(by)
+	return int64(n), err
+}
+
+// appendUint appends the given number of low-order bytes of the given
+// unsigned integer, at most eight, in big-endian order, to the given
+// slice.
+func appendUint(by []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		by = append(by, byte(v>>(8*uint(i))))
+	}
+	return by
+}
+
+// uvarintLen answers the length of the given unsigned integer, encoded
+// as a uvarint.
+func uvarintLen(n uint64) int {
+	l := 1
+	for ; n >= 0x80; n >>= 7 {
+		l++
+	}
+	return l
+}
+
+// varintLen answers the length of the given integer, encoded as a
+// zigzag varint.
+func varintLen(n int64) int {
+	return uvarintLen(uint64(n<<1) ^ uint64(n>>63))
+}
@@ -0,0 +1,128 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCompressStage(t *testing.T) {
+	noise := make([]byte, 600)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	tests := []struct {
+		name       string
+		above      int
+		val        string
+		compressed bool
+	}{
+		{"disabled", 0, strings.Repeat("abc", 200), false},
+		{"below threshold", 1000, strings.Repeat("abc", 200), false},
+		{"above threshold", 100, strings.Repeat("abc", 200), true},
+		{"incompressible", 100, string(noise), false},
+		{"empty", 1, "", false},
+	}
+
+	for _, tc := range tests {
+		ed, err := NewEntityTypeDefn("compress")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ed.AddField("text", FieldTypeString)
+		ed.SetCodec(CodecMsgpack)
+		ed.SetCompressAbove(tc.above)
+
+		d := NewDocument(ed, 1)
+		f, _ := d.Field("text")
+		f.(*FieldString).Set(tc.val)
+		by, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (by[0] == envelopeCompressed) != tc.compressed {
+			t.Fatalf("%s: tag %#x", tc.name, by[0])
+		}
+		if tc.compressed {
+			plain, err := snappy.Decode(nil, by[1:])
+			if err != nil || plain[0] != byte(ed.Codec()) || len(by) >= len(plain) {
+				t.Fatalf("%s: envelope of %d bytes holds %d, %v", tc.name, len(by), len(plain), err)
+			}
+		}
+
+		d2 := NewDocument(ed, 1)
+		if err := d2.UnmarshalBinary(by); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		f2, _ := d2.Field("text")
+		if f2.(*FieldString).Get() != tc.val {
+			t.Errorf("%s: value not read back", tc.name)
+		}
+	}
+}
+
+func TestCompressedEnvelopeInvalid(t *testing.T) {
+	ed, err := NewEntityTypeDefn("compress_bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed.AddField("text", FieldTypeString)
+	d := NewDocument(ed, 1)
+
+	tests := []struct {
+		name string
+		by   []byte
+		err  error
+	}{
+		{"not snappy", []byte{envelopeCompressed, 0xff, 0xff}, ErrPayloadInvalid},
+		{"empty payload", append([]byte{envelopeCompressed}, snappy.Encode(nil, nil)...), ErrPayloadInvalid},
+		{"unknown codec", append([]byte{envelopeCompressed}, snappy.Encode(nil, []byte{0x7f})...), ErrCodecUnknown},
+	}
+	for _, tc := range tests {
+		if err := d.UnmarshalBinary(tc.by); err != tc.err {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestCompressedStorage(t *testing.T) {
+	ns := testNamespace(t, "compress_ns")
+	ed := testDefn(t, "compress_st", []testField{{"text", FieldTypeString}}, func(ed *EntityTypeDefn) {
+		ed.SetCodec(CodecMsgpack)
+		ed.SetCompressAbove(64)
+	})
+	et := testDB.EntityType(ns, ed)
+
+	val := strings.Repeat("flagon ", 100)
+	d := testDoc(t, ed, 0, map[string]interface{}{"text": val})
+	if err := et.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	if by := storedForm(t, ns, ed, d.ID()); by[0] != envelopeCompressed || len(by) >= len(val) {
+		t.Fatalf("stored form: tag %#x, %d bytes", by[0], len(by))
+	}
+
+	e, err := et.Get(d.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := e.(*Document).Field("text")
+	if f.(*FieldString).Get() != val {
+		t.Fatal("value not read back")
+	}
+}
@@ -0,0 +1,257 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Schema declares entity types, and the canonical reference data -
+// such as country codes, currencies and statuses - that they hold.
+// Its JSON form is a schema file:
+//
+//	{
+//	  "entity_types": [ <entity type definition>, ... ],
+//	  "seeds": [
+//	    {"entity_type": "currency", "rows": [
+//	      {"id": 1, "fields": {"code": "EUR", "name": "Euro"}},
+//	      ...
+//	    ]},
+//	    ...
+//	  ]
+//	}
+//
+// Entity type definitions are in the form answered by their
+// `MarshalJSON`.  See `EnsureSchema`.
+type Schema struct {
+	EntityTypes []*EntityTypeDefn `json:"entity_types"`
+	Seeds       []Seed            `json:"seeds,omitempty"`
+}
+
+// Seed declares the canonical instances of an entity type.
+type Seed struct {
+	Type string    `json:"entity_type"` // name of the entity type
+	Rows []SeedRow `json:"rows"`
+}
+
+// SeedRow declares a canonical instance.  Its ID is stable, so that
+// reference fields can name it.
+type SeedRow struct {
+	ID     uint64                     `json:"id"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+// ReadSchema reads a schema file from the given reader.
+func ReadSchema(r io.Reader) (*Schema, error) {
+	s := &Schema{}
+	err := json.NewDecoder(r).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EnsureReport describes the changes made by `EnsureSchema`.
+type EnsureReport struct {
+	Saved     []string // entity types saved in the catalogue
+	Written   uint64   // seed rows created or updated
+	Unchanged uint64   // seed rows already as declared
+}
+
+// EnsureSchema brings the given namespace in line with the given
+// schema, idempotently.  Declared entity types that are new, or differ
+// from their definitions in the system catalogue, are saved; they
+// retain the IDs of the latter.  A declared definition should not
+// remove a field of the one in the catalogue, or change its ID, type
+// or target; else, it answers `ErrSchemaConflict`, before saving
+// anything.
+//
+// The declared seed rows are then upserted, in order, under their IDs:
+// missing rows are created, and rows differing from their declarations
+// are updated.  Rows of entity types not declared in the schema use
+// the definitions in the catalogue.  The sequences of the entity types
+// are raised past the IDs of their rows, so that new IDs do not
+// collide with them.  Hence, reference fields can always name the
+// rows, even in fresh environments.
+//
+// Running this is recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) EnsureSchema(ns *Namespace, s *Schema) (EnsureReport, error) {
+	start := time.Now()
+	rep, err := db.ensureSchema(ns, s)
+	params := map[string]interface{}{"saved": rep.Saved, "written": rep.Written, "unchanged": rep.Unchanged}
+	db.logAdmin(context.Background(), AdminEnsureSchema, ns.Name(), "", params, start, err)
+	return rep, err
+}
+
+// ensureSchema implements `EnsureSchema`.
+func (db *DB) ensureSchema(ns *Namespace, s *Schema) (EnsureReport, error) {
+	var rep EnsureReport
+	defns, err := db.defnsByName()
+	if err != nil {
+		return rep, err
+	}
+
+	var save []*EntityTypeDefn
+	for _, ed := range s.EntityTypes {
+		cur, ok := defns[ed.Name()]
+		if !ok {
+			save = append(save, ed)
+			continue
+		}
+		err = checkCompatible(cur, ed)
+		if err != nil {
+			return rep, err
+		}
+		ed.mutex.Lock()
+		ed.id = cur.id
+		ed.mutex.Unlock()
+
+		a, err := json.Marshal(cur)
+		if err != nil {
+			return rep, err
+		}
+		b, err := json.Marshal(ed)
+		if err != nil {
+			return rep, err
+		}
+		if !bytes.Equal(a, b) {
+			save = append(save, ed)
+		}
+	}
+	for _, ed := range save {
+		err = db.SaveEntityTypeDefn(ed)
+		if err != nil {
+			return rep, err
+		}
+		rep.Saved = append(rep.Saved, ed.Name())
+	}
+	for _, ed := range s.EntityTypes {
+		defns[ed.Name()] = ed
+	}
+
+	for _, sd := range s.Seeds {
+		ed, ok := defns[sd.Type]
+		if !ok {
+			return rep, ErrNameUnknown
+		}
+		err = db.seed(&entityType{db: db, ns: ns, defn: ed}, sd.Rows, &rep)
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	return rep, nil
+}
+
+// checkCompatible answers `ErrSchemaConflict` if the given declared
+// definition removes a field of the given current one, or changes its
+// ID, type or target.
+func checkCompatible(cur, ed *EntityTypeDefn) error {
+	for _, fd := range cur.Fields() {
+		nfd, err := ed.Field(fd.Name)
+		if err != nil || nfd.ID != fd.ID || nfd.Ftype != fd.Ftype || nfd.Target != fd.Target {
+			return ErrSchemaConflict
+		}
+	}
+	return nil
+}
+
+// seed upserts the given rows of the given entity type, counting them
+// in the given report.
+func (db *DB) seed(et *entityType, rows []SeedRow, rep *EnsureReport) error {
+	docs := make([]*Document, len(rows))
+	var max uint64
+	for i, r := range rows {
+		if r.ID == 0 {
+			return ErrIdentifierZero
+		}
+		by, err := json.Marshal(documentJSON{ID: r.ID, Type: et.Name(), Fields: r.Fields})
+		if err != nil {
+			return err
+		}
+		d := NewDocument(et.defn, r.ID)
+		err = d.UnmarshalJSON(by)
+		if err != nil {
+			return err
+		}
+		docs[i] = d
+		if r.ID > max {
+			max = r.ID
+		}
+	}
+
+	err := db.sdb.Update(func(tx *storage.Tx) error {
+		return tx.ReserveSequence(et.ns.Name(), et.Name(), max)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range docs {
+		cur, err := et.Get(d.ID())
+		switch {
+		case err == nil:
+			same, err := sameDocument(cur.(*Document), d)
+			if err != nil {
+				return err
+			}
+			if same {
+				rep.Unchanged++
+				continue
+			}
+		case errors.Is(err, ErrIdentifierUnknown):
+		default:
+			return err
+		}
+
+		err = et.Put(d)
+		if err != nil {
+			return err
+		}
+		rep.Written++
+	}
+
+	return nil
+}
+
+// sameDocument answers `true` if the given documents have the same
+// fields.
+func sameDocument(a, b *Document) (bool, error) {
+	x, err := a.fieldsJSON()
+	if err != nil {
+		return false, err
+	}
+	y, err := b.fieldsJSON()
+	if err != nil {
+		return false, err
+	}
+	if len(x) != len(y) {
+		return false, nil
+	}
+	for name, v := range x {
+		if !bytes.Equal(v, y[name]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
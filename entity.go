@@ -17,9 +17,11 @@ package flagon
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 // CompOp enumerates the possible comparison operators that can be
@@ -57,6 +59,37 @@ type SearchOpts struct {
 	// particularly for large entities.  `nil` deserialises the entire
 	// object, and is hence expensive.
 	Fields []int
+	// Maximum number of entities to scan; `0` for unlimited.  A search
+	// that would scan more answers `ErrScanLimit`.
+	MaxScanned uint64
+	// Stats, if not `nil`, receives the cost of the search.
+	Stats *SearchStats
+	// IncludeDeleted makes soft-deleted entities available to the
+	// predicate.  See `SoftDeleter`.
+	IncludeDeleted bool
+
+	orderBy string // field by whose values results are ordered, if any
+	desc    bool   // order results in the descending order of values?
+	stop    *bool  // set to stop the search early, if given
+	noCopy  bool   // decode strings without copying them?
+}
+
+// OrderBy answers a copy of these options that orders the results of
+// a search by the values of the given field, ascending or descending,
+// rather than by their IDs.  See `Search`.
+func (opts SearchOpts) OrderBy(field string, ascending bool) SearchOpts {
+	opts.orderBy = field
+	opts.desc = !ascending
+	return opts
+}
+
+// SearchStats reports the cost of a search, so that it can be charged
+// against budgets.
+type SearchStats struct {
+	Scanned      uint64 // number of entities scanned
+	BytesDecoded uint64 // total size of the stored forms decoded
+
+	last uint64 // ID of the last entity scanned
 }
 
 // EntityKey holds the globally-unique ID of an instance within its
@@ -77,7 +110,7 @@ func (k EntityKey) Key() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, 8))
 	err := binary.Write(buf, binary.BigEndian, k.id)
 	if err != nil {
-		log.Printf("error writing key: %s", err)
+		logMsg(LogError, "writing key failed", LogField{"id", k.id}, LogField{"error", err})
 		return nil
 	}
 
@@ -117,18 +150,32 @@ type EntityType interface {
 	// Name answers the user-defined name of this entity type.
 	Name() string
 	// Get looks up the table for the entity having the given ID, and
-	// answers the same if found.
+	// answers the same if found.  Otherwise, it answers an error that
+	// is an `ErrNotFound`.
 	Get(uint64) (Entity, error)
 	// Put creates - or updates - the given entity in the table.
 	Put(Entity) error
 	// Delete removes the entity having the given ID from the table,
-	// if found.
+	// if found.  Otherwise, it answers an error that is an
+	// `ErrNotFound`.
 	Delete(uint64) error
 	// Search iterates through the table, passing each (key, entity)
 	// tuple to the provided predicate.
 	Search(SearchOpts, SearchFn) ([]uint64, error)
 }
 
+// VersionedEntityType is implemented by entity types that support
+// optimistic concurrency control.  Every stored entity has a version,
+// that is incremented each time it is stored.
+type VersionedEntityType interface {
+	EntityType
+
+	// PutIfVersion creates - or updates - the given entity in the
+	// table, only if its stored version is the given one; `0` if it
+	// should not exist.  Otherwise, it answers `ErrVersionConflict`.
+	PutIfVersion(Entity, uint64) error
+}
+
 // EntityTypeDefn captures the necessary information for defining and
 // dealing with instances of specific entity types.
 //
@@ -142,16 +189,29 @@ type EntityTypeDefn struct {
 	name   string               // unique name of this entity type
 	mutex  sync.RWMutex         // to protect fields
 	fields map[string]FieldDefn // recognised fields of this entity type
+	codec  CodecID              // codec used to serialise new instances
+	zabove int                  // compress payloads larger than this; 0 = never
+	maxsz  int                  // maximum stored payload size; 0 = none
+	rules  []rule               // validation rules, in order of evaluation
+	idxs   []Index              // secondary indexes, in order of addition
+	schema uint32               // schema version of new instances
+	hist   bool                 // retain the versions of instances?
+	csize  int                  // instances cached per namespace; 0 = none
+	ts     bool                 // IDs of new instances are their times?
+	retain time.Duration        // age at which time-series instances are removed; 0 = never
+
+	migrations map[uint32]MigrationFn // by target schema version
+	computed   map[uint8]ComputeFn    // by ID of derived field
 }
 
 // NewEntityTypeDefn creates an in-memory definition for a new entity
 // type with the given name.
 func NewEntityTypeDefn(name string) (*EntityTypeDefn, error) {
-	if !nameRegexp.MatchString(name) {
-		return nil, ErrNameInvalid
+	if err := validName(name); err != nil {
+		return nil, err
 	}
 
-	ed := &EntityTypeDefn{name: name, fields: make(map[string]FieldDefn, 2)}
+	ed := &EntityTypeDefn{name: name, fields: make(map[string]FieldDefn, 2), codec: CodecFramed}
 	return ed, nil
 }
 
@@ -165,11 +225,96 @@ func (ed *EntityTypeDefn) Name() string {
 	return ed.name
 }
 
+// Codec answers the codec used to serialise instances of this entity
+// type.
+func (ed *EntityTypeDefn) Codec() CodecID {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.codec
+}
+
+// SetCodec sets the codec to be used to serialise instances of this
+// entity type.  Since every serialised instance records its codec,
+// existing instances remain readable; they are re-encoded using the
+// new codec when they are next stored.
+func (ed *EntityTypeDefn) SetCodec(c CodecID) error {
+	if _, ok := codecs[c]; !ok {
+		return ErrCodecUnknown
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.codec = c
+	return nil
+}
+
+// CompressAbove answers the payload size in bytes, above which
+// instances of this entity type are compressed; `0` if compression is
+// disabled.
+func (ed *EntityTypeDefn) CompressAbove() int {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.zabove
+}
+
+// SetCompressAbove enables compression of those instances of this
+// entity type, whose serialised size exceeds the given number of
+// bytes.  `0` disables compression.  Instances that do not shrink on
+// compression are stored uncompressed.  As with codecs, changing this
+// does not affect the readability of existing instances.
+func (ed *EntityTypeDefn) SetCompressAbove(n int) {
+	if n < 0 {
+		n = 0
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.zabove = n
+}
+
+// KeepsHistory answers `true` if the versions of the instances of this
+// entity type are retained.  See `HistoryEntityType`.
+func (ed *EntityTypeDefn) KeepsHistory() bool {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.hist
+}
+
+// SetKeepHistory sets whether the versions of the instances of this
+// entity type are retained, from when they are next stored or
+// deleted.  Retained versions are never removed.
+func (ed *EntityTypeDefn) SetKeepHistory(keep bool) {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.hist = keep
+}
+
 // AddField adds a new field to this entity type using the given
-// details.
+// details.  Reference fields should be added using `AddReference`.
 func (ed *EntityTypeDefn) AddField(name string, ftype FieldType) error {
-	if !nameRegexp.MatchString(name) {
-		return ErrNameInvalid
+	if ftype == FieldTypeReference {
+		return ErrReferenceTarget
+	}
+	return ed.addField(name, ftype, "")
+}
+
+// AddReference adds a new field to this entity type, which refers to
+// instances of the given target entity type.
+func (ed *EntityTypeDefn) AddReference(name string, target string) error {
+	if validName(target) != nil {
+		return ErrReferenceTarget
+	}
+	return ed.addField(name, FieldTypeReference, target)
+}
+
+// addField adds a new field having the given details.
+func (ed *EntityTypeDefn) addField(name string, ftype FieldType, target string) error {
+	if err := validName(name); err != nil {
+		return err
 	}
 	if !IsValidFieldType(ftype) {
 		return ErrFieldTypeUnknown
@@ -182,11 +327,42 @@ func (ed *EntityTypeDefn) AddField(name string, ftype FieldType) error {
 	}
 
 	n := len(ed.fields)
-	fd := FieldDefn{Ftype: ftype, ID: uint8(n + 1), Name: name}
+	fd := FieldDefn{Ftype: ftype, ID: uint8(n + 1), Name: name, Target: target}
+	ed.fields[name] = fd
+	return nil
+}
+
+// SetImmutable marks the given field as immutable: once set, it can
+// not be changed or cleared.  Storing a document that does so answers
+// an `*ImmutableFieldError`.  Like fields, this can not be undone.
+func (ed *EntityTypeDefn) SetImmutable(name string) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	fd, ok := ed.fields[name]
+	if !ok {
+		return ErrNameUnknown
+	}
+	fd.Immutable = true
 	ed.fields[name] = fd
 	return nil
 }
 
+// immutableFields answers the definitions of the immutable fields of
+// this entity type.
+func (ed *EntityTypeDefn) immutableFields() []FieldDefn {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	var res []FieldDefn
+	for _, fd := range ed.fields {
+		if fd.Immutable {
+			res = append(res, fd)
+		}
+	}
+	return res
+}
+
 // Field answers the definition for the given field, if found.
 func (ed *EntityTypeDefn) Field(name string) (FieldDefn, error) {
 	ed.mutex.RLock()
@@ -199,6 +375,35 @@ func (ed *EntityTypeDefn) Field(name string) (FieldDefn, error) {
 	return FieldDefn{}, ErrNameUnknown
 }
 
+// fieldByID answers the definition of the field having the given ID,
+// if found.
+func (ed *EntityTypeDefn) fieldByID(id uint8) (FieldDefn, bool) {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	for _, fd := range ed.fields {
+		if fd.ID == id {
+			return fd, true
+		}
+	}
+
+	return FieldDefn{}, false
+}
+
+// hasReferences answers `true` if this entity type has reference
+// fields.
+func (ed *EntityTypeDefn) hasReferences() bool {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	for _, fd := range ed.fields {
+		if fd.Ftype == FieldTypeReference {
+			return true
+		}
+	}
+	return false
+}
+
 // Fields answers a copy of the field definitions of this entity type.
 func (ed *EntityTypeDefn) Fields() []FieldDefn {
 	ed.mutex.RLock()
@@ -212,3 +417,155 @@ func (ed *EntityTypeDefn) Fields() []FieldDefn {
 
 	return res
 }
+
+// projectFields answers the definitions of the given fields of the
+// given entity type, in the given order; of all its fields, in the
+// ascending order of their IDs, if none are given.  It answers
+// `ErrNameUnknown` if a given field is not defined.
+func projectFields(ed *EntityTypeDefn, names []string) ([]FieldDefn, error) {
+	if len(names) == 0 {
+		fds := ed.Fields()
+		sort.Sort(fieldDefnsByID(fds))
+		return fds, nil
+	}
+
+	fds := make([]FieldDefn, 0, len(names))
+	for _, name := range names {
+		fd, err := ed.Field(name)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// entityTypeDefnJSON is the serialisable form of an entity type
+// definition.
+type entityTypeDefnJSON struct {
+	ID     uint16      `json:"id"`
+	Name   string      `json:"name"`
+	Fields []FieldDefn `json:"fields"`
+	Codec  CodecID     `json:"codec,omitempty"`
+	ZAbove int         `json:"compress_above,omitempty"`
+	Rules  []Rule      `json:"rules,omitempty"`
+	Idxs   []Index     `json:"indexes,omitempty"`
+	Schema uint32      `json:"schema_version,omitempty"`
+	Hist   bool        `json:"keep_history,omitempty"`
+	MaxSz  int         `json:"max_size,omitempty"`
+	TS     bool        `json:"time_series,omitempty"`
+	Retain int64       `json:"retention,omitempty"`
+}
+
+// MarshalJSON conforms to `json.Marshaler`.  Fields are serialised in
+// the ascending order of their IDs.
+func (ed *EntityTypeDefn) MarshalJSON() ([]byte, error) {
+	fs := ed.Fields()
+	sort.Sort(fieldDefnsByID(fs))
+
+	return json.Marshal(entityTypeDefnJSON{
+		ID:     ed.id,
+		Name:   ed.name,
+		Fields: fs,
+		Codec:  ed.Codec(),
+		ZAbove: ed.CompressAbove(),
+		Rules:  ed.Rules(),
+		Idxs:   ed.Indexes(),
+		Schema: ed.SchemaVersion(),
+		Hist:   ed.KeepsHistory(),
+		MaxSz:  ed.MaxSize(),
+		TS:     ed.TimeSeries(),
+		Retain: int64(ed.Retention()),
+	})
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.  The given definition
+// is validated in the same manner as definitions constructed
+// programmatically.  Registered migrations and compute functions, and
+// the cache size, are retained.
+func (ed *EntityTypeDefn) UnmarshalJSON(by []byte) error {
+	var v entityTypeDefnJSON
+	err := json.Unmarshal(by, &v)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(v.Name); err != nil {
+		return err
+	}
+	fields := make(map[string]FieldDefn, len(v.Fields))
+	ids := make(map[uint8]bool, len(v.Fields))
+	for _, fd := range v.Fields {
+		if err := validName(fd.Name); err != nil {
+			return err
+		}
+		if !IsValidFieldType(fd.Ftype) {
+			return ErrFieldTypeUnknown
+		}
+		if fd.ID == 0 {
+			return ErrIdentifierZero
+		}
+		if (fd.Ftype == FieldTypeReference) != (fd.Target != "") ||
+			fd.Target != "" && validName(fd.Target) != nil ||
+			fd.OnDelete != OnDeleteNone && fd.Ftype != FieldTypeReference {
+			return ErrReferenceTarget
+		}
+		if _, ok := fields[fd.Name]; ok || ids[fd.ID] {
+			return ErrNameExists
+		}
+		fields[fd.Name] = fd
+		ids[fd.ID] = true
+	}
+	if v.Retain < 0 {
+		return ErrRetentionInvalid
+	}
+	if v.Codec == 0 {
+		v.Codec = CodecBinary
+	}
+	if _, ok := codecs[v.Codec]; !ok {
+		return ErrCodecUnknown
+	}
+	rules := make([]rule, 0, len(v.Rules))
+	names := make(map[string]bool, len(v.Rules))
+	for _, r := range v.Rules {
+		if names[r.Name] {
+			return ErrNameExists
+		}
+		cr, err := compileRule(r, fields)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, cr)
+		names[r.Name] = true
+	}
+	idxs := make([]Index, 0, len(v.Idxs))
+	names = make(map[string]bool, len(v.Idxs))
+	for _, ix := range v.Idxs {
+		if names[ix.Name] {
+			return ErrNameExists
+		}
+		err := checkIndex(ix, fields)
+		if err != nil {
+			return err
+		}
+		idxs = append(idxs, ix)
+		names[ix.Name] = true
+	}
+
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.id = v.ID
+	ed.name = v.Name
+	ed.fields = fields
+	ed.codec = v.Codec
+	ed.zabove = v.ZAbove
+	ed.rules = rules
+	ed.idxs = idxs
+	ed.schema = v.Schema
+	ed.hist = v.Hist
+	ed.maxsz = v.MaxSz
+	ed.ts = v.TS
+	ed.retain = time.Duration(v.Retain)
+	return nil
+}
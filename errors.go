@@ -17,6 +17,36 @@ package flagon
 import (
 	"errors"
 	"fmt"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Categories of errors.  Errors answered by `flagon` that belong to a
+// category answer `true` to `errors.Is` with it, so that callers can
+// handle failures by their kinds, rather than by the specific errors.
+var (
+	// ErrNotFound is the category of errors answered when a requested
+	// namespace, entity type, entity or other item does not exist.
+	ErrNotFound = storage.ErrNotFound
+
+	// ErrConflict is the category of errors answered when an
+	// operation conflicts with the current state of the database,
+	// such as an existing name, a stored version or references.
+	ErrConflict = storage.ErrConflict
+
+	// ErrValidation is the category of errors answered when an entity
+	// or a field value is not acceptable.  See `ValidationError`.
+	ErrValidation = errors.New("validation failed")
+
+	// ErrCorrupt is the category of errors answered when stored,
+	// exported or replicated data are damaged.
+	ErrCorrupt = storage.ErrCorrupt
+
+	// ErrReadOnly is the category of errors answered when an attempt
+	// is made to modify data that can only be read, such as those of
+	// read-only databases and frozen entity types.  Read-only views
+	// answer it as such.
+	ErrReadOnly = storage.ErrReadOnly
 )
 
 var (
@@ -25,26 +55,348 @@ var (
 	ErrNameEmpty = errors.New("empty name given")
 
 	// ErrNameInvalid is answered when the given name does not conform
-	// to naming rules of `flagon`.
-	ErrNameInvalid = fmt.Errorf("name should conform to `%s`", nameRegexp.String())
+	// to the naming policy in use.  See `NamePolicy`.
+	ErrNameInvalid = errors.New("name does not conform to the naming policy")
+
+	// ErrNameTooLong is answered when the given name is longer than
+	// allowed.  See `MaxNameLen`.
+	ErrNameTooLong = errors.New("name too long")
 
 	// ErrNameExists is answered when a unique name was expected, but
 	// an existing name was provided.
-	ErrNameExists = errors.New("name already exists")
+	ErrNameExists = storage.NewError("name already exists", ErrConflict)
 
 	// ErrNameUnknown is answered when an existing name was expected,
 	// but an unknown name was provided.
-	ErrNameUnknown = errors.New("unknown name given")
+	ErrNameUnknown = storage.NewError("unknown name given", ErrNotFound)
 )
 
 var (
 	// ErrFieldTypeUnknown is answered when an unrecognised field type
 	// is specified when defining a field.
 	ErrFieldTypeUnknown = errors.New("unknown field type specified")
+
+	// ErrFieldTypeUnsupported is answered when a field of a
+	// recognised type, for which no field implementation is
+	// available yet, is requested.
+	ErrFieldTypeUnsupported = errors.New("field type is not supported yet")
+
+	// ErrStringTooLong is answered when a string value exceeds the
+	// maximum length of a string field.
+	ErrStringTooLong = storage.NewError("string length exceeds maximum limit of 65535", ErrValidation)
+
+	// ErrFieldValueType is answered when a value of a type that does
+	// not match the field's type is given.
+	ErrFieldValueType = storage.NewError("value type does not match field type", ErrValidation)
+
+	// ErrFieldValueRange is answered when a numeric value that can
+	// not be represented in the field's type is given.
+	ErrFieldValueRange = storage.NewError("value out of range of field type", ErrValidation)
+
+	// ErrReferenceTarget is answered when a reference field is defined
+	// without a valid target entity type name, or another field is
+	// defined with one, or with an `OnDelete` behaviour.
+	ErrReferenceTarget = errors.New("invalid reference target")
+)
+
+var (
+	// ErrCodecUnknown is answered when an unrecognised codec is
+	// specified, or is found in a serialised entity.
+	ErrCodecUnknown = errors.New("unknown codec")
+
+	// ErrPayloadInvalid is answered when a serialised entity can not
+	// be decoded.
+	ErrPayloadInvalid = storage.NewError("invalid entity payload", ErrCorrupt)
+
+	// ErrKeyUnavailable is answered when the key needed to decrypt an
+	// entity is not available.
+	ErrKeyUnavailable = errors.New("encryption key not available")
+
+	// ErrKeyConflict is answered when both a key and a key provider
+	// are given when opening the database.
+	ErrKeyConflict = errors.New("both a key and a key provider given")
 )
 
 var (
 	// ErrIdentifierZero is answered when an ID was expected, but a
 	// zero value was provided.
 	ErrIdentifierZero = errors.New("zero ID value given")
+
+	// ErrIdentifierOverflow is answered when no more unique IDs can
+	// be assigned.
+	ErrIdentifierOverflow = errors.New("unique IDs exhausted")
+
+	// ErrIdentifierUnknown is answered when an entity having the
+	// given ID does not exist.
+	ErrIdentifierUnknown = storage.NewError("unknown ID given", ErrNotFound)
+)
+
+var (
+	// ErrEntityTypeMismatch is answered when an entity of a type
+	// other than the expected one is given.
+	ErrEntityTypeMismatch = errors.New("entity is not of the expected type")
+
+	// ErrVersionConflict is answered when an entity is stored
+	// conditionally, but its stored version differs from the expected
+	// one, since another writer has intervened.
+	ErrVersionConflict = storage.NewError("entity version conflict", ErrConflict)
+
+	// ErrProvenanceInvalid is answered when a provenance without a
+	// batch ID, or having a batch ID or a source longer than 255
+	// bytes, is given.
+	ErrProvenanceInvalid = errors.New("invalid provenance")
+
+	// ErrExpiryInvalid is answered when an expiry time before the
+	// epoch is given.
+	ErrExpiryInvalid = errors.New("invalid expiry time")
+
+	// ErrNotTimeSeries is answered when time-series operations are
+	// used on an entity type that is not a time series.  See
+	// `EntityTypeDefn.SetTimeSeries`.
+	ErrNotTimeSeries = errors.New("entity type is not a time series")
+
+	// ErrTimeInvalid is answered when a time-series entity is given a
+	// time before the epoch, or when a time series is downsampled at
+	// an interval that is not positive.
+	ErrTimeInvalid = errors.New("invalid time-series time or interval")
+
+	// ErrRetentionInvalid is answered when a negative retention period
+	// is given.
+	ErrRetentionInvalid = errors.New("invalid retention period")
+
+	// ErrLabelInvalid is answered when a malformed label, or more
+	// labels than an entity can have, are given.
+	ErrLabelInvalid = errors.New("invalid label")
+
+	// ErrSelectorInvalid is answered when a label selector can not be
+	// parsed.
+	ErrSelectorInvalid = errors.New("invalid label selector")
+
+	// ErrSchemaVersion is answered when a schema version is
+	// decreased, or a migration to version `0`, or a second migration
+	// to a version, is registered.
+	ErrSchemaVersion = errors.New("invalid schema version")
+
+	// ErrSchemaConflict is answered when a declared entity type
+	// definition removes a field of the definition in the system
+	// catalogue, or changes its ID, type or target.  It is also
+	// answered when a loaded catalogue gives an entity type an ID
+	// other than its ID in the system catalogue, or one taken by
+	// another entity type.
+	ErrSchemaConflict = storage.NewError("schema conflicts with the catalogue", ErrConflict)
+
+	// ErrCatalogueVersion is answered when a catalogue of an unknown
+	// format version is loaded.  See `LoadCatalogue`.
+	ErrCatalogueVersion = storage.NewError("unknown catalogue version", ErrValidation)
+
+	// ErrHookPoint is answered when a hook is registered at an
+	// unknown point.
+	ErrHookPoint = errors.New("unknown hook point")
+
+	// ErrScanLimit is answered when a search would scan more entities
+	// than its `SearchOpts.MaxScanned`.
+	ErrScanLimit = errors.New("search scan limit exceeded")
+
+	// ErrNamespaceSame is answered when entities are copied or moved
+	// into the namespace that holds them.
+	ErrNamespaceSame = errors.New("source and destination namespaces are the same")
+
+	// ErrTenantUnknown is answered when a tenant that has not been
+	// provisioned is requested.  See `Tenancy`.
+	ErrTenantUnknown = storage.NewError("unknown tenant", ErrNotFound)
+
+	// ErrTenantMissing is answered when a tenant's data is requested
+	// using a context that carries no tenant.  See `WithTenant`.
+	ErrTenantMissing = errors.New("no tenant in context")
+
+	// ErrIndexValueTooLong is answered when the encoded values of the
+	// indexed fields of an entity exceed 4096 bytes.
+	ErrIndexValueTooLong = storage.NewError("indexed values too long", ErrValidation)
+
+	// ErrIndexRange is answered when an index range gives more values
+	// than the index has fields.  See `IndexRange`.
+	ErrIndexRange = errors.New("invalid index range")
+
+	// ErrOnDeleteUnknown is answered when an unrecognised `OnDelete`
+	// behaviour is given.
+	ErrOnDeleteUnknown = errors.New("unknown on-delete behaviour")
+
+	// ErrAggregateInvalid is answered when an aggregation having an
+	// unknown function, or a function other than a count without a
+	// field, is given.  See `Aggregator`.
+	ErrAggregateInvalid = errors.New("invalid aggregation")
+
+	// ErrWriterClosed is answered when an entity is put using an
+	// `AsyncWriter` that has been closed.
+	ErrWriterClosed = errors.New("writer is closed")
+
+	// ErrIntervalInvalid is answered when a maintenance job having no
+	// function, or a non-positive interval, is registered.
+	ErrIntervalInvalid = errors.New("invalid maintenance job interval")
+
+	// ErrSchedulerStopped is answered when a job is registered with a
+	// maintenance scheduler that has been stopped.
+	ErrSchedulerStopped = errors.New("maintenance scheduler is stopped")
+
+	// ErrQuotaExceeded is answered when storing an entity would exceed
+	// the quota of its entity type.  See `DB.SetQuota`.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+	// ErrShadowReadOnly is answered when a handle is opened both in
+	// shadow mode and for reading only.
+	ErrShadowReadOnly = errors.New("shadow mode can not be read-only")
+
+	// ErrChangeLogDisabled is answered when changes are watched using
+	// a handle that does not record them.  See `Options.ChangeLog`.
+	ErrChangeLogDisabled = errors.New("change log is not recorded")
+
+	// ErrOutboxMessageInvalid is answered when a modification carries
+	// an outbox message whose topic is empty, or whose topic or key is
+	// longer than 255 bytes.  See `WithOutbox`.
+	ErrOutboxMessageInvalid = errors.New("invalid outbox message")
+
+	// ErrSequenceExhausted is answered when a sequence has no values
+	// left to allocate.
+	ErrSequenceExhausted = errors.New("sequence is exhausted")
+
+	// ErrSequenceStart is answered when a sequence is given zero as
+	// its start.
+	ErrSequenceStart = errors.New("sequence can not start at zero")
+
+	// ErrCounterRange is answered when the value of a counter would
+	// overflow `int64`.
+	ErrCounterRange = errors.New("counter value out of range")
+
+	// ErrLeaseHeld is answered when a lease that is held by another,
+	// and has not expired, is acquired.
+	ErrLeaseHeld = storage.NewError("lease is held by another", ErrConflict)
+
+	// ErrLeaseLost is answered when a lease is renewed or released
+	// after it has been released, or acquired by another.
+	ErrLeaseLost = storage.NewError("lease is no longer held", ErrConflict)
+
+	// ErrLeaseInvalid is answered when a lease is given an empty name
+	// or holder, one longer than 255 bytes, or a duration that is not
+	// positive.
+	ErrLeaseInvalid = errors.New("invalid lease")
+
+	// ErrQueueEmpty is answered when a message is dequeued from a
+	// queue that has none visible.
+	ErrQueueEmpty = storage.NewError("queue has no visible messages", ErrNotFound)
+
+	// ErrQueueReceipt is answered when a message is acknowledged,
+	// returned or extended after it has been dequeued again, or
+	// removed from its queue.
+	ErrQueueReceipt = storage.NewError("queue message is no longer held", ErrConflict)
+
+	// ErrDurabilityUnknown is answered when an unrecognised durability
+	// level is given.
+	ErrDurabilityUnknown = errors.New("unknown durability level")
+
+	// ErrBulkOrder is answered when a bulk load is given an entity
+	// whose ID does not exceed that of the previous one.  See
+	// `BulkSource`.
+	ErrBulkOrder = errors.New("bulk entities out of order")
+
+	// ErrSQLiteFile is answered when refreshing a SQLite database file
+	// that was not written by `ExportSQLite`, or has since been put in
+	// a form that it can not read, such as that of write-ahead logging.
+	ErrSQLiteFile = errors.New("not a SQLite export file")
+
+	// ErrCorruptRecord is answered when a stored entity fails its
+	// checksum verification, indicating a partial write or media
+	// corruption.
+	ErrCorruptRecord = storage.ErrCorruptRecord
+
+	// ErrDatabaseReadOnly is answered when an attempt is made to
+	// modify a database opened with `Options.ReadOnly`.
+	ErrDatabaseReadOnly = storage.ErrDatabaseReadOnly
+
+	// ErrModeChange is answered when a database is opened again, in
+	// the same process, with another path, or another of the modes of
+	// `Options.ReadOnly` and `Options.Shadow`.  See `Open`.
+	ErrModeChange = storage.ErrModeChange
+
+	// ErrTypeFrozen is answered when an attempt is made to modify the
+	// entities of a frozen entity type.  See `Freezer`.
+	ErrTypeFrozen = storage.ErrTypeFrozen
+
+	// ErrCloneExists is answered when a database is cloned into a
+	// storage directory that already holds one.  See `CloneOpts`.
+	ErrCloneExists = storage.ErrCloneExists
+
+	// ErrCloneSelf is answered when a database is cloned into its own
+	// storage directory.
+	ErrCloneSelf = storage.ErrCloneSelf
+
+	// ErrEntityTypeNotEmpty is answered when an attempt is made to
+	// drop an entity type that has entities.  See `Namespace.Truncate`.
+	ErrEntityTypeNotEmpty = storage.ErrTypeNotEmpty
+
+	// ErrEntityTypeReferenced is answered when an attempt is made to
+	// truncate an entity type whose entities are referred to by those
+	// of other entity types.
+	ErrEntityTypeReferenced = storage.ErrTypeReferenced
+
+	// ErrNamespaceNotEmpty is answered when a namespace having
+	// entities is deleted without forcing it.  See `DeleteNamespace`.
+	ErrNamespaceNotEmpty = storage.ErrNamespaceNotEmpty
+
+	// ErrChangesTrimmed is answered when the change log is read from a
+	// position whose successors have been trimmed.  See `Changes`.
+	ErrChangesTrimmed = storage.ErrChangesTrimmed
 )
+
+var (
+	// ErrGroupInvalid is answered when a consumer group is given an
+	// invalid name or settings.
+	ErrGroupInvalid = errors.New("invalid consumer group name or settings")
+
+	// ErrGroupBusy is answered when a consumer group that is being
+	// consumed is joined, or deleted.
+	ErrGroupBusy = errors.New("consumer group is being consumed")
+
+	// ErrGroupAck is answered when a consumer group is acknowledged
+	// past the events that it has delivered.
+	ErrGroupAck = errors.New("acknowledgement past the events delivered")
+)
+
+// EntityError is answered by the operations on entities - `Get`,
+// `GetMany`, `Put` and its variants, `Update` and `Delete` - when they
+// fail.  It identifies the entity concerned, and wraps the error
+// answered; `errors.Is` and `errors.As` see through it.
+type EntityError struct {
+	Op        string // operation: "get", "put", "update" or "delete"
+	Namespace string // name of the namespace
+	Type      string // name of the entity type
+	ID        uint64 // ID of the entity; `0` if new, or not one
+	Err       error  // error answered
+}
+
+// Error conforms to `error`.
+func (e *EntityError) Error() string {
+	return fmt.Sprintf("%s %s/%s %d: %s", e.Op, e.Namespace, e.Type, e.ID, e.Err)
+}
+
+// Unwrap answers the wrapped error.
+func (e *EntityError) Unwrap() error {
+	return e.Err
+}
+
+// Operations recorded in `EntityError`.
+const (
+	opGet    = "get"
+	opPut    = "put"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// entityError answers the given error of the given operation on the
+// entity of this entity type having the given ID, wrapped in an
+// `*EntityError`; `nil` if it is `nil`.
+func (et *entityType) entityError(op string, id uint64, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &EntityError{Op: op, Namespace: et.ns.Name(), Type: et.Name(), ID: id, Err: err}
+}
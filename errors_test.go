@@ -0,0 +1,84 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorCategories(t *testing.T) {
+	for _, c := range []struct {
+		err, class error
+	}{
+		{ErrIdentifierUnknown, ErrNotFound},
+		{ErrNameUnknown, ErrNotFound},
+		{ErrNameExists, ErrConflict},
+		{ErrVersionConflict, ErrConflict},
+		{ErrFieldValueType, ErrValidation},
+		{ErrPayloadInvalid, ErrCorrupt},
+		{ErrCorruptRecord, ErrCorrupt},
+		{ErrTypeFrozen, ErrReadOnly},
+		{ErrDatabaseReadOnly, ErrReadOnly},
+		{&ValidationError{}, ErrValidation},
+		{&ImmutableFieldError{Field: "sku"}, ErrValidation},
+		{&ReferencedError{}, ErrConflict},
+	} {
+		if !errors.Is(c.err, c.class) {
+			t.Errorf("%v: not %v", c.err, c.class)
+		}
+	}
+	if errors.Is(ErrIdentifierUnknown, ErrConflict) || errors.Is(ErrNotFound, ErrIdentifierUnknown) {
+		t.Error("category mismatch")
+	}
+
+	ve := &ValidationError{Violations: []Violation{
+		{Rule: "r1", Fields: []string{"qty", "price"}},
+		{Rule: "r2", Fields: []string{"price", "sku"}},
+	}}
+	if fs := ve.Fields(); !reflect.DeepEqual(fs, []string{"qty", "price", "sku"}) {
+		t.Errorf("fields: %v", fs)
+	}
+}
+
+func TestEntityError(t *testing.T) {
+	ns := testNamespace(t, "err_ns")
+	ed := testDefn(t, "err_item", []testField{{"qty", FieldTypeUint32}}, func(ed *EntityTypeDefn) {
+		ed.AddRule(Rule{Name: "positive", Expr: "qty > 0"})
+	})
+	et := testDB.EntityType(ns, ed)
+
+	_, err := et.Get(42)
+	var ee *EntityError
+	if !errors.As(err, &ee) || ee.Op != "get" || ee.Namespace != "err_ns" || ee.Type != "err_item" || ee.ID != 42 {
+		t.Fatalf("get: %#v", err)
+	}
+	if !errors.Is(err, ErrIdentifierUnknown) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("get: %v", err)
+	}
+	if err.Error() != "get err_ns/err_item 42: unknown ID given" {
+		t.Errorf("message: %s", err)
+	}
+
+	err = et.Put(testDoc(t, ed, 0, map[string]interface{}{"qty": uint32(0)}))
+	var ve *ValidationError
+	if !errors.As(err, &ee) || ee.Op != "put" || !errors.As(err, &ve) || !errors.Is(err, ErrValidation) {
+		t.Errorf("put: %v", err)
+	}
+	if err := et.Delete(0); !errors.Is(err, ErrIdentifierZero) {
+		t.Errorf("delete: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// node is a node of the syntax tree of an expression.
+type node interface {
+	eval(env Env) (interface{}, error)
+}
+
+// walk calls the given function for every node of the given tree, in
+// depth-first order.
+func walk(n node, fn func(node)) {
+	fn(n)
+	switch n := n.(type) {
+	case *unaryNode:
+		walk(n.x, fn)
+	case *binaryNode:
+		walk(n.lhs, fn)
+		walk(n.rhs, fn)
+	case *callNode:
+		for _, a := range n.args {
+			walk(a, fn)
+		}
+	}
+}
+
+// litNode is a literal value.
+type litNode struct {
+	v interface{}
+}
+
+func (n *litNode) eval(Env) (interface{}, error) {
+	return n.v, nil
+}
+
+// varNode is a reference to a variable.
+type varNode struct {
+	name string
+}
+
+func (n *varNode) eval(env Env) (interface{}, error) {
+	if env == nil {
+		return nil, fmt.Errorf("%s: %s", ErrUnknownName, n.name)
+	}
+	v, ok := env.Lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ErrUnknownName, n.name)
+	}
+	return Normalise(v), nil
+}
+
+// callNode is a function call.
+type callNode struct {
+	name string
+	args []node
+}
+
+func (n *callNode) eval(env Env) (interface{}, error) {
+	fn, ok := Funcs[n.name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s()", ErrUnknownName, n.name)
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	v, err := fn(args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %s", n.name, err)
+	}
+	return Normalise(v), nil
+}
+
+// unaryNode is a unary operator applied to an operand.
+type unaryNode struct {
+	op string
+	x  node
+}
+
+func (n *unaryNode) eval(env Env) (interface{}, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "!":
+		if b, ok := v.(bool); ok {
+			return !b, nil
+		}
+	case "-":
+		switch v := v.(type) {
+		case int64:
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+	}
+	return nil, typeError(n.op, v)
+}
+
+// binaryNode is a binary operator applied to two operands.
+type binaryNode struct {
+	op       string
+	lhs, rhs node
+}
+
+func (n *binaryNode) eval(env Env) (interface{}, error) {
+	l, err := n.lhs.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuiting logical operators.
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, typeError(n.op, l)
+		}
+		if lb == (n.op == "||") {
+			return lb, nil
+		}
+		r, err := n.rhs.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, typeError(n.op, r)
+		}
+		return rb, nil
+	}
+
+	r, err := n.rhs.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==", "!=":
+		eq, err := equal(l, r)
+		if err != nil {
+			return nil, err
+		}
+		return eq == (n.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		c, err := Compare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+
+	if ls, ok := l.(string); ok && n.op == "+" {
+		if rs, ok := r.(string); ok {
+			return ls + rs, nil
+		}
+	}
+	return arith(n.op, l, r)
+}
+
+// arith applies the given arithmetic operator to the given numbers.
+func arith(op string, l, r interface{}) (interface{}, error) {
+	li, lok := l.(int64)
+	ri, rok := r.(int64)
+	if lok && rok {
+		switch op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/", "%":
+			if ri == 0 {
+				return nil, ErrDivisionByZero
+			}
+			if op == "/" {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, typeError(op, l, r)
+	}
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	default:
+		return math.Mod(lf, rf), nil
+	}
+}
+
+// equal answers `true` if the given values are equal.  Numbers are
+// compared numerically, and `nil` equals only `nil`.
+func equal(l, r interface{}) (bool, error) {
+	if l == nil || r == nil {
+		return l == nil && r == nil, nil
+	}
+	if lb, ok := l.(bool); ok {
+		rb, ok := r.(bool)
+		if !ok {
+			return false, typeError("==", l, r)
+		}
+		return lb == rb, nil
+	}
+
+	c, err := Compare(l, r)
+	if err != nil {
+		return false, err
+	}
+	return c == 0, nil
+}
+
+// Compare answers `-1`, `0` or `1` as the first of the given values
+// is less than, equal to or greater than the second.  Both should be
+// numbers, strings or times.
+func Compare(l, r interface{}) (int, error) {
+	l, r = Normalise(l), Normalise(r)
+
+	switch lv := l.(type) {
+	case int64:
+		if rv, ok := r.(int64); ok {
+			return cmpInt(lv, rv), nil
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			return strings.Compare(lv, rv), nil
+		}
+	case time.Time:
+		if rv, ok := r.(time.Time); ok {
+			switch {
+			case lv.Before(rv):
+				return -1, nil
+			case lv.After(rv):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return 0, typeError("compare", l, r)
+	}
+	switch {
+	case lf < rf:
+		return -1, nil
+	case lf > rf:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func cmpInt(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// toFloat converts the given number to `float64`.
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// typeError answers an error describing the application of the given
+// operator to operands of unsuitable types.
+func typeError(op string, vs ...interface{}) error {
+	ts := make([]string, len(vs))
+	for i, v := range vs {
+		ts[i] = fmt.Sprintf("%T", v)
+	}
+	return fmt.Errorf("%s: `%s` can not be applied to %s", ErrType, op, strings.Join(ts, ", "))
+}
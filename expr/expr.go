@@ -0,0 +1,192 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expr implements the small expression language used by
+// `flagon` to transform and validate field values.
+//
+// An expression refers to the fields of an entity by name, and
+// combines them using literals, operators and functions.  Examples:
+//
+//	lower(email)
+//	end_time > start_time
+//	discount <= price && price > 0
+//	concat("user-", hash(name))
+//
+// Values are `nil`, `bool`, `int64`, `float64`, `string` or
+// `time.Time`.  Integers are promoted to floating point numbers when
+// combined with them.
+//
+// Operators, in decreasing order of precedence:
+//
+//	!  - (unary)
+//	*  /  %
+//	+  -          (`+` also concatenates strings)
+//	== != < <= > >=
+//	&&
+//	||
+//
+// `&&` and `||` short-circuit.  Functions are looked up in `Funcs`.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	// ErrSyntax is answered when an expression can not be parsed.
+	ErrSyntax = errors.New("expression syntax error")
+
+	// ErrType is answered when an operator or function is applied to
+	// values of unsuitable types.
+	ErrType = errors.New("expression type error")
+
+	// ErrUnknownName is answered when an expression refers to an
+	// unknown variable or function.
+	ErrUnknownName = errors.New("unknown name in expression")
+
+	// ErrDivisionByZero is answered when an integer is divided by
+	// zero.
+	ErrDivisionByZero = errors.New("division by zero in expression")
+)
+
+// Env supplies the values of the variables referred to by an
+// expression.
+type Env interface {
+	// Lookup answers the value of the given variable, and `true` if
+	// it is known.
+	Lookup(name string) (interface{}, bool)
+}
+
+// MapEnv is an `Env` backed by a map.
+type MapEnv map[string]interface{}
+
+// Lookup conforms to `Env`.
+func (m MapEnv) Lookup(name string) (interface{}, bool) {
+	v, ok := m[name]
+	return v, ok
+}
+
+// Expr is a compiled expression.  It is safe for concurrent use.
+type Expr struct {
+	src  string
+	root node
+	vars []string
+}
+
+// Compile parses the given expression.
+func Compile(src string) (*Expr, error) {
+	p := &parser{lex: newLexer(src)}
+	p.next()
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+
+	e := &Expr{src: src, root: n}
+	seen := make(map[string]bool)
+	walk(n, func(n node) {
+		if v, ok := n.(*varNode); ok && !seen[v.name] {
+			seen[v.name] = true
+			e.vars = append(e.vars, v.name)
+		}
+	})
+	return e, nil
+}
+
+// MustCompile is like `Compile`, but panics if the expression can not
+// be parsed.
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String answers the source of this expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Vars answers the names of the variables referred to by this
+// expression, in the order of their first appearance.
+func (e *Expr) Vars() []string {
+	res := make([]string, len(e.vars))
+	copy(res, e.vars)
+	return res
+}
+
+// Eval evaluates this expression in the given environment.
+func (e *Expr) Eval(env Env) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+// EvalBool evaluates this expression, which should answer a boolean.
+func (e *Expr) EvalBool(env Env) (bool, error) {
+	v, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: %q does not answer a boolean", ErrType, e.src)
+	}
+	return b, nil
+}
+
+// Normalise converts the given Go value into one of the types that
+// expressions operate on.  Values of other types are answered as is.
+func Normalise(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return normaliseUint(uint64(v))
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return normaliseUint(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.UTC()
+	default:
+		return v
+	}
+}
+
+// normaliseUint answers the given unsigned integer as an `int64` if
+// it fits, and as a `float64` otherwise.
+func normaliseUint(u uint64) interface{} {
+	if u > math.MaxInt64 {
+		return float64(u)
+	}
+	return int64(u)
+}
@@ -0,0 +1,248 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expr
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	at := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	env := MapEnv{
+		"small": int8(3),
+		"ratio": 2.5,
+		"title": "Hello World",
+		"email": "user@example.com",
+		"count": uint64(10),
+		"huge":  uint64(math.MaxUint64),
+		"start": at,
+		"end":   at.Add(time.Hour),
+		"none":  nil,
+	}
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Literals and arithmetic.
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"7 / 2", int64(3)},
+		{"7 % 4", int64(3)},
+		{"7.0 / 2", 3.5},
+		{"1e3 + .5", 1000.5},
+		{"-small - -2", int64(-1)},
+		{"small * ratio", 7.5},
+		{"count % 3 == 1", true},
+		{"huge > count", true},
+		{"'ab' + \"cd\"", "abcd"},
+		{`"tab\there"`, "tab\there"},
+		{`'it\'s'`, "it's"},
+
+		// Comparisons and logic.
+		{"ratio < small", true},
+		{"small == 3.0", true},
+		{"title != 'Hello World'", false},
+		{"end > start", true},
+		{"none == null", true},
+		{"none != 0", true},
+		{"true == !false", true},
+		{"small > ratio || count >= 10", true},
+		{"small < ratio && count >= 10", false},
+
+		// `&&` and `||` short-circuit past errors.
+		{"false && nope", false},
+		{"true || nope", true},
+
+		// Functions.
+		{"lower(title)", "hello world"},
+		{"upper(title)", "HELLO WORLD"},
+		{"trim('  x ')", "x"},
+		{"len('héllo')", int64(5)},
+		{"substr(title, 6)", "World"},
+		{"substr(title, 0, 5)", "Hello"},
+		{"substr(title, 20)", ""},
+		{"contains(email, '@')", true},
+		{"prefix(email, 'user')", true},
+		{"suffix(email, '.org')", false},
+		{"concat('id-', small, '/', ratio, none)", "id-3/2.5"},
+		{"str(start)", "2015-03-01T10:00:00Z"},
+		{"int(' 42 ') + int(true)", int64(43)},
+		{"int(2.9)", int64(2)},
+		{"float('1.5') * 2", 3.0},
+		{"hash('flagon') == hash(\"flagon\")", true},
+		{"len(hash(email))", int64(16)},
+		{"hash(none)", nil},
+		{"redact('abc')", "***"},
+		{"mask(email, 4)", "************.com"},
+		{"mask('ab', 4)", "ab"},
+		{"mask(none, 4)", nil},
+		{"coalesce(none, null, 'x', 'y')", "x"},
+		{"coalesce(none)", nil},
+		{"if(small > 1, 'big', 'small')", "big"},
+		{"abs(-4) + abs(-0.5)", 4.5},
+		{"round(2.5) + round(3)", 6.0},
+	}
+	for _, tc := range tests {
+		e, err := Compile(tc.src)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		v, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if v != tc.want {
+			t.Errorf("%s: %#v, want %#v", tc.src, v, tc.want)
+		}
+	}
+}
+
+func TestNow(t *testing.T) {
+	before := time.Now()
+	v, err := MustCompile("now()").Eval(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now, ok := v.(time.Time)
+	if !ok || now.Location() != time.UTC || now.Before(before.Truncate(time.Second)) {
+		t.Errorf("now: %v", v)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	env := MapEnv{"text": "x", "num": int64(1), "flag": true}
+	tests := []struct {
+		src string
+		err error
+	}{
+		{"", ErrSyntax},
+		{"1 +", ErrSyntax},
+		{"(1", ErrSyntax},
+		{"1 2", ErrSyntax},
+		{"'open", ErrSyntax},
+		{"1 < 2 < 3", ErrSyntax},
+		{"lower(text", ErrSyntax},
+		{"text # 1", ErrSyntax},
+		{"99999999999999999999", ErrSyntax},
+
+		{"nope", ErrUnknownName},
+		{"nope(1)", ErrUnknownName},
+		{"num / 0", ErrDivisionByZero},
+		{"num % 0", ErrDivisionByZero},
+
+		{"-text", ErrType},
+		{"!num", ErrType},
+		{"text * 2", ErrType},
+		{"text < num", ErrType},
+		{"flag == 1", ErrType},
+		{"num && flag", ErrType},
+		{"flag && num", ErrType},
+		{"lower(num)", errArgs},
+		{"substr(text, -1)", errArgs},
+		{"if(num, 1, 2)", errArgs},
+		{"now(1)", errArgs},
+	}
+	for _, tc := range tests {
+		e, err := Compile(tc.src)
+		if err == nil {
+			_, err = e.Eval(env)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err.Error()) {
+			t.Errorf("%q: %v, want %v", tc.src, err, tc.err)
+		}
+	}
+
+	if _, err := MustCompile("flag").EvalBool(env); err != nil {
+		t.Error(err)
+	}
+	if _, err := MustCompile("num").EvalBool(env); err == nil || !strings.HasPrefix(err.Error(), ErrType.Error()) {
+		t.Errorf("non-boolean: %v", err)
+	}
+	if _, err := MustCompile("num").Eval(nil); err == nil || !strings.HasPrefix(err.Error(), ErrUnknownName.Error()) {
+		t.Errorf("no environment: %v", err)
+	}
+}
+
+func TestVars(t *testing.T) {
+	e := MustCompile("concat(b, a) == lower(b) || -c > 0 && a != null")
+	if got := e.Vars(); !reflect.DeepEqual(got, []string{"b", "a", "c"}) {
+		t.Errorf("vars: %v", got)
+	}
+	e.Vars()[0] = "x"
+	if e.Vars()[0] != "b" {
+		t.Error("vars shared with the caller")
+	}
+	if e.String() != "concat(b, a) == lower(b) || -c > 0 && a != null" {
+		t.Errorf("source: %q", e.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("invalid expression compiled")
+		}
+	}()
+	MustCompile("(")
+}
+
+func TestNormalise(t *testing.T) {
+	loc := time.FixedZone("IST", 19800)
+	at := time.Date(2015, 3, 1, 10, 0, 0, 0, loc)
+	tests := []struct {
+		in, want interface{}
+	}{
+		{int(-1), int64(-1)},
+		{int8(-2), int64(-2)},
+		{int16(-3), int64(-3)},
+		{int32(-4), int64(-4)},
+		{uint(5), int64(5)},
+		{uint8(6), int64(6)},
+		{uint16(7), int64(7)},
+		{uint32(8), int64(8)},
+		{uint64(9), int64(9)},
+		{uint64(math.MaxUint64), float64(math.MaxUint64)},
+		{float32(0.5), 0.5},
+		{"s", "s"},
+		{nil, nil},
+		{at, at.UTC()},
+	}
+	for _, tc := range tests {
+		if got := Normalise(tc.in); got != tc.want {
+			t.Errorf("%#v: %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		l, r interface{}
+		want int
+	}{
+		{int8(1), uint64(2), -1},
+		{2.5, int32(2), 1},
+		{"b", "a", 1},
+		{time.Unix(1, 0), time.Unix(1, 0).In(loc), 0},
+	} {
+		if c, err := Compare(tc.l, tc.r); err != nil || c != tc.want {
+			t.Errorf("compare %v, %v: %d, %v", tc.l, tc.r, c, err)
+		}
+	}
+	if _, err := Compare("a", 1); err == nil {
+		t.Error("string compared with number")
+	}
+}
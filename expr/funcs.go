@@ -0,0 +1,310 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Func is a function that can be called from expressions.  Its
+// arguments are normalised values (see `Normalise`).
+type Func func(args ...interface{}) (interface{}, error)
+
+// Funcs holds the functions that can be called from expressions.
+// Applications may register their own functions during their
+// initialisation; the map should not be modified thereafter.
+//
+// The built-in functions are:
+//
+//	lower(s), upper(s), trim(s)   case conversion and trimming
+//	len(s)                        length of a string, in characters
+//	substr(s, start[, n])         substring, in characters
+//	contains(s, t), prefix(s, t), suffix(s, t)
+//	concat(v...)                  concatenation of string forms
+//	str(v), int(v), float(v)      conversions
+//	hash(v)                       16 hex digits of the SHA-256 of `v`
+//	redact(s)                     `s` with every character as `*`
+//	mask(s, n)                    `s` with all but the last n characters as `*`
+//	coalesce(v...)                the first non-null argument
+//	if(c, a, b)                   `a` if `c`, otherwise `b`
+//	abs(x), round(x)              absolute value and rounding
+//	now()                         the current time, in UTC
+var Funcs = map[string]Func{
+	"lower":    strFunc(strings.ToLower),
+	"upper":    strFunc(strings.ToUpper),
+	"trim":     strFunc(strings.TrimSpace),
+	"len":      fnLen,
+	"substr":   fnSubstr,
+	"contains": strPred(strings.Contains),
+	"prefix":   strPred(strings.HasPrefix),
+	"suffix":   strPred(strings.HasSuffix),
+	"concat":   fnConcat,
+	"str":      fnStr,
+	"int":      fnInt,
+	"float":    fnFloat,
+	"hash":     fnHash,
+	"redact":   fnRedact,
+	"mask":     fnMask,
+	"coalesce": fnCoalesce,
+	"if":       fnIf,
+	"abs":      fnAbs,
+	"round":    fnRound,
+	"now":      fnNow,
+}
+
+// errArgs is answered when a function is called with the wrong
+// number or types of arguments.
+var errArgs = errors.New("invalid arguments")
+
+// strFunc adapts a string transformation.  `null` is answered as is.
+func strFunc(fn func(string) string) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errArgs
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, errArgs
+		}
+		return fn(s), nil
+	}
+}
+
+// strPred adapts a string predicate.
+func strPred(fn func(string, string) bool) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errArgs
+		}
+		s, ok1 := args[0].(string)
+		t, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errArgs
+		}
+		return fn(s, t), nil
+	}
+}
+
+func fnLen(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, errArgs
+	}
+	return int64(utf8.RuneCountInString(s)), nil
+}
+
+func fnSubstr(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errArgs
+	}
+	s, ok1 := args[0].(string)
+	start, ok2 := args[1].(int64)
+	if !ok1 || !ok2 || start < 0 {
+		return nil, errArgs
+	}
+
+	rs := []rune(s)
+	if start > int64(len(rs)) {
+		start = int64(len(rs))
+	}
+	end := int64(len(rs))
+	if len(args) == 3 {
+		n, ok := args[2].(int64)
+		if !ok || n < 0 {
+			return nil, errArgs
+		}
+		if start+n < end {
+			end = start + n
+		}
+	}
+	return string(rs[start:end]), nil
+}
+
+func fnConcat(args ...interface{}) (interface{}, error) {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		s, err := fnStr(a)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = s.(string)
+	}
+	return strings.Join(parts, ""), nil
+}
+
+func fnStr(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	switch v := args[0].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func fnInt(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	switch v := args[0].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, errArgs
+}
+
+func fnFloat(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	switch v := args[0].(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return nil, errArgs
+}
+
+func fnHash(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, err := fnStr(args[0])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(s.(string)))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func fnRedact(args ...interface{}) (interface{}, error) {
+	return fnMask(append(args, int64(0))...)
+}
+
+func fnMask(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errArgs
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, ok1 := args[0].(string)
+	keep, ok2 := args[1].(int64)
+	if !ok1 || !ok2 || keep < 0 {
+		return nil, errArgs
+	}
+
+	rs := []rune(s)
+	for i := 0; i < len(rs)-int(keep); i++ {
+		rs[i] = '*'
+	}
+	return string(rs), nil
+}
+
+func fnCoalesce(args ...interface{}) (interface{}, error) {
+	for _, a := range args {
+		if a != nil {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+func fnIf(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errArgs
+	}
+	c, ok := args[0].(bool)
+	if !ok {
+		return nil, errArgs
+	}
+	if c {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+func fnAbs(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	switch v := args[0].(type) {
+	case int64:
+		if v < 0 {
+			return -v, nil
+		}
+		return v, nil
+	case float64:
+		return math.Abs(v), nil
+	}
+	return nil, errArgs
+}
+
+func fnRound(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errArgs
+	}
+	switch v := args[0].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return math.Floor(v + 0.5), nil
+	}
+	return nil, errArgs
+}
+
+func fnNow(args ...interface{}) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errArgs
+	}
+	return time.Now().UTC(), nil
+}
@@ -0,0 +1,308 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokKind enumerates the kinds of lexical tokens.
+type tokKind uint8
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+)
+
+// token is a single lexical token.
+type token struct {
+	kind tokKind
+	text string // operator, identifier or literal text
+	pos  int    // byte offset in the source
+}
+
+// lexer splits an expression into tokens.
+type lexer struct {
+	src string
+	pos int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src}
+}
+
+// twoCharOps holds the operators that are two characters long.
+var twoCharOps = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+// next answers the next token.
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		return l.lexString(c)
+
+	case c >= '0' && c <= '9' || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		kind := tokInt
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.' || l.src[l.pos] == 'e' || l.src[l.pos] == 'E' ||
+			(l.src[l.pos] == '-' || l.src[l.pos] == '+') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+			if !isDigit(l.src[l.pos]) {
+				kind = tokFloat
+			}
+			l.pos++
+		}
+		return token{kind: kind, text: l.src[start:l.pos], pos: start}, nil
+
+	case c == '_' || c < utf8.RuneSelf && unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isDigit(l.src[l.pos]) ||
+			l.src[l.pos] < utf8.RuneSelf && unicode.IsLetter(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range twoCharOps {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += 2
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	if strings.IndexByte("+-*/%<>!(),", c) >= 0 {
+		l.pos++
+		return token{kind: tokOp, text: string(c), pos: start}, nil
+	}
+
+	return token{}, fmt.Errorf("%s: unexpected character %q at %d", ErrSyntax, c, start)
+}
+
+// lexString reads a string literal delimited by the given quote.
+// Backslash escapes are those of Go.
+func (l *lexer) lexString(q byte) (token, error) {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) && l.src[l.pos] != q {
+		if l.src[l.pos] == '\\' {
+			l.pos++
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{}, fmt.Errorf("%s: unterminated string at %d", ErrSyntax, start)
+	}
+	l.pos++
+
+	body := l.src[start+1 : l.pos-1]
+	if q == '\'' {
+		body = strings.Replace(body, `\'`, `'`, -1)
+		body = strings.Replace(body, `"`, `\"`, -1)
+	}
+	s, err := strconv.Unquote(`"` + body + `"`)
+	if err != nil {
+		return token{}, fmt.Errorf("%s: invalid string at %d", ErrSyntax, start)
+	}
+	return token{kind: tokString, text: s, pos: start}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser is a recursive descent parser for expressions.
+type parser struct {
+	lex *lexer
+	tok token
+	err error
+}
+
+// next advances to the next token.
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+// errorf answers a syntax error at the current token.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("%s: %s at %d", ErrSyntax, fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+// isOp answers `true` if the current token is one of the given
+// operators.
+func (p *parser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseExpr() (node, error) {
+	return p.parseBinary(0)
+}
+
+// precedence lists the binary operators, in increasing order of
+// precedence.
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// parseBinary parses a chain of binary operators at the given level
+// of precedence, or higher.
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(precedence[level]...) {
+		op := p.tok.text
+		p.next()
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: op, lhs: lhs, rhs: rhs}
+
+		// Comparisons do not chain.
+		if level == 2 {
+			break
+		}
+	}
+	return lhs, p.err
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!", "-") {
+		op := p.tok.text
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	t := p.tok
+	switch t.kind {
+	case tokInt:
+		p.next()
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid integer %q at %d", ErrSyntax, t.text, t.pos)
+		}
+		return &litNode{v: n}, nil
+
+	case tokFloat:
+		p.next()
+		x, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid number %q at %d", ErrSyntax, t.text, t.pos)
+		}
+		return &litNode{v: x}, nil
+
+	case tokString:
+		p.next()
+		return &litNode{v: t.text}, nil
+
+	case tokIdent:
+		p.next()
+		switch t.text {
+		case "true":
+			return &litNode{v: true}, nil
+		case "false":
+			return &litNode{v: false}, nil
+		case "null":
+			return &litNode{v: nil}, nil
+		}
+		if !p.isOp("(") {
+			return &varNode{name: t.text}, nil
+		}
+
+		p.next()
+		call := &callNode{name: t.text}
+		for !p.isOp(")") {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf("expected `)`")
+		}
+		p.next()
+		return call, p.err
+
+	case tokOp:
+		if t.text == "(" {
+			p.next()
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, p.errorf("expected `)`")
+			}
+			p.next()
+			return x, p.err
+		}
+	}
+
+	if t.kind == tokEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", t.text)
+}
@@ -15,9 +15,12 @@
 package flagon
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"math"
 	"time"
 )
 
@@ -71,6 +74,61 @@ func IsValidFieldType(t FieldType) bool {
 	}
 }
 
+// fieldTypeNames holds the serialisable names of the recognised field
+// types.
+var fieldTypeNames = map[FieldType]string{
+	FieldTypeBool:       "bool",
+	FieldTypeInt8:       "int8",
+	FieldTypeInt16:      "int16",
+	FieldTypeInt32:      "int32",
+	FieldTypeInt64:      "int64",
+	FieldTypeUint8:      "uint8",
+	FieldTypeUint16:     "uint16",
+	FieldTypeUint32:     "uint32",
+	FieldTypeUint64:     "uint64",
+	FieldTypeFloat32:    "float32",
+	FieldTypeFloat64:    "float64",
+	FieldTypeTime:       "time",
+	FieldTypeString:     "string",
+	FieldTypeReference:  "reference",
+	FieldTypeLink:       "link",
+	FieldTypeCollection: "collection",
+}
+
+// String answers the name of this field type.
+func (t FieldType) String() string {
+	if s, ok := fieldTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("FieldType(%d)", uint8(t))
+}
+
+// MarshalJSON conforms to `json.Marshaler`.  Field types are
+// serialised by name.
+func (t FieldType) MarshalJSON() ([]byte, error) {
+	if !IsValidFieldType(t) {
+		return nil, ErrFieldTypeUnknown
+	}
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (t *FieldType) UnmarshalJSON(by []byte) error {
+	var s string
+	err := json.Unmarshal(by, &s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range fieldTypeNames {
+		if v == s {
+			*t = k
+			return nil
+		}
+	}
+	return ErrFieldTypeUnknown
+}
+
 // FieldDefn captures the necessary information for defining and
 // dealing with fields and their data.
 //
@@ -78,24 +136,363 @@ func IsValidFieldType(t FieldType) bool {
 // is a limit of 255 fields per entity type.  In practice, much
 // smaller entity types are recommended.
 type FieldDefn struct {
-	Ftype FieldType // type of the data in this field
-	ID    uint8     // unique ID within its entity type
-	Name  string    // name of the field
+	Ftype FieldType `json:"type"` // type of the data in this field
+	ID    uint8     `json:"id"`   // unique ID within its entity type
+	Name  string    `json:"name"` // name of the field
+
+	// Target is the name of the entity type referred to by a field of
+	// type `FieldTypeReference`; empty for other fields.
+	Target string `json:"target,omitempty"`
+
+	// Immutable fields can not be changed once set, such as creation
+	// times and external IDs.  See `EntityTypeDefn.SetImmutable`.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// OnDelete is what becomes of the entities that refer to another
+	// using a field of type `FieldTypeReference`, when the latter is
+	// deleted.  See `EntityTypeDefn.SetOnDelete`.
+	OnDelete OnDelete `json:"on_delete,omitempty"`
 }
 
+// fieldDefnsByID sorts field definitions in the ascending order of
+// their IDs.
+type fieldDefnsByID []FieldDefn
+
+func (s fieldDefnsByID) Len() int           { return len(s) }
+func (s fieldDefnsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s fieldDefnsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // Field is the building block of an entity.  It is identified by the
 // ID of its field definition, and stores the actual content of
 // user-supplied data.
+//
+// A field is either set, or null.  A field is set when a value is
+// assigned to it, or read into it; it becomes null when cleared.  Null
+// fields answer the zero values of their types, are not stored, and
+// are serialised as `null` in JSON.  Hence, a field that was never set
+// can be told apart from one that was set to its zero value.
 type Field interface {
 	ID() uint8
 
+	// IsSet answers `true` if this field holds a value, and `false` if
+	// it is null.
+	IsSet() bool
+	// Clear discards this field's value, making it null.
+	Clear()
+
 	io.ReaderFrom
 	io.WriterTo
+
+	json.Marshaler
+	json.Unmarshaler
+}
+
+// newField creates an empty field conforming to the given definition.
+func newField(fd FieldDefn) (Field, error) {
+	if fd.ID != 0 {
+		if f := pooledFieldFor(fd); f != nil {
+			return f, nil
+		}
+	}
+
+	var f Field
+	switch fd.Ftype {
+	case FieldTypeBool:
+		f = &FieldBool{basicField: basicField{id: fd.ID}}
+	case FieldTypeInt8:
+		f = &FieldInt8{basicField: basicField{id: fd.ID}}
+	case FieldTypeInt16:
+		f = &FieldInt16{basicField: basicField{id: fd.ID}}
+	case FieldTypeInt32:
+		f = &FieldInt32{basicField: basicField{id: fd.ID}}
+	case FieldTypeInt64:
+		f = &FieldInt64{basicField: basicField{id: fd.ID}}
+	case FieldTypeUint8:
+		f = &FieldUint8{basicField: basicField{id: fd.ID}}
+	case FieldTypeUint16:
+		f = &FieldUint16{basicField: basicField{id: fd.ID}}
+	case FieldTypeUint32:
+		f = &FieldUint32{basicField: basicField{id: fd.ID}}
+	case FieldTypeUint64:
+		f = &FieldUint64{basicField: basicField{id: fd.ID}}
+	case FieldTypeFloat32:
+		f = &FieldFloat32{basicField: basicField{id: fd.ID}}
+	case FieldTypeFloat64:
+		f = &FieldFloat64{basicField: basicField{id: fd.ID}}
+	case FieldTypeTime:
+		f = &FieldTime{basicField: basicField{id: fd.ID}}
+	case FieldTypeString:
+		f = &FieldString{basicField: basicField{id: fd.ID}}
+	case FieldTypeReference:
+		f = &FieldReference{basicField: basicField{id: fd.ID}}
+	case FieldTypeLink, FieldTypeCollection:
+		return nil, ErrFieldTypeUnsupported
+	default:
+		return nil, ErrFieldTypeUnknown
+	}
+
+	if fd.ID == 0 {
+		return nil, ErrIdentifierZero
+	}
+	return f, nil
+}
+
+// fieldValue answers the value of the given field, as its Go type;
+// `nil` if the field is null.
+func fieldValue(f Field) interface{} {
+	if !f.IsSet() {
+		return nil
+	}
+
+	switch f := f.(type) {
+	case *FieldBool:
+		return f.Get()
+	case *FieldInt8:
+		return f.Get()
+	case *FieldInt16:
+		return f.Get()
+	case *FieldInt32:
+		return f.Get()
+	case *FieldInt64:
+		return f.Get()
+	case *FieldUint8:
+		return f.Get()
+	case *FieldUint16:
+		return f.Get()
+	case *FieldUint32:
+		return f.Get()
+	case *FieldUint64:
+		return f.Get()
+	case *FieldFloat32:
+		return f.Get()
+	case *FieldFloat64:
+		return f.Get()
+	case *FieldTime:
+		return f.Get()
+	case *FieldString:
+		return f.Get()
+	case *FieldReference:
+		return f.Get()
+	default:
+		return nil
+	}
+}
+
+// setFieldValue sets the given value in the given field.  Numeric
+// values of any Go numeric type are accepted, provided that they are
+// representable in the field's type.  A `nil` value clears the field.
+func setFieldValue(f Field, v interface{}) error {
+	if v == nil {
+		f.Clear()
+		return nil
+	}
+
+	switch f := f.(type) {
+	case *FieldBool:
+		b, ok := v.(bool)
+		if !ok {
+			return ErrFieldValueType
+		}
+		f.Set(b)
+	case *FieldInt8:
+		n, err := toInt64(v, math.MinInt8, math.MaxInt8)
+		if err != nil {
+			return err
+		}
+		f.Set(int8(n))
+	case *FieldInt16:
+		n, err := toInt64(v, math.MinInt16, math.MaxInt16)
+		if err != nil {
+			return err
+		}
+		f.Set(int16(n))
+	case *FieldInt32:
+		n, err := toInt64(v, math.MinInt32, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		f.Set(int32(n))
+	case *FieldInt64:
+		n, err := toInt64(v, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		f.Set(n)
+	case *FieldUint8:
+		n, err := toUint64(v, math.MaxUint8)
+		if err != nil {
+			return err
+		}
+		f.Set(uint8(n))
+	case *FieldUint16:
+		n, err := toUint64(v, math.MaxUint16)
+		if err != nil {
+			return err
+		}
+		f.Set(uint16(n))
+	case *FieldUint32:
+		n, err := toUint64(v, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		f.Set(uint32(n))
+	case *FieldUint64:
+		n, err := toUint64(v, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		f.Set(n)
+	case *FieldReference:
+		n, err := toUint64(v, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		f.Set(n)
+	case *FieldFloat32:
+		x, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		f.Set(float32(x))
+	case *FieldFloat64:
+		x, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		f.Set(x)
+	case *FieldTime:
+		t, ok := v.(time.Time)
+		if !ok {
+			return ErrFieldValueType
+		}
+		f.Set(t)
+	case *FieldString:
+		s, ok := v.(string)
+		if !ok {
+			return ErrFieldValueType
+		}
+		if len(s) > 65535 {
+			return ErrStringTooLong
+		}
+		f.Set(s)
+	default:
+		return ErrFieldTypeUnsupported
+	}
+
+	return nil
+}
+
+// toInt64 converts the given numeric value to `int64`, provided that
+// it lies in the given range.  Floating point values are accepted
+// only if they are integral.
+func toInt64(v interface{}, min, max int64) (int64, error) {
+	var n int64
+	switch v := v.(type) {
+	case int:
+		n = int64(v)
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint, uint8, uint16, uint32, uint64:
+		u, err := toUint64(v, math.MaxInt64)
+		if err != nil {
+			return 0, err
+		}
+		n = int64(u)
+	case float32, float64:
+		x, _ := toFloat64(v)
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return 0, ErrFieldValueRange
+		}
+		n = int64(x)
+	default:
+		return 0, ErrFieldValueType
+	}
+
+	if n < min || n > max {
+		return 0, ErrFieldValueRange
+	}
+	return n, nil
+}
+
+// toUint64 converts the given numeric value to `uint64`, provided
+// that it lies in the range [0, max].  Floating point values are
+// accepted only if they are integral.
+func toUint64(v interface{}, max uint64) (uint64, error) {
+	var n uint64
+	switch v := v.(type) {
+	case uint:
+		n = uint64(v)
+	case uint8:
+		n = uint64(v)
+	case uint16:
+		n = uint64(v)
+	case uint32:
+		n = uint64(v)
+	case uint64:
+		n = v
+	case int, int8, int16, int32, int64:
+		i, err := toInt64(v, 0, math.MaxInt64)
+		if err != nil {
+			return 0, err
+		}
+		n = uint64(i)
+	case float32, float64:
+		x, _ := toFloat64(v)
+		if x != math.Trunc(x) || x < 0 || x >= math.MaxUint64 {
+			return 0, ErrFieldValueRange
+		}
+		n = uint64(x)
+	default:
+		return 0, ErrFieldValueType
+	}
+
+	if n > max {
+		return 0, ErrFieldValueRange
+	}
+	return n, nil
+}
+
+// toFloat64 converts the given numeric value to `float64`.
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int, int8, int16, int32, int64:
+		n, err := toInt64(v, math.MinInt64, math.MaxInt64)
+		return float64(n), err
+	case uint, uint8, uint16, uint32, uint64:
+		n, err := toUint64(v, math.MaxUint64)
+		return float64(n), err
+	default:
+		return 0, ErrFieldValueType
+	}
+}
+
+// jsonNull is the JSON serialisation of null fields.
+var jsonNull = []byte("null")
+
+// isJSONNull answers `true` if the given JSON value is `null`.
+func isJSONNull(by []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(by), jsonNull)
 }
 
 // basicField defines the common core of all fields.
 type basicField struct {
-	id uint8
+	id  uint8
+	set bool // `false` if null
+}
+
+// IsSet answers `true` if this field holds a value; see `Field`.
+func (f basicField) IsSet() bool {
+	return f.set
 }
 
 // ID answers the unique identifier of this field within its entity
@@ -136,26 +533,55 @@ func (f *FieldBool) Set(v bool) {
 	} else {
 		f.value = 0
 	}
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldBool) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldBool) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 1)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = uint8(v)
+	f.set = true
 	return 1, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldBool) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldBool) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldBool) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v bool
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 1, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldInt8 represents an 8-bit integer value.
@@ -172,26 +598,55 @@ func (f *FieldInt8) Get() int8 {
 // Set sets the given value in this field's storage.
 func (f *FieldInt8) Set(v int8) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldInt8) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldInt8) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 1)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = int8(v)
+	f.set = true
 	return 1, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldInt8) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldInt8) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldInt8) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v int8
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 1, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldInt16 represents a 16-bit integer value.
@@ -208,26 +663,55 @@ func (f *FieldInt16) Get() int16 {
 // Set sets the given value in this field's storage.
 func (f *FieldInt16) Set(v int16) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldInt16) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldInt16) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 2)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = int16(v)
+	f.set = true
 	return 2, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldInt16) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldInt16) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldInt16) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v int16
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 2, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldInt32 represents a 32-bit integer value.
@@ -244,26 +728,55 @@ func (f *FieldInt32) Get() int32 {
 // Set sets the given value in this field's storage.
 func (f *FieldInt32) Set(v int32) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldInt32) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldInt32) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 4)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = int32(v)
+	f.set = true
 	return 4, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldInt32) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldInt32) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldInt32) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v int32
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 4, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldInt64 represents a 64-bit integer value.
@@ -280,26 +793,55 @@ func (f *FieldInt64) Get() int64 {
 // Set sets the given value in this field's storage.
 func (f *FieldInt64) Set(v int64) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldInt64) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldInt64) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 8)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = int64(v)
+	f.set = true
 	return 8, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldInt64) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldInt64) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldInt64) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v int64
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 8, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldUint8 represents an unsigned 8-bit integer value.
@@ -316,26 +858,55 @@ func (f *FieldUint8) Get() uint8 {
 // Set sets the given value in this field's storage.
 func (f *FieldUint8) Set(v uint8) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldUint8) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldUint8) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 1)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = uint8(v)
+	f.set = true
 	return 1, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldUint8) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldUint8) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldUint8) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v uint8
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 1, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldUint16 represents an unsigned 16-bit integer value.
@@ -352,26 +923,55 @@ func (f *FieldUint16) Get() uint16 {
 // Set sets the given value in this field's storage.
 func (f *FieldUint16) Set(v uint16) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldUint16) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldUint16) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 2)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = uint16(v)
+	f.set = true
 	return 2, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldUint16) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldUint16) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldUint16) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v uint16
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 2, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldUint32 represents an unsigned 32-bit integer value.
@@ -388,26 +988,55 @@ func (f *FieldUint32) Get() uint32 {
 // Set sets the given value in this field's storage.
 func (f *FieldUint32) Set(v uint32) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldUint32) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldUint32) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 4)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = uint32(v)
+	f.set = true
 	return 4, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldUint32) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldUint32) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldUint32) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v uint32
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 4, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldUint64 represents an unsigned 64-bit integer value.
@@ -424,26 +1053,55 @@ func (f *FieldUint64) Get() uint64 {
 // Set sets the given value in this field's storage.
 func (f *FieldUint64) Set(v uint64) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldUint64) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldUint64) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 8)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = v
+	f.set = true
 	return 8, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldUint64) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldUint64) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldUint64) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v uint64
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 8, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldFloat32 represents a 32-bit float value.
@@ -460,26 +1118,55 @@ func (f *FieldFloat32) Get() float32 {
 // Set sets the given value in this field's storage.
 func (f *FieldFloat32) Set(v float32) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldFloat32) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldFloat32) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 4)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = math.Float32frombits(uint32(v))
+	f.set = true
 	return 4, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldFloat32) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldFloat32) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldFloat32) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v float32
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 4, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldFloat64 represents a 64-bit float value.
@@ -496,33 +1183,81 @@ func (f *FieldFloat64) Get() float64 {
 // Set sets the given value in this field's storage.
 func (f *FieldFloat64) Set(v float64) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldFloat64) Clear() {
+	f.value = 0
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldFloat64) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &f.value)
+	v, err := readUint(r, 8)
 	if err != nil {
 		return 0, err
 	}
 
+	f.value = math.Float64frombits(v)
+	f.set = true
 	return 8, nil
 }
 
 // WriteTo conforms to `io.WriteTo`.
 func (f *FieldFloat64) WriteTo(w io.Writer) (int64, error) {
-	err := binary.Write(w, binary.BigEndian, f.value)
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldFloat64) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldFloat64) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v float64
+	err := json.Unmarshal(by, &v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return 8, nil
+	f.Set(v)
+	return nil
 }
 
+// Serialised forms of time values.  The current form is fixed-length:
+//
+//	tag (= 0x80) | Unix seconds int64 | nanoseconds uint32 | zone offset int32
+//
+// The zone offset is in seconds east of UTC.  Values serialised by
+// earlier versions of `flagon` are in the binary form of `time.Time`,
+// whose first byte is its version (1 or 2).  They remain readable, and
+// are rewritten in the current form when their entities are next
+// stored.
+const (
+	timeTagLegacyV1 = 1
+	timeTagLegacyV2 = 2
+	timeTagFixed    = 0x80
+
+	timeLenLegacyV1 = 15
+	timeLenLegacyV2 = 16
+	timeLenFixed    = 17
+)
+
 // FieldTime represents a time value.
 //
-// N.B. Time values are converted to UTC before serialisation, to
-// enable standardised search and comparison.  Hence, applications
-// should adjust them to the desired time zones before use.
+// N.B. Time values are serialised as instants together with their
+// zone offsets.  Names of time zones are not preserved; values are
+// read back in fixed zones having the original offsets.
 type FieldTime struct {
 	basicField
 	value time.Time
@@ -536,37 +1271,98 @@ func (f *FieldTime) Get() time.Time {
 // Set sets the given value in this field's storage.
 func (f *FieldTime) Set(v time.Time) {
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldTime) Clear() {
+	f.value = time.Time{}
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
 func (f *FieldTime) ReadFrom(r io.Reader) (int64, error) {
-	by := make([]byte, 0, 15)
-	n, err := r.Read(by)
-	if n != 15 && err != nil {
-		return int64(n), err
+	v, err := readUint(r, 1)
+	if err != nil {
+		return 0, err
+	}
+	tag := byte(v)
+
+	var l int
+	switch tag {
+	case timeTagFixed:
+		l = timeLenFixed
+	case timeTagLegacyV1:
+		l = timeLenLegacyV1
+	case timeTagLegacyV2:
+		l = timeLenLegacyV2
+	default:
+		return 1, ErrPayloadInvalid
 	}
 
-	err = f.value.UnmarshalBinary(by)
+	by := make([]byte, l)
+	by[0] = tag
+	n, err := io.ReadFull(r, by[1:])
 	if err != nil {
-		return 0, err
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return int64(1 + n), err
+	}
+
+	if tag != timeTagFixed {
+		err = f.value.UnmarshalBinary(by)
+		if err != nil {
+			return int64(l), ErrPayloadInvalid
+		}
+		f.set = true
+		return int64(l), nil
+	}
+
+	sec := int64(binary.BigEndian.Uint64(by[1:]))
+	nsec := binary.BigEndian.Uint32(by[9:])
+	off := int32(binary.BigEndian.Uint32(by[13:]))
+	if nsec >= 1e9 {
+		return int64(l), ErrPayloadInvalid
+	}
+	t := time.Unix(sec, int64(nsec)).UTC()
+	if off != 0 {
+		t = t.In(time.FixedZone("", int(off)))
 	}
+	f.value = t
 
-	return 15, nil
+	f.set = true
+	return int64(l), nil
 }
 
 // WriteTo conforms to `io.WriterTo`.
 func (f *FieldTime) WriteTo(w io.Writer) (int64, error) {
-	by, err := f.value.UTC().MarshalBinary()
-	if err != nil {
-		return 0, err
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldTime) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.value.UTC())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldTime) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
 	}
 
-	n, err := w.Write(by)
-	if n != 15 && err != nil {
-		return int64(n), err
+	var v time.Time
+	err := json.Unmarshal(by, &v)
+	if err != nil {
+		return err
 	}
 
-	return 15, nil
+	f.Set(v)
+	return nil
 }
 
 // FieldString represents a string value.
@@ -588,51 +1384,154 @@ func (f *FieldString) Get() string {
 // Set sets the given value in this field's storage.
 func (f *FieldString) Set(v string) {
 	if len(v) > 65535 {
-		log.Printf("string length exceeds maximum limit of 65535")
+		logMsg(LogWarn, "string length exceeds maximum limit of 65535", LogField{"field", f.ID()}, LogField{"length", len(v)})
 		return
 	}
 
 	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldString) Clear() {
+	f.value = ""
+	f.set = false
 }
 
 // ReadFrom conforms to `io.ReaderFrom`.
+//
+// Strings are serialised as their length in bytes, as `uint16`,
+// followed by their UTF-8 bytes.  Empty strings have a zero length,
+// and no bytes.
 func (f *FieldString) ReadFrom(r io.Reader) (int64, error) {
-	l := uint16(len(f.value))
-	err := binary.Read(r, binary.BigEndian, &l)
+	l, err := readUint(r, 2)
 	if err != nil {
 		return 0, err
 	}
-	if l == 0 {
-		return 0, io.EOF
-	}
 
-	by := make([]byte, 0, l)
-	n, err := r.Read(by)
-	if err != nil || n != int(l) {
-		return int64(n), err
+	if fr, ok := r.(*fieldReader); ok {
+		by, err := fr.next(int(l))
+		if err != nil {
+			return 2, err
+		}
+		f.value = fr.string(by)
+		f.set = true
+		return int64(2 + l), nil
+	}
+	by := make([]byte, l)
+	n, err := io.ReadFull(r, by)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return int64(2 + n), err
 	}
 
 	f.value = string(by)
-	return int64(n), nil
+	f.set = true
+	return int64(2 + n), nil
 }
 
 // WriteTo conforms to `io.WriterTo`.
 func (f *FieldString) WriteTo(w io.Writer) (int64, error) {
-	if f.value == "" {
-		return 0, nil
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldString) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldString) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v string
+	err := json.Unmarshal(by, &v)
+	if err != nil {
+		return err
+	}
+
+	if len(v) > 65535 {
+		return ErrStringTooLong
 	}
 
-	by := []byte(f.value)
-	l := uint16(len(by))
-	err := binary.Write(w, binary.BigEndian, l)
+	f.Set(v)
+	return nil
+}
+
+// FieldReference represents a strong reference to an entity of the
+// entity type named in the field's definition, in the same namespace.
+// Its value is the ID of the referred entity; `0` for no reference.
+//
+// `flagon` maintains an index of references, from which the number of
+// references to an entity can be determined.
+type FieldReference struct {
+	basicField
+	value uint64
+}
+
+// Get answers the ID of the referred entity.
+func (f *FieldReference) Get() uint64 {
+	return f.value
+}
+
+// Set sets the ID of the referred entity.
+func (f *FieldReference) Set(v uint64) {
+	f.value = v
+	f.set = true
+}
+
+// Clear clears this field's value; see `Field`.
+func (f *FieldReference) Clear() {
+	f.value = 0
+	f.set = false
+}
+
+// ReadFrom conforms to `io.ReaderFrom`.
+func (f *FieldReference) ReadFrom(r io.Reader) (int64, error) {
+	v, err := readUint(r, 8)
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := w.Write(by)
-	if err != nil || n != int(l) {
-		return int64(n), err
+	f.value = v
+	f.set = true
+	return 8, nil
+}
+
+// WriteTo conforms to `io.WriterTo`.
+func (f *FieldReference) WriteTo(w io.Writer) (int64, error) {
+	return writeField(w, f)
+}
+
+// MarshalJSON conforms to `json.Marshaler`.
+func (f *FieldReference) MarshalJSON() ([]byte, error) {
+	if !f.set {
+		return jsonNull, nil
+	}
+	return json.Marshal(f.Get())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (f *FieldReference) UnmarshalJSON(by []byte) error {
+	if isJSONNull(by) {
+		f.Clear()
+		return nil
+	}
+
+	var v uint64
+	err := json.Unmarshal(by, &v)
+	if err != nil {
+		return err
 	}
 
-	return int64(n), nil
+	f.Set(v)
+	return nil
 }
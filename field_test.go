@@ -0,0 +1,274 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fieldReaders are the kinds of readers that fields are read from:
+// plain ones, and one that answers a byte at a time.
+var fieldReaders = []struct {
+	name string
+	fn   func([]byte) io.Reader
+}{
+	{"bytes", func(by []byte) io.Reader { return bytes.NewReader(by) }},
+	{"short", func(by []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(by)) }},
+}
+
+func TestFieldTimeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		val  time.Time
+	}{
+		{"utc", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"east", time.Date(2021, 3, 4, 5, 6, 7, 0, time.FixedZone("IST", 5*3600+1800))},
+		{"west", time.Date(2021, 3, 4, 5, 6, 7, 0, time.FixedZone("", -8*3600))},
+		{"seconds offset", time.Date(1900, 1, 1, 0, 0, 0, 0, time.FixedZone("LMT", 19800+28))},
+		{"zero", time.Time{}},
+		{"pre-1970", time.Date(1969, 12, 31, 23, 59, 59, 999999999, time.UTC)},
+		{"ancient", time.Date(-200, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"sub-second", time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.FixedZone("", 3600))},
+		{"nanosecond", time.Unix(0, 1).UTC()},
+	}
+
+	for _, tc := range tests {
+		f := &FieldTime{}
+		f.Set(tc.val)
+		var buf bytes.Buffer
+		n, err := f.WriteTo(&buf)
+		if err != nil || n != timeLenFixed || buf.Len() != timeLenFixed || buf.Bytes()[0] != timeTagFixed {
+			t.Fatalf("%s: wrote %d, % x, %v", tc.name, n, buf.Bytes(), err)
+		}
+
+		for _, fr := range fieldReaders {
+			g := &FieldTime{}
+			n, err = g.ReadFrom(fr.fn(buf.Bytes()))
+			if err != nil || n != timeLenFixed {
+				t.Fatalf("%s, %s: read %d, %v", tc.name, fr.name, n, err)
+			}
+			v := g.Get()
+			_, off := v.Zone()
+			_, want := tc.val.Zone()
+			if !g.IsSet() || !v.Equal(tc.val) || off != want {
+				t.Errorf("%s, %s: read %v, want %v", tc.name, fr.name, v, tc.val)
+			}
+		}
+	}
+}
+
+func TestFieldTimeLegacy(t *testing.T) {
+	tests := []struct {
+		name string
+		by   []byte
+		want time.Time
+	}{
+		{
+			// Version 1 of the binary form of `time.Time`: seconds since
+			// year 1, nanoseconds, and the zone offset in minutes; `-1`
+			// for UTC.
+			name: "v1 utc",
+			by:   []byte{0x01, 0, 0, 0, 0x0e, 0xd7, 0xd2, 0x61, 0xbf, 0, 0, 0, 0x64, 0xff, 0xff},
+			want: time.Date(2021, 3, 4, 5, 6, 7, 100, time.UTC),
+		},
+		{
+			name: "v1 offset",
+			by:   []byte{0x01, 0, 0, 0, 0x0e, 0xd7, 0xd2, 0x61, 0xbf, 0, 0, 0, 0, 0x01, 0x4a},
+			want: time.Date(2021, 3, 4, 10, 36, 7, 0, time.FixedZone("", 5*3600+1800)),
+		},
+		{
+			// Version 2 adds the seconds of the zone offset.
+			name: "v2 seconds offset",
+			by:   []byte{0x02, 0, 0, 0, 0x0d, 0xf3, 0xe7, 0x2b, 0x0c, 0, 0, 0, 0, 0x01, 0x4a, 0x1c},
+			want: time.Date(1900, 1, 1, 0, 0, 0, 0, time.FixedZone("", 19800+28)),
+		},
+	}
+
+	for _, tc := range tests {
+		by, err := tc.want.MarshalBinary()
+		if err != nil || !bytes.Equal(by, tc.by) {
+			t.Fatalf("%s: legacy form % x, %v; want % x", tc.name, by, err, tc.by)
+		}
+
+		for _, fr := range fieldReaders {
+			f := &FieldTime{}
+			n, err := f.ReadFrom(fr.fn(tc.by))
+			if err != nil || n != int64(len(tc.by)) {
+				t.Fatalf("%s, %s: read %d, %v", tc.name, fr.name, n, err)
+			}
+			v := f.Get()
+			_, off := v.Zone()
+			_, want := tc.want.Zone()
+			if !v.Equal(tc.want) || off != want {
+				t.Errorf("%s, %s: read %v, want %v", tc.name, fr.name, v, tc.want)
+			}
+
+			// Legacy values are rewritten in the current form.
+			var buf bytes.Buffer
+			if _, err := f.WriteTo(&buf); err != nil || buf.Bytes()[0] != timeTagFixed {
+				t.Errorf("%s, %s: rewritten as % x, %v", tc.name, fr.name, buf.Bytes(), err)
+			}
+		}
+	}
+}
+
+func TestFieldTimeInvalid(t *testing.T) {
+	valid := make([]byte, timeLenFixed)
+	valid[0] = timeTagFixed
+	badNanos := append([]byte(nil), valid...)
+	copy(badNanos[9:], []byte{0x3b, 0x9a, 0xca, 0x00}) // 1e9
+
+	tests := []struct {
+		name string
+		by   []byte
+		err  error
+	}{
+		{"empty", nil, io.EOF},
+		{"unknown tag", []byte{0x7f, 0, 0}, ErrPayloadInvalid},
+		{"truncated", valid[:timeLenFixed-1], io.ErrUnexpectedEOF},
+		{"tag only", valid[:1], io.ErrUnexpectedEOF},
+		{"truncated v1", []byte{1, 0, 0}, io.ErrUnexpectedEOF},
+		{"nanoseconds", badNanos, ErrPayloadInvalid},
+	}
+
+	for _, tc := range tests {
+		for _, fr := range fieldReaders {
+			f := &FieldTime{}
+			if _, err := f.ReadFrom(fr.fn(tc.by)); err != tc.err {
+				t.Errorf("%s, %s: %v, want %v", tc.name, fr.name, err, tc.err)
+			}
+		}
+	}
+}
+
+func TestFieldStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+	}{
+		{"empty", ""},
+		{"ascii", "hello"},
+		{"utf-8", "ನಮಸ್ಕಾರ, 世界"},
+		{"nul", "a\x00b"},
+		{"max", strings.Repeat("x", 65535)},
+	}
+
+	for _, tc := range tests {
+		f := &FieldString{}
+		f.Set(tc.val)
+		var buf bytes.Buffer
+		n, err := f.WriteTo(&buf)
+		if err != nil || n != int64(2+len(tc.val)) || buf.Len() != int(n) {
+			t.Fatalf("%s: wrote %d, %v", tc.name, n, err)
+		}
+
+		for _, fr := range fieldReaders {
+			// A following field is read in step.
+			by := append(append([]byte(nil), buf.Bytes()...), 0x00, 0x01, 'z')
+			r := fr.fn(by)
+			g, h := &FieldString{}, &FieldString{}
+			n, err = g.ReadFrom(r)
+			if err != nil || n != int64(2+len(tc.val)) || !g.IsSet() || g.Get() != tc.val {
+				t.Fatalf("%s, %s: read %d, %v", tc.name, fr.name, n, err)
+			}
+			if _, err = h.ReadFrom(r); err != nil || h.Get() != "z" {
+				t.Errorf("%s, %s: next field %q, %v", tc.name, fr.name, h.Get(), err)
+			}
+		}
+	}
+}
+
+func TestFieldStringTooLong(t *testing.T) {
+	f := &FieldString{}
+	f.Set("kept")
+	f.Set(strings.Repeat("x", 65536))
+	if f.Get() != "kept" {
+		t.Fatalf("over-length value set: %d bytes", len(f.Get()))
+	}
+
+	f.value = strings.Repeat("x", 65536)
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != ErrStringTooLong || buf.Len() != 0 {
+		t.Fatalf("over-length value written: %d bytes, %v", buf.Len(), err)
+	}
+}
+
+func TestFieldStringTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		by   []byte
+		err  error
+	}{
+		{"empty", nil, io.EOF},
+		{"half length", []byte{0x00}, io.ErrUnexpectedEOF},
+		{"no bytes", []byte{0x00, 0x05}, io.ErrUnexpectedEOF},
+		{"short bytes", []byte{0x00, 0x05, 'a', 'b', 'c'}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tc := range tests {
+		for _, fr := range fieldReaders {
+			f := &FieldString{}
+			if _, err := f.ReadFrom(fr.fn(tc.by)); err != tc.err || f.IsSet() {
+				t.Errorf("%s, %s: %v, want %v", tc.name, fr.name, err, tc.err)
+			}
+		}
+	}
+}
+
+func TestFieldNull(t *testing.T) {
+	ed, vals := codecDefn(t, "null_all")
+	d := NewDocument(ed, 1)
+	for name, v := range vals {
+		f, _ := d.Field(name)
+		if f.IsSet() || fieldValue(f) != nil {
+			t.Fatalf("%s: new field set", name)
+		}
+		if by, err := json.Marshal(f); err != nil || string(by) != "null" {
+			t.Errorf("%s: null marshalled as %s, %v", name, by, err)
+		}
+
+		// Zero values are values, distinct from null.
+		zero := reflect.Zero(reflect.TypeOf(v)).Interface()
+		if err := setFieldValue(f, zero); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !f.IsSet() || !sameValue(fieldValue(f), zero) {
+			t.Errorf("%s: zero value read as %v", name, fieldValue(f))
+		}
+		if by, _ := json.Marshal(f); string(by) == "null" {
+			t.Errorf("%s: zero value marshalled as null", name)
+		}
+
+		f.Clear()
+		if f.IsSet() {
+			t.Errorf("%s: set after clearing", name)
+		}
+		setFieldValue(f, v)
+		if err := setFieldValue(f, nil); err != nil || f.IsSet() {
+			t.Errorf("%s: set after setting nil: %v", name, err)
+		}
+		setFieldValue(f, v)
+		if err := json.Unmarshal([]byte(" null "), f); err != nil || f.IsSet() {
+			t.Errorf("%s: set after unmarshalling null: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"github.com/js-ojus/flagon/expr"
+)
+
+// Filter is a search predicate written in the expression language of
+// package `expr`, such as `age >= 18 && country == "IN"`.  The fields
+// of documents are its variables; defined fields that a document does
+// not hold are `null`.  It lets remote access layers and tools accept
+// predicates as text.
+//
+// A filter records the first error of evaluating its expression; it
+// is hence not safe for concurrent use.  Use a filter per search.
+type Filter struct {
+	ex  *expr.Expr
+	err error
+}
+
+// NewFilter compiles the given expression, which should answer a
+// boolean, into a filter.
+func NewFilter(src string) (*Filter, error) {
+	ex, err := expr.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{ex: ex}, nil
+}
+
+// Match conforms to `SearchFn`, answering `true` if the given entity
+// satisfies the expression of this filter.  Entities that are not
+// documents do not match.  Once evaluating the expression fails,
+// nothing matches; the error is answered by `Err`.
+func (f *Filter) Match(_ uint64, e Entity) bool {
+	if f.err != nil {
+		return false
+	}
+	d, ok := e.(*Document)
+	if !ok {
+		return false
+	}
+
+	ok, err := f.ex.EvalBool(documentEnv{d})
+	if err != nil {
+		f.err = err
+		return false
+	}
+	return ok
+}
+
+// Err answers the first error of evaluating the expression of this
+// filter, if any.
+func (f *Filter) Err() error {
+	return f.err
+}
+
+// String answers the expression of this filter.
+func (f *Filter) String() string {
+	return f.ex.String()
+}
@@ -0,0 +1,62 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"testing"
+
+	"github.com/js-ojus/flagon/expr"
+)
+
+func TestFilter(t *testing.T) {
+	ed := wireDefn(t, "filter_item", []testField{{"name", FieldTypeString}, {"qty", FieldTypeUint32}}, CodecFramed)
+	tests := []struct {
+		src  string
+		vals map[string]interface{}
+		want bool
+	}{
+		{"qty >= 3 && name == 'bolt'", map[string]interface{}{"name": "bolt", "qty": uint32(3)}, true},
+		{"qty >= 3 && name == 'bolt'", map[string]interface{}{"name": "nut", "qty": uint32(3)}, false},
+		{"name == null", map[string]interface{}{"qty": uint32(1)}, true},
+		{"name == null", map[string]interface{}{"name": ""}, false},
+	}
+	for _, tc := range tests {
+		f, err := NewFilter(tc.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(1, testDoc(t, ed, 1, tc.vals)); got != tc.want || f.Err() != nil {
+			t.Errorf("%s, %v: %v, %v", tc.src, tc.vals, got, f.Err())
+		}
+		if f.String() != tc.src {
+			t.Errorf("source %q", f.String())
+		}
+	}
+
+	// Once evaluation fails, nothing matches.
+	f, _ := NewFilter("qty")
+	d := testDoc(t, ed, 1, map[string]interface{}{"qty": uint32(1)})
+	if f.Match(1, d) || f.Err() == nil {
+		t.Error("non-boolean filter matched")
+	}
+	f.ex = expr.MustCompile("true")
+	if f.Match(1, d) {
+		t.Error("matched after an error")
+	}
+
+	if _, err := NewFilter("qty >"); err == nil {
+		t.Error("invalid filter compiled")
+	}
+}
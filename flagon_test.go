@@ -0,0 +1,127 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// testDB is the handle to the database shared by the tests, in the
+// directory testDir.  Storage is a process-wide singleton; tests
+// therefore use names of their own.
+var (
+	testDB  *DB
+	testDir string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = os.MkdirTemp("", "flagon")
+	if err != nil {
+		panic(err)
+	}
+	testDB, err = Open(testDir, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	testDB.Close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// clockDB answers a handle to the test database that reads the time
+// from a manual clock showing the given time, together with the clock.
+func clockDB(at time.Time) (*DB, *ManualClock) {
+	clk := NewManualClock(at)
+	return &DB{sdb: testDB.sdb, opts: Options{Clock: clk}}, clk
+}
+
+// testNamespace answers a new namespace having the given name.
+func testNamespace(t *testing.T, name string) *Namespace {
+	t.Helper()
+	ns, err := NewNamespace(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+// testField is a field of an entity type defined by a test.
+type testField struct {
+	name  string
+	ftype FieldType
+}
+
+// testDefn answers the definition of an entity type having the given
+// name and fields, saved in the catalogue after the given function, if
+// any, has configured it.
+func testDefn(t *testing.T, name string, fields []testField, fn func(*EntityTypeDefn)) *EntityTypeDefn {
+	t.Helper()
+	ed, err := NewEntityTypeDefn(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if err := ed.AddField(f.name, f.ftype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fn != nil {
+		fn(ed)
+	}
+	if err := testDB.SaveEntityTypeDefn(ed); err != nil {
+		t.Fatal(err)
+	}
+	return ed
+}
+
+// testDoc answers a new document of the given entity type having the
+// given ID and field values.
+func testDoc(t *testing.T, ed *EntityTypeDefn, id uint64, vals map[string]interface{}) *Document {
+	t.Helper()
+	d := NewDocument(ed, id)
+	for name, v := range vals {
+		f, err := d.Field(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := setFieldValue(f, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// storedForm answers the stored form of the entity having the given ID,
+// without its checksum.
+func storedForm(t *testing.T, ns *Namespace, ed *EntityTypeDefn, id uint64) []byte {
+	t.Helper()
+	var by []byte
+	err := testDB.sdb.View(func(tx *storage.Tx) error {
+		v, err := tx.Get(ns.Name(), ed.Name(), EntityKey{id: id}.Key())
+		by = append([]byte(nil), v...)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return by
+}
@@ -0,0 +1,282 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/js-ojus/flagon"
+)
+
+// StatusError is answered by a `Client` when the server answers an
+// error that does not correspond to an error of package `flagon`.
+type StatusError struct {
+	StatusCode int    // HTTP status code of the response
+	Message    string // body of the response
+}
+
+// Error conforms to `error`.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client accesses the entities served by a `Handler`.  It is safe for
+// concurrent use.
+type Client struct {
+	base string // URL of the handler, without a trailing `/`
+	hc   *http.Client
+}
+
+// NewClient answers a client of the handler served at the given
+// address.  The network is `unix`, for a Unix socket at the path
+// `addr`, or `tcp`, for the handler at the root of the HTTP server at
+// `addr`.
+func NewClient(network, addr string) (*Client, error) {
+	switch network {
+	case "unix":
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		}
+		return &Client{base: "http://flagon", hc: &http.Client{Transport: tr}}, nil
+	case "tcp":
+		return &Client{base: "http://" + addr, hc: http.DefaultClient}, nil
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+}
+
+// NewClientURL answers a client of the handler served at the given
+// URL, using the given HTTP client; `http.DefaultClient` if `nil`.
+func NewClientURL(u string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{base: strings.TrimSuffix(u, "/"), hc: hc}
+}
+
+// EntityTypeDefns answers the entity type definitions in the system
+// catalogue of the served database.
+func (c *Client) EntityTypeDefns() ([]*flagon.EntityTypeDefn, error) {
+	var res []*flagon.EntityTypeDefn
+	_, err := c.do(context.Background(), http.MethodGet, "/types", "", nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// EntityType answers the entity type having the given name in the
+// given namespace of the served database.  It is a
+// `flagon.VersionedEntityType`, and a `flagon.ContextEntityType`.
+func (c *Client) EntityType(ns *flagon.Namespace, name string) (flagon.EntityType, error) {
+	defns, err := c.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range defns {
+		if ed.Name() == name {
+			return &remoteType{c: c, ed: ed, path: "/ns/" + ns.Name() + "/" + name}, nil
+		}
+	}
+	return nil, flagon.ErrNameUnknown
+}
+
+// do sends a request having the given method, path, `If-Match` header
+// and body - if not empty - to the server, decoding the response into
+// `out`, if not `nil`.  It answers the status code of the response.
+func (c *Client) do(ctx context.Context, method, p, match string, body []byte, out interface{}) (int, error) {
+	req, err := http.NewRequest(method, c.base+p, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if match != "" {
+		req.Header.Set("If-Match", match)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	by, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode >= 300 {
+		code := resp.Header.Get(ErrorHeader)
+		for _, ke := range knownErrors {
+			if code == ke.code && resp.StatusCode == ke.status {
+				return resp.StatusCode, ke.err
+			}
+		}
+		return resp.StatusCode, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(by))}
+	}
+	if out != nil {
+		err = json.Unmarshal(by, out)
+	}
+	return resp.StatusCode, err
+}
+
+// remoteType is an entity type of a served database.
+type remoteType struct {
+	c    *Client
+	ed   *flagon.EntityTypeDefn
+	path string // of the entity type, relative to the client's URL
+}
+
+// Name conforms to `flagon.EntityType`.
+func (rt *remoteType) Name() string {
+	return rt.ed.Name()
+}
+
+// Get conforms to `flagon.EntityType`.
+func (rt *remoteType) Get(id uint64) (flagon.Entity, error) {
+	return rt.GetContext(context.Background(), id)
+}
+
+// GetContext conforms to `flagon.ContextEntityType`.
+func (rt *remoteType) GetContext(ctx context.Context, id uint64) (flagon.Entity, error) {
+	if id == 0 {
+		return nil, flagon.ErrIdentifierZero
+	}
+	d := flagon.NewDocument(rt.ed, 0)
+	_, err := rt.c.do(ctx, http.MethodGet, rt.path+"/"+strconv.FormatUint(id, 10), "", nil, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Put conforms to `flagon.EntityType`.  The ID and the version of the
+// given document are updated with those stored.
+func (rt *remoteType) Put(e flagon.Entity) error {
+	return rt.put(context.Background(), e, "")
+}
+
+// PutContext conforms to `flagon.ContextEntityType`.
+func (rt *remoteType) PutContext(ctx context.Context, e flagon.Entity) error {
+	return rt.put(ctx, e, "")
+}
+
+// PutIfVersion conforms to `flagon.VersionedEntityType`.
+func (rt *remoteType) PutIfVersion(e flagon.Entity, expected uint64) error {
+	return rt.PutIfVersionContext(context.Background(), e, expected)
+}
+
+// PutIfVersionContext conforms to `flagon.ContextEntityType`.  Since
+// new entities are created without conditions, the expected version
+// of a document without an ID should be `0`.
+func (rt *remoteType) PutIfVersionContext(ctx context.Context, e flagon.Entity, expected uint64) error {
+	if e.ID() == 0 {
+		if expected != 0 {
+			return flagon.ErrVersionConflict
+		}
+		return rt.put(ctx, e, "")
+	}
+	return rt.put(ctx, e, `"`+strconv.FormatUint(expected, 10)+`"`)
+}
+
+// put stores the given entity, conditionally if a version to match is
+// given.
+func (rt *remoteType) put(ctx context.Context, e flagon.Entity, match string) error {
+	d, ok := e.(*flagon.Document)
+	if !ok || d.TypeName() != rt.Name() {
+		return flagon.ErrEntityTypeMismatch
+	}
+	by, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	method, p := http.MethodPost, rt.path
+	if d.ID() != 0 {
+		method, p = http.MethodPut, rt.path+"/"+strconv.FormatUint(d.ID(), 10)
+	}
+	_, err = rt.c.do(ctx, method, p, match, by, d)
+	return err
+}
+
+// Delete conforms to `flagon.EntityType`.
+func (rt *remoteType) Delete(id uint64) error {
+	return rt.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext conforms to `flagon.ContextEntityType`.
+func (rt *remoteType) DeleteContext(ctx context.Context, id uint64) error {
+	if id == 0 {
+		return flagon.ErrIdentifierZero
+	}
+	_, err := rt.c.do(ctx, http.MethodDelete, rt.path+"/"+strconv.FormatUint(id, 10), "", nil, nil)
+	return err
+}
+
+// Search conforms to `flagon.EntityType`.
+func (rt *remoteType) Search(opts flagon.SearchOpts, fn flagon.SearchFn) ([]uint64, error) {
+	return rt.SearchContext(context.Background(), opts, fn)
+}
+
+// SearchContext conforms to `flagon.ContextEntityType`.  The entities
+// are fetched a page at a time, and are passed to the predicate in
+// this process; only `opts.StartAt` and `opts.Limit` are honoured.
+func (rt *remoteType) SearchContext(ctx context.Context, opts flagon.SearchOpts, fn flagon.SearchFn) ([]uint64, error) {
+	res := make([]uint64, 0, 8)
+	start := opts.StartAt
+	for {
+		q := url.Values{}
+		q.Set("start", strconv.FormatUint(start, 10))
+		q.Set("limit", strconv.Itoa(MaxLimit))
+		var pg flagon.Page[json.RawMessage]
+		_, err := rt.c.do(ctx, http.MethodGet, rt.path+"?"+q.Encode(), "", nil, &pg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, raw := range pg.Items {
+			d := flagon.NewDocument(rt.ed, 0)
+			err = json.Unmarshal(raw, d)
+			if err != nil {
+				return nil, err
+			}
+			if !fn(d.ID(), d) {
+				continue
+			}
+			res = append(res, d.ID())
+			if opts.Limit > 0 && uint64(len(res)) == opts.Limit {
+				return res, nil
+			}
+		}
+		if pg.Next == 0 {
+			return res, nil
+		}
+		start = pg.Next
+	}
+}
@@ -0,0 +1,223 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonhttp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/flagonhttp"
+)
+
+func TestClient(t *testing.T) {
+	userDefn(t, "client_user")
+	srv := httptest.NewServer(flagonhttp.NewHandler(testDB))
+	defer srv.Close()
+	c := flagonhttp.NewClientURL(srv.URL+"/", nil)
+	ns, _ := flagon.NewNamespace("client_ns")
+
+	if _, err := c.EntityType(ns, "client_none"); err != flagon.ErrNameUnknown {
+		t.Errorf("unknown type: %v", err)
+	}
+	et, err := c.EntityType(ns, "client_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := et.(interface{ Name() string })
+	if ed.Name() != "client_user" {
+		t.Errorf("name: %s", ed.Name())
+	}
+	defns, err := c.EntityTypeDefns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var red *flagon.EntityTypeDefn
+	for _, d := range defns {
+		if d.Name() == "client_user" {
+			red = d
+		}
+	}
+	if red == nil {
+		t.Fatal("definition not listed")
+	}
+
+	// More entities than fit in a page of the server.
+	n := flagonhttp.MaxLimit + 5
+	for i := 0; i < n; i++ {
+		d := flagon.NewDocument(red, 0)
+		f, _ := d.Field("age")
+		f.(*flagon.FieldInt64).Set(int64(i))
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		if d.ID() != uint64(i+1) || d.Version() != 1 {
+			t.Fatalf("stored as %d, version %d", d.ID(), d.Version())
+		}
+	}
+
+	e, err := et.Get(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt := et.(flagon.VersionedEntityType)
+	if err := vt.PutIfVersion(e, 1); err != nil {
+		t.Fatal(err)
+	}
+	if e.(*flagon.Document).Version() != 2 {
+		t.Errorf("version %d", e.(*flagon.Document).Version())
+	}
+	if err := vt.PutIfVersion(e, 1); err != flagon.ErrVersionConflict {
+		t.Errorf("stale put: %v", err)
+	}
+	if err := vt.PutIfVersion(flagon.NewDocument(red, 0), 3); err != flagon.ErrVersionConflict {
+		t.Errorf("new entity of a version: %v", err)
+	}
+
+	// Searches page through all the entities.
+	ids, err := et.Search(flagon.SearchOpts{}, func(_ uint64, e flagon.Entity) bool {
+		f, _ := e.(*flagon.Document).Field("age")
+		return f.(*flagon.FieldInt64).Get()%500 == 0
+	})
+	if err != nil || len(ids) != 3 || ids[2] != 1001 {
+		t.Errorf("search: %v, %v", ids, err)
+	}
+	all := func(uint64, flagon.Entity) bool { return true }
+	ids, err = et.Search(flagon.SearchOpts{StartAt: uint64(n - 1), Limit: 5}, all)
+	if err != nil || len(ids) != 2 || ids[0] != uint64(n-1) {
+		t.Errorf("search from %d: %v, %v", n-1, ids, err)
+	}
+
+	if err := et.Delete(7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.Get(7); err != flagon.ErrIdentifierUnknown {
+		t.Errorf("get deleted: %v", err)
+	}
+	if _, err := et.Get(0); err != flagon.ErrIdentifierZero {
+		t.Errorf("get zero: %v", err)
+	}
+	if err := et.Delete(0); err != flagon.ErrIdentifierZero {
+		t.Errorf("delete zero: %v", err)
+	}
+	other, _ := flagon.NewEntityTypeDefn("client_other")
+	if err := et.Put(flagon.NewDocument(other, 0)); err != flagon.ErrEntityTypeMismatch {
+		t.Errorf("put of another type: %v", err)
+	}
+
+	// Errors that are not those of package flagon carry their status.
+	bad := flagonhttp.NewClientURL(srv.URL+"/nowhere", nil)
+	if _, err := bad.EntityTypeDefns(); err == nil {
+		t.Error("no error")
+	} else if se, ok := err.(*flagonhttp.StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		t.Errorf("status error: %v", err)
+	}
+}
+
+func TestClientUnix(t *testing.T) {
+	userDefn(t, "unix_user")
+	sock := filepath.Join(t.TempDir(), "flagon.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := &http.Server{Handler: flagonhttp.NewHandler(testDB)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := flagonhttp.NewClient("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := flagon.NewNamespace("unix_ns")
+	et, err := c.EntityType(ns, "unix_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, _ := testDB.EntityTypeDefns()
+	var red *flagon.EntityTypeDefn
+	for _, d := range ed {
+		if d.Name() == "unix_user" {
+			red = d
+		}
+	}
+	d := flagon.NewDocument(red, 0)
+	if err := et.Put(d); err != nil || d.ID() == 0 {
+		t.Fatalf("put: %d, %v", d.ID(), err)
+	}
+
+	if _, err := flagonhttp.NewClient("udp", "x"); err == nil {
+		t.Error("udp client created")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	red := userDefn(t, "err_user")
+	srv := httptest.NewServer(flagonhttp.NewHandler(testDB))
+	defer srv.Close()
+	const base = "/ns/err_ns/err_user"
+
+	// Known errors are identified by their codes.
+	r := request(t, srv, "GET", base+"/9", "")
+	if r.status != http.StatusNotFound || r.header.Get(flagonhttp.ErrorHeader) != "identifier-unknown" {
+		t.Errorf("not found: %+v", r)
+	}
+	request(t, srv, "POST", base, `{"fields": {"name": "ann"}}`)
+	r = request(t, srv, "PUT", base+"/1", `{"fields": {"name": "bob"}}`, "If-Match", `"3"`)
+	if r.status != http.StatusPreconditionFailed || r.header.Get(flagonhttp.ErrorHeader) != "version-conflict" {
+		t.Errorf("conflict: %+v", r)
+	}
+
+	// Clients answer them as the errors of package flagon.
+	c := flagonhttp.NewClientURL(srv.URL, nil)
+	ns, _ := flagon.NewNamespace("err_ns")
+	et, err := c.EntityType(ns, "err_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.Get(9); err != flagon.ErrIdentifierUnknown || !errors.Is(err, flagon.ErrNotFound) {
+		t.Errorf("get: %v", err)
+	}
+	d := flagon.NewDocument(red, 1)
+	if err := et.(flagon.VersionedEntityType).PutIfVersion(d, 3); err != flagon.ErrVersionConflict || !errors.Is(err, flagon.ErrConflict) {
+		t.Errorf("put: %v", err)
+	}
+
+	// Messages alone, and codes answered with other statuses, are not
+	// recognised.
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/types" {
+			w.Header().Set(flagonhttp.ErrorHeader, "identifier-unknown")
+			http.Error(w, "unknown ID given", http.StatusTeapot)
+			return
+		}
+		http.Error(w, flagon.ErrIdentifierUnknown.Error(), http.StatusNotFound)
+	}))
+	defer fake.Close()
+	fc := flagonhttp.NewClientURL(fake.URL, nil)
+	if _, err := fc.EntityTypeDefns(); err == flagon.ErrIdentifierUnknown {
+		t.Error("code of another status recognised")
+	}
+	if _, err := fc.Changes(context.Background(), 0, 1); err == flagon.ErrIdentifierUnknown {
+		t.Error("message recognised")
+	} else if se, ok := err.(*flagonhttp.StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		t.Errorf("status error: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flagonhttp exposes the entities of a `flagon` database over
+// HTTP, so that small services can serve their data without writing
+// handlers by hand.
+//
+// Entities are addressed by their namespace, the name of their entity
+// type in the system catalogue, and their ID:
+//
+//	GET    /ns/{namespace}/{entityType}/{id}   read an entity
+//	PUT    /ns/{namespace}/{entityType}/{id}   create or replace it
+//	DELETE /ns/{namespace}/{entityType}/{id}   delete it
+//	POST   /ns/{namespace}/{entityType}        create an entity, with a new ID
+//	GET    /ns/{namespace}/{entityType}        search the entities
+//	GET    /types                              list the entity type definitions
+//	GET    /watch?after={position}             stream the changes to entities
+//	GET    /changes?after={position}           read the change log
+//	GET    /snapshot                           read a snapshot of the database
+//
+// Entities are read and written in the JSON form answered by
+// `Document.MarshalJSON`; the ID and the type may be omitted from
+// request bodies.  Reads answer the version of the entity as its
+// `ETag`; a `PUT` carrying an `If-Match` header stores the entity only
+// if its stored version is the given one.
+//
+// Searches accept the query parameters `where` (a `flagon.Filter`
+// expression), `start` and `limit` (at most `MaxLimit`; `DefaultLimit`
+// if absent), and answer a page of entities, as a `flagon.Page`:
+//
+//	{"items": [...], "next": 0, "total": 2, "exact": true, "truncated": false}
+//
+// Watches stream the changes to entities recorded in the change log,
+// as JSON lines, until the client goes away; see `flagon.DB.Watch`.
+// They accept the query parameters `namespace`, `type` (repeatable),
+// `min`, `max` and `where`, which filter the changes:
+//
+//	{"seq": 7, "op": "put", "namespace": "ns", "type": "t", "id": 3, "entity": {...}}
+//
+// Watching a single entity type of a namespace needs the right to read
+// it; other watches need the administrative right.
+//
+// The last two serve the followers of the database; see `Follower`.
+// They expose all the entities of all the namespaces, and should be
+// protected accordingly.
+//
+// Errors are answered with a status corresponding to their category,
+// and a plain-text body holding their messages.  The errors of package
+// `flagon` that a `Client` recognises are also identified by a code in
+// the `Flagon-Error` header.
+//
+// A `Client` accesses the entities served by a handler through the
+// interfaces of package `flagon`.  Since BoltDB locks the database
+// file, serving it - say, over a Unix socket, as `flagon serve` does -
+// is how other processes can access a database that is in use.
+//
+// The operations run with the contexts of their requests; hence, the
+// principals authenticated by `auth.Middleware` are recorded in the
+// audit log, and are authorised by the policy of the database, if any
+// (see `flagon.Options.Policy`).  The last two endpoints need the
+// administrative right; denied requests are answered with
+// `403 Forbidden`.  When a query ticket of `quota.Admitter.Middleware` is
+// present, searches are limited to its remaining budget, and their
+// costs are charged to it.
+package flagonhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/quota"
+)
+
+// Limits of the number of entities answered by a search.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Maximum size of a request body.
+const maxBody = 4 << 20
+
+// errIDMismatch is answered when the ID in the body of a request
+// differs from that in its path.
+var errIDMismatch = errors.New("ID in body does not match path")
+
+// Handler serves the entities of a database.  Mount it using
+// `http.StripPrefix` to serve it below a path prefix.
+type Handler struct {
+	db *flagon.DB
+}
+
+// NewHandler answers a handler serving the entities of the given
+// database.
+func NewHandler(db *flagon.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// ServeHTTP conforms to `http.Handler`.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		switch parts[0] {
+		case "types":
+			h.types(w, r)
+			return
+		case "changes":
+			h.changes(w, r)
+			return
+		case "watch":
+			h.watch(w, r)
+			return
+		case "snapshot":
+			h.snapshot(w, r)
+			return
+		}
+	}
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "ns" {
+		http.NotFound(w, r)
+		return
+	}
+	ns, err := flagon.NewNamespace(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	ed, err := h.entityTypeDefn(parts[2])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	et := h.db.EntityType(ns, ed)
+
+	if len(parts) == 3 {
+		switch r.Method {
+		case http.MethodGet:
+			h.search(w, r, ns, et)
+		case http.MethodPost:
+			h.put(w, r, et, ed, 0)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil || id == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w, r, et, id)
+	case http.MethodPut:
+		h.put(w, r, et, ed, id)
+	case http.MethodDelete:
+		err = et.(flagon.ContextEntityType).DeleteContext(r.Context(), id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// types answers the entity type definitions in the system catalogue.
+func (h *Handler) types(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	defns, err := h.db.EntityTypeDefns()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, defns)
+}
+
+// entityTypeDefn answers the definition of the entity type having the
+// given name in the system catalogue.
+func (h *Handler) entityTypeDefn(name string) (*flagon.EntityTypeDefn, error) {
+	defns, err := h.db.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range defns {
+		if ed.Name() == name {
+			return ed, nil
+		}
+	}
+	return nil, flagon.ErrNameUnknown
+}
+
+// get answers the entity having the given ID.
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, et flagon.EntityType, id uint64) {
+	e, err := et.(flagon.ContextEntityType).GetContext(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// put stores the entity in the body of the request under the given ID;
+// a new one, if it is `0`.
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, et flagon.EntityType, ed *flagon.EntityTypeDefn, id uint64) {
+	d, err := readDocument(r, ed, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cet := et.(flagon.ContextEntityType)
+	if m := r.Header.Get("If-Match"); m != "" && id != 0 {
+		var v uint64
+		v, err = strconv.ParseUint(strings.Trim(m, `"`), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+		err = cet.PutIfVersionContext(r.Context(), d, v)
+	} else {
+		err = cet.PutContext(r.Context(), d)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if id == 0 {
+		status = http.StatusCreated
+		w.Header().Set("Location", strings.TrimSuffix(requestPath(r), "/")+"/"+strconv.FormatUint(d.ID(), 10))
+	}
+	e, err := cet.GetContext(r.Context(), d.ID())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, e)
+}
+
+// requestPath answers the path of the given request, as sent by the
+// client; that is, including any prefix stripped by `http.StripPrefix`.
+func requestPath(r *http.Request) string {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return r.URL.Path
+	}
+	return u.Path
+}
+
+// readDocument reads the document in the body of the given request.
+// Its ID and type, if given, should match the given ones.
+func readDocument(r *http.Request, ed *flagon.EntityTypeDefn, id uint64) (*flagon.Document, error) {
+	by, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(by, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw, ok := m["id"]; ok && id != 0 {
+		var bid uint64
+		if json.Unmarshal(raw, &bid) != nil || bid != 0 && bid != id {
+			return nil, errIDMismatch
+		}
+	}
+	m["id"], _ = json.Marshal(id)
+	if _, ok := m["type"]; !ok {
+		m["type"], _ = json.Marshal(ed.Name())
+	}
+	by, err = json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	d := flagon.NewDocument(ed, 0)
+	err = json.Unmarshal(by, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// search answers a page of the entities matching the query parameters
+// of the request.
+func (h *Handler) search(w http.ResponseWriter, r *http.Request, ns *flagon.Namespace, et flagon.EntityType) {
+	if err := h.db.Authorize(r.Context(), flagon.RightRead, ns.Name(), et.Name()); err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	opts := flagon.SearchOpts{Limit: DefaultLimit}
+	var err error
+	if s := q.Get("start"); s != "" {
+		opts.StartAt, err = strconv.ParseUint(s, 10, 64)
+	}
+	if s := q.Get("limit"); s != "" && err == nil {
+		opts.Limit, err = strconv.ParseUint(s, 10, 64)
+		if opts.Limit == 0 || opts.Limit > MaxLimit {
+			opts.Limit = MaxLimit
+		}
+	}
+	if err != nil {
+		http.Error(w, "invalid start or limit", http.StatusBadRequest)
+		return
+	}
+
+	match := func(uint64, flagon.Entity) bool { return true }
+	var f *flagon.Filter
+	if s := q.Get("where"); s != "" {
+		f, err = flagon.NewFilter(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		match = f.Match
+	}
+
+	var st flagon.SearchStats
+	opts.Stats = &st
+	t, charged := quota.FromContext(r.Context())
+	if charged {
+		opts.MaxScanned = t.Remaining()
+	}
+	pg, err := et.(flagon.Paginator).SearchPage(opts, match)
+	if charged {
+		t.Charge(st.Scanned, st.BytesDecoded)
+	}
+	if err == nil && f != nil {
+		err = f.Err()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if pg.Items == nil {
+		pg.Items = []flagon.Entity{}
+	}
+	writeJSON(w, http.StatusOK, pg)
+}
+
+// writeJSON writes the given value as the JSON body of a response
+// having the given status.  Documents carry their versions as their
+// entity tags.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	by, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if d, ok := v.(*flagon.Document); ok {
+		w.Header().Set("ETag", `"`+strconv.FormatUint(d.Version(), 10)+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(by)
+	w.Write([]byte("\n"))
+}
+
+// ErrorHeader is the header of error responses that identifies the
+// error of package `flagon` answered, for those that a `Client`
+// recognises.
+const ErrorHeader = "Flagon-Error"
+
+// knownErrors are the errors of package `flagon` identified by their
+// codes in error responses, and the statuses answered for them.
+var knownErrors = []struct {
+	code   string
+	err    error
+	status int
+}{
+	{"identifier-unknown", flagon.ErrIdentifierUnknown, http.StatusNotFound},
+	{"name-unknown", flagon.ErrNameUnknown, http.StatusNotFound},
+	{"version-conflict", flagon.ErrVersionConflict, http.StatusPreconditionFailed},
+	{"type-frozen", flagon.ErrTypeFrozen, http.StatusConflict},
+	{"database-read-only", flagon.ErrDatabaseReadOnly, http.StatusConflict},
+	{"identifier-zero", flagon.ErrIdentifierZero, http.StatusBadRequest},
+	{"entity-type-mismatch", flagon.ErrEntityTypeMismatch, http.StatusBadRequest},
+	{"changes-trimmed", flagon.ErrChangesTrimmed, http.StatusGone},
+	{"change-log-disabled", flagon.ErrChangeLogDisabled, http.StatusNotImplemented},
+	{"quota-exceeded", flagon.ErrQuotaExceeded, http.StatusInsufficientStorage},
+}
+
+// writeError writes the response corresponding to the given error.
+// Known errors are identified by their codes in the `Flagon-Error`
+// header; others are answered by their categories.
+func writeError(w http.ResponseWriter, err error) {
+	for _, ke := range knownErrors {
+		if errors.Is(err, ke.err) {
+			w.Header().Set(ErrorHeader, ke.code)
+			http.Error(w, err.Error(), ke.status)
+			return
+		}
+	}
+
+	status := http.StatusInternalServerError
+	var ae *flagon.AccessError
+	switch {
+	case errors.Is(err, flagon.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, flagon.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, flagon.ErrReadOnly):
+		status = http.StatusConflict
+	case errors.Is(err, flagon.ErrValidation):
+		status = http.StatusUnprocessableEntity
+	case errors.As(err, &ae):
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// methodNotAllowed writes a `405 Method Not Allowed` response, listing
+// the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,186 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonhttp_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/flagonhttp"
+)
+
+// testDB is the database shared by the tests.  It records its
+// changes, for the tests of followers.
+var testDB *flagon.DB
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "flagonhttp")
+	if err != nil {
+		panic(err)
+	}
+	testDB, err = flagon.Open(dir, &flagon.Options{ChangeLog: true})
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+
+	code := m.Run()
+	testDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// response is a response read by `request`.
+type response struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// request sends a request to the given server, setting the given
+// header, if any.
+func request(t *testing.T, srv *httptest.Server, method, path, body string, header ...string) response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) == 2 {
+		req.Header.Set(header[0], header[1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	by, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response{status: resp.StatusCode, header: resp.Header, body: string(by)}
+}
+
+// userDefn saves, and answers, an entity type of users having the
+// given name.
+func userDefn(t *testing.T, name string) *flagon.EntityTypeDefn {
+	t.Helper()
+	ed, err := flagon.NewEntityTypeDefn(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed.AddField("name", flagon.FieldTypeString)
+	ed.AddField("age", flagon.FieldTypeInt64)
+	if err := testDB.SaveEntityTypeDefn(ed); err != nil {
+		t.Fatal(err)
+	}
+	return ed
+}
+
+func TestHandler(t *testing.T) {
+	userDefn(t, "http_user")
+	srv := httptest.NewServer(http.StripPrefix("/api", flagonhttp.NewHandler(testDB)))
+	defer srv.Close()
+	const base = "/api/ns/http_ns/http_user"
+
+	r := request(t, srv, "POST", base, `{"fields": {"name": "ann", "age": 30}}`)
+	if r.status != http.StatusCreated || r.header.Get("Location") != base+"/1" || r.header.Get("ETag") != `"1"` {
+		t.Fatalf("create: %+v", r)
+	}
+	request(t, srv, "POST", base, `{"fields": {"name": "bob", "age": 20}}`)
+
+	r = request(t, srv, "GET", base+"/1", "")
+	var doc struct {
+		ID     uint64                 `json:"id"`
+		Type   string                 `json:"type"`
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(r.body), &doc); err != nil || r.status != http.StatusOK {
+		t.Fatalf("get: %+v, %v", r, err)
+	}
+	if doc.ID != 1 || doc.Type != "http_user" || doc.Fields["name"] != "ann" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("get: %+v", doc)
+	}
+
+	// Conditional replacement uses the entity tag.
+	r = request(t, srv, "PUT", base+"/1", `{"fields": {"name": "ann", "age": 31}}`, "If-Match", `"1"`)
+	if r.status != http.StatusOK || r.header.Get("ETag") != `"2"` {
+		t.Errorf("put: %+v", r)
+	}
+	if r = request(t, srv, "PUT", base+"/1", `{"fields": {"name": "ann", "age": 32}}`, "If-Match", `"1"`); r.status != http.StatusPreconditionFailed {
+		t.Errorf("stale put: %+v", r)
+	}
+	if r = request(t, srv, "PUT", base+"/1", `{}`, "If-Match", "x"); r.status != http.StatusBadRequest {
+		t.Errorf("bad If-Match: %+v", r)
+	}
+	if r = request(t, srv, "PUT", base+"/1", `{"id": 2, "fields": {}}`); r.status != http.StatusBadRequest {
+		t.Errorf("ID mismatch: %+v", r)
+	}
+	if r = request(t, srv, "PUT", base+"/1", `not json`); r.status != http.StatusBadRequest {
+		t.Errorf("invalid body: %+v", r)
+	}
+
+	// Searches answer pages.
+	var pg flagon.Page[json.RawMessage]
+	page := func(query string) {
+		t.Helper()
+		r := request(t, srv, "GET", base+"?"+query, "")
+		pg.Items, pg.Next = nil, 0
+		if err := json.Unmarshal([]byte(r.body), &pg); err != nil || r.status != http.StatusOK {
+			t.Fatalf("%s: %+v, %v", query, r, err)
+		}
+	}
+	page("where=age+%3E+25")
+	if len(pg.Items) != 1 || pg.Next != 0 || !pg.Exact || pg.Truncated || !strings.Contains(string(pg.Items[0]), `"ann"`) {
+		t.Errorf("search: %+v", pg)
+	}
+	page("limit=1")
+	if len(pg.Items) != 1 || pg.Next != 2 {
+		t.Errorf("first page: %+v", pg)
+	}
+	page("start=2&limit=1")
+	if len(pg.Items) != 1 || pg.Next != 0 {
+		t.Errorf("last page: %+v", pg)
+	}
+	page("where=age+%3E+99")
+	if pg.Items == nil || len(pg.Items) != 0 {
+		t.Errorf("empty page: %+v", pg)
+	}
+	for _, q := range []string{"where=age+%3E", "limit=x", "start=-1"} {
+		if r = request(t, srv, "GET", base+"?"+q, ""); r.status != http.StatusBadRequest {
+			t.Errorf("%s: %+v", q, r)
+		}
+	}
+
+	if r = request(t, srv, "DELETE", base+"/1", ""); r.status != http.StatusNoContent {
+		t.Errorf("delete: %+v", r)
+	}
+	for _, path := range []string{base + "/1", "/api/ns/http_ns/nope/1", base + "/0", "/api/other/http_ns/http_user", "/api/ns/http_ns"} {
+		if r = request(t, srv, "GET", path, ""); r.status != http.StatusNotFound {
+			t.Errorf("%s: %+v", path, r)
+		}
+	}
+	if r = request(t, srv, "PATCH", base+"/2", ""); r.status != http.StatusMethodNotAllowed || r.header.Get("Allow") != "GET, PUT, DELETE" {
+		t.Errorf("patch: %+v", r)
+	}
+	if r = request(t, srv, "PUT", base, "{}"); r.status != http.StatusMethodNotAllowed || r.header.Get("Allow") != "GET, POST" {
+		t.Errorf("put to type: %+v", r)
+	}
+}
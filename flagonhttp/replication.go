@@ -0,0 +1,301 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonhttp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/js-ojus/flagon"
+)
+
+// changes is the serialisable form of a batch of change records.
+type changes struct {
+	Changes []flagon.ChangeRecord `json:"changes"`
+}
+
+// changes answers the entries of the change log following the
+// position given by the query parameter `after`, up to `limit`.
+func (h *Handler) changes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if err := h.db.Authorize(r.Context(), flagon.RightAdmin, "", ""); err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	after, err := strconv.ParseUint(q.Get("after"), 10, 64)
+	if err != nil && q.Get("after") != "" {
+		http.Error(w, "invalid after", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	cs, err := h.db.Changes(after, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if cs == nil {
+		cs = []flagon.ChangeRecord{}
+	}
+	writeJSON(w, http.StatusOK, changes{Changes: cs})
+}
+
+// watchEvent is the serialisable form of a `flagon.WatchEvent`.
+type watchEvent struct {
+	Seq       uint64           `json:"seq"`
+	Op        string           `json:"op"`
+	Namespace string           `json:"namespace"`
+	Type      string           `json:"type"`
+	ID        uint64           `json:"id"`
+	Entity    *flagon.Document `json:"entity,omitempty"`
+}
+
+// watch streams the changes to entities following the position given
+// by the query parameter `after`, as JSON lines, until the client goes
+// away.  The query parameters `namespace`, `type` (repeatable), `min`,
+// `max` and `where` filter the changes, as the fields of
+// `flagon.WatchOpts` do.  Watching a single entity type of a namespace
+// needs the right to read it; other watches need the administrative
+// right.
+func (h *Handler) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	q := r.URL.Query()
+	opts := flagon.WatchOpts{Namespace: q.Get("namespace"), Types: q["type"], Where: q.Get("where")}
+	var err error
+	for _, p := range []struct {
+		name string
+		v    *uint64
+	}{{"after", &opts.After}, {"min", &opts.MinID}, {"max", &opts.MaxID}} {
+		if s := q.Get(p.name); s != "" {
+			if *p.v, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "invalid "+p.name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	right, et := flagon.RightAdmin, ""
+	if opts.Namespace != "" && len(opts.Types) == 1 {
+		right, et = flagon.RightRead, opts.Types[0]
+	}
+	if err = h.db.Authorize(r.Context(), right, opts.Namespace, et); err != nil {
+		writeError(w, err)
+		return
+	}
+	if opts.Where != "" {
+		if _, err = flagon.NewFilter(opts.Where); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Errors known before streaming begins are answered as statuses.
+	if !h.db.ChangeLog() {
+		writeError(w, flagon.ErrChangeLogDisabled)
+		return
+	}
+	if _, err = h.db.Changes(opts.After, 1); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	h.db.Watch(r.Context(), opts, func(ev flagon.WatchEvent) error {
+		we := watchEvent{Seq: ev.Seq, Op: "put", Namespace: ev.Namespace, Type: ev.Type, ID: ev.ID, Entity: ev.Doc}
+		if ev.Op == flagon.ChangeDelete {
+			we.Op = "delete"
+		}
+		err := enc.Encode(we)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+}
+
+// snapshot answers a snapshot of the database.
+func (h *Handler) snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if err := h.db.Authorize(r.Context(), flagon.RightAdmin, "", ""); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.db.WriteSnapshot(w)
+}
+
+// Changes answers up to `max` entries of the change log of the served
+// database, following the given position.  See `flagon.DB.Changes`.
+func (c *Client) Changes(ctx context.Context, after uint64, max int) ([]flagon.ChangeRecord, error) {
+	q := url.Values{}
+	q.Set("after", strconv.FormatUint(after, 10))
+	q.Set("limit", strconv.Itoa(max))
+	var res changes
+	_, err := c.do(ctx, http.MethodGet, "/changes?"+q.Encode(), "", nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Changes, nil
+}
+
+// Snapshot answers a snapshot of the served database, to be read by
+// `flagon.DB.LoadSnapshot`.  The caller should close it.
+func (c *Client) Snapshot(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+"/snapshot", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	return resp.Body, nil
+}
+
+// Default interval between polls of an idle leader.
+const defaultPollInterval = time.Second
+
+// Follower replicates the database served by a handler - the leader,
+// which should record its changes (see `flagon.Options.ChangeLog`) -
+// into a local database.  The local database is bootstrapped from a
+// snapshot of the leader; thereafter, the changes of the leader are
+// applied in order.  Its position in the change log of the leader is
+// stored in it; hence, replication resumes where it stopped.  When the
+// leader has trimmed changes that the follower has not applied, the
+// follower is bootstrapped afresh.
+//
+// A leader can have any number of followers, each replicating at its
+// own pace; the leader should trim its change log only up to the
+// position that all of them have reached.
+type Follower struct {
+	DB     *flagon.DB // the local database
+	Leader *Client    // client of the leader
+
+	// Interval is the time to wait before polling the leader again,
+	// once all its changes are applied; one second if zero.
+	Interval time.Duration
+
+	// OnApply, if not `nil`, is called after every batch of changes
+	// is applied, with the position reached.
+	OnApply func(cursor uint64)
+
+	// OnError, if not `nil`, is called with the errors that `Run`
+	// retries.
+	OnError func(error)
+}
+
+// Sync brings the local database up to date with the leader: it is
+// bootstrapped if necessary, and the changes of the leader are applied
+// until none remain.  It answers the number of changes applied.
+func (f *Follower) Sync(ctx context.Context) (uint64, error) {
+	var n uint64
+	for {
+		cur, ok, err := f.DB.ReplicaCursor()
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			cur, err = f.bootstrap(ctx)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		cs, err := f.Leader.Changes(ctx, cur, MaxLimit)
+		if err == flagon.ErrChangesTrimmed {
+			_, err = f.bootstrap(ctx)
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err != nil || len(cs) == 0 {
+			return n, err
+		}
+
+		err = f.DB.ApplyChanges(cs)
+		if err != nil {
+			return n, err
+		}
+		n += uint64(len(cs))
+		if f.OnApply != nil {
+			f.OnApply(cs[len(cs)-1].Seq)
+		}
+	}
+}
+
+// bootstrap loads a snapshot of the leader into the local database,
+// answering its position.
+func (f *Follower) bootstrap(ctx context.Context) (uint64, error) {
+	rc, err := f.Leader.Snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return f.DB.LoadSnapshot(rc)
+}
+
+// Run synchronises the local database with the leader, polling it at
+// its interval, until the given context is done.  Errors are retried
+// after the interval; it answers the error of the context.
+func (f *Follower) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		_, err := f.Sync(ctx)
+		if err != nil && ctx.Err() == nil && f.OnError != nil {
+			f.OnError(err)
+		}
+		t.Reset(interval)
+	}
+}
@@ -0,0 +1,116 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonhttp_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/flagonhttp"
+)
+
+// A process has a single database; the follower here replicates its
+// own leader.  Applying the changes of the leader leaves it unchanged,
+// and is not recorded in its change log.
+func TestFollower(t *testing.T) {
+	leader := testDB
+	var base uint64
+	for {
+		cs, err := leader.Changes(base, flagonhttp.MaxLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) == 0 {
+			break
+		}
+		base = cs[len(cs)-1].Seq
+	}
+	ed := userDefn(t, "repl_user")
+	ns, _ := flagon.NewNamespace("repl_ns")
+	et := leader.EntityType(ns, ed)
+	put := func() uint64 {
+		d := flagon.NewDocument(ed, 0)
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID()
+	}
+	put()
+
+	srv := httptest.NewServer(flagonhttp.NewHandler(leader))
+	defer srv.Close()
+	c := flagonhttp.NewClientURL(srv.URL, nil)
+	ctx := context.Background()
+
+	// The definition and the entity are the first changes.
+	cs, err := c.Changes(ctx, base, 10)
+	if err != nil || len(cs) != 2 || cs[0].Kind != flagon.ChangeRecordDefn || cs[1].Kind != flagon.ChangeRecordPut || cs[1].Namespace != "repl_ns" {
+		t.Fatalf("changes: %+v, %v", cs, err)
+	}
+	if cs, err = c.Changes(ctx, base+1, 10); err != nil || len(cs) != 1 || cs[0].Seq != base+2 {
+		t.Errorf("changes after %d: %+v, %v", base+1, cs, err)
+	}
+
+	// Bootstrapping applies no changes.
+	var applied []uint64
+	f := &flagonhttp.Follower{DB: testDB, Leader: c, OnApply: func(cur uint64) { applied = append(applied, cur) }}
+	if n, err := f.Sync(ctx); n != 0 || err != nil {
+		t.Fatalf("bootstrap: %d, %v", n, err)
+	}
+	if cur, ok, _ := testDB.ReplicaCursor(); cur != base+2 || !ok {
+		t.Errorf("bootstrapped at %d, %v", cur, ok)
+	}
+	id := put()
+	et.Delete(id)
+	if n, err := f.Sync(ctx); n != 2 || err != nil || len(applied) != 1 || applied[0] != base+4 {
+		t.Errorf("sync: %d, %v, %v", n, err, applied)
+	}
+
+	// Trimmed changes cause a fresh bootstrap.
+	put()
+	if _, err := leader.TrimChanges(base + 5); err != nil {
+		t.Fatal(err)
+	}
+	put()
+	if _, err := c.Changes(ctx, base+4, 10); err != flagon.ErrChangesTrimmed {
+		t.Errorf("trimmed: %v", err)
+	}
+	if n, err := f.Sync(ctx); n != 0 || err != nil {
+		t.Errorf("sync after trimming: %d, %v", n, err)
+	}
+	if cur, _, _ := testDB.ReplicaCursor(); cur != base+6 {
+		t.Errorf("rebootstrapped at %d", cur)
+	}
+	if ids, _ := et.Search(flagon.SearchOpts{}, func(uint64, flagon.Entity) bool { return true }); len(ids) != 3 {
+		t.Errorf("entities: %v", ids)
+	}
+
+	r := request(t, srv, "GET", "/changes?after=x", "")
+	if r.status != http.StatusBadRequest {
+		t.Errorf("invalid position: %+v", r)
+	}
+	resp, err := http.Post(srv.URL+"/snapshot", "", nil)
+	if err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("post snapshot: %d", resp.StatusCode)
+		}
+	}
+}
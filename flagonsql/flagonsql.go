@@ -0,0 +1,402 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flagonsql is a read-only `database/sql` driver for `flagon`
+// databases, so that reporting code written against SQL can read
+// them.  The driver is registered as `flagon`; its data source name is
+// the base storage directory path of the database:
+//
+//	db, err := sql.Open("flagon", "/path/to/storage")
+//	rows, err := db.Query("SELECT id, name FROM people.person WHERE age >= ? ORDER BY name", 18)
+//
+// Since a process can open a single `flagon` database, the database is
+// opened for reading only once, and remains open for the life of the
+// process.  Applications that already hold a handle to the database
+// should use `NewConnector` with `sql.OpenDB` instead.
+//
+// Tables are entity types, qualified by their namespaces.  Their
+// columns are `id`, holding the IDs of the entities, and their fields.
+// Queries are simple `SELECT` statements:
+//
+//	SELECT * | column {, column}
+//	FROM namespace.type
+//	[WHERE condition]
+//	[ORDER BY column [ASC | DESC]]
+//	[LIMIT n [OFFSET n]]
+//
+// Conditions combine columns, literals and `?` placeholders using the
+// comparison operators, `AND`, `OR`, `NOT`, `IS [NOT] NULL`,
+// `[NOT] IN (...)`, `[NOT] BETWEEN ... AND ...`, arithmetic, and the
+// functions of package `expr`, such as `lower(name)`.  As in SQL,
+// operators applied to nulls answer nulls, and conditions involving
+// nulls are unknown, and do not select rows.  Queries are translated
+// into searches, whose conditions are evaluated against every entity
+// of the type; the rows of a query are read in full before they are
+// answered.  Soft-deleted and expired entities are not read.
+//
+// Values are answered as `int64`, `float64`, `bool`, `string` or
+// `time.Time`, or `nil` for nulls; unsigned integers beyond the range
+// of `int64` are answered as `float64`s.  Statements other than
+// queries, and transactions other than read-only ones, answer
+// `ErrReadOnly`.
+package flagonsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/expr"
+)
+
+var (
+	// ErrReadOnly is answered by statements that would modify the
+	// database, and by transactions that are not read-only.
+	ErrReadOnly = errors.New("flagon SQL driver is read-only")
+
+	// ErrSyntax is answered when a query can not be parsed, or uses
+	// SQL that is not supported.
+	ErrSyntax = errors.New("unsupported SQL query")
+
+	// ErrPathConflict is answered when a database other than the one
+	// already opened by the driver is opened.
+	ErrPathConflict = errors.New("another flagon database is already open")
+)
+
+func init() {
+	sql.Register("flagon", Driver{})
+}
+
+// Driver is the `flagon` SQL driver.
+type Driver struct{}
+
+// shared is the handle opened by the driver, and the path of its
+// database.
+var shared struct {
+	mutex sync.Mutex
+	db    *flagon.DB
+	path  string
+}
+
+// Open conforms to `driver.Driver`.
+func (d Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector conforms to `driver.DriverContext`.  It opens the
+// database at the given path for reading, unless already open.
+func (Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.db != nil {
+		if dsn != shared.path {
+			return nil, fmt.Errorf("%s: %s", ErrPathConflict, shared.path)
+		}
+		return NewConnector(shared.db), nil
+	}
+
+	db, err := flagon.Open(dsn, &flagon.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	shared.db, shared.path = db, dsn
+	return NewConnector(db), nil
+}
+
+// NewConnector answers a connector to the database of the given
+// handle, for use with `sql.OpenDB`.
+func NewConnector(db *flagon.DB) driver.Connector {
+	return connector{db: db}
+}
+
+// connector conforms to `driver.Connector`.
+type connector struct {
+	db *flagon.DB
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (connector) Driver() driver.Driver {
+	return Driver{}
+}
+
+// conn is a connection to a database.  Since the database stays open,
+// closing connections has no effect.
+type conn struct {
+	db *flagon.DB
+}
+
+func (c *conn) Prepare(src string) (driver.Stmt, error) {
+	q, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{db: c.db, q: q}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, ErrReadOnly
+}
+
+// BeginTx conforms to `driver.ConnBeginTx`.  Only read-only
+// transactions are supported; each of their queries reads the
+// database as of its own beginning.
+func (c *conn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if !opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	return tx{}, nil
+}
+
+// tx is a read-only transaction.
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+// stmt is a prepared query.
+type stmt struct {
+	db *flagon.DB
+	q  *query
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.q.params
+}
+
+func (s *stmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, ErrReadOnly
+}
+
+// Query runs the query, with the given arguments for its placeholders.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	q := s.q
+	ns, err := flagon.NewNamespace(q.ns)
+	if err != nil {
+		return nil, err
+	}
+	ed, err := entityTypeDefn(s.db, q.et)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := columns(ed, q.cols)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows in the descending order of IDs are all read, and reversed.
+	var opts flagon.SearchOpts
+	reverse := false
+	switch {
+	case q.orderBy != "" && q.orderBy != "id":
+		if _, err = ed.Field(q.orderBy); err != nil {
+			return nil, fmt.Errorf("%s: %s", err, q.orderBy)
+		}
+		opts = opts.OrderBy(q.orderBy, !q.desc)
+	case q.desc:
+		reverse = true
+	}
+	r := &rows{cols: cols}
+	if q.limit == 0 {
+		return r, nil
+	}
+
+	env := &rowEnv{args: args}
+	var everr error
+	match := func(_ uint64, e flagon.Entity) bool {
+		d, ok := e.(*flagon.Document)
+		if !ok || everr != nil {
+			return false
+		}
+		if q.where == nil {
+			return true
+		}
+		env.d = d
+		ok, everr = q.where.EvalBool(env)
+		return ok
+	}
+	skip := q.offset
+	each := func(e flagon.Entity) bool {
+		if !reverse && skip > 0 {
+			skip--
+			return true
+		}
+		r.data = append(r.data, row(e.(*flagon.Document), cols))
+		return reverse || q.limit < 0 || int64(len(r.data)) < q.limit
+	}
+
+	es, ok := s.db.EntityType(ns, ed).(flagon.EntitySearcher)
+	if !ok {
+		return nil, ErrSyntax
+	}
+	err = es.SearchEntities(opts, match, each)
+	if err == nil {
+		err = everr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if reverse {
+		n := int64(len(r.data))
+		for i, j := 0, n-1; int64(i) < j; i, j = i+1, j-1 {
+			r.data[i], r.data[j] = r.data[j], r.data[i]
+		}
+		lo, hi := q.offset, n
+		if lo > n {
+			lo = n
+		}
+		if q.limit >= 0 && lo+q.limit < hi {
+			hi = lo + q.limit
+		}
+		r.data = r.data[lo:hi]
+	}
+	return r, nil
+}
+
+// entityTypeDefn answers the definition of the entity type having the
+// given name.
+func entityTypeDefn(db *flagon.DB, name string) (*flagon.EntityTypeDefn, error) {
+	defns, err := db.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range defns {
+		if ed.Name() == name {
+			return ed, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %s", flagon.ErrNameUnknown, name)
+}
+
+// columns answers the given columns of the given entity type, after
+// verifying them; `id` and all its fields, in the ascending order of
+// their IDs, if none are given.
+func columns(ed *flagon.EntityTypeDefn, cols []string) ([]string, error) {
+	if cols == nil {
+		fds := ed.Fields()
+		sort.Sort(fieldDefnsByID(fds))
+		cols = []string{"id"}
+		for _, fd := range fds {
+			cols = append(cols, fd.Name)
+		}
+		return cols, nil
+	}
+
+	for _, col := range cols {
+		if _, err := ed.Field(col); err != nil && col != "id" {
+			return nil, fmt.Errorf("%s: %s", err, col)
+		}
+	}
+	return cols, nil
+}
+
+// fieldDefnsByID sorts field definitions in the ascending order of
+// their IDs.
+type fieldDefnsByID []flagon.FieldDefn
+
+func (s fieldDefnsByID) Len() int           { return len(s) }
+func (s fieldDefnsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s fieldDefnsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// row answers the values of the given columns of the given document.
+func row(d *flagon.Document, cols []string) []driver.Value {
+	res := make([]driver.Value, len(cols))
+	for i, col := range cols {
+		if col == "id" {
+			res[i] = expr.Normalise(d.ID())
+			continue
+		}
+		v, _ := d.Value(col)
+		res[i] = expr.Normalise(v)
+	}
+	return res
+}
+
+// rowEnv exposes the columns of a document, and the arguments of a
+// query, to its condition.
+type rowEnv struct {
+	d    *flagon.Document
+	args []driver.Value
+}
+
+// Lookup conforms to `expr.Env`.
+func (e *rowEnv) Lookup(name string) (interface{}, bool) {
+	switch {
+	case name == "id":
+		return e.d.ID(), true
+
+	case name[0] == '_':
+		n, err := strconv.Atoi(name[1:])
+		if err != nil || n < 1 || n > len(e.args) {
+			return nil, false
+		}
+		if by, ok := e.args[n-1].([]byte); ok {
+			return string(by), true
+		}
+		return e.args[n-1], true
+	}
+
+	v, err := e.d.Value(name)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// rows holds the rows answered by a query.
+type rows struct {
+	cols []string
+	data [][]driver.Value
+}
+
+func (r *rows) Columns() []string {
+	return r.cols
+}
+
+func (r *rows) Close() error {
+	r.data = nil
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.data) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.data[0])
+	r.data = r.data[1:]
+	return nil
+}
@@ -0,0 +1,237 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonsql_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/js-ojus/flagon"
+	"github.com/js-ojus/flagon/flagonsql"
+)
+
+// testDB is the database shared by the tests, and `sqlDB` the SQL
+// handle to it.
+var (
+	testDB *flagon.DB
+	sqlDB  *sql.DB
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "flagonsql")
+	if err != nil {
+		panic(err)
+	}
+	testDB, err = flagon.Open(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	sqlDB = sql.OpenDB(flagonsql.NewConnector(testDB))
+
+	code := m.Run()
+	sqlDB.Close()
+	testDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// peopleOnce stores the people read by the tests, once.
+var peopleOnce sync.Once
+
+// people stores a few people, in entity type `sql_ns.person`, unless
+// already stored.  A nil score leaves it null.  The person named
+// `gone` is soft-deleted.
+func people(t *testing.T) {
+	t.Helper()
+	peopleOnce.Do(func() { storePeople(t) })
+}
+
+func storePeople(t *testing.T) {
+	ed, err := flagon.NewEntityTypeDefn("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed.AddField("name", flagon.FieldTypeString)
+	ed.AddField("age", flagon.FieldTypeInt64)
+	ed.AddField("score", flagon.FieldTypeFloat64)
+	if err := testDB.SaveEntityTypeDefn(ed); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := flagon.NewNamespace("sql_ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	et := testDB.EntityType(ns, ed)
+
+	for _, p := range []struct {
+		name  string
+		age   int64
+		score interface{}
+	}{
+		{"ann", 30, 7.5},
+		{"bob", 20, nil},
+		{"cat", 40, 9.0},
+		{"gone", 50, 1.0},
+		{"dan", 20, 6.0},
+	} {
+		d := flagon.NewDocument(ed, 0)
+		f, _ := d.Field("name")
+		f.(*flagon.FieldString).Set(p.name)
+		f, _ = d.Field("age")
+		f.(*flagon.FieldInt64).Set(p.age)
+		if p.score != nil {
+			f, _ = d.Field("score")
+			f.(*flagon.FieldFloat64).Set(p.score.(float64))
+		}
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		if p.name == "gone" {
+			if err := et.(flagon.SoftDeleter).DeleteSoft(d.ID()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// query answers the rows of the given query, as slices of values.
+func query(t *testing.T, src string, args ...interface{}) [][]interface{} {
+	t.Helper()
+	rows, err := sqlDB.Query(src, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res [][]interface{}
+	for rows.Next() {
+		vs := make([]interface{}, len(cols))
+		ps := make([]interface{}, len(cols))
+		for i := range vs {
+			ps[i] = &vs[i]
+		}
+		if err := rows.Scan(ps...); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, vs)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// names answers the first values of the given rows, as strings.
+func names(rows [][]interface{}) []string {
+	res := []string{}
+	for _, r := range rows {
+		res = append(res, r[0].(string))
+	}
+	return res
+}
+
+func TestQuery(t *testing.T) {
+	people(t)
+
+	rows := query(t, "SELECT * FROM sql_ns.person WHERE id = 2")
+	want := [][]interface{}{{int64(2), "bob", int64(20), nil}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("select *: %v", rows)
+	}
+
+	for _, c := range []struct {
+		src  string
+		args []interface{}
+		want []string
+	}{
+		{"SELECT name FROM sql_ns.person", nil, []string{"ann", "bob", "cat", "dan"}},
+		{"SELECT name FROM sql_ns.person ORDER BY id DESC", nil, []string{"dan", "cat", "bob", "ann"}},
+		{"SELECT name FROM sql_ns.person ORDER BY id DESC LIMIT 2 OFFSET 1", nil, []string{"cat", "bob"}},
+		{"SELECT name FROM sql_ns.person ORDER BY name DESC LIMIT 2", nil, []string{"dan", "cat"}},
+		{"SELECT name FROM sql_ns.person LIMIT 2 OFFSET 1", nil, []string{"bob", "cat"}},
+		{"SELECT name FROM sql_ns.person LIMIT 0", nil, []string{}},
+		{"SELECT name FROM sql_ns.person WHERE age >= ? ORDER BY name", []interface{}{30}, []string{"ann", "cat"}},
+		{"SELECT name FROM sql_ns.person WHERE age = 20 AND name <> 'bob'", nil, []string{"dan"}},
+		{"SELECT name FROM sql_ns.person WHERE score IS NULL", nil, []string{"bob"}},
+		{"SELECT name FROM sql_ns.person WHERE score IS NOT NULL AND score > 7", nil, []string{"ann", "cat"}},
+		{"SELECT name FROM sql_ns.person WHERE score < 7", nil, []string{"dan"}},
+		{"SELECT name FROM sql_ns.person WHERE NOT score < 7", nil, []string{"ann", "cat"}},
+		{"SELECT name FROM sql_ns.person WHERE name IN ('ann', 'dan', 'eve')", nil, []string{"ann", "dan"}},
+		{"SELECT name FROM sql_ns.person WHERE name NOT IN ('ann', 'dan')", nil, []string{"bob", "cat"}},
+		{"SELECT name FROM sql_ns.person WHERE age BETWEEN 25 AND 40", nil, []string{"ann", "cat"}},
+		{"SELECT name FROM sql_ns.person WHERE age NOT BETWEEN 25 AND 40", nil, []string{"bob", "dan"}},
+		{"SELECT name FROM sql_ns.person WHERE age * 2 + 1 = 41 OR name = ?", []interface{}{"cat"}, []string{"bob", "cat", "dan"}},
+		{"SELECT name FROM sql_ns.person WHERE lower(name) = 'ann'", nil, []string{"ann"}},
+	} {
+		if got := names(query(t, c.src, c.args...)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %v", c.src, got)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	people(t)
+
+	for _, src := range []string{
+		"DELETE FROM sql_ns.person",
+		"SELECT FROM sql_ns.person",
+		"SELECT name FROM person",
+		"SELECT name FROM sql_ns.person WHERE",
+		"SELECT name FROM sql_ns.person LIMIT x",
+		"SELECT name FROM sql_ns.person ORDER",
+	} {
+		if _, err := sqlDB.Query(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+	for _, src := range []string{
+		"SELECT name FROM sql_ns.nobody",
+		"SELECT height FROM sql_ns.person",
+		"SELECT name FROM sql_ns.person ORDER BY height",
+	} {
+		if _, err := sqlDB.Query(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+
+	if _, err := sqlDB.Exec("SELECT name FROM sql_ns.person"); !errors.Is(err, flagonsql.ErrReadOnly) {
+		t.Errorf("exec: %v", err)
+	}
+	if _, err := sqlDB.Begin(); !errors.Is(err, flagonsql.ErrReadOnly) {
+		t.Errorf("begin: %v", err)
+	}
+
+	tx, err := sqlDB.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := tx.QueryRow("SELECT id FROM sql_ns.person WHERE name = 'cat'").Scan(&n); err != nil || n != 3 {
+		t.Errorf("read-only transaction: %d, %v", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,621 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagonsql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/js-ojus/flagon/expr"
+)
+
+// tokKind enumerates the kinds of lexical tokens of queries.
+type tokKind uint8
+
+const (
+	tokEOF    tokKind = iota
+	tokIdent          // identifier or keyword
+	tokQuoted         // quoted identifier
+	tokNumber         // numeric literal
+	tokString         // string literal
+	tokParam          // `?`
+	tokOp             // operator or punctuation
+)
+
+// token is a single lexical token of a query.
+type token struct {
+	kind tokKind
+	text string // identifier, literal value or operator
+	pos  int    // byte offset in the query
+}
+
+// is answers `true` if this token is the given keyword, or operator.
+func (t token) is(s string) bool {
+	switch t.kind {
+	case tokIdent:
+		return strings.EqualFold(t.text, s)
+	case tokOp:
+		return t.text == s
+	}
+	return false
+}
+
+// twoCharOps holds the operators that are two characters long.
+var twoCharOps = []string{"<>", "!=", "<=", ">="}
+
+// lex splits the given query into tokens.
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; ; {
+		for i < len(src) && unicode.IsSpace(rune(src[i])) {
+			i++
+		}
+		if i >= len(src) {
+			return append(toks, token{kind: tokEOF, pos: i}), nil
+		}
+
+		start := i
+		c := src[i]
+		switch {
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, syntaxError(start, "unterminated literal")
+				}
+				if src[i] == c {
+					if i+1 < len(src) && src[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+				b.WriteByte(src[i])
+			}
+			i++
+			kind := tokString
+			if c == '"' {
+				kind = tokQuoted
+			}
+			toks = append(toks, token{kind: kind, text: b.String(), pos: start})
+
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], pos: start})
+
+		case isIdentByte(c) && !isDigit(c):
+			for i < len(src) && isIdentByte(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[start:i], pos: start})
+
+		case c == '?':
+			i++
+			toks = append(toks, token{kind: tokParam, text: "?", pos: start})
+
+		default:
+			op := ""
+			for _, o := range twoCharOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+				}
+			}
+			if op == "" && strings.IndexByte("=<>(),.*+-/%;", c) >= 0 {
+				op = string(c)
+			}
+			if op == "" {
+				return nil, syntaxError(start, fmt.Sprintf("unexpected character %q", c))
+			}
+			i += len(op)
+			toks = append(toks, token{kind: tokOp, text: op, pos: start})
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// syntaxError answers an error describing the given problem at the
+// given position of a query.
+func syntaxError(pos int, msg string) error {
+	return fmt.Errorf("%s: %s at %d", ErrSyntax, msg, pos)
+}
+
+// query is a parsed `SELECT` statement.
+type query struct {
+	ns, et  string     // namespace and entity type of the table
+	cols    []string   // selected columns; `nil` for all
+	where   *expr.Expr // condition; `nil` if none
+	params  int        // number of placeholders
+	orderBy string     // column by which rows are ordered; empty for IDs
+	desc    bool       // descending order?
+	limit   int64      // maximum number of rows; `-1` for all
+	offset  int64      // number of rows skipped
+}
+
+// parser is a recursive descent parser for queries.  Conditions are
+// translated into the expression language of package `expr`.
+type parser struct {
+	toks   []token
+	pos    int
+	params int
+}
+
+// parse parses the given query.
+//
+//	SELECT * | column {, column}
+//	FROM namespace.type
+//	[WHERE condition]
+//	[ORDER BY column [ASC | DESC]]
+//	[LIMIT n [OFFSET n]]
+func parse(src string) (*query, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	q := &query{limit: -1}
+
+	if err = p.keyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peek().is("*") {
+		p.next()
+	} else {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			q.cols = append(q.cols, col)
+			if !p.peek().is(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err = p.keyword("FROM"); err != nil {
+		return nil, err
+	}
+	if q.ns, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if !p.peek().is(".") {
+		return nil, syntaxError(p.peek().pos, "table should be qualified by its namespace")
+	}
+	p.next()
+	if q.et, err = p.ident(); err != nil {
+		return nil, err
+	}
+
+	if p.peek().is("WHERE") {
+		p.next()
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if q.where, err = expr.Compile(c.t); err != nil {
+			return nil, fmt.Errorf("%s: %v", ErrSyntax, err)
+		}
+	}
+	if p.peek().is("ORDER") {
+		p.next()
+		if err = p.keyword("BY"); err != nil {
+			return nil, err
+		}
+		if q.orderBy, err = p.ident(); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.peek().is("ASC"):
+			p.next()
+		case p.peek().is("DESC"):
+			p.next()
+			q.desc = true
+		}
+	}
+	if p.peek().is("LIMIT") {
+		p.next()
+		if q.limit, err = p.count(); err != nil {
+			return nil, err
+		}
+		if p.peek().is("OFFSET") {
+			p.next()
+			if q.offset, err = p.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.peek().is(";") {
+		p.next()
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, syntaxError(t.pos, fmt.Sprintf("unexpected %q", t.text))
+	}
+	q.params = p.params
+	return q, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the given keyword.
+func (p *parser) keyword(kw string) error {
+	t := p.next()
+	if !t.is(kw) || t.kind != tokIdent {
+		return syntaxError(t.pos, "expected "+kw)
+	}
+	return nil
+}
+
+// ident consumes an identifier, quoted or not.
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent && t.kind != tokQuoted || t.kind == tokIdent && keywords[strings.ToUpper(t.text)] {
+		return "", syntaxError(t.pos, "expected a name")
+	}
+	return t.text, nil
+}
+
+// count consumes a non-negative integer.
+func (p *parser) count() (int64, error) {
+	t := p.next()
+	n, err := strconv.ParseInt(t.text, 10, 64)
+	if t.kind != tokNumber || err != nil || n < 0 {
+		return 0, syntaxError(t.pos, "expected a count")
+	}
+	return n, nil
+}
+
+// keywords are the reserved words of queries.
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true, "AND": true,
+	"OR": true, "NOT": true, "IS": true, "NULL": true, "IN": true,
+	"BETWEEN": true, "TRUE": true, "FALSE": true,
+}
+
+// cond is a condition translated into the expression language.  SQL
+// conditions may be true, false or unknown - when they involve nulls -
+// and only those that are true select rows.  Since expressions answer
+// either `true` or `false`, a condition is translated into two: one
+// that holds if it is true, and another that holds if it is false.
+type cond struct {
+	t, f string
+}
+
+// operand is an operand of a condition translated into the expression
+// language, along with a guard that holds if it is not null; empty if
+// it is never null.  Since `&&` short-circuits, operands are evaluated
+// only once their guards hold: in SQL, operators applied to nulls
+// answer nulls.
+type operand struct {
+	x, nn string
+}
+
+// and answers the conjunction of the given expressions, ignoring those
+// that are empty; empty if all are.
+func and(xs ...string) string {
+	var res []string
+	for _, x := range xs {
+		if x != "" {
+			res = append(res, x)
+		}
+	}
+	if len(res) < 2 {
+		return strings.Join(res, "")
+	}
+	return "(" + strings.Join(res, " && ") + ")"
+}
+
+// The following methods translate conditions and their operands.
+// Operands are parenthesised fully, since the precedences of the two
+// languages differ.
+
+func (p *parser) or() (cond, error) {
+	lhs, err := p.and()
+	for err == nil && p.peek().is("OR") {
+		p.next()
+		var rhs cond
+		rhs, err = p.and()
+		lhs = cond{"(" + lhs.t + " || " + rhs.t + ")", and(lhs.f, rhs.f)}
+	}
+	return lhs, err
+}
+
+func (p *parser) and() (cond, error) {
+	lhs, err := p.not()
+	for err == nil && p.peek().is("AND") {
+		p.next()
+		var rhs cond
+		rhs, err = p.not()
+		lhs = cond{and(lhs.t, rhs.t), "(" + lhs.f + " || " + rhs.f + ")"}
+	}
+	return lhs, err
+}
+
+func (p *parser) not() (cond, error) {
+	if p.peek().is("NOT") {
+		p.next()
+		c, err := p.not()
+		return cond{c.f, c.t}, err
+	}
+	return p.predicate()
+}
+
+// comparisons maps the comparison operators of SQL to those of the
+// expression language.
+var comparisons = map[string]string{
+	"=": "==", "<>": "!=", "!=": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+}
+
+// isComparison answers `true` if the given token is a comparison
+// operator.
+func isComparison(t token) bool {
+	_, ok := comparisons[t.text]
+	return ok && t.kind == tokOp
+}
+
+// predicate translates a parenthesised condition, a comparison, or a
+// test of nullity, membership or range.  Other operands are taken to
+// be boolean values.
+func (p *parser) predicate() (cond, error) {
+	if c, ok, err := p.group(); ok || err != nil {
+		return c, err
+	}
+
+	lhs, err := p.sum()
+	if err != nil {
+		return cond{}, err
+	}
+
+	t := p.peek()
+	if isComparison(t) {
+		p.next()
+		rhs, err := p.sum()
+		return compare(lhs, comparisons[t.text], rhs), err
+	}
+
+	neg := false
+	switch {
+	case t.is("IS"):
+		p.next()
+		c := cond{"false", "true"}
+		if lhs.nn != "" {
+			c = cond{"!(" + lhs.nn + ")", lhs.nn}
+		}
+		if p.peek().is("NOT") {
+			p.next()
+			c = cond{c.f, c.t}
+		}
+		return c, p.keyword("NULL")
+
+	case t.is("NOT"):
+		p.next()
+		neg = true
+	}
+
+	var c cond
+	switch t := p.peek(); {
+	case t.is("IN"):
+		p.next()
+		if !p.next().is("(") {
+			return cond{}, syntaxError(t.pos, "expected (")
+		}
+		var ts, fs []string
+		for {
+			x, err := p.sum()
+			if err != nil {
+				return cond{}, err
+			}
+			eq := compare(lhs, "==", x)
+			ts, fs = append(ts, eq.t), append(fs, eq.f)
+			if !p.peek().is(",") {
+				break
+			}
+			p.next()
+		}
+		if u := p.next(); !u.is(")") {
+			return cond{}, syntaxError(u.pos, "expected )")
+		}
+		c = cond{"(" + strings.Join(ts, " || ") + ")", and(fs...)}
+
+	case t.is("BETWEEN"):
+		p.next()
+		lo, err := p.sum()
+		if err != nil {
+			return cond{}, err
+		}
+		if err = p.keyword("AND"); err != nil {
+			return cond{}, err
+		}
+		hi, err := p.sum()
+		if err != nil {
+			return cond{}, err
+		}
+		ge, le := compare(lhs, ">=", lo), compare(lhs, "<=", hi)
+		c = cond{and(ge.t, le.t), "(" + ge.f + " || " + le.f + ")"}
+
+	default:
+		if neg {
+			return cond{}, syntaxError(t.pos, "expected IN or BETWEEN")
+		}
+		return cond{and(lhs.nn, lhs.x+" == true"), and(lhs.nn, lhs.x+" == false")}, nil
+	}
+
+	if neg {
+		c = cond{c.f, c.t}
+	}
+	return c, nil
+}
+
+// group translates a parenthesised condition, answering `false` if the
+// parentheses enclose an operand instead, such as in `(a + b) > c`.
+func (p *parser) group() (cond, bool, error) {
+	if !p.peek().is("(") {
+		return cond{}, false, nil
+	}
+
+	start := p.pos
+	p.next()
+	c, err := p.or()
+	if err == nil && p.next().is(")") {
+		t := p.peek()
+		arith := t.kind == tokOp && strings.Contains("+-*/%", t.text)
+		if !isComparison(t) && !arith && !t.is("IS") && !t.is("NOT") && !t.is("IN") && !t.is("BETWEEN") {
+			return c, true, nil
+		}
+	}
+	p.pos = start
+	return cond{}, false, nil
+}
+
+// compare answers the comparison of the given operands, which is
+// unknown if either is null.
+func compare(lhs operand, op string, rhs operand) cond {
+	x := lhs.x + " " + op + " " + rhs.x
+	return cond{and(lhs.nn, rhs.nn, x), and(lhs.nn, rhs.nn, "!("+x+")")}
+}
+
+func (p *parser) sum() (operand, error) {
+	lhs, err := p.product()
+	for err == nil && (p.peek().is("+") || p.peek().is("-")) {
+		op := p.next().text
+		var rhs operand
+		rhs, err = p.product()
+		lhs = operand{"(" + lhs.x + " " + op + " " + rhs.x + ")", and(lhs.nn, rhs.nn)}
+	}
+	return lhs, err
+}
+
+func (p *parser) product() (operand, error) {
+	lhs, err := p.unary()
+	for err == nil && (p.peek().is("*") || p.peek().is("/") || p.peek().is("%")) {
+		op := p.next().text
+		var rhs operand
+		rhs, err = p.unary()
+		lhs = operand{"(" + lhs.x + " " + op + " " + rhs.x + ")", and(lhs.nn, rhs.nn)}
+	}
+	return lhs, err
+}
+
+func (p *parser) unary() (operand, error) {
+	if p.peek().is("-") {
+		p.next()
+		x, err := p.unary()
+		return operand{"-" + x.x, x.nn}, err
+	}
+	return p.primary()
+}
+
+// primary translates a literal, a placeholder, a column, a function
+// call or a parenthesised operand.  Placeholders become the variables
+// `_1`, `_2` and so on.  Functions are called with nulls as given; it
+// is their results that are tested for nullity.
+func (p *parser) primary() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return operand{x: t.text}, nil
+
+	case tokString:
+		return operand{x: strconv.Quote(t.text)}, nil
+
+	case tokParam:
+		p.params++
+		v := "_" + strconv.Itoa(p.params)
+		return operand{v, v + " != null"}, nil
+
+	case tokQuoted:
+		return p.name(t)
+
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "TRUE", "FALSE":
+			return operand{x: strings.ToLower(t.text)}, nil
+		case "NULL":
+			return operand{"null", "false"}, nil
+		}
+		if !p.peek().is("(") {
+			return p.name(t)
+		}
+
+		p.next()
+		var args []string
+		for !p.peek().is(")") {
+			arg, err := p.sum()
+			if err != nil {
+				return operand{}, err
+			}
+			args = append(args, arg.x)
+			if !p.peek().is(",") {
+				break
+			}
+			p.next()
+		}
+		if u := p.next(); !u.is(")") {
+			return operand{}, syntaxError(u.pos, "expected )")
+		}
+		x := strings.ToLower(t.text) + "(" + strings.Join(args, ", ") + ")"
+		return operand{x, x + " != null"}, nil
+
+	case tokOp:
+		if t.is("(") {
+			x, err := p.sum()
+			if err != nil {
+				return operand{}, err
+			}
+			if u := p.next(); !u.is(")") {
+				return operand{}, syntaxError(u.pos, "expected )")
+			}
+			return operand{"(" + x.x + ")", x.nn}, nil
+		}
+	}
+	return operand{}, syntaxError(t.pos, fmt.Sprintf("unexpected %q", t.text))
+}
+
+// name translates a column, which should be a name in the expression
+// language as well.
+func (p *parser) name(t token) (operand, error) {
+	if t.kind == tokIdent && keywords[strings.ToUpper(t.text)] {
+		return operand{}, syntaxError(t.pos, fmt.Sprintf("unexpected %s", t.text))
+	}
+	if t.text == "" || isDigit(t.text[0]) || t.text[0] == '_' || strings.IndexFunc(t.text, func(r rune) bool {
+		return r > unicode.MaxASCII || !isIdentByte(byte(r))
+	}) >= 0 {
+		return operand{}, syntaxError(t.pos, fmt.Sprintf("unsupported column name %q", t.text))
+	}
+	return operand{t.text, t.text + " != null"}, nil
+}
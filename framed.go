@@ -0,0 +1,116 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Entity payload framing used by `CodecFramed`.  All integers are
+// big-endian.
+//
+//	payload : field count uint8 | field...
+//	field   : field ID uint8 | field type uint8 | length uint32 | data
+//
+// Field data is as written by the field's `WriteTo`.  Since every
+// field carries its length, fields can be skipped without knowing
+// their types: fields that are unknown to the entity type definition,
+// or whose types differ from their definitions, are skipped when
+// decoding.  This allows older programs to read entities written by
+// newer ones, and enables decoding only some of the fields.
+const framedHeaderLen = 6
+
+// framedCodec implements `CodecFramed`.
+type framedCodec struct{}
+
+func (framedCodec) size(d *Document) int {
+	n := 1
+	for _, f := range d.fields {
+		if f.IsSet() {
+			n += framedHeaderLen + fieldSize(f)
+		}
+	}
+	return n
+}
+
+func (framedCodec) encode(by []byte, d *Document) ([]byte, error) {
+	fs := d.setFields()
+	by = append(by, uint8(len(fs)))
+
+	for _, f := range fs {
+		fd, ok := d.defn.fieldByID(f.ID())
+		if !ok {
+			return nil, ErrPayloadInvalid
+		}
+
+		by = append(by, f.ID(), uint8(fd.Ftype))
+		by = appendUint(by, uint64(fieldSize(f)), 4)
+		var err error
+		by, err = appendField(by, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+func (c framedCodec) decode(r *fieldReader, d *Document) error {
+	return c.decodeOnly(r, d, nil)
+}
+
+// decodeOnly conforms to `partialDecoder`.
+func (framedCodec) decodeOnly(r *fieldReader, d *Document, ids map[uint8]bool) error {
+	cnt, err := r.ReadByte()
+	if err != nil {
+		return ErrPayloadInvalid
+	}
+
+	hdr := make([]byte, framedHeaderLen)
+	for i := 0; i < int(cnt); i++ {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			return ErrPayloadInvalid
+		}
+		id, ft := hdr[0], FieldType(hdr[1])
+		l := int64(binary.BigEndian.Uint32(hdr[2:]))
+		if l > int64(r.Len()) {
+			return ErrPayloadInvalid
+		}
+
+		fd, ok := d.defn.fieldByID(id)
+		if !ok || fd.Ftype != ft || (ids != nil && !ids[id]) {
+			r.Seek(l, io.SeekCurrent)
+			continue
+		}
+
+		f, err := newField(fd)
+		if err != nil {
+			return err
+		}
+		fr, _ := r.limit(int(l))
+		n, err := f.ReadFrom(fr)
+		if err != nil || n != l {
+			return ErrPayloadInvalid
+		}
+		d.fields[id] = f
+	}
+
+	if r.Len() != 0 {
+		return ErrPayloadInvalid
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"testing"
+)
+
+// wireDefn answers an unsaved entity type having the given name and
+// fields, serialised using the given codec.
+func wireDefn(t *testing.T, name string, fields []testField, codec CodecID) *EntityTypeDefn {
+	t.Helper()
+	ed, err := NewEntityTypeDefn(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if err := ed.AddField(f.name, f.ftype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ed.SetCodec(codec); err != nil {
+		t.Fatal(err)
+	}
+	return ed
+}
+
+// marshal answers the serialised form of the given document.
+func marshal(t *testing.T, d *Document) []byte {
+	t.Helper()
+	by, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return by
+}
+
+func TestFramedForm(t *testing.T) {
+	ed := wireDefn(t, "framed_form", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeString}, {"spare", FieldTypeBool}}, CodecFramed)
+	d := testDoc(t, ed, 1, map[string]interface{}{"count": int16(-2), "label": "hi"})
+	want := []byte{
+		byte(CodecFramed), 2,
+		1, byte(FieldTypeInt16), 0, 0, 0, 2, 0xff, 0xfe,
+		2, byte(FieldTypeString), 0, 0, 0, 4, 0, 2, 'h', 'i',
+	}
+	if by := marshal(t, d); !bytes.Equal(by, want) {
+		t.Errorf("framed form % x, want % x", by, want)
+	}
+}
+
+func TestFramedSkip(t *testing.T) {
+	// A newer definition has a field more, and has changed the type of
+	// another.
+	newer := wireDefn(t, "framed_skip", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeString}, {"extra", FieldTypeUint64}}, CodecFramed)
+	older := wireDefn(t, "framed_skip", []testField{{"count", FieldTypeInt16}, {"label", FieldTypeInt32}}, CodecFramed)
+	by := marshal(t, testDoc(t, newer, 1, map[string]interface{}{"count": int16(7), "label": "new", "extra": uint64(1 << 40)}))
+
+	d := NewDocument(older, 1)
+	if err := d.UnmarshalBinary(by); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := heldValue(t, d, "count"); v != int16(7) {
+		t.Errorf("count: %v", v)
+	}
+	if _, ok := heldValue(t, d, "label"); ok {
+		t.Error("label of another type read")
+	}
+	if len(d.Fields()) != 1 {
+		t.Errorf("%d fields read", len(d.Fields()))
+	}
+
+	// Only the fields asked for are decoded.
+	d = NewDocument(newer, 1)
+	if err := d.unmarshalFields(by, []int{3}, false); err != nil {
+		t.Fatal(err)
+	}
+	fs := d.Fields()
+	if len(fs) != 1 || fieldValue(fs[0]) != uint64(1<<40) {
+		t.Errorf("partial decode: %v", fs)
+	}
+}
+
+func TestFramedInvalid(t *testing.T) {
+	ed := wireDefn(t, "framed_bad", []testField{{"count", FieldTypeInt16}}, CodecFramed)
+	good := marshal(t, testDoc(t, ed, 1, map[string]interface{}{"count": int16(1)}))
+	tests := []struct {
+		name string
+		by   []byte
+	}{
+		{"no count", good[:1]},
+		{"fields missing", []byte{byte(CodecFramed), 2, 1, byte(FieldTypeInt16), 0, 0, 0, 2, 0, 1}},
+		{"header truncated", good[:5]},
+		{"length too long", []byte{byte(CodecFramed), 1, 1, byte(FieldTypeInt16), 0, 0, 0, 3, 0, 1}},
+		{"length too short", []byte{byte(CodecFramed), 1, 1, byte(FieldTypeInt16), 0, 0, 0, 1, 0, 1}},
+		{"trailing bytes", append(append([]byte(nil), good...), 0)},
+	}
+	d := NewDocument(ed, 1)
+	for _, tc := range tests {
+		if err := d.UnmarshalBinary(tc.by); err != ErrPayloadInvalid {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Freezer is implemented by entity types that can be frozen.  All
+// writes to the instances of a frozen entity type in its namespace -
+// puts, deletes, soft deletes and restores, label changes, imports,
+// migrations, compactions and rollbacks - answer `ErrTypeFrozen`,
+// while reads continue.  This is useful during migrations, audits or
+// incident containment.
+//
+// Freezing is recorded in the system catalogue; hence, it applies to
+// all handles, and persists until the entity type is unfrozen.
+type Freezer interface {
+	// Freeze makes this entity type reject writes.
+	Freeze() error
+	// Unfreeze makes this entity type accept writes again.
+	Unfreeze() error
+	// Frozen answers the time at which this entity type was frozen,
+	// and `true`, if it is frozen.
+	Frozen() (time.Time, bool, error)
+}
+
+// Freeze makes this entity type reject writes.  Freezing a frozen
+// entity type has no effect.  Freezing is recorded in the
+// administrative event log.  See `DB.AdminLog`.
+func (et *entityType) Freeze() error {
+	return et.setFrozen(true)
+}
+
+// Unfreeze makes this entity type accept writes again.  Unfreezing an
+// entity type that is not frozen has no effect.  Unfreezing is
+// recorded in the administrative event log.
+func (et *entityType) Unfreeze() error {
+	return et.setFrozen(false)
+}
+
+// setFrozen implements `Freeze` and `Unfreeze`.
+func (et *entityType) setFrozen(frozen bool) error {
+	start := time.Now()
+	now := et.db.now().UnixNano()
+	err := et.db.sdb.Update(func(tx *storage.Tx) error {
+		return tx.SetFrozen(et.ns.Name(), et.Name(), frozen, now)
+	})
+
+	action := AdminFreeze
+	if !frozen {
+		action = AdminUnfreeze
+	}
+	et.db.logAdmin(context.Background(), action, et.ns.Name(), et.Name(), nil, start, err)
+	return err
+}
+
+// Frozen answers the time at which this entity type was frozen, and
+// `true`, if it is frozen.
+func (et *entityType) Frozen() (time.Time, bool, error) {
+	var t int64
+	var ok bool
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		t, ok = tx.Frozen(et.ns.Name(), et.Name())
+		return nil
+	})
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, t), true, nil
+}
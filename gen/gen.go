@@ -0,0 +1,301 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gen generates typed Go code from `flagon` entity type
+// definitions.
+//
+// For each entity type, the generated code comprises a typed view
+// over `flagon.Document` with an accessor pair per field, an
+// enumeration of the entity type's fields, and a query builder that
+// accepts only those fields.  Misspelt field names, hence, become
+// compilation errors rather than run-time errors.
+//
+// N.B. `flagon` does not expose a remote API yet.  The generated code,
+// therefore, targets the embedded API.
+package gen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/js-ojus/flagon"
+)
+
+var (
+	// ErrPackageEmpty is answered when an empty package name is
+	// given.
+	ErrPackageEmpty = errors.New("empty package name given")
+
+	// ErrIdentifierClash is answered when two names map to the same
+	// Go identifier.
+	ErrIdentifierClash = errors.New("names map to the same Go identifier")
+)
+
+// goTypes maps the supported field types to their Go types and field
+// implementations.
+var goTypes = map[flagon.FieldType][2]string{
+	flagon.FieldTypeBool:      {"bool", "FieldBool"},
+	flagon.FieldTypeInt8:      {"int8", "FieldInt8"},
+	flagon.FieldTypeInt16:     {"int16", "FieldInt16"},
+	flagon.FieldTypeInt32:     {"int32", "FieldInt32"},
+	flagon.FieldTypeInt64:     {"int64", "FieldInt64"},
+	flagon.FieldTypeUint8:     {"uint8", "FieldUint8"},
+	flagon.FieldTypeUint16:    {"uint16", "FieldUint16"},
+	flagon.FieldTypeUint32:    {"uint32", "FieldUint32"},
+	flagon.FieldTypeUint64:    {"uint64", "FieldUint64"},
+	flagon.FieldTypeFloat32:   {"float32", "FieldFloat32"},
+	flagon.FieldTypeFloat64:   {"float64", "FieldFloat64"},
+	flagon.FieldTypeTime:      {"time.Time", "FieldTime"},
+	flagon.FieldTypeString:    {"string", "FieldString"},
+	flagon.FieldTypeReference: {"uint64", "FieldReference"},
+}
+
+// field holds the template data of a single field.
+type field struct {
+	Name   string // name of the field in the catalogue
+	Ident  string // Go identifier derived from the name
+	ID     uint8  // field ID
+	Ftype  uint8  // field type
+	GoType string // Go type of the field's value
+	Impl   string // `flagon` field implementation
+	Target string // target entity type of a reference
+}
+
+// entityType holds the template data of a single entity type.
+type entityType struct {
+	Name   string  // name of the entity type in the catalogue
+	Ident  string  // Go identifier derived from the name
+	Fields []field // supported fields of the entity type
+}
+
+// Generate writes Go source code for the given entity type
+// definitions, in a package having the given name.  Fields of types
+// that do not have field implementations yet are skipped.
+func Generate(w io.Writer, pkg string, defns []*flagon.EntityTypeDefn) error {
+	if pkg == "" {
+		return ErrPackageEmpty
+	}
+
+	data := struct {
+		Package string
+		Time    bool
+		Types   []entityType
+	}{Package: pkg}
+
+	idents := make(map[string]bool, len(defns))
+	for _, ed := range defns {
+		et := entityType{Name: ed.Name(), Ident: identifier(ed.Name())}
+		if idents[et.Ident] {
+			return fmt.Errorf("%s: %s", ErrIdentifierClash, ed.Name())
+		}
+		idents[et.Ident] = true
+
+		fds := ed.Fields()
+		sort.Sort(byID(fds))
+		fidents := make(map[string]bool, len(fds))
+		for _, fd := range fds {
+			gt, ok := goTypes[fd.Ftype]
+			if !ok {
+				continue
+			}
+			f := field{Name: fd.Name, Ident: identifier(fd.Name), ID: fd.ID, Ftype: uint8(fd.Ftype), GoType: gt[0], Impl: gt[1], Target: fd.Target}
+			if f.Ident == "Document" {
+				f.Ident = "DocumentField"
+			}
+			if fidents[f.Ident] {
+				return fmt.Errorf("%s: %s.%s", ErrIdentifierClash, ed.Name(), fd.Name)
+			}
+			fidents[f.Ident] = true
+
+			if fd.Ftype == flagon.FieldTypeTime {
+				data.Time = true
+			}
+			et.Fields = append(et.Fields, f)
+		}
+
+		data.Types = append(data.Types, et)
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+// identifier converts the given `flagon` name into an exported Go
+// identifier.
+func identifier(name string) string {
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// byID sorts field definitions in the ascending order of their IDs.
+type byID []flagon.FieldDefn
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var tmpl = template.Must(template.New("gen").Parse(`// Code generated by flagon-gen from the flagon catalogue.  DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .Time}}
+	"time"
+{{end}}
+	"github.com/js-ojus/flagon"
+)
+{{range .Types}}{{$t := .}}
+// {{.Ident}}TypeName is the name of the ` + "`{{.Name}}`" + ` entity type.
+const {{.Ident}}TypeName = "{{.Name}}"
+
+// {{.Ident}}Field enumerates the fields of the ` + "`{{.Name}}`" + ` entity type.
+type {{.Ident}}Field int
+
+const (
+{{- range .Fields}}
+	{{$t.Ident}}Field{{.Ident}} {{$t.Ident}}Field = {{.ID}}
+{{- end}}
+)
+
+// {{.Ident}}FieldDefns holds the definitions of the fields this code was
+// generated from.
+var {{.Ident}}FieldDefns = map[{{.Ident}}Field]flagon.FieldDefn{
+{{- range .Fields}}
+	{{$t.Ident}}Field{{.Ident}}: {Ftype: flagon.FieldType({{.Ftype}}), ID: {{.ID}}, Name: "{{.Name}}"{{if .Target}}, Target: "{{.Target}}"{{end}}},
+{{- end}}
+}
+
+// Name answers the name of this field in the catalogue.
+func (f {{.Ident}}Field) Name() string {
+	return {{.Ident}}FieldDefns[f].Name
+}
+
+// {{.Ident}} is a typed view over a ` + "`{{.Name}}`" + ` document.
+type {{.Ident}} struct {
+	doc *flagon.Document
+}
+
+// As{{.Ident}} answers a typed view over the given document, after
+// verifying that its entity type definition is compatible with the
+// one this code was generated from.
+func As{{.Ident}}(d *flagon.Document) ({{.Ident}}, error) {
+	if d.TypeName() != {{.Ident}}TypeName {
+		return {{.Ident}}{}, flagon.ErrNameUnknown
+	}
+	for _, gfd := range {{.Ident}}FieldDefns {
+		fd, err := d.Defn().Field(gfd.Name)
+		if err != nil {
+			return {{.Ident}}{}, err
+		}
+		if fd.ID != gfd.ID || fd.Ftype != gfd.Ftype {
+			return {{.Ident}}{}, flagon.ErrFieldTypeUnknown
+		}
+	}
+
+	return {{.Ident}}{doc: d}, nil
+}
+
+// Document answers the underlying document.
+func (e {{.Ident}}) Document() *flagon.Document {
+	return e.doc
+}
+{{range .Fields}}
+// {{.Ident}} answers the value of the ` + "`{{.Name}}`" + ` field.
+func (e {{$t.Ident}}) {{.Ident}}() {{.GoType}} {
+	f, _ := e.doc.Field("{{.Name}}")
+	return f.(*flagon.{{.Impl}}).Get()
+}
+
+// Set{{.Ident}} sets the value of the ` + "`{{.Name}}`" + ` field.
+func (e {{$t.Ident}}) Set{{.Ident}}(v {{.GoType}}) {
+	f, _ := e.doc.Field("{{.Name}}")
+	f.(*flagon.{{.Impl}}).Set(v)
+}
+
+// Has{{.Ident}} answers whether the ` + "`{{.Name}}`" + ` field is set.
+func (e {{$t.Ident}}) Has{{.Ident}}() bool {
+	f, _ := e.doc.Field("{{.Name}}")
+	return f.IsSet()
+}
+
+// Clear{{.Ident}} sets the ` + "`{{.Name}}`" + ` field to null.
+func (e {{$t.Ident}}) Clear{{.Ident}}() {
+	f, _ := e.doc.Field("{{.Name}}")
+	f.Clear()
+}
+{{end}}
+// {{.Ident}}Query builds search options that can refer only to the
+// fields of the ` + "`{{.Name}}`" + ` entity type.
+type {{.Ident}}Query struct {
+	opts flagon.SearchOpts
+}
+
+// New{{.Ident}}Query answers a new, empty query builder.
+func New{{.Ident}}Query() *{{.Ident}}Query {
+	return &{{.Ident}}Query{}
+}
+
+// Operator sets the comparison operator of the search.
+func (q *{{.Ident}}Query) Operator(op flagon.CompOp) *{{.Ident}}Query {
+	q.opts.Operator = op
+	return q
+}
+
+// StartAt sets the key at which the search should begin.
+func (q *{{.Ident}}Query) StartAt(id uint64) *{{.Ident}}Query {
+	q.opts.StartAt = id
+	return q
+}
+
+// Limit sets the maximum number of results to answer.
+func (q *{{.Ident}}Query) Limit(n uint64) *{{.Ident}}Query {
+	q.opts.Limit = n
+	return q
+}
+
+// Fields restricts the fields made available to the predicate.
+func (q *{{.Ident}}Query) Fields(fs ...{{.Ident}}Field) *{{.Ident}}Query {
+	for _, f := range fs {
+		q.opts.Fields = append(q.opts.Fields, int(f))
+	}
+	return q
+}
+
+// Opts answers the search options built so far.
+func (q *{{.Ident}}Query) Opts() flagon.SearchOpts {
+	return q.opts
+}
+{{end}}`))
@@ -0,0 +1,328 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// groupBuffer is the default number of events buffered by a consumer
+// group.
+const groupBuffer = 64
+
+// Feed is an ordered source of events, each at a position in it,
+// which consumer groups read.  Positions are positive, and increase
+// along the feed.
+type Feed interface {
+	// Read answers up to the given number of the events following the
+	// given position, in order.  If there are none, it waits until
+	// there are, or the given context is done.
+	Read(ctx context.Context, after uint64, max int) ([]FeedEvent, error)
+}
+
+// FeedEvent is an event read from a `Feed`.
+type FeedEvent struct {
+	Pos   uint64      // position of the event in its feed
+	Value interface{} // event, as the feed defines it
+}
+
+// GroupOpts holds the settings of `JoinGroup`.
+type GroupOpts struct {
+	// After is the position following which a new group starts; an
+	// existing group continues from the position that it has
+	// acknowledged.
+	After uint64
+
+	// Buffer is the number of events read ahead of the consumer; when
+	// as many are awaiting it, reading stops until it catches up.
+	// `64` by default.
+	Buffer int
+}
+
+// ConsumerGroup is a named, durable consumer of a feed.  It delivers
+// the events of the feed over a channel of bounded capacity, and
+// records the position that its consumer has acknowledged, so that a
+// consumer that joins it later - say, after a restart - continues from
+// there.  Events that were delivered but not acknowledged are
+// delivered again: delivery is at least once.
+//
+// A slow consumer neither loses events nor makes memory grow: reading
+// waits for the consumer, and events remain in the feed until read.
+// The change log, read using `ChangeFeed`, is not trimmed past the
+// position that any group reading it has acknowledged; such groups
+// should, hence, be deleted once no longer consumed.
+//
+// A group has one consumer at a time.  A `ConsumerGroup` is safe for
+// concurrent use.
+type ConsumerGroup struct {
+	db      *DB
+	name    string
+	changes bool // does it read the change log?
+	events  chan FeedEvent
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when reading ends
+	err     error         // that ended reading; valid once done
+
+	mu        sync.Mutex
+	paused    bool
+	resumed   chan struct{} // closed by `Resume`
+	delivered uint64        // position of the last event delivered
+	acked     uint64        // position acknowledged
+}
+
+// activeGroups holds the names of the consumer groups being consumed
+// in this process.
+var activeGroups = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// JoinGroup starts consuming the consumer group having the given name,
+// creating it if necessary, reading the given feed.  Events are read
+// until the given context is done, the group is closed, or the feed
+// fails.  It answers `ErrGroupBusy` if the group is being consumed
+// already.
+//
+// A group records only its position; it should be joined with the
+// same feed every time.
+func (db *DB) JoinGroup(ctx context.Context, name string, feed Feed, opts GroupOpts) (*ConsumerGroup, error) {
+	if name == "" || len(name) > 255 || feed == nil || opts.Buffer < 0 {
+		return nil, ErrGroupInvalid
+	}
+	if opts.Buffer == 0 {
+		opts.Buffer = groupBuffer
+	}
+
+	activeGroups.Lock()
+	defer activeGroups.Unlock()
+	if activeGroups.names[name] {
+		return nil, ErrGroupBusy
+	}
+
+	_, changes := feed.(*changeFeed)
+	pos := opts.After
+	err := db.update(context.Background(), func(tx *storage.Tx) error {
+		off, ok, err := tx.GroupOffset(name)
+		if err != nil || ok {
+			pos = off
+			return err
+		}
+		return tx.PutGroupOffset(name, pos, changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	activeGroups.names[name] = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	g := &ConsumerGroup{
+		db:        db,
+		name:      name,
+		changes:   changes,
+		events:    make(chan FeedEvent, opts.Buffer),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		resumed:   make(chan struct{}),
+		delivered: pos,
+		acked:     pos,
+	}
+	go g.read(ctx, feed, pos, opts.Buffer)
+	return g, nil
+}
+
+// read delivers the events of the given feed following the given
+// position, reading up to the given number at a time, until the given
+// context is done, or the feed fails.
+func (g *ConsumerGroup) read(ctx context.Context, feed Feed, pos uint64, max int) {
+	defer func() {
+		close(g.events)
+		activeGroups.Lock()
+		delete(activeGroups.names, g.name)
+		activeGroups.Unlock()
+		close(g.done)
+	}()
+
+	for {
+		evs, err := feed.Read(ctx, pos, max)
+		if err != nil {
+			g.err = err
+			return
+		}
+		for _, ev := range evs {
+			if err = g.deliver(ctx, ev); err != nil {
+				g.err = err
+				return
+			}
+			pos = ev.Pos
+		}
+	}
+}
+
+// deliver sends the given event to the consumer, waiting while
+// delivery is paused, or the buffer is full.
+func (g *ConsumerGroup) deliver(ctx context.Context, ev FeedEvent) error {
+	for {
+		g.mu.Lock()
+		paused, resumed := g.paused, g.resumed
+		g.mu.Unlock()
+		if !paused {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case g.events <- ev:
+	}
+	g.mu.Lock()
+	g.delivered = ev.Pos
+	g.mu.Unlock()
+	return nil
+}
+
+// Name answers the name of this group.
+func (g *ConsumerGroup) Name() string {
+	return g.name
+}
+
+// Events answers the channel over which the events of this group are
+// delivered.  It is closed when reading ends; see `Err`.
+func (g *ConsumerGroup) Events() <-chan FeedEvent {
+	return g.events
+}
+
+// Ack acknowledges the events of this group up to, and including, that
+// at the given position, recording the position in the database.
+// Acknowledgements are cumulative; positions already acknowledged are
+// ignored.  It answers `ErrGroupAck` if no event has been delivered at,
+// or after, the position.
+func (g *ConsumerGroup) Ack(pos uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if pos <= g.acked {
+		return nil
+	}
+	if pos > g.delivered {
+		return ErrGroupAck
+	}
+	err := g.db.update(context.Background(), func(tx *storage.Tx) error {
+		return tx.PutGroupOffset(g.name, pos, g.changes)
+	})
+	if err != nil {
+		return err
+	}
+	g.acked = pos
+	return nil
+}
+
+// Offset answers the position acknowledged by this group.
+func (g *ConsumerGroup) Offset() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.acked
+}
+
+// Pause stops the delivery of events, other than those buffered
+// already, until `Resume` is called.  Events are not lost meanwhile:
+// they remain in the feed.
+func (g *ConsumerGroup) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.paused = true
+}
+
+// Resume resumes the delivery of events paused by `Pause`.
+func (g *ConsumerGroup) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Paused answers `true` if the delivery of events is paused.
+func (g *ConsumerGroup) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paused
+}
+
+// Err answers the error that ended reading, once the channel of
+// events is closed: that of the context, or of the feed; `nil` before.
+func (g *ConsumerGroup) Err() error {
+	select {
+	case <-g.done:
+		return g.err
+	default:
+		return nil
+	}
+}
+
+// Close stops reading the events of this group, and waits for it to
+// end, so that the group can be joined again.  The position
+// acknowledged is retained.  It answers the error that ended reading,
+// if not the cancellation.
+func (g *ConsumerGroup) Close() error {
+	g.cancel()
+	<-g.done
+	if g.err == context.Canceled {
+		return nil
+	}
+	return g.err
+}
+
+// GroupOffset answers the position acknowledged by the consumer group
+// having the given name, and `true` if the group exists.
+func (db *DB) GroupOffset(name string) (uint64, bool, error) {
+	var pos uint64
+	var ok bool
+	err := db.view(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		pos, ok, err = tx.GroupOffset(name)
+		return err
+	})
+	return pos, ok, err
+}
+
+// DeleteGroup removes the consumer group having the given name, if it
+// exists, so that the change log can be trimmed past its position, if
+// it reads the change log.  It answers `ErrGroupBusy` if the group is being consumed.
+func (db *DB) DeleteGroup(name string) error {
+	activeGroups.Lock()
+	defer activeGroups.Unlock()
+
+	if activeGroups.names[name] {
+		return ErrGroupBusy
+	}
+	return db.update(context.Background(), func(tx *storage.Tx) error {
+		return tx.DeleteGroup(name)
+	})
+}
@@ -0,0 +1,412 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// memFeed is a `Feed` of the positions appended to it, which records
+// the reads made of it.
+type memFeed struct {
+	mu      sync.Mutex
+	last    uint64        // position of the last event
+	changed chan struct{} // closed when an event is appended
+	reads   []uint64      // positions after which it was read
+}
+
+func newMemFeed() *memFeed {
+	return &memFeed{changed: make(chan struct{})}
+}
+
+// append appends the given number of events.
+func (f *memFeed) append(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.last += uint64(n)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Read conforms to `Feed`.
+func (f *memFeed) Read(ctx context.Context, after uint64, max int) ([]FeedEvent, error) {
+	for {
+		f.mu.Lock()
+		f.reads = append(f.reads, after)
+		last, changed := f.last, f.changed
+		f.mu.Unlock()
+
+		if last > after {
+			var evs []FeedEvent
+			for pos := after + 1; pos <= last && len(evs) < max; pos++ {
+				evs = append(evs, FeedEvent{Pos: pos, Value: pos * 10})
+			}
+			return evs, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// furthest answers the furthest position after which the feed has been
+// read.
+func (f *memFeed) furthest() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var max uint64
+	for _, pos := range f.reads {
+		if pos > max {
+			max = pos
+		}
+	}
+	return max
+}
+
+// receive answers the position of the next event of the given group,
+// failing the test unless one is delivered soon.
+func receive(t *testing.T, g *ConsumerGroup) uint64 {
+	t.Helper()
+	select {
+	case ev, ok := <-g.Events():
+		if !ok {
+			t.Fatalf("events closed: %v", g.Err())
+		}
+		if ev.Value != ev.Pos*10 {
+			t.Fatalf("event %d: value %v", ev.Pos, ev.Value)
+		}
+		return ev.Pos
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	return 0
+}
+
+// waitFor waits until the given condition holds, failing the test
+// unless it does soon.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestConsumerGroup(t *testing.T) {
+	feed := newMemFeed()
+	feed.append(3)
+	g, err := testDB.JoinGroup(context.Background(), "grp_basic", feed, GroupOpts{After: 1, Buffer: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB.JoinGroup(context.Background(), "grp_basic", feed, GroupOpts{}); err != ErrGroupBusy {
+		t.Errorf("join when consumed: %v", err)
+	}
+	if err := testDB.DeleteGroup("grp_basic"); err != ErrGroupBusy {
+		t.Errorf("delete when consumed: %v", err)
+	}
+
+	// A new group starts after the given position.
+	for _, want := range []uint64{2, 3} {
+		if pos := receive(t, g); pos != want {
+			t.Fatalf("received %d, want %d", pos, want)
+		}
+	}
+	if err := g.Ack(4); err != ErrGroupAck {
+		t.Errorf("ack past delivered: %v", err)
+	}
+	if err := g.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Ack(1); err != nil || g.Offset() != 2 {
+		t.Errorf("ack before acknowledged: %v, offset %d", err, g.Offset())
+	}
+
+	// A slow consumer stops reading once the buffer is full.
+	feed.append(10)
+	waitFor(t, "full buffer", func() bool { return len(g.Events()) == 2 })
+	time.Sleep(20 * time.Millisecond)
+	if f := feed.furthest(); f > 6 {
+		t.Errorf("read ahead after %d", f)
+	}
+
+	// Paused groups deliver only the events buffered already.
+	g.Pause()
+	if !g.Paused() {
+		t.Error("not paused")
+	}
+	for _, want := range []uint64{4, 5} {
+		if pos := receive(t, g); pos != want {
+			t.Fatalf("received %d, want %d", pos, want)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(g.Events()); n > 1 {
+		t.Errorf("%d events delivered while paused", n)
+	}
+	g.Resume()
+	for _, want := range []uint64{6, 7} {
+		if pos := receive(t, g); pos != want {
+			t.Fatalf("received %d, want %d", pos, want)
+		}
+	}
+	if err := g.Ack(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for ev := range g.Events() {
+		if ev.Pos <= 7 {
+			t.Errorf("buffered event %d after closing", ev.Pos)
+		}
+	}
+
+	// A group continues after the position that it acknowledged, even
+	// if joined with another.
+	g, err = testDB.JoinGroup(context.Background(), "grp_basic", feed, GroupOpts{After: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := receive(t, g); pos != 8 {
+		t.Errorf("rejoined at %d", pos)
+	}
+	g.Close()
+	if pos, ok, err := testDB.GroupOffset("grp_basic"); pos != 7 || !ok || err != nil {
+		t.Errorf("offset: %d, %v, %v", pos, ok, err)
+	}
+
+	if err := testDB.DeleteGroup("grp_basic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := testDB.GroupOffset("grp_basic"); ok {
+		t.Error("group remains after deletion")
+	}
+}
+
+func TestConsumerGroupEnds(t *testing.T) {
+	feed := newMemFeed()
+	ctx, cancel := context.WithCancel(context.Background())
+	g, err := testDB.JoinGroup(ctx, "grp_ends", feed, GroupOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Err() != nil {
+		t.Errorf("error while reading: %v", g.Err())
+	}
+	cancel()
+	if _, ok := <-g.Events(); ok {
+		t.Fatal("event delivered from an empty feed")
+	}
+	if g.Err() != context.Canceled {
+		t.Errorf("error after cancellation: %v", g.Err())
+	}
+
+	// The group can be joined again once reading ends.
+	waitFor(t, "group to be released", func() bool {
+		g, err = testDB.JoinGroup(context.Background(), "grp_ends", feed, GroupOpts{})
+		return err == nil
+	})
+	g.Close()
+}
+
+func TestConsumerGroupInvalid(t *testing.T) {
+	feed := newMemFeed()
+	tests := []struct {
+		name string
+		feed Feed
+		opts GroupOpts
+	}{
+		{"", feed, GroupOpts{}},
+		{string(make([]byte, 256)), feed, GroupOpts{}},
+		{"grp_nofeed", nil, GroupOpts{}},
+		{"grp_buffer", feed, GroupOpts{Buffer: -1}},
+	}
+	for _, tc := range tests {
+		if _, err := testDB.JoinGroup(context.Background(), tc.name, tc.feed, tc.opts); err != ErrGroupInvalid {
+			t.Errorf("%q: %v", tc.name, err)
+		}
+	}
+}
+
+// changeLogDB answers a handle to the test database that records the
+// change log, until the given test ends.
+func changeLogDB(t *testing.T) *DB {
+	testDB.sdb.SetChangeLog(true)
+	t.Cleanup(func() { testDB.sdb.SetChangeLog(false) })
+	return &DB{sdb: testDB.sdb, opts: Options{ChangeLog: true}}
+}
+
+// receiveChange answers the next change delivered to the given group,
+// failing the test unless one is delivered soon.
+func receiveChange(t *testing.T, g *ConsumerGroup) (uint64, WatchEvent) {
+	t.Helper()
+	select {
+	case ev, ok := <-g.Events():
+		if !ok {
+			t.Fatalf("events closed: %v", g.Err())
+		}
+		wev := ev.Value.(WatchEvent)
+		if wev.Seq != ev.Pos {
+			t.Fatalf("event %d: position %d", ev.Pos, wev.Seq)
+		}
+		return ev.Pos, wev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change delivered")
+	}
+	return 0, WatchEvent{}
+}
+
+func TestChangeFeed(t *testing.T) {
+	if _, err := testDB.ChangeFeed(WatchOpts{}); err != ErrChangeLogDisabled {
+		t.Fatalf("without change log: %v", err)
+	}
+	db := changeLogDB(t)
+	if _, err := db.ChangeFeed(WatchOpts{Where: "label =="}); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+
+	ns := testNamespace(t, "grp_ns")
+	ed := testDefn(t, "grp_watched", []testField{{"label", FieldTypeString}}, nil)
+	other := testDefn(t, "grp_other", []testField{{"label", FieldTypeString}}, nil)
+	put := func(ed *EntityTypeDefn) uint64 {
+		d := testDoc(t, ed, 0, nil)
+		if err := db.EntityType(ns, ed).Put(d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID()
+	}
+
+	var start uint64
+	db.sdb.View(func(tx *storage.Tx) error {
+		start = tx.ChangeLogPosition()
+		return nil
+	})
+	feed, err := db.ChangeFeed(WatchOpts{Types: []string{"grp_watched"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := db.JoinGroup(context.Background(), "grp_changes", feed, GroupOpts{After: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes of other entity types are not delivered.
+	id1 := put(ed)
+	for i := 0; i < 3; i++ {
+		put(other)
+	}
+	id2 := put(ed)
+	pos1, ev1 := receiveChange(t, g)
+	pos2, ev2 := receiveChange(t, g)
+	if ev1.ID != id1 || ev1.Op != ChangePut || ev1.Doc == nil || ev2.ID != id2 || pos2 != pos1+4 {
+		t.Fatalf("events: %d at %d, %d at %d", ev1.ID, pos1, ev2.ID, pos2)
+	}
+	if err := g.Ack(pos1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change log is not trimmed past the offset of the group; that
+	// of a group reading another feed does not hold it.
+	err = db.sdb.Update(func(tx *storage.Tx) error {
+		return tx.PutGroupOffset("grp_elsewhere", 0, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TrimChanges(math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := db.sdb.ReadChanges(pos1, 10); len(cs) != 4 || err != nil {
+		t.Fatalf("after the offset: %d, %v", len(cs), err)
+	}
+	if _, err := db.sdb.ReadChanges(start, 10); err != ErrChangesTrimmed {
+		t.Fatalf("before the offset: %v", err)
+	}
+
+	// Once deleted, the group no longer holds the change log.
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"grp_changes", "grp_elsewhere"} {
+		if err := db.DeleteGroup(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.TrimChanges(math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := db.sdb.ReadChanges(pos2, 10); len(cs) != 0 || err != nil {
+		t.Fatalf("after deletion: %d, %v", len(cs), err)
+	}
+	if _, err := db.sdb.ReadChanges(pos1, 10); err != ErrChangesTrimmed {
+		t.Fatalf("after deletion: %v", err)
+	}
+}
+
+func TestChangeFeedSkips(t *testing.T) {
+	db := changeLogDB(t)
+	ns := testNamespace(t, "grp_skip_ns")
+	ed := testDefn(t, "grp_skipped", []testField{{"label", FieldTypeString}}, nil)
+	et := db.EntityType(ns, ed)
+
+	var start uint64
+	db.sdb.View(func(tx *storage.Tx) error {
+		start = tx.ChangeLogPosition()
+		return nil
+	})
+	for i := 0; i < watchBatch+3; i++ {
+		if err := et.Put(testDoc(t, ed, 0, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A read whose changes are all filtered out waits for more,
+	// without answering; the next resumes past those read.
+	feed, err := db.ChangeFeed(WatchOpts{Namespace: "grp_skip_other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := feed.(*changeFeed)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if evs, err := f.Read(ctx, start, 10); len(evs) != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("filtered out: %d, %v", len(evs), err)
+	}
+	if f.last != start || f.read != start+watchBatch+3 {
+		t.Fatalf("read up to %d, after %d", f.read, f.last)
+	}
+
+	// At most the given number of events are answered.
+	feed, _ = db.ChangeFeed(WatchOpts{Namespace: "grp_skip_ns"})
+	f = feed.(*changeFeed)
+	evs, err := f.Read(context.Background(), start, 5)
+	if len(evs) != 5 || err != nil || evs[4].Pos != start+5 || f.read != start+5 {
+		t.Fatalf("limited: %d, %v", len(evs), err)
+	}
+}
@@ -0,0 +1,254 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// HistoryEntityType is implemented by entity types that can answer the
+// past versions of their instances.  Versions are retained only for
+// entity types that keep history (see `EntityTypeDefn.SetKeepHistory`),
+// from when that is enabled.  Applications can audit past versions,
+// or roll an individual entity back by storing one of them again.
+//
+// N.B. Retained versions are stored as they were written; hence, they
+// are encrypted using the keys current at the time, and are not
+// re-encrypted by `Rekey`.  Retired keys should be kept available for
+// as long as the versions encrypted using them are needed.
+type HistoryEntityType interface {
+	// History answers the retained versions of the entity having the
+	// given ID, in the order in which they were written.
+	History(uint64) ([]HistoryEntry, error)
+	// GetAt answers the version of the entity having the given ID,
+	// that was current at the given time.
+	GetAt(uint64, time.Time) (Entity, error)
+	// AsOfQuery answers a read-only view of the instances of this
+	// entity type as they were at the given time.
+	AsOfQuery(time.Time) *AsOfView
+}
+
+// HistoryEntry is a retained version of an entity.
+type HistoryEntry struct {
+	Version uint64    // version of the entity
+	Time    time.Time // time at which it was written
+	Deleted bool      // `true` if the entity was deleted
+	Doc     *Document // the version; `nil` if deleted
+}
+
+// History answers the retained versions of the document having the
+// given ID, in the order in which they were written.  Deletions are
+// included.  An entity having no retained versions has no history.
+func (et *entityType) History(id uint64) ([]HistoryEntry, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+
+	var res []HistoryEntry
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		return tx.History(et.ns.Name(), et.Name(), id, func(h storage.HistoryRecord) (bool, error) {
+			e, err := et.historyEntry(id, h)
+			if err != nil {
+				return false, err
+			}
+			res = append(res, e)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetAt answers the version of the document having the given ID, that
+// was current at the given time.  It answers `ErrIdentifierUnknown` if
+// the document did not exist then, was deleted, or has no version
+// retained from then.
+func (et *entityType) GetAt(id uint64, at time.Time) (Entity, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+
+	t := at.UnixNano()
+	var last *storage.HistoryRecord
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		return tx.History(et.ns.Name(), et.Name(), id, func(h storage.HistoryRecord) (bool, error) {
+			if h.Time > t {
+				return false, nil
+			}
+			h.Record = append([]byte(nil), h.Record...)
+			last = &h
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if last == nil || last.Record == nil {
+		return nil, ErrIdentifierUnknown
+	}
+
+	e, err := et.historyEntry(id, *last)
+	if err != nil {
+		return nil, err
+	}
+	return e.Doc, nil
+}
+
+// historyEntry answers the entry of the given retained version of the
+// document having the given ID.  Documents are upgraded to the current
+// schema version.
+func (et *entityType) historyEntry(id uint64, h storage.HistoryRecord) (HistoryEntry, error) {
+	e := HistoryEntry{Version: h.Rev, Time: time.Unix(0, h.Time), Deleted: h.Record == nil}
+	if e.Deleted {
+		return e, nil
+	}
+
+	d := NewDocument(et.defn, id)
+	err := et.decode(h.Record, d)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	d.version = h.Rev
+	err = et.defn.upgrade(d)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	e.Doc = d
+	return e, nil
+}
+
+// AsOfView is a read-only view of the instances of an entity type as
+// they were at a past time, reconstructed from their retained
+// versions.  It conforms to `EntityType`; however, `Put` and `Delete`
+// answer `ErrReadOnly`.  Any search can be run against it, to learn
+// what the data looked like then.
+//
+// Only the instances having a version retained from then are visible;
+// entities written before their entity type began to keep history are
+// not.  Soft deletion and expiry are not retained; hence, entities
+// that were soft-deleted or expired then are visible.
+type AsOfView struct {
+	et *entityType
+	at int64
+}
+
+// AsOfQuery answers a read-only view of the documents of this entity
+// type as they were at the given time.  See `AsOfView`.
+func (et *entityType) AsOfQuery(at time.Time) *AsOfView {
+	return &AsOfView{et: et, at: at.UnixNano()}
+}
+
+// Name answers the name of the underlying entity type.
+func (v *AsOfView) Name() string {
+	return v.et.Name()
+}
+
+// Time answers the time at which this view shows the documents.
+func (v *AsOfView) Time() time.Time {
+	return time.Unix(0, v.at)
+}
+
+// Get answers the version of the document having the given ID, that
+// was current at the time of this view.  See `GetAt`.
+func (v *AsOfView) Get(id uint64) (Entity, error) {
+	return v.et.GetAt(id, time.Unix(0, v.at))
+}
+
+// Put answers `ErrReadOnly`.
+func (v *AsOfView) Put(Entity) error {
+	return ErrReadOnly
+}
+
+// Delete answers `ErrReadOnly`.
+func (v *AsOfView) Delete(uint64) error {
+	return ErrReadOnly
+}
+
+// Search is like that of the underlying entity type, but the predicate
+// receives the versions of the documents that were current at the
+// time of this view.  `opts.IncludeDeleted` has no effect.
+func (v *AsOfView) Search(opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	et := v.et
+	res := make([]uint64, 0, 8)
+	var scanned uint64
+
+	// emit passes the given version of the given document, if it
+	// exists, to the predicate, answering whether to continue.
+	emit := func(id uint64, h *storage.HistoryRecord) (bool, error) {
+		if h == nil || h.Record == nil {
+			return true, nil
+		}
+		if opts.MaxScanned > 0 && scanned == opts.MaxScanned {
+			return false, ErrScanLimit
+		}
+		scanned++
+		if opts.Stats != nil {
+			opts.Stats.Scanned++
+			opts.Stats.BytesDecoded += uint64(len(h.Record))
+		}
+
+		d := NewDocument(et.defn, id)
+		err := et.decodeFields(h.Record, d, opts.Fields)
+		if err != nil {
+			return false, err
+		}
+		d.version = h.Rev
+		err = et.defn.upgrade(d)
+		if err != nil {
+			return false, err
+		}
+
+		if fn(id, d) {
+			res = append(res, id)
+		}
+		return opts.Limit == 0 || uint64(len(res)) < opts.Limit, nil
+	}
+
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		var cur uint64
+		var last *storage.HistoryRecord
+		done := false
+		err := tx.HistoryFrom(et.ns.Name(), et.Name(), opts.StartAt, func(id uint64, h storage.HistoryRecord) (bool, error) {
+			if id != cur {
+				ok, err := emit(cur, last)
+				if err != nil || !ok {
+					done = true
+					return false, err
+				}
+				cur, last = id, nil
+			}
+			if h.Time <= v.at {
+				last = &h
+			}
+			return true, nil
+		})
+		if err != nil || done {
+			return err
+		}
+		_, err = emit(cur, last)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,137 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sync"
+)
+
+// HookPoint identifies when a hook is called.
+type HookPoint uint8
+
+// Points at which hooks are called.
+const (
+	BeforePut HookPoint = iota + 1
+	AfterPut
+	BeforeDelete
+	AfterDelete
+)
+
+// HookEvent describes the operation for which a hook is called.
+type HookEvent struct {
+	// Context is that of the operation; `context.Background()` for
+	// operations made without one.  It carries metadata such as the
+	// actor (see `ActorFrom`) and tracing information to hooks.
+	Context context.Context
+
+	Point     HookPoint
+	Namespace string // name of the namespace of the entity
+	Type      string // name of the entity type of the entity
+
+	// ID is the ID of the entity; `0` before a new entity is stored.
+	ID uint64
+
+	// Doc is the document being stored; `nil` for deletions.  Hooks
+	// called before it is stored may modify it.
+	Doc *Document
+}
+
+// HookFn is a hook.  An error answered by a hook called before an
+// operation aborts it, and is answered by it.  Errors answered by
+// hooks called after operations are ignored, since the operations
+// have been committed.
+type HookFn func(HookEvent) error
+
+// hook is a registered hook.
+type hook struct {
+	id uint64
+	fn HookFn
+}
+
+// hookRegistry holds the hooks registered using any handle; see `DB`.
+type hookRegistry struct {
+	mutex sync.RWMutex
+	next  uint64 // ID of the next hook
+	hooks map[hookKey][]hook
+}
+
+// hookKey identifies the hooks of an entity type at a point.
+type hookKey struct {
+	et string
+	p  HookPoint
+}
+
+var hooks = &hookRegistry{hooks: make(map[hookKey][]hook)}
+
+// RegisterHook registers the given function to be called at the given
+// point of every `Put` and `Delete` - and their variants - of the
+// instances of the given entity type, in any namespace, made by any
+// handle to the database.  Hooks are called in the order of their
+// registration, in the goroutine making the operation; those called
+// after operations are called once they are committed.  It answers a
+// function that removes the hook.
+//
+// Hooks enable applications to plug in validation, denormalisation,
+// cache invalidation and metrics, without wrapping every call site.
+// Internal modifications, such as rollbacks, purges, expiry and
+// migrations, do not call hooks.
+func (db *DB) RegisterHook(ed *EntityTypeDefn, p HookPoint, fn HookFn) (func(), error) {
+	if p < BeforePut || p > AfterDelete {
+		return nil, ErrHookPoint
+	}
+	key := hookKey{et: ed.Name(), p: p}
+
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+
+	hooks.next++
+	id := hooks.next
+	hooks.hooks[key] = append(hooks.hooks[key], hook{id: id, fn: fn})
+
+	return func() {
+		hooks.mutex.Lock()
+		defer hooks.mutex.Unlock()
+
+		hs := hooks.hooks[key]
+		for i, h := range hs {
+			if h.id == id {
+				hooks.hooks[key] = append(hs[:i:i], hs[i+1:]...)
+				break
+			}
+		}
+		if len(hooks.hooks[key]) == 0 {
+			delete(hooks.hooks, key)
+		}
+	}, nil
+}
+
+// runHooks calls the hooks of this entity type at the given point,
+// for an operation having the given context, until one of them answers
+// an error.
+func (et *entityType) runHooks(ctx context.Context, p HookPoint, id uint64, d *Document) error {
+	hooks.mutex.RLock()
+	hs := hooks.hooks[hookKey{et: et.Name(), p: p}]
+	hooks.mutex.RUnlock()
+
+	e := HookEvent{Context: ctx, Point: p, Namespace: et.ns.Name(), Type: et.Name(), ID: id, Doc: d}
+	for _, h := range hs {
+		err := h.fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
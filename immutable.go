@@ -0,0 +1,87 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// ImmutableFieldError is answered when storing a document would change
+// or clear an immutable field that is set in its stored version.
+type ImmutableFieldError struct {
+	Field string // name of the field
+}
+
+// Error conforms to `error`.
+func (e *ImmutableFieldError) Error() string {
+	return fmt.Sprintf("field `%s` is immutable", e.Field)
+}
+
+// Is answers `true` for `ErrValidation`.
+func (e *ImmutableFieldError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// checkImmutable verifies, within the given transaction, that the
+// given document does not change the immutable fields set in the
+// stored version having the given ID, if any.
+func (et *entityType) checkImmutable(tx *storage.Tx, id uint64, d *Document) error {
+	fds := et.defn.immutableFields()
+	if len(fds) == 0 {
+		return nil
+	}
+
+	old, err := et.get(tx, id)
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil
+		}
+		return err
+	}
+	for _, fd := range fds {
+		of, ok := old.fields[fd.ID]
+		if !ok || !of.IsSet() {
+			continue
+		}
+		nf, ok := d.fields[fd.ID]
+		if !ok || !sameValue(fieldValue(of), fieldValue(nf)) {
+			return &ImmutableFieldError{Field: fd.Name}
+		}
+	}
+
+	return nil
+}
+
+// sameValue answers `true` if the given field values are equal.  Times
+// are equal if they denote the same instant, and floating point
+// numbers if they have the same representation.
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		bt, ok := b.(time.Time)
+		return ok && a.Equal(bt)
+	case float32:
+		bf, ok := b.(float32)
+		return ok && math.Float32bits(a) == math.Float32bits(bf)
+	case float64:
+		bf, ok := b.(float64)
+		return ok && math.Float64bits(a) == math.Float64bits(bf)
+	}
+	return a == b
+}
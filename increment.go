@@ -0,0 +1,76 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"math"
+)
+
+// Incrementer is implemented by entity types that can adjust integer
+// fields of their entities atomically.
+type Incrementer interface {
+	// Increment adds the given delta to the field having the given
+	// name, of the entity having the given ID, and answers its new
+	// value.
+	Increment(uint64, string, int64) (int64, error)
+}
+
+// Increment adds the given delta, which may be negative, to the
+// integer field having the given name, of the document having the
+// given ID, and stores it, as `Update` does.  It answers the new value
+// of the field.  A null field is treated as zero.  Concurrent
+// increments are serialised, and so none is lost.
+//
+// Fields of other types answer `ErrFieldValueType`.  If the new value
+// is not representable in the field's type - or the current value, in
+// `int64` - `ErrFieldValueRange` is answered, and nothing is stored.
+func (et *entityType) Increment(id uint64, name string, delta int64) (int64, error) {
+	return et.increment(context.Background(), id, name, delta)
+}
+
+// increment implements `Increment` and `IncrementContext`.
+func (et *entityType) increment(ctx context.Context, id uint64, name string, delta int64) (int64, error) {
+	var n int64
+	err := et.update(ctx, id, func(e Entity) error {
+		f, err := e.(*Document).Field(name)
+		if err != nil {
+			return err
+		}
+		switch f.(type) {
+		case *FieldInt8, *FieldInt16, *FieldInt32, *FieldInt64,
+			*FieldUint8, *FieldUint16, *FieldUint32, *FieldUint64:
+		default:
+			return ErrFieldValueType
+		}
+
+		var cur int64
+		if v := fieldValue(f); v != nil {
+			cur, err = toInt64(v, math.MinInt64, math.MaxInt64)
+			if err != nil {
+				return err
+			}
+		}
+		if delta > 0 && cur > math.MaxInt64-delta || delta < 0 && cur < math.MinInt64-delta {
+			return ErrFieldValueRange
+		}
+		n = cur + delta
+		return setFieldValue(f, n)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
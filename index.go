@@ -0,0 +1,456 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Index is a secondary index of an entity type, over one or more of
+// its fields.  Its entries are ordered by the values of its fields -
+// by the first field, then by the second, and so on - and then by the
+// IDs of the entities; null values precede all others.  Hence,
+// entities whose leading fields have given values, and whose next
+// field lies in a range, are found without scanning the entity type.
+// See `Indexer`.
+type Index struct {
+	Name   string   `json:"name"`   // unique name of the index
+	Fields []string `json:"fields"` // names of the indexed fields, in order
+}
+
+// maxIndexValue is the maximum length of the encoded values of the
+// fields of an index entry.
+const maxIndexValue = 4096
+
+// Tags preceding encoded values in index entries.
+const (
+	indexTagNull  = 0x00
+	indexTagValue = 0x01
+)
+
+// checkIndex verifies that the given index names distinct fields
+// among the given ones, of types that can be indexed.
+func checkIndex(ix Index, fields map[string]FieldDefn) error {
+	if err := validName(ix.Name); err != nil {
+		return err
+	}
+	if len(ix.Fields) == 0 {
+		return ErrNameEmpty
+	}
+	seen := make(map[string]bool, len(ix.Fields))
+	for _, name := range ix.Fields {
+		fd, ok := fields[name]
+		if !ok {
+			return ErrNameUnknown
+		}
+		if seen[name] {
+			return ErrNameExists
+		}
+		if fd.Ftype == FieldTypeLink || fd.Ftype == FieldTypeCollection {
+			return ErrFieldTypeUnsupported
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// AddIndex adds an index having the given name over the given fields,
+// in order, to this entity type.  Fields of all the scalar types can
+// be indexed.  Entities stored thereafter are indexed; those stored
+// already are indexed by `DB.RebuildIndexes`.
+//
+// The encoded values of the fields of an entity should not exceed
+// 4096 bytes; else, storing it answers `ErrIndexValueTooLong`.  This
+// limits the lengths of indexed strings.
+func (ed *EntityTypeDefn) AddIndex(name string, fields ...string) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	for _, el := range ed.idxs {
+		if el.Name == name {
+			return ErrNameExists
+		}
+	}
+	ix := Index{Name: name, Fields: append([]string(nil), fields...)}
+	err := checkIndex(ix, ed.fields)
+	if err != nil {
+		return err
+	}
+
+	ed.idxs = append(ed.idxs, ix)
+	return nil
+}
+
+// RemoveIndex removes the index having the given name.  Its entries
+// are removed by `DB.RebuildIndexes`.
+func (ed *EntityTypeDefn) RemoveIndex(name string) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	for i, el := range ed.idxs {
+		if el.Name == name {
+			ed.idxs = append(ed.idxs[:i:i], ed.idxs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNameUnknown
+}
+
+// Indexes answers the indexes of this entity type, in the order in
+// which they were added.
+func (ed *EntityTypeDefn) Indexes() []Index {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	res := make([]Index, len(ed.idxs))
+	for i, el := range ed.idxs {
+		res[i] = Index{Name: el.Name, Fields: append([]string(nil), el.Fields...)}
+	}
+	return res
+}
+
+// hasIndexes answers `true` if this entity type has indexes.
+func (ed *EntityTypeDefn) hasIndexes() bool {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return len(ed.idxs) > 0
+}
+
+// index answers the index having the given name, and the definitions
+// of its fields.
+func (ed *EntityTypeDefn) index(name string) (Index, []FieldDefn, error) {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	for _, ix := range ed.idxs {
+		if ix.Name != name {
+			continue
+		}
+		fds := make([]FieldDefn, len(ix.Fields))
+		for i, fname := range ix.Fields {
+			fds[i] = ed.fields[fname]
+		}
+		return ix, fds, nil
+	}
+	return Index{}, nil, ErrNameUnknown
+}
+
+// appendIndexValue appends the order-preserving encoding of the value
+// of the given field - `nil` if null - to the given bytes.
+//
+// Signed integers and times have their sign bits inverted, and
+// floating point numbers have all their bits inverted if negative,
+// and their sign bits otherwise, so that they compare as unsigned
+// integers.  Strings have their zero bytes escaped as `0x00 0xff`, and
+// are terminated by `0x00 0x01`, so that shorter strings precede those
+// that they are prefixes of, irrespective of the fields that follow.
+func appendIndexValue(by []byte, f Field) []byte {
+	var v interface{}
+	if f != nil {
+		v = fieldValue(f)
+	}
+	if v == nil {
+		return append(by, indexTagNull)
+	}
+
+	by = append(by, indexTagValue)
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(by, 1)
+		}
+		return append(by, 0)
+	case int8:
+		return appendIndexInt(by, int64(v))
+	case int16:
+		return appendIndexInt(by, int64(v))
+	case int32:
+		return appendIndexInt(by, int64(v))
+	case int64:
+		return appendIndexInt(by, v)
+	case uint8:
+		return appendIndexUint(by, uint64(v))
+	case uint16:
+		return appendIndexUint(by, uint64(v))
+	case uint32:
+		return appendIndexUint(by, uint64(v))
+	case uint64:
+		return appendIndexUint(by, v)
+	case float32:
+		return appendIndexFloat(by, float64(v))
+	case float64:
+		return appendIndexFloat(by, v)
+	case time.Time:
+		return appendIndexInt(by, v.UnixNano())
+	case string:
+		for i := 0; i < len(v); i++ {
+			by = append(by, v[i])
+			if v[i] == 0 {
+				by = append(by, 0xff)
+			}
+		}
+		return append(by, 0, 1)
+	}
+	return by
+}
+
+// appendIndexUint appends the given integer, in big-endian order.
+func appendIndexUint(by []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(by, buf[:]...)
+}
+
+// appendIndexInt appends the given integer, with its sign bit
+// inverted.
+func appendIndexInt(by []byte, n int64) []byte {
+	return appendIndexUint(by, uint64(n)^(1<<63))
+}
+
+// appendIndexFloat appends the given number, so that its encoding
+// compares as an unsigned integer.
+func appendIndexFloat(by []byte, x float64) []byte {
+	n := math.Float64bits(x)
+	if n&(1<<63) != 0 {
+		n = ^n
+	} else {
+		n |= 1 << 63
+	}
+	return appendIndexUint(by, n)
+}
+
+// prefixEnd answers the least byte string greater than all those that
+// begin with the given prefix; `nil` if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// indexValues answers the encoded values of the fields of the given
+// index in the given document.
+func indexValues(d *Document, fds []FieldDefn) ([]byte, error) {
+	var by []byte
+	for _, fd := range fds {
+		by = appendIndexValue(by, d.fields[fd.ID])
+	}
+	if len(by) > maxIndexValue {
+		return nil, ErrIndexValueTooLong
+	}
+	return by, nil
+}
+
+// updateIndexes replaces the index entries of the given old version of
+// the document having the given ID, if any, with those of its given
+// current version, if any, within the given transaction.  The old
+// version should be as stored; see `indexed`.
+func (et *entityType) updateIndexes(tx *storage.Tx, id uint64, old, cur *Document) error {
+	for _, ix := range et.defn.Indexes() {
+		_, fds, err := et.defn.index(ix.Name)
+		if err != nil {
+			return err
+		}
+		var ov, cv []byte
+		if old != nil {
+			ov, _ = indexValues(old, fds)
+		}
+		if cur != nil {
+			cv, err = indexValues(cur, fds)
+			if err != nil {
+				return err
+			}
+		}
+		if old != nil && cur != nil && bytes.Equal(ov, cv) {
+			continue
+		}
+
+		if old != nil {
+			err = tx.RemoveIndexEntry(et.ns.Name(), et.Name(), ix.Name, ov, id)
+			if err != nil {
+				return err
+			}
+		}
+		if cur != nil {
+			err = tx.AddIndexEntry(et.ns.Name(), et.Name(), ix.Name, cv, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexed answers the stored version of the document having the given
+// ID, within the given transaction, without upgrading it, since its
+// index entries were made from it as stored; `nil` if there is none or
+// if this entity type has no indexes.
+func (et *entityType) indexed(tx *storage.Tx, id uint64) (*Document, error) {
+	if !et.defn.hasIndexes() {
+		return nil, nil
+	}
+	by, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil, nil
+		}
+		return nil, err
+	}
+	d := NewDocument(et.defn, id)
+	return d, et.decode(by, d)
+}
+
+// IndexRange selects the entries of an index whose leading fields have
+// the given values, and whose next field lies in the given range.
+type IndexRange struct {
+	// Equal holds the values of the leading fields of the index, in
+	// order; `nil` values match null fields.  Values of any Go type
+	// that can be stored in the fields are accepted.
+	Equal []interface{}
+
+	// Min and Max, if not `nil`, bound the value of the field
+	// following those in `Equal`, inclusively.  Null values precede
+	// all others; hence, they are selected unless `Min` is given.
+	Min, Max interface{}
+
+	// Limit is the maximum number of entities answered; `0` for all.
+	Limit uint64
+}
+
+// Indexer is implemented by entity types that can answer their
+// entities using their indexes.  See `EntityTypeDefn.AddIndex`.
+type Indexer interface {
+	// SearchIndex answers the IDs of the entities selected by the
+	// given range of the index having the given name, in the order
+	// of the index.
+	SearchIndex(string, IndexRange) ([]uint64, error)
+}
+
+// SearchIndex answers the IDs of the entities selected by the given
+// range of the index having the given name, in the order of their
+// values in the index, and then of their IDs.  Soft-deleted and
+// expired entities are not answered.
+//
+// Entities are indexed by their values as stored.  Until entities
+// stored at earlier schema versions are migrated, their index entries
+// reflect their values before migration.  Indexes are not maintained
+// by `DB.Import`, `DB.ApplyChanges` and `DB.LoadSnapshot`; use
+// `DB.RebuildIndexes` after these.
+func (et *entityType) SearchIndex(name string, r IndexRange) ([]uint64, error) {
+	_, fds, err := et.defn.index(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Equal) > len(fds) || len(r.Equal) == len(fds) && (r.Min != nil || r.Max != nil) {
+		return nil, ErrIndexRange
+	}
+
+	var prefix []byte
+	for i, v := range r.Equal {
+		prefix, err = appendIndexBound(prefix, fds[i], v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	from, to := prefix, prefixEnd(prefix)
+	if r.Min != nil {
+		from, err = appendIndexBound(append([]byte(nil), prefix...), fds[len(r.Equal)], r.Min)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Max != nil {
+		max, err := appendIndexBound(append([]byte(nil), prefix...), fds[len(r.Equal)], r.Max)
+		if err != nil {
+			return nil, err
+		}
+		to = prefixEnd(max)
+	}
+
+	var res []uint64
+	now := et.db.now().UnixNano()
+	err = et.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.ScanIndex(et.ns.Name(), et.Name(), name, from, to, func(id uint64) (bool, error) {
+			if _, ok := tx.Trashed(et.ns.Name(), et.Name(), id); ok {
+				return true, nil
+			}
+			if t, ok := tx.Expiry(et.ns.Name(), et.Name(), id); ok && t <= now {
+				return true, nil
+			}
+			res = append(res, id)
+			return r.Limit == 0 || uint64(len(res)) < r.Limit, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// appendIndexBound appends the encoding of the given value of a field
+// having the given definition to the given bytes.
+func appendIndexBound(by []byte, fd FieldDefn, v interface{}) ([]byte, error) {
+	f, err := newField(fd)
+	if err != nil {
+		return nil, err
+	}
+	err = setFieldValue(f, v)
+	if err != nil {
+		return nil, err
+	}
+	return appendIndexValue(by, f), nil
+}
+
+// RebuildIndexes removes all the index entries of the given entity
+// type in the given namespace - including those of removed indexes -
+// and indexes its entities afresh, in a single transaction.  It
+// answers the number of entities indexed.
+//
+// Rebuilding is recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) RebuildIndexes(ns *Namespace, ed *EntityTypeDefn) (uint64, error) {
+	start := time.Now()
+	et := &entityType{db: db, ns: ns, defn: ed}
+	var n uint64
+	err := db.sdb.Update(func(tx *storage.Tx) error {
+		err := tx.DropIndexes(ns.Name(), ed.Name())
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, v []byte) (bool, error) {
+			d := AcquireDocument(ed, binary.BigEndian.Uint64(k))
+			err := et.decode(v, d)
+			if err == nil {
+				err = et.updateIndexes(tx, d.ID(), nil, d)
+			}
+			d.Release()
+			n++
+			return err == nil, err
+		})
+	})
+	db.logAdmin(context.Background(), AdminRebuildIndexes, ns.Name(), ed.Name(), map[string]interface{}{"entities": n}, start, err)
+	return n, err
+}
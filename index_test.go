@@ -0,0 +1,189 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexDefn answers an entity type of orders, indexed by their status
+// and amount.
+func indexDefn(t *testing.T, name string) *EntityTypeDefn {
+	t.Helper()
+	return testDefn(t, name, []testField{
+		{"status", FieldTypeString},
+		{"amount", FieldTypeInt64},
+		{"rate", FieldTypeFloat64},
+	}, func(ed *EntityTypeDefn) {
+		if err := ed.AddIndex("by_status", "status", "amount"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.AddIndex("by_rate", "rate"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestIndexSearch(t *testing.T) {
+	ns := testNamespace(t, "idx_ns")
+	ed := indexDefn(t, "idx_order")
+	et := testDB.EntityType(ns, ed)
+	ix := et.(Indexer)
+
+	for _, vals := range []map[string]interface{}{
+		{"status": "open", "amount": int64(30), "rate": 1.5},
+		{"status": "open", "amount": int64(-5), "rate": -2.0},
+		{"status": "closed", "amount": int64(10), "rate": 0.0},
+		{"status": "open\x00x", "amount": int64(1), "rate": -0.5},
+		{"status": "open", "amount": int64(10)},
+		{"amount": int64(7), "rate": 100.0},
+	} {
+		if err := et.Put(testDoc(t, ed, 0, vals)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		r    IndexRange
+		want []uint64
+	}{
+		{"by_status", IndexRange{}, []uint64{6, 3, 2, 5, 1, 4}},
+		{"by_status", IndexRange{Equal: []interface{}{"open"}}, []uint64{2, 5, 1}},
+		{"by_status", IndexRange{Equal: []interface{}{"open"}, Min: 0, Max: 10}, []uint64{5}},
+		{"by_status", IndexRange{Equal: []interface{}{"open"}, Min: 10}, []uint64{5, 1}},
+		{"by_status", IndexRange{Equal: []interface{}{"open"}, Max: 0}, []uint64{2}},
+		{"by_status", IndexRange{Equal: []interface{}{"open", 30}}, []uint64{1}},
+		{"by_status", IndexRange{Equal: []interface{}{nil}}, []uint64{6}},
+		{"by_status", IndexRange{Min: "c", Max: "open"}, []uint64{3, 2, 5, 1}},
+		{"by_status", IndexRange{Equal: []interface{}{"open"}, Limit: 2}, []uint64{2, 5}},
+		{"by_rate", IndexRange{}, []uint64{5, 2, 4, 3, 1, 6}},
+		{"by_rate", IndexRange{Min: -1.0, Max: 1.5}, []uint64{4, 3, 1}},
+	} {
+		ids, err := ix.SearchIndex(c.name, c.r)
+		if err != nil || !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%s %+v: %v, %v", c.name, c.r, ids, err)
+		}
+	}
+
+	// Entries follow updates and deletions.
+	if err := et.Put(testDoc(t, ed, 1, map[string]interface{}{"status": "closed", "amount": int64(30)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := ix.SearchIndex("by_status", IndexRange{Equal: []interface{}{"open"}}); !reflect.DeepEqual(ids, []uint64{5}) {
+		t.Errorf("open after update: %v", ids)
+	}
+	if ids, _ := ix.SearchIndex("by_status", IndexRange{Equal: []interface{}{"closed"}}); !reflect.DeepEqual(ids, []uint64{3, 1}) {
+		t.Errorf("closed after update: %v", ids)
+	}
+
+	if _, err := ix.SearchIndex("by_none", IndexRange{}); err != ErrNameUnknown {
+		t.Errorf("unknown index: %v", err)
+	}
+	if _, err := ix.SearchIndex("by_rate", IndexRange{Equal: []interface{}{1.5}, Min: 1.0}); err != ErrIndexRange {
+		t.Errorf("range past the fields: %v", err)
+	}
+	if _, err := ix.SearchIndex("by_status", IndexRange{Equal: []interface{}{"open", "x"}}); err != ErrFieldValueType {
+		t.Errorf("value of another type: %v", err)
+	}
+	long := testDoc(t, ed, 0, map[string]interface{}{"status": strings.Repeat("x", maxIndexValue)})
+	if err := et.Put(long); !errors.Is(err, ErrIndexValueTooLong) {
+		t.Errorf("long value: %v", err)
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	ns := testNamespace(t, "idx_rb_ns")
+	ed := testDefn(t, "idx_rb_order", []testField{{"status", FieldTypeString}}, nil)
+	et := testDB.EntityType(ns, ed)
+	for _, s := range []string{"b", "a", "b"} {
+		if err := et.Put(testDoc(t, ed, 0, map[string]interface{}{"status": s})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entities stored before an index is added are indexed by
+	// rebuilding.
+	if err := ed.AddIndex("by_status", "status"); err != nil {
+		t.Fatal(err)
+	}
+	ix := et.(Indexer)
+	if ids, _ := ix.SearchIndex("by_status", IndexRange{}); len(ids) != 0 {
+		t.Errorf("before rebuilding: %v", ids)
+	}
+	if n, err := testDB.RebuildIndexes(ns, ed); n != 3 || err != nil {
+		t.Fatalf("rebuild: %d, %v", n, err)
+	}
+	if ids, _ := ix.SearchIndex("by_status", IndexRange{Equal: []interface{}{"b"}}); !reflect.DeepEqual(ids, []uint64{1, 3}) {
+		t.Errorf("after rebuilding: %v", ids)
+	}
+
+	if err := ed.RemoveIndex("by_status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ed.RemoveIndex("by_status"); err != ErrNameUnknown {
+		t.Errorf("remove again: %v", err)
+	}
+	if _, err := testDB.RebuildIndexes(ns, ed); err != nil {
+		t.Fatal(err)
+	}
+	ed.AddIndex("by_status", "status")
+	if ids, _ := ix.SearchIndex("by_status", IndexRange{}); len(ids) != 0 {
+		t.Errorf("entries of a removed index: %v", ids)
+	}
+}
+
+func TestIndexDefn(t *testing.T) {
+	ed, _ := NewEntityTypeDefn("idx_defn")
+	ed.AddField("qty", FieldTypeInt32)
+	ed.AddField("note", FieldTypeString)
+	if err := ed.AddIndex("by_qty", "qty", "note"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		fields []string
+		err    error
+	}{
+		{"by_qty", []string{"qty"}, ErrNameExists},
+		{"bad name", []string{"qty"}, ErrNameInvalid},
+		{"by_none", nil, ErrNameEmpty},
+		{"by_unknown", []string{"size"}, ErrNameUnknown},
+		{"by_twice", []string{"qty", "qty"}, ErrNameExists},
+	} {
+		if err := ed.AddIndex(c.name, c.fields...); err != c.err {
+			t.Errorf("%s %v: %v", c.name, c.fields, err)
+		}
+	}
+
+	by, err := json.Marshal(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var red EntityTypeDefn
+	if err := json.Unmarshal(by, &red); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Index{{Name: "by_qty", Fields: []string{"qty", "note"}}}; !reflect.DeepEqual(red.Indexes(), want) {
+		t.Errorf("indexes: %+v", red.Indexes())
+	}
+}
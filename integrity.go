@@ -0,0 +1,264 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// OnDelete enumerates what becomes of the entities that refer to an
+// entity using a reference field, when the latter is deleted.
+type OnDelete uint8
+
+const (
+	// OnDeleteNone leaves the references dangling.  This is the
+	// default.
+	OnDeleteNone OnDelete = iota
+	// OnDeleteRestrict prevents the deletion of entities that are
+	// referred to.
+	OnDeleteRestrict
+	// OnDeleteCascade deletes the referring entities too.
+	OnDeleteCascade
+	// OnDeleteSetNull clears the referring fields.
+	OnDeleteSetNull
+)
+
+// onDeleteNames holds the names of `OnDelete` behaviours.
+var onDeleteNames = map[OnDelete]string{
+	OnDeleteNone:     "none",
+	OnDeleteRestrict: "restrict",
+	OnDeleteCascade:  "cascade",
+	OnDeleteSetNull:  "set_null",
+}
+
+// String answers the name of this behaviour.
+func (od OnDelete) String() string {
+	if s, ok := onDeleteNames[od]; ok {
+		return s
+	}
+	return fmt.Sprintf("OnDelete(%d)", uint8(od))
+}
+
+// MarshalJSON conforms to `json.Marshaler`.  Behaviours are serialised
+// by name.
+func (od OnDelete) MarshalJSON() ([]byte, error) {
+	if _, ok := onDeleteNames[od]; !ok {
+		return nil, ErrOnDeleteUnknown
+	}
+	return json.Marshal(od.String())
+}
+
+// UnmarshalJSON conforms to `json.Unmarshaler`.
+func (od *OnDelete) UnmarshalJSON(by []byte) error {
+	var s string
+	err := json.Unmarshal(by, &s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range onDeleteNames {
+		if v == s {
+			*od = k
+			return nil
+		}
+	}
+	return ErrOnDeleteUnknown
+}
+
+// SetOnDelete sets what becomes of the entities that refer to another
+// using the given reference field, when the latter is deleted using
+// `Delete`.  Unlike immutability, this can be changed.
+//
+// Behaviours are looked up in the system catalogue when entities are
+// deleted; hence, the definitions of the referring entity types should
+// be saved.  Referring entities are found using the index of
+// references, which does not cover those stored using `Import`.
+func (ed *EntityTypeDefn) SetOnDelete(name string, od OnDelete) error {
+	if _, ok := onDeleteNames[od]; !ok {
+		return ErrOnDeleteUnknown
+	}
+
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	fd, ok := ed.fields[name]
+	if !ok {
+		return ErrNameUnknown
+	}
+	if fd.Ftype != FieldTypeReference {
+		return ErrReferenceTarget
+	}
+	fd.OnDelete = od
+	ed.fields[name] = fd
+	return nil
+}
+
+// ReferencedError is answered when deleting an entity is restricted by
+// a reference to it.  See `OnDeleteRestrict`.
+type ReferencedError struct {
+	Type       string // entity type of the entity being deleted
+	ID         uint64 // ID of the entity being deleted
+	Referrer   string // entity type of the referring entity
+	ReferrerID uint64 // ID of the referring entity
+	Field      string // name of the referring field
+}
+
+// Error conforms to `error`.
+func (e *ReferencedError) Error() string {
+	return fmt.Sprintf("%s %d is referred to by field `%s` of %s %d", e.Type, e.ID, e.Field, e.Referrer, e.ReferrerID)
+}
+
+// Is answers `true` for `ErrConflict`.
+func (e *ReferencedError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// dependent is a reference to an entity being deleted.
+type dependent struct {
+	et *entityType // entity type of the referring entity
+	id uint64      // ID of the referring entity
+	fd FieldDefn   // referring field
+}
+
+// enforceRefs applies the `OnDelete` behaviours of the references to
+// the entity having the given ID, within the given transaction, before
+// it is removed.  Restrictions are verified before any referring
+// entity is changed.  Cascades recurse; the given set holds the
+// entities being deleted, so that cycles terminate.  The given actor
+// is recorded in the audit log, if enabled.
+func (et *entityType) enforceRefs(tx *storage.Tx, id uint64, now int64, actor string, deleting map[ref]bool) error {
+	deleting[ref{target: et.Name(), id: id}] = true
+	if n, _, _ := tx.RefCount(et.ns.Name(), et.Name(), id); n == 0 {
+		return nil
+	}
+
+	var rs []dependent
+	types := make(map[string]*entityType)
+	err := tx.Referrers(et.ns.Name(), et.Name(), id, func(src string, sid uint64, fid uint8) (bool, error) {
+		ret, ok := types[src]
+		if !ok {
+			ed, err := catalogueDefn(tx, src)
+			if err != nil {
+				return false, err
+			}
+			ret = &entityType{db: et.db, ns: et.ns, defn: ed}
+			types[src] = ret
+		}
+		fd, ok := ret.defn.fieldByID(fid)
+		if ok && fd.OnDelete != OnDeleteNone && !deleting[ref{target: src, id: sid}] {
+			rs = append(rs, dependent{et: ret, id: sid, fd: fd})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		if r.fd.OnDelete == OnDeleteRestrict {
+			return &ReferencedError{Type: et.Name(), ID: id, Referrer: r.et.Name(), ReferrerID: r.id, Field: r.fd.Name}
+		}
+	}
+	for _, r := range rs {
+		switch r.fd.OnDelete {
+		case OnDeleteCascade:
+			if deleting[ref{target: r.et.Name(), id: r.id}] {
+				continue
+			}
+			err = r.et.enforceRefs(tx, r.id, now, actor, deleting)
+			if err == nil {
+				err = r.et.remove(tx, r.id, now, actor)
+			}
+			if err == nil {
+				err = tx.ClearProvenance(et.ns.Name(), r.et.Name(), r.id)
+			}
+		case OnDeleteSetNull:
+			err = r.et.clearRef(tx, r.id, r.fd, now, actor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes the entities having the given IDs, within the
+// given transaction, on behalf of no actor, applying the `OnDelete`
+// behaviours of the references to each first, as `Delete` does.  When
+// the removal of one is restricted, it answers the error together with
+// its ID, so that the caller can retry without it; the transaction
+// must then be rolled back.
+func (et *entityType) removeAll(tx *storage.Tx, ids []uint64, now int64) (uint64, error) {
+	for _, id := range ids {
+		err := et.enforceRefs(tx, id, now, "", make(map[ref]bool))
+		if err != nil {
+			if _, ok := err.(*ReferencedError); ok {
+				return id, err
+			}
+			return 0, err
+		}
+		err = et.remove(tx, id, now, "")
+		if err == nil {
+			err = tx.ClearProvenance(et.ns.Name(), et.Name(), id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// catalogueDefn answers the definition of the given entity type in the
+// system catalogue, within the given transaction; an empty definition
+// if there is none.
+func catalogueDefn(tx *storage.Tx, name string) (*EntityTypeDefn, error) {
+	ed := &EntityTypeDefn{name: name, fields: make(map[string]FieldDefn)}
+	if by, ok := tx.EntityTypeDefn(name); ok {
+		err := json.Unmarshal(by, ed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ed, nil
+}
+
+// clearRef clears the given reference field of the entity having the
+// given ID, within the given transaction.  A soft-deleted entity
+// remains so.
+func (et *entityType) clearRef(tx *storage.Tx, id uint64, fd FieldDefn, now int64, actor string) error {
+	d, err := et.get(tx, id)
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil
+		}
+		return err
+	}
+	if f, ok := d.fields[fd.ID]; ok {
+		f.Clear()
+	}
+
+	by, err := et.encode(d)
+	if err != nil {
+		return err
+	}
+	_, err = et.store(tx, id, by, d, now, actor)
+	if err != nil || d.deleted == 0 {
+		return err
+	}
+	return tx.Trash(et.ns.Name(), et.Name(), id, d.deleted)
+}
@@ -0,0 +1,261 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// refBase is the time shown by the clocks of the reference tests.
+var refBase = time.Unix(4000000, 0)
+
+// refChild answers an entity type whose documents refer to those of
+// the given one, restricting their deletion by field `keeper`, and
+// cascading it by field `owner`.
+func refChild(t *testing.T, name, target string) *EntityTypeDefn {
+	t.Helper()
+	return testDefn(t, name, nil, func(ed *EntityTypeDefn) {
+		for _, f := range []struct {
+			name string
+			od   OnDelete
+		}{{"keeper", OnDeleteRestrict}, {"owner", OnDeleteCascade}} {
+			if err := ed.AddReference(f.name, target); err != nil {
+				t.Fatal(err)
+			}
+			if err := ed.SetOnDelete(f.name, f.od); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// stored answers `true` if the entity having the given ID is stored.
+func stored(t *testing.T, ns *Namespace, ed *EntityTypeDefn, id uint64) bool {
+	t.Helper()
+	var ok bool
+	err := testDB.sdb.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(ns.Name(), ed.Name(), EntityKey{id: id}.Key())
+		if err == storage.ErrKeyUnknown {
+			return nil
+		}
+		ok = err == nil
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestRemovalEnforcesRefs(t *testing.T) {
+	tests := []struct {
+		name   string
+		series bool
+		put    func(*DB, EntityType, *Document) error
+		remove func(*DB, EntityType, *ManualClock) (uint64, error)
+	}{
+		{
+			name: "ref_expiry",
+			put: func(db *DB, et EntityType, d *Document) error {
+				return et.(ExpiringEntityType).PutWithExpiry(d, refBase.Add(time.Minute))
+			},
+			remove: func(db *DB, et EntityType, clk *ManualClock) (uint64, error) {
+				clk.Advance(time.Hour)
+				return et.(ExpiringEntityType).ExpireNow()
+			},
+		},
+		{
+			name: "ref_purge",
+			put: func(db *DB, et EntityType, d *Document) error {
+				if err := et.Put(d); err != nil {
+					return err
+				}
+				return et.(SoftDeleter).DeleteSoft(d.ID())
+			},
+			remove: func(db *DB, et EntityType, clk *ManualClock) (uint64, error) {
+				clk.Advance(time.Hour)
+				return et.(SoftDeleter).PurgeDeleted(time.Minute)
+			},
+		},
+		{
+			name:   "ref_retention",
+			series: true,
+			put: func(db *DB, et EntityType, d *Document) error {
+				return et.(TimeSeriesEntityType).PutAt(d, refBase.Add(-2*time.Hour))
+			},
+			remove: func(db *DB, et EntityType, clk *ManualClock) (uint64, error) {
+				return et.(TimeSeriesEntityType).EnforceRetention()
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		db, clk := clockDB(refBase)
+		ns := testNamespace(t, tc.name)
+		ped := testDefn(t, tc.name, []testField{{"label", FieldTypeString}}, func(ed *EntityTypeDefn) {
+			if tc.series {
+				ed.SetTimeSeries(true)
+				if err := ed.SetRetention(time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		ced := refChild(t, tc.name+"_child", tc.name)
+		pet, cet := db.EntityType(ns, ped), db.EntityType(ns, ced)
+
+		var ps [3]*Document
+		for i := range ps {
+			ps[i] = testDoc(t, ped, 0, nil)
+			if err := tc.put(db, pet, ps[i]); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+		keeper := testDoc(t, ced, 0, map[string]interface{}{"keeper": ps[0].ID()})
+		owned := testDoc(t, ced, 0, map[string]interface{}{"owner": ps[1].ID()})
+		for _, d := range []*Document{keeper, owned} {
+			if err := cet.Put(d); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+
+		n, err := tc.remove(db, pet, clk)
+		if err != nil || n != 2 {
+			t.Errorf("%s: removed %d, %v; want 2", tc.name, n, err)
+		}
+		if !stored(t, ns, ped, ps[0].ID()) {
+			t.Errorf("%s: restricted entity removed", tc.name)
+		}
+		if stored(t, ns, ped, ps[1].ID()) || stored(t, ns, ped, ps[2].ID()) {
+			t.Errorf("%s: unrestricted entities kept", tc.name)
+		}
+		if !stored(t, ns, ced, keeper.ID()) || stored(t, ns, ced, owned.ID()) {
+			t.Errorf("%s: cascade not applied", tc.name)
+		}
+
+		n, err = tc.remove(db, pet, clk)
+		if err != nil || n != 0 {
+			t.Errorf("%s: second pass removed %d, %v", tc.name, n, err)
+		}
+	}
+}
+
+func TestRollbackEnforcesRefs(t *testing.T) {
+	ns := testNamespace(t, "ref_rb")
+	ped := testDefn(t, "ref_rb", []testField{{"label", FieldTypeString}}, nil)
+	ced := refChild(t, "ref_rb_child", "ref_rb")
+	pet, cet := testDB.EntityType(ns, ped), testDB.EntityType(ns, ced)
+
+	put := func(batch string) *Document {
+		d := testDoc(t, ped, 0, nil)
+		if err := pet.(ProvenanceRecorder).PutWithProvenance(d, Provenance{Source: "test", Batch: batch}); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	restricted, cascaded := put("ref_rb_1"), put("ref_rb_2")
+	keeper := testDoc(t, ced, 0, map[string]interface{}{"keeper": restricted.ID()})
+	owned := testDoc(t, ced, 0, map[string]interface{}{"owner": cascaded.ID()})
+	for _, d := range []*Document{keeper, owned} {
+		if err := cet.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rerr *ReferencedError
+	if _, err := testDB.RollbackBatch(ns, "ref_rb_1", RollbackOpts{}); !errors.As(err, &rerr) || rerr.ID != restricted.ID() {
+		t.Fatalf("restricted rollback: %v", err)
+	}
+	if !stored(t, ns, ped, restricted.ID()) {
+		t.Error("restricted rollback: entity removed")
+	}
+
+	if _, err := testDB.RollbackBatch(ns, "ref_rb_2", RollbackOpts{}); err != nil {
+		t.Fatalf("cascading rollback: %v", err)
+	}
+	if stored(t, ns, ped, cascaded.ID()) || stored(t, ns, ced, owned.ID()) {
+		t.Error("cascading rollback: entities kept")
+	}
+}
+
+func TestMoveEnforcesRefs(t *testing.T) {
+	src, dst := testNamespace(t, "ref_mv_src"), testNamespace(t, "ref_mv_dst")
+	ped := testDefn(t, "ref_mv", []testField{{"label", FieldTypeString}}, nil)
+	ced := refChild(t, "ref_mv_child", "ref_mv")
+	pet, cet := testDB.EntityType(src, ped), testDB.EntityType(src, ced)
+
+	var ps [3]*Document
+	for i := range ps {
+		ps[i] = testDoc(t, ped, 0, nil)
+		if err := pet.Put(ps[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keeper := testDoc(t, ced, 0, map[string]interface{}{"keeper": ps[0].ID()})
+	owned := testDoc(t, ced, 0, map[string]interface{}{"owner": ps[1].ID()})
+	for _, d := range []*Document{keeper, owned} {
+		if err := cet.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restricted move moves nothing.
+	var rerr *ReferencedError
+	if _, err := testDB.MoveEntities(src, ped, SearchOpts{}, nil, dst, nil); !errors.As(err, &rerr) || rerr.ID != ps[0].ID() {
+		t.Fatalf("restricted move: %v", err)
+	}
+	for _, d := range ps {
+		if !stored(t, src, ped, d.ID()) || stored(t, dst, ped, d.ID()) {
+			t.Fatalf("restricted move: %d moved", d.ID())
+		}
+	}
+
+	unkept := func(id uint64, _ Entity) bool { return id != ps[0].ID() }
+	ids, err := testDB.MoveEntities(src, ped, SearchOpts{}, unkept, dst, nil)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("move: %v, %v", ids, err)
+	}
+	if stored(t, src, ped, ps[1].ID()) || !stored(t, dst, ped, ps[1].ID()) {
+		t.Error("move: entity not moved")
+	}
+	if !stored(t, src, ced, keeper.ID()) || stored(t, src, ced, owned.ID()) {
+		t.Error("move: cascade not applied")
+	}
+
+	// References from entities moved along do not restrict the move.
+	ned := testDefn(t, "ref_mv_node", nil, func(ed *EntityTypeDefn) {
+		if err := ed.AddReference("parent", "ref_mv_node"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.SetOnDelete("parent", OnDeleteRestrict); err != nil {
+			t.Fatal(err)
+		}
+	})
+	net := testDB.EntityType(src, ned)
+	root := testDoc(t, ned, 0, nil)
+	if err := net.Put(root); err != nil {
+		t.Fatal(err)
+	}
+	leaf := testDoc(t, ned, 0, map[string]interface{}{"parent": root.ID()})
+	if err := net.Put(leaf); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := testDB.MoveEntities(src, ned, SearchOpts{}, nil, dst, nil); err != nil || len(ids) != 2 {
+		t.Fatalf("move along: %v, %v", ids, err)
+	}
+}
@@ -0,0 +1,96 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold an append-only bucket of audit
+// records:
+//
+//	key   : entity type | ID uint64 | sequence uint64
+//	value : time int64 | operation uint8 | revision uint64 | actor
+//
+// Entity types and actors are prefixed by their lengths as `uint8`.
+// The sequence is that of the bucket; hence, the records of an entity
+// are in the order in which they were written.
+const (
+	dbauditname = "_audit"
+)
+
+// AuditRecord records a mutation of an entity.
+type AuditRecord struct {
+	Time  int64
+	Op    uint8
+	Rev   uint64 // revision of the entity after the mutation
+	Actor string
+}
+
+// Audit appends the given record to the audit records of the given
+// entity.  The actor should not be longer than 255 bytes.
+func (tx *Tx) Audit(ns, et string, id uint64, r AuditRecord) error {
+	ab, err := nsBucket(tx.tx, ns, dbauditname, true)
+	if err != nil {
+		return err
+	}
+	seq, err := ab.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	v := appendUint64(nil, uint64(r.Time))
+	v = append(v, r.Op)
+	v = appendUint64(v, r.Rev)
+	v = appendShortString(v, r.Actor)
+	return ab.Put(appendUint64(entityRefKey(et, id), seq), v)
+}
+
+// AuditHistory calls the given function with every audit record of the
+// given entity, in the order in which they were written, until the
+// function answers `false` or an error.
+func (tx *Tx) AuditHistory(ns, et string, id uint64, fn func(AuditRecord) (bool, error)) error {
+	ab, err := nsBucket(tx.tx, ns, dbauditname, false)
+	if err != nil || ab == nil {
+		return err
+	}
+
+	prefix := entityRefKey(et, id)
+	c := ab.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 || len(v) < 17 {
+			return ErrKeyInvalid
+		}
+		r := AuditRecord{
+			Time: int64(binary.BigEndian.Uint64(v)),
+			Op:   v[8],
+			Rev:  binary.BigEndian.Uint64(v[9:17]),
+		}
+		var rest []byte
+		var ok bool
+		r.Actor, rest, ok = readShortString(v[17:])
+		if !ok || len(rest) != 0 {
+			return ErrKeyInvalid
+		}
+
+		ok, err := fn(r)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
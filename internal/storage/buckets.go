@@ -0,0 +1,201 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+)
+
+// typeBuckets lists the internal buckets of a namespace whose entries
+// outlive the entities that they refer to, but not their entity types.
+// Audit logs and batch logs outlive entity types too.
+var typeBuckets = []string{
+	dbhistname, dbrevname, dbrefcntname,
+}
+
+// HasEntityType answers `true` if the given entity type has a bucket
+// in the given namespace.
+func (tx *Tx) HasEntityType(ns, et string) bool {
+	_, err := entityBucket(tx.tx, ns, et, false)
+	return err == nil
+}
+
+// CreateEntityType creates the bucket of the given entity type in the
+// given namespace, if it does not exist already.
+func (tx *Tx) CreateEntityType(ns, et string) error {
+	_, err := entityBucket(tx.tx, ns, et, true)
+	return err
+}
+
+// Truncate removes all the records of the given entity type, together
+// with the entries of the internal buckets of the namespace that refer
+// to them, such as labels and references.  Reference counts,
+// revisions, histories, audit logs and batch logs are retained, as
+// they are when entities are deleted.  The sequence of the entity
+// type is retained too; hence, IDs are not reused.  The deletions are
+// recorded in the change log.
+//
+// It answers `ErrTypeReferenced` if entities of other entity types
+// refer to its entities.  It answers the number of records removed.
+func (tx *Tx) Truncate(ns, et string, now int64) (uint64, error) {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return 0, err
+	}
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if err = checkReferrers(tx.tx, ns, et); err != nil {
+		return 0, err
+	}
+
+	var keys [][]byte
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+		err = logChange(tx.tx, Change{Kind: ChangeDelete, NS: ns, ET: et, Key: k})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return uint64(len(keys)), tx.dropIndexEntries(ns, et, now)
+}
+
+// DropEntityType removes the bucket of the given entity type from the
+// given namespace, together with the reference counts, revisions and
+// histories of its former entities.  Audit logs and batch logs are
+// retained.  Since its sequence is removed too, IDs are reused if the
+// entity type is created again.
+//
+// Only empty entity types can be dropped: it answers
+// `ErrTypeNotEmpty` if the entity type has records; see `Truncate`.
+// Frozen entity types can not be dropped either.  Dropping is not
+// recorded in the change log; replicas retain the empty bucket.
+func (tx *Tx) DropEntityType(ns, et string, now int64) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			return ErrTypeNotEmpty
+		}
+	}
+
+	err = tx.dropIndexEntries(ns, et, now)
+	if err != nil {
+		return err
+	}
+	prefix := appendShortString(nil, et)
+	for _, name := range typeBuckets {
+		err = deletePrefix(tx.tx, ns, name, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.tx.Bucket([]byte(ns)).DeleteBucket([]byte(et))
+}
+
+// checkReferrers answers `ErrTypeReferenced` if entities of other
+// entity types refer to entities of the given entity type.
+func checkReferrers(tx *bolt.Tx, ns, et string) error {
+	rb, err := nsBucket(tx, ns, dbrefsname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	prefix := appendShortString(nil, et)
+	c := rb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		e, ok := parseIndexKey(dbrefsname, k)
+		if !ok {
+			return ErrKeyInvalid
+		}
+		if e.Type != et {
+			return ErrTypeReferenced
+		}
+	}
+	return nil
+}
+
+// dropIndexEntries removes the entries of the internal buckets of the
+// given namespace that refer to entities of the given entity type.
+// References are removed using `RemoveRef`, so that the reference
+// counts of their targets are maintained.
+func (tx *Tx) dropIndexEntries(ns, et string, now int64) error {
+	var es []IndexEntry
+	err := tx.IndexEntries(ns, func(e IndexEntry) (bool, error) {
+		if e.Type == et {
+			e.Key = append([]byte(nil), e.Key...)
+			es = append(es, e)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range es {
+		if e.Bucket == dbrefsname {
+			err = tx.RemoveRef(ns, e.Target, e.TargetID, e.Type, e.ID, e.Field, now)
+		} else {
+			err = tx.DeleteIndexEntry(ns, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix removes the entries having keys that begin with the
+// given prefix from the given internal bucket of the given namespace.
+func deletePrefix(tx *bolt.Tx, ns, name string, prefix []byte) error {
+	b, err := nsBucket(tx, ns, name, false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
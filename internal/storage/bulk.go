@@ -0,0 +1,43 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+// SetFillPercent sets how full the pages of the given entity type's
+// bucket are filled when they split, for the rest of this transaction,
+// creating the bucket if necessary.  Filling them fully suits records
+// appended in the ascending order of their keys: the pages need no
+// room for later insertions, and the database file is smaller.
+func (tx *Tx) SetFillPercent(ns, et string, fill float64) error {
+	b, err := entityBucket(tx.tx, ns, et, true)
+	if err != nil {
+		return err
+	}
+	b.FillPercent = fill
+	return nil
+}
+
+// RaiseSequence raises the ID sequence of the given entity type to
+// the given ID, if it is lower, so that new IDs do not collide with
+// it.
+func (tx *Tx) RaiseSequence(ns, et string, id uint64) error {
+	b, err := entityBucket(tx.tx, ns, et, true)
+	if err != nil {
+		return err
+	}
+	if id > b.Sequence() {
+		return b.SetSequence(id)
+	}
+	return nil
+}
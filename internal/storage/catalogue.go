@@ -0,0 +1,129 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// NextEntityTypeID answers a new unique ID for an entity type, from
+// the system catalogue.
+func (db *DB) NextEntityTypeID() (uint64, error) {
+	var id uint64
+	err := update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname))
+		var err error
+		id, err = b.NextSequence()
+		return err
+	})
+	return id, err
+}
+
+// PutEntityTypeDefn stores the given serialised entity type definition
+// in the system catalogue, under the given name.
+func (db *DB) PutEntityTypeDefn(name string, defn []byte) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		return (&Tx{tx: tx}).PutEntityTypeDefn(name, defn)
+	})
+}
+
+// EntityTypeDefn answers a copy of the serialised definition of the
+// given entity type in the system catalogue, if any.
+func (tx *Tx) EntityTypeDefn(name string) ([]byte, bool) {
+	v := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname)).Get([]byte(name))
+	if v == nil {
+		return nil, false
+	}
+	return append([]byte(nil), v...), true
+}
+
+// EntityTypeDefns answers a copy of all the serialised entity type
+// definitions in the system catalogue, keyed by their names.
+func (db *DB) EntityTypeDefns() (map[string][]byte, error) {
+	res := make(map[string][]byte)
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname))
+		return b.ForEach(func(k, v []byte) error {
+			by := make([]byte, len(v))
+			copy(by, v)
+			res[string(k)] = by
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// PutEntityTypeDefn stores the given serialised entity type definition
+// in the system catalogue, under the given name, in this transaction.
+func (tx *Tx) PutEntityTypeDefn(name string, defn []byte) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+
+	b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname))
+	err := b.Put([]byte(name), defn)
+	if err != nil {
+		return err
+	}
+	return logChange(tx.tx, Change{Kind: ChangeDefn, ET: name, Value: defn})
+}
+
+// EntityTypeDefns answers a copy of all the serialised entity type
+// definitions in the system catalogue, keyed by their names.
+func (tx *Tx) EntityTypeDefns() map[string][]byte {
+	res := make(map[string][]byte)
+	tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname)).ForEach(func(k, v []byte) error {
+		res[string(k)] = append([]byte(nil), v...)
+		return nil
+	})
+	return res
+}
+
+// EntityTypeSequence answers the last ID assigned to an entity type by
+// the system catalogue.
+func (tx *Tx) EntityTypeSequence() uint64 {
+	return tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname)).Sequence()
+}
+
+// RaiseEntityTypeSequence raises the entity type ID sequence of the
+// system catalogue to the given ID, if it is lower.
+func (tx *Tx) RaiseEntityTypeSequence(id uint64) error {
+	b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname))
+	if id > b.Sequence() {
+		return b.SetSequence(id)
+	}
+	return nil
+}
+
+// CreateNamespace creates the bucket of the given namespace, if it
+// does not exist already.  Reserved names are not accepted.
+func (tx *Tx) CreateNamespace(ns string) error {
+	if ns == "" {
+		return ErrNameEmpty
+	}
+	if ns == dbsysname || ns[0] == '_' {
+		return ErrBucketUnknown
+	}
+	_, err := tx.tx.CreateBucketIfNotExists([]byte(ns))
+	return err
+}
@@ -0,0 +1,496 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// System change log bucket name.
+	dbchangesname = "changes"
+
+	// System replica state bucket name.
+	dbreplicaname = "replica"
+)
+
+// Key of the cursor of a replica, in the replica state bucket.
+var replicaCursorKey = []byte("cursor")
+
+// Kinds of changes recorded in the change log.
+const (
+	ChangePut      = 1 // a record was stored
+	ChangeDelete   = 2 // a record was deleted
+	ChangeDefn     = 3 // an entity type definition was stored
+	ChangeSequence = 4 // sequence of an entity type; only in snapshots
+)
+
+// Change is an entry of the change log.  Values of records are sealed,
+// as stored.
+//
+// Serialised form:
+//
+//	change : kind uint8 | namespace | entity type | key | value
+//
+// The namespace, the entity type and the key are short strings.  The
+// namespace of a definition is empty, and its entity type is its name.
+type Change struct {
+	Seq   uint64 // position in the change log
+	Kind  uint8
+	NS    string
+	ET    string
+	Key   []byte
+	Value []byte
+}
+
+// encode answers the serialised form of this change.
+func (c Change) encode() []byte {
+	by := make([]byte, 0, 3+len(c.NS)+len(c.ET)+len(c.Key)+len(c.Value)+1)
+	by = append(by, c.Kind)
+	by = appendShortString(by, c.NS)
+	by = appendShortString(by, c.ET)
+	by = appendShortString(by, string(c.Key))
+	return append(by, c.Value...)
+}
+
+// Record answers the record stored by a change of kind `ChangePut`,
+// after verifying its checksum.
+func (c Change) Record() ([]byte, error) {
+	return openRecord(c.Value)
+}
+
+// decodeChange reads a change serialised by `encode`.
+func decodeChange(seq uint64, by []byte) (Change, error) {
+	c := Change{Seq: seq}
+	if len(by) < 1 {
+		return c, ErrCorruptRecord
+	}
+	c.Kind = by[0]
+	var key string
+	var ok1, ok2, ok3 bool
+	c.NS, by, ok1 = readShortString(by[1:])
+	c.ET, by, ok2 = readShortString(by)
+	key, by, ok3 = readShortString(by)
+	if !ok1 || !ok2 || !ok3 || c.Kind < ChangePut || c.Kind > ChangeSequence {
+		return c, ErrCorruptRecord
+	}
+	c.Key = []byte(key)
+	c.Value = append([]byte(nil), by...)
+	return c, nil
+}
+
+// SetChangeLog enables or disables recording of committed changes in
+// the change log.  Changes in reserved namespaces are never recorded.
+func (db *DB) SetChangeLog(on bool) {
+	theDB.mu.Lock()
+	defer theDB.mu.Unlock()
+
+	theDB.changeLog = on
+}
+
+// logChange records the given change in the change log of the given
+// transaction, if enabled.
+func logChange(tx *bolt.Tx, c Change) error {
+	if !theDB.changeLog || c.NS != "" && c.NS[0] == '_' {
+		return nil
+	}
+
+	b, err := tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbchangesname))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(signalChanges)
+	return b.Put(appendUint64(nil, seq), c.encode())
+}
+
+// changesLogged is closed, and replaced, whenever changes are
+// committed to the change log.
+var changesLogged = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// signalChanges wakes those waiting for changes to be logged.
+func signalChanges() {
+	changesLogged.Lock()
+	defer changesLogged.Unlock()
+
+	close(changesLogged.ch)
+	changesLogged.ch = make(chan struct{})
+}
+
+// ChangesLogged answers a channel that is closed once changes are
+// committed to the change log, following those committed so far.
+func (db *DB) ChangesLogged() <-chan struct{} {
+	changesLogged.Lock()
+	defer changesLogged.Unlock()
+
+	return changesLogged.ch
+}
+
+// ChangeLogPosition answers the position of the last change recorded
+// in the change log, as of this transaction; `0` if none has been.
+func (tx *Tx) ChangeLogPosition() uint64 {
+	if b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbchangesname)); b != nil {
+		return b.Sequence()
+	}
+	return 0
+}
+
+// ReadChanges answers up to `max` changes following the given position
+// in the change log, in order.  It answers `ErrChangesTrimmed` if some
+// of the changes following it have been trimmed already.
+func (db *DB) ReadChanges(after uint64, max int) ([]Change, error) {
+	var res []Change
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbchangesname))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek(appendUint64(nil, after+1))
+		if k == nil && after < b.Sequence() || k != nil && binary.BigEndian.Uint64(k) != after+1 {
+			return ErrChangesTrimmed
+		}
+		for ; k != nil && len(res) < max; k, v = c.Next() {
+			ch, err := decodeChange(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			res = append(res, ch)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// TrimChanges removes the changes up to the given position from the
+// change log, but not past the least offset of the consumer groups
+// that read it.  It answers the number of changes removed.
+func (db *DB) TrimChanges(upTo uint64) (uint64, error) {
+	var n uint64
+	err := update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbchangesname))
+		if b == nil {
+			return nil
+		}
+		floor, ok, err := groupsFloor(tx)
+		if err != nil {
+			return err
+		}
+		if ok && floor < upTo {
+			upTo = floor
+		}
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= upTo; k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// applyChange applies the given change, received from another
+// database, in the given transaction.  Stored records are verified
+// against their checksums; their revisions are incremented, and the
+// sequences of their entity types are raised past their IDs.  Applied
+// changes are not recorded in the change log of this database.
+func applyChange(tx *bolt.Tx, c Change) error {
+	if c.Kind == ChangeDefn {
+		return tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname)).Put([]byte(c.ET), c.Value)
+	}
+	if len(c.Key) != 8 {
+		return ErrKeyInvalid
+	}
+	b, err := entityBucket(tx, c.NS, c.ET, true)
+	if err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint64(c.Key)
+
+	switch c.Kind {
+	case ChangePut:
+		if _, err = openRecord(c.Value); err != nil {
+			return err
+		}
+		err = b.Put(c.Key, c.Value)
+		if err == nil {
+			_, err = nextRevision(tx, c.NS, c.ET, id)
+		}
+		if err == nil && id > b.Sequence() {
+			err = b.SetSequence(id)
+		}
+	case ChangeDelete:
+		err = b.Delete(c.Key)
+	case ChangeSequence:
+		if id > b.Sequence() {
+			err = b.SetSequence(id)
+		}
+	}
+	return err
+}
+
+// ApplyChanges applies the given changes, read from the change log of
+// another database, in a single transaction, and records the position
+// of the last one as the cursor of this replica.
+func (db *DB) ApplyChanges(cs []Change) error {
+	if len(cs) == 0 {
+		return nil
+	}
+	return update(func(tx *bolt.Tx) error {
+		for _, c := range cs {
+			err := applyChange(tx, c)
+			if err != nil {
+				return err
+			}
+		}
+		return setReplicaCursor(tx, cs[len(cs)-1].Seq)
+	})
+}
+
+// ReplicaCursor answers the position in the change log of the source
+// database up to which this replica has applied changes, and `true`
+// if it has been synchronised from a snapshot.
+func (db *DB) ReplicaCursor() (uint64, bool, error) {
+	var cur uint64
+	var ok bool
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbreplicaname))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(replicaCursorKey); len(v) == 8 {
+			cur, ok = binary.BigEndian.Uint64(v), true
+		}
+		return nil
+	})
+	return cur, ok, err
+}
+
+// setReplicaCursor records the given cursor of this replica.
+func setReplicaCursor(tx *bolt.Tx, cur uint64) error {
+	b, err := tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbreplicaname))
+	if err != nil {
+		return err
+	}
+	return b.Put(replicaCursorKey, appendUint64(nil, cur))
+}
+
+// Snapshot stream format, version 1.  All integers are big-endian.
+//
+//	header  : magic "FLGS" | version uint8 | position uint64
+//	change  : tag uint8 (= 1) | length uint32 | change
+//	trailer : tag uint8 (= 0) | change count uint64
+//
+// The position is that of the last change in the change log that the
+// snapshot includes.  The changes store the entity type definitions,
+// the records and the sequences of the entity types, in reserved
+// namespaces excepted.
+const (
+	snapshotMagic   = "FLGS"
+	snapshotVersion = 1
+)
+
+// WriteSnapshot writes a consistent snapshot of the entity type
+// definitions and of the records of all the entity types to the given
+// writer.  It answers the position in the change log that the
+// snapshot corresponds to.
+func (db *DB) WriteSnapshot(w io.Writer) (uint64, error) {
+	var seq uint64
+	err := view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbchangesname)); b != nil {
+			seq = b.Sequence()
+		}
+
+		bw := bufio.NewWriter(w)
+		bw.WriteString(snapshotMagic)
+		bw.WriteByte(snapshotVersion)
+		bw.Write(appendUint64(nil, seq))
+
+		var n uint64
+		write := func(c Change) error {
+			by := c.encode()
+			bw.WriteByte(exportTagRecord)
+			binary.Write(bw, binary.BigEndian, uint32(len(by)))
+			_, err := bw.Write(by)
+			n++
+			return err
+		}
+
+		err := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbetdefsname)).ForEach(func(k, v []byte) error {
+			return write(Change{Kind: ChangeDefn, ET: string(k), Value: v})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.ForEach(func(ns []byte, nsb *bolt.Bucket) error {
+			if string(ns) == dbsysname || ns[0] == '_' {
+				return nil
+			}
+			return nsb.ForEach(func(et, v []byte) error {
+				if v != nil || et[0] == '_' {
+					return nil
+				}
+				b := nsb.Bucket(et)
+				err := b.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return nil
+					}
+					return write(Change{Kind: ChangePut, NS: string(ns), ET: string(et), Key: k, Value: v})
+				})
+				if err != nil {
+					return err
+				}
+				return write(Change{Kind: ChangeSequence, NS: string(ns), ET: string(et), Key: appendUint64(nil, b.Sequence())})
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		bw.WriteByte(exportTagEnd)
+		bw.Write(appendUint64(nil, n))
+		return bw.Flush()
+	})
+	return seq, err
+}
+
+// LoadSnapshot replaces the records of all the entity types of this
+// database - in reserved namespaces excepted - with those in the
+// snapshot read from the given reader, and records its position as
+// the cursor of this replica.  Other data of the namespaces, such as
+// labels, are removed too.
+//
+// Changes are applied in chunks; the cursor is recorded only once the
+// snapshot is loaded entirely.  It answers the position of the
+// snapshot.
+func (db *DB) LoadSnapshot(r io.Reader) (uint64, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(snapshotMagic)+1+8)
+	_, err := io.ReadFull(br, hdr)
+	if err != nil || string(hdr[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrExportMagic
+	}
+	if hdr[len(snapshotMagic)] != snapshotVersion {
+		return 0, ErrExportVersion
+	}
+	seq := binary.BigEndian.Uint64(hdr[len(snapshotMagic)+1:])
+
+	err = update(func(tx *bolt.Tx) error {
+		var names [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != dbsysname && name[0] != '_' {
+				names = append(names, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		for _, name := range names {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbreplicaname)); b != nil {
+			return b.Delete(replicaCursorKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	chunk := make([]Change, 0, importChunk)
+	flush := func() error {
+		err := update(func(tx *bolt.Tx) error {
+			for _, c := range chunk {
+				err := applyChange(tx, c)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		chunk = chunk[:0]
+		return err
+	}
+	for {
+		tag, err := br.ReadByte()
+		if err != nil {
+			return 0, ErrExportTruncated
+		}
+
+		switch tag {
+		case exportTagRecord:
+			var l uint32
+			err = binary.Read(br, binary.BigEndian, &l)
+			by := make([]byte, l)
+			if err == nil {
+				_, err = io.ReadFull(br, by)
+			}
+			if err != nil {
+				return 0, ErrExportTruncated
+			}
+			c, err := decodeChange(0, by)
+			if err != nil {
+				return 0, err
+			}
+			chunk = append(chunk, c)
+			n++
+			if len(chunk) == importChunk {
+				err = flush()
+				if err != nil {
+					return 0, err
+				}
+			}
+
+		case exportTagEnd:
+			var cnt uint64
+			err = binary.Read(br, binary.BigEndian, &cnt)
+			if err != nil || cnt != n {
+				return 0, ErrExportTruncated
+			}
+			err = flush()
+			if err != nil {
+				return 0, err
+			}
+			return seq, update(func(tx *bolt.Tx) error {
+				return setReplicaCursor(tx, seq)
+			})
+
+		default:
+			return 0, ErrExportMagic
+		}
+	}
+}
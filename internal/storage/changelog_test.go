@@ -0,0 +1,160 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// lastChange answers the position of the last change in the change log.
+func lastChange(t *testing.T) uint64 {
+	t.Helper()
+	var seq uint64
+	for {
+		cs, err := testDB.ReadChanges(seq, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) == 0 {
+			return seq
+		}
+		seq = cs[len(cs)-1].Seq
+	}
+}
+
+// record answers the value of the record having the given key, or
+// `nil`.
+func record(t *testing.T, key []byte) []byte {
+	t.Helper()
+	var v []byte
+	err := testDB.View(func(tx *Tx) error {
+		var err error
+		v, err = tx.Get("cl_ns", "cl_et", key)
+		if err == ErrKeyUnknown {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestChangeLog(t *testing.T) {
+	testDB.SetChangeLog(true)
+	t.Cleanup(func() { testDB.SetChangeLog(false) })
+
+	k1, k2, k3 := appendUint64(nil, 1), appendUint64(nil, 2), appendUint64(nil, 3)
+	base := lastChange(t)
+	err := testDB.Update(func(tx *Tx) error {
+		tx.Put("cl_ns", "cl_et", k1, []byte("a"))
+		tx.Put("cl_ns", "cl_et", k2, []byte("b"))
+		tx.Delete("cl_ns", "cl_et", k1)
+		tx.Delete("cl_ns", "cl_et", k3)
+		return tx.Put("_cl_ns", "cl_et", k1, []byte("reserved"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletions of absent records, and reserved namespaces, are not
+	// recorded.
+	cs, err := testDB.ReadChanges(base, 10)
+	if err != nil || len(cs) != 3 {
+		t.Fatalf("changes: %+v, %v", cs, err)
+	}
+	for i, kind := range []uint8{ChangePut, ChangePut, ChangeDelete} {
+		c := cs[i]
+		if c.Seq != base+uint64(i)+1 || c.Kind != kind || c.NS != "cl_ns" || c.ET != "cl_et" {
+			t.Errorf("change %d: %+v", i, c)
+		}
+	}
+	if v, err := openRecord(cs[1].Value); err != nil || string(v) != "b" || !bytes.Equal(cs[1].Key, k2) {
+		t.Errorf("stored value: %q, %v", v, err)
+	}
+	if cs, _ = testDB.ReadChanges(base+1, 1); len(cs) != 1 || cs[0].Seq != base+2 {
+		t.Errorf("changes after %d: %+v", base+1, cs)
+	}
+
+	// A snapshot restores the records, and becomes the cursor.
+	var buf bytes.Buffer
+	pos, err := testDB.WriteSnapshot(&buf)
+	if err != nil || pos != base+3 {
+		t.Fatalf("snapshot at %d: %v", pos, err)
+	}
+	testDB.Update(func(tx *Tx) error {
+		tx.Put("cl_ns", "cl_et", k2, []byte("c"))
+		return tx.Put("cl_ns", "cl_et", k3, []byte("d"))
+	})
+	later, _ := testDB.ReadChanges(pos, 10)
+	if len(later) != 2 {
+		t.Fatalf("later changes: %+v", later)
+	}
+	if n, err := testDB.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil || n != pos {
+		t.Fatalf("load: %d, %v", n, err)
+	}
+	if string(record(t, k2)) != "b" || record(t, k3) != nil || record(t, k1) != nil {
+		t.Errorf("loaded: %q, %q", record(t, k2), record(t, k3))
+	}
+	if cur, ok, err := testDB.ReplicaCursor(); cur != pos || !ok || err != nil {
+		t.Errorf("cursor: %d, %v, %v", cur, ok, err)
+	}
+
+	// Applied changes advance the cursor, and are not recorded.
+	if err := testDB.ApplyChanges(later); err != nil {
+		t.Fatal(err)
+	}
+	if string(record(t, k2)) != "c" || string(record(t, k3)) != "d" {
+		t.Errorf("applied: %q, %q", record(t, k2), record(t, k3))
+	}
+	if cur, _, _ := testDB.ReplicaCursor(); cur != pos+2 {
+		t.Errorf("cursor: %d", cur)
+	}
+	if seq := lastChange(t); seq != pos+2 {
+		t.Errorf("last change: %d", seq)
+	}
+
+	if n, err := testDB.TrimChanges(base + 2); err != nil || n != base+2 {
+		t.Errorf("trimmed %d: %v", n, err)
+	}
+	if _, err := testDB.ReadChanges(base, 10); err != ErrChangesTrimmed {
+		t.Errorf("read trimmed: %v", err)
+	}
+	if cs, err := testDB.ReadChanges(base+2, 10); err != nil || len(cs) != 3 {
+		t.Errorf("read after trimming: %+v, %v", cs, err)
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := testDB.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	by := buf.Bytes()
+
+	if _, err := testDB.LoadSnapshot(bytes.NewReader([]byte("FLGX"))); err != ErrExportMagic {
+		t.Errorf("magic: %v", err)
+	}
+	bad := append([]byte(nil), by...)
+	bad[len(snapshotMagic)] = snapshotVersion + 1
+	if _, err := testDB.LoadSnapshot(bytes.NewReader(bad)); err != ErrExportVersion {
+		t.Errorf("version: %v", err)
+	}
+	if _, err := testDB.LoadSnapshot(bytes.NewReader(by[:len(by)-1])); err != ErrExportTruncated {
+		t.Errorf("truncated: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// IndexEntry is an entry of an internal bucket of a namespace, that
+// refers to an entity.
+type IndexEntry struct {
+	Bucket string // name of the internal bucket
+	Key    []byte // key of the entry
+	Type   string // entity type of the entity referred to
+	ID     uint64 // ID of the entity referred to
+
+	// Entries of the reference index refer to the source entity of a
+	// reference; these identify its target and its field.
+	Target   string
+	TargetID uint64
+	Field    uint8
+}
+
+// indexBuckets lists the internal buckets of a namespace whose entries
+// refer to entities, that should exist.  Reference counts, revisions,
+// batch logs, audit logs and histories outlive their entities.
+var indexBuckets = []string{
+	dbtrashname, dbexpiryname, dbttlname, dblabelsname, dblblidxname,
+	dbschemaname, dbprovname, dbrefsname, dbidxname,
+}
+
+// IndexEntries calls the given function with every entry of the
+// internal buckets of the given namespace that refer to entities that
+// should exist: soft-deletion marks, expiry times, labels, schema
+// versions, provenance, references and secondary index entries.
+// Iteration stops when the function answers `false` or an error.
+// Malformed keys answer `ErrKeyInvalid`.  Keys are valid only until
+// the transaction ends.
+func (tx *Tx) IndexEntries(ns string, fn func(IndexEntry) (bool, error)) error {
+	for _, name := range indexBuckets {
+		b, err := nsBucket(tx.tx, ns, name, false)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			e, ok := parseIndexKey(name, k)
+			if !ok {
+				return ErrKeyInvalid
+			}
+			ok, err := fn(e)
+			if err != nil || !ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseIndexKey answers the entry having the given key in the given
+// internal bucket, and `true` if the key is well-formed.
+func parseIndexKey(bucket string, k []byte) (IndexEntry, bool) {
+	e := IndexEntry{Bucket: bucket, Key: k}
+	et, rest, ok := readShortString(k)
+	if !ok {
+		return e, false
+	}
+
+	switch bucket {
+	case dbttlname:
+		if len(rest) != 16 {
+			return e, false
+		}
+		rest = rest[8:]
+	case dblblidxname:
+		for i := 0; i < 2 && ok; i++ {
+			_, rest, ok = readShortString(rest)
+		}
+		if !ok {
+			return e, false
+		}
+	case dbidxname:
+		_, rest, ok = readShortString(rest)
+		if !ok || len(rest) < 8 {
+			return e, false
+		}
+		rest = rest[len(rest)-8:]
+	case dbrefsname:
+		if len(rest) < 8 {
+			return e, false
+		}
+		e.Target, e.TargetID = et, binary.BigEndian.Uint64(rest)
+		et, rest, ok = readShortString(rest[8:])
+		if !ok || len(rest) != 9 {
+			return e, false
+		}
+		e.Field = rest[8]
+		rest = rest[:8]
+	}
+	if len(rest) != 8 {
+		return e, false
+	}
+
+	e.Type, e.ID = et, binary.BigEndian.Uint64(rest)
+	return e, true
+}
+
+// DeleteIndexEntry removes the given entry from its internal bucket.
+// Entries of the reference index should be removed using `RemoveRef`
+// instead, so that the reference counts are maintained.
+func (tx *Tx) DeleteIndexEntry(ns string, e IndexEntry) error {
+	b, err := nsBucket(tx.tx, ns, e.Bucket, false)
+	if err != nil || b == nil {
+		return err
+	}
+	return b.Delete(e.Key)
+}
+
+// Exists answers `true` if the given entity type's bucket has a record
+// having the given key.  Its checksum is not verified.
+func (tx *Tx) Exists(ns, et string, key []byte) bool {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		return false
+	}
+	return b.Get(key) != nil
+}
+
+// Scan is like `ForEach`, but passes records failing their checksum
+// verification - or having malformed keys - to the given function,
+// together with the error, rather than stopping.
+func (tx *Tx) Scan(ns, et string, fn func(k, v []byte, err error) (bool, error)) error {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil
+		}
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil { // nested bucket
+			continue
+		}
+		var rerr error
+		if len(k) != 8 {
+			rerr = ErrKeyInvalid
+		} else {
+			v, rerr = openRecord(v)
+		}
+		ok, err := fn(k, v, rerr)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
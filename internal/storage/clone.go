@@ -0,0 +1,123 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/boltdb/bolt"
+)
+
+// Clone copies the database inside the base storage directory `src`
+// into the base storage directory `dst`, creating the latter if
+// necessary.  Both paths should be absolute paths.  An existing
+// database at the destination is replaced only if `overwrite` is
+// `true`.
+//
+// The copy is a consistent snapshot, written in a read transaction;
+// writers are not blocked meanwhile.  If `src` is the directory of the
+// open database, the snapshot is taken using it; otherwise, the
+// database there is opened for reading only, for the duration of the
+// copy.  The copy is written to a temporary file, which is renamed
+// into place once complete.
+//
+// BoltDB can not share pages between files; hence, the clone is always
+// a full copy.
+func Clone(src, dst string, overwrite bool) error {
+	if src == "" {
+		return ErrPathEmpty
+	}
+	if !path.IsAbs(src) {
+		return ErrPathNotAbsolute
+	}
+	src = path.Clean(src)
+	fn, err := destFile(src, dst, overwrite)
+	if err != nil {
+		return err
+	}
+
+	tmp := fn + ".clone"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = copyDB(src, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// copyDB writes a snapshot of the database inside the given base
+// storage directory to the given writer.
+func copyDB(src string, w io.Writer) error {
+	theDB.mu.RLock()
+	open := theDB.db != nil && src == path.Clean(storageDir)
+	if open {
+		err := theDB.db.View(func(tx *bolt.Tx) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+		theDB.mu.RUnlock()
+		if err != bolt.ErrDatabaseNotOpen {
+			return err
+		}
+	} else {
+		theDB.mu.RUnlock()
+	}
+
+	bdb, err := bolt.Open(path.Join(src, dbdir, dbname), 0600, &bolt.Options{ReadOnly: true, Timeout: readOnlyTimeout})
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// destFile prepares the base storage directory `dst` to receive a
+// copy of the database inside the base storage directory `src`,
+// answering the path of the database file there.
+func destFile(src, dst string, overwrite bool) (string, error) {
+	if dst == "" {
+		return "", ErrPathEmpty
+	}
+	if !path.IsAbs(dst) {
+		return "", ErrPathNotAbsolute
+	}
+	dst = path.Clean(dst)
+	if src == dst {
+		return "", ErrCloneSelf
+	}
+
+	dir := path.Join(dst, dbdir)
+	fn := path.Join(dir, dbname)
+	if _, err := os.Stat(fn); err == nil && !overwrite {
+		return "", ErrCloneExists
+	}
+	return fn, os.MkdirAll(dir, 0700)
+}
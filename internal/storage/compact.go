@@ -0,0 +1,216 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"os"
+	"path"
+
+	"github.com/boltdb/bolt"
+)
+
+// Maximum number of bytes of keys and values written per transaction
+// when compacting the database.
+const compactTxSize = 1 << 20
+
+// Compact copies all the buckets of the open database into a fresh
+// database file inside the base storage directory `dst`, creating the
+// latter if necessary.  The path should be an absolute path.  An
+// existing database at the destination is replaced only if
+// `overwrite` is `true`.
+//
+// Unlike `Clone`, which copies pages as they are, this writes every
+// key and value afresh, packing pages densely: the copy does not have
+// the free pages that deletions leave behind in the source.  Bucket
+// sequences are preserved.
+//
+// The source is read in a single read transaction; writers are not
+// blocked meanwhile, but their changes are not part of the copy.  The
+// copy is written to a temporary file, which is renamed into place
+// once complete.  If `progress` is not `nil`, it is called
+// periodically with the number of entries - keys and nested buckets -
+// copied, and the total.
+//
+// It answers the sizes of the source and the destination files.
+func (db *DB) Compact(dst string, overwrite bool, progress func(done, total uint64)) (int64, int64, error) {
+	fn, err := destFile(path.Clean(storageDir), dst, overwrite)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp := fn + ".compact"
+	os.Remove(tmp)
+	bdb, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	var before int64
+	err = view(func(tx *bolt.Tx) error {
+		before = tx.Size()
+		c := &compactor{dst: bdb, progress: progress}
+		return c.run(tx)
+	})
+	if cerr := bdb.Close(); err == nil {
+		err = cerr
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	return before, fi.Size(), os.Rename(tmp, fn)
+}
+
+// compactor copies the buckets of a database into another, committing
+// the destination's transaction whenever `compactTxSize` bytes have
+// been written in it.
+type compactor struct {
+	dst      *bolt.DB
+	tx       *bolt.Tx // current transaction in the destination
+	size     int      // bytes written in the current transaction
+	done     uint64
+	total    uint64
+	progress func(done, total uint64)
+}
+
+// run copies all the buckets of the given transaction.
+func (c *compactor) run(src *bolt.Tx) error {
+	err := src.ForEach(func(_ []byte, b *bolt.Bucket) error {
+		c.total += uint64(b.Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.tx, err = c.dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	err = src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return c.copyBucket(b, [][]byte{name})
+	})
+	if err != nil {
+		if c.tx != nil {
+			c.tx.Rollback()
+		}
+		return err
+	}
+	err = c.tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if c.progress != nil {
+		c.progress(c.done, c.total)
+	}
+	return nil
+}
+
+// copyBucket copies the given source bucket into the destination
+// bucket having the given path, creating the latter.
+func (c *compactor) copyBucket(src *bolt.Bucket, p [][]byte) error {
+	b, err := c.bucket(p, true)
+	if err != nil {
+		return err
+	}
+	err = b.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+
+	cur := src.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		if c.size+len(k)+len(v) > compactTxSize {
+			err = c.commit()
+			if err != nil {
+				return err
+			}
+			b, err = c.bucket(p, false)
+			if err != nil {
+				return err
+			}
+		}
+		c.size += len(k) + len(v)
+		c.done++
+		if c.progress != nil && c.done%compactProgressEvery == 0 {
+			c.progress(c.done, c.total)
+		}
+
+		if v == nil { // nested bucket
+			cp := append(append([][]byte(nil), p...), k)
+			err = c.copyBucket(src.Bucket(k), cp)
+			if err != nil {
+				return err
+			}
+			b, err = c.bucket(p, false)
+		} else {
+			err = b.Put(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Number of entries copied between progress reports of a compaction.
+const compactProgressEvery = 1024
+
+// bucket answers the destination bucket having the given path, in the
+// current transaction.  When `create` is `true`, its last element is
+// created.
+func (c *compactor) bucket(p [][]byte, create bool) (*bolt.Bucket, error) {
+	var b *bolt.Bucket
+	var err error
+	for i, name := range p {
+		last := create && i == len(p)-1
+		switch {
+		case i == 0 && last:
+			b, err = c.tx.CreateBucket(name)
+		case i == 0:
+			b = c.tx.Bucket(name)
+		case last:
+			b, err = b.CreateBucket(name)
+		default:
+			b = b.Bucket(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return nil, ErrBucketUnknown
+		}
+	}
+
+	b.FillPercent = 1.0
+	return b, nil
+}
+
+// commit commits the current transaction in the destination, and
+// begins another.
+func (c *compactor) commit() error {
+	err := c.tx.Commit()
+	if err != nil {
+		return err
+	}
+	c.tx, err = c.dst.Begin(true)
+	c.size = 0
+	return err
+}
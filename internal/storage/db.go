@@ -18,6 +18,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -37,6 +38,12 @@ const (
 
 	// System catalogue entity type definitions bucket name.
 	dbetdefsname = "etdefs"
+
+	// System space usage samples bucket name.
+	dbspacename = "space"
+
+	// System catalogue frozen entity types bucket name.
+	dbfrozenname = "frozen"
 )
 
 var (
@@ -56,11 +63,33 @@ var dberr error
 // Internally, each entity type has its own bucket per namespace in
 // which its instances have to be stored.
 type DB struct {
-	db *bolt.DB // handle to the underlying BoltDB database
+	db *bolt.DB     // handle to the underlying BoltDB database
+	mu sync.RWMutex // held exclusively while the handle is swapped
+
+	// syncMu guards the `NoSync` setting of the BoltDB handle.  It is
+	// held shared by writers, and exclusively by those that override
+	// the setting for their transactions.
+	syncMu sync.RWMutex
+
+	readOnly  bool          // opened for reading only?
+	changeLog bool          // recording changes in the change log?
+	fi        os.FileInfo   // identity of the open database file
+	stop      chan struct{} // closed to stop the file watcher, if any
+
+	shadow     string // overlay file opened in shadow mode, if any
+	shadowTemp bool   // overlay to be removed on closing?
 }
 
+// Time to wait for the lock on the database file, when opening it for
+// reading only.
+const readOnlyTimeout = 5 * time.Second
+
 // InitDB creates and initialises a database inside the given base
 // storage directory path.  This path should be an absolute path.
+//
+// The database is opened once per process.  Once it is open, calls to
+// `InitDB`, `InitReadOnly` and `InitShadow` change nothing; they
+// answer `ErrModeChange` unless they give the same path and mode.
 func InitDB(p string) error {
 	if p == "" {
 		return ErrPathEmpty
@@ -68,13 +97,76 @@ func InitDB(p string) error {
 	if !path.IsAbs(p) {
 		return ErrPathNotAbsolute
 	}
+	if open, err := openedAs(p, false, false, ""); open {
+		return err
+	}
 
 	storageDir = p
+	theDB.readOnly = false
+	theDB.shadow, theDB.shadowTemp = "", false
 	initDB()
 
 	return dberr
 }
 
+// InitReadOnly prepares to open the existing database inside the
+// given base storage directory path, for reading only.  This path
+// should be an absolute path.
+//
+// BoltDB locks the database file: it can not be opened for reading
+// while another process has it open for writing.  Read-only opening
+// is meant for database files that writers publish by atomically
+// renaming complete snapshots or compacted copies into place.  See
+// `Watch`.
+func InitReadOnly(p string) error {
+	if p == "" {
+		return ErrPathEmpty
+	}
+	if !path.IsAbs(p) {
+		return ErrPathNotAbsolute
+	}
+	if open, err := openedAs(p, true, false, ""); open {
+		return err
+	}
+
+	storageDir = p
+	theDB.readOnly = true
+	theDB.shadow, theDB.shadowTemp = "", false
+	_, dberr = os.Stat(dbPath())
+	return dberr
+}
+
+// openedAs answers `true` if the database has been opened already,
+// along with `ErrModeChange` unless it was opened inside the given
+// base storage directory path, for reading only if asked, and in
+// shadow mode, with the given overlay file, if asked; an empty overlay
+// path stands for a temporary file.
+func openedAs(p string, readOnly, shadow bool, overlay string) (bool, error) {
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+
+	if theDB.db == nil {
+		return false, nil
+	}
+	same := path.Clean(p) == path.Clean(storageDir) && theDB.readOnly == readOnly && (theDB.shadow != "") == shadow
+	if shadow {
+		same = same && theDB.shadowTemp == (overlay == "") && (overlay == "" || overlay == theDB.shadow)
+	}
+	if !same {
+		return true, ErrModeChange
+	}
+	return true, nil
+}
+
+// dbPath answers the path of the database file: that of the overlay,
+// in shadow mode.
+func dbPath() string {
+	if theDB.shadow != "" {
+		return theDB.shadow
+	}
+	return path.Join(storageDir, dbdir, dbname)
+}
+
 func initDB() {
 	dberr = nil
 
@@ -109,14 +201,26 @@ func initDB() {
 		if err != nil {
 			return err
 		}
+		_, err = sys.CreateBucketIfNotExists([]byte(dbspacename))
+		if err != nil {
+			return err
+		}
+		_, err = sys.CreateBucketIfNotExists([]byte(dbfrozenname))
+		if err != nil {
+			return err
+		}
 
 		return nil
 	})
 }
 
 // DbInstance opens the underlying BoltDB database, and answers the
-// singleton DB instance.
+// singleton DB instance.  It answers `ErrPathEmpty` unless the
+// database has been initialised using `InitDB` or `InitReadOnly`.
 func DbInstance() (*DB, error) {
+	if storageDir == "" {
+		return nil, ErrPathEmpty
+	}
 	onceDB.Do(instance)
 	if dberr != nil {
 		return nil, dberr
@@ -126,14 +230,163 @@ func DbInstance() (*DB, error) {
 }
 
 func instance() {
-	fn := path.Join(storageDir, dbdir, dbname)
-	theDB.db, dberr = bolt.Open(fn, 0600, nil)
-	if dberr != nil {
-		return
+	theDB.db, theDB.fi, dberr = openFile()
+}
+
+// openFile opens the database file, and answers its identity.
+func openFile() (*bolt.DB, os.FileInfo, error) {
+	var opts *bolt.Options
+	if theDB.readOnly {
+		opts = &bolt.Options{ReadOnly: true, Timeout: readOnlyTimeout}
+	}
+	bdb, err := bolt.Open(dbPath(), 0600, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := os.Stat(dbPath())
+	if err != nil {
+		bdb.Close()
+		return nil, nil, err
 	}
+	return bdb, fi, nil
 }
 
 // Close closes the underlying BoltDB database.
 func (db *DB) Close() error {
-	return theDB.db.Close()
+	theDB.mu.Lock()
+	defer theDB.mu.Unlock()
+
+	if theDB.stop != nil {
+		close(theDB.stop)
+		theDB.stop = nil
+	}
+	theDB.changeLog = false
+	if theDB.db.NoSync {
+		err := theDB.db.Sync()
+		if err != nil {
+			theDB.db.Close()
+			return err
+		}
+	}
+	err := theDB.db.Close()
+	if theDB.shadowTemp {
+		if rerr := os.Remove(theDB.shadow); err == nil {
+			err = rerr
+		}
+		theDB.shadowTemp = false
+	}
+	return err
+}
+
+// ReadOnly answers `true` if the database is opened for reading only.
+func (db *DB) ReadOnly() bool {
+	return theDB.readOnly
+}
+
+// Reopen checks whether the database file has been replaced since it
+// was opened - as happens when a writer swaps in a compacted copy or
+// a snapshot - and if so, reopens it.  Transactions in progress
+// complete against the old file; later ones use the new file.
+//
+// It answers `true` if the database was reopened.
+func (db *DB) Reopen() (bool, error) {
+	fi, err := os.Stat(dbPath())
+	if err != nil {
+		return false, err
+	}
+	theDB.mu.RLock()
+	same := os.SameFile(fi, theDB.fi)
+	theDB.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	bdb, fi, err := openFile()
+	if err != nil {
+		return false, err
+	}
+	theDB.mu.Lock()
+	old := theDB.db
+	theDB.db, theDB.fi = bdb, fi
+	theDB.mu.Unlock()
+
+	return true, old.Close()
+}
+
+// Watch starts checking for replacement of the database file at the
+// given interval, reopening it as needed.  Errors are retried at the
+// next check.  Watching stops when the database is closed.
+func (db *DB) Watch(interval time.Duration) {
+	theDB.mu.Lock()
+	defer theDB.mu.Unlock()
+
+	if theDB.stop != nil {
+		close(theDB.stop)
+	}
+	stop := make(chan struct{})
+	theDB.stop = stop
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				db.Reopen()
+			}
+		}
+	}()
+}
+
+// view executes the given function in a read-only BoltDB transaction.
+func view(fn func(*bolt.Tx) error) error {
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+
+	return theDB.db.View(fn)
+}
+
+// update executes the given function in a read-write BoltDB
+// transaction.
+func update(fn func(*bolt.Tx) error) error {
+	if theDB.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+	theDB.syncMu.RLock()
+	defer theDB.syncMu.RUnlock()
+
+	return theDB.db.Update(fn)
+}
+
+// entityBucket answers the data bucket of the given entity type in
+// the given namespace.  When `create` is `true`, the namespace and
+// entity type buckets are created if they do not exist already.
+// Creation requires a writable transaction.
+func entityBucket(tx *bolt.Tx, ns, et string, create bool) (*bolt.Bucket, error) {
+	if ns == "" || et == "" {
+		return nil, ErrNameEmpty
+	}
+
+	if create {
+		nsb, err := tx.CreateBucketIfNotExists([]byte(ns))
+		if err != nil {
+			return nil, err
+		}
+		return nsb.CreateBucketIfNotExists([]byte(et))
+	}
+
+	nsb := tx.Bucket([]byte(ns))
+	if nsb == nil {
+		return nil, ErrBucketUnknown
+	}
+	etb := nsb.Bucket([]byte(et))
+	if etb == nil {
+		return nil, ErrBucketUnknown
+	}
+	return etb, nil
 }
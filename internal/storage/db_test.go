@@ -0,0 +1,39 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"path"
+	"testing"
+)
+
+func TestInitOpened(t *testing.T) {
+	dir := storageDir
+	if err := InitDB(dir); err != nil {
+		t.Errorf("same mode: %v", err)
+	}
+	if err := InitReadOnly(dir); err != ErrModeChange {
+		t.Errorf("read-only: %v", err)
+	}
+	if err := InitShadow(dir, ""); err != ErrModeChange {
+		t.Errorf("shadow: %v", err)
+	}
+	if err := InitDB(path.Join(dir, "other")); err != ErrModeChange {
+		t.Errorf("other path: %v", err)
+	}
+	if storageDir != dir || testDB.ReadOnly() || testDB.Shadow() != "" {
+		t.Errorf("changed: %q, %v, %q", storageDir, testDB.ReadOnly(), testDB.Shadow())
+	}
+}
@@ -16,6 +16,48 @@ package storage
 
 import "errors"
 
+// Categories of errors.  Errors belonging to a category answer `true`
+// to `errors.Is` with it.
+var (
+	// ErrNotFound is the category of errors answered when a requested
+	// item does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is the category of errors answered when an
+	// operation conflicts with the current state of the database.
+	ErrConflict = errors.New("conflict")
+
+	// ErrCorrupt is the category of errors answered when stored or
+	// transferred data are damaged.
+	ErrCorrupt = errors.New("corrupt data")
+
+	// ErrReadOnly is the category of errors answered when an attempt
+	// is made to modify data that can only be read.
+	ErrReadOnly = errors.New("data is read-only")
+)
+
+// classError is an error belonging to a category of errors.
+type classError struct {
+	msg   string
+	class error
+}
+
+// NewError answers an error having the given message, belonging to
+// the given category.
+func NewError(msg string, class error) error {
+	return &classError{msg: msg, class: class}
+}
+
+// Error conforms to `error`.
+func (e *classError) Error() string {
+	return e.msg
+}
+
+// Is answers `true` if the given error is the category of this one.
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
 var (
 	// ErrPathEmpty is answered when a non-empty path was expected but
 	// an empty path was given.
@@ -24,10 +66,91 @@ var (
 	// ErrPathNotAbsolute is answered when an absolute path was
 	// expected but a relative path was given.
 	ErrPathNotAbsolute = errors.New("given path is not an absolute one")
+
+	// ErrModeChange is answered when the database is initialised
+	// again, once open, with another path or mode.  See `InitDB`.
+	ErrModeChange = errors.New("database is open in another mode")
+
+	// ErrDatabaseReadOnly is answered when an attempt is made to
+	// modify a database opened for reading only.
+	ErrDatabaseReadOnly = NewError("database is opened read-only", ErrReadOnly)
 )
 
 var (
 	// ErrNameEmpty is answered when an unexpected empty name is
 	// provided.
 	ErrNameEmpty = errors.New("empty name given")
+
+	// ErrBucketUnknown is answered when the bucket of the requested
+	// namespace or entity type does not exist in the database.
+	ErrBucketUnknown = NewError("unknown bucket requested", ErrNotFound)
+
+	// ErrKeyInvalid is answered when a key that is not a serialised
+	// entity key is encountered in an entity type's bucket.
+	ErrKeyInvalid = errors.New("invalid entity key")
+
+	// ErrKeyUnknown is answered when the requested key does not exist
+	// in an entity type's bucket.
+	ErrKeyUnknown = NewError("unknown key requested", ErrNotFound)
+
+	// ErrCorruptRecord is answered when a stored record fails its
+	// checksum verification.
+	ErrCorruptRecord = NewError("stored record is corrupt", ErrCorrupt)
+
+	// ErrTypeFrozen is answered when an attempt is made to modify the
+	// entities of a frozen entity type.
+	ErrTypeFrozen = NewError("entity type is frozen", ErrReadOnly)
+
+	// ErrTypeNotEmpty is answered when an attempt is made to drop an
+	// entity type that has records.
+	ErrTypeNotEmpty = NewError("entity type is not empty", ErrConflict)
+
+	// ErrTypeReferenced is answered when an attempt is made to
+	// truncate an entity type whose entities are referred to by those
+	// of other entity types.
+	ErrTypeReferenced = NewError("entity type is referred to by others", ErrConflict)
+
+	// ErrNamespaceNotEmpty is answered when an attempt is made to
+	// delete a namespace having records, without forcing it.
+	ErrNamespaceNotEmpty = NewError("namespace is not empty", ErrConflict)
+
+	// ErrBucketExists is answered when a bucket is to be created under
+	// a name that is taken already.
+	ErrBucketExists = NewError("bucket already exists", ErrConflict)
+)
+
+var (
+	// ErrExportMagic is answered when the stream being imported does
+	// not begin with the `flagon` export header.
+	ErrExportMagic = errors.New("not a flagon export stream")
+
+	// ErrExportVersion is answered when the stream being imported
+	// was written using an unsupported version of the export format.
+	ErrExportVersion = errors.New("unsupported export format version")
+
+	// ErrExportTruncated is answered when the stream being imported
+	// ends before its trailer is read.
+	ErrExportTruncated = NewError("export stream is truncated", ErrCorrupt)
+)
+
+var (
+	// ErrGroupCorrupt is answered when the recorded offset of a
+	// consumer group is malformed.
+	ErrGroupCorrupt = errors.New("corrupt consumer group offset")
+)
+
+var (
+	// ErrCloneExists is answered when a database is cloned into a
+	// storage directory that already holds one, without overwriting.
+	ErrCloneExists = NewError("destination already holds a database", ErrConflict)
+
+	// ErrCloneSelf is answered when a database is cloned into its own
+	// storage directory.
+	ErrCloneSelf = errors.New("source and destination are the same")
+)
+
+var (
+	// ErrChangesTrimmed is answered when changes are read from a
+	// position in the change log whose successors have been trimmed.
+	ErrChangesTrimmed = errors.New("changes have been trimmed from the change log")
 )
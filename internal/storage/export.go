@@ -0,0 +1,362 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// Export stream format, version 1.  All integers are big-endian.
+//
+//	header  : magic "FLGX" | version uint8 | namespace | entity type
+//	name    : length uint16 | UTF-8 bytes
+//	record  : tag uint8 (= 1) | key uint64 | length uint32 | value
+//	trailer : tag uint8 (= 0) | record count uint64
+//
+// Records appear in ascending key order.  Values are copied verbatim
+// from the entity type's bucket, including their checksums; hence,
+// the stream is independent of the machine and of the underlying
+// database file, but not of the entity serialisation format.
+const (
+	exportMagic   = "FLGX"
+	exportVersion = 1
+
+	exportTagEnd    = 0
+	exportTagRecord = 1
+)
+
+// Number of records committed per transaction during an import.
+const importChunk = 1024
+
+// Export writes all the entities of the given entity type in the
+// given namespace to the given writer, whose key is equal to or
+// greater than `startAt`.  Starting at the successor of the last key
+// of a previous export enables incremental exports.
+//
+// It answers the number of records written.
+func (db *DB) Export(ns, et string, startAt uint64, w io.Writer) (uint64, error) {
+	var ew *ExportWriter
+
+	err := view(func(tx *bolt.Tx) error {
+		b, err := entityBucket(tx, ns, et, false)
+		if err != nil {
+			return err
+		}
+
+		ew, err = NewExportWriter(w, ns, et)
+		if err != nil {
+			return err
+		}
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, startAt)
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if v == nil { // nested bucket
+				continue
+			}
+			err = ew.writeSealed(k, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return ew.Close()
+}
+
+// ExportWriter writes an export stream record by record, for records
+// that do not come verbatim from the database.  Its output can be
+// imported using `Import`.
+type ExportWriter struct {
+	bw *bufio.Writer
+	n  uint64
+}
+
+// NewExportWriter writes the header of an export stream for the given
+// namespace and entity type to the given writer, and answers a writer
+// for the stream's records.
+func NewExportWriter(w io.Writer, ns, et string) (*ExportWriter, error) {
+	bw := bufio.NewWriter(w)
+	err := writeExportHeader(bw, ns, et)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportWriter{bw: bw}, nil
+}
+
+// Write appends a record having the given key and value to the
+// stream.  The value is sealed with a checksum, as if it were stored.
+// Keys should be written in ascending order.
+func (ew *ExportWriter) Write(k, v []byte) error {
+	return ew.writeSealed(k, sealRecord(v))
+}
+
+// writeSealed appends a record whose value is already sealed.
+func (ew *ExportWriter) writeSealed(k, v []byte) error {
+	err := writeExportRecord(ew.bw, k, v)
+	if err != nil {
+		return err
+	}
+	ew.n++
+	return nil
+}
+
+// Close writes the trailer of the stream, and flushes it.  It answers
+// the number of records written.  Closing does not close the
+// underlying writer.
+func (ew *ExportWriter) Close() (uint64, error) {
+	err := ew.bw.WriteByte(exportTagEnd)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(ew.bw, binary.BigEndian, ew.n)
+	if err != nil {
+		return 0, err
+	}
+	return ew.n, ew.bw.Flush()
+}
+
+// Import reads an export stream from the given reader, and stores
+// its records in the namespace and entity type recorded in the
+// stream's header.  Existing entities having the same keys are
+// overwritten, and their revisions incremented.  Records are verified
+// against their checksums before they are stored.
+//
+// Records are committed in chunks.  Therefore, in case of an error,
+// a prefix of the stream may have been imported already.  Since
+// imports are idempotent, the same stream can be safely re-imported.
+//
+// When a stamp is given, it is recorded as the provenance of every
+// record imported; otherwise, the recorded provenance of the records
+// is removed.
+//
+// It answers the number of records read.
+func (db *DB) Import(r io.Reader, s *Stamp) (uint64, error) {
+	br := bufio.NewReader(r)
+	ns, et, err := readExportHeader(br)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	keys := make([][]byte, 0, importChunk)
+	vals := make([][]byte, 0, importChunk)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		err := update(func(tx *bolt.Tx) error {
+			if err := checkFrozen(tx, ns, et); err != nil {
+				return err
+			}
+			b, err := entityBucket(tx, ns, et, true)
+			if err != nil {
+				return err
+			}
+			var max uint64
+			for i := range keys {
+				id := binary.BigEndian.Uint64(keys[i])
+				var prior Prior
+				if s != nil {
+					prior, err = priorVersion(tx, b, ns, et, id, keys[i])
+					if err != nil {
+						return err
+					}
+				}
+
+				err = b.Put(keys[i], vals[i])
+				if err != nil {
+					return err
+				}
+				err = logChange(tx, Change{Kind: ChangePut, NS: ns, ET: et, Key: keys[i], Value: vals[i]})
+				if err != nil {
+					return err
+				}
+				rev, err := nextRevision(tx, ns, et, id)
+				if err != nil {
+					return err
+				}
+				if s != nil {
+					st := *s
+					st.Rev = rev
+					err = setProvenance(tx, ns, et, id, st, prior)
+				} else {
+					err = restoreProvenance(tx, ns, et, id, nil)
+				}
+				if err != nil {
+					return err
+				}
+				if id > max {
+					max = id
+				}
+			}
+
+			// Keep new IDs from colliding with imported ones.
+			if max > b.Sequence() {
+				return b.SetSequence(max)
+			}
+			return nil
+		})
+		keys, vals = keys[:0], vals[:0]
+		return err
+	}
+
+	for {
+		tag, err := br.ReadByte()
+		if err != nil {
+			return n, ErrExportTruncated
+		}
+
+		switch tag {
+		case exportTagRecord:
+			k, v, err := readExportRecord(br)
+			if err != nil {
+				return n, err
+			}
+			_, err = openRecord(v)
+			if err != nil {
+				return n, err
+			}
+			keys, vals = append(keys, k), append(vals, v)
+			n++
+			if len(keys) == importChunk {
+				err = flush()
+				if err != nil {
+					return n, err
+				}
+			}
+
+		case exportTagEnd:
+			var cnt uint64
+			err = binary.Read(br, binary.BigEndian, &cnt)
+			if err != nil {
+				return n, ErrExportTruncated
+			}
+			if cnt != n {
+				return n, ErrExportTruncated
+			}
+			return n, flush()
+
+		default:
+			return n, ErrExportMagic
+		}
+	}
+}
+
+// writeExportHeader writes the export stream header for the given
+// namespace and entity type.
+func writeExportHeader(w io.Writer, ns, et string) error {
+	var buf bytes.Buffer
+	buf.WriteString(exportMagic)
+	buf.WriteByte(exportVersion)
+	for _, s := range []string{ns, et} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readExportHeader validates the export stream header, and answers
+// the namespace and entity type recorded in it.
+func readExportHeader(r io.Reader) (string, string, error) {
+	hdr := make([]byte, len(exportMagic)+1)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return "", "", ErrExportMagic
+	}
+	if string(hdr[:len(exportMagic)]) != exportMagic {
+		return "", "", ErrExportMagic
+	}
+	if hdr[len(exportMagic)] != exportVersion {
+		return "", "", ErrExportVersion
+	}
+
+	names := make([]string, 2)
+	for i := range names {
+		var l uint16
+		err = binary.Read(r, binary.BigEndian, &l)
+		if err != nil {
+			return "", "", ErrExportTruncated
+		}
+		by := make([]byte, l)
+		_, err = io.ReadFull(r, by)
+		if err != nil {
+			return "", "", ErrExportTruncated
+		}
+		names[i] = string(by)
+	}
+	if names[0] == "" || names[1] == "" {
+		return "", "", ErrNameEmpty
+	}
+
+	return names[0], names[1], nil
+}
+
+// writeExportRecord writes a single (key, value) record.
+func writeExportRecord(w *bufio.Writer, k, v []byte) error {
+	if len(k) != 8 {
+		return ErrKeyInvalid
+	}
+
+	err := w.WriteByte(exportTagRecord)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(k)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, uint32(len(v)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(v)
+	return err
+}
+
+// readExportRecord reads a single (key, value) record, whose tag has
+// already been consumed.
+func readExportRecord(r io.Reader) ([]byte, []byte, error) {
+	k := make([]byte, 8)
+	_, err := io.ReadFull(r, k)
+	if err != nil {
+		return nil, nil, ErrExportTruncated
+	}
+
+	var l uint32
+	err = binary.Read(r, binary.BigEndian, &l)
+	if err != nil {
+		return nil, nil, ErrExportTruncated
+	}
+	v := make([]byte, l)
+	_, err = io.ReadFull(r, v)
+	if err != nil {
+		return nil, nil, ErrExportTruncated
+	}
+
+	return k, v, nil
+}
@@ -0,0 +1,85 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The system catalogue holds a bucket of the frozen entity types:
+//
+//	key   : namespace | entity type
+//	value : time int64
+//
+// Namespaces are prefixed by their length as `uint8`.  The time is
+// that at which the entity type was frozen.
+//
+// Storing, deleting, rewriting or importing the records of a frozen
+// entity type, or changing their trash marks or labels, answers
+// `ErrTypeFrozen`.
+
+// frozenKey answers the key of the given entity type in the bucket of
+// frozen entity types.
+func frozenKey(ns, et string) []byte {
+	return append(appendShortString(nil, ns), et...)
+}
+
+// SetFrozen freezes the given entity type at the given time, or thaws
+// it.  Freezing a frozen entity type retains its original time.
+func (tx *Tx) SetFrozen(ns, et string, frozen bool, now int64) error {
+	b, err := tx.tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbfrozenname))
+	if err != nil {
+		return err
+	}
+
+	k := frozenKey(ns, et)
+	if !frozen {
+		return b.Delete(k)
+	}
+	if b.Get(k) != nil {
+		return nil
+	}
+	return b.Put(k, appendUint64(nil, uint64(now)))
+}
+
+// Frozen answers the time at which the given entity type was frozen,
+// and `true`, if it is frozen.
+func (tx *Tx) Frozen(ns, et string) (int64, bool) {
+	return frozenAt(tx.tx, ns, et)
+}
+
+// frozenAt implements `Frozen`.
+func frozenAt(tx *bolt.Tx, ns, et string) (int64, bool) {
+	b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbfrozenname))
+	if b == nil {
+		return 0, false
+	}
+	v := b.Get(frozenKey(ns, et))
+	if len(v) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), true
+}
+
+// checkFrozen answers `ErrTypeFrozen` if the given entity type is
+// frozen.
+func checkFrozen(tx *bolt.Tx, ns, et string) error {
+	if _, ok := frozenAt(tx, ns, et); ok {
+		return ErrTypeFrozen
+	}
+	return nil
+}
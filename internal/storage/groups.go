@@ -0,0 +1,115 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The system catalogue holds a bucket of the offsets of consumer
+// groups:
+//
+//	key   : group name
+//	value : position acknowledged uint64, change log flag byte
+//
+// The flag is `1` for groups that read the change log; changes are not
+// trimmed from the change log past the least offset of those groups.
+// Offsets recorded without the flag are of groups that do not.
+const (
+	dbgroupsname = "groups"
+)
+
+// GroupOffset answers the position acknowledged by the given consumer
+// group, and `true` if the group exists.
+func (tx *Tx) GroupOffset(name string) (uint64, bool, error) {
+	b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbgroupsname))
+	if b == nil {
+		return 0, false, nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return 0, false, nil
+	}
+	pos, _, err := groupRecord(v)
+	return pos, err == nil, err
+}
+
+// PutGroupOffset records the given position as that acknowledged by
+// the given consumer group, creating the group if necessary.  Groups
+// that read the change log should say so, lest it be trimmed past
+// their positions.
+func (tx *Tx) PutGroupOffset(name string, pos uint64, changes bool) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+
+	b, err := tx.tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbgroupsname))
+	if err != nil {
+		return err
+	}
+	v := appendUint64(nil, pos)
+	if changes {
+		v = append(v, 1)
+	} else {
+		v = append(v, 0)
+	}
+	return b.Put([]byte(name), v)
+}
+
+// DeleteGroup removes the given consumer group, if it exists.
+func (tx *Tx) DeleteGroup(name string) error {
+	b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbgroupsname))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(name))
+}
+
+// groupRecord answers the position, and the change log flag, of the
+// given offset record.
+func groupRecord(v []byte) (uint64, bool, error) {
+	switch {
+	case len(v) == 8:
+		return binary.BigEndian.Uint64(v), false, nil
+	case len(v) == 9 && v[8] <= 1:
+		return binary.BigEndian.Uint64(v), v[8] == 1, nil
+	}
+	return 0, false, ErrGroupCorrupt
+}
+
+// groupsFloor answers the least offset of the consumer groups that
+// read the change log, and `true` if there are any.
+func groupsFloor(tx *bolt.Tx) (uint64, bool, error) {
+	b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbgroupsname))
+	if b == nil {
+		return 0, false, nil
+	}
+
+	var floor uint64
+	found := false
+	err := b.ForEach(func(_, v []byte) error {
+		pos, changes, err := groupRecord(v)
+		if err != nil || !changes {
+			return err
+		}
+		if !found || pos < floor {
+			floor, found = pos, true
+		}
+		return nil
+	})
+	return floor, found, err
+}
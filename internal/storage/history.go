@@ -0,0 +1,129 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold an append-only bucket of the
+// versions of those entities whose entity types retain history:
+//
+//	key   : entity type | ID uint64 | sequence uint64
+//	value : time int64 | revision uint64 | record
+//
+// Entity types are prefixed by their length as `uint8`.  The sequence
+// is that of the bucket; hence, the versions of an entity are in the
+// order in which they were written.  Deletions are recorded as
+// versions without records.
+const (
+	dbhistname = "_hist"
+)
+
+// HistoryRecord is a recorded version of an entity.
+type HistoryRecord struct {
+	Time   int64
+	Rev    uint64
+	Record []byte // stored form of the version; `nil` on deletion
+}
+
+// AppendHistory appends the given version to the history of the given
+// entity.
+func (tx *Tx) AppendHistory(ns, et string, id uint64, h HistoryRecord) error {
+	hb, err := nsBucket(tx.tx, ns, dbhistname, true)
+	if err != nil {
+		return err
+	}
+	seq, err := hb.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	v := appendUint64(nil, uint64(h.Time))
+	v = appendUint64(v, h.Rev)
+	v = append(v, h.Record...)
+	return hb.Put(appendUint64(entityRefKey(et, id), seq), v)
+}
+
+// History calls the given function with every recorded version of the
+// given entity, in the order in which they were written, until the
+// function answers `false` or an error.  Records are valid only until
+// the transaction ends.
+func (tx *Tx) History(ns, et string, id uint64, fn func(HistoryRecord) (bool, error)) error {
+	hb, err := nsBucket(tx.tx, ns, dbhistname, false)
+	if err != nil || hb == nil {
+		return err
+	}
+
+	prefix := entityRefKey(et, id)
+	c := hb.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 || len(v) < 16 {
+			return ErrKeyInvalid
+		}
+		h := HistoryRecord{
+			Time: int64(binary.BigEndian.Uint64(v)),
+			Rev:  binary.BigEndian.Uint64(v[8:16]),
+		}
+		if len(v) > 16 {
+			h.Record = v[16:]
+		}
+
+		ok, err := fn(h)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HistoryFrom calls the given function with every recorded version of
+// the entities of the given entity type, beginning with the entity
+// having the given ID, or the next one.  Versions are answered in the
+// ascending order of the IDs of their entities, and those of each
+// entity in the order in which they were written.  Iteration stops
+// when the function answers `false` or an error.  Records are valid
+// only until the transaction ends.
+func (tx *Tx) HistoryFrom(ns, et string, start uint64, fn func(uint64, HistoryRecord) (bool, error)) error {
+	hb, err := nsBucket(tx.tx, ns, dbhistname, false)
+	if err != nil || hb == nil {
+		return err
+	}
+
+	prefix := appendShortString(nil, et)
+	c := hb.Cursor()
+	for k, v := c.Seek(entityRefKey(et, start)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+16 || len(v) < 16 {
+			return ErrKeyInvalid
+		}
+		id := binary.BigEndian.Uint64(k[len(prefix):])
+		h := HistoryRecord{
+			Time: int64(binary.BigEndian.Uint64(v)),
+			Rev:  binary.BigEndian.Uint64(v[8:16]),
+		}
+		if len(v) > 16 {
+			h.Record = v[16:]
+		}
+
+		ok, err := fn(id, h)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
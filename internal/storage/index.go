@@ -0,0 +1,143 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold a bucket of the entries of the
+// secondary indexes of its entity types:
+//
+//	key   : entity type | index | value | ID uint64
+//	value : empty
+//
+// Entity types and indexes are prefixed by their lengths as `uint8`.
+// The value is the order-preserving encoding of the values of the
+// indexed fields, as answered by the caller; hence, the entries of an
+// index are in the order of their values, and then of their IDs.
+const (
+	dbidxname = "_idx"
+)
+
+// indexPrefix answers the prefix of the keys of the entries of the
+// given index.
+func indexPrefix(et, index string) []byte {
+	return appendShortString(appendShortString(nil, et), index)
+}
+
+// prefixEnd answers the least key greater than all those that begin
+// with the given prefix; `nil` if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// AddIndexEntry records the given value of the given entity in the
+// given index.
+func (tx *Tx) AddIndexEntry(ns, et, index string, value []byte, id uint64) error {
+	b, err := nsBucket(tx.tx, ns, dbidxname, true)
+	if err != nil {
+		return err
+	}
+	k := append(indexPrefix(et, index), value...)
+	return b.Put(appendUint64(k, id), []byte{})
+}
+
+// RemoveIndexEntry removes the given value of the given entity from
+// the given index.  Removing an unknown entry has no effect.
+func (tx *Tx) RemoveIndexEntry(ns, et, index string, value []byte, id uint64) error {
+	b, err := nsBucket(tx.tx, ns, dbidxname, false)
+	if err != nil || b == nil {
+		return err
+	}
+	k := append(indexPrefix(et, index), value...)
+	return b.Delete(appendUint64(k, id))
+}
+
+// ScanIndex calls the given function with the IDs of the entities in
+// the given index whose values are equal to or greater than `from`,
+// and less than `to`, in the order of their values.  A `nil` upper
+// bound is unbounded.  Iteration stops when the function answers
+// `false` or an error.
+func (tx *Tx) ScanIndex(ns, et, index string, from, to []byte, fn func(id uint64) (bool, error)) error {
+	b, err := nsBucket(tx.tx, ns, dbidxname, false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	prefix := indexPrefix(et, index)
+	c := b.Cursor()
+	for k, _ := c.Seek(append(prefix, from...)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) < len(prefix)+8 {
+			return ErrKeyInvalid
+		}
+		v := k[len(prefix) : len(k)-8]
+		if to != nil && bytes.Compare(v, to) >= 0 {
+			break
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(k)-8:]))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanIndexReverse calls the given function with the IDs of all the
+// entities in the given index, in the descending order of their
+// values.  Iteration stops when the function answers `false` or an
+// error.
+func (tx *Tx) ScanIndexReverse(ns, et, index string, fn func(id uint64) (bool, error)) error {
+	b, err := nsBucket(tx.tx, ns, dbidxname, false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	prefix := indexPrefix(et, index)
+	c := b.Cursor()
+	var k []byte
+	if end := prefixEnd(prefix); end != nil {
+		k, _ = c.Seek(end)
+	}
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+		if len(k) < len(prefix)+8 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(k)-8:]))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropIndexes removes all the entries of the indexes of the given
+// entity type.
+func (tx *Tx) DropIndexes(ns, et string) error {
+	return deletePrefix(tx.tx, ns, dbidxname, appendShortString(nil, et))
+}
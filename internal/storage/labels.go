@@ -0,0 +1,177 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Every namespace bucket may hold two buckets recording the labels of
+// entities:
+//
+//	_labels : entity type | ID uint64  ->  count uint8 | (key | value)...
+//	_lblidx : entity type | key | value | ID uint64  ->  empty
+//
+// Entity types, keys and values are prefixed by their lengths as
+// `uint8`.  Labels are stored in the ascending order of their keys.
+// The latter bucket indexes entities by their labels.
+const (
+	dblabelsname = "_labels"
+	dblblidxname = "_lblidx"
+)
+
+// labelIndexKey answers the key of the given label of the given entity
+// in the label index.
+func labelIndexKey(et, key, value string, id uint64) []byte {
+	by := appendShortString(nil, et)
+	by = appendShortString(by, key)
+	by = appendShortString(by, value)
+	return appendUint64(by, id)
+}
+
+// SetLabels replaces the labels of the given entity with the given
+// ones.  Keys and values should not be longer than 255 bytes, and
+// there should be at most 255 labels.  No labels removes them all.
+func (tx *Tx) SetLabels(ns, et string, id uint64, labels map[string]string) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	lb, err := nsBucket(tx.tx, ns, dblabelsname, len(labels) > 0)
+	if err != nil || lb == nil {
+		return err
+	}
+	ib, err := nsBucket(tx.tx, ns, dblblidxname, true)
+	if err != nil {
+		return err
+	}
+
+	key := entityRefKey(et, id)
+	old, ok := decodeLabels(lb.Get(key))
+	if !ok {
+		return ErrKeyInvalid
+	}
+	for k, v := range old {
+		err = ib.Delete(labelIndexKey(et, k, v, id))
+		if err != nil {
+			return err
+		}
+	}
+	if len(labels) == 0 {
+		return lb.Delete(key)
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	by := []byte{uint8(len(keys))}
+	for _, k := range keys {
+		by = appendShortString(by, k)
+		by = appendShortString(by, labels[k])
+		err = ib.Put(labelIndexKey(et, k, labels[k], id), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return lb.Put(key, by)
+}
+
+// Labels answers the labels of the given entity; `nil` if it has none.
+func (tx *Tx) Labels(ns, et string, id uint64) map[string]string {
+	lb, _ := nsBucket(tx.tx, ns, dblabelsname, false)
+	if lb == nil {
+		return nil
+	}
+	m, _ := decodeLabels(lb.Get(entityRefKey(et, id)))
+	return m
+}
+
+// decodeLabels decodes the given labels.  An empty slice decodes to
+// `nil`.
+func decodeLabels(by []byte) (map[string]string, bool) {
+	if len(by) == 0 {
+		return nil, true
+	}
+
+	n := int(by[0])
+	by = by[1:]
+	res := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		var k, v string
+		var ok bool
+		k, by, ok = readShortString(by)
+		if ok {
+			v, by, ok = readShortString(by)
+		}
+		if !ok {
+			return nil, false
+		}
+		res[k] = v
+	}
+	return res, len(by) == 0
+}
+
+// ForEachLabelled calls the given function with the ID of every entity
+// of the given entity type having the given label, in ascending order
+// of IDs, until the function answers `false` or an error.
+func (tx *Tx) ForEachLabelled(ns, et, key, value string, fn func(id uint64) (bool, error)) error {
+	ib, err := nsBucket(tx.tx, ns, dblblidxname, false)
+	if err != nil || ib == nil {
+		return err
+	}
+
+	prefix := appendShortString(appendShortString(appendShortString(nil, et), key), value)
+	c := ib.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) != len(prefix)+8 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(prefix):]))
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForEachLabel calls the given function with the ID and the label
+// value of every entity of the given entity type having a label with
+// the given key, in ascending order of values, and then of IDs, until
+// the function answers `false` or an error.
+func (tx *Tx) ForEachLabel(ns, et, key string, fn func(id uint64, value string) (bool, error)) error {
+	ib, err := nsBucket(tx.tx, ns, dblblidxname, false)
+	if err != nil || ib == nil {
+		return err
+	}
+
+	prefix := appendShortString(appendShortString(nil, et), key)
+	c := ib.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		v, rest, ok := readShortString(k[len(prefix):])
+		if !ok || len(rest) != 8 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(rest), v)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
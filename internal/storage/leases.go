@@ -0,0 +1,75 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// The system bucket may hold a bucket of leases:
+//
+//	key   : name
+//	value : token uint64 | expiry time int64 | holder
+//
+// The holder is a short string.  Released leases retain their records,
+// with an expiry time of `0`, so that their tokens keep increasing.
+const (
+	dbleasename = "leases"
+)
+
+// LeaseRecord records the latest acquisition of a lease.
+type LeaseRecord struct {
+	Token   uint64 // incremented by every acquisition
+	Expires int64  // `0` if released
+	Holder  string
+}
+
+// Lease answers the record of the given lease; its zero value if it
+// has never been acquired.
+func (tx *Tx) Lease(name string) (LeaseRecord, error) {
+	var r LeaseRecord
+	b := tx.tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbleasename))
+	if b == nil {
+		return r, nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return r, nil
+	}
+	if len(v) < 16 {
+		return r, ErrCorruptRecord
+	}
+	r.Token = binary.BigEndian.Uint64(v)
+	r.Expires = int64(binary.BigEndian.Uint64(v[8:]))
+	var rest []byte
+	var ok bool
+	r.Holder, rest, ok = readShortString(v[16:])
+	if !ok || len(rest) != 0 {
+		return r, ErrCorruptRecord
+	}
+	return r, nil
+}
+
+// PutLease stores the given record of the given lease.  The holder
+// should not be longer than 255 bytes.
+func (tx *Tx) PutLease(name string, r LeaseRecord) error {
+	b, err := tx.tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbleasename))
+	if err != nil {
+		return err
+	}
+	v := appendUint64(nil, r.Token)
+	v = appendUint64(v, uint64(r.Expires))
+	return b.Put([]byte(name), appendShortString(v, r.Holder))
+}
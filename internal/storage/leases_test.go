@@ -0,0 +1,76 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestLeaseRecord(t *testing.T) {
+	tests := []LeaseRecord{
+		{Token: 1, Expires: 1000, Holder: "w1"},
+		{Token: 1 << 50, Expires: -1, Holder: string(make([]byte, 255))},
+		{Token: 2},
+	}
+	for _, r := range tests {
+		err := testDB.Update(func(tx *Tx) error {
+			if err := tx.PutLease("lease_rec", r); err != nil {
+				return err
+			}
+			got, err := tx.Lease("lease_rec")
+			if err != nil {
+				return err
+			}
+			if got != r {
+				t.Errorf("read %+v, want %+v", got, r)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testDB.View(func(tx *Tx) error {
+		if r, err := tx.Lease("lease_unknown"); r != (LeaseRecord{}) || err != nil {
+			t.Errorf("unknown lease: %+v, %v", r, err)
+		}
+		return nil
+	})
+
+	good := appendShortString(appendUint64(appendUint64(nil, 1), 1000), "w1")
+	corrupt := map[string][]byte{
+		"short":     good[:15],
+		"truncated": good[:len(good)-1],
+		"trailing":  append(append([]byte(nil), good...), 0),
+	}
+	for name, v := range corrupt {
+		err := update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbleasename))
+			return b.Put([]byte("lease_rec"), v)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDB.View(func(tx *Tx) error {
+			if _, err := tx.Lease("lease_rec"); err != ErrCorruptRecord {
+				t.Errorf("%s: %v", name, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+)
+
+// DeleteNamespace removes the given namespace: the buckets of its
+// entity types and its internal buckets, together with its entry in
+// the catalogue of namespaces.  The deletions of the records are
+// recorded in the change log.
+//
+// Unless forced, it answers `ErrNamespaceNotEmpty` if any of its
+// entity types has records.  It answers `ErrTypeFrozen` if any of its
+// entity types is frozen, even if forced, and `ErrBucketUnknown` if
+// the namespace does not exist.
+func (db *DB) DeleteNamespace(ns string, force bool) error {
+	return update(func(tx *bolt.Tx) error {
+		nsb, err := namespaceBucket(tx, ns)
+		if err != nil {
+			return err
+		}
+		if fb := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbfrozenname)); fb != nil {
+			prefix := appendShortString(nil, ns)
+			if k, _ := fb.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+				return ErrTypeFrozen
+			}
+		}
+		if !force {
+			err = checkEmpty(nsb)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = forEachRecord(nsb, func(et, k, _ []byte) error {
+			return logChange(tx, Change{Kind: ChangeDelete, NS: ns, ET: string(et), Key: k})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbnsdefsname)).Delete([]byte(ns))
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(ns))
+	})
+}
+
+// RenameNamespace gives the given namespace a new name, in a single
+// transaction: its buckets are copied - retaining their sequences -
+// and the entries of the catalogues that refer to it are rewritten.
+// The renamed records are recorded in the change log as deletions
+// from the old namespace, followed by puts in the new one.
+//
+// It answers `ErrBucketUnknown` if the namespace does not exist, and
+// `ErrBucketExists` if the new name is taken.
+func (db *DB) RenameNamespace(from, to string) error {
+	if to == "" {
+		return ErrNameEmpty
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		src, err := namespaceBucket(tx, from)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(to)) != nil {
+			return ErrBucketExists
+		}
+		dst, err := tx.CreateBucket([]byte(to))
+		if err != nil {
+			return err
+		}
+		err = copyBuckets(dst, src)
+		if err != nil {
+			return err
+		}
+
+		err = forEachRecord(src, func(et, k, v []byte) error {
+			err := logChange(tx, Change{Kind: ChangeDelete, NS: from, ET: string(et), Key: k})
+			if err != nil {
+				return err
+			}
+			return logChange(tx, Change{Kind: ChangePut, NS: to, ET: string(et), Key: k, Value: v})
+		})
+		if err != nil {
+			return err
+		}
+
+		sys := tx.Bucket([]byte(dbsysname))
+		nb := sys.Bucket([]byte(dbnsdefsname))
+		if v := nb.Get([]byte(from)); v != nil {
+			err = nb.Put([]byte(to), append([]byte(nil), v...))
+			if err == nil {
+				err = nb.Delete([]byte(from))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if fb := sys.Bucket([]byte(dbfrozenname)); fb != nil {
+			err = renamePrefix(fb, appendShortString(nil, from), appendShortString(nil, to))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket([]byte(from))
+	})
+}
+
+// namespaceBucket answers the bucket of the given namespace, which
+// should not be a reserved one.
+func namespaceBucket(tx *bolt.Tx, ns string) (*bolt.Bucket, error) {
+	if ns == "" {
+		return nil, ErrNameEmpty
+	}
+	if ns == dbsysname || ns[0] == '_' {
+		return nil, ErrBucketUnknown
+	}
+	nsb := tx.Bucket([]byte(ns))
+	if nsb == nil {
+		return nil, ErrBucketUnknown
+	}
+	return nsb, nil
+}
+
+// checkEmpty answers `ErrNamespaceNotEmpty` if any entity type of the
+// given namespace bucket has records.
+func checkEmpty(nsb *bolt.Bucket) error {
+	return forEachRecord(nsb, func(_, _, _ []byte) error {
+		return ErrNamespaceNotEmpty
+	})
+}
+
+// forEachRecord calls the given function with every record of every
+// entity type of the given namespace bucket, as stored.
+func forEachRecord(nsb *bolt.Bucket, fn func(et, k, v []byte) error) error {
+	return nsb.ForEach(func(et, v []byte) error {
+		if v != nil || et[0] == '_' {
+			return nil
+		}
+		return nsb.Bucket(et).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			return fn(et, k, v)
+		})
+	})
+}
+
+// copyBuckets copies the keys and the nested buckets of the given
+// source bucket into the given destination bucket, retaining the
+// sequences of the nested buckets.
+func copyBuckets(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		sb := src.Bucket(k)
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		err = nb.SetSequence(sb.Sequence())
+		if err != nil {
+			return err
+		}
+		return copyBuckets(nb, sb)
+	})
+}
+
+// renamePrefix replaces the given prefix of the keys of the given
+// bucket that begin with it, with the given replacement.
+func renamePrefix(b *bolt.Bucket, prefix, repl []byte) error {
+	var keys, vals [][]byte
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+		vals = append(vals, append([]byte(nil), v...))
+	}
+
+	for i, k := range keys {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+		err = b.Put(append(append([]byte(nil), repl...), k[len(prefix):]...), vals[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
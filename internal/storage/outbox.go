@@ -0,0 +1,187 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// The system bucket may hold a bucket of outbox records, written in
+// the transactions of the modifications that they describe, and
+// removed when acknowledged by their consumers:
+//
+//	key   : sequence uint64
+//	value : time int64 | operation uint8 | ID uint64 | revision uint64 |
+//	        namespace | entity type | topic | key | payload
+//
+// The namespace, the entity type, the topic and the key are short
+// strings.
+const (
+	dboutboxname = "outbox"
+)
+
+// OutboxRecord is a message in the outbox, describing a modification
+// of an entity.
+type OutboxRecord struct {
+	Seq     uint64 // position in the outbox; assigned when appended
+	Time    int64
+	Op      uint8
+	NS      string
+	ET      string
+	ID      uint64
+	Rev     uint64 // revision of the entity after the modification
+	Topic   string
+	Key     []byte
+	Payload []byte
+}
+
+// encode answers the serialised form of this record.
+func (r OutboxRecord) encode() []byte {
+	by := make([]byte, 0, 29+4+len(r.NS)+len(r.ET)+len(r.Topic)+len(r.Key)+len(r.Payload))
+	by = appendUint64(by, uint64(r.Time))
+	by = append(by, r.Op)
+	by = appendUint64(by, r.ID)
+	by = appendUint64(by, r.Rev)
+	by = appendShortString(by, r.NS)
+	by = appendShortString(by, r.ET)
+	by = appendShortString(by, r.Topic)
+	by = appendShortString(by, string(r.Key))
+	return append(by, r.Payload...)
+}
+
+// decodeOutboxRecord reads a record serialised by `encode`.
+func decodeOutboxRecord(seq uint64, by []byte) (OutboxRecord, error) {
+	r := OutboxRecord{Seq: seq}
+	if len(by) < 25 {
+		return r, ErrCorruptRecord
+	}
+	r.Time = int64(binary.BigEndian.Uint64(by))
+	r.Op = by[8]
+	r.ID = binary.BigEndian.Uint64(by[9:])
+	r.Rev = binary.BigEndian.Uint64(by[17:])
+	var key string
+	var ok1, ok2, ok3, ok4 bool
+	r.NS, by, ok1 = readShortString(by[25:])
+	r.ET, by, ok2 = readShortString(by)
+	r.Topic, by, ok3 = readShortString(by)
+	key, by, ok4 = readShortString(by)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return r, ErrCorruptRecord
+	}
+	if key != "" {
+		r.Key = []byte(key)
+	}
+	r.Payload = append([]byte(nil), by...)
+	return r, nil
+}
+
+// AppendOutbox appends the given record to the outbox, and answers its
+// position.  Its namespace, entity type, topic and key should not be
+// longer than 255 bytes each.
+func (tx *Tx) AppendOutbox(r OutboxRecord) (uint64, error) {
+	b, err := tx.tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dboutboxname))
+	if err != nil {
+		return 0, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	tx.OnCommit(signalOutbox)
+	return seq, b.Put(appendUint64(nil, seq), r.encode())
+}
+
+// ReadOutbox answers up to `max` records following the given position
+// in the outbox, in order.  Acknowledged records are not answered.
+func (db *DB) ReadOutbox(after uint64, max int) ([]OutboxRecord, error) {
+	var res []OutboxRecord
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dboutboxname))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(appendUint64(nil, after+1)); k != nil && len(res) < max; k, v = c.Next() {
+			r, err := decodeOutboxRecord(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			res = append(res, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// AckOutbox removes the records at the given positions from the
+// outbox.  Positions that are not in it are ignored.  It answers the
+// number of records removed.
+func (db *DB) AckOutbox(seqs []uint64) (int, error) {
+	var n int
+	err := update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dboutboxname))
+		if b == nil {
+			return nil
+		}
+
+		for _, seq := range seqs {
+			k := appendUint64(nil, seq)
+			if b.Get(k) == nil {
+				continue
+			}
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// outboxAppended is closed, and replaced, whenever records are
+// committed to the outbox.
+var outboxAppended = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// signalOutbox wakes those waiting for records to be appended to the
+// outbox.
+func signalOutbox() {
+	outboxAppended.Lock()
+	defer outboxAppended.Unlock()
+
+	close(outboxAppended.ch)
+	outboxAppended.ch = make(chan struct{})
+}
+
+// OutboxAppended answers a channel that is closed once records are
+// committed to the outbox, following those committed so far.
+func (db *DB) OutboxAppended() <-chan struct{} {
+	outboxAppended.Lock()
+	defer outboxAppended.Unlock()
+
+	return outboxAppended.ch
+}
@@ -0,0 +1,326 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// Stamp records the origin of an entity written by an import or a
+// synchronisation: the system it came from, the batch that wrote it,
+// and when.  Times are in nanoseconds since the epoch.
+type Stamp struct {
+	Source string
+	Batch  string
+	Time   int64
+	Rev    uint64 // revision of the entity written by the batch
+}
+
+// Prior describes the version of an entity that a batch replaced.
+type Prior struct {
+	// Known is `false` for batch log entries that do not record their
+	// prior versions.
+	Known bool
+	// Record is the replaced record; `nil` if the entity did not
+	// exist.
+	Record []byte
+	// Stamp is the provenance of the replaced record, if any.
+	Stamp *Stamp
+}
+
+// BatchEntry is an entry in the batch log.
+type BatchEntry struct {
+	Type  string // entity type
+	ID    uint64 // entity ID
+	Stamp Stamp  // provenance of the revision written by the batch
+	Prior Prior  // version replaced by the revision
+}
+
+// Every namespace bucket may hold two buckets of provenance records.
+//
+// The provenance bucket holds the stamp of every entity whose current
+// revision was written by a batch:
+//
+//	key   : entity type | ID uint64   (as in the reference buckets)
+//	value : stamp
+//	stamp : revision uint64 | time int64 | batch | source
+//
+// The batch log has a key per entity revision written by a batch, and
+// is retained when the entities are modified or deleted later.  It
+// records the versions replaced by the batches, so that they can be
+// restored:
+//
+//	key   : batch | entity type | ID uint64 | revision uint64
+//	value : time int64 | source | flags uint8 | [prior stamp] | [prior record]
+//
+// Bit 0 of the flags is set if the entity existed, in which case the
+// prior record follows; bit 1 is set if it had a provenance, in which
+// case the prior stamp is present.  Entries not having the flags do
+// not record the prior versions.
+//
+// Batch IDs and sources are prefixed by their lengths, as `uint8`.
+// Hence, the entries of a batch are contiguous.
+const (
+	dbprovname  = "_prov"
+	dbbatchname = "_batch"
+
+	priorExists = 1 << 0
+	priorStamp  = 1 << 1
+)
+
+// SetProvenance records the given stamp as the provenance of the given
+// entity, and logs it against its batch together with the version that
+// it replaced.
+func (tx *Tx) SetProvenance(ns, et string, id uint64, s Stamp, prior Prior) error {
+	return setProvenance(tx.tx, ns, et, id, s, prior)
+}
+
+// setProvenance implements `SetProvenance`.
+func setProvenance(tx *bolt.Tx, ns, et string, id uint64, s Stamp, prior Prior) error {
+	if !validStamp(s) || prior.Stamp != nil && !validStamp(*prior.Stamp) {
+		return ErrKeyInvalid
+	}
+	err := restoreProvenance(tx, ns, et, id, &s)
+	if err != nil {
+		return err
+	}
+	bb, err := nsBucket(tx, ns, dbbatchname, true)
+	if err != nil {
+		return err
+	}
+
+	k := appendShortString(nil, s.Batch)
+	k = append(k, entityRefKey(et, id)...)
+	k = appendUint64(k, s.Rev)
+
+	v := appendUint64(nil, uint64(s.Time))
+	v = appendShortString(v, s.Source)
+	var flags uint8
+	if prior.Record != nil {
+		flags |= priorExists
+	}
+	if prior.Stamp != nil {
+		flags |= priorStamp
+	}
+	v = append(v, flags)
+	if prior.Stamp != nil {
+		v = appendStamp(v, *prior.Stamp)
+	}
+	v = append(v, prior.Record...)
+	return bb.Put(k, v)
+}
+
+// PriorVersion answers the current version of the given entity, to
+// be recorded by `SetProvenance` when it is replaced.
+func (tx *Tx) PriorVersion(ns, et string, id uint64) (Prior, error) {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return Prior{Known: true}, nil
+		}
+		return Prior{}, err
+	}
+	return priorVersion(tx.tx, b, ns, et, id, appendUint64(nil, id))
+}
+
+// priorVersion answers the current version of the entity having the
+// given ID and key in the given bucket, before it is replaced.
+func priorVersion(tx *bolt.Tx, b *bolt.Bucket, ns, et string, id uint64, key []byte) (Prior, error) {
+	p := Prior{Known: true}
+	if v := b.Get(key); v != nil {
+		rec, err := openRecord(v)
+		if err != nil {
+			return Prior{}, err
+		}
+		p.Record = append([]byte{}, rec...)
+	}
+	if s, ok := provenance(tx, ns, et, id); ok {
+		p.Stamp = &s
+	}
+	return p, nil
+}
+
+// RestoreProvenance sets the recorded provenance of the given entity
+// to the given stamp, without logging it against its batch; a `nil`
+// stamp removes it.
+func (tx *Tx) RestoreProvenance(ns, et string, id uint64, s *Stamp) error {
+	return restoreProvenance(tx.tx, ns, et, id, s)
+}
+
+// restoreProvenance implements `RestoreProvenance`.
+func restoreProvenance(tx *bolt.Tx, ns, et string, id uint64, s *Stamp) error {
+	pb, err := nsBucket(tx, ns, dbprovname, s != nil)
+	if err != nil || pb == nil {
+		return err
+	}
+	if s == nil {
+		return pb.Delete(entityRefKey(et, id))
+	}
+	return pb.Put(entityRefKey(et, id), appendStamp(nil, *s))
+}
+
+// ClearProvenance removes the recorded provenance of the given entity,
+// if any.  Its entries in the batch log are retained.
+func (tx *Tx) ClearProvenance(ns, et string, id uint64) error {
+	return restoreProvenance(tx.tx, ns, et, id, nil)
+}
+
+// Provenance answers the recorded provenance of the given entity, and
+// `true` if one is recorded.
+func (tx *Tx) Provenance(ns, et string, id uint64) (Stamp, bool) {
+	return provenance(tx.tx, ns, et, id)
+}
+
+// provenance implements `Provenance`.
+func provenance(tx *bolt.Tx, ns, et string, id uint64) (Stamp, bool) {
+	pb, _ := nsBucket(tx, ns, dbprovname, false)
+	if pb == nil {
+		return Stamp{}, false
+	}
+	s, _, ok := readStamp(pb.Get(entityRefKey(et, id)))
+	return s, ok
+}
+
+// BatchEntries calls the given function with every entry in the batch
+// log, in key order, until the function answers `false` or an error.
+// Only the entries of the given batch are visited, unless it is empty.
+// The entries remain valid after the transaction ends.
+func (tx *Tx) BatchEntries(ns, batch string, fn func(BatchEntry) (bool, error)) error {
+	bb, err := nsBucket(tx.tx, ns, dbbatchname, false)
+	if err != nil || bb == nil {
+		return err
+	}
+
+	var prefix []byte
+	if batch != "" {
+		prefix = appendShortString(nil, batch)
+	}
+	c := bb.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		e, ok := decodeBatchEntry(k, v)
+		if !ok {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(e)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeBatchEntry decodes the given batch log entry.
+func decodeBatchEntry(k, v []byte) (BatchEntry, bool) {
+	var e BatchEntry
+	var ok bool
+	e.Stamp.Batch, k, ok = readShortString(k)
+	if !ok {
+		return e, false
+	}
+	e.Type, k, ok = readShortString(k)
+	if !ok || len(k) != 16 || len(v) < 8 {
+		return e, false
+	}
+	e.ID = binary.BigEndian.Uint64(k)
+	e.Stamp.Rev = binary.BigEndian.Uint64(k[8:])
+
+	e.Stamp.Time = int64(binary.BigEndian.Uint64(v))
+	e.Stamp.Source, v, ok = readShortString(v[8:])
+	if !ok {
+		return e, false
+	}
+	if len(v) == 0 {
+		return e, true
+	}
+
+	flags := v[0]
+	v = v[1:]
+	e.Prior.Known = true
+	if flags&priorStamp != 0 {
+		var s Stamp
+		s, v, ok = readStamp(v)
+		if !ok {
+			return e, false
+		}
+		e.Prior.Stamp = &s
+	}
+	if flags&priorExists != 0 {
+		e.Prior.Record = append([]byte{}, v...)
+	}
+	return e, true
+}
+
+// validStamp answers `true` if the given stamp can be recorded.
+func validStamp(s Stamp) bool {
+	return s.Batch != "" && len(s.Batch) <= 255 && len(s.Source) <= 255
+}
+
+// appendStamp appends the serialised form of the given stamp to the
+// given slice.
+func appendStamp(by []byte, s Stamp) []byte {
+	by = appendUint64(by, s.Rev)
+	by = appendUint64(by, uint64(s.Time))
+	by = appendShortString(by, s.Batch)
+	return appendShortString(by, s.Source)
+}
+
+// readStamp reads a stamp written by `appendStamp`, and answers it
+// together with the remaining bytes.
+func readStamp(by []byte) (Stamp, []byte, bool) {
+	if len(by) < 16 {
+		return Stamp{}, nil, false
+	}
+	s := Stamp{Rev: binary.BigEndian.Uint64(by), Time: int64(binary.BigEndian.Uint64(by[8:]))}
+	var ok bool
+	s.Batch, by, ok = readShortString(by[16:])
+	if !ok {
+		return Stamp{}, nil, false
+	}
+	s.Source, by, ok = readShortString(by)
+	if !ok {
+		return Stamp{}, nil, false
+	}
+	return s, by, true
+}
+
+// appendUint64 appends the given integer, in big-endian order, to the
+// given slice.
+func appendUint64(by []byte, n uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	return append(by, b[:]...)
+}
+
+// appendShortString appends the given string, prefixed by its length
+// as `uint8`, to the given slice.  The string should not be longer
+// than 255 bytes.
+func appendShortString(by []byte, s string) []byte {
+	by = append(by, uint8(len(s)))
+	return append(by, s...)
+}
+
+// readShortString reads a string written by `appendShortString`, and
+// answers it together with the remaining bytes.
+func readShortString(by []byte) (string, []byte, bool) {
+	if len(by) < 1 || len(by) < 1+int(by[0]) {
+		return "", nil, false
+	}
+	l := int(by[0])
+	return string(by[1 : 1+l]), by[1+l:], true
+}
@@ -0,0 +1,316 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every namespace bucket may hold a bucket of the messages of its
+// queues:
+//
+//	message     : queue | 'm' | ID uint64                      -> record
+//	visibility  : queue | 'v' | visibility time int64 | ID uint64 -> empty
+//	dead letter : queue | 'd' | ID uint64                      -> record
+//	record      : attempts uint32 | enqueue time int64 | visibility time int64 | payload
+//
+// Queues are prefixed by their lengths as `uint8`.  IDs are those of
+// the sequence of the bucket, and hence are unique in the namespace.
+// The visibility time of a dead letter is the time at which it was
+// set aside.
+const (
+	dbqueuename = "_queue"
+)
+
+// Kinds of queue keys.
+const (
+	queueMessage    = 'm'
+	queueVisibility = 'v'
+	queueDead       = 'd'
+)
+
+// QueueRecord is a message of a queue.
+type QueueRecord struct {
+	ID       uint64
+	Attempts uint32 // number of times it has been dequeued
+	Enqueued int64
+	Visible  int64 // time from which it can be dequeued
+	Payload  []byte
+}
+
+// queueKey answers the key of the given kind of the message having the
+// given ID, of the given queue.
+func queueKey(q string, kind byte, id uint64) []byte {
+	return appendUint64(append(appendShortString(nil, q), kind), id)
+}
+
+// visibilityKey answers the key of the given message in the visibility
+// index of the given queue.
+func visibilityKey(q string, r QueueRecord) []byte {
+	by := append(appendShortString(nil, q), queueVisibility)
+	return appendUint64(appendUint64(by, uint64(r.Visible)), r.ID)
+}
+
+// encode answers the stored form of this record.
+func (r QueueRecord) encode() []byte {
+	by := make([]byte, 4, 20+len(r.Payload))
+	binary.BigEndian.PutUint32(by, r.Attempts)
+	by = appendUint64(by, uint64(r.Enqueued))
+	by = appendUint64(by, uint64(r.Visible))
+	return append(by, r.Payload...)
+}
+
+// decodeQueueRecord reads a record stored by `encode`.
+func decodeQueueRecord(id uint64, by []byte) (QueueRecord, error) {
+	if len(by) < 20 {
+		return QueueRecord{}, ErrCorruptRecord
+	}
+	return QueueRecord{
+		ID:       id,
+		Attempts: binary.BigEndian.Uint32(by),
+		Enqueued: int64(binary.BigEndian.Uint64(by[4:])),
+		Visible:  int64(binary.BigEndian.Uint64(by[12:])),
+		Payload:  append([]byte(nil), by[20:]...),
+	}, nil
+}
+
+// putQueueRecord stores the given message of the given queue, and its
+// visibility.
+func (tx *Tx) putQueueRecord(b *bolt.Bucket, q string, r QueueRecord) error {
+	err := b.Put(queueKey(q, queueMessage, r.ID), r.encode())
+	if err == nil {
+		err = b.Put(visibilityKey(q, r), nil)
+	}
+	tx.OnCommit(signalQueues)
+	return err
+}
+
+// Enqueue appends the given message, whose ID is assigned, to the
+// given queue, and answers its ID.
+func (tx *Tx) Enqueue(ns, q string, r QueueRecord) (uint64, error) {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, true)
+	if err != nil {
+		return 0, err
+	}
+	r.ID, err = b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return r.ID, tx.putQueueRecord(b, q, r)
+}
+
+// ReadyMessage answers the message of the given queue that has been
+// visible for the longest time, as of the given time; one whose ID is
+// `0` if none is visible.  In that case, it also answers the earliest
+// time at which one becomes visible; `0` if the queue is empty.
+func (tx *Tx) ReadyMessage(ns, q string, now int64) (QueueRecord, int64, error) {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, false)
+	if err != nil || b == nil {
+		return QueueRecord{}, 0, err
+	}
+
+	prefix := append(appendShortString(nil, q), queueVisibility)
+	k, _ := b.Cursor().Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return QueueRecord{}, 0, nil
+	}
+	if len(k) != len(prefix)+16 {
+		return QueueRecord{}, 0, ErrKeyInvalid
+	}
+	visible := int64(binary.BigEndian.Uint64(k[len(prefix):]))
+	if visible > now {
+		return QueueRecord{}, visible, nil
+	}
+	r, err := tx.QueueMessage(ns, q, binary.BigEndian.Uint64(k[len(prefix)+8:]))
+	return r, 0, err
+}
+
+// QueueMessage answers the message of the given queue having the given
+// ID.  It answers `ErrKeyUnknown` if the queue does not hold it.
+func (tx *Tx) QueueMessage(ns, q string, id uint64) (QueueRecord, error) {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, false)
+	if err != nil {
+		return QueueRecord{}, err
+	}
+	var v []byte
+	if b != nil {
+		v = b.Get(queueKey(q, queueMessage, id))
+	}
+	if v == nil {
+		return QueueRecord{}, ErrKeyUnknown
+	}
+	return decodeQueueRecord(id, v)
+}
+
+// UpdateQueueMessage replaces the given message of the given queue by
+// the given modified one, having the same ID.
+func (tx *Tx) UpdateQueueMessage(ns, q string, old, cur QueueRecord) error {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, true)
+	if err != nil {
+		return err
+	}
+	err = b.Delete(visibilityKey(q, old))
+	if err != nil {
+		return err
+	}
+	return tx.putQueueRecord(b, q, cur)
+}
+
+// removeQueueRecord removes the given message from the given queue.
+func removeQueueRecord(b *bolt.Bucket, q string, r QueueRecord) error {
+	err := b.Delete(visibilityKey(q, r))
+	if err != nil {
+		return err
+	}
+	return b.Delete(queueKey(q, queueMessage, r.ID))
+}
+
+// RemoveQueueMessage removes the given message from the given queue.
+func (tx *Tx) RemoveQueueMessage(ns, q string, r QueueRecord) error {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, true)
+	if err != nil {
+		return err
+	}
+	return removeQueueRecord(b, q, r)
+}
+
+// DeadLetter moves the given message of the given queue to its dead
+// letters, recording the given time.
+func (tx *Tx) DeadLetter(ns, q string, r QueueRecord, now int64) error {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, true)
+	if err != nil {
+		return err
+	}
+	err = removeQueueRecord(b, q, r)
+	if err != nil {
+		return err
+	}
+	r.Visible = now
+	return b.Put(queueKey(q, queueDead, r.ID), r.encode())
+}
+
+// DeadLetters calls the given function with the dead letters of the
+// given queue whose IDs follow the given one, in the order of their
+// IDs, until the function answers `false` or an error.
+func (tx *Tx) DeadLetters(ns, q string, after uint64, fn func(QueueRecord) (bool, error)) error {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	prefix := append(appendShortString(nil, q), queueDead)
+	c := b.Cursor()
+	for k, v := c.Seek(queueKey(q, queueDead, after+1)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 {
+			return ErrKeyInvalid
+		}
+		r, err := decodeQueueRecord(binary.BigEndian.Uint64(k[len(prefix):]), v)
+		if err != nil {
+			return err
+		}
+		ok, err := fn(r)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redrive moves the dead letter of the given queue having the given ID
+// back to the queue, visible from the given time, with no attempts.  It
+// answers `ErrKeyUnknown` if there is no such dead letter.
+func (tx *Tx) Redrive(ns, q string, id uint64, visible int64) error {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, false)
+	if err != nil {
+		return err
+	}
+	var v []byte
+	k := queueKey(q, queueDead, id)
+	if b != nil {
+		v = b.Get(k)
+	}
+	if v == nil {
+		return ErrKeyUnknown
+	}
+	r, err := decodeQueueRecord(id, v)
+	if err != nil {
+		return err
+	}
+
+	err = b.Delete(k)
+	if err != nil {
+		return err
+	}
+	r.Attempts, r.Visible = 0, visible
+	return tx.putQueueRecord(b, q, r)
+}
+
+// QueueCounts answers the numbers of messages of the given queue that
+// are visible as of the given time, of those that are not, and of its
+// dead letters.
+func (tx *Tx) QueueCounts(ns, q string, now int64) (uint64, uint64, uint64, error) {
+	b, err := nsBucket(tx.tx, ns, dbqueuename, false)
+	if err != nil || b == nil {
+		return 0, 0, 0, err
+	}
+
+	var ready, hidden, dead uint64
+	prefix := append(appendShortString(nil, q), queueVisibility)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) != len(prefix)+16 {
+			return 0, 0, 0, ErrKeyInvalid
+		}
+		if int64(binary.BigEndian.Uint64(k[len(prefix):])) > now {
+			hidden++
+		} else {
+			ready++
+		}
+	}
+	prefix = append(appendShortString(nil, q), queueDead)
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		dead++
+	}
+	return ready, hidden, dead, nil
+}
+
+// queuesChanged is closed, and replaced, whenever messages are
+// enqueued, or made visible again.
+var queuesChanged = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// signalQueues wakes those waiting for messages.
+func signalQueues() {
+	queuesChanged.Lock()
+	defer queuesChanged.Unlock()
+
+	close(queuesChanged.ch)
+	queuesChanged.ch = make(chan struct{})
+}
+
+// QueuesChanged answers a channel that is closed once messages are
+// next committed to queues.
+func (db *DB) QueuesChanged() <-chan struct{} {
+	queuesChanged.Lock()
+	defer queuesChanged.Unlock()
+
+	return queuesChanged.ch
+}
@@ -0,0 +1,87 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestQueueRecord(t *testing.T) {
+	tests := []QueueRecord{
+		{ID: 1},
+		{ID: 7, Attempts: 3, Enqueued: 1000, Visible: -5, Payload: []byte("payload")},
+		{ID: 1 << 40, Attempts: 1<<32 - 1, Enqueued: -1, Visible: 1 << 62, Payload: []byte{0}},
+	}
+	for _, r := range tests {
+		by := r.encode()
+		if len(by) != 20+len(r.Payload) {
+			t.Errorf("%+v: encoded length %d", r, len(by))
+		}
+		got, err := decodeQueueRecord(r.ID, by)
+		if err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+		if !bytes.Equal(got.Payload, r.Payload) {
+			t.Errorf("%+v: decoded payload %q", r, got.Payload)
+		}
+		got.Payload, r.Payload = nil, nil
+		if !reflect.DeepEqual(got, r) {
+			t.Errorf("decoded %+v, want %+v", got, r)
+		}
+		if _, err := decodeQueueRecord(r.ID, by[:19]); err != ErrCorruptRecord {
+			t.Errorf("%+v: truncated: %v", r, err)
+		}
+	}
+}
+
+func TestQueueKeys(t *testing.T) {
+	// The visibility index orders messages by time, then by ID.
+	ordered := []QueueRecord{
+		{ID: 9, Visible: 10},
+		{ID: 2, Visible: 20},
+		{ID: 3, Visible: 20},
+		{ID: 1, Visible: 1 << 40},
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, b := visibilityKey("q", ordered[i-1]), visibilityKey("q", ordered[i])
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("%+v not before %+v", ordered[i-1], ordered[i])
+		}
+	}
+
+	// Keys of different queues and kinds do not share prefixes, even
+	// when the name of one queue is a prefix of another.
+	keys := [][]byte{
+		queueKey("q", queueMessage, 1),
+		queueKey("q", queueDead, 1),
+		visibilityKey("q", QueueRecord{ID: 1}),
+		queueKey("qm", queueMessage, 1),
+	}
+	prefixes := [][]byte{
+		append(appendShortString(nil, "q"), queueMessage),
+		append(appendShortString(nil, "q"), queueDead),
+		append(appendShortString(nil, "q"), queueVisibility),
+		append(appendShortString(nil, "qm"), queueMessage),
+	}
+	for i, k := range keys {
+		for j, p := range prefixes {
+			if bytes.HasPrefix(k, p) != (i == j) {
+				t.Errorf("key % x, prefix % x", k, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every namespace bucket may hold the following buckets besides those
+// of its entity types.  Their names can not clash with entity type
+// names, which begin with a letter.
+//
+// The reverse reference index has a key per reference, and no values:
+//
+//	target | target ID uint64 | source | source ID uint64 | field ID uint8
+//
+// where entity type names are prefixed by their lengths, as `uint8`.
+// Hence, the references to an entity are contiguous.
+//
+// The reference counts bucket has a key per entity that is - or was,
+// or may be - referred to:
+//
+//	key   : entity type | ID uint64
+//	value : count uint64 | time since which the count is zero int64
+//
+// Times are in nanoseconds since the epoch.
+const (
+	dbrefsname   = "_refs"
+	dbrefcntname = "_refcnt"
+)
+
+// nsBucket answers the given internal bucket of the given namespace.
+// When `create` is `true`, the buckets are created if necessary;
+// otherwise, `nil` is answered if they do not exist.
+func nsBucket(tx *bolt.Tx, ns, name string, create bool) (*bolt.Bucket, error) {
+	if ns == "" {
+		return nil, ErrNameEmpty
+	}
+
+	if create {
+		nsb, err := tx.CreateBucketIfNotExists([]byte(ns))
+		if err != nil {
+			return nil, err
+		}
+		return nsb.CreateBucketIfNotExists([]byte(name))
+	}
+
+	nsb := tx.Bucket([]byte(ns))
+	if nsb == nil {
+		return nil, nil
+	}
+	return nsb.Bucket([]byte(name)), nil
+}
+
+// entityRefKey answers the key identifying the given entity in the
+// reference buckets.
+func entityRefKey(et string, id uint64) []byte {
+	by := make([]byte, 1+len(et)+8)
+	by[0] = uint8(len(et))
+	copy(by[1:], et)
+	binary.BigEndian.PutUint64(by[1+len(et):], id)
+	return by
+}
+
+// AddRef records a reference from the given field of the given source
+// entity to the given target entity, and counts it against the
+// target.  Recording an existing reference has no effect.
+func (tx *Tx) AddRef(ns, target string, tid uint64, src string, sid uint64, fid uint8, now int64) error {
+	rb, err := nsBucket(tx.tx, ns, dbrefsname, true)
+	if err != nil {
+		return err
+	}
+	k := append(append(entityRefKey(target, tid), entityRefKey(src, sid)...), fid)
+	if rb.Get(k) != nil {
+		return nil
+	}
+	err = rb.Put(k, []byte{})
+	if err != nil {
+		return err
+	}
+
+	return tx.adjustRefCount(ns, target, tid, 1, now)
+}
+
+// RemoveRef removes a reference recorded by `AddRef`, and discounts it
+// against the target.  Removing an unknown reference has no effect.
+func (tx *Tx) RemoveRef(ns, target string, tid uint64, src string, sid uint64, fid uint8, now int64) error {
+	rb, err := nsBucket(tx.tx, ns, dbrefsname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+	k := append(append(entityRefKey(target, tid), entityRefKey(src, sid)...), fid)
+	if rb.Get(k) == nil {
+		return nil
+	}
+	err = rb.Delete(k)
+	if err != nil {
+		return err
+	}
+
+	return tx.adjustRefCount(ns, target, tid, -1, now)
+}
+
+// adjustRefCount adds the given delta to the reference count of the
+// given entity.
+func (tx *Tx) adjustRefCount(ns, et string, id uint64, delta int64, now int64) error {
+	cb, err := nsBucket(tx.tx, ns, dbrefcntname, true)
+	if err != nil {
+		return err
+	}
+
+	k := entityRefKey(et, id)
+	cnt, since, _ := decodeRefCount(cb.Get(k))
+	switch {
+	case delta < 0 && cnt < uint64(-delta):
+		cnt = 0
+	default:
+		cnt = uint64(int64(cnt) + delta)
+	}
+	if cnt == 0 {
+		since = now
+	}
+
+	return cb.Put(k, encodeRefCount(cnt, since))
+}
+
+// TouchRefCount records a zero reference count for the given entity,
+// as of the given time, unless it has a recorded count already.
+func (tx *Tx) TouchRefCount(ns, et string, id uint64, now int64) error {
+	cb, err := nsBucket(tx.tx, ns, dbrefcntname, true)
+	if err != nil {
+		return err
+	}
+
+	k := entityRefKey(et, id)
+	if cb.Get(k) != nil {
+		return nil
+	}
+	return cb.Put(k, encodeRefCount(0, now))
+}
+
+// DropRefCount removes the recorded reference count of the given
+// entity, if any.
+func (tx *Tx) DropRefCount(ns, et string, id uint64) error {
+	cb, err := nsBucket(tx.tx, ns, dbrefcntname, false)
+	if err != nil || cb == nil {
+		return err
+	}
+	return cb.Delete(entityRefKey(et, id))
+}
+
+// RefCount answers the recorded reference count of the given entity,
+// the time since which it has been zero, and `true` if a count is
+// recorded.
+func (tx *Tx) RefCount(ns, et string, id uint64) (uint64, int64, bool) {
+	cb, _ := nsBucket(tx.tx, ns, dbrefcntname, false)
+	if cb == nil {
+		return 0, 0, false
+	}
+	return decodeRefCount(cb.Get(entityRefKey(et, id)))
+}
+
+// Referrers calls the given function with the source entity type, ID
+// and field ID of every recorded reference to the given entity, in
+// key order, until the function answers `false` or an error.
+func (tx *Tx) Referrers(ns, et string, id uint64, fn func(src string, sid uint64, fid uint8) (bool, error)) error {
+	rb, err := nsBucket(tx.tx, ns, dbrefsname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	prefix := entityRefKey(et, id)
+	c := rb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		rest := k[len(prefix):]
+		if len(rest) < 1 || len(rest) != 1+int(rest[0])+8+1 {
+			return ErrKeyInvalid
+		}
+		l := int(rest[0])
+		ok, err := fn(string(rest[1:1+l]), binary.BigEndian.Uint64(rest[1+l:]), rest[len(rest)-1])
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RefsFrom calls the given function with the target entity type, ID,
+// source ID and field ID of every recorded reference made by entities
+// of the given entity type, until the function answers `false` or an
+// error.  It scans the entire reverse reference index.
+func (tx *Tx) RefsFrom(ns, src string, fn func(target string, tid, sid uint64, fid uint8) (bool, error)) error {
+	rb, err := nsBucket(tx.tx, ns, dbrefsname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	c := rb.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		target, rest, ok := readShortString(k)
+		if !ok || len(rest) < 8 {
+			return ErrKeyInvalid
+		}
+		tid := binary.BigEndian.Uint64(rest)
+		s, rest, ok := readShortString(rest[8:])
+		if !ok || len(rest) != 8+1 {
+			return ErrKeyInvalid
+		}
+		if s != src {
+			continue
+		}
+
+		ok, err := fn(target, tid, binary.BigEndian.Uint64(rest), rest[8])
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func encodeRefCount(cnt uint64, since int64) []byte {
+	by := make([]byte, 16)
+	binary.BigEndian.PutUint64(by, cnt)
+	binary.BigEndian.PutUint64(by[8:], uint64(since))
+	return by
+}
+
+func decodeRefCount(by []byte) (uint64, int64, bool) {
+	if len(by) != 16 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(by), int64(binary.BigEndian.Uint64(by[8:])), true
+}
@@ -0,0 +1,140 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold a bucket of the pairs of the
+// many-to-many relations between its entities, indexed in both
+// directions:
+//
+//	key   : relation | 'a' | A's ID uint64 | B's ID uint64
+//	key   : relation | 'b' | B's ID uint64 | A's ID uint64
+//	value : empty
+//
+// Relations are prefixed by their lengths as `uint8`.
+const (
+	dbrelname = "_rel"
+)
+
+// Directions of the entries of relations.
+const (
+	relFromA = 'a'
+	relFromB = 'b'
+)
+
+// pairKey answers the key of the given pair in the given direction.
+func pairKey(rel string, dir byte, from, to uint64) []byte {
+	by := append(appendShortString(nil, rel), dir)
+	return appendUint64(appendUint64(by, from), to)
+}
+
+// AddPair records the given pair of the given relation, in both
+// directions.
+func (tx *Tx) AddPair(ns, rel string, a, b uint64) error {
+	rb, err := nsBucket(tx.tx, ns, dbrelname, true)
+	if err != nil {
+		return err
+	}
+
+	err = rb.Put(pairKey(rel, relFromA, a, b), []byte{})
+	if err != nil {
+		return err
+	}
+	return rb.Put(pairKey(rel, relFromB, b, a), []byte{})
+}
+
+// RemovePair removes the given pair of the given relation, if it
+// exists.
+func (tx *Tx) RemovePair(ns, rel string, a, b uint64) error {
+	rb, err := nsBucket(tx.tx, ns, dbrelname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	err = rb.Delete(pairKey(rel, relFromA, a, b))
+	if err != nil {
+		return err
+	}
+	return rb.Delete(pairKey(rel, relFromB, b, a))
+}
+
+// HasPair answers `true` if the given pair of the given relation
+// exists.
+func (tx *Tx) HasPair(ns, rel string, a, b uint64) bool {
+	rb, _ := nsBucket(tx.tx, ns, dbrelname, false)
+	return rb != nil && rb.Get(pairKey(rel, relFromA, a, b)) != nil
+}
+
+// Paired calls the given function with the IDs of the entities paired
+// with the given entity in the given relation, in ascending order,
+// until it answers `false` or an error.  The given entity is on the A
+// side of the relation if `fromA` is `true`, and on the B side
+// otherwise.
+func (tx *Tx) Paired(ns, rel string, fromA bool, id uint64, fn func(uint64) (bool, error)) error {
+	rb, err := nsBucket(tx.tx, ns, dbrelname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	dir := byte(relFromB)
+	if fromA {
+		dir = relFromA
+	}
+	prefix := appendUint64(append(appendShortString(nil, rel), dir), id)
+	c := rb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) != len(prefix)+8 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(prefix):]))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachPair calls the given function with every pair of the given
+// relation, in the ascending order of A's IDs and then of B's, until it
+// answers `false` or an error.
+func (tx *Tx) ForEachPair(ns, rel string, fn func(a, b uint64) (bool, error)) error {
+	rb, err := nsBucket(tx.tx, ns, dbrelname, false)
+	if err != nil || rb == nil {
+		return err
+	}
+
+	prefix := append(appendShortString(nil, rel), relFromA)
+	c := rb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) != len(prefix)+16 {
+			return ErrKeyInvalid
+		}
+		rest := k[len(prefix):]
+		ok, err := fn(binary.BigEndian.Uint64(rest), binary.BigEndian.Uint64(rest[8:]))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropRelation removes all the pairs of the given relation.
+func (tx *Tx) DropRelation(ns, rel string) error {
+	return deletePrefix(tx.tx, ns, dbrelname, appendShortString(nil, rel))
+}
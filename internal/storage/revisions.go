@@ -0,0 +1,71 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every namespace bucket may hold a bucket of entity revisions, having
+// a key per entity that has ever been stored:
+//
+//	key   : entity type | ID uint64   (as in the reference buckets)
+//	value : revision uint64
+//
+// The revision of an entity is incremented every time it is stored.
+// Revisions of deleted entities are retained, so that a revision
+// number is never reused for an entity.
+const (
+	dbrevname = "_rev"
+)
+
+// Revision answers the current revision of the given entity; `0` if
+// it has never been stored.
+func (tx *Tx) Revision(ns, et string, id uint64) uint64 {
+	rb, _ := nsBucket(tx.tx, ns, dbrevname, false)
+	if rb == nil {
+		return 0
+	}
+	return decodeRevision(rb.Get(entityRefKey(et, id)))
+}
+
+// NextRevision increments the revision of the given entity, and
+// answers the new revision.
+func (tx *Tx) NextRevision(ns, et string, id uint64) (uint64, error) {
+	return nextRevision(tx.tx, ns, et, id)
+}
+
+// nextRevision implements `NextRevision`.
+func nextRevision(tx *bolt.Tx, ns, et string, id uint64) (uint64, error) {
+	rb, err := nsBucket(tx, ns, dbrevname, true)
+	if err != nil {
+		return 0, err
+	}
+
+	k := entityRefKey(et, id)
+	rev := decodeRevision(rb.Get(k)) + 1
+	by := make([]byte, 8)
+	binary.BigEndian.PutUint64(by, rev)
+	return rev, rb.Put(k, by)
+}
+
+func decodeRevision(by []byte) uint64 {
+	if len(by) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(by)
+}
@@ -0,0 +1,123 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+// BucketUsage describes the pages of an entity type's bucket.
+type BucketUsage struct {
+	Keys       int   // number of records
+	Pages      int   // number of pages, including overflow pages
+	InuseBytes int64 // bytes in use by records and B+tree nodes
+	AllocBytes int64 // bytes allocated to the pages
+
+	// InlineBytes is the bytes in use by the records of a small bucket
+	// stored inline in its parent, having no pages of its own.
+	InlineBytes int64
+}
+
+// RecordOverhead is the number of bytes that an entity record
+// occupies in a leaf page besides its contents: the header of the
+// element, its key and its checksum.
+const RecordOverhead = 16 + 8 + checksumLen
+
+// BucketUsage answers the usage of the pages of the given entity
+// type's bucket.  A missing bucket has no pages.
+func (tx *Tx) BucketUsage(ns, et string) (BucketUsage, error) {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return BucketUsage{}, nil
+		}
+		return BucketUsage{}, err
+	}
+
+	bs := b.Stats()
+	return BucketUsage{
+		Keys:       bs.KeyN,
+		Pages:      bs.BranchPageN + bs.BranchOverflowN + bs.LeafPageN + bs.LeafOverflowN,
+		InuseBytes: int64(bs.BranchInuse + bs.LeafInuse),
+		AllocBytes: int64(bs.BranchAlloc + bs.LeafAlloc),
+
+		InlineBytes: int64(bs.InlineBucketInuse),
+	}, nil
+}
+
+// Rewrite rebuilds the given entity type's bucket, packing its records
+// densely in new pages.  The pages of the old bucket become free, and
+// are reused by later writes.  The sequence of the bucket is retained.
+//
+// The given function is called with every record, in ascending order
+// of keys, before anything is written.  It may answer a replacement
+// for the record, or `nil` to retain it as is.  If it answers an
+// error, the rewrite is abandoned.
+//
+// Since BoltDB can not rename buckets, all the records are held in
+// memory, and rewritten in this transaction.  A missing bucket is
+// treated as an empty one.
+func (tx *Tx) Rewrite(ns, et string, fn func(k, v []byte) ([]byte, error)) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil
+		}
+		return err
+	}
+
+	var keys, vals [][]byte
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil { // nested bucket
+			continue
+		}
+		rec, err := openRecord(v)
+		if err != nil {
+			return err
+		}
+		nv, err := fn(k, rec)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		if nv != nil {
+			vals = append(vals, sealRecord(nv))
+		} else {
+			vals = append(vals, append([]byte(nil), v...))
+		}
+	}
+	seq := b.Sequence()
+
+	nsb := tx.tx.Bucket([]byte(ns))
+	err = nsb.DeleteBucket([]byte(et))
+	if err != nil {
+		return err
+	}
+	b, err = nsb.CreateBucket([]byte(et))
+	if err != nil {
+		return err
+	}
+
+	// Keys are appended in order; full pages need no room for inserts.
+	b.FillPercent = 1.0
+	for i := range keys {
+		err = b.Put(keys[i], vals[i])
+		if err != nil {
+			return err
+		}
+	}
+	return b.SetSequence(seq)
+}
@@ -0,0 +1,87 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold a bucket recording the schema
+// versions at which entities were stored:
+//
+//	key   : entity type | ID uint64   (as in the reference buckets)
+//	value : schema version uint32
+//
+// Entities stored at schema version `0` have no record.
+const (
+	dbschemaname = "_schema"
+)
+
+// SetSchemaVersion records the schema version at which the given
+// entity was stored.
+func (tx *Tx) SetSchemaVersion(ns, et string, id uint64, v uint32) error {
+	sb, err := nsBucket(tx.tx, ns, dbschemaname, v > 0)
+	if err != nil || sb == nil {
+		return err
+	}
+
+	key := entityRefKey(et, id)
+	if v == 0 {
+		return sb.Delete(key)
+	}
+	var by [4]byte
+	binary.BigEndian.PutUint32(by[:], v)
+	return sb.Put(key, by[:])
+}
+
+// SchemaVersion answers the schema version at which the given entity
+// was stored.
+func (tx *Tx) SchemaVersion(ns, et string, id uint64) uint32 {
+	sb, _ := nsBucket(tx.tx, ns, dbschemaname, false)
+	if sb == nil {
+		return 0
+	}
+	v := sb.Get(entityRefKey(et, id))
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+// ForEachSchemaVersion calls the given function with the ID and the
+// schema version of every entity of the given entity type stored at a
+// non-zero schema version, in ascending order of IDs, until the
+// function answers `false` or an error.
+func (tx *Tx) ForEachSchemaVersion(ns, et string, fn func(id uint64, v uint32) (bool, error)) error {
+	sb, err := nsBucket(tx.tx, ns, dbschemaname, false)
+	if err != nil || sb == nil {
+		return err
+	}
+
+	prefix := appendShortString(nil, et)
+	c := sb.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 || len(v) != 4 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(prefix):]), binary.BigEndian.Uint32(v))
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
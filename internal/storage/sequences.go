@@ -0,0 +1,83 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold a bucket of named sequences, and one
+// of named counters:
+//
+//	key   : name
+//	value : value uint64
+//
+// The value of a sequence is the last one allocated from it; that of a
+// counter is an `int64`.
+const (
+	dbseqname   = "_seq"
+	dbcountname = "_count"
+)
+
+// namedValue answers the value stored under the given name, in the
+// given bucket of the given namespace; `0` if none is.
+func (tx *Tx) namedValue(ns, bucket, name string) (uint64, error) {
+	b, err := nsBucket(tx.tx, ns, bucket, false)
+	if err != nil || b == nil {
+		return 0, err
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return 0, nil
+	}
+	if len(v) != 8 {
+		return 0, ErrCorruptRecord
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// setNamedValue stores the given value under the given name, in the
+// given bucket of the given namespace.
+func (tx *Tx) setNamedValue(ns, bucket, name string, v uint64) error {
+	b, err := nsBucket(tx.tx, ns, bucket, true)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), appendUint64(nil, v))
+}
+
+// SequenceValue answers the last value allocated from the given
+// sequence; `0` if none has been.
+func (tx *Tx) SequenceValue(ns, name string) (uint64, error) {
+	return tx.namedValue(ns, dbseqname, name)
+}
+
+// SetSequenceValue records the given value as the last one allocated
+// from the given sequence.
+func (tx *Tx) SetSequenceValue(ns, name string, v uint64) error {
+	return tx.setNamedValue(ns, dbseqname, name, v)
+}
+
+// CounterValue answers the value of the given counter; `0` if it has
+// none.
+func (tx *Tx) CounterValue(ns, name string) (int64, error) {
+	v, err := tx.namedValue(ns, dbcountname, name)
+	return int64(v), err
+}
+
+// SetCounterValue sets the value of the given counter.
+func (tx *Tx) SetCounterValue(ns, name string, v int64) error {
+	return tx.setNamedValue(ns, dbcountname, name, uint64(v))
+}
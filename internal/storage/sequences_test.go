@@ -0,0 +1,71 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestNamedValues(t *testing.T) {
+	err := testDB.Update(func(tx *Tx) error {
+		if v, err := tx.SequenceValue("seq_ns", "invoice"); v != 0 || err != nil {
+			t.Errorf("unknown sequence: %d, %v", v, err)
+		}
+		if v, err := tx.CounterValue("seq_ns", "invoice"); v != 0 || err != nil {
+			t.Errorf("unknown counter: %d, %v", v, err)
+		}
+
+		// Sequences and counters of the same name are distinct.
+		if err := tx.SetSequenceValue("seq_ns", "invoice", math.MaxUint64); err != nil {
+			return err
+		}
+		if err := tx.SetCounterValue("seq_ns", "invoice", math.MinInt64); err != nil {
+			return err
+		}
+		if v, err := tx.SequenceValue("seq_ns", "invoice"); v != math.MaxUint64 || err != nil {
+			t.Errorf("sequence: %d, %v", v, err)
+		}
+		if v, err := tx.CounterValue("seq_ns", "invoice"); v != math.MinInt64 || err != nil {
+			t.Errorf("counter: %d, %v", v, err)
+		}
+		if v, err := tx.SequenceValue("seq_other", "invoice"); v != 0 || err != nil {
+			t.Errorf("sequence of another namespace: %d, %v", v, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = update(func(tx *bolt.Tx) error {
+		b, err := nsBucket(tx, "seq_ns", dbseqname, false)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("invoice"), []byte{0, 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB.View(func(tx *Tx) error {
+		if _, err := tx.SequenceValue("seq_ns", "invoice"); err != ErrCorruptRecord {
+			t.Errorf("corrupt sequence: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// InitShadow prepares to open the existing database inside the given
+// base storage directory path in shadow mode: a consistent copy of it
+// is written to the given overlay file, which is opened in its place.
+// Hence, all the mutations are made to the overlay, and the database
+// itself is never modified.  Both paths should be absolute paths; an
+// existing overlay file is replaced.
+//
+// An empty overlay path makes the overlay a temporary file, which is
+// removed when the database is closed.  Once the database is open,
+// the overlay is not written again; see `InitDB`.
+func InitShadow(p, overlay string) error {
+	if p == "" {
+		return ErrPathEmpty
+	}
+	if !path.IsAbs(p) || overlay != "" && !path.IsAbs(overlay) {
+		return ErrPathNotAbsolute
+	}
+	if open, err := openedAs(p, false, true, overlay); open {
+		return err
+	}
+	src := path.Join(p, dbdir, dbname)
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+
+	var f *os.File
+	var err error
+	if overlay == "" {
+		f, err = ioutil.TempFile("", "flagon-shadow-")
+	} else {
+		f, err = os.OpenFile(overlay, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	err = copyDB(path.Clean(p), f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	storageDir = p
+	theDB.readOnly = false
+	theDB.shadow = f.Name()
+	theDB.shadowTemp = overlay == ""
+	return nil
+}
+
+// Shadow answers the path of the overlay file of a database opened in
+// shadow mode, and an empty string otherwise.  See `InitShadow`.
+func (db *DB) Shadow() string {
+	return theDB.shadow
+}
@@ -0,0 +1,103 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"path"
+
+	"github.com/boltdb/bolt"
+)
+
+// SpaceUsage is a snapshot of the space used by the database file.
+type SpaceUsage struct {
+	FileBytes int64 // size of the database file
+	UsedBytes int64 // bytes in use by keys, values and B+tree nodes
+	FreeBytes int64 // bytes in free pages, reclaimable by compaction
+	DiskFree  int64 // free bytes in the file system; `-1` if unknown
+}
+
+// SpaceUsage answers the current space usage of the database.
+func (db *DB) SpaceUsage() (SpaceUsage, error) {
+	var su SpaceUsage
+	err := view(func(tx *bolt.Tx) error {
+		su.FileBytes = tx.Size()
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			bs := b.Stats()
+			su.UsedBytes += int64(bs.BranchInuse + bs.LeafInuse)
+			return nil
+		})
+	})
+	if err != nil {
+		return SpaceUsage{}, err
+	}
+
+	theDB.mu.RLock()
+	su.FreeBytes = int64(theDB.db.Stats().FreeAlloc)
+	theDB.mu.RUnlock()
+	su.DiskFree = diskFree(path.Join(storageDir, dbdir))
+	return su, nil
+}
+
+// PutSpaceSample stores the given serialised space usage sample,
+// taken at the given time (in nanoseconds since the epoch).  Only the
+// latest `max` samples are retained.
+func (db *DB) PutSpaceSample(ts int64, sample []byte, max int) error {
+	return update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(dbsysname)).CreateBucketIfNotExists([]byte(dbspacename))
+		if err != nil {
+			return err
+		}
+
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(ts))
+		err = b.Put(k, sample)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for n := b.Stats().KeyN - max; n > 0; n-- {
+			k, _ := c.First()
+			if k == nil {
+				break
+			}
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SpaceSamples answers a copy of the stored space usage samples, in
+// the ascending order of the times at which they were taken.
+func (db *DB) SpaceSamples() ([][]byte, error) {
+	var res [][]byte
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbsysname)).Bucket([]byte(dbspacename))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			by := make([]byte, len(v))
+			copy(by, v)
+			res = append(res, by)
+			return nil
+		})
+	})
+	return res, err
+}
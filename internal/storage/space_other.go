@@ -12,18 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package flagon
+//go:build !darwin && !dragonfly && !freebsd && !linux
+// +build !darwin,!dragonfly,!freebsd,!linux
 
-import (
-	"log"
-	"regexp"
-)
+package storage
 
-func init() {
-	// Set log format.
-	f := log.Flags()
-	log.SetFlags(f | log.Llongfile)
-
-	// Initialisations.
-	nameRegexp = regexp.MustCompile("^[a-z][a-z0-9_]*[a-z0-9]$")
+// diskFree answers `-1`, since free space can not be determined on
+// this platform.
+func diskFree(p string) int64 {
+	return -1
 }
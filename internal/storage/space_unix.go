@@ -0,0 +1,33 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package storage
+
+import "syscall"
+
+// diskFree answers the number of bytes available to unprivileged
+// users in the file system holding the given path, or `-1` if that
+// can not be determined.
+func diskFree(p string) int64 {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return -1
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize)
+}
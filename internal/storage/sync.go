@@ -0,0 +1,88 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "github.com/boltdb/bolt"
+
+// SetNoSync determines whether committed transactions are synced to
+// disk.  When they are not, commits are much faster, but those made
+// since the last sync are lost - and the database may be corrupted -
+// if the machine, rather than the process, crashes.  Turning syncing
+// back on syncs the database.
+func (db *DB) SetNoSync(on bool) error {
+	if theDB.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+	theDB.syncMu.Lock()
+	defer theDB.syncMu.Unlock()
+
+	theDB.db.NoSync = on
+	if on {
+		return nil
+	}
+	return theDB.db.Sync()
+}
+
+// NoSync answers `true` if committed transactions are not synced to
+// disk.  See `SetNoSync`.
+func (db *DB) NoSync() bool {
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+	theDB.syncMu.RLock()
+	defer theDB.syncMu.RUnlock()
+
+	return theDB.db.NoSync
+}
+
+// Sync syncs the database to disk, making all the committed
+// transactions durable.
+func (db *DB) Sync() error {
+	if theDB.readOnly {
+		return nil
+	}
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+
+	return theDB.db.Sync()
+}
+
+// updateSync executes the given function in a read-write BoltDB
+// transaction, which is synced to disk when it commits - or is not -
+// as given.
+func updateSync(sync bool, fn func(*bolt.Tx) error) error {
+	if theDB.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	theDB.mu.RLock()
+	defer theDB.mu.RUnlock()
+
+	theDB.syncMu.RLock()
+	if theDB.db.NoSync != sync {
+		defer theDB.syncMu.RUnlock()
+		return theDB.db.Update(fn)
+	}
+	theDB.syncMu.RUnlock()
+
+	// Override the setting exclusively, for this transaction alone.
+	theDB.syncMu.Lock()
+	defer theDB.syncMu.Unlock()
+
+	prev := theDB.db.NoSync
+	theDB.db.NoSync = !sync
+	defer func() { theDB.db.NoSync = prev }()
+	return theDB.db.Update(fn)
+}
@@ -0,0 +1,95 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold a bucket of soft-deleted entities,
+// which remain in their entity types' buckets until purged:
+//
+//	key   : entity type | ID uint64   (as in the reference buckets)
+//	value : time of deletion int64
+//
+// Times are in nanoseconds since the epoch.
+const (
+	dbtrashname = "_trash"
+)
+
+// Trash marks the given entity as soft-deleted at the given time.
+func (tx *Tx) Trash(ns, et string, id uint64, now int64) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	tb, err := nsBucket(tx.tx, ns, dbtrashname, true)
+	if err != nil {
+		return err
+	}
+	return tb.Put(entityRefKey(et, id), appendUint64(nil, uint64(now)))
+}
+
+// Untrash removes the soft-deletion mark of the given entity, if any.
+func (tx *Tx) Untrash(ns, et string, id uint64) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	tb, err := nsBucket(tx.tx, ns, dbtrashname, false)
+	if err != nil || tb == nil {
+		return err
+	}
+	return tb.Delete(entityRefKey(et, id))
+}
+
+// Trashed answers the time at which the given entity was soft-deleted,
+// and `true` if it is soft-deleted.
+func (tx *Tx) Trashed(ns, et string, id uint64) (int64, bool) {
+	tb, _ := nsBucket(tx.tx, ns, dbtrashname, false)
+	if tb == nil {
+		return 0, false
+	}
+	v := tb.Get(entityRefKey(et, id))
+	if len(v) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), true
+}
+
+// ForEachTrashed calls the given function with the ID and the time of
+// deletion of every soft-deleted entity of the given entity type, in
+// ascending order of IDs, beginning with the given ID, until the
+// function answers `false` or an error.
+func (tx *Tx) ForEachTrashed(ns, et string, start uint64, fn func(id uint64, t int64) (bool, error)) error {
+	tb, err := nsBucket(tx.tx, ns, dbtrashname, false)
+	if err != nil || tb == nil {
+		return err
+	}
+
+	prefix := entityRefKey(et, 0)
+	prefix = prefix[:len(prefix)-8]
+	c := tb.Cursor()
+	for k, v := c.Seek(entityRefKey(et, start)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 || len(v) != 8 {
+			return ErrKeyInvalid
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(prefix):]), int64(binary.BigEndian.Uint64(v)))
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
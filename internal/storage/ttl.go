@@ -0,0 +1,117 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Every namespace bucket may hold two buckets recording the expiry
+// times of entities:
+//
+//	_expiry : entity type | ID uint64   ->  expiry time int64
+//	_ttl    : entity type | expiry time int64 | ID uint64  ->  empty
+//
+// Entity types are prefixed by their length as `uint8`.  The latter
+// bucket orders the entities of each entity type by their expiry
+// times, so that expired entities can be found without scanning.
+// Times are in nanoseconds since the epoch, and are positive.
+const (
+	dbexpiryname = "_expiry"
+	dbttlname    = "_ttl"
+)
+
+// ttlKey answers the key of the given entity in the TTL index.
+func ttlKey(et string, t int64, id uint64) []byte {
+	by := appendShortString(nil, et)
+	by = appendUint64(by, uint64(t))
+	return appendUint64(by, id)
+}
+
+// SetExpiry records the given expiry time of the given entity,
+// replacing its previous one, if any.  A non-positive time removes
+// the expiry time.
+func (tx *Tx) SetExpiry(ns, et string, id uint64, t int64) error {
+	eb, err := nsBucket(tx.tx, ns, dbexpiryname, t > 0)
+	if err != nil || eb == nil {
+		return err
+	}
+	ib, err := nsBucket(tx.tx, ns, dbttlname, true)
+	if err != nil {
+		return err
+	}
+
+	key := entityRefKey(et, id)
+	if v := eb.Get(key); len(v) == 8 {
+		err = ib.Delete(ttlKey(et, int64(binary.BigEndian.Uint64(v)), id))
+		if err != nil {
+			return err
+		}
+	}
+	if t <= 0 {
+		return eb.Delete(key)
+	}
+
+	err = eb.Put(key, appendUint64(nil, uint64(t)))
+	if err != nil {
+		return err
+	}
+	return ib.Put(ttlKey(et, t, id), []byte{})
+}
+
+// Expiry answers the expiry time of the given entity, and `true` if it
+// has one.
+func (tx *Tx) Expiry(ns, et string, id uint64) (int64, bool) {
+	eb, _ := nsBucket(tx.tx, ns, dbexpiryname, false)
+	if eb == nil {
+		return 0, false
+	}
+	v := eb.Get(entityRefKey(et, id))
+	if len(v) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), true
+}
+
+// ForEachExpired calls the given function with the ID and the expiry
+// time of every entity of the given entity type, that expires at or
+// before the given time, in ascending order of expiry times, until the
+// function answers `false` or an error.  The function should not
+// change expiry times.
+func (tx *Tx) ForEachExpired(ns, et string, until int64, fn func(id uint64, t int64) (bool, error)) error {
+	ib, err := nsBucket(tx.tx, ns, dbttlname, false)
+	if err != nil || ib == nil {
+		return err
+	}
+
+	prefix := appendShortString(nil, et)
+	c := ib.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) != len(prefix)+16 {
+			return ErrKeyInvalid
+		}
+		t := int64(binary.BigEndian.Uint64(k[len(prefix):]))
+		if t > until {
+			break
+		}
+		ok, err := fn(binary.BigEndian.Uint64(k[len(prefix)+8:]), t)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
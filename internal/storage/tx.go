@@ -0,0 +1,346 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every stored entity record is followed by a CRC-32 (Castagnoli)
+// checksum of its contents, in big-endian order.
+const checksumLen = 4
+
+// crcTable is the CRC-32 table used to compute record checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Tx is a transaction on the database.  Values answered by a
+// transaction are valid only until the transaction ends.
+type Tx struct {
+	tx       *bolt.Tx // underlying BoltDB transaction
+	onCommit []func() // called after a successful commit
+}
+
+// View executes the given function in a read-only transaction.
+func (db *DB) View(fn func(*Tx) error) error {
+	return view(func(tx *bolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// Update executes the given function in a read-write transaction.
+// The transaction is committed if the function answers `nil`, and is
+// rolled back otherwise.  Functions registered using `OnCommit` are
+// called after a successful commit, in the order of their
+// registration.
+func (db *DB) Update(fn func(*Tx) error) error {
+	var t *Tx
+	err := update(func(tx *bolt.Tx) error {
+		t = &Tx{tx: tx}
+		return fn(t)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range t.onCommit {
+		f()
+	}
+	return nil
+}
+
+// UpdateSync is like `Update`, but syncs the transaction to disk when
+// it commits - or does not - as given, regardless of `SetNoSync`.
+func (db *DB) UpdateSync(sync bool, fn func(*Tx) error) error {
+	var t *Tx
+	err := updateSync(sync, func(tx *bolt.Tx) error {
+		t = &Tx{tx: tx}
+		return fn(t)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range t.onCommit {
+		f()
+	}
+	return nil
+}
+
+// Batch is like `Update`, but may combine the given function with
+// those given to concurrent calls, into a single transaction, as
+// BoltDB's `Batch` does.  If the combined transaction fails, the
+// functions are run again, separately; the given function should,
+// therefore, be idempotent, and confine its side effects to the
+// transaction until it commits.
+func (db *DB) Batch(fn func(*Tx) error) error {
+	if theDB.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	theDB.mu.RLock()
+	theDB.syncMu.RLock()
+	var t *Tx
+	err := theDB.db.Batch(func(tx *bolt.Tx) error {
+		t = &Tx{tx: tx}
+		return fn(t)
+	})
+	theDB.syncMu.RUnlock()
+	theDB.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range t.onCommit {
+		f()
+	}
+	return nil
+}
+
+// OnCommit registers the given function to be called after this
+// transaction commits successfully, once the database is available to
+// other transactions.  It has no effect in read-only transactions.
+func (tx *Tx) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// Get answers the record having the given key in the given entity
+// type's bucket, after verifying its checksum.
+func (tx *Tx) Get(ns, et string, key []byte) ([]byte, error) {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil, ErrKeyUnknown
+		}
+		return nil, err
+	}
+
+	v := b.Get(key)
+	if v == nil {
+		return nil, ErrKeyUnknown
+	}
+	return openRecord(v)
+}
+
+// Put stores the given record under the given key in the given entity
+// type's bucket, creating the bucket if necessary.
+func (tx *Tx) Put(ns, et string, key, value []byte) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	b, err := entityBucket(tx.tx, ns, et, true)
+	if err != nil {
+		return err
+	}
+
+	v := sealRecord(value)
+	err = b.Put(key, v)
+	if err != nil {
+		return err
+	}
+	return logChange(tx.tx, Change{Kind: ChangePut, NS: ns, ET: et, Key: key, Value: v})
+}
+
+// Delete removes the record having the given key from the given
+// entity type's bucket, if it exists.
+func (tx *Tx) Delete(ns, et string, key []byte) error {
+	if err := checkFrozen(tx.tx, ns, et); err != nil {
+		return err
+	}
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil
+		}
+		return err
+	}
+
+	if b.Get(key) == nil {
+		return nil
+	}
+	err = b.Delete(key)
+	if err != nil {
+		return err
+	}
+	return logChange(tx.tx, Change{Kind: ChangeDelete, NS: ns, ET: et, Key: key})
+}
+
+// NextSequence answers the next value of the given entity type's
+// sequence, creating its bucket if necessary.  Sequence values begin
+// at `1`.
+func (tx *Tx) NextSequence(ns, et string) (uint64, error) {
+	b, err := entityBucket(tx.tx, ns, et, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.NextSequence()
+}
+
+// ReserveSequence raises the given entity type's sequence to the given
+// value, if it is lower, creating its bucket if necessary.  New IDs,
+// hence, do not collide with IDs up to the given one, that are
+// assigned by the application.
+func (tx *Tx) ReserveSequence(ns, et string, min uint64) error {
+	b, err := entityBucket(tx.tx, ns, et, true)
+	if err != nil {
+		return err
+	}
+
+	if min > b.Sequence() {
+		return b.SetSequence(min)
+	}
+	return nil
+}
+
+// ForEach iterates over the records of the given entity type, in
+// ascending order of their keys, beginning with the first key equal
+// to or greater than `start`.  Iteration stops when the given
+// function answers `false` or an error.  A missing bucket is treated
+// as an empty one.
+func (tx *Tx) ForEach(ns, et string, start []byte, fn func(k, v []byte) (bool, error)) error {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil
+		}
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+		if v == nil { // nested bucket
+			continue
+		}
+		v, err = openRecord(v)
+		if err != nil {
+			return err
+		}
+		ok, err := fn(k, v)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForEachKey is like `ForEach`, but passes only the keys of the
+// records; their values are neither read nor verified.
+func (tx *Tx) ForEachKey(ns, et string, start []byte, fn func(k []byte) (bool, error)) error {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil
+		}
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+		if v == nil { // nested bucket
+			continue
+		}
+		ok, err := fn(k)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KeyRange answers the first and the last keys of the given entity
+// type's bucket; `nil` if it is missing or empty.
+func (tx *Tx) KeyRange(ns, et string) ([]byte, []byte, error) {
+	b, err := entityBucket(tx.tx, ns, et, false)
+	if err != nil {
+		if err == ErrBucketUnknown {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	c := b.Cursor()
+	first, v := c.First()
+	for first != nil && v == nil { // nested bucket
+		first, v = c.Next()
+	}
+	last, v := c.Last()
+	for last != nil && v == nil {
+		last, v = c.Prev()
+	}
+	if first == nil || last == nil {
+		return nil, nil, nil
+	}
+	return first, last, nil
+}
+
+// sealRecord answers a copy of the given record, followed by its
+// checksum.
+func sealRecord(v []byte) []byte {
+	by := make([]byte, len(v), len(v)+checksumLen)
+	copy(by, v)
+	sum := make([]byte, checksumLen)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(v, crcTable))
+	return append(by, sum...)
+}
+
+// openRecord verifies the checksum of the given sealed record, and
+// answers the record without its checksum.
+func openRecord(v []byte) ([]byte, error) {
+	if len(v) < checksumLen {
+		return nil, ErrCorruptRecord
+	}
+
+	l := len(v) - checksumLen
+	if crc32.Checksum(v[:l], crcTable) != binary.BigEndian.Uint32(v[l:]) {
+		return nil, ErrCorruptRecord
+	}
+	return v[:l], nil
+}
+
+// Namespaces answers the names of the namespaces that have buckets in
+// the database, in ascending order.
+func (tx *Tx) Namespaces() []string {
+	var res []string
+	tx.tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if string(name) != dbsysname {
+			res = append(res, string(name))
+		}
+		return nil
+	})
+	return res
+}
+
+// EntityTypes answers the names of the entity types that have buckets
+// in the given namespace, in ascending order.  Internal buckets of the
+// namespace are excluded.
+func (tx *Tx) EntityTypes(ns string) []string {
+	nsb := tx.tx.Bucket([]byte(ns))
+	if nsb == nil {
+		return nil
+	}
+
+	var res []string
+	nsb.ForEach(func(k, v []byte) error {
+		if v == nil && k[0] != '_' {
+			res = append(res, string(k))
+		}
+		return nil
+	})
+	return res
+}
@@ -0,0 +1,90 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRecordChecksum(t *testing.T) {
+	for _, v := range [][]byte{{}, {0x00}, []byte("flagon record")} {
+		sealed := sealRecord(v)
+		if len(sealed) != len(v)+checksumLen {
+			t.Fatalf("%q: sealed length %d", v, len(sealed))
+		}
+		got, err := openRecord(sealed)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("%q: opened %q, %v", v, got, err)
+		}
+
+		// Every single-bit error is detected.
+		for i := range sealed {
+			for bit := uint(0); bit < 8; bit++ {
+				bad := append([]byte(nil), sealed...)
+				bad[i] ^= 1 << bit
+				if _, err := openRecord(bad); err != ErrCorruptRecord {
+					t.Fatalf("%q: byte %d, bit %d: %v", v, i, bit, err)
+				}
+			}
+		}
+		if _, err := openRecord(sealed[:len(sealed)-1]); err != ErrCorruptRecord {
+			t.Fatalf("%q: truncated: %v", v, err)
+		}
+	}
+	if _, err := openRecord(nil); err != ErrCorruptRecord {
+		t.Fatalf("empty: %v", err)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	key := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	err := testDB.Update(func(tx *Tx) error {
+		return tx.Put("crc_ns", "crc_et", key, []byte("value"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the stored record in place, as a torn write would.
+	err = theDB.db.Update(func(tx *bolt.Tx) error {
+		b, err := entityBucket(tx, "crc_ns", "crc_et", false)
+		if err != nil {
+			return err
+		}
+		v := append([]byte(nil), b.Get(key)...)
+		v[0] ^= 0xff
+		return b.Put(key, v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDB.View(func(tx *Tx) error {
+		if _, err := tx.Get("crc_ns", "crc_et", key); err != ErrCorruptRecord {
+			t.Errorf("get: %v", err)
+		}
+		err := tx.ForEach("crc_ns", "crc_et", nil, func(k, v []byte) (bool, error) {
+			t.Errorf("for each: corrupt record %x answered", k)
+			return true, nil
+		})
+		if err != ErrCorruptRecord {
+			t.Errorf("for each: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// KeyScanner is implemented by entity types that can answer the IDs
+// of their stored entities cheaply, without reading the entities.
+// This serves external pagination, sharding and sampling.
+type KeyScanner interface {
+	// Keys answers up to the given number of IDs - all, if it is `0`
+	// - that are equal to or greater than the first given ID, and
+	// less than the second, in ascending order.
+	Keys(uint64, uint64, uint64) ([]uint64, error)
+
+	// MinKey answers the least ID; `0` if there are no entities.
+	MinKey() (uint64, error)
+
+	// MaxKey answers the greatest ID; `0` if there are no entities.
+	MaxKey() (uint64, error)
+}
+
+// Keys answers up to `limit` IDs of the stored documents of this
+// entity type - all of them, if it is `0` - that are equal to or
+// greater than `start`, and less than `end`, in ascending order.  An
+// `end` of `0` is unbounded.
+//
+// Only the keys of the documents are read.  Hence, the IDs of
+// soft-deleted and expired documents are included; use `Search` to
+// exclude them.
+func (et *entityType) Keys(start, end, limit uint64) ([]uint64, error) {
+	res := make([]uint64, 0, 8)
+	err := et.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.ForEachKey(et.ns.Name(), et.Name(), EntityKey{id: start}.Key(), func(k []byte) (bool, error) {
+			id := binary.BigEndian.Uint64(k)
+			if end > 0 && id >= end {
+				return false, nil
+			}
+			res = append(res, id)
+			return limit == 0 || uint64(len(res)) < limit, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MinKey answers the least ID of the stored documents of this entity
+// type; `0` if there are none.  Soft-deleted and expired documents are
+// included, as in `Keys`.
+func (et *entityType) MinKey() (uint64, error) {
+	first, _, err := et.keyRange()
+	return first, err
+}
+
+// MaxKey answers the greatest ID of the stored documents of this
+// entity type; `0` if there are none.  Soft-deleted and expired
+// documents are included, as in `Keys`.
+func (et *entityType) MaxKey() (uint64, error) {
+	_, last, err := et.keyRange()
+	return last, err
+}
+
+// keyRange answers the least and the greatest IDs of the stored
+// documents of this entity type; `0`s if there are none.
+func (et *entityType) keyRange() (uint64, uint64, error) {
+	var first, last uint64
+	err := et.view(context.Background(), func(tx *storage.Tx) error {
+		f, l, err := tx.KeyRange(et.ns.Name(), et.Name())
+		if f != nil {
+			first, last = binary.BigEndian.Uint64(f), binary.BigEndian.Uint64(l)
+		}
+		return err
+	})
+	return first, last, err
+}
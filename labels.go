@@ -0,0 +1,263 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Maximum number of labels of an entity.
+const maxLabels = 64
+
+// labelRegexp validates label keys and non-empty label values.
+var labelRegexp = regexp.MustCompile("^[A-Za-z0-9]([A-Za-z0-9_./-]{0,61}[A-Za-z0-9])?$")
+
+// Labeller is implemented by entity types whose instances can carry
+// labels: small key/value pairs outside their schema, such as
+// `migrated=true` or `team=billing`.  Labels are meant for operational
+// tagging; they are indexed, and entities can be found using label
+// selectors.
+//
+// Label keys, and non-empty label values, consist of up to 63 ASCII
+// letters, digits, `_`, `.`, `/` and `-`, and begin and end with a
+// letter or a digit.  An entity can have up to 64 labels.  Labels are
+// retained when entities are stored, and are removed when they are
+// deleted.
+type Labeller interface {
+	// SetLabels sets the given labels of the entity having the given
+	// ID, and removes those having the given keys.
+	SetLabels(uint64, map[string]string, []string) error
+	// Labels answers the labels of the entity having the given ID.
+	Labels(uint64) (map[string]string, error)
+	// SearchLabels answers the IDs of the entities matching the
+	// given label selector.
+	SearchLabels(string) ([]uint64, error)
+}
+
+// SetLabels sets the given labels of the document having the given
+// ID, replacing the values of existing ones, and removes the labels
+// having the given keys.  Labels are not part of the document; so, its
+// version is not changed.
+func (et *entityType) SetLabels(id uint64, set map[string]string, remove []string) error {
+	if id == 0 {
+		return ErrIdentifierZero
+	}
+	for k, v := range set {
+		if !labelRegexp.MatchString(k) || v != "" && !labelRegexp.MatchString(v) {
+			return ErrLabelInvalid
+		}
+	}
+
+	err := et.db.sdb.Update(func(tx *storage.Tx) error {
+		_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+		if err != nil {
+			return err
+		}
+
+		m := tx.Labels(et.ns.Name(), et.Name(), id)
+		if m == nil {
+			m = make(map[string]string, len(set))
+		}
+		for _, k := range remove {
+			delete(m, k)
+		}
+		for k, v := range set {
+			m[k] = v
+		}
+		if len(m) > maxLabels {
+			return ErrLabelInvalid
+		}
+		return tx.SetLabels(et.ns.Name(), et.Name(), id, m)
+	})
+	if err == storage.ErrKeyUnknown {
+		return ErrIdentifierUnknown
+	}
+	return err
+}
+
+// Labels answers the labels of the document having the given ID.
+func (et *entityType) Labels(id uint64) (map[string]string, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+
+	var m map[string]string
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+		if err != nil {
+			return err
+		}
+		m = tx.Labels(et.ns.Name(), et.Name(), id)
+		return nil
+	})
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil, ErrIdentifierUnknown
+		}
+		return nil, err
+	}
+
+	if m == nil {
+		m = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Operators of label requirements.
+const (
+	labelEq = iota
+	labelNe
+	labelExists
+	labelNotExists
+)
+
+// labelReq is a requirement of a label selector.
+type labelReq struct {
+	op    int
+	key   string
+	value string
+}
+
+// matches answers `true` if the given labels satisfy this requirement.
+func (r labelReq) matches(m map[string]string) bool {
+	v, ok := m[r.key]
+	switch r.op {
+	case labelEq:
+		return ok && v == r.value
+	case labelNe:
+		return !ok || v != r.value
+	case labelExists:
+		return ok
+	default:
+		return !ok
+	}
+}
+
+// parseSelector parses the given label selector.  A selector is a
+// comma-separated list of requirements, each of which is one of:
+//
+//	key=value   key==value   key!=value   key   !key
+func parseSelector(s string) ([]labelReq, error) {
+	var res []labelReq
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r labelReq
+		switch {
+		case strings.HasPrefix(part, "!"):
+			r = labelReq{op: labelNotExists, key: strings.TrimSpace(part[1:])}
+		case strings.Contains(part, "!="):
+			i := strings.Index(part, "!=")
+			r = labelReq{op: labelNe, key: part[:i], value: part[i+2:]}
+		case strings.Contains(part, "=="):
+			i := strings.Index(part, "==")
+			r = labelReq{op: labelEq, key: part[:i], value: part[i+2:]}
+		case strings.Contains(part, "="):
+			i := strings.Index(part, "=")
+			r = labelReq{op: labelEq, key: part[:i], value: part[i+1:]}
+		default:
+			r = labelReq{op: labelExists, key: part}
+		}
+
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if !labelRegexp.MatchString(r.key) || r.value != "" && !labelRegexp.MatchString(r.value) {
+			return nil, ErrSelectorInvalid
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// uint64s sorts IDs in ascending order.
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SearchLabels answers the IDs of the documents whose labels match the
+// given selector, in ascending order.  A selector is a comma-separated
+// list of requirements, all of which should be satisfied:
+//
+//	key=value    the label `key` has the value `value`
+//	key==value   the same
+//	key!=value   the label `key` is absent, or has another value
+//	key          the label `key` is present
+//	!key         the label `key` is absent
+//
+// The label index is used when the selector has a requirement of
+// either of the first or the fourth kinds; otherwise, all documents
+// are scanned.  An empty selector matches all documents.  As with
+// `Search`, soft-deleted and expired documents are skipped.
+func (et *entityType) SearchLabels(selector string) ([]uint64, error) {
+	reqs, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	ns, etn := et.ns.Name(), et.Name()
+	now := et.db.now().UnixNano()
+	res := make([]uint64, 0, 8)
+
+	err = et.db.sdb.View(func(tx *storage.Tx) error {
+		match := func(id uint64) {
+			m := tx.Labels(ns, etn, id)
+			for _, r := range reqs {
+				if !r.matches(m) {
+					return
+				}
+			}
+			if _, ok := tx.Trashed(ns, etn, id); ok {
+				return
+			}
+			if t, ok := tx.Expiry(ns, etn, id); ok && t <= now {
+				return
+			}
+			res = append(res, id)
+		}
+
+		for _, r := range reqs {
+			switch r.op {
+			case labelEq:
+				return tx.ForEachLabelled(ns, etn, r.key, r.value, func(id uint64) (bool, error) {
+					match(id)
+					return true, nil
+				})
+			case labelExists:
+				return tx.ForEachLabel(ns, etn, r.key, func(id uint64, _ string) (bool, error) {
+					match(id)
+					return true, nil
+				})
+			}
+		}
+		return tx.ForEach(ns, etn, nil, func(k, _ []byte) (bool, error) {
+			match(binary.BigEndian.Uint64(k))
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(uint64s(res))
+	return res, nil
+}
@@ -0,0 +1,174 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	ns := testNamespace(t, "lbl_ns")
+	ed := testDefn(t, "lbl_item", []testField{{"qty", FieldTypeUint32}}, nil)
+	et := testDB.EntityType(ns, ed)
+	lb := et.(Labeller)
+
+	d := testDoc(t, ed, 0, map[string]interface{}{"qty": uint32(1)})
+	if err := et.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	id := d.ID()
+	if m, err := lb.Labels(id); err != nil || len(m) != 0 {
+		t.Fatalf("new labels: %v, %v", m, err)
+	}
+
+	if err := lb.SetLabels(id, map[string]string{"team": "billing", "migrated": "", "v": "1.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.SetLabels(id, map[string]string{"v": "2"}, []string{"migrated", "absent"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"team": "billing", "v": "2"}
+	if m, err := lb.Labels(id); err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("labels: %v, %v", m, err)
+	}
+
+	// Labels survive storing the document, and are read with it.
+	if err := et.Put(testDoc(t, ed, id, map[string]interface{}{"qty": uint32(2)})); err != nil {
+		t.Fatal(err)
+	}
+	e, err := et.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := e.(*Document).Labels(); !reflect.DeepEqual(m, want) {
+		t.Errorf("document labels: %v", m)
+	}
+	e.(*Document).Labels()["team"] = "other"
+	if m := e.(*Document).Labels(); m["team"] != "billing" {
+		t.Error("document labels shared with the caller")
+	}
+
+	// Invalid labels are refused as a whole.
+	for _, m := range []map[string]string{
+		{"": "x"},
+		{"-lead": "x"},
+		{"trail.": "x"},
+		{"sp ace": "x"},
+		{"ok": "bad value"},
+		{"ok": "-x"},
+	} {
+		if err := lb.SetLabels(id, m, nil); err != ErrLabelInvalid {
+			t.Errorf("%v: %v", m, err)
+		}
+	}
+	many := make(map[string]string)
+	for i := 0; i < maxLabels-1; i++ {
+		many[fmt.Sprintf("k%d", i)] = "x"
+	}
+	if err := lb.SetLabels(id, many, nil); err != ErrLabelInvalid {
+		t.Errorf("too many labels: %v", err)
+	}
+	if m, _ := lb.Labels(id); !reflect.DeepEqual(m, want) {
+		t.Errorf("labels after refusals: %v", m)
+	}
+
+	if err := lb.SetLabels(0, want, nil); err != ErrIdentifierZero {
+		t.Errorf("zero ID: %v", err)
+	}
+	if err := lb.SetLabels(id+100, want, nil); err != ErrIdentifierUnknown {
+		t.Errorf("unknown ID: %v", err)
+	}
+
+	// Deleting the document removes its labels.
+	if err := et.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.Labels(id); err != ErrIdentifierUnknown {
+		t.Errorf("labels of deleted: %v", err)
+	}
+	if ids, err := lb.SearchLabels("team"); err != nil || len(ids) != 0 {
+		t.Errorf("deleted found: %v, %v", ids, err)
+	}
+}
+
+func TestSearchLabels(t *testing.T) {
+	ns := testNamespace(t, "lbl_ns")
+	ed := testDefn(t, "lbl_search", []testField{{"qty", FieldTypeUint32}}, nil)
+	et := testDB.EntityType(ns, ed)
+	lb := et.(Labeller)
+
+	labels := []map[string]string{
+		{"team": "billing", "env": "prod"},
+		{"team": "billing", "env": "test"},
+		{"team": "search"},
+		nil,
+	}
+	var ids []uint64
+	for _, m := range labels {
+		d := testDoc(t, ed, 0, map[string]interface{}{"qty": uint32(1)})
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := lb.SetLabels(d.ID(), m, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID())
+	}
+
+	tests := []struct {
+		sel  string
+		want []int // indexes into ids
+	}{
+		{"team=billing", []int{0, 1}},
+		{"team == billing, env=prod", []int{0}},
+		{"team!=billing", []int{2, 3}},
+		{"env", []int{0, 1}},
+		{"!env", []int{2, 3}},
+		{"team, !env", []int{2}},
+		{"env!=prod, team=billing", []int{1}},
+		{"", []int{0, 1, 2, 3}},
+		{"team=none", nil},
+	}
+	for _, tc := range tests {
+		got, err := lb.SearchLabels(tc.sel)
+		if err != nil {
+			t.Errorf("%q: %v", tc.sel, err)
+			continue
+		}
+		want := make([]uint64, 0, len(tc.want))
+		for _, i := range tc.want {
+			want = append(want, ids[i])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: %v, want %v", tc.sel, got, want)
+		}
+	}
+
+	// Soft-deleted documents are not found.
+	if err := et.(SoftDeleter).DeleteSoft(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lb.SearchLabels("team=billing"); err != nil || !reflect.DeepEqual(got, []uint64{ids[1]}) {
+		t.Errorf("after soft deletion: %v, %v", got, err)
+	}
+
+	for _, sel := range []string{"=x", "!", "team=a b", ",", "team=x,"} {
+		if _, err := lb.SearchLabels(sel); err != ErrSelectorInvalid {
+			t.Errorf("%q: %v", sel, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Lease is a named, exclusive lease, held by one holder at a time
+// until it is released or expires - so that, say, only one of several
+// workers runs a job.  Leases are stored in the database; they are not
+// tied to namespaces.
+//
+// Every acquisition of a lease increments its token.  Holders should
+// pass theirs with the work that they do under a lease, so that the
+// work of a holder whose lease has expired, and been acquired by
+// another, can be recognised by its smaller token, and refused.
+//
+// A `Lease` is safe for concurrent use.
+type Lease struct {
+	db     *DB
+	name   string
+	holder string
+	token  uint64
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// LeaseInfo describes the state of a lease.
+type LeaseInfo struct {
+	Holder  string    // current holder; empty if none
+	Token   uint64    // token of the latest acquisition; `0` if none
+	Expires time.Time // expiry time of the current holder; zero if none
+}
+
+// validLease answers `ErrLeaseInvalid` unless the given name and
+// holder are not empty and no longer than 255 bytes.
+func validLease(name, holder string) error {
+	if name == "" || holder == "" || len(name) > 255 || len(holder) > 255 {
+		return ErrLeaseInvalid
+	}
+	return nil
+}
+
+// AcquireLease acquires the lease having the given name for the given
+// holder, for the given duration.  It answers `ErrLeaseHeld` if the
+// lease is held, and has not expired - even by the same holder, which
+// should renew it instead.  Times are read from the clock of this
+// handle.
+func (db *DB) AcquireLease(name, holder string, ttl time.Duration) (*Lease, error) {
+	if err := validLease(name, holder); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, ErrLeaseInvalid
+	}
+
+	l := &Lease{db: db, name: name, holder: holder}
+	err := db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := tx.Lease(name)
+		if err != nil {
+			return err
+		}
+		now := db.now()
+		if r.Expires > now.UnixNano() {
+			return ErrLeaseHeld
+		}
+
+		l.token = r.Token + 1
+		l.expires = now.Add(ttl)
+		return tx.PutLease(name, storage.LeaseRecord{Token: l.token, Expires: l.expires.UnixNano(), Holder: holder})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Lease answers the state of the lease having the given name.  A lease
+// that has never been acquired is not held.
+func (db *DB) Lease(name string) (LeaseInfo, error) {
+	var li LeaseInfo
+	err := db.view(context.Background(), func(tx *storage.Tx) error {
+		r, err := tx.Lease(name)
+		if err != nil {
+			return err
+		}
+		li.Token = r.Token
+		if r.Expires > db.now().UnixNano() {
+			li.Holder = r.Holder
+			li.Expires = time.Unix(0, r.Expires)
+		}
+		return nil
+	})
+	return li, err
+}
+
+// Name answers the name of this lease.
+func (l *Lease) Name() string {
+	return l.name
+}
+
+// Holder answers the holder of this lease.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Token answers the token of this acquisition of the lease.
+func (l *Lease) Token() uint64 {
+	return l.token
+}
+
+// Expires answers the time at which this lease expires, unless it is
+// renewed.
+func (l *Lease) Expires() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.expires
+}
+
+// Renew extends this lease to the given duration from now.  A lease
+// that has expired can be renewed, as long as it has not been
+// acquired by another in the meantime; otherwise, and if it has been
+// released, `ErrLeaseLost` is answered.
+func (l *Lease) Renew(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrLeaseInvalid
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expires time.Time
+	err := l.db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := tx.Lease(l.name)
+		if err != nil {
+			return err
+		}
+		if r.Token != l.token || r.Expires == 0 {
+			return ErrLeaseLost
+		}
+
+		expires = l.db.now().Add(ttl)
+		r.Expires = expires.UnixNano()
+		return tx.PutLease(l.name, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	l.expires = expires
+	return nil
+}
+
+// Release releases this lease, so that others can acquire it without
+// waiting for it to expire.  It answers `ErrLeaseLost` if the lease
+// has been released already, or acquired by another.
+func (l *Lease) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := tx.Lease(l.name)
+		if err != nil {
+			return err
+		}
+		if r.Token != l.token || r.Expires == 0 {
+			return ErrLeaseLost
+		}
+
+		r.Expires = 0
+		return tx.PutLease(l.name, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	l.expires = time.Time{}
+	return nil
+}
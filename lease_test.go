@@ -0,0 +1,98 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseInvalid(t *testing.T) {
+	tests := []struct {
+		name, holder string
+	}{
+		{"", "w1"},
+		{"lease_inv", ""},
+		{string(make([]byte, 256)), "w1"},
+	}
+	for _, tc := range tests {
+		if _, err := testDB.AcquireLease(tc.name, tc.holder, time.Second); !errors.Is(err, ErrLeaseInvalid) {
+			t.Errorf("%q, %q: %v", tc.name, tc.holder, err)
+		}
+	}
+}
+
+func TestLeaseFencing(t *testing.T) {
+	db, clk := clockDB(time.Unix(1000000, 0))
+	const name = "lease_fence"
+
+	if li, err := db.Lease(name); err != nil || li.Holder != "" || li.Token != 0 {
+		t.Fatalf("unknown lease: %+v, %v", li, err)
+	}
+	l1, err := db.AcquireLease(name, "w1", 10*time.Second)
+	if err != nil || l1.Token() != 1 {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := db.AcquireLease(name, "w2", time.Second); !errors.Is(err, ErrLeaseHeld) || !errors.Is(err, ErrConflict) {
+		t.Errorf("acquire when held: %v", err)
+	}
+	li, _ := db.Lease(name)
+	if li.Holder != "w1" || li.Token != 1 || !li.Expires.Equal(clk.Now().Add(10*time.Second)) {
+		t.Errorf("held lease: %+v", li)
+	}
+
+	// Renewal extends the lease from now.
+	clk.Advance(5 * time.Second)
+	if err := l1.Renew(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(8 * time.Second)
+	if _, err := db.AcquireLease(name, "w2", time.Second); !errors.Is(err, ErrLeaseHeld) {
+		t.Errorf("acquire when renewed: %v", err)
+	}
+
+	// An expired lease remains renewable until another acquires it.
+	clk.Advance(4 * time.Second)
+	if err := l1.Renew(time.Second); err != nil {
+		t.Errorf("renew when expired: %v", err)
+	}
+	clk.Advance(2 * time.Second)
+	l2, err := db.AcquireLease(name, "w2", time.Second)
+	if err != nil || l2.Token() != 2 {
+		t.Fatalf("acquire when expired: %v", err)
+	}
+	if err := l1.Renew(time.Second); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("renew when taken: %v", err)
+	}
+	if err := l1.Release(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("release when taken: %v", err)
+	}
+
+	// Releasing keeps the token, so that fencing tokens never repeat.
+	if err := l2.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.Release(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("release twice: %v", err)
+	}
+	if li, _ := db.Lease(name); li.Holder != "" || li.Token != 2 {
+		t.Errorf("released lease: %+v", li)
+	}
+	l3, err := db.AcquireLease(name, "w1", time.Second)
+	if err != nil || l3.Token() != 3 {
+		t.Errorf("acquire when released: %v", err)
+	}
+}
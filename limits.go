@@ -0,0 +1,270 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Storage quotas limit the number of entities of an entity type in a
+// namespace, and the bytes that they occupy, so that a single runaway
+// tenant or log type can not fill the disk.  Storing an entity that
+// would exceed its quota answers `ErrQuotaExceeded`.
+//
+// Usage is measured from the pages of the bucket of the entity type -
+// soft-deleted and expired entities included - and is adjusted by the
+// sizes of the entities stored and deleted thereafter.  It is measured
+// afresh at least every `quotaRefresh`, and after operations that
+// change many entities at once, such as `Truncate`, `Import`,
+// `BulkLoad` and `ApplyChanges`.  Hence, bytes are approximate: they
+// include the overhead of the B+tree nodes.  Those operations are not
+// limited by quotas; `Put` and its variants, and `Update`, are.
+
+// quotaRefresh is the interval after which the usage of an entity type
+// is measured afresh.
+const quotaRefresh = time.Minute
+
+// Quota limits the storage used by an entity type in a namespace.  A
+// zero limit is no limit.
+type Quota struct {
+	MaxEntities uint64 // maximum number of entities
+	MaxBytes    int64  // maximum bytes occupied by them
+}
+
+// QuotaUsage is the storage used by an entity type in a namespace, as
+// counted against its quota.
+type QuotaUsage struct {
+	Entities uint64 // number of entities
+	Bytes    int64  // bytes occupied by them
+}
+
+// SetQuota sets the quota of the entity type having the given name in
+// the namespace having the given name.  An empty namespace name sets
+// the default quota of the entity type, for the namespaces that do not
+// have quotas of their own.  A zero quota removes the quota set.
+//
+// Quotas are not stored in the database, and should be set by every
+// process that writes the entity type.  Since all handles refer to the
+// same database, quotas apply to all of them.
+func (db *DB) SetQuota(ns, et string, q Quota) {
+	quotas.set(ns, et, q)
+}
+
+// Quota answers the quota of the entity type having the given name in
+// the namespace having the given name - its default quota, if the
+// namespace does not have one - and `false` if it has none.
+func (db *DB) Quota(ns, et string) (Quota, bool) {
+	return quotas.lookup(ns, et)
+}
+
+// QuotaUsage measures the storage used by the given entity type in the
+// given namespace, as counted against its quota.
+func (db *DB) QuotaUsage(ns *Namespace, ed *EntityTypeDefn) (QuotaUsage, error) {
+	var u QuotaUsage
+	err := db.view(context.Background(), func(tx *storage.Tx) error {
+		bu, err := tx.BucketUsage(ns.Name(), ed.Name())
+		u = quotaUsage(bu)
+		return err
+	})
+	return u, err
+}
+
+// quotaUsage answers the given bucket usage as a `QuotaUsage`.
+func quotaUsage(bu storage.BucketUsage) QuotaUsage {
+	return QuotaUsage{Entities: uint64(bu.Keys), Bytes: bu.InuseBytes + bu.InlineBytes}
+}
+
+// quotaTracker tracks the usage of an entity type in a namespace.
+type quotaTracker struct {
+	mutex    sync.Mutex
+	usage    QuotaUsage
+	measured time.Time // when last measured; zero if never
+	gen      uint64    // incremented when measured
+}
+
+// current answers the usage tracked, measuring it in the given
+// transaction if it is stale, together with its generation.
+func (t *quotaTracker) current(tx *storage.Tx, ns, et string) (QuotaUsage, uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.measured.IsZero() || time.Since(t.measured) >= quotaRefresh {
+		bu, err := tx.BucketUsage(ns, et)
+		if err != nil {
+			return QuotaUsage{}, 0, err
+		}
+		t.usage = quotaUsage(bu)
+		t.measured = time.Now()
+		t.gen++
+	}
+	return t.usage, t.gen, nil
+}
+
+// adjust adds the given changes to the usage tracked, unless it has
+// been measured afresh since the given generation; the measurement
+// then includes the changes.
+func (t *quotaTracker) adjust(gen uint64, entities, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if gen != t.gen {
+		return
+	}
+	if entities < 0 && uint64(-entities) > t.usage.Entities {
+		t.usage.Entities = 0
+	} else {
+		t.usage.Entities = uint64(int64(t.usage.Entities) + entities)
+	}
+	t.usage.Bytes += bytes
+	if t.usage.Bytes < 0 {
+		t.usage.Bytes = 0
+	}
+}
+
+// quotaHub holds the quotas, and the usage tracked against them, for
+// all handles; see `DB`.
+type quotaHub struct {
+	mutex    sync.Mutex
+	quotas   map[string]Quota         // by namespace and entity type
+	trackers map[string]*quotaTracker // by namespace and entity type
+}
+
+var quotas = &quotaHub{quotas: make(map[string]Quota), trackers: make(map[string]*quotaTracker)}
+
+// set sets the quota of the given entity type in the given namespace;
+// a zero quota removes it.
+func (h *quotaHub) set(ns, et string, q Quota) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if q == (Quota{}) {
+		delete(h.quotas, changeKey(ns, et))
+		return
+	}
+	h.quotas[changeKey(ns, et)] = q
+}
+
+// lookup answers the quota of the given entity type in the given
+// namespace, or its default quota, if any.
+func (h *quotaHub) lookup(ns, et string) (Quota, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.quotas) == 0 {
+		return Quota{}, false
+	}
+	if q, ok := h.quotas[changeKey(ns, et)]; ok {
+		return q, true
+	}
+	q, ok := h.quotas[changeKey("", et)]
+	return q, ok
+}
+
+// tracker answers the usage tracker of the given entity type in the
+// given namespace, creating it if necessary.
+func (h *quotaHub) tracker(ns, et string) *quotaTracker {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := changeKey(ns, et)
+	t := h.trackers[key]
+	if t == nil {
+		t = &quotaTracker{}
+		h.trackers[key] = t
+	}
+	return t
+}
+
+// reset discards the usage tracked for the given entity type in the
+// given namespace, so that it is measured afresh.
+func (h *quotaHub) reset(ns, et string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.trackers, changeKey(ns, et))
+}
+
+// purge discards all the usage tracked.
+func (h *quotaHub) purge() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.trackers = make(map[string]*quotaTracker)
+}
+
+// checkQuota answers `ErrQuotaExceeded` if storing the given payload as
+// the entity having the given ID would exceed the quota of this entity
+// type, if any.  Otherwise, the change in usage is tracked once the
+// given transaction commits.
+func (et *entityType) checkQuota(tx *storage.Tx, id uint64, by []byte) error {
+	q, ok := quotas.lookup(et.ns.Name(), et.Name())
+	if !ok {
+		return nil
+	}
+
+	n, b := int64(1), int64(storage.RecordOverhead+len(by))
+	old, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	switch err {
+	case nil:
+		n, b = 0, int64(len(by)-len(old))
+	case storage.ErrKeyUnknown:
+	default:
+		return err
+	}
+	t := quotas.tracker(et.ns.Name(), et.Name())
+	u, gen, err := t.current(tx, et.ns.Name(), et.Name())
+	if err != nil {
+		return err
+	}
+
+	if q.MaxEntities > 0 && n > 0 && u.Entities+uint64(n) > q.MaxEntities ||
+		q.MaxBytes > 0 && b > 0 && u.Bytes+b > q.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	tx.OnCommit(func() {
+		t.adjust(gen, n, b)
+	})
+	return nil
+}
+
+// releaseQuota tracks the release of the storage of the entity having
+// the given ID, once the given transaction commits, if this entity
+// type has a quota.
+func (et *entityType) releaseQuota(tx *storage.Tx, id uint64) error {
+	if _, ok := quotas.lookup(et.ns.Name(), et.Name()); !ok {
+		return nil
+	}
+
+	old, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil
+		}
+		return err
+	}
+	t := quotas.tracker(et.ns.Name(), et.Name())
+	_, gen, err := t.current(tx, et.ns.Name(), et.Name())
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		t.adjust(gen, -1, -int64(storage.RecordOverhead+len(old)))
+	})
+	return nil
+}
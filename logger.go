@@ -0,0 +1,129 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// LogLevel enumerates the severities of the messages that `flagon`
+// logs.
+type LogLevel uint8
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+// String answers the name of this level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", uint8(l))
+	}
+}
+
+// LogField is a named value accompanying a logged message.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the messages that `flagon` logs, such as errors
+// encountered by background work, which have no caller to answer them
+// to.  Implementations should be safe for concurrent use, and may
+// filter messages by level.  See `Options.Logger`.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// NewStdLogger answers a logger that writes the messages at or above
+// the given level to the given standard logger, with their fields
+// appended as `key=value` pairs.  A `nil` standard logger writes to
+// that of package `log`, without altering its settings.
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+// stdLogger implements `NewStdLogger`.
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+func (sl *stdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level < sl.min {
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "flagon: %s %s", level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&buf, " %s=%v", f.Key, f.Value)
+	}
+	if sl.l == nil {
+		log.Print(buf.String())
+		return
+	}
+	sl.l.Print(buf.String())
+}
+
+// NopLogger answers a logger that discards all messages.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+// nopLogger implements `NopLogger`.
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, ...LogField) {}
+
+// The logger in use.  Since all handles answered by `Open` refer to
+// the same database, the logger is shared by them; that given to the
+// latest `Open` prevails.
+var (
+	logMutex sync.RWMutex
+	logger   Logger = NewStdLogger(nil, LogInfo)
+)
+
+// setLogger makes the given logger the one in use.
+func setLogger(l Logger) {
+	logMutex.Lock()
+	logger = l
+	logMutex.Unlock()
+}
+
+// logMsg logs the given message at the given level, using the logger in
+// use.
+func logMsg(level LogLevel, msg string, fields ...LogField) {
+	logMutex.RLock()
+	l := logger
+	logMutex.RUnlock()
+
+	l.Log(level, msg, fields...)
+}
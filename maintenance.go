@@ -0,0 +1,456 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaintenanceJob is a periodic job run by a `Maintenance` scheduler.
+// Jobs are run with a context that is cancelled when the scheduler is
+// stopped.  A job is never run concurrently with itself.
+type MaintenanceJob struct {
+	Name     string                      // unique among the jobs of a scheduler
+	Interval time.Duration               // from the end of a run to the start of the next
+	Run      func(context.Context) error // the work
+}
+
+// MaintenanceOpts holds the optional settings of `NewMaintenance`.
+type MaintenanceOpts struct {
+	// Concurrency is the maximum number of jobs running at once; `1`
+	// if not positive.
+	Concurrency int
+
+	// Jitter delays every run by a random duration of up to this
+	// fraction of the interval of its job, so that jobs having equal
+	// intervals - in this process, or in others - do not run in
+	// lockstep.  It is capped at `1`; `0` disables jitter.
+	Jitter float64
+}
+
+// MaintenanceStatus describes the runs of a maintenance job.
+type MaintenanceStatus struct {
+	Name         string
+	Runs         uint64        // number of completed runs
+	Failures     uint64        // number of runs that answered errors
+	LastStart    time.Time     // start of the last completed run; zero if none
+	LastDuration time.Duration // duration of the last completed run
+	LastError    error         // error of the last completed run, if any
+	Running      bool          // running now?
+}
+
+// Maintenance runs registered maintenance jobs periodically in the
+// background - expiring entities, checking invariants, recording space
+// usage and the like - limiting the number of jobs running at once.
+// Failures are logged at `LogWarn`, and retried at the next run.  See
+// `DB.NewMaintenance`.
+//
+// Jobs run once `Start` is called, until `Stop` is called.  Stop the
+// scheduler before closing the database.  The methods are safe for
+// concurrent use.
+type Maintenance struct {
+	opts MaintenanceOpts
+	sem  chan struct{} // holds a token per running job
+
+	mutex   sync.Mutex
+	jobs    map[string]*maintJob
+	started bool
+	stopped bool
+	paused  chan struct{} // closed on resuming; `nil` unless paused
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	rnd     *rand.Rand
+}
+
+// maintJob is a registered job, together with its status.
+type maintJob struct {
+	job     MaintenanceJob
+	status  MaintenanceStatus // guarded by the scheduler's mutex
+	trigger chan struct{}     // signalled to run the job now
+	quit    chan struct{}     // closed when the job is unregistered
+}
+
+// NewMaintenance creates a scheduler of maintenance jobs.  `opts` may
+// be `nil`.  See `SweepJob`, `CheckJob`, `SpaceStatsJob` and
+// `CompactionCheckJob` for the jobs that `flagon` provides.
+func (db *DB) NewMaintenance(opts *MaintenanceOpts) *Maintenance {
+	var o MaintenanceOpts
+	if opts != nil {
+		o = *opts
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.Jitter < 0 {
+		o.Jitter = 0
+	}
+	if o.Jitter > 1 {
+		o.Jitter = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Maintenance{
+		opts:   o,
+		sem:    make(chan struct{}, o.Concurrency),
+		jobs:   make(map[string]*maintJob),
+		ctx:    ctx,
+		cancel: cancel,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Register adds the given job to this scheduler.  If the scheduler has
+// been started, the job's first run is due after its interval.
+//
+// It answers `ErrNameEmpty` if the job has no name, `ErrNameExists` if
+// a job having its name is registered, `ErrIntervalInvalid` if its
+// interval is not positive, and `ErrSchedulerStopped` if the scheduler
+// has been stopped.
+func (m *Maintenance) Register(job MaintenanceJob) error {
+	if job.Name == "" {
+		return ErrNameEmpty
+	}
+	if job.Interval <= 0 || job.Run == nil {
+		return ErrIntervalInvalid
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stopped {
+		return ErrSchedulerStopped
+	}
+	if _, ok := m.jobs[job.Name]; ok {
+		return ErrNameExists
+	}
+	j := &maintJob{
+		job:     job,
+		status:  MaintenanceStatus{Name: job.Name},
+		trigger: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	m.jobs[job.Name] = j
+	if m.started {
+		m.launch(j)
+	}
+	return nil
+}
+
+// Unregister removes the job having the given name from this
+// scheduler.  A run in progress completes.  It answers
+// `ErrNameUnknown` if no such job is registered.
+func (m *Maintenance) Unregister(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	j, ok := m.jobs[name]
+	if !ok {
+		return ErrNameUnknown
+	}
+	close(j.quit)
+	delete(m.jobs, name)
+	return nil
+}
+
+// Start starts running the registered jobs, and those registered
+// later.  The first run of every job is due after its interval.
+// Starting a started or stopped scheduler does nothing.
+func (m *Maintenance) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.started || m.stopped {
+		return
+	}
+	m.started = true
+	for _, j := range m.jobs {
+		m.launch(j)
+	}
+}
+
+// Stop stops this scheduler: the context of the running jobs is
+// cancelled, and it waits for them to return.  A stopped scheduler can
+// not be started again.
+func (m *Maintenance) Stop() {
+	m.mutex.Lock()
+	if m.stopped {
+		m.mutex.Unlock()
+		return
+	}
+	m.stopped = true
+	m.cancel()
+	m.mutex.Unlock()
+
+	m.wg.Wait()
+}
+
+// Pause holds back the runs that fall due, until `Resume` is called.
+// Runs in progress complete.
+func (m *Maintenance) Pause() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.paused == nil {
+		m.paused = make(chan struct{})
+	}
+}
+
+// Resume lets the runs held back by `Pause` proceed.
+func (m *Maintenance) Resume() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.paused != nil {
+		close(m.paused)
+		m.paused = nil
+	}
+}
+
+// Paused answers `true` if this scheduler is paused.
+func (m *Maintenance) Paused() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.paused != nil
+}
+
+// RunNow makes the job having the given name due immediately, once
+// this scheduler is started; its following run is due after its
+// interval.  Pausing and the concurrency limit apply as usual.  It
+// answers `ErrNameUnknown` if no such job is registered.
+func (m *Maintenance) RunNow(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	j, ok := m.jobs[name]
+	if !ok {
+		return ErrNameUnknown
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default: // already due
+	}
+	return nil
+}
+
+// Jobs answers the status of the registered jobs, in the ascending
+// order of their names.
+func (m *Maintenance) Jobs() []MaintenanceStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	res := make([]MaintenanceStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		res = append(res, j.status)
+	}
+	sort.Sort(maintStatusesByName(res))
+	return res
+}
+
+// launch starts the goroutine running the given job.  The caller
+// should hold the lock of this scheduler.
+func (m *Maintenance) launch(j *maintJob) {
+	m.wg.Add(1)
+	go m.loop(j)
+}
+
+// loop runs the given job whenever it falls due, until it is
+// unregistered or this scheduler is stopped.
+func (m *Maintenance) loop(j *maintJob) {
+	defer m.wg.Done()
+
+	for {
+		t := time.NewTimer(m.delay(j.job.Interval))
+		select {
+		case <-m.ctx.Done():
+			t.Stop()
+			return
+		case <-j.quit:
+			t.Stop()
+			return
+		case <-j.trigger:
+			t.Stop()
+		case <-t.C:
+		}
+
+		if !m.wait(j) {
+			return
+		}
+		m.run(j)
+		<-m.sem
+	}
+}
+
+// delay answers the given interval, extended by a random jitter.
+func (m *Maintenance) delay(interval time.Duration) time.Duration {
+	if m.opts.Jitter == 0 {
+		return interval
+	}
+	m.mutex.Lock()
+	f := m.rnd.Float64()
+	m.mutex.Unlock()
+	return interval + time.Duration(f*m.opts.Jitter*float64(interval))
+}
+
+// wait waits while this scheduler is paused, and then for a free slot
+// of the concurrency limit, which it takes.  It answers `false` if the
+// given job is unregistered, or this scheduler is stopped, meanwhile.
+func (m *Maintenance) wait(j *maintJob) bool {
+	for {
+		m.mutex.Lock()
+		paused := m.paused
+		m.mutex.Unlock()
+		if paused == nil {
+			break
+		}
+		select {
+		case <-m.ctx.Done():
+			return false
+		case <-j.quit:
+			return false
+		case <-paused:
+		}
+	}
+
+	select {
+	case <-m.ctx.Done():
+		return false
+	case <-j.quit:
+		return false
+	case m.sem <- struct{}{}:
+		return true
+	}
+}
+
+// run runs the given job once, recording its status.
+func (m *Maintenance) run(j *maintJob) {
+	m.mutex.Lock()
+	j.status.Running = true
+	m.mutex.Unlock()
+
+	start := time.Now()
+	err := j.job.Run(m.ctx)
+	d := time.Since(start)
+	if err != nil && m.ctx.Err() == nil {
+		logMsg(LogWarn, "maintenance job failed", LogField{"job", j.job.Name}, LogField{"error", err})
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	if err != nil {
+		j.status.Failures++
+	}
+	j.status.LastStart = start
+	j.status.LastDuration = d
+	j.status.LastError = err
+}
+
+// maintStatusesByName sorts job statuses in the ascending order of
+// their names.
+type maintStatusesByName []MaintenanceStatus
+
+func (s maintStatusesByName) Len() int           { return len(s) }
+func (s maintStatusesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s maintStatusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SweepJob answers a maintenance job, named "sweep", that removes the
+// expired entities at the given interval.  See `ExpireNow`, and
+// `Options.SweepInterval` for a sweeper without a scheduler.
+func (db *DB) SweepJob(interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{Name: "sweep", Interval: interval, Run: func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := db.ExpireNow()
+		return err
+	}}
+}
+
+// RetentionJob answers a maintenance job, named "retention", that
+// removes the entities of time series older than their retention
+// periods at the given interval.  See `EnforceRetention`.
+func (db *DB) RetentionJob(interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{Name: "retention", Interval: interval, Run: func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := db.EnforceRetention()
+		return err
+	}}
+}
+
+// CheckJob answers a maintenance job, named "check", that validates
+// the invariants of `flagon` - indexes and references included - at
+// the given interval, using the given options.  Problems found are
+// logged at `LogWarn`.  See `Check`.
+func (db *DB) CheckJob(interval time.Duration, opts CheckOpts) MaintenanceJob {
+	return MaintenanceJob{Name: "check", Interval: interval, Run: func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rep, err := db.Check(opts)
+		if err != nil {
+			return err
+		}
+		for _, p := range rep.Problems {
+			logMsg(LogWarn, "check found a problem", LogField{"kind", p.Kind.String()}, LogField{"namespace", p.Namespace},
+				LogField{"type", p.Type}, LogField{"id", p.ID}, LogField{"detail", p.Detail}, LogField{"repaired", p.Repaired})
+		}
+		return nil
+	}}
+}
+
+// SpaceStatsJob answers a maintenance job, named "space_stats", that
+// records the space usage of the database at the given interval, for
+// use by `ForecastSpace`.  See `RecordSpaceStats`.
+func (db *DB) SpaceStatsJob(interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{Name: "space_stats", Interval: interval, Run: func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := db.RecordSpaceStats()
+		return err
+	}}
+}
+
+// CompactionCheckJob answers a maintenance job, named
+// "compaction_check", that records the space usage of the database at
+// the given interval, and logs at `LogWarn` when compaction is advised
+// at the given garbage threshold.  See `ForecastSpace`.  Since it
+// records space usage too, it replaces `SpaceStatsJob`.
+func (db *DB) CompactionCheckJob(interval time.Duration, garbageThreshold float64) MaintenanceJob {
+	return MaintenanceJob{Name: "compaction_check", Interval: interval, Run: func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := db.ForecastSpace(garbageThreshold)
+		if err != nil {
+			return err
+		}
+		if f.CompactionAdvised {
+			logMsg(LogWarn, "compaction advised", LogField{"garbage_ratio", f.Current.GarbageRatio()},
+				LogField{"file_bytes", f.Current.FileBytes})
+		}
+		return nil
+	}}
+}
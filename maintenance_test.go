@@ -0,0 +1,165 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := testDB.NewMaintenance(&MaintenanceOpts{Concurrency: 1})
+	defer m.Stop()
+
+	var running, most, runs int32
+	release := make(chan struct{})
+	slow := func(ctx context.Context) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&most)
+			if n <= old || atomic.CompareAndSwapInt32(&most, old, n) {
+				break
+			}
+		}
+		defer atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&runs, 1)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, name := range []string{"job_b", "job_a"} {
+		if err := m.Register(MaintenanceJob{Name: name, Interval: time.Hour, Run: slow}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing := errors.New("failed")
+	if err := m.Register(MaintenanceJob{Name: "job_fail", Interval: time.Hour, Run: func(context.Context) error { return failing }}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range []MaintenanceJob{
+		{Name: "", Interval: time.Hour, Run: slow},
+		{Name: "job_a", Interval: time.Hour, Run: slow},
+		{Name: "job_c", Interval: 0, Run: slow},
+		{Name: "job_d", Interval: time.Hour},
+	} {
+		if err := m.Register(job); err == nil {
+			t.Errorf("%+v registered", job)
+		}
+	}
+	if err := m.RunNow("job_none"); err != ErrNameUnknown {
+		t.Errorf("run unknown: %v", err)
+	}
+
+	// Jobs run only once started, one at a time.
+	m.RunNow("job_a")
+	m.RunNow("job_b")
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != 0 {
+		t.Fatal("ran before starting")
+	}
+	m.Start()
+	waitFor(t, "a run", func() bool { return atomic.LoadInt32(&runs) == 1 })
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Error("concurrency limit exceeded")
+	}
+	release <- struct{}{}
+	waitFor(t, "both runs", func() bool { return atomic.LoadInt32(&runs) == 2 })
+	release <- struct{}{}
+	waitFor(t, "idle", func() bool { return atomic.LoadInt32(&running) == 0 })
+	if atomic.LoadInt32(&most) != 1 {
+		t.Errorf("%d jobs ran at once", most)
+	}
+
+	// Runs are held back while paused.
+	m.Pause()
+	if !m.Paused() {
+		t.Error("not paused")
+	}
+	m.RunNow("job_fail")
+	time.Sleep(10 * time.Millisecond)
+	if st := m.Jobs(); st[2].Runs != 0 {
+		t.Errorf("ran while paused: %+v", st[2])
+	}
+	m.Resume()
+	waitFor(t, "the failing run", func() bool { return m.Jobs()[2].Runs == 1 })
+
+	st := m.Jobs()
+	if len(st) != 3 || st[0].Name != "job_a" || st[1].Name != "job_b" || st[2].Name != "job_fail" {
+		t.Fatalf("jobs: %+v", st)
+	}
+	if st[0].Runs != 1 || st[0].Failures != 0 || st[0].LastError != nil || st[0].LastStart.IsZero() {
+		t.Errorf("job_a: %+v", st[0])
+	}
+	if st[2].Failures != 1 || st[2].LastError != failing {
+		t.Errorf("job_fail: %+v", st[2])
+	}
+
+	if err := m.Unregister("job_fail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unregister("job_fail"); err != ErrNameUnknown {
+		t.Errorf("unregister twice: %v", err)
+	}
+
+	// Stopping cancels the runs in progress.
+	m.RunNow("job_a")
+	waitFor(t, "a run", func() bool { return atomic.LoadInt32(&running) == 1 })
+	m.Stop()
+	if st := m.Jobs(); st[0].Runs != 2 || st[0].LastError != context.Canceled {
+		t.Errorf("stopped: %+v", st[0])
+	}
+	if err := m.Register(MaintenanceJob{Name: "job_e", Interval: time.Hour, Run: slow}); err != ErrSchedulerStopped {
+		t.Errorf("register when stopped: %v", err)
+	}
+}
+
+func TestMaintenanceJobs(t *testing.T) {
+	m := testDB.NewMaintenance(&MaintenanceOpts{Concurrency: 4, Jitter: 0.5})
+	for _, job := range []MaintenanceJob{
+		testDB.SweepJob(time.Hour),
+		testDB.CheckJob(time.Hour, CheckOpts{}),
+		testDB.SpaceStatsJob(time.Hour),
+	} {
+		if err := m.Register(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Start()
+	for _, name := range []string{"sweep", "check", "space_stats"} {
+		m.RunNow(name)
+	}
+	waitFor(t, "the jobs", func() bool {
+		for _, st := range m.Jobs() {
+			if st.Runs == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	m.Stop()
+	for _, st := range m.Jobs() {
+		if st.LastError != nil {
+			t.Errorf("%s: %v", st.Name, st.LastError)
+		}
+	}
+}
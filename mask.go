@@ -0,0 +1,253 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/js-ojus/flagon/expr"
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// MaskDefn declares how the fields of an entity type are transformed
+// when they are read through a masked view.  It maps field names to
+// expressions (see package `expr`), which may refer to any field of
+// the original entity by name.  For instance:
+//
+//	{
+//		"email": "concat(hash(email), \"@example.com\")",
+//		"phone": "mask(phone, 4)",
+//		"notes": "null"
+//	}
+//
+// An expression answering `null` removes the field.  Fields not
+// mentioned are passed through unchanged.
+//
+// Since `hash` is deterministic, the same input is always transformed
+// into the same output; references between entities hence remain
+// consistent in the masked data.
+type MaskDefn map[string]string
+
+// mask is a compiled field transformation.
+type mask struct {
+	fd FieldDefn
+	ex *expr.Expr
+}
+
+// masksByID sorts masks in the ascending order of their field IDs.
+type masksByID []mask
+
+func (s masksByID) Len() int           { return len(s) }
+func (s masksByID) Less(i, j int) bool { return s[i].fd.ID < s[j].fd.ID }
+func (s masksByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// MaskedView is a read-only view of the instances of an entity type,
+// whose fields are transformed as declared in a `MaskDefn`.  It
+// conforms to `EntityType`; however, `Put` and `Delete` answer
+// `ErrReadOnly`.
+//
+// Masked views are meant to supply production-shaped data to lower
+// environments without exposing personally identifiable information.
+type MaskedView struct {
+	et    *entityType
+	masks []mask
+}
+
+// MaskedView answers a masked view of the instances of the given
+// entity type in the given namespace.  All the fields named in the
+// given definition, and referred to by its expressions, should be
+// defined in the entity type.
+func (db *DB) MaskedView(ns *Namespace, ed *EntityTypeDefn, md MaskDefn) (*MaskedView, error) {
+	mv := &MaskedView{et: &entityType{db: db, ns: ns, defn: ed}}
+	for name, src := range md {
+		fd, err := ed.Field(name)
+		if err != nil {
+			return nil, err
+		}
+		ex, err := expr.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for _, v := range ex.Vars() {
+			_, err = ed.Field(v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		mv.masks = append(mv.masks, mask{fd: fd, ex: ex})
+	}
+	sort.Sort(masksByID(mv.masks))
+
+	return mv, nil
+}
+
+// Name answers the name of the underlying entity type.
+func (mv *MaskedView) Name() string {
+	return mv.et.Name()
+}
+
+// Get answers the masked document having the given ID.
+func (mv *MaskedView) Get(id uint64) (Entity, error) {
+	e, err := mv.et.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d := e.(*Document)
+	err = mv.apply(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Put answers `ErrReadOnly`.
+func (mv *MaskedView) Put(Entity) error {
+	return ErrReadOnly
+}
+
+// Delete answers `ErrReadOnly`.
+func (mv *MaskedView) Delete(uint64) error {
+	return ErrReadOnly
+}
+
+// Search is like that of the underlying entity type, but the
+// predicate receives masked documents.  Masking precedes the
+// selection of `opts.Fields`; so, masks can refer to fields that are
+// not selected.
+func (mv *MaskedView) Search(opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	var err error
+	sel := opts.Fields
+	opts.Fields = nil
+
+	res, serr := mv.et.Search(opts, func(id uint64, e Entity) bool {
+		if err != nil {
+			return false
+		}
+		d := e.(*Document)
+		err = mv.apply(d)
+		if err != nil {
+			return false
+		}
+		if sel != nil {
+			d.retain(sel)
+		}
+		return fn(id, d)
+	})
+	if serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Export writes all the masked documents to the given writer, in the
+// export stream format (see `DB.Export`).  Documents are written
+// unencrypted, so that they can be imported into a database that
+// does not have the keys of this one.  It answers the number of
+// documents written.
+func (mv *MaskedView) Export(w io.Writer) (uint64, error) {
+	et := mv.et
+	var ew *storage.ExportWriter
+
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		var err error
+		ew, err = storage.NewExportWriter(w, et.ns.Name(), et.Name())
+		if err != nil {
+			return err
+		}
+
+		return tx.ForEach(et.ns.Name(), et.Name(), nil, func(k, v []byte) (bool, error) {
+			d := NewDocument(et.defn, binary.BigEndian.Uint64(k))
+			err := et.decode(v, d)
+			if err != nil {
+				return false, err
+			}
+			err = mv.apply(d)
+			if err != nil {
+				return false, err
+			}
+			by, err := d.MarshalBinary()
+			if err != nil {
+				return false, err
+			}
+			return true, ew.Write(k, by)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return ew.Close()
+}
+
+// apply transforms the fields of the given document.  All the
+// expressions are evaluated against the original document, so that
+// the order of masks does not matter.
+func (mv *MaskedView) apply(d *Document) error {
+	env := documentEnv{d}
+	vals := make([]interface{}, len(mv.masks))
+	for i, m := range mv.masks {
+		v, err := m.ex.Eval(env)
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.fd.Name, err)
+		}
+		vals[i] = v
+	}
+
+	for i, m := range mv.masks {
+		if vals[i] == nil {
+			delete(d.fields, m.fd.ID)
+			continue
+		}
+		f, err := newField(m.fd)
+		if err != nil {
+			return err
+		}
+		err = setFieldValue(f, vals[i])
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.fd.Name, err)
+		}
+		d.fields[m.fd.ID] = f
+	}
+
+	return nil
+}
+
+// documentEnv exposes the fields of a document to expressions.
+// Defined fields that the document does not hold answer `null`.
+type documentEnv struct {
+	d *Document
+}
+
+// Lookup conforms to `expr.Env`.
+func (e documentEnv) Lookup(name string) (interface{}, bool) {
+	fd, err := e.d.defn.Field(name)
+	if err != nil {
+		return nil, false
+	}
+	f, ok := e.d.fields[fd.ID]
+	if !ok {
+		return nil, true
+	}
+	return fieldValue(f), true
+}
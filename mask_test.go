@@ -0,0 +1,197 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// heldValue answers the value of the given field of the given
+// document, and `true` if the document holds the field.
+func heldValue(t *testing.T, d *Document, name string) (interface{}, bool) {
+	t.Helper()
+	fd, err := d.defn.Field(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := d.fields[fd.ID]
+	if !ok {
+		return nil, false
+	}
+	return fieldValue(f), true
+}
+
+func TestMaskedView(t *testing.T) {
+	ns := testNamespace(t, "mask_ns")
+	ed := testDefn(t, "mask_person", []testField{
+		{"name", FieldTypeString},
+		{"email", FieldTypeString},
+		{"phone", FieldTypeString},
+		{"notes", FieldTypeString},
+		{"age", FieldTypeUint8},
+	}, func(ed *EntityTypeDefn) {
+		ed.SetCodec(CodecMsgpack)
+	})
+	et := testDB.EntityType(ns, ed)
+	people := []map[string]interface{}{
+		{"name": "Asha", "email": "asha@home.in", "phone": "9876543210", "notes": "private", "age": uint8(30)},
+		{"name": "Ravi", "email": "ravi@work.in", "phone": "9123456789", "notes": "secret", "age": uint8(45)},
+	}
+	var ids []uint64
+	for _, vals := range people {
+		d := testDoc(t, ed, 0, vals)
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID())
+	}
+
+	// Every expression is evaluated against the original document.
+	mv, err := testDB.MaskedView(ns, ed, MaskDefn{
+		"name":  "upper(name)",
+		"email": "concat(hash(email), \"@example.com\")",
+		"phone": "mask(phone, 4)",
+		"notes": "null",
+		"age":   "if(len(name) > 3, age - age % 10, age)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mv.Name() != ed.Name() {
+		t.Errorf("name: %s", mv.Name())
+	}
+
+	check := func(what string, d *Document, vals map[string]interface{}) {
+		t.Helper()
+		want := map[string]interface{}{
+			"name":  strings.ToUpper(vals["name"].(string)),
+			"phone": "******" + vals["phone"].(string)[6:],
+			"age":   vals["age"].(uint8) / 10 * 10,
+		}
+		for name, w := range want {
+			if v, _ := heldValue(t, d, name); v != w {
+				t.Errorf("%s: %s: %v, want %v", what, name, v, w)
+			}
+		}
+		email, _ := heldValue(t, d, "email")
+		if s, ok := email.(string); !ok || len(s) != 28 || !strings.HasSuffix(s, "@example.com") || strings.Contains(s, vals["email"].(string)) {
+			t.Errorf("%s: email: %v", what, email)
+		}
+		if v, ok := heldValue(t, d, "notes"); ok {
+			t.Errorf("%s: notes: %v", what, v)
+		}
+	}
+	for i, id := range ids {
+		e, err := mv.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("get", e.(*Document), people[i])
+	}
+
+	// Masking is deterministic, and leaves the stored entities alone.
+	e1, _ := mv.Get(ids[0])
+	e2, _ := mv.Get(ids[0])
+	v1, _ := heldValue(t, e1.(*Document), "email")
+	v2, _ := heldValue(t, e2.(*Document), "email")
+	if v1 != v2 {
+		t.Errorf("email masked as %v and %v", v1, v2)
+	}
+	e, _ := et.Get(ids[0])
+	if v, _ := heldValue(t, e.(*Document), "notes"); v != "private" {
+		t.Errorf("stored notes: %v", v)
+	}
+
+	if err := mv.Put(testDoc(t, ed, 0, nil)); err != ErrReadOnly {
+		t.Errorf("put: %v", err)
+	}
+	if err := mv.Delete(ids[0]); err != ErrReadOnly {
+		t.Errorf("delete: %v", err)
+	}
+
+	// Predicates see masked documents, restricted to the selected
+	// fields after masking.
+	age, _ := ed.Field("age")
+	res, err := mv.Search(SearchOpts{Fields: []int{int(age.ID)}}, func(id uint64, e Entity) bool {
+		d := e.(*Document)
+		if _, ok := heldValue(t, d, "name"); ok {
+			t.Errorf("search: %d: unselected field held", id)
+		}
+		v, _ := heldValue(t, d, "age")
+		return v == uint8(40)
+	})
+	if err != nil || len(res) != 1 || res[0] != ids[1] {
+		t.Errorf("search: %v, %v", res, err)
+	}
+
+	// Exported documents are masked; importing them replaces the
+	// originals.
+	var buf bytes.Buffer
+	n, err := mv.Export(&buf)
+	if err != nil || n != uint64(len(ids)) {
+		t.Fatalf("export: %d, %v", n, err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("asha@home.in")) {
+		t.Fatal("export holds an unmasked value")
+	}
+	if n, err = testDB.Import(&buf); err != nil || n != uint64(len(ids)) {
+		t.Fatalf("import: %d, %v", n, err)
+	}
+	for i, id := range ids {
+		e, err := et.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("imported", e.(*Document), people[i])
+	}
+}
+
+func TestMaskedViewInvalid(t *testing.T) {
+	ns := testNamespace(t, "mask_ns")
+	ed := testDefn(t, "mask_bad", []testField{{"name", FieldTypeString}, {"age", FieldTypeUint8}}, func(ed *EntityTypeDefn) {
+		ed.SetCodec(CodecMsgpack)
+	})
+	for _, md := range []MaskDefn{
+		{"missing": "null"},
+		{"name": "lower(name"},
+		{"name": "lower(missing)"},
+	} {
+		if _, err := testDB.MaskedView(ns, ed, md); err == nil {
+			t.Errorf("%v: view created", md)
+		}
+	}
+
+	// Values that do not suit their fields are reported when read.
+	et := testDB.EntityType(ns, ed)
+	d := testDoc(t, ed, 0, map[string]interface{}{"name": "x", "age": uint8(1)})
+	if err := et.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	for _, md := range []MaskDefn{
+		{"age": "name"},
+		{"age": "age * 1000"},
+		{"name": "age / 0"},
+	} {
+		mv, err := testDB.MaskedView(ns, ed, md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mv.Get(d.ID()); err == nil {
+			t.Errorf("%v: masked", md)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// MessagePack format bytes used by `CodecMsgpack`.
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpExt8     = 0xc7
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpFixExt4  = 0xd6
+	mpFixExt8  = 0xd7
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpMap16    = 0xde
+	mpFixMap   = 0x80
+	mpFixStr   = 0xa0
+	mpNegFixed = 0xe0
+
+	mpExtTimestamp = 0xff // extension type -1
+)
+
+// msgpackCodec implements `CodecMsgpack`.
+type msgpackCodec struct{}
+
+func (msgpackCodec) size(d *Document) int {
+	n, cnt := 0, 0
+	for _, f := range d.fields {
+		if !f.IsSet() {
+			continue
+		}
+		if f.ID() < 128 {
+			n++
+		} else {
+			n += 2
+		}
+		n += msgpackSize(f)
+		cnt++
+	}
+	if cnt < 16 {
+		return 1 + n
+	}
+	return 3 + n
+}
+
+func (msgpackCodec) encode(by []byte, d *Document) ([]byte, error) {
+	fs := d.setFields()
+	if len(fs) < 16 {
+		by = append(by, mpFixMap|byte(len(fs)))
+	} else {
+		by = append(by, mpMap16)
+		by = appendUint(by, uint64(len(fs)), 2)
+	}
+
+	for _, f := range fs {
+		if f.ID() < 128 {
+			by = append(by, f.ID())
+		} else {
+			by = append(by, mpUint8, f.ID())
+		}
+
+		var err error
+		by, err = msgpackAppendValue(by, fieldValue(f))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+func (msgpackCodec) decode(r *fieldReader, d *Document) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return ErrPayloadInvalid
+	}
+	var n int
+	switch {
+	case b&0xf0 == mpFixMap:
+		n = int(b & 0x0f)
+	case b == mpMap16:
+		l, err := readUint(r, 2)
+		if err != nil {
+			return ErrPayloadInvalid
+		}
+		n = int(l)
+	default:
+		return ErrPayloadInvalid
+	}
+
+	for i := 0; i < n; i++ {
+		k, err := msgpackReadValue(r)
+		if err != nil {
+			return err
+		}
+		id, err := toUint64(k, math.MaxUint8)
+		if err != nil {
+			return ErrPayloadInvalid
+		}
+		v, err := msgpackReadValue(r)
+		if err != nil {
+			return err
+		}
+
+		fd, ok := d.defn.fieldByID(uint8(id))
+		if !ok || v == nil {
+			// Values are self-delimiting; unknown fields are skipped.
+			continue
+		}
+		f, err := newField(fd)
+		if err != nil {
+			return err
+		}
+		err = setFieldValue(f, v)
+		if err != nil {
+			return err
+		}
+		d.fields[fd.ID] = f
+	}
+
+	return nil
+}
+
+// msgpackSize answers the length of the value of the given field,
+// once encoded by `msgpackAppendValue`.
+func msgpackSize(f Field) int {
+	switch f := f.(type) {
+	case *FieldBool:
+		return 1
+	case *FieldTime:
+		return 15
+	case *FieldString:
+		l := len(f.Get())
+		switch {
+		case l < 32:
+			return 1 + l
+		case l < 256:
+			return 2 + l
+		default:
+			return 3 + l
+		}
+	default:
+		// A format byte, followed by the big-endian value.
+		return 1 + fieldSize(f)
+	}
+}
+
+// msgpackAppendValue appends the given field value to the given
+// slice, using the format corresponding to its Go type.
+func msgpackAppendValue(by []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(by, mpTrue), nil
+		}
+		return append(by, mpFalse), nil
+	case int8:
+		return appendUint(append(by, mpInt8), uint64(v), 1), nil
+	case int16:
+		return appendUint(append(by, mpInt16), uint64(v), 2), nil
+	case int32:
+		return appendUint(append(by, mpInt32), uint64(v), 4), nil
+	case int64:
+		return appendUint(append(by, mpInt64), uint64(v), 8), nil
+	case uint8:
+		return appendUint(append(by, mpUint8), uint64(v), 1), nil
+	case uint16:
+		return appendUint(append(by, mpUint16), uint64(v), 2), nil
+	case uint32:
+		return appendUint(append(by, mpUint32), uint64(v), 4), nil
+	case uint64:
+		return appendUint(append(by, mpUint64), v, 8), nil
+	case float32:
+		return appendUint(append(by, mpFloat32), uint64(math.Float32bits(v)), 4), nil
+	case float64:
+		return appendUint(append(by, mpFloat64), math.Float64bits(v), 8), nil
+	case string:
+		l := len(v)
+		switch {
+		case l < 32:
+			by = append(by, mpFixStr|byte(l))
+		case l < 256:
+			by = append(by, mpStr8, byte(l))
+		default:
+			by = appendUint(append(by, mpStr16), uint64(l), 2)
+		}
+		return append(by, v...), nil
+	case time.Time:
+		// Timestamp 96: nanoseconds uint32 | seconds int64.
+		by = append(by, mpExt8, 12, mpExtTimestamp)
+		by = appendUint(by, uint64(v.Nanosecond()), 4)
+		return appendUint(by, uint64(v.Unix()), 8), nil
+	default:
+		return nil, ErrFieldTypeUnsupported
+	}
+}
+
+// msgpackReadValue reads a single value of any of the formats that
+// `msgpackAppendValue` appends.  Integers are answered as `int64` or
+// `uint64`, floating point numbers as `float32` or `float64`, and
+// `nil` as `nil`.
+func msgpackReadValue(r *fieldReader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+
+	switch {
+	case b < 0x80:
+		return uint64(b), nil
+	case b >= mpNegFixed:
+		return int64(int8(b)), nil
+	case b&0xe0 == mpFixStr:
+		return msgpackReadString(r, int(b&0x1f))
+	}
+
+	var v interface{}
+	switch b {
+	case mpNil:
+		return nil, nil
+	case mpFalse:
+		return false, nil
+	case mpTrue:
+		return true, nil
+	case mpInt8:
+		var u uint64
+		u, err = readUint(r, 1)
+		v = int64(int8(u))
+	case mpInt16:
+		var u uint64
+		u, err = readUint(r, 2)
+		v = int64(int16(u))
+	case mpInt32:
+		var u uint64
+		u, err = readUint(r, 4)
+		v = int64(int32(u))
+	case mpInt64:
+		var u uint64
+		u, err = readUint(r, 8)
+		v = int64(u)
+	case mpUint8:
+		var u uint64
+		u, err = readUint(r, 1)
+		v = u
+	case mpUint16:
+		var u uint64
+		u, err = readUint(r, 2)
+		v = u
+	case mpUint32:
+		var u uint64
+		u, err = readUint(r, 4)
+		v = u
+	case mpUint64:
+		var u uint64
+		u, err = readUint(r, 8)
+		v = u
+	case mpFloat32:
+		var u uint64
+		u, err = readUint(r, 4)
+		v = math.Float32frombits(uint32(u))
+	case mpFloat64:
+		var u uint64
+		u, err = readUint(r, 8)
+		v = math.Float64frombits(u)
+	case mpStr8:
+		var l uint64
+		l, err = readUint(r, 1)
+		if err == nil {
+			return msgpackReadString(r, int(l))
+		}
+	case mpStr16:
+		var l uint64
+		l, err = readUint(r, 2)
+		if err == nil {
+			return msgpackReadString(r, int(l))
+		}
+	case mpStr32:
+		var l uint64
+		l, err = readUint(r, 4)
+		if err == nil {
+			return msgpackReadString(r, int(l))
+		}
+	case mpFixExt4, mpFixExt8, mpExt8:
+		return msgpackReadTimestamp(r, b)
+	default:
+		return nil, ErrPayloadInvalid
+	}
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+
+	return v, nil
+}
+
+// msgpackReadString reads a string of the given length.
+func msgpackReadString(r *fieldReader, l int) (interface{}, error) {
+	by, err := r.next(l)
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+
+	return r.string(by), nil
+}
+
+// msgpackReadTimestamp reads a timestamp extension value in any of its
+// three forms, whose format byte is given.  Time values are answered
+// in UTC.
+func msgpackReadTimestamp(r *fieldReader, b byte) (interface{}, error) {
+	l := 4
+	switch b {
+	case mpFixExt8:
+		l = 8
+	case mpExt8:
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrPayloadInvalid
+		}
+		l = int(n)
+	}
+	typ, err := r.ReadByte()
+	if err != nil || typ != mpExtTimestamp || l > r.Len() {
+		return nil, ErrPayloadInvalid
+	}
+	by := make([]byte, l)
+	_, err = io.ReadFull(r, by)
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+
+	var sec, nsec int64
+	switch l {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(by))
+	case 8:
+		n := binary.BigEndian.Uint64(by)
+		nsec = int64(n >> 34)
+		sec = int64(n & 0x3ffffffff)
+	case 12:
+		nsec = int64(binary.BigEndian.Uint32(by[:4]))
+		sec = int64(binary.BigEndian.Uint64(by[4:]))
+	default:
+		return nil, ErrPayloadInvalid
+	}
+
+	return time.Unix(sec, nsec).UTC(), nil
+}
@@ -0,0 +1,86 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// MultiGetter is implemented by entity types that can read many
+// entities in a single transaction.
+type MultiGetter interface {
+	// GetMany answers the entities having the given IDs, in the given
+	// order, together with the IDs of those that could not be found.
+	GetMany([]uint64) ([]Entity, []uint64, error)
+}
+
+// GetMany answers the documents having the given IDs, in the given
+// order, reading and decoding all of them in a single read
+// transaction, rather than in one transaction per document.  Documents
+// that do not exist, are soft-deleted or have expired are answered as
+// `nil`; their IDs are answered as misses, in the given order.
+// Otherwise, documents are read as `Get` reads them.  An ID that is
+// given more than once is answered at each of its positions.
+func (et *entityType) GetMany(ids []uint64) ([]Entity, []uint64, error) {
+	for _, id := range ids {
+		if id == 0 {
+			return nil, nil, ErrIdentifierZero
+		}
+	}
+
+	ctx, sp := et.startSpan(context.Background(), spanGetMany)
+	res, misses, err := et.getMany(ctx, ids)
+	if err == nil {
+		sp.SetAttribute(attrResults, len(ids)-len(misses))
+	}
+	endSpan(sp, err)
+	if err != nil {
+		return nil, nil, et.entityError(opGet, 0, err)
+	}
+	return res, misses, nil
+}
+
+// getMany implements `GetMany`.
+func (et *entityType) getMany(ctx context.Context, ids []uint64) ([]Entity, []uint64, error) {
+	res := make([]Entity, len(ids))
+	var misses, repair []uint64
+	now := et.db.now().UnixNano()
+	c := et.cache()
+	err := et.view(ctx, func(tx *storage.Tx) error {
+		for i, id := range ids {
+			d, err := et.getLive(tx, c, id, now)
+			if err != nil {
+				if err != storage.ErrKeyUnknown {
+					return err
+				}
+				misses = append(misses, id)
+				continue
+			}
+			res[i] = d
+			if et.needsRepair(d) {
+				repair = append(repair, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	et.readRepair(repair)
+	return res, misses, nil
+}
@@ -0,0 +1,148 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxNameLen is the maximum length in bytes of names, whatever the
+// naming policy.  Storage records the names of entity types prefixed
+// by their lengths, as single bytes.
+const MaxNameLen = 255
+
+// NamePolicy validates the names of namespaces, entity types, fields,
+// indexes, validation rules and relations.
+type NamePolicy interface {
+	// ValidName answers `nil` if the given name is acceptable, and
+	// `ErrNameInvalid`, or a more specific error, otherwise.
+	ValidName(string) error
+}
+
+// NameRules is a configurable `NamePolicy`.  Names should begin with a
+// letter, can contain letters, digits and underscores, and should
+// not end with an underscore.  Its zero value is the default policy:
+// letters are lowercase ASCII ones, digits are ASCII ones, and names
+// should be of length 2 or more.
+//
+// N.B. Validation rules refer to fields by their names; fields having
+// names that are not ASCII identifiers can not be used in rules.
+type NameRules struct {
+	Unicode bool // letters and digits of any script?
+	Upper   bool // uppercase letters too?
+	Hyphens bool // hyphens too, wherever underscores are allowed?
+	MinLen  int  // minimum length in characters; 2 if not positive
+	MaxLen  int  // maximum length in bytes; `MaxNameLen` if not positive or greater
+}
+
+// ValidName conforms to `NamePolicy`.
+func (nr NameRules) ValidName(name string) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+	max := nr.MaxLen
+	if max <= 0 || max > MaxNameLen {
+		max = MaxNameLen
+	}
+	if len(name) > max {
+		return ErrNameTooLong
+	}
+	if !utf8.ValidString(name) {
+		return ErrNameInvalid
+	}
+	min := nr.MinLen
+	if min <= 0 {
+		min = 2
+	}
+	if utf8.RuneCountInString(name) < min {
+		return ErrNameInvalid
+	}
+
+	first, last := true, rune(0)
+	for _, c := range name {
+		switch {
+		case nr.letter(c):
+		case first:
+			return ErrNameInvalid
+		case nr.digit(c), c == '_', c == '-' && nr.Hyphens:
+		default:
+			return ErrNameInvalid
+		}
+		first, last = false, c
+	}
+	if last == '_' || last == '-' {
+		return ErrNameInvalid
+	}
+	return nil
+}
+
+// letter answers `true` if the given character is a letter that these
+// rules allow.
+func (nr NameRules) letter(c rune) bool {
+	if c < utf8.RuneSelf {
+		return c >= 'a' && c <= 'z' || nr.Upper && c >= 'A' && c <= 'Z'
+	}
+	return nr.Unicode && unicode.IsLetter(c) && (nr.Upper || !unicode.IsUpper(c))
+}
+
+// digit answers `true` if the given character is a digit that these
+// rules allow.
+func (nr NameRules) digit(c rune) bool {
+	if c < utf8.RuneSelf {
+		return c >= '0' && c <= '9'
+	}
+	return nr.Unicode && unicode.IsDigit(c)
+}
+
+// The naming policy in use.  Since namespaces and entity type
+// definitions are created independently of database handles, the
+// policy is shared by all of them; that given to the latest `Open` or
+// `SetNamePolicy` prevails.
+var (
+	namesMutex sync.RWMutex
+	names      NamePolicy = NameRules{}
+)
+
+// SetNamePolicy makes the given policy the one that validates names;
+// the default policy if it is `nil`.  Names are validated when they
+// are created, and when definitions are read; hence, the policy
+// should be set before any, and should accept the names already in
+// use.  See `Options.Names`.
+func SetNamePolicy(p NamePolicy) {
+	if p == nil {
+		p = NameRules{}
+	}
+	namesMutex.Lock()
+	names = p
+	namesMutex.Unlock()
+}
+
+// validName answers the error, if any, of the given name, as per the
+// naming policy in use.
+func validName(name string) error {
+	namesMutex.RLock()
+	p := names
+	namesMutex.RUnlock()
+
+	if name == "" {
+		return ErrNameEmpty
+	}
+	if len(name) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	return p.ValidName(name)
+}
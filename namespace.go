@@ -15,13 +15,13 @@
 package flagon
 
 import (
-	"regexp"
+	"context"
+	"sort"
 	"sync"
-)
+	"time"
 
-// nsNameRegexp holds the compiled regular expression that validates
-// namespace names.
-var nameRegexp *regexp.Regexp
+	"github.com/js-ojus/flagon/internal/storage"
+)
 
 // Namespace provides a logical grouping of related data.
 //
@@ -38,16 +38,14 @@ type Namespace struct {
 
 // NewNamespace creates and registers a namespace with `flagon`.
 //
-// Namespace names must begin with an ASCII letter or a digit, can
-// contain ASCII letters, digits, hyphens and underscores, and must
-// not end with a hyphen or an underscore.  Names must be of length 2
-// or more.  Names must be lowercase.
+// Namespace names should conform to the naming policy in use.  By
+// default, they should begin with a lowercase ASCII letter, can
+// contain lowercase ASCII letters, digits and underscores, should not
+// end with an underscore, and should be of length 2 or more.  See
+// `NameRules`.
 func NewNamespace(name string) (*Namespace, error) {
-	if name == "" {
-		return nil, ErrNameEmpty
-	}
-	if !nameRegexp.MatchString(name) {
-		return nil, ErrNameInvalid
+	if err := validName(name); err != nil {
+		return nil, err
 	}
 
 	return &Namespace{name: name, buckets: make([]string, 0, 1)}, nil
@@ -68,3 +66,162 @@ func (ns *Namespace) Buckets() []string {
 	copy(bs, ns.buckets)
 	return bs
 }
+
+// addBucket adds the given name to the buckets of this namespace, if
+// it is not among them already.
+func (ns *Namespace) addBucket(name string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	i := sort.SearchStrings(ns.buckets, name)
+	if i < len(ns.buckets) && ns.buckets[i] == name {
+		return
+	}
+	ns.buckets = append(ns.buckets, "")
+	copy(ns.buckets[i+1:], ns.buckets[i:])
+	ns.buckets[i] = name
+}
+
+// removeBucket removes the given name from the buckets of this
+// namespace, if it is among them.
+func (ns *Namespace) removeBucket(name string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	i := sort.SearchStrings(ns.buckets, name)
+	if i < len(ns.buckets) && ns.buckets[i] == name {
+		ns.buckets = append(ns.buckets[:i], ns.buckets[i+1:]...)
+	}
+}
+
+// updateBucket validates the given entity type name, and runs the
+// given function in a read-write transaction of the open database.
+func (ns *Namespace) updateBucket(name string, fn func(*storage.Tx) error) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	sdb, err := storage.DbInstance()
+	if err != nil {
+		return err
+	}
+
+	return sdb.Update(fn)
+}
+
+// CreateEntityType creates the bucket of the given entity type in this
+// namespace, if it does not exist already, and adds it to the buckets
+// of this namespace.  Otherwise, buckets are created when the first
+// instances of their entity types are stored.  The database should be
+// open.
+func (ns *Namespace) CreateEntityType(ed *EntityTypeDefn) error {
+	err := ns.updateBucket(ed.Name(), func(tx *storage.Tx) error {
+		return tx.CreateEntityType(ns.name, ed.Name())
+	})
+	if err != nil {
+		return err
+	}
+
+	ns.addBucket(ed.Name())
+	return nil
+}
+
+// DropEntityType removes the bucket of the entity type having the
+// given name from this namespace, together with the histories,
+// revisions and reference counts of its former instances.  Audit logs
+// and batch logs are retained.  Since the sequence of the entity type
+// is removed too, IDs are reused if it is created again.
+//
+// Dropping is guarded: it answers `ErrEntityTypeNotEmpty` if the entity
+// type has instances - soft-deleted and expired ones included - and
+// `ErrTypeFrozen` if it is frozen.  Use `Truncate` first to remove its
+// instances.  It answers `ErrNameUnknown` if the entity type has no
+// bucket in this namespace.
+func (ns *Namespace) DropEntityType(name string) error {
+	err := ns.updateBucket(name, func(tx *storage.Tx) error {
+		return tx.DropEntityType(ns.name, name, time.Now().UnixNano())
+	})
+	if err != nil {
+		if err == storage.ErrBucketUnknown {
+			return ErrNameUnknown
+		}
+		return err
+	}
+
+	ns.removeBucket(name)
+	quotas.reset(ns.name, name)
+	return nil
+}
+
+// Truncate removes all the instances of the entity type having the
+// given name from this namespace, including soft-deleted and expired
+// ones, together with their labels, expiry times, provenance and
+// references.  As when instances are deleted, their histories,
+// revisions and audit logs are retained, and their IDs are not
+// reused.  The removals are recorded in the change log, if enabled.
+//
+// It answers `ErrEntityTypeReferenced` if instances of other entity
+// types refer to its instances, and `ErrTypeFrozen` if it is frozen.
+// It answers the number of instances removed.
+func (ns *Namespace) Truncate(name string) (uint64, error) {
+	var n uint64
+	err := ns.updateBucket(name, func(tx *storage.Tx) error {
+		var err error
+		n, err = tx.Truncate(ns.name, name, time.Now().UnixNano())
+		return err
+	})
+	quotas.reset(ns.name, name)
+	return n, err
+}
+
+// DeleteNamespace removes the namespace having the given name from the
+// database: the instances of all its entity types, together with
+// their labels, references, histories and other data.  Entity type
+// definitions are retained, since they are not specific to namespaces.
+//
+// Unless `force` is `true`, it answers `ErrNamespaceNotEmpty` if any of
+// its entity types has instances - soft-deleted and expired ones
+// included.  It answers `ErrTypeFrozen` if any of them is frozen, and
+// `ErrNameUnknown` if the namespace does not exist.  Deletions are
+// recorded in the administrative event log.  See `AdminLog`.
+func (db *DB) DeleteNamespace(name string, force bool) error {
+	start := time.Now()
+	err := validName(name)
+	if err == nil {
+		err = db.sdb.DeleteNamespace(name, force)
+		if err == storage.ErrBucketUnknown {
+			err = ErrNameUnknown
+		}
+	}
+	quotas.purge()
+	db.logAdmin(context.Background(), AdminDeleteNamespace, name, "", map[string]interface{}{"force": force}, start, err)
+	return err
+}
+
+// RenameNamespace gives the namespace having the given old name the
+// given new name, atomically.  Its instances retain their IDs, and
+// their entity types retain their sequences and frozen states.
+// Handles of its entity types obtained earlier should not be used
+// thereafter.
+//
+// It answers `ErrNameUnknown` if the namespace does not exist, and
+// `ErrNameExists` if the new name is taken.  Renames are recorded in
+// the administrative event log.  See `AdminLog`.
+func (db *DB) RenameNamespace(old, new string) error {
+	start := time.Now()
+	err := validName(old)
+	if err == nil {
+		err = validName(new)
+	}
+	if err == nil {
+		err = db.sdb.RenameNamespace(old, new)
+		switch err {
+		case storage.ErrBucketUnknown:
+			err = ErrNameUnknown
+		case storage.ErrBucketExists:
+			err = ErrNameExists
+		}
+	}
+	quotas.purge()
+	db.logAdmin(context.Background(), AdminRenameNamespace, old, "", map[string]interface{}{"to": new}, start, err)
+	return err
+}
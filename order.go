@@ -0,0 +1,372 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// sortRunLen is the number of matching entities that an ordered search
+// of an unindexed field sorts in memory, before spilling them to a
+// temporary file.
+const sortRunLen = 1 << 16
+
+// searchOrdered passes the documents to the given predicate, as
+// `Search` does, and answers the IDs of those that satisfy it in the
+// order of the values of the field given to `SearchOpts.OrderBy`.
+// Null values precede all others.
+//
+// If an index of the entity type begins with the field, the index is
+// walked in order - preferring one having only that field - and the
+// search stops once `opts.Limit` documents match.  Entities having
+// equal values are then in the order of the other fields of the index,
+// and of their IDs; and, until migrated, entities stored at earlier
+// schema versions are in the order of their values as stored.
+//
+// Otherwise, all the documents from `opts.StartAt` are scanned, and
+// the matching ones are sorted by an external merge sort, using
+// temporary files once they are many.  Entities having equal values
+// are then in the order of their IDs.
+//
+// The descending order is the reverse of the ascending one.
+// `opts.StartAt` continues to exclude documents having lesser IDs.
+func (et *entityType) searchOrdered(ctx context.Context, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	fd, err := et.defn.Field(opts.orderBy)
+	if err != nil {
+		return nil, err
+	}
+	if fd.Ftype == FieldTypeLink || fd.Ftype == FieldTypeCollection {
+		return nil, ErrFieldTypeUnsupported
+	}
+
+	var index string
+	for _, ix := range et.defn.Indexes() {
+		if ix.Fields[0] == fd.Name && (index == "" || len(ix.Fields) == 1) {
+			index = ix.Name
+		}
+	}
+	if index != "" {
+		return et.walkIndex(ctx, index, opts, fn)
+	}
+	return et.sortDocs(ctx, fd, opts, fn)
+}
+
+// walkIndex passes the documents to the given predicate in the order
+// of the given index, as `searchOrdered` does.
+func (et *entityType) walkIndex(ctx context.Context, index string, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	res := make([]uint64, 0, 8)
+	var scanned uint64
+	var repairs []uint64
+	now := et.db.now().UnixNano()
+
+	err := et.view(ctx, func(tx *storage.Tx) error {
+		visit := func(id uint64) (bool, error) {
+			if id < opts.StartAt {
+				return true, nil
+			}
+			if opts.MaxScanned > 0 && scanned == opts.MaxScanned {
+				return false, ErrScanLimit
+			}
+			if scanned%searchCheckEvery == 0 && scanned > 0 {
+				if err := ctx.Err(); err != nil {
+					return false, err
+				}
+			}
+			scanned++
+			v, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+			if err != nil {
+				if err == storage.ErrKeyUnknown {
+					return true, nil
+				}
+				return false, err
+			}
+			d, err := et.searchDoc(tx, id, v, opts, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			if et.needsRepair(d) {
+				repairs = append(repairs, id)
+			}
+
+			if fn(id, d) {
+				res = append(res, id)
+			}
+			return opts.Limit == 0 || uint64(len(res)) < opts.Limit, nil
+		}
+
+		if opts.desc {
+			return tx.ScanIndexReverse(et.ns.Name(), et.Name(), index, visit)
+		}
+		return tx.ScanIndex(et.ns.Name(), et.Name(), index, nil, nil, visit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	et.readRepair(repairs)
+	return res, nil
+}
+
+// sortDocs passes the documents to the given predicate in the order of
+// their IDs, and sorts the matching ones by the values of the given
+// field, as `searchOrdered` does.
+func (et *entityType) sortDocs(ctx context.Context, fd FieldDefn, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	if opts.Fields != nil {
+		opts.Fields = append(opts.Fields[:len(opts.Fields):len(opts.Fields)], int(fd.ID))
+	}
+	start := EntityKey{id: opts.StartAt}.Key()
+	var scanned uint64
+	var repairs []uint64
+	now := et.db.now().UnixNano()
+
+	s := &sorter{desc: opts.desc}
+	defer s.close()
+	err := et.view(ctx, func(tx *storage.Tx) error {
+		return tx.ForEach(et.ns.Name(), et.Name(), start, func(k, v []byte) (bool, error) {
+			if opts.MaxScanned > 0 && scanned == opts.MaxScanned {
+				return false, ErrScanLimit
+			}
+			if scanned%searchCheckEvery == 0 && scanned > 0 {
+				if err := ctx.Err(); err != nil {
+					return false, err
+				}
+			}
+			scanned++
+			id := binary.BigEndian.Uint64(k)
+			d, err := et.searchDoc(tx, id, v, opts, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			if et.needsRepair(d) {
+				repairs = append(repairs, id)
+			}
+
+			if fn(id, d) {
+				err = s.add(sortEntry{key: appendIndexValue(nil, d.fields[fd.ID]), id: id})
+			}
+			return err == nil, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	et.readRepair(repairs)
+
+	res := make([]uint64, 0, 8)
+	err = s.each(func(id uint64) bool {
+		res = append(res, id)
+		return opts.Limit == 0 || uint64(len(res)) < opts.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// sortEntry is a matching entity of an ordered search, keyed by the
+// order-preserving encoding of the value of the ordering field.
+type sortEntry struct {
+	key []byte
+	id  uint64
+}
+
+// less answers `true` if the first entry precedes the second in the
+// given order.
+func (e sortEntry) less(o sortEntry, desc bool) bool {
+	c := bytes.Compare(e.key, o.key)
+	if desc {
+		return c > 0 || c == 0 && e.id > o.id
+	}
+	return c < 0 || c == 0 && e.id < o.id
+}
+
+// sortRun is a run of entries, sortable in either order.
+type sortRun struct {
+	entries []sortEntry
+	desc    bool
+}
+
+func (s *sortRun) Len() int           { return len(s.entries) }
+func (s *sortRun) Less(i, j int) bool { return s.entries[i].less(s.entries[j], s.desc) }
+func (s *sortRun) Swap(i, j int)      { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+
+// sorter sorts entries by an external merge sort.  Entries are sorted
+// in memory in runs of up to `sortRunLen`, all but the last of which
+// are spilled to temporary files, and the runs are merged.
+type sorter struct {
+	run   sortRun    // run being accumulated
+	files []*os.File // spilled runs
+	desc  bool       // sort in the descending order?
+}
+
+// add adds the given entry, spilling the current run if it is full.
+func (s *sorter) add(e sortEntry) error {
+	s.run.entries = append(s.run.entries, e)
+	if len(s.run.entries) < sortRunLen {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill sorts the current run, and writes it to a temporary file, as
+// a sequence of the lengths of the keys as `uvarint`s, the keys and
+// the IDs as `uint64`s.
+func (s *sorter) spill() error {
+	s.run.desc = s.desc
+	sort.Sort(&s.run)
+
+	f, err := ioutil.TempFile("", "flagon-sort-")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+
+	w := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64 + 8]byte
+	for _, e := range s.run.entries {
+		n := binary.PutUvarint(buf[:], uint64(len(e.key)))
+		_, err = w.Write(buf[:n])
+		if err == nil {
+			_, err = w.Write(e.key)
+		}
+		if err == nil {
+			binary.BigEndian.PutUint64(buf[:8], e.id)
+			_, err = w.Write(buf[:8])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.run.entries = s.run.entries[:0]
+	return w.Flush()
+}
+
+// close removes the temporary files of this sorter.
+func (s *sorter) close() {
+	for _, f := range s.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.files = nil
+}
+
+// each calls the given function with the IDs of the entries added, in
+// order, until it answers `false`.
+func (s *sorter) each(fn func(id uint64) bool) error {
+	s.run.desc = s.desc
+	sort.Sort(&s.run)
+
+	h := &mergeHeap{desc: s.desc}
+	if len(s.run.entries) > 0 {
+		h.sources = append(h.sources, &mergeSource{cur: s.run.entries[0], mem: s.run.entries[1:]})
+	}
+	for _, f := range s.files {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		src := &mergeSource{r: bufio.NewReader(f)}
+		ok, err := src.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.sources = append(h.sources, src)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		src := h.sources[0]
+		if !fn(src.cur.id) {
+			return nil
+		}
+		ok, err := src.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// mergeSource is a sorted run being merged: either the in-memory run,
+// or a spilled one.
+type mergeSource struct {
+	cur sortEntry     // current entry
+	mem []sortEntry   // remaining entries of the in-memory run
+	r   *bufio.Reader // reader of a spilled run
+}
+
+// next advances this source to its next entry, answering `false` if it
+// is exhausted.
+func (ms *mergeSource) next() (bool, error) {
+	if ms.r == nil {
+		if len(ms.mem) == 0 {
+			return false, nil
+		}
+		ms.cur, ms.mem = ms.mem[0], ms.mem[1:]
+		return true, nil
+	}
+
+	n, err := binary.ReadUvarint(ms.r)
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	by := make([]byte, n+8)
+	_, err = io.ReadFull(ms.r, by)
+	if err != nil {
+		return false, err
+	}
+	ms.cur = sortEntry{key: by[:n], id: binary.BigEndian.Uint64(by[n:])}
+	return true, nil
+}
+
+// mergeHeap is a heap of merge sources, by their current entries.  It
+// conforms to `heap.Interface`.
+type mergeHeap struct {
+	sources []*mergeSource
+	desc    bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return h.sources[i].cur.less(h.sources[j].cur, h.desc)
+}
+func (h *mergeHeap) Swap(i, j int)      { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.sources) - 1
+	x := h.sources[n]
+	h.sources = h.sources[:n]
+	return x
+}
@@ -0,0 +1,127 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSearchOrdered(t *testing.T) {
+	ns := testNamespace(t, "ord_ns")
+	ed := testDefn(t, "ord_item", []testField{
+		{"name", FieldTypeString},
+		{"qty", FieldTypeInt32},
+	}, func(ed *EntityTypeDefn) {
+		ed.AddIndex("by_qty", "qty")
+	})
+	et := testDB.EntityType(ns, ed)
+	for _, vals := range []map[string]interface{}{
+		{"name": "pear", "qty": 3},
+		{"name": "fig", "qty": -1},
+		{"qty": 3},
+		{"name": "apple"},
+		{"name": "fig", "qty": 7},
+	} {
+		if err := et.Put(testDoc(t, ed, 0, vals)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := func(uint64, Entity) bool { return true }
+	for _, c := range []struct {
+		opts SearchOpts
+		want []uint64
+	}{
+		// Unindexed fields are sorted.
+		{SearchOpts{}.OrderBy("name", true), []uint64{3, 4, 2, 5, 1}},
+		{SearchOpts{}.OrderBy("name", false), []uint64{1, 5, 2, 4, 3}},
+		{SearchOpts{Limit: 2}.OrderBy("name", false), []uint64{1, 5}},
+		{SearchOpts{StartAt: 3}.OrderBy("name", true), []uint64{3, 4, 5}},
+
+		// Indexed fields walk their indexes.
+		{SearchOpts{}.OrderBy("qty", true), []uint64{4, 2, 1, 3, 5}},
+		{SearchOpts{}.OrderBy("qty", false), []uint64{5, 3, 1, 2, 4}},
+		{SearchOpts{Limit: 3}.OrderBy("qty", true), []uint64{4, 2, 1}},
+		{SearchOpts{StartAt: 2}.OrderBy("qty", false), []uint64{5, 3, 2, 4}},
+	} {
+		ids, err := et.Search(c.opts, all)
+		if err != nil || !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%+v: %v, %v", c.opts, ids, err)
+		}
+	}
+
+	// The predicate still selects the entities.
+	ids, err := et.Search(SearchOpts{}.OrderBy("qty", false), func(_ uint64, e Entity) bool {
+		f, _ := e.(*Document).Field("name")
+		return f.IsSet() && f.(*FieldString).Get() == "fig"
+	})
+	if err != nil || !reflect.DeepEqual(ids, []uint64{5, 2}) {
+		t.Errorf("figs: %v, %v", ids, err)
+	}
+
+	if _, err := et.Search(SearchOpts{}.OrderBy("size", true), all); err != ErrNameUnknown {
+		t.Errorf("unknown field: %v", err)
+	}
+}
+
+func TestSorter(t *testing.T) {
+	for _, desc := range []bool{false, true} {
+		s := &sorter{desc: desc}
+		r := rand.New(rand.NewSource(1))
+		var want []sortEntry
+		for i := 0; i < 1000; i++ {
+			e := sortEntry{key: []byte{byte(r.Intn(50))}, id: uint64(i + 1)}
+			if err := s.add(e); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, e)
+
+			// Spill runs of varying lengths, as `add` would.
+			if i%300 == 299 || i == 10 {
+				if err := s.spill(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		wr := &sortRun{entries: want, desc: desc}
+		sortRunInsertion(wr)
+
+		var got []uint64
+		if err := s.each(func(id uint64) bool { got = append(got, id); return true }); err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		if len(got) != len(want) {
+			t.Fatalf("desc %v: %d entries", desc, len(got))
+		}
+		for i, e := range wr.entries {
+			if got[i] != e.id {
+				t.Fatalf("desc %v: entry %d is %d, not %d", desc, i, got[i], e.id)
+			}
+		}
+	}
+}
+
+// sortRunInsertion sorts the given run by insertion, independently of
+// the sorter.
+func sortRunInsertion(s *sortRun) {
+	for i := 1; i < s.Len(); i++ {
+		for j := i; j > 0 && s.Less(j, j-1); j-- {
+			s.Swap(j, j-1)
+		}
+	}
+}
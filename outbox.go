@@ -0,0 +1,193 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// outboxBatch is the number of outbox entries read at a time, by
+// consumers.
+const outboxBatch = 256
+
+// OutboxMessage is an event to be published by the application - to,
+// say, Kafka or NATS - describing a modification of an entity.  See
+// `WithOutbox`.
+type OutboxMessage struct {
+	Topic   string // topic to publish to; at most 255 bytes
+	Key     []byte // partitioning key, if any; at most 255 bytes
+	Payload []byte
+}
+
+// outboxKey is the context key of the outbox messages of
+// modifications.
+type outboxKey struct{}
+
+// WithOutbox answers a copy of the given context carrying the given
+// messages, in addition to those that it already carries.  The
+// modifications made using it - by `PutContext`, `DeleteContext` and
+// the other operations of `ContextEntityType` - write the messages to
+// the outbox in their transactions, so that they are recorded if, and
+// only if, the modifications are committed.  Cascades, expiry, purges
+// and bulk loads write none.  The messages are then delivered to consumers by
+// `ConsumeOutbox`.
+func WithOutbox(ctx context.Context, msgs ...OutboxMessage) context.Context {
+	cur := outboxFrom(ctx)
+	all := make([]OutboxMessage, 0, len(cur)+len(msgs))
+	all = append(append(all, cur...), msgs...)
+	return context.WithValue(ctx, outboxKey{}, all)
+}
+
+// outboxFrom answers the outbox messages carried by the given context.
+func outboxFrom(ctx context.Context) []OutboxMessage {
+	msgs, _ := ctx.Value(outboxKey{}).([]OutboxMessage)
+	return msgs
+}
+
+// outbox writes the outbox messages carried by the given context,
+// describing the given operation on the entity having the given ID, to
+// the outbox, within the given transaction.
+func (et *entityType) outbox(ctx context.Context, tx *storage.Tx, op ChangeOp, id, rev uint64, now int64) error {
+	for _, m := range outboxFrom(ctx) {
+		if m.Topic == "" || len(m.Topic) > 255 || len(m.Key) > 255 {
+			return ErrOutboxMessageInvalid
+		}
+		_, err := tx.AppendOutbox(storage.OutboxRecord{
+			Time:    now,
+			Op:      uint8(op),
+			NS:      et.ns.Name(),
+			ET:      et.Name(),
+			ID:      id,
+			Rev:     rev,
+			Topic:   m.Topic,
+			Key:     m.Key,
+			Payload: m.Payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutboxEntry is a message in the outbox, together with the
+// modification that wrote it.
+type OutboxEntry struct {
+	OutboxMessage
+
+	Seq       uint64    // position in the outbox
+	Time      time.Time // time of the modification
+	Op        ChangeOp  // `ChangePut` or `ChangeDelete`
+	Namespace string    // name of the namespace of the entity
+	Type      string    // name of the entity type of the entity
+	ID        uint64    // ID of the entity
+	Version   uint64    // version of the entity after the modification; that deleted, for deletions
+}
+
+// ReadOutbox answers up to `max` unacknowledged entries of the outbox
+// following the given position, in the order in which they were
+// written.  Reading does not acknowledge them; see `AckOutbox`.
+func (db *DB) ReadOutbox(after uint64, max int) ([]OutboxEntry, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	rs, err := db.sdb.ReadOutbox(after, max)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]OutboxEntry, len(rs))
+	for i, r := range rs {
+		res[i] = OutboxEntry{
+			OutboxMessage: OutboxMessage{Topic: r.Topic, Key: r.Key, Payload: r.Payload},
+			Seq:           r.Seq,
+			Time:          time.Unix(0, r.Time),
+			Op:            ChangeOp(r.Op),
+			Namespace:     r.NS,
+			Type:          r.ET,
+			ID:            r.ID,
+			Version:       r.Rev,
+		}
+	}
+	return res, nil
+}
+
+// AckOutbox acknowledges the outbox entries at the given positions,
+// removing them from the outbox.  Positions that are not in it -
+// because they have been acknowledged already, say - are ignored.
+func (db *DB) AckOutbox(seqs ...uint64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	_, err := db.sdb.AckOutbox(seqs)
+	return err
+}
+
+// ConsumeOutbox delivers the unacknowledged entries of the outbox to
+// the given function, in order, acknowledging those for which the
+// function answers `nil` in batches, and then waits for more, until
+// the given context is done.  It answers the error that ended it: that of the context, or
+// that of the function, whose entry remains unacknowledged, to be
+// delivered again by the next consumer.
+//
+// Delivery is, therefore, at least once: an entry is delivered again
+// if the process stops after publishing it, but before acknowledging
+// it.  Consumers that need exactly-once effects should publish the
+// `Seq` of every entry with it - as the message ID that Kafka's
+// idempotent producers and NATS JetStream use to drop duplicates, say
+// - or otherwise discard entries already seen.  Entries are delivered
+// to every consumer running; only one should run per database.
+func (db *DB) ConsumeOutbox(ctx context.Context, fn func(OutboxEntry) error) error {
+	var after uint64
+	for {
+		appended := db.sdb.OutboxAppended()
+		es, err := db.ReadOutbox(after, outboxBatch)
+		if err != nil {
+			return err
+		}
+
+		acked := make([]uint64, 0, len(es))
+		for _, e := range es {
+			err = ctx.Err()
+			if err == nil {
+				err = fn(e)
+			}
+			if err != nil {
+				if aerr := db.AckOutbox(acked...); aerr != nil {
+					return aerr
+				}
+				return err
+			}
+			acked = append(acked, e.Seq)
+			after = e.Seq
+		}
+		err = db.AckOutbox(acked...)
+		if err != nil {
+			return err
+		}
+		if len(es) == outboxBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// drainOutbox acknowledges every entry of the outbox.
+func drainOutbox(t *testing.T) {
+	es, err := testDB.ReadOutbox(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range es {
+		if err := testDB.AckOutbox(e.Seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutboxModifications(t *testing.T) {
+	ns := testNamespace(t, "ob_mods")
+	ed := testDefn(t, "ob_mods", []testField{{"name", FieldTypeString}, {"count", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed).(ContextEntityType)
+	drainOutbox(t)
+
+	msg := func(topic string) context.Context {
+		return WithOutbox(context.Background(), OutboxMessage{Topic: topic, Key: []byte("k"), Payload: []byte(topic)})
+	}
+	d := testDoc(t, ed, 0, map[string]interface{}{"name": "a"})
+	if err := et.PutContext(msg("put"), d); err != nil {
+		t.Fatal(err)
+	}
+	err := et.UpdateContext(msg("update"), d.ID(), func(e Entity) error {
+		f, err := e.(*Document).Field("name")
+		if err != nil {
+			return err
+		}
+		return setFieldValue(f, "b")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := et.PatchContext(msg("patch"), d.ID(), map[string]interface{}{"name": "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.IncrementContext(msg("increment"), d.ID(), "count", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.DeleteContext(msg("delete"), d.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := testDB.ReadOutbox(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		topic string
+		op    ChangeOp
+		ver   uint64
+	}{
+		{"put", ChangePut, 1},
+		{"update", ChangePut, 2},
+		{"patch", ChangePut, 3},
+		{"increment", ChangePut, 4},
+		{"delete", ChangeDelete, 4},
+	}
+	if len(es) != len(want) {
+		t.Fatalf("entries: %+v", es)
+	}
+	for i, w := range want {
+		e := es[i]
+		if e.Topic != w.topic || e.Op != w.op || e.Version != w.ver || e.ID != d.ID() ||
+			e.Namespace != "ob_mods" || e.Type != "ob_mods" || string(e.Key) != "k" || string(e.Payload) != w.topic {
+			t.Errorf("entry %d: %+v", i, e)
+		}
+	}
+	drainOutbox(t)
+}
+
+func TestOutboxRollback(t *testing.T) {
+	ns := testNamespace(t, "ob_rb")
+	ed := testDefn(t, "ob_rb", []testField{{"count", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed).(ContextEntityType)
+	d := testDoc(t, ed, 0, nil)
+	if err := et.PutContext(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t)
+
+	ctx := WithOutbox(context.Background(), OutboxMessage{Topic: "t"})
+	boom := errors.New("boom")
+	if err := et.UpdateContext(ctx, d.ID(), func(Entity) error { return boom }); !errors.Is(err, boom) {
+		t.Fatalf("failed update: %v", err)
+	}
+	if _, err := et.IncrementContext(ctx, d.ID(), "none", 1); err == nil {
+		t.Fatal("unknown field: no error")
+	}
+	bad := WithOutbox(context.Background(), OutboxMessage{})
+	if _, err := et.IncrementContext(bad, d.ID(), "count", 1); !errors.Is(err, ErrOutboxMessageInvalid) {
+		t.Fatalf("invalid message: %v", err)
+	}
+	if e, err := et.GetContext(context.Background(), d.ID()); err != nil || e.(*Document).Version() != 1 {
+		t.Fatalf("invalid message: stored %v, %v", e, err)
+	}
+
+	es, err := testDB.ReadOutbox(0, 10)
+	if err != nil || len(es) != 0 {
+		t.Fatalf("entries of failed modifications: %+v, %v", es, err)
+	}
+}
+
+func TestConsumeOutbox(t *testing.T) {
+	ns := testNamespace(t, "ob_cons")
+	ed := testDefn(t, "ob_cons", []testField{{"count", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed).(ContextEntityType)
+	drainOutbox(t)
+
+	d := testDoc(t, ed, 0, nil)
+	ctx := WithOutbox(context.Background(), OutboxMessage{Topic: "first"}, OutboxMessage{Topic: "second"})
+	if err := et.PutContext(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan OutboxEntry, 10)
+	done := make(chan error, 1)
+	boom := errors.New("boom")
+	go func() {
+		done <- testDB.ConsumeOutbox(cctx, func(e OutboxEntry) error {
+			if e.Topic == "second" {
+				return boom
+			}
+			got <- e
+			return nil
+		})
+	}()
+	if e := <-got; e.Topic != "first" {
+		t.Fatalf("first delivery: %+v", e)
+	}
+	if err := <-done; !errors.Is(err, boom) {
+		t.Fatalf("failing consumer: %v", err)
+	}
+
+	go func() {
+		done <- testDB.ConsumeOutbox(cctx, func(e OutboxEntry) error { got <- e; return nil })
+	}()
+	if e := <-got; e.Topic != "second" {
+		t.Fatalf("redelivery: %+v", e)
+	}
+	if err := et.PatchContext(WithOutbox(context.Background(), OutboxMessage{Topic: "third"}), d.ID(), map[string]interface{}{"count": int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-got:
+		if e.Topic != "third" || e.Version != 2 {
+			t.Fatalf("waiting consumer: %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting consumer: no delivery")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("cancelled consumer: %v", err)
+	}
+	if es, _ := testDB.ReadOutbox(0, 10); len(es) != 0 {
+		t.Fatalf("unacknowledged: %+v", es)
+	}
+}
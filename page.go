@@ -0,0 +1,143 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Page is a page of the results of a search, in the form that every
+// consumer paginates with: search APIs and the HTTP layer alike answer
+// it, serialised as it is.  `Paginator` answers pages of entities;
+// `PageOf` converts them into pages of documents, say.
+type Page[T any] struct {
+	// Items holds the matching entities of this page, in the
+	// ascending order of their IDs.
+	Items []T `json:"items"`
+	// Next is the `SearchOpts.StartAt` of the next page; `0` if there
+	// are no more matching entities.
+	Next uint64 `json:"next"`
+	// Total is the number of matching entities in the entity type.
+	// Unless `Exact`, it is estimated from the fraction of the
+	// entities scanned that matched.
+	Total uint64 `json:"total"`
+	// Exact is `true` if `Total` is the exact number.
+	Exact bool `json:"exact"`
+	// Truncated is `true` if the page was cut short by
+	// `SearchOpts.MaxScanned`, before it filled; searching from
+	// `Next` continues the scan.
+	Truncated bool `json:"truncated"`
+}
+
+// PageOf answers the given page, with its items converted into the
+// given type of entity, such as `*Document`.  It answers
+// `ErrEntityTypeMismatch` if any of them is not one.
+func PageOf[T Entity](pg Page[Entity]) (Page[T], error) {
+	res := Page[T]{Next: pg.Next, Total: pg.Total, Exact: pg.Exact, Truncated: pg.Truncated}
+	if pg.Items != nil {
+		res.Items = make([]T, 0, len(pg.Items))
+	}
+	for _, e := range pg.Items {
+		item, ok := e.(T)
+		if !ok {
+			return Page[T]{}, ErrEntityTypeMismatch
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// Paginator is implemented by entity types that can answer their
+// search results a page at a time.
+type Paginator interface {
+	// SearchPage is like `Search`, but answers a page of up to
+	// `SearchOpts.Limit` matching entities.
+	SearchPage(SearchOpts, SearchFn) (Page[Entity], error)
+}
+
+// SearchPage is like `Search`, but answers a page of up to `opts.Limit`
+// matching documents - all of them, if it is `0` - beginning at
+// `opts.StartAt`.  A search that would scan more than
+// `opts.MaxScanned` documents answers a truncated page, rather than
+// `ErrScanLimit`.  Ordering requested using `SearchOpts.OrderBy` is
+// ignored, since pages continue from the IDs of their successors.
+//
+// Unless the page holds all the matching documents of the entity type,
+// the total is estimated by extrapolating the fraction of the
+// documents scanned that matched, over the number of stored records.
+// The latter includes soft-deleted and expired documents.
+func (et *entityType) SearchPage(opts SearchOpts, fn SearchFn) (Page[Entity], error) {
+	opts.orderBy = ""
+	var st SearchStats
+	caller := opts.Stats
+	opts.Stats = &st
+	limit := opts.Limit
+	if limit > 0 {
+		opts.Limit = limit + 1
+	}
+
+	var pg Page[Entity]
+	_, err := et.search(context.Background(), opts, func(id uint64, e Entity) bool {
+		if !fn(id, e) {
+			return false
+		}
+		pg.Items = append(pg.Items, e)
+		return true
+	})
+	if caller != nil {
+		caller.Scanned += st.Scanned
+		caller.BytesDecoded += st.BytesDecoded
+	}
+	switch err {
+	case nil:
+	case ErrScanLimit:
+		// The scan continues past the last document scanned, whether
+		// or not it was passed to the predicate.
+		pg.Truncated = true
+		pg.Next = st.last + 1
+	default:
+		return Page[Entity]{}, err
+	}
+
+	matched := uint64(len(pg.Items))
+	if limit > 0 && matched > limit {
+		pg.Next = pg.Items[limit].ID()
+		pg.Items = pg.Items[:limit]
+	}
+
+	if opts.StartAt == 0 && pg.Next == 0 {
+		pg.Total, pg.Exact = matched, true
+		return pg, nil
+	}
+	if st.Scanned == 0 {
+		return pg, nil
+	}
+	var keys int
+	err = et.db.sdb.View(func(tx *storage.Tx) error {
+		bu, err := tx.BucketUsage(et.ns.Name(), et.Name())
+		keys = bu.Keys
+		return err
+	})
+	if err != nil {
+		return Page[Entity]{}, err
+	}
+	pg.Total = uint64(float64(matched) / float64(st.Scanned) * float64(keys))
+	if pg.Total < matched {
+		pg.Total = matched
+	}
+	return pg, nil
+}
@@ -0,0 +1,126 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchPage(t *testing.T) {
+	ns := testNamespace(t, "page_ns")
+	ed := testDefn(t, "page_item", []testField{{"amount", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed)
+	for i := int64(1); i <= 10; i++ {
+		if err := et.Put(testDoc(t, ed, 0, map[string]interface{}{"amount": i})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pgr := et.(Paginator)
+	even := func(_ uint64, e Entity) bool {
+		v, _ := e.(*Document).Value("amount")
+		return v.(int64)%2 == 0
+	}
+
+	pg, err := pgr.SearchPage(SearchOpts{}, even)
+	if err != nil || len(pg.Items) != 5 || pg.Next != 0 || pg.Total != 5 || !pg.Exact || pg.Truncated {
+		t.Fatalf("all: %+v, %v", pg, err)
+	}
+
+	// Pages continue from the successors of their last items.
+	pg, err = pgr.SearchPage(SearchOpts{Limit: 2}, even)
+	if err != nil || len(pg.Items) != 2 || pg.Items[1].ID() != 4 || pg.Next != 6 || pg.Exact {
+		t.Fatalf("first: %+v, %v", pg, err)
+	}
+	if pg.Total != 5 {
+		t.Errorf("estimated total: %d", pg.Total)
+	}
+	pg, err = pgr.SearchPage(SearchOpts{StartAt: pg.Next, Limit: 2}, even)
+	if err != nil || len(pg.Items) != 2 || pg.Items[0].ID() != 6 || pg.Next != 10 {
+		t.Fatalf("second: %+v, %v", pg, err)
+	}
+
+	// Truncated pages continue past the last document scanned.
+	st := SearchStats{}
+	pg, err = pgr.SearchPage(SearchOpts{Limit: 5, MaxScanned: 3, Stats: &st}, even)
+	if err != nil || len(pg.Items) != 1 || !pg.Truncated || pg.Next != 4 || st.Scanned != 3 {
+		t.Fatalf("truncated: %+v, %v, %+v", pg, err, st)
+	}
+}
+
+func TestSearchPageSkipped(t *testing.T) {
+	ns := testNamespace(t, "page_skip_ns")
+	ed := testDefn(t, "page_skipped", []testField{{"amount", FieldTypeInt64}}, nil)
+	et := testDB.EntityType(ns, ed)
+	for i := 1; i <= 6; i++ {
+		if err := et.Put(testDoc(t, ed, 0, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(1); id <= 4; id++ {
+		if err := et.(SoftDeleter).DeleteSoft(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The documents scanned are all soft-deleted: none reaches the
+	// predicate, yet the next page follows them.
+	all := func(uint64, Entity) bool { return true }
+	var next []uint64
+	opts := SearchOpts{Limit: 10, MaxScanned: 3}
+	for {
+		pg, err := et.(Paginator).SearchPage(opts, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next = append(next, pg.Next)
+		if pg.Next == 0 {
+			if len(pg.Items) != 2 || pg.Truncated {
+				t.Errorf("last page: %+v", pg)
+			}
+			break
+		}
+		if len(pg.Items) != 0 || !pg.Truncated || len(next) > 2 {
+			t.Fatalf("pages: %v, %+v", next, pg)
+		}
+		opts.StartAt = pg.Next
+	}
+	if len(next) != 2 || next[0] != 4 {
+		t.Errorf("pages: %v", next)
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	ed := testDefn(t, "page_of", nil, nil)
+	d := NewDocument(ed, 7)
+	pg, err := PageOf[*Document](Page[Entity]{Items: []Entity{d}, Next: 8, Total: 9})
+	if err != nil || len(pg.Items) != 1 || pg.Items[0] != d || pg.Next != 8 || pg.Total != 9 {
+		t.Fatalf("documents: %+v, %v", pg, err)
+	}
+	if pg, err := PageOf[*Document](Page[Entity]{}); err != nil || pg.Items != nil {
+		t.Errorf("empty: %+v, %v", pg, err)
+	}
+	if _, err := PageOf[*Document](Page[Entity]{Items: []Entity{otherEntity{}}}); !errors.Is(err, ErrEntityTypeMismatch) {
+		t.Errorf("mismatch: %v", err)
+	}
+}
+
+// otherEntity is an entity that is not a document.
+type otherEntity struct{}
+
+func (otherEntity) ID() uint64       { return 1 }
+func (otherEntity) Key() []byte      { return EntityKey{id: 1}.Key() }
+func (otherEntity) TypeName() string { return "other" }
+func (otherEntity) String() string   { return "other 1" }
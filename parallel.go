@@ -0,0 +1,132 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// ParallelSearcher is implemented by entity types that can scan
+// segments of their entities concurrently.
+type ParallelSearcher interface {
+	// ParallelSearch is like `Search`, but scans up to the given
+	// number of segments of the entity type concurrently.
+	ParallelSearch(SearchOpts, SearchFn, int) ([]uint64, error)
+}
+
+// ParallelSearch is like `Search`, but splits the IDs of the documents
+// of this entity type, from `opts.StartAt`, into up to the given
+// number of ranges of equal widths - `runtime.GOMAXPROCS` of them, if
+// it is not positive - and scans them on as many goroutines, each in a
+// read transaction of its own.  The results are merged in the
+// ascending order of their IDs, and truncated to `opts.Limit`.
+//
+// Hence, the predicate is called concurrently, and should be safe for
+// such use.  `opts.MaxScanned` bounds the documents scanned by all the
+// goroutines together; the first of them to fail stops the others.
+// Since the transactions begin at slightly different times, the
+// documents scanned are not guaranteed to be a consistent snapshot of
+// the entity type.  Searches ordered using `SearchOpts.OrderBy`, and
+// those in the snapshots of `DB.View`, are not parallelised.
+func (et *entityType) ParallelSearch(opts SearchOpts, fn SearchFn, n int) ([]uint64, error) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n == 1 || opts.orderBy != "" || et.rtx != nil {
+		return et.Search(opts, fn)
+	}
+
+	ctx, sp := et.startSpan(context.Background(), spanSearch)
+	res, err := et.parallelSearch(ctx, opts, fn, n)
+	sp.SetAttribute(attrResults, len(res))
+	endSpan(sp, err)
+	return res, err
+}
+
+// parallelSearch implements `ParallelSearch`.
+func (et *entityType) parallelSearch(ctx context.Context, opts SearchOpts, fn SearchFn, n int) ([]uint64, error) {
+	first, last, err := et.keyRange()
+	if err != nil || last == 0 {
+		return nil, err
+	}
+	if first < opts.StartAt {
+		first = opts.StartAt
+	}
+	if first > last {
+		return nil, nil
+	}
+
+	width := (last-first)/uint64(n) + 1
+	var bounds []uint64
+	for lo := first; ; lo += width {
+		bounds = append(bounds, lo)
+		if last-lo < width {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([][]uint64, len(bounds))
+	repairs := make([][]uint64, len(bounds))
+	stats := make([]SearchStats, len(bounds))
+	errs := make([]error, len(bounds))
+	var scanned uint64
+	var wg sync.WaitGroup
+	for i, lo := range bounds {
+		wg.Add(1)
+		go func(i int, lo uint64) {
+			defer wg.Done()
+
+			o := opts
+			o.StartAt = lo
+			o.Stats = &stats[i]
+			var end uint64
+			if i < len(bounds)-1 {
+				end = bounds[i+1]
+			}
+			results[i], repairs[i], errs[i] = et.scanRange(ctx, o, fn, end, &scanned)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, lo)
+	}
+	wg.Wait()
+
+	for i := range bounds {
+		if opts.Stats != nil {
+			opts.Stats.Scanned += stats[i].Scanned
+			opts.Stats.BytesDecoded += stats[i].BytesDecoded
+		}
+		if errs[i] != nil && (err == nil || err == context.Canceled) {
+			err = errs[i]
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res []uint64
+	for i := range bounds {
+		res = append(res, results[i]...)
+		et.readRepair(repairs[i])
+	}
+	if opts.Limit > 0 && uint64(len(res)) > opts.Limit {
+		res = res[:opts.Limit]
+	}
+	return res, nil
+}
@@ -0,0 +1,532 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Parquet exports let analytics engines - Spark, DuckDB, BigQuery and
+// the like - read the entities of a database directly.  An export is a
+// Parquet file with a column `id`, holding the IDs of the entities,
+// and a nullable column per field, typed as follows.
+//
+//	bool                        BOOLEAN
+//	int8, int16, int32          INT32, annotated INT(8|16|32, signed)
+//	uint8, uint16, uint32       INT32, annotated INT(8|16|32, unsigned)
+//	int64                       INT64, annotated INT(64, signed)
+//	uint64, reference, id       INT64, annotated INT(64, unsigned)
+//	float32                     FLOAT
+//	float64                     DOUBLE
+//	time                        INT64, annotated TIMESTAMP(MICROS, UTC)
+//	string                      BYTE_ARRAY, annotated UTF8
+//
+// Times are truncated to microseconds.  Pages are plain-encoded, and
+// compressed using Snappy, unless asked otherwise.
+
+// Physical types of Parquet columns.
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Converted types of Parquet columns, which annotate their physical
+// types.
+const (
+	parquetNone            = -1
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetUint8           = 11
+	parquetUint16          = 12
+	parquetUint32          = 13
+	parquetUint64          = 14
+	parquetInt8            = 15
+	parquetInt16           = 16
+	parquetInt32Conv       = 17
+	parquetInt64Conv       = 18
+)
+
+// Other Parquet enumerations used.
+const (
+	parquetRequired     = 0 // repetition type
+	parquetOptional     = 1 // repetition type
+	parquetPlain        = 0 // encoding
+	parquetRLE          = 3 // encoding
+	parquetUncompressed = 0 // compression codec
+	parquetSnappy       = 1 // compression codec
+	parquetDataPage     = 0 // page type
+)
+
+// Types of the Thrift compact protocol, in which Parquet metadata are
+// serialised.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetMagic begins and ends Parquet files.
+const parquetMagic = "PAR1"
+
+// defaultRowGroupSize is the number of rows per row group, by default.
+const defaultRowGroupSize = 65536
+
+// ParquetOpts holds the optional settings of `ExportParquet`.
+type ParquetOpts struct {
+	// Fields are the fields to write, in order; all the fields of the
+	// entity type, in the ascending order of their IDs, by default.
+	Fields []string
+
+	// RowGroupSize is the number of rows per row group; 65536, by
+	// default.  Rows are buffered in memory a row group at a time.
+	RowGroupSize int
+
+	// Uncompressed disables the compression of pages.
+	Uncompressed bool
+}
+
+// ExportParquet writes the entities of the given entity type in the
+// given namespace to the given writer as a Parquet file, in the
+// ascending order of their IDs.  Soft-deleted and expired entities are
+// not written.
+//
+// The entities are read from a consistent snapshot, in a single read
+// transaction.  It answers the number of entities written;
+// `ErrNameUnknown` if a given field is not defined, and
+// `ErrFieldTypeUnsupported` if a field is of a type that can not be
+// exported.
+func (db *DB) ExportParquet(ns *Namespace, ed *EntityTypeDefn, w io.Writer, opts *ParquetOpts) (uint64, error) {
+	var o ParquetOpts
+	if opts != nil {
+		o = *opts
+	}
+	if o.RowGroupSize <= 0 {
+		o.RowGroupSize = defaultRowGroupSize
+	}
+	fds, err := projectFields(ed, o.Fields)
+	if err != nil {
+		return 0, err
+	}
+
+	pw := &parquetWriter{w: w, snappy: !o.Uncompressed}
+	pw.cols = append(pw.cols, &parquetColumn{name: csvIDColumn, ptype: parquetInt64, conv: parquetUint64})
+	ids := make([]int, len(fds))
+	for i, fd := range fds {
+		c := &parquetColumn{name: fd.Name, ftype: fd.Ftype, fid: fd.ID, optional: true}
+		c.ptype, c.conv = parquetType(fd.Ftype)
+		if c.ptype < 0 {
+			return 0, ErrFieldTypeUnsupported
+		}
+		pw.cols = append(pw.cols, c)
+		ids[i] = int(fd.ID)
+	}
+	err = pw.write([]byte(parquetMagic))
+	if err != nil {
+		return 0, err
+	}
+
+	et := &entityType{db: db, ns: ns, defn: ed}
+	sopts := SearchOpts{Fields: ids}
+	now := db.now().UnixNano()
+	err = db.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, v []byte) (bool, error) {
+			d, err := et.searchDoc(tx, binary.BigEndian.Uint64(k), v, sopts, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			pw.add(d)
+			if pw.rows == o.RowGroupSize {
+				err = pw.flushRowGroup()
+			}
+			return err == nil, err
+		})
+	})
+	if err == nil {
+		err = pw.flushRowGroup()
+	}
+	if err == nil {
+		err = pw.writeFooter()
+	}
+	return pw.total, err
+}
+
+// parquetType answers the physical and the converted types of the
+// columns holding fields of the given type; `-1` if they can not be
+// exported.
+func parquetType(t FieldType) (int32, int32) {
+	switch t {
+	case FieldTypeBool:
+		return parquetBoolean, parquetNone
+	case FieldTypeInt8:
+		return parquetInt32, parquetInt8
+	case FieldTypeInt16:
+		return parquetInt32, parquetInt16
+	case FieldTypeInt32:
+		return parquetInt32, parquetInt32Conv
+	case FieldTypeInt64:
+		return parquetInt64, parquetInt64Conv
+	case FieldTypeUint8:
+		return parquetInt32, parquetUint8
+	case FieldTypeUint16:
+		return parquetInt32, parquetUint16
+	case FieldTypeUint32:
+		return parquetInt32, parquetUint32
+	case FieldTypeUint64, FieldTypeReference:
+		return parquetInt64, parquetUint64
+	case FieldTypeFloat32:
+		return parquetFloat, parquetNone
+	case FieldTypeFloat64:
+		return parquetDouble, parquetNone
+	case FieldTypeTime:
+		return parquetInt64, parquetTimestampMicros
+	case FieldTypeString:
+		return parquetByteArray, parquetUTF8
+	default:
+		return -1, parquetNone
+	}
+}
+
+// parquetColumn buffers the values of a column for the current row
+// group.
+type parquetColumn struct {
+	name     string
+	ftype    FieldType
+	fid      uint8
+	ptype    int32
+	conv     int32
+	optional bool
+
+	defs  []byte // definition levels of the rows: `1` if not null
+	bools []bool // values of boolean columns
+	vals  []byte // plain-encoded values of the other columns
+	meta  []byte // serialised metadata of the chunks written
+}
+
+// add buffers the given value; `nil` for null.
+func (c *parquetColumn) add(v interface{}) {
+	if c.optional {
+		if v == nil {
+			c.defs = append(c.defs, 0)
+			return
+		}
+		c.defs = append(c.defs, 1)
+	}
+
+	switch v := v.(type) {
+	case bool:
+		c.bools = append(c.bools, v)
+	case int8:
+		c.vals = appendLE32(c.vals, uint32(v))
+	case int16:
+		c.vals = appendLE32(c.vals, uint32(v))
+	case int32:
+		c.vals = appendLE32(c.vals, uint32(v))
+	case uint8:
+		c.vals = appendLE32(c.vals, uint32(v))
+	case uint16:
+		c.vals = appendLE32(c.vals, uint32(v))
+	case uint32:
+		c.vals = appendLE32(c.vals, v)
+	case int64:
+		c.vals = appendLE64(c.vals, uint64(v))
+	case uint64:
+		c.vals = appendLE64(c.vals, v)
+	case float32:
+		c.vals = appendLE32(c.vals, math.Float32bits(v))
+	case float64:
+		c.vals = appendLE64(c.vals, math.Float64bits(v))
+	case time.Time:
+		c.vals = appendLE64(c.vals, uint64(v.Unix()*1e6+int64(v.Nanosecond()/1e3)))
+	case string:
+		c.vals = appendLE32(c.vals, uint32(len(v)))
+		c.vals = append(c.vals, v...)
+	}
+}
+
+// page answers the body of a data page holding the buffered values.
+func (c *parquetColumn) page() []byte {
+	var by []byte
+	if c.optional {
+		levels := appendLevels(nil, c.defs)
+		by = appendLE32(by, uint32(len(levels)))
+		by = append(by, levels...)
+	}
+	if c.ptype == parquetBoolean {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, b := range c.bools {
+			if b {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		return append(by, packed...)
+	}
+	return append(by, c.vals...)
+}
+
+// reset discards the buffered values.
+func (c *parquetColumn) reset() {
+	c.defs, c.bools, c.vals = c.defs[:0], c.bools[:0], c.vals[:0]
+}
+
+// parquetWriter writes a Parquet file, a row group at a time.
+type parquetWriter struct {
+	w      io.Writer
+	snappy bool
+	off    int64 // number of bytes written
+	err    error // first error encountered, if any
+
+	cols   []*parquetColumn
+	rows   int      // number of rows in the current row group
+	total  uint64   // number of rows written
+	groups [][]byte // serialised metadata of the row groups written
+}
+
+// write writes the given bytes, remembering the first error.
+func (pw *parquetWriter) write(by []byte) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	n, err := pw.w.Write(by)
+	pw.off += int64(n)
+	pw.err = err
+	return err
+}
+
+// add buffers the given document as a row.
+func (pw *parquetWriter) add(d *Document) {
+	pw.cols[0].add(d.ID())
+	for _, c := range pw.cols[1:] {
+		f, ok := d.fields[c.fid]
+		if !ok {
+			c.add(nil)
+			continue
+		}
+		c.add(fieldValue(f))
+	}
+	pw.rows++
+}
+
+// flushRowGroup writes the buffered rows as a row group, with a column
+// chunk of a single data page per column.
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return pw.err
+	}
+
+	var chunks [][]byte
+	var size int64
+	for _, c := range pw.cols {
+		body := c.page()
+		comp, codec := body, int32(parquetUncompressed)
+		if pw.snappy {
+			comp, codec = snappy.Encode(nil, body), parquetSnappy
+		}
+
+		dph := &thriftWriter{}
+		dph.i32(1, int32(pw.rows))
+		dph.i32(2, parquetPlain)
+		dph.i32(3, parquetRLE)
+		dph.i32(4, parquetRLE)
+		ph := &thriftWriter{}
+		ph.i32(1, parquetDataPage)
+		ph.i32(2, int32(len(body)))
+		ph.i32(3, int32(len(comp)))
+		ph.structure(5, dph.end())
+		header := ph.end()
+
+		offset := pw.off
+		pw.write(header)
+		if err := pw.write(comp); err != nil {
+			return err
+		}
+
+		md := &thriftWriter{}
+		md.i32(1, c.ptype)
+		md.i32List(2, []int32{parquetPlain, parquetRLE})
+		md.binaryList(3, []string{c.name})
+		md.i32(4, codec)
+		md.i64(5, int64(pw.rows))
+		md.i64(6, int64(len(header)+len(body)))
+		md.i64(7, int64(len(header)+len(comp)))
+		md.i64(9, offset)
+		cc := &thriftWriter{}
+		cc.i64(2, offset)
+		cc.structure(3, md.end())
+		chunks = append(chunks, cc.end())
+		size += int64(len(header) + len(body))
+		c.reset()
+	}
+
+	rg := &thriftWriter{}
+	rg.structList(1, chunks)
+	rg.i64(2, size)
+	rg.i64(3, int64(pw.rows))
+	pw.groups = append(pw.groups, rg.end())
+	pw.total += uint64(pw.rows)
+	pw.rows = 0
+	return nil
+}
+
+// writeFooter writes the file metadata, and ends the file.
+func (pw *parquetWriter) writeFooter() error {
+	root := &thriftWriter{}
+	root.binary(4, "schema")
+	root.i32(5, int32(len(pw.cols)))
+	schema := [][]byte{root.end()}
+	for _, c := range pw.cols {
+		se := &thriftWriter{}
+		se.i32(1, c.ptype)
+		if c.optional {
+			se.i32(3, parquetOptional)
+		} else {
+			se.i32(3, parquetRequired)
+		}
+		se.binary(4, c.name)
+		if c.conv != parquetNone {
+			se.i32(6, c.conv)
+		}
+		schema = append(schema, se.end())
+	}
+
+	fm := &thriftWriter{}
+	fm.i32(1, 1)
+	fm.structList(2, schema)
+	fm.i64(3, int64(pw.total))
+	fm.structList(4, pw.groups)
+	fm.binary(6, "flagon")
+	by := fm.end()
+
+	pw.write(by)
+	pw.write(appendLE32(nil, uint32(len(by))))
+	return pw.write([]byte(parquetMagic))
+}
+
+// appendLevels appends the given definition levels, of bit width `1`,
+// in the run length encoding of Parquet.
+func appendLevels(by []byte, levels []byte) []byte {
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		by = binary.AppendUvarint(by, uint64(j-i)<<1)
+		by = append(by, levels[i])
+		i = j
+	}
+	return by
+}
+
+// appendLE32 appends the given number in little-endian order.
+func appendLE32(by []byte, n uint32) []byte {
+	return append(by, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+// appendLE64 appends the given number in little-endian order.
+func appendLE64(by []byte, n uint64) []byte {
+	return appendLE32(appendLE32(by, uint32(n)), uint32(n>>32))
+}
+
+// thriftWriter serialises a structure in the Thrift compact protocol.
+// Fields should be written in the ascending order of their IDs.
+type thriftWriter struct {
+	by   []byte
+	last int16 // ID of the last field written
+}
+
+// field writes the header of a field having the given ID and type.
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.by = append(t.by, byte(delta)<<4|typ)
+	} else {
+		t.by = append(t.by, typ)
+		t.by = binary.AppendVarint(t.by, int64(id))
+	}
+	t.last = id
+}
+
+// list writes the header of a list field.
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.by = append(t.by, byte(n)<<4|typ)
+		return
+	}
+	t.by = append(t.by, 0xf0|typ)
+	t.by = binary.AppendUvarint(t.by, uint64(n))
+}
+
+func (t *thriftWriter) i32(id int16, n int32) {
+	t.field(id, thriftI32)
+	t.by = binary.AppendVarint(t.by, int64(n))
+}
+
+func (t *thriftWriter) i64(id int16, n int64) {
+	t.field(id, thriftI64)
+	t.by = binary.AppendVarint(t.by, n)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.by = binary.AppendUvarint(t.by, uint64(len(s)))
+	t.by = append(t.by, s...)
+}
+
+// structure writes the given serialised structure.
+func (t *thriftWriter) structure(id int16, s []byte) {
+	t.field(id, thriftStruct)
+	t.by = append(t.by, s...)
+}
+
+func (t *thriftWriter) i32List(id int16, ns []int32) {
+	t.list(id, thriftI32, len(ns))
+	for _, n := range ns {
+		t.by = binary.AppendVarint(t.by, int64(n))
+	}
+}
+
+func (t *thriftWriter) binaryList(id int16, ss []string) {
+	t.list(id, thriftBinary, len(ss))
+	for _, s := range ss {
+		t.by = binary.AppendUvarint(t.by, uint64(len(s)))
+		t.by = append(t.by, s...)
+	}
+}
+
+// structList writes the given serialised structures.
+func (t *thriftWriter) structList(id int16, ss [][]byte) {
+	t.list(id, thriftStruct, len(ss))
+	for _, s := range ss {
+		t.by = append(t.by, s...)
+	}
+}
+
+// end answers the serialised structure.
+func (t *thriftWriter) end() []byte {
+	return append(t.by, 0)
+}
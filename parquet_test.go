@@ -0,0 +1,333 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// thriftReader reads structures serialised in the Thrift compact
+// protocol, as maps from field IDs to values: `int64`s, `bool`s,
+// `float64`s, byte slices, slices and maps.
+type thriftReader struct {
+	t   *testing.T
+	by  []byte
+	pos int
+}
+
+func (r *thriftReader) varint() int64 {
+	n, l := binary.Varint(r.by[r.pos:])
+	if l <= 0 {
+		r.t.Fatalf("invalid varint at %d", r.pos)
+	}
+	r.pos += l
+	return n
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	n, l := binary.Uvarint(r.by[r.pos:])
+	if l <= 0 {
+		r.t.Fatalf("invalid uvarint at %d", r.pos)
+	}
+	r.pos += l
+	return n
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	m := make(map[int16]interface{})
+	var last int16
+	for {
+		h := r.by[r.pos]
+		r.pos++
+		if h == 0 {
+			return m
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.varint())
+		}
+		last = id
+		m[id] = r.value(h & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case 3:
+		r.pos++
+		return int64(r.by[r.pos-1])
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		r.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.by[r.pos-8:]))
+	case thriftBinary:
+		n := int(r.uvarint())
+		r.pos += n
+		return r.by[r.pos-n : r.pos]
+	case thriftList:
+		h := r.by[r.pos]
+		r.pos++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = r.value(h & 0x0f)
+		}
+		return l
+	case thriftStruct:
+		return r.structure()
+	}
+	r.t.Fatalf("unsupported Thrift type %d", typ)
+	return nil
+}
+
+// parquetFile is a Parquet file read back by `readParquet`.
+type parquetFile struct {
+	columns []string
+	rows    [][]interface{}
+	groups  int
+}
+
+// readParquet reads a Parquet file written by `ExportParquet`: plain
+// encoded, optionally Snappy-compressed, data pages of flat columns.
+// Values are answered as `int64`s, `uint64`s, `time.Time`s and as the
+// other types of fields; `nil` if null.
+func readParquet(t *testing.T, by []byte) parquetFile {
+	t.Helper()
+	if len(by) < 12 || string(by[:4]) != parquetMagic || string(by[len(by)-4:]) != parquetMagic {
+		t.Fatal("not a Parquet file")
+	}
+	flen := int(binary.LittleEndian.Uint32(by[len(by)-8:]))
+	fr := &thriftReader{t: t, by: by[len(by)-8-flen : len(by)-8]}
+	fm := fr.structure()
+	if fr.pos != flen {
+		t.Fatalf("footer of %d bytes read as %d", flen, fr.pos)
+	}
+
+	type column struct {
+		ptype, conv int64
+		optional    bool
+	}
+	var pf parquetFile
+	var cols []column
+	schema := fm[2].([]interface{})
+	if n := schema[0].(map[int16]interface{})[5].(int64); int(n) != len(schema)-1 {
+		t.Fatalf("root of %d children, for %d columns", n, len(schema)-1)
+	}
+	for _, el := range schema[1:] {
+		se := el.(map[int16]interface{})
+		c := column{ptype: se[1].(int64), conv: parquetNone, optional: se[3].(int64) == parquetOptional}
+		if conv, ok := se[6]; ok {
+			c.conv = conv.(int64)
+		}
+		cols = append(cols, c)
+		pf.columns = append(pf.columns, string(se[4].([]byte)))
+	}
+
+	for _, g := range fm[4].([]interface{}) {
+		rg := g.(map[int16]interface{})
+		n := int(rg[3].(int64))
+		base := len(pf.rows)
+		for i := 0; i < n; i++ {
+			pf.rows = append(pf.rows, make([]interface{}, len(cols)))
+		}
+		for ci, el := range rg[1].([]interface{}) {
+			md := el.(map[int16]interface{})[3].(map[int16]interface{})
+			if md[5].(int64) != int64(n) || string(md[3].([]interface{})[0].([]byte)) != pf.columns[ci] {
+				t.Fatalf("chunk %d: %v", ci, md)
+			}
+			pr := &thriftReader{t: t, by: by, pos: int(md[9].(int64))}
+			ph := pr.structure()
+			body := by[pr.pos : pr.pos+int(ph[3].(int64))]
+			if md[4].(int64) == parquetSnappy {
+				var err error
+				body, err = snappy.Decode(nil, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(body) != int(ph[2].(int64)) || ph[5].(map[int16]interface{})[1].(int64) != int64(n) {
+				t.Fatalf("page of chunk %d: %v", ci, ph)
+			}
+
+			defs := bytes.Repeat([]byte{1}, n)
+			if cols[ci].optional {
+				l := int(binary.LittleEndian.Uint32(body))
+				defs = readLevels(t, body[4:4+l], n)
+				body = body[4+l:]
+			}
+			k := 0 // values read
+			for i, def := range defs {
+				if def == 0 {
+					continue
+				}
+				var v interface{}
+				switch c := cols[ci]; c.ptype {
+				case parquetBoolean:
+					v = body[k/8]&(1<<uint(k%8)) != 0
+				case parquetInt32:
+					n := binary.LittleEndian.Uint32(body)
+					body = body[4:]
+					if c.conv == parquetUint8 || c.conv == parquetUint16 || c.conv == parquetUint32 {
+						v = uint64(n)
+					} else {
+						v = int64(int32(n))
+					}
+				case parquetInt64:
+					n := binary.LittleEndian.Uint64(body)
+					body = body[8:]
+					switch c.conv {
+					case parquetUint64:
+						v = n
+					case parquetTimestampMicros:
+						v = time.UnixMicro(int64(n)).UTC()
+					default:
+						v = int64(n)
+					}
+				case parquetFloat:
+					v = math.Float32frombits(binary.LittleEndian.Uint32(body))
+					body = body[4:]
+				case parquetDouble:
+					v = math.Float64frombits(binary.LittleEndian.Uint64(body))
+					body = body[8:]
+				case parquetByteArray:
+					l := int(binary.LittleEndian.Uint32(body))
+					v = string(body[4 : 4+l])
+					body = body[4+l:]
+				}
+				pf.rows[base+i][ci] = v
+				k++
+			}
+		}
+		pf.groups++
+	}
+	if fm[3].(int64) != int64(len(pf.rows)) {
+		t.Fatalf("%d rows, of %d", len(pf.rows), fm[3])
+	}
+	return pf
+}
+
+// readLevels reads the given number of definition levels, of bit width
+// `1`, in the run length encoding of Parquet.
+func readLevels(t *testing.T, by []byte, n int) []byte {
+	var res []byte
+	r := &thriftReader{t: t, by: by}
+	for len(res) < n {
+		h := r.uvarint()
+		if h&1 != 0 {
+			t.Fatal("bit-packed levels")
+		}
+		v := by[r.pos]
+		r.pos++
+		res = append(res, bytes.Repeat([]byte{v}, int(h>>1))...)
+	}
+	return res
+}
+
+func TestExportParquet(t *testing.T) {
+	ns := testNamespace(t, "pq_ns")
+	ed := testDefn(t, "pq_item", []testField{
+		{"ok", FieldTypeBool},
+		{"small", FieldTypeInt8},
+		{"count", FieldTypeUint16},
+		{"delta", FieldTypeInt64},
+		{"big", FieldTypeUint64},
+		{"ratio", FieldTypeFloat32},
+		{"score", FieldTypeFloat64},
+		{"at", FieldTypeTime},
+		{"name", FieldTypeString},
+	}, nil)
+	et := testDB.EntityType(ns, ed)
+	at := time.Date(2024, 2, 29, 12, 30, 0, 123456789, time.UTC)
+	rows := []map[string]interface{}{
+		{"ok": true, "small": -8, "count": 65535, "delta": int64(-1) << 40, "big": uint64(math.MaxUint64),
+			"ratio": float32(0.5), "score": -2.25, "at": at, "name": "héllo"},
+		{"ok": false, "name": ""},
+		{},
+		{"ok": true, "count": 3, "at": time.Unix(-1, 0), "name": "x"},
+		{"small": 7},
+	}
+	for _, vals := range rows {
+		if err := et.Put(testDoc(t, ed, 0, vals)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := et.(SoftDeleter).DeleteSoft(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values as read back.
+	want := [][]interface{}{
+		{uint64(1), true, int64(-8), uint64(65535), int64(-1) << 40, uint64(math.MaxUint64), float32(0.5), -2.25, at.Truncate(time.Microsecond), "héllo"},
+		{uint64(2), false, nil, nil, nil, nil, nil, nil, nil, ""},
+		{uint64(4), true, nil, uint64(3), nil, nil, nil, nil, time.Unix(-1, 0).UTC(), "x"},
+		{uint64(5), nil, int64(7), nil, nil, nil, nil, nil, nil, nil},
+	}
+	for _, opts := range []*ParquetOpts{nil, {RowGroupSize: 3, Uncompressed: true}, {RowGroupSize: 1}} {
+		var buf bytes.Buffer
+		n, err := testDB.ExportParquet(ns, ed, &buf, opts)
+		if err != nil || n != 4 {
+			t.Fatalf("%+v: %d, %v", opts, n, err)
+		}
+		pf := readParquet(t, buf.Bytes())
+		if !reflect.DeepEqual(pf.columns, []string{"id", "ok", "small", "count", "delta", "big", "ratio", "score", "at", "name"}) {
+			t.Errorf("%+v: columns %v", opts, pf.columns)
+		}
+		groups := 1
+		if opts != nil {
+			groups = (4 + opts.RowGroupSize - 1) / opts.RowGroupSize
+		}
+		if pf.groups != groups {
+			t.Errorf("%+v: %d row groups", opts, pf.groups)
+		}
+		if !reflect.DeepEqual(pf.rows, want) {
+			t.Errorf("%+v: rows\n%v, not\n%v", opts, pf.rows, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := testDB.ExportParquet(ns, ed, &buf, &ParquetOpts{Fields: []string{"name", "ok"}}); err != nil {
+		t.Fatal(err)
+	}
+	pf := readParquet(t, buf.Bytes())
+	if !reflect.DeepEqual(pf.columns, []string{"id", "name", "ok"}) || !reflect.DeepEqual(pf.rows[3], []interface{}{uint64(5), nil, nil}) {
+		t.Errorf("projection: %v, %v", pf.columns, pf.rows)
+	}
+	if _, err := testDB.ExportParquet(ns, ed, &buf, &ParquetOpts{Fields: []string{"size"}}); err != ErrNameUnknown {
+		t.Errorf("unknown field: %v", err)
+	}
+
+	// Empty entity types answer files without row groups.
+	buf.Reset()
+	empty := testDefn(t, "pq_empty", []testField{{"name", FieldTypeString}}, nil)
+	if n, err := testDB.ExportParquet(ns, empty, &buf, nil); n != 0 || err != nil {
+		t.Fatalf("empty: %d, %v", n, err)
+	}
+	if pf := readParquet(t, buf.Bytes()); pf.groups != 0 || len(pf.rows) != 0 {
+		t.Errorf("empty: %+v", pf)
+	}
+}
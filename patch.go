@@ -0,0 +1,55 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import "context"
+
+// Patcher is implemented by entity types that can update some fields
+// of their entities in place.
+type Patcher interface {
+	// Patch sets the given values in the fields having the given
+	// names, of the entity having the given ID, leaving its other
+	// fields unchanged.
+	Patch(uint64, map[string]interface{}) error
+}
+
+// Patch sets the given values in the fields having the given names, of
+// the document having the given ID, and stores it, as `Update` does.
+// Values must be of the Go types of their fields, as answered by their
+// `Get` methods; numeric values of any Go numeric type are accepted,
+// provided that they are representable in their fields' types.  A
+// `nil` value clears its field.  If any name is unknown or any value
+// does not suit its field, nothing is stored.
+func (et *entityType) Patch(id uint64, vals map[string]interface{}) error {
+	return et.patch(context.Background(), id, vals)
+}
+
+// patch implements `Patch` and `PatchContext`.
+func (et *entityType) patch(ctx context.Context, id uint64, vals map[string]interface{}) error {
+	return et.update(ctx, id, func(e Entity) error {
+		d := e.(*Document)
+		for name, v := range vals {
+			f, err := d.Field(name)
+			if err != nil {
+				return err
+			}
+			err = setFieldValue(f, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
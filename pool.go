@@ -0,0 +1,132 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"io"
+	"sync"
+)
+
+// Scanning large entity types decodes many documents, which are
+// discarded soon after.  To reduce the allocations of doing so, the
+// fields of documents are read and written without reflection, and
+// applications can reuse documents and their fields: see
+// `AcquireDocument`.
+
+// docPool holds reusable documents.
+var docPool = sync.Pool{
+	New: func() interface{} { return &Document{fields: make(map[uint8]Field, 4)} },
+}
+
+// fieldPools hold reusable fields, by field type.
+var fieldPools [FieldTypeCollection + 1]sync.Pool
+
+// pooledField is implemented by fields, so that they can be reused.
+type pooledField interface {
+	Field
+	reset(id uint8)
+}
+
+// reset prepares this field for reuse as the null field having the
+// given ID.  The value of the field is cleared by the caller.
+func (f *basicField) reset(id uint8) {
+	f.id = id
+	f.set = false
+}
+
+// pooledFieldFor answers a reused field conforming to the given
+// definition, if one is available.
+func pooledFieldFor(fd FieldDefn) Field {
+	if int(fd.Ftype) >= len(fieldPools) {
+		return nil
+	}
+	f, ok := fieldPools[fd.Ftype].Get().(pooledField)
+	if !ok {
+		return nil
+	}
+	f.Clear()
+	f.reset(fd.ID)
+	return f
+}
+
+// AcquireDocument answers an empty document of the given entity type,
+// having the given ID, as `NewDocument` does, but reusing a released
+// document - and released fields - if available.  Applications that
+// read many documents, using each only briefly, can reduce allocations
+// by releasing each document once done with it.  See `Release`.
+func AcquireDocument(ed *EntityTypeDefn, id uint64) *Document {
+	d := docPool.Get().(*Document)
+	d.defn = ed
+	d.id = id
+	return d
+}
+
+// Reset discards all the fields of this document, and what is known
+// of its stored version, retaining its entity type and ID.  It is then
+// as answered by `NewDocument`.  Fields obtained from it earlier
+// remain valid, but are no longer part of it.
+func (d *Document) Reset() {
+	for id := range d.fields {
+		delete(d.fields, id)
+	}
+	d.version, d.prov = 0, nil
+	d.deleted, d.expires = 0, 0
+	d.labels, d.schema = nil, 0
+}
+
+// Release makes this document, and its fields, available for reuse by
+// `AcquireDocument`.  Neither the document nor any of its fields -
+// including those obtained from it earlier - may be used afterwards.
+func (d *Document) Release() {
+	for id, f := range d.fields {
+		if fd, ok := d.defn.fieldByID(id); ok && int(fd.Ftype) < len(fieldPools) {
+			fieldPools[fd.Ftype].Put(f)
+		}
+	}
+	d.Reset()
+	d.defn, d.id = nil, 0
+	docPool.Put(d)
+}
+
+// readUint reads an unsigned integer of the given number of bytes, at
+// most eight, in big-endian order, from the given reader.  Like
+// `binary.Read`, it answers `io.EOF` if no bytes could be read, and
+// `io.ErrUnexpectedEOF` if only some could.
+func readUint(r io.Reader, n int) (uint64, error) {
+	var v uint64
+	if br, ok := r.(io.ByteReader); ok {
+		for i := 0; i < n; i++ {
+			b, err := br.ReadByte()
+			if err != nil {
+				if err == io.EOF && i > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			v = v<<8 | uint64(b)
+		}
+		return v, nil
+	}
+
+	var by [8]byte
+	_, err := io.ReadFull(r, by[:n])
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range by[:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
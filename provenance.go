@@ -0,0 +1,196 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Provenance describes the origin of a stored version of an entity,
+// written by an import or a synchronisation from another system.
+//
+// Entities written together share a batch ID, so that the effects of
+// a bad batch can be identified - and reverted - later.  The recorded
+// provenance of an entity is removed when it is stored without one, or
+// deleted.  The batch log, however, retains every version written by a
+// batch.
+type Provenance struct {
+	Source string    // system the data came from
+	Batch  string    // ID of the batch that wrote the data
+	Time   time.Time // time at which the data was written
+}
+
+// validate answers an error if this provenance can not be recorded.
+func (p Provenance) validate() error {
+	if p.Batch == "" || len(p.Batch) > 255 || len(p.Source) > 255 {
+		return ErrProvenanceInvalid
+	}
+	return nil
+}
+
+// stamp answers the storage form of this provenance, for the given
+// version of an entity.
+func (p Provenance) stamp(rev uint64) storage.Stamp {
+	return storage.Stamp{Source: p.Source, Batch: p.Batch, Time: p.Time.UnixNano(), Rev: rev}
+}
+
+// provenanceOf answers the provenance having the given storage form.
+func provenanceOf(s storage.Stamp) *Provenance {
+	return &Provenance{Source: s.Source, Batch: s.Batch, Time: time.Unix(0, s.Time)}
+}
+
+// ProvenanceRecorder is implemented by entity types that can record
+// the provenance of the entities that they store.
+type ProvenanceRecorder interface {
+	// PutWithProvenance creates - or updates - the given entity in the
+	// table, recording the given provenance for it.
+	PutWithProvenance(Entity, Provenance) error
+}
+
+// ImportBatch is like `Import`, but records the given provenance for
+// every entity imported.  A zero time in the provenance is replaced by
+// the current time.
+func (db *DB) ImportBatch(r io.Reader, p Provenance) (uint64, error) {
+	if p.Time.IsZero() {
+		p.Time = db.now()
+	}
+	err := p.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	s := p.stamp(0)
+	n, err := db.sdb.Import(r, &s)
+	quotas.purge()
+	params := map[string]interface{}{"entities": n, "batch": p.Batch, "source": p.Source}
+	db.logAdmin(context.Background(), AdminImport, "", "", params, start, err)
+	return n, err
+}
+
+// BatchSummary describes a batch recorded in the batch log of a
+// namespace.
+type BatchSummary struct {
+	Batch   string    // ID of the batch
+	Source  string    // system the batch came from
+	First   time.Time // time of the earliest entity written
+	Last    time.Time // time of the latest entity written
+	Entries uint64    // number of entity versions written
+}
+
+// Batches answers a summary of every batch recorded in the batch log
+// of the given namespace, in the ascending order of their IDs.
+func (db *DB) Batches(ns string) ([]BatchSummary, error) {
+	var res []BatchSummary
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		return tx.BatchEntries(ns, "", func(e storage.BatchEntry) (bool, error) {
+			s := e.Stamp
+			t := time.Unix(0, s.Time)
+			if n := len(res); n > 0 && res[n-1].Batch == s.Batch {
+				bs := &res[n-1]
+				bs.Entries++
+				if t.Before(bs.First) {
+					bs.First = t
+				}
+				if t.After(bs.Last) {
+					bs.Last = t
+				}
+				return true, nil
+			}
+
+			res = append(res, BatchSummary{Batch: s.Batch, Source: s.Source, First: t, Last: t, Entries: 1})
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// BatchEntry describes an entity version written by a batch.
+type BatchEntry struct {
+	Type    string     // name of the entity type
+	ID      uint64     // ID of the entity
+	Version uint64     // version written by the batch
+	Prov    Provenance // provenance recorded for the version
+
+	// Current is `true` if the entity still exists, and its stored
+	// version is the one written by the batch.
+	Current bool
+}
+
+// batchEntries answers the entries of the given batch in the batch log
+// of the given namespace, within the given transaction, in the
+// ascending order of entity types, IDs and versions.
+func batchEntries(tx *storage.Tx, ns, batch string) ([]BatchEntry, error) {
+	var res []BatchEntry
+	err := tx.BatchEntries(ns, batch, func(e storage.BatchEntry) (bool, error) {
+		res = append(res, BatchEntry{
+			Type:    e.Type,
+			ID:      e.ID,
+			Version: e.Stamp.Rev,
+			Prov:    *provenanceOf(e.Stamp),
+			Current: isCurrent(tx, ns, e),
+		})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// isCurrent answers `true` if the version written by the given batch
+// log entry is the current version of its entity.
+func isCurrent(tx *storage.Tx, ns string, e storage.BatchEntry) bool {
+	cur, ok := tx.Provenance(ns, e.Type, e.ID)
+	return ok && sameStamp(&cur, &e.Stamp)
+}
+
+// sameStamp answers `true` if the given stamps record the same write.
+func sameStamp(a, b *storage.Stamp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Batch == b.Batch && a.Rev == b.Rev
+}
+
+// BatchEntries answers the entity versions written by the given batch
+// in the given namespace, in the ascending order of entity types, IDs
+// and versions.
+func (db *DB) BatchEntries(ns, batch string) ([]BatchEntry, error) {
+	if batch == "" {
+		return nil, ErrProvenanceInvalid
+	}
+
+	var res []BatchEntry
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		var err error
+		res, err = batchEntries(tx, ns, batch)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
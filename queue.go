@@ -0,0 +1,328 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// defaultVisibility is the visibility timeout of queues, when none is
+// given.
+const defaultVisibility = 30 * time.Second
+
+// QueueOpts holds the settings of a `Queue`.
+type QueueOpts struct {
+	// Visibility is the duration for which dequeued messages are
+	// hidden from other consumers, unless acknowledged, returned or
+	// extended; 30 seconds if not positive.  Messages whose consumers
+	// fail to acknowledge them in time are delivered again.
+	Visibility time.Duration
+
+	// MaxAttempts, if positive, is the number of times that a message
+	// is delivered before it is set aside as a dead letter, rather
+	// than delivered again.
+	MaxAttempts int
+}
+
+// Queue is a named, durable queue of work, stored in a namespace.
+// Messages are delivered at least once, in the order in which they
+// become visible, to one consumer at a time: each is hidden from
+// others while it is being processed, for the visibility timeout, and
+// delivered again unless it is acknowledged by then.  It is safe for
+// concurrent use.
+type Queue struct {
+	db   *DB
+	ns   string
+	name string
+	opts QueueOpts
+}
+
+// QueueMessage is a message delivered by a `Queue`.
+type QueueMessage struct {
+	ID       uint64    // ID of the message, unique in the namespace
+	Attempts int       // number of times it has been delivered, including this one
+	Enqueued time.Time // time at which it was enqueued
+	Payload  []byte
+
+	// Visible is the time until which it is hidden, for dequeued
+	// messages; and the time at which it was set aside, for dead
+	// letters.
+	Visible time.Time
+}
+
+// QueueStats describes the messages of a queue.
+type QueueStats struct {
+	Ready  uint64 // messages that can be dequeued
+	Hidden uint64 // messages being processed, or delayed
+	Dead   uint64 // dead letters
+}
+
+// Queue answers the queue having the given name in the given
+// namespace, which is created when a message is first enqueued in it.
+// The settings given apply to the operations using the `Queue`
+// answered; they are not stored.
+func (db *DB) Queue(ns *Namespace, name string, opts *QueueOpts) (*Queue, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{db: db, ns: ns.Name(), name: name}
+	if opts != nil {
+		q.opts = *opts
+	}
+	if q.opts.Visibility <= 0 {
+		q.opts.Visibility = defaultVisibility
+	}
+	return q, nil
+}
+
+// Name answers the name of this queue.
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// queueMessage answers the given stored message as delivered.
+func queueMessage(r storage.QueueRecord) *QueueMessage {
+	return &QueueMessage{
+		ID:       r.ID,
+		Attempts: int(r.Attempts),
+		Enqueued: time.Unix(0, r.Enqueued),
+		Visible:  time.Unix(0, r.Visible),
+		Payload:  r.Payload,
+	}
+}
+
+// Enqueue appends a message having the given payload to this queue,
+// visible after the given delay, and answers its ID.
+func (q *Queue) Enqueue(payload []byte, delay time.Duration) (uint64, error) {
+	var id uint64
+	now := q.db.now()
+	err := q.db.update(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		id, err = tx.Enqueue(q.ns, q.name, storage.QueueRecord{
+			Enqueued: now.UnixNano(),
+			Visible:  now.Add(delay).UnixNano(),
+			Payload:  payload,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Dequeue delivers the message of this queue that has been visible for
+// the longest time, hiding it for the visibility timeout.  Messages
+// that have been delivered `MaxAttempts` times already are set aside
+// as dead letters instead.  It answers `ErrQueueEmpty`, which is an
+// `ErrNotFound`, if no message is visible.  See `DequeueWait`.
+func (q *Queue) Dequeue() (*QueueMessage, error) {
+	m, _, err := q.dequeue()
+	return m, err
+}
+
+// dequeue implements `Dequeue`.  When no message is visible, it also
+// answers the earliest time at which one becomes visible; `0` if the
+// queue is empty.
+func (q *Queue) dequeue() (*QueueMessage, int64, error) {
+	var m *QueueMessage
+	var next int64
+	err := q.db.update(context.Background(), func(tx *storage.Tx) error {
+		now := q.db.now()
+		for {
+			r, n, err := tx.ReadyMessage(q.ns, q.name, now.UnixNano())
+			if err != nil {
+				return err
+			}
+			if r.ID == 0 {
+				next = n
+				return nil
+			}
+			if q.dead(r) {
+				err = tx.DeadLetter(q.ns, q.name, r, now.UnixNano())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			cur := r
+			cur.Attempts++
+			cur.Visible = now.Add(q.opts.Visibility).UnixNano()
+			m = queueMessage(cur)
+			return tx.UpdateQueueMessage(q.ns, q.name, r, cur)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if m == nil {
+		return nil, next, ErrQueueEmpty
+	}
+	return m, 0, nil
+}
+
+// dead answers `true` if the given message has been delivered as many
+// times as this queue allows.
+func (q *Queue) dead(r storage.QueueRecord) bool {
+	return q.opts.MaxAttempts > 0 && int(r.Attempts) >= q.opts.MaxAttempts
+}
+
+// DequeueWait is like `Dequeue`, but waits for a message to become
+// visible, if none is, until the given context is done.
+func (q *Queue) DequeueWait(ctx context.Context) (*QueueMessage, error) {
+	for {
+		changed := q.db.sdb.QueuesChanged()
+		m, next, err := q.dequeue()
+		if err != ErrQueueEmpty {
+			return m, err
+		}
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if next != 0 {
+			t = time.NewTimer(time.Until(time.Unix(0, next)))
+			timeout = t.C
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-changed:
+		case <-timeout:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if err != ErrQueueEmpty {
+			return nil, err
+		}
+	}
+}
+
+// held answers the stored form of the given message, within the given
+// transaction.  It answers `ErrQueueReceipt` if it has been delivered
+// again since, or removed from this queue.
+func (q *Queue) held(tx *storage.Tx, m *QueueMessage) (storage.QueueRecord, error) {
+	r, err := tx.QueueMessage(q.ns, q.name, m.ID)
+	if err == storage.ErrKeyUnknown || err == nil && int(r.Attempts) != m.Attempts {
+		return r, ErrQueueReceipt
+	}
+	return r, err
+}
+
+// Ack acknowledges the given message, delivered by this queue,
+// removing it.  It answers `ErrQueueReceipt`, which is an
+// `ErrConflict`, if the message has been delivered again since - its
+// visibility timeout having passed - or removed already.
+func (q *Queue) Ack(m *QueueMessage) error {
+	return q.db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := q.held(tx, m)
+		if err != nil {
+			return err
+		}
+		return tx.RemoveQueueMessage(q.ns, q.name, r)
+	})
+}
+
+// Nack returns the given message, delivered by this queue, whose
+// processing failed, making it visible again after the given delay.
+// If it has been delivered `MaxAttempts` times, it is set aside as a
+// dead letter instead.  It answers `ErrQueueReceipt` as `Ack` does.
+func (q *Queue) Nack(m *QueueMessage, delay time.Duration) error {
+	return q.db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := q.held(tx, m)
+		if err != nil {
+			return err
+		}
+		now := q.db.now()
+		if q.dead(r) {
+			return tx.DeadLetter(q.ns, q.name, r, now.UnixNano())
+		}
+		cur := r
+		cur.Visible = now.Add(delay).UnixNano()
+		return tx.UpdateQueueMessage(q.ns, q.name, r, cur)
+	})
+}
+
+// Extend hides the given message, delivered by this queue, for the
+// given duration from now, so that the processing of it can continue
+// past its visibility timeout.  It answers `ErrQueueReceipt` as `Ack`
+// does.
+func (q *Queue) Extend(m *QueueMessage, d time.Duration) error {
+	var visible time.Time
+	err := q.db.update(context.Background(), func(tx *storage.Tx) error {
+		r, err := q.held(tx, m)
+		if err != nil {
+			return err
+		}
+		visible = q.db.now().Add(d)
+		cur := r
+		cur.Visible = visible.UnixNano()
+		return tx.UpdateQueueMessage(q.ns, q.name, r, cur)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.Visible = visible
+	return nil
+}
+
+// Stats answers the numbers of the messages of this queue.
+func (q *Queue) Stats() (QueueStats, error) {
+	var s QueueStats
+	err := q.db.view(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		s.Ready, s.Hidden, s.Dead, err = tx.QueueCounts(q.ns, q.name, q.db.now().UnixNano())
+		return err
+	})
+	return s, err
+}
+
+// DeadLetters answers up to `max` dead letters of this queue whose IDs
+// follow the given one, in the order of their IDs.
+func (q *Queue) DeadLetters(after uint64, max int) ([]*QueueMessage, error) {
+	var res []*QueueMessage
+	if max <= 0 {
+		return res, nil
+	}
+	err := q.db.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.DeadLetters(q.ns, q.name, after, func(r storage.QueueRecord) (bool, error) {
+			res = append(res, queueMessage(r))
+			return len(res) < max, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Redrive moves the dead letter of this queue having the given ID back
+// to the queue, visible immediately, with its attempts reset.  It
+// answers `ErrIdentifierUnknown` if there is no such dead letter.
+func (q *Queue) Redrive(id uint64) error {
+	return q.db.update(context.Background(), func(tx *storage.Tx) error {
+		err := tx.Redrive(q.ns, q.name, id, q.db.now().UnixNano())
+		if err == storage.ErrKeyUnknown {
+			return ErrIdentifierUnknown
+		}
+		return err
+	})
+}
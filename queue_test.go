@@ -0,0 +1,219 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testQueue answers the queue having the given name in a namespace of
+// its own, using a handle that reads the time from a manual clock.
+func testQueue(t *testing.T, name string, opts *QueueOpts) (*Queue, *ManualClock) {
+	t.Helper()
+	db, clk := clockDB(time.Unix(2000000, 0))
+	q, err := db.Queue(testNamespace(t, name), name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, clk
+}
+
+// dequeue answers the next message of the given queue, failing the test
+// if there is none.
+func dequeue(t *testing.T, q *Queue) *QueueMessage {
+	t.Helper()
+	m, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// queueStats checks the statistics of the given queue.
+func queueStats(t *testing.T, q *Queue, want QueueStats) {
+	t.Helper()
+	s, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("%s: stats %+v, want %+v", q.Name(), s, want)
+	}
+}
+
+func TestQueueDelivery(t *testing.T) {
+	q, clk := testQueue(t, "queue_dlv", &QueueOpts{Visibility: 10 * time.Second})
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("dequeue when empty: %v", err)
+	}
+
+	id1, err := q.Enqueue([]byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := q.Enqueue([]byte("b"), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := q.db.Queue(testNamespace(t, "queue_dlv"), "queue_other", nil)
+	if _, err := other.Enqueue([]byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	queueStats(t, q, QueueStats{Ready: 1, Hidden: 1})
+
+	m1 := dequeue(t, q)
+	if m1.ID != id1 || string(m1.Payload) != "a" || m1.Attempts != 1 || !m1.Visible.Equal(clk.Now().Add(10*time.Second)) {
+		t.Fatalf("first: %+v", m1)
+	}
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("dequeue when delayed: %v", err)
+	}
+
+	// Delayed messages become visible in time.
+	clk.Advance(6 * time.Second)
+	m2 := dequeue(t, q)
+	if m2.ID != id2 {
+		t.Fatalf("second: %+v", m2)
+	}
+	if err := q.Ack(m2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(m2); !errors.Is(err, ErrQueueReceipt) {
+		t.Errorf("ack twice: %v", err)
+	}
+
+	// Unacknowledged messages are delivered again, invalidating the
+	// earlier receipts.
+	clk.Advance(5 * time.Second)
+	again := dequeue(t, q)
+	if again.ID != id1 || again.Attempts != 2 {
+		t.Fatalf("redelivered: %+v", again)
+	}
+	if err := q.Ack(m1); !errors.Is(err, ErrQueueReceipt) {
+		t.Errorf("ack of stale receipt: %v", err)
+	}
+	if err := q.Extend(again, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(30 * time.Second)
+	queueStats(t, q, QueueStats{Hidden: 1})
+	if err := q.Nack(again, 0); err != nil {
+		t.Fatal(err)
+	}
+	queueStats(t, q, QueueStats{Ready: 1})
+	queueStats(t, other, QueueStats{Ready: 1})
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	q, clk := testQueue(t, "queue_dead", &QueueOpts{Visibility: 10 * time.Second, MaxAttempts: 2})
+	id, err := q.Enqueue([]byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returning a message delivered `MaxAttempts` times sets it aside.
+	dequeue(t, q)
+	clk.Advance(11 * time.Second)
+	if err := q.Nack(dequeue(t, q), 0); err != nil {
+		t.Fatal(err)
+	}
+	queueStats(t, q, QueueStats{Dead: 1})
+	dl, err := q.DeadLetters(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dl) != 1 || dl[0].ID != id || string(dl[0].Payload) != "a" || !dl[0].Visible.Equal(clk.Now()) {
+		t.Fatalf("dead letters: %+v", dl)
+	}
+	if dl, _ := q.DeadLetters(id, 10); len(dl) != 0 {
+		t.Errorf("dead letters after %d: %+v", id, dl)
+	}
+
+	// Redriving resets the attempts.
+	if err := q.Redrive(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Redrive(id); !errors.Is(err, ErrIdentifierUnknown) {
+		t.Errorf("redrive twice: %v", err)
+	}
+	m := dequeue(t, q)
+	if m.ID != id || m.Attempts != 1 {
+		t.Fatalf("redriven: %+v", m)
+	}
+	if err := q.Nack(m, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	queueStats(t, q, QueueStats{Hidden: 1})
+
+	// A message that times out after its last attempt is set aside
+	// when it would otherwise be delivered again.
+	clk.Advance(2 * time.Second)
+	if m := dequeue(t, q); m.Attempts != 2 {
+		t.Fatalf("last attempt: %+v", m)
+	}
+	clk.Advance(11 * time.Second)
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("dequeue after last attempt: %v", err)
+	}
+	queueStats(t, q, QueueStats{Dead: 1})
+}
+
+func TestQueueWait(t *testing.T) {
+	q, err := testDB.Queue(testNamespace(t, "queue_wait"), "queue_wait", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enqueuing wakes waiting consumers.
+	got := make(chan *QueueMessage, 1)
+	go func() {
+		m, err := q.DequeueWait(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- m
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := q.Enqueue([]byte("now"), 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if m == nil || string(m.Payload) != "now" {
+			t.Fatalf("woken with %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not woken")
+	}
+
+	// Consumers wait for delayed messages to become visible.
+	if _, err := q.Enqueue([]byte("later"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	m, err := q.DequeueWait(context.Background())
+	if err != nil || string(m.Payload) != "later" || time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("delayed: %+v, %v", m, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := q.DequeueWait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait when empty: %v", err)
+	}
+}
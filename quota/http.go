@@ -0,0 +1,91 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/js-ojus/flagon/auth"
+)
+
+// Names of the headers reporting the budget and usage of the
+// principal making a request.  Remaining amounts are omitted for
+// unlimited budgets.
+const (
+	HeaderScannedRemaining = "X-Flagon-Scanned-Remaining"
+	HeaderBytesRemaining   = "X-Flagon-Bytes-Remaining"
+	HeaderQuotaReset       = "X-Flagon-Quota-Reset"
+)
+
+// Middleware admits every request through the given admitter, before
+// passing it - with its ticket in its context - to the given handler.
+// Principals are identified by `auth.FromContext`; hence, this should
+// be installed inside `auth.Middleware`.  Requests without a principal
+// are charged to the empty principal.
+//
+// Rejected requests are answered with `429 Too Many Requests` and a
+// `Retry-After` header.  Every response carries headers reporting the
+// principal's usage as of admission; handlers should charge the cost
+// of the query to the ticket, and may call `SetHeaders` again before
+// writing their responses to report the usage after the query.
+func (a *Admitter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		if p, ok := auth.FromContext(r.Context()); ok {
+			name = p.Name
+		}
+
+		t, err := a.Admit(name)
+		a.SetHeaders(w.Header(), name)
+		if err != nil {
+			secs := int64(1)
+			if err == ErrBudgetExhausted {
+				secs = int64(math.Ceil(a.Usage(name).Reset.Sub(a.Now()).Seconds()))
+			}
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer t.Close()
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), t)))
+	})
+}
+
+// SetHeaders sets the headers reporting the budget and usage of the
+// given principal in the given header set.
+func (a *Admitter) SetHeaders(h http.Header, principal string) {
+	a.mutex.Lock()
+	u := a.current(principal)
+	b, use := u.budget, u.Usage
+	a.mutex.Unlock()
+
+	if b.Scanned > 0 {
+		h.Set(HeaderScannedRemaining, strconv.FormatUint(remaining(b.Scanned, use.Scanned), 10))
+	}
+	if b.BytesDecoded > 0 {
+		h.Set(HeaderBytesRemaining, strconv.FormatUint(remaining(b.BytesDecoded, use.BytesDecoded), 10))
+	}
+	h.Set(HeaderQuotaReset, strconv.FormatInt(use.Reset.Unix(), 10))
+}
+
+func remaining(limit, used uint64) uint64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
@@ -0,0 +1,237 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota implements per-principal admission of queries to the
+// remote access layers of `flagon`, so that a shared service can be
+// fair to the teams consuming it.
+//
+// Every principal has a `Budget`: a limit on the number of its
+// concurrent queries, and limits on the number of entities scanned
+// and on the bytes decoded by its queries within a window of time.
+// A query is admitted only when the principal is within its budget;
+// its cost is charged to the principal after it runs.  Costs are
+// measured using `flagon.SearchOpts.Stats`, and the remaining budget
+// of a query can be enforced using `flagon.SearchOpts.MaxScanned`.
+package quota
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooManyQueries is answered when a principal already has as
+	// many queries in progress as its budget allows.
+	ErrTooManyQueries = errors.New("too many concurrent queries")
+
+	// ErrBudgetExhausted is answered when a principal has exhausted
+	// its budget for the current window.
+	ErrBudgetExhausted = errors.New("query budget exhausted")
+)
+
+// Budget limits the queries of a principal.  Zero limits are
+// unlimited.
+type Budget struct {
+	Concurrent   int           // queries in progress at a time
+	Scanned      uint64        // entities scanned per window
+	BytesDecoded uint64        // bytes decoded per window
+	Window       time.Duration // accounting window; one minute if zero
+}
+
+// window answers the accounting window of this budget.
+func (b Budget) window() time.Duration {
+	if b.Window <= 0 {
+		return time.Minute
+	}
+	return b.Window
+}
+
+// Usage is the consumption of a principal's budget in the current
+// window.
+type Usage struct {
+	Concurrent   int       // queries in progress
+	Scanned      uint64    // entities scanned
+	BytesDecoded uint64    // bytes decoded
+	Reset        time.Time // end of the current window
+}
+
+// usage is the accounting state of a principal.
+type usage struct {
+	Usage
+	budget Budget
+}
+
+// Admitter admits the queries of principals according to their
+// budgets.  It is safe for concurrent use.
+type Admitter struct {
+	mutex   sync.Mutex
+	def     Budget            // budget of principals not given one
+	budgets map[string]Budget // budgets by principal
+	usages  map[string]*usage // usages by principal
+
+	// Now answers the current time; `time.Now` by default.  It can be
+	// replaced in tests.
+	Now func() time.Time
+}
+
+// NewAdmitter answers an admitter that applies the given budget to
+// principals that are not given budgets of their own.
+func NewAdmitter(def Budget) *Admitter {
+	return &Admitter{
+		def:     def,
+		budgets: make(map[string]Budget),
+		usages:  make(map[string]*usage),
+		Now:     time.Now,
+	}
+}
+
+// SetBudget sets the budget of the given principal.  It applies from
+// the principal's next window.
+func (a *Admitter) SetBudget(principal string, b Budget) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.budgets[principal] = b
+}
+
+// Budget answers the budget of the given principal.
+func (a *Admitter) Budget(principal string) Budget {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.budgetOf(principal)
+}
+
+func (a *Admitter) budgetOf(principal string) Budget {
+	if b, ok := a.budgets[principal]; ok {
+		return b
+	}
+	return a.def
+}
+
+// current answers the accounting state of the given principal,
+// starting a new window if the previous one has ended.
+func (a *Admitter) current(principal string) *usage {
+	now := a.Now()
+	u, ok := a.usages[principal]
+	if !ok {
+		u = &usage{}
+		a.usages[principal] = u
+	}
+	if !now.Before(u.Reset) {
+		u.budget = a.budgetOf(principal)
+		u.Scanned, u.BytesDecoded = 0, 0
+		u.Reset = now.Add(u.budget.window())
+	}
+	return u
+}
+
+// Admit admits a query of the given principal, if it is within its
+// budget.  The answered ticket should be charged with the cost of the
+// query, and closed when the query completes.
+func (a *Admitter) Admit(principal string) (*Ticket, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u := a.current(principal)
+	b := u.budget
+	if b.Concurrent > 0 && u.Concurrent >= b.Concurrent {
+		return nil, ErrTooManyQueries
+	}
+	if b.Scanned > 0 && u.Scanned >= b.Scanned ||
+		b.BytesDecoded > 0 && u.BytesDecoded >= b.BytesDecoded {
+		return nil, ErrBudgetExhausted
+	}
+
+	u.Concurrent++
+	return &Ticket{a: a, principal: principal}, nil
+}
+
+// Usage answers the usage of the given principal in the current
+// window.
+func (a *Admitter) Usage(principal string) Usage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.current(principal).Usage
+}
+
+// Ticket is an admitted query.
+type Ticket struct {
+	a         *Admitter
+	principal string
+	once      sync.Once
+}
+
+// Principal answers the principal whose query this is.
+func (t *Ticket) Principal() string {
+	return t.principal
+}
+
+// Remaining answers the number of entities that the query may scan
+// without exceeding the principal's budget; `0` if unlimited.  Use it
+// as `flagon.SearchOpts.MaxScanned`.
+func (t *Ticket) Remaining() uint64 {
+	t.a.mutex.Lock()
+	defer t.a.mutex.Unlock()
+
+	u := t.a.current(t.principal)
+	if u.budget.Scanned == 0 {
+		return 0
+	}
+	if u.Scanned >= u.budget.Scanned {
+		return 1 // the budget was exhausted after admission
+	}
+	return u.budget.Scanned - u.Scanned
+}
+
+// Charge charges the given cost to the principal.  It may be called
+// several times for a query.
+func (t *Ticket) Charge(scanned, bytesDecoded uint64) {
+	t.a.mutex.Lock()
+	defer t.a.mutex.Unlock()
+
+	u := t.a.current(t.principal)
+	u.Scanned += scanned
+	u.BytesDecoded += bytesDecoded
+}
+
+// Close marks the query as complete.  Closing a ticket more than once
+// has no effect.
+func (t *Ticket) Close() {
+	t.once.Do(func() {
+		t.a.mutex.Lock()
+		defer t.a.mutex.Unlock()
+
+		t.a.usages[t.principal].Concurrent--
+	})
+}
+
+// ticketKey is the context key of the ticket of a query.
+type ticketKey struct{}
+
+// NewContext answers a copy of the given context carrying the given
+// ticket.
+func NewContext(ctx context.Context, t *Ticket) context.Context {
+	return context.WithValue(ctx, ticketKey{}, t)
+}
+
+// FromContext answers the ticket carried by the given context, if
+// any.
+func FromContext(ctx context.Context) (*Ticket, bool) {
+	t, ok := ctx.Value(ticketKey{}).(*Ticket)
+	return t, ok && t != nil
+}
@@ -0,0 +1,214 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// ref is the target of a reference field.
+type ref struct {
+	target string // name of the referred entity type
+	id     uint64 // ID of the referred entity
+}
+
+// references answers the non-zero reference fields of the given
+// document, by field ID.  A `nil` document has no references.
+func references(d *Document) map[uint8]ref {
+	res := make(map[uint8]ref)
+	if d == nil {
+		return res
+	}
+
+	for id, f := range d.fields {
+		rf, ok := f.(*FieldReference)
+		if !ok || rf.Get() == 0 {
+			continue
+		}
+		fd, ok := d.defn.fieldByID(id)
+		if !ok {
+			continue
+		}
+		res[id] = ref{target: fd.Target, id: rf.Get()}
+	}
+	return res
+}
+
+// refFieldIDs answers the field IDs of the given references, in
+// ascending order.
+func refFieldIDs(rs map[uint8]ref) []uint8 {
+	res := make([]uint8, 0, len(rs))
+	for fid := range rs {
+		res = append(res, fid)
+	}
+	sort.Sort(uint8s(res))
+	return res
+}
+
+// uint8s sorts field IDs in ascending order.
+type uint8s []uint8
+
+func (s uint8s) Len() int           { return len(s) }
+func (s uint8s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint8s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// updateRefs updates the index of references made by the entity
+// having the given ID, from those of its old version to those of its
+// new version.  Either version may be `nil`.
+func (et *entityType) updateRefs(tx *storage.Tx, id uint64, old, cur *Document, now int64) error {
+	ns := et.ns.Name()
+	olds, curs := references(old), references(cur)
+
+	for fid, r := range olds {
+		if curs[fid] == r {
+			continue
+		}
+		err := tx.RemoveRef(ns, r.target, r.id, et.Name(), id, fid, now)
+		if err != nil {
+			return err
+		}
+	}
+	for fid, r := range curs {
+		if olds[fid] == r {
+			continue
+		}
+		err := tx.AddRef(ns, r.target, r.id, et.Name(), id, fid, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RefCount answers the number of references to the entity having the
+// given ID, of the given entity type in the given namespace.
+func (db *DB) RefCount(ns *Namespace, ed *EntityTypeDefn, id uint64) (uint64, error) {
+	if id == 0 {
+		return 0, ErrIdentifierZero
+	}
+
+	var n uint64
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		n, _, _ = tx.RefCount(ns.Name(), ed.Name(), id)
+		return nil
+	})
+	return n, err
+}
+
+// Referrer is an entity that refers to another.  See
+// `ReferrerFinder`.
+type Referrer struct {
+	Type  string // entity type of the referring entity
+	ID    uint64 // ID of the referring entity
+	Field string // name of the referring field; empty if unknown
+}
+
+// ReferrerFinder is implemented by entity types that can answer the
+// entities referring to their entities.
+type ReferrerFinder interface {
+	// Referrers answers the entities that refer to the entity having
+	// the given ID.
+	Referrers(uint64) ([]Referrer, error)
+}
+
+// Referrers answers the entities in this namespace that refer to the
+// document having the given ID, using reference fields, grouped by
+// entity type, in the ascending order of their IDs.  They are
+// found using the index of references, without scanning.  Soft-deleted
+// referring entities are included; those stored using `Import` are
+// not.  The names of the fields are looked up in the system catalogue.
+func (et *entityType) Referrers(id uint64) ([]Referrer, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+
+	var res []Referrer
+	defns := make(map[string]*EntityTypeDefn)
+	err := et.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.Referrers(et.ns.Name(), et.Name(), id, func(src string, sid uint64, fid uint8) (bool, error) {
+			ed, ok := defns[src]
+			if !ok {
+				var err error
+				ed, err = catalogueDefn(tx, src)
+				if err != nil {
+					return false, err
+				}
+				defns[src] = ed
+			}
+			r := Referrer{Type: src, ID: sid}
+			if fd, ok := ed.fieldByID(fid); ok {
+				r.Field = fd.Name
+			}
+			res = append(res, r)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Unreferenced describes an entity to which there are no references.
+type Unreferenced struct {
+	ID uint64 // ID of the entity
+
+	// Since is the time since which the entity has had no references:
+	// the time when its last reference was removed, or when it was
+	// created.  It is zero for entities stored before reference
+	// counting was introduced, and for imported entities.
+	Since time.Time
+}
+
+// Unreferenced answers the entities of the given entity type in the
+// given namespace, that have had no references for at least the
+// given duration, in the ascending order of their IDs.  In
+// applications that share entities by reference, these are the
+// candidates for cleanup.
+//
+// N.B. References made by entities stored using `Import` are not
+// counted.
+func (db *DB) Unreferenced(ns *Namespace, ed *EntityTypeDefn, olderThan time.Duration) ([]Unreferenced, error) {
+	cutoff := db.now().Add(-olderThan).UnixNano()
+	var res []Unreferenced
+
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, _ []byte) (bool, error) {
+			id := binary.BigEndian.Uint64(k)
+			n, since, ok := tx.RefCount(ns.Name(), ed.Name(), id)
+			if n > 0 || since > cutoff {
+				return true, nil
+			}
+
+			u := Unreferenced{ID: id}
+			if ok {
+				u.Since = time.Unix(0, since).UTC()
+			}
+			res = append(res, u)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
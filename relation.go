@@ -0,0 +1,179 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Relation is a many-to-many relation between the entities of two
+// entity types - its A and B sides - in a namespace.  Its pairs are
+// recorded in a join bucket, indexed in both directions; hence, the
+// entities related to an entity on either side are listed without
+// scanning.
+//
+// Pairs are not removed when their entities are deleted; use `Prune`
+// for that.
+type Relation struct {
+	db   *DB
+	ns   *Namespace
+	name string
+	a, b *entityType
+}
+
+// Relation answers the relation having the given name, between the
+// given entity types in the given namespace.  Relations need not be
+// declared; their pairs are recorded as they are added.  The name
+// should be unique in the namespace.
+func (db *DB) Relation(ns *Namespace, name string, a, b *EntityTypeDefn) (*Relation, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	return &Relation{
+		db:   db,
+		ns:   ns,
+		name: name,
+		a:    &entityType{db: db, ns: ns, defn: a},
+		b:    &entityType{db: db, ns: ns, defn: b},
+	}, nil
+}
+
+// Name answers the name of this relation.
+func (r *Relation) Name() string {
+	return r.name
+}
+
+// AddPair relates the given entity on the A side to the given one on
+// the B side.  Both should exist.  Adding an existing pair has no
+// effect.
+func (r *Relation) AddPair(a, b uint64) error {
+	if a == 0 || b == 0 {
+		return ErrIdentifierZero
+	}
+
+	return r.db.update(context.Background(), func(tx *storage.Tx) error {
+		ok, err := r.exists(tx, a, b)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrIdentifierUnknown
+		}
+		return tx.AddPair(r.ns.Name(), r.name, a, b)
+	})
+}
+
+// RemovePair removes the given pair, if it exists.
+func (r *Relation) RemovePair(a, b uint64) error {
+	return r.db.update(context.Background(), func(tx *storage.Tx) error {
+		return tx.RemovePair(r.ns.Name(), r.name, a, b)
+	})
+}
+
+// HasPair answers `true` if the given pair exists.
+func (r *Relation) HasPair(a, b uint64) (bool, error) {
+	var ok bool
+	err := r.db.view(context.Background(), func(tx *storage.Tx) error {
+		ok = tx.HasPair(r.ns.Name(), r.name, a, b)
+		return nil
+	})
+	return ok, err
+}
+
+// ListA answers the IDs of the entities on the A side that are related
+// to the given entity on the B side, in ascending order.
+func (r *Relation) ListA(b uint64) ([]uint64, error) {
+	return r.list(false, b)
+}
+
+// ListB answers the IDs of the entities on the B side that are related
+// to the given entity on the A side, in ascending order.
+func (r *Relation) ListB(a uint64) ([]uint64, error) {
+	return r.list(true, a)
+}
+
+// list answers the IDs of the entities related to the given one, which
+// is on the A side if `fromA` is `true`.
+func (r *Relation) list(fromA bool, id uint64) ([]uint64, error) {
+	res := make([]uint64, 0, 8)
+	err := r.db.view(context.Background(), func(tx *storage.Tx) error {
+		return tx.Paired(r.ns.Name(), r.name, fromA, id, func(other uint64) (bool, error) {
+			res = append(res, other)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Prune removes the pairs of which either entity no longer exists, in
+// a single transaction, and answers their number.  Soft-deleted
+// entities exist until they are purged.
+func (r *Relation) Prune() (uint64, error) {
+	var n uint64
+	err := r.db.update(context.Background(), func(tx *storage.Tx) error {
+		var stale [][2]uint64
+		err := tx.ForEachPair(r.ns.Name(), r.name, func(a, b uint64) (bool, error) {
+			ok, err := r.exists(tx, a, b)
+			if err == nil && !ok {
+				stale = append(stale, [2]uint64{a, b})
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, p := range stale {
+			err = tx.RemovePair(r.ns.Name(), r.name, p[0], p[1])
+			if err != nil {
+				return err
+			}
+		}
+		n = uint64(len(stale))
+		return nil
+	})
+	return n, err
+}
+
+// exists answers `true` if both the given entities exist, within the
+// given transaction.
+func (r *Relation) exists(tx *storage.Tx, a, b uint64) (bool, error) {
+	for _, el := range []struct {
+		et *entityType
+		id uint64
+	}{{r.a, a}, {r.b, b}} {
+		_, err := tx.Get(r.ns.Name(), el.et.Name(), EntityKey{id: el.id}.Key())
+		if err != nil {
+			if err == storage.ErrKeyUnknown {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Drop removes all the pairs of this relation.
+func (r *Relation) Drop() error {
+	return r.db.update(context.Background(), func(tx *storage.Tx) error {
+		return tx.DropRelation(r.ns.Name(), r.name)
+	})
+}
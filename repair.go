@@ -0,0 +1,138 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// throttle admits up to a given number of events per second, with
+// bursts of up to that number.
+type throttle struct {
+	mutex  sync.Mutex
+	rate   float64   // events admitted per second
+	tokens float64   // events that can be admitted now
+	last   time.Time // time of the last refill
+}
+
+// newThrottle answers a throttle admitting the given number of events
+// per second.
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// allow answers `true` if an event can be admitted now, consuming its
+// token.
+func (t *throttle) allow() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// needsRepair answers `true` if the given document, as read, is stored
+// at an earlier schema version, and can be repaired now.  Documents
+// read in a snapshot are not repaired, since writing would block on
+// its read transaction.
+func (et *entityType) needsRepair(d *Document) bool {
+	return et.db.repair != nil && et.rtx == nil && d.schema < et.defn.SchemaVersion() && et.db.repair.allow()
+}
+
+// readRepair stores the documents having the given IDs, read at
+// earlier schema versions, at the current schema version, once they
+// are upgraded.  Unlike when they are put, their versions are not
+// changed, since their contents are not; the new forms are not
+// recorded in their histories, audit logs or change events either.
+// Failures are logged, and otherwise ignored, since the documents will
+// be repaired when they are next read or stored.  Documents of frozen
+// entity types are not repaired.
+//
+// Read-repair makes migrations converge for frequently read data,
+// without `DB.Migrate`.  See `Options.ReadRepair`.
+func (et *entityType) readRepair(ids []uint64) {
+	if len(ids) == 0 {
+		return
+	}
+	cur := et.defn.SchemaVersion()
+	now := et.db.now().UnixNano()
+
+	err := et.db.sdb.Update(func(tx *storage.Tx) error {
+		if _, ok := tx.Frozen(et.ns.Name(), et.Name()); ok {
+			return nil
+		}
+		for _, id := range ids {
+			if tx.SchemaVersion(et.ns.Name(), et.Name(), id) >= cur {
+				continue
+			}
+			by, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+			if err != nil {
+				if err == storage.ErrKeyUnknown {
+					continue
+				}
+				return err
+			}
+			old := NewDocument(et.defn, id)
+			err = et.decode(by, old)
+			if err != nil {
+				return err
+			}
+			d, err := et.get(tx, id)
+			if err != nil {
+				return err
+			}
+
+			by, err = et.encode(d)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(et.ns.Name(), et.Name(), d.Key(), by)
+			if err != nil {
+				return err
+			}
+			err = tx.SetSchemaVersion(et.ns.Name(), et.Name(), id, cur)
+			if err != nil {
+				return err
+			}
+			err = et.updateRefs(tx, id, old, d, now)
+			if err != nil {
+				return err
+			}
+			if et.defn.hasIndexes() {
+				err = et.updateIndexes(tx, id, old, d)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logMsg(LogWarn, "read-repair failed", LogField{"namespace", et.ns.Name()}, LogField{"type", et.Name()}, LogField{"error", err})
+	}
+}
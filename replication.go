@@ -0,0 +1,148 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Kinds of change records.
+const (
+	ChangeRecordPut    = storage.ChangePut    // an entity was stored
+	ChangeRecordDelete = storage.ChangeDelete // an entity was deleted
+	ChangeRecordDefn   = storage.ChangeDefn   // an entity type definition was saved
+)
+
+// ChangeRecord is an entry of the change log of a database.  See
+// `Options.ChangeLog`.
+type ChangeRecord struct {
+	Seq       uint64 `json:"seq"`                 // position in the change log
+	Kind      uint8  `json:"kind"`                // one of `ChangeRecord*`
+	Namespace string `json:"namespace,omitempty"` // empty for definitions
+	Type      string `json:"type"`                // entity type, or the name of the definition
+	Key       []byte `json:"key,omitempty"`       // key of the entity
+	Value     []byte `json:"value,omitempty"`     // stored record, or the definition
+}
+
+// Changes answers up to `max` entries of the change log, following the
+// given position in it; beginning with the first, if it is `0`.  It
+// answers `ErrChangesTrimmed` if some of the entries following it have
+// been trimmed already; a follower at that position should then be
+// synchronised afresh, from a snapshot.
+//
+// The change log is the basis of replication: followers apply the
+// changes of the leader, in order, using `ApplyChanges`, after
+// bootstrapping from a snapshot written by `WriteSnapshot`.  Changes
+// are recorded at the granularity of stored records; soft deletions,
+// labels, expiry times, provenance and other metadata of entities are
+// not replicated.
+func (db *DB) Changes(after uint64, max int) ([]ChangeRecord, error) {
+	cs, err := db.sdb.ReadChanges(after, max)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ChangeRecord, len(cs))
+	for i, c := range cs {
+		res[i] = ChangeRecord{Seq: c.Seq, Kind: c.Kind, Namespace: c.NS, Type: c.ET, Key: c.Key, Value: c.Value}
+	}
+	return res, nil
+}
+
+// ChangeLog answers `true` if this handle records the changes to
+// entities in the change log.  See `Options.ChangeLog`.
+func (db *DB) ChangeLog() bool {
+	return db.opts.ChangeLog && !db.opts.ReadOnly
+}
+
+// TrimChanges removes the entries of the change log up to the given
+// position, once all followers have applied them.  Entries not yet
+// acknowledged by a consumer group reading the change log are kept;
+// see `ChangeFeed`.  It answers the number of entries removed.
+func (db *DB) TrimChanges(upTo uint64) (uint64, error) {
+	return db.sdb.TrimChanges(upTo)
+}
+
+// WriteSnapshot writes a consistent snapshot of the entity type
+// definitions, and of the entities of all namespaces, to the given
+// writer, for bootstrapping followers.  It answers the position in the
+// change log that the snapshot corresponds to; followers continue
+// with the changes following it.
+func (db *DB) WriteSnapshot(w io.Writer) (uint64, error) {
+	return db.sdb.WriteSnapshot(w)
+}
+
+// LoadSnapshot makes this database a follower of the database whose
+// snapshot is read from the given reader.  All the namespaces of this
+// database are replaced with those of the snapshot, and the
+// definitions in the snapshot are saved in the catalogue.  The
+// position of the snapshot becomes the cursor of this follower.  See
+// `ReplicaCursor`.
+//
+// Loading snapshots is recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) LoadSnapshot(r io.Reader) (uint64, error) {
+	start := time.Now()
+	seq, err := db.sdb.LoadSnapshot(r)
+	caches.purge()
+	quotas.purge()
+	db.logAdmin(context.Background(), AdminLoadSnapshot, "", "", map[string]interface{}{"position": seq}, start, err)
+	return seq, err
+}
+
+// ApplyChanges applies the given entries of the change log of the
+// leader to this follower, in a single transaction, and advances the
+// cursor of this follower to the position of the last one.  Entries
+// should be applied in order, without gaps; changes made through this
+// database would be overwritten by later changes of the leader, and
+// are, hence, not meant to be made.  The versions of the entities are
+// counted by this follower.  Applied changes do not invoke
+// hooks or notify subscribers, and are not recorded in the change log
+// of this follower.
+func (db *DB) ApplyChanges(cs []ChangeRecord) error {
+	scs := make([]storage.Change, len(cs))
+	for i, c := range cs {
+		scs[i] = storage.Change{Seq: c.Seq, Kind: c.Kind, NS: c.Namespace, ET: c.Type, Key: c.Key, Value: c.Value}
+	}
+	err := db.sdb.ApplyChanges(scs)
+	if err != nil {
+		return err
+	}
+	quotas.purge()
+
+	for _, c := range cs {
+		if c.Kind == ChangeRecordDefn || len(c.Key) != 8 {
+			continue
+		}
+		if ec := caches.lookup(c.Namespace, c.Type); ec != nil {
+			ec.remove(binary.BigEndian.Uint64(c.Key))
+		}
+	}
+	return nil
+}
+
+// ReplicaCursor answers the position in the change log of the leader
+// up to which this follower has applied changes, and `true` if it has
+// been bootstrapped from a snapshot.  A follower that has not been
+// bootstrapped - or whose bootstrap was interrupted - should load a
+// snapshot before applying changes.
+func (db *DB) ReplicaCursor() (uint64, bool, error) {
+	return db.sdb.ReplicaCursor()
+}
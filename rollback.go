@@ -0,0 +1,310 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of entities rolled back per transaction, by default.
+const rollbackChunk = 256
+
+// RollbackOpts are the options of a rollback.
+type RollbackOpts struct {
+	// DryRun, if `true`, answers the steps of the rollback without
+	// performing them.
+	DryRun bool
+	// Chunk is the number of entities rolled back per transaction;
+	// `0` for the default.
+	Chunk int
+}
+
+// RollbackAction enumerates the actions taken to roll back an entity
+// version written by a batch.
+type RollbackAction uint8
+
+const (
+	// RollbackRestore restores the version that the batch replaced.
+	RollbackRestore RollbackAction = iota + 1
+	// RollbackDelete deletes an entity that the batch created.
+	RollbackDelete
+	// RollbackSkip leaves the entity as is, since it has been modified
+	// after the batch wrote it, or since the version that the batch
+	// replaced is not recorded.
+	RollbackSkip
+)
+
+// RollbackStep describes the rollback of an entity version written by
+// a batch.
+type RollbackStep struct {
+	Type    string         // name of the entity type
+	ID      uint64         // ID of the entity
+	Batch   string         // batch that wrote the version
+	Version uint64         // version written by the batch
+	Action  RollbackAction // action taken, or to be taken
+	Reason  string         // reason for skipping, if skipped
+}
+
+// RollbackReport describes a rollback.
+type RollbackReport struct {
+	Steps    []RollbackStep // in the order performed
+	Restored uint64         // number of prior versions restored
+	Deleted  uint64         // number of entities deleted
+	Skipped  uint64         // number of entity versions left as is
+}
+
+// Reasons for skipping entity versions.
+const (
+	skipModified = "no longer the current version"
+	skipNoPrior  = "prior version not recorded"
+)
+
+// RollbackBatch reverts the entities written by the given batch in the
+// given namespace to the versions that the batch replaced, deleting
+// those that it created.  See `Provenance`.
+//
+// Entities modified after the batch wrote them are left as is, and
+// reported as skipped; so are those whose prior versions are not
+// recorded.  Restored versions regain their own provenance, if any.
+//
+// The rollback proceeds in chunks, each in its own transaction.  An
+// interrupted rollback can simply be run again: versions already
+// rolled back are no longer current, and are skipped.
+//
+// Rollbacks, other than dry runs, are recorded in the administrative
+// event log.  See `AdminLog`.
+func (db *DB) RollbackBatch(ns *Namespace, batch string, opts RollbackOpts) (RollbackReport, error) {
+	if batch == "" {
+		return RollbackReport{}, ErrProvenanceInvalid
+	}
+	start := time.Now()
+	rep, err := db.rollback(ns, batch, func(storage.BatchEntry) bool { return true }, opts)
+	db.logRollback(ns, map[string]interface{}{"batch": batch}, opts, rep, start, err)
+	return rep, err
+}
+
+// RollbackSince is like `RollbackBatch`, but reverts the entity
+// versions written by all batches at or after the given time.  Later
+// versions are reverted first.
+func (db *DB) RollbackSince(ns *Namespace, t time.Time, opts RollbackOpts) (RollbackReport, error) {
+	since := t.UnixNano()
+	start := time.Now()
+	rep, err := db.rollback(ns, "", func(e storage.BatchEntry) bool { return e.Stamp.Time >= since }, opts)
+	db.logRollback(ns, map[string]interface{}{"since": t.UTC()}, opts, rep, start, err)
+	return rep, err
+}
+
+// logRollback records the given rollback, with the given parameters,
+// in the administrative event log, unless it is a dry run.
+func (db *DB) logRollback(ns *Namespace, params map[string]interface{}, opts RollbackOpts, rep RollbackReport, start time.Time, err error) {
+	if opts.DryRun {
+		return
+	}
+	params["restored"] = rep.Restored
+	params["deleted"] = rep.Deleted
+	params["skipped"] = rep.Skipped
+	db.logAdmin(context.Background(), AdminRollback, ns.Name(), "", params, start, err)
+}
+
+// rollback reverts the entries of the given batch - or of all batches,
+// if none is given - that satisfy the given predicate.
+func (db *DB) rollback(ns *Namespace, batch string, pred func(storage.BatchEntry) bool, opts RollbackOpts) (RollbackReport, error) {
+	var entries []storage.BatchEntry
+	var steps []RollbackStep
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		err := tx.BatchEntries(ns.Name(), batch, func(e storage.BatchEntry) (bool, error) {
+			if pred(e) {
+				entries = append(entries, e)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Sort(batchEntriesByRev(entries))
+		steps = planRollback(tx, ns.Name(), entries)
+		return nil
+	})
+	if err != nil {
+		return RollbackReport{}, err
+	}
+	if opts.DryRun {
+		return newRollbackReport(steps), nil
+	}
+
+	ets, err := db.rollbackTypes(ns, entries)
+	if err != nil {
+		return RollbackReport{}, err
+	}
+	chunk := opts.Chunk
+	if chunk <= 0 {
+		chunk = rollbackChunk
+	}
+	for start := 0; start < len(steps); start += chunk {
+		end := start + chunk
+		if end > len(steps) {
+			end = len(steps)
+		}
+		err = db.sdb.Update(func(tx *storage.Tx) error {
+			now := db.now().UnixNano()
+			for i := start; i < end; i++ {
+				err := applyRollback(tx, ets[entries[i].Type], entries[i], &steps[i], now)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return newRollbackReport(steps[:start]), err
+		}
+	}
+
+	return newRollbackReport(steps), nil
+}
+
+// planRollback answers the steps needed to roll back the given batch
+// log entries, in the given order.  Each step is planned assuming that
+// the preceding ones have been performed.
+func planRollback(tx *storage.Tx, ns string, entries []storage.BatchEntry) []RollbackStep {
+	type key struct {
+		et string
+		id uint64
+	}
+	cur := make(map[key]*storage.Stamp)
+
+	steps := make([]RollbackStep, len(entries))
+	for i, e := range entries {
+		k := key{e.Type, e.ID}
+		s, ok := cur[k]
+		if !ok {
+			if st, ok := tx.Provenance(ns, e.Type, e.ID); ok {
+				s = &st
+			}
+		}
+
+		steps[i] = RollbackStep{Type: e.Type, ID: e.ID, Batch: e.Stamp.Batch, Version: e.Stamp.Rev}
+		switch {
+		case !sameStamp(s, &e.Stamp):
+			steps[i].Action, steps[i].Reason = RollbackSkip, skipModified
+		case !e.Prior.Known:
+			steps[i].Action, steps[i].Reason = RollbackSkip, skipNoPrior
+		case e.Prior.Record == nil:
+			steps[i].Action = RollbackDelete
+			s = nil
+		default:
+			steps[i].Action = RollbackRestore
+			s = e.Prior.Stamp
+		}
+		cur[k] = s
+	}
+
+	return steps
+}
+
+// applyRollback performs the given step of a rollback, within the
+// given transaction.  The step is skipped if its entity has been
+// modified since it was planned.
+func applyRollback(tx *storage.Tx, et *entityType, e storage.BatchEntry, step *RollbackStep, now int64) error {
+	if step.Action == RollbackSkip {
+		return nil
+	}
+	if !isCurrent(tx, et.ns.Name(), e) {
+		step.Action, step.Reason = RollbackSkip, skipModified
+		return nil
+	}
+
+	if step.Action == RollbackDelete {
+		_, err := et.removeAll(tx, []uint64{e.ID}, now)
+		return err
+	}
+
+	var d *Document
+	if et.defn.hasReferences() {
+		d = NewDocument(et.defn, e.ID)
+		err := et.decode(e.Prior.Record, d)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := et.store(tx, e.ID, e.Prior.Record, d, now, "")
+	if err != nil {
+		return err
+	}
+	return tx.RestoreProvenance(et.ns.Name(), et.Name(), e.ID, e.Prior.Stamp)
+}
+
+// rollbackTypes answers handles to the entity types of the given batch
+// log entries, by name.  Their definitions are looked up in the system
+// catalogue, so that the index of references can be maintained; the
+// references of entity types not in the catalogue are not indexed.
+func (db *DB) rollbackTypes(ns *Namespace, entries []storage.BatchEntry) (map[string]*entityType, error) {
+	defns, err := db.defnsByName()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*entityType)
+	for _, e := range entries {
+		if _, ok := res[e.Type]; ok {
+			continue
+		}
+		et, err := db.catalogueType(ns, e.Type, defns)
+		if err != nil {
+			return nil, err
+		}
+		res[e.Type] = et
+	}
+
+	return res, nil
+}
+
+// newRollbackReport answers a report of the given steps.
+func newRollbackReport(steps []RollbackStep) RollbackReport {
+	rep := RollbackReport{Steps: steps}
+	for _, s := range steps {
+		switch s.Action {
+		case RollbackRestore:
+			rep.Restored++
+		case RollbackDelete:
+			rep.Deleted++
+		default:
+			rep.Skipped++
+		}
+	}
+	return rep
+}
+
+// batchEntriesByRev sorts batch log entries by entity, and the entries
+// of each entity in the descending order of their revisions.
+type batchEntriesByRev []storage.BatchEntry
+
+func (s batchEntriesByRev) Len() int      { return len(s) }
+func (s batchEntriesByRev) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s batchEntriesByRev) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return a.Stamp.Rev > b.Stamp.Rev
+}
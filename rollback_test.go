@@ -0,0 +1,155 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRollbackBatch(t *testing.T) {
+	ns := testNamespace(t, "rb_ns")
+	ed := testDefn(t, "rb_item", []testField{{"qty", FieldTypeUint32}}, nil)
+	et := testDB.EntityType(ns, ed)
+	pr := et.(ProvenanceRecorder)
+	prov := Provenance{Source: "erp", Batch: "rb_b1"}
+
+	put := func(id uint64, qty uint32, p *Provenance) uint64 {
+		t.Helper()
+		d := testDoc(t, ed, id, map[string]interface{}{"qty": qty})
+		var err error
+		if p == nil {
+			err = et.Put(d)
+		} else {
+			err = pr.PutWithProvenance(d, *p)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.ID()
+	}
+	qty := func(id uint64) interface{} {
+		t.Helper()
+		e, err := et.Get(id)
+		if errors.Is(err, ErrIdentifierUnknown) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := heldValue(t, e.(*Document), "qty")
+		return v
+	}
+
+	// The batch updates `upd` twice, creates `add`, and updates `mod`,
+	// which is modified again afterwards.
+	upd := put(0, 1, nil)
+	mod := put(0, 1, nil)
+	put(upd, 2, &prov)
+	put(upd, 3, &prov)
+	add := put(0, 5, &prov)
+	put(mod, 2, &prov)
+	put(mod, 9, nil)
+
+	count := func(rep RollbackReport, restored, deleted, skipped uint64) {
+		t.Helper()
+		if rep.Restored != restored || rep.Deleted != deleted || rep.Skipped != skipped {
+			t.Errorf("report: %+v", rep)
+		}
+	}
+
+	// A dry run leaves the entities alone.
+	rep, err := testDB.RollbackBatch(ns, "rb_b1", RollbackOpts{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(rep, 2, 1, 1)
+	if qty(upd) != uint32(3) || qty(add) != uint32(5) {
+		t.Fatal("dry run changed entities")
+	}
+
+	// Later versions are reverted first.
+	rep, err = testDB.RollbackBatch(ns, "rb_b1", RollbackOpts{Chunk: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(rep, 2, 1, 1)
+	var vers []uint64
+	for _, s := range rep.Steps {
+		if s.ID == upd {
+			vers = append(vers, s.Version)
+		}
+		if s.ID == mod && (s.Action != RollbackSkip || s.Reason != skipModified) {
+			t.Errorf("modified entity: %+v", s)
+		}
+	}
+	if len(vers) != 2 || vers[0] <= vers[1] {
+		t.Errorf("versions of %d rolled back in the order %v", upd, vers)
+	}
+	for id, want := range map[uint64]interface{}{upd: uint32(1), add: nil, mod: uint32(9)} {
+		if v := qty(id); v != want {
+			t.Errorf("%d: qty %v, want %v", id, v, want)
+		}
+	}
+
+	// Rolling back again changes nothing.
+	rep, err = testDB.RollbackBatch(ns, "rb_b1", RollbackOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(rep, 0, 0, 4)
+
+	if _, err := testDB.RollbackBatch(ns, "", RollbackOpts{}); err != ErrProvenanceInvalid {
+		t.Errorf("no batch: %v", err)
+	}
+}
+
+func TestRollbackSince(t *testing.T) {
+	ns := testNamespace(t, "rb_since")
+	ed := testDefn(t, "rb_since_item", []testField{{"qty", FieldTypeUint32}}, nil)
+	pr := testDB.EntityType(ns, ed).(ProvenanceRecorder)
+
+	at := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDocument(ed, 0)
+	f, _ := d.Field("qty")
+	for i, batch := range []string{"rb_early", "rb_late", "rb_later"} {
+		setFieldValue(f, uint32(i+1))
+		if err := pr.PutWithProvenance(d, Provenance{Batch: batch, Time: at.Add(time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the versions written at or after the given time are
+	// reverted, restoring their prior provenance.
+	rep, err := testDB.RollbackSince(ns, at.Add(time.Hour), RollbackOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Restored != 2 || rep.Deleted != 0 || rep.Skipped != 0 {
+		t.Errorf("report: %+v", rep)
+	}
+	ents, err := testDB.BatchEntries(ns.Name(), "rb_early")
+	if err != nil || len(ents) != 1 || !ents[0].Current {
+		t.Errorf("earlier batch: %+v, %v", ents, err)
+	}
+	e, err := testDB.EntityType(ns, ed).Get(d.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := heldValue(t, e.(*Document), "qty"); v != uint32(1) {
+		t.Errorf("qty %v", v)
+	}
+}
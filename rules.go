@@ -0,0 +1,195 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/js-ojus/flagon/expr"
+)
+
+// Rule is a validation rule of an entity type, which spans its
+// fields.  Its expression (see package `expr`) refers to fields by
+// name, and should answer `true` for valid entities.  For instance:
+//
+//	end_time > start_time
+//	discount <= price
+//	end_time == null || end_time > start_time
+//
+// Comparing a null field with a value is an error, which is reported
+// as a violation of the rule; hence, rules over optional fields should
+// test for `null` explicitly, as in the last example.
+type Rule struct {
+	Name    string `json:"name"`              // unique name of the rule
+	Expr    string `json:"expr"`              // expression of the rule
+	Message string `json:"message,omitempty"` // reported when violated
+}
+
+// rule is a compiled validation rule.
+type rule struct {
+	Rule
+	ex *expr.Expr
+}
+
+// compileRule compiles the given rule, whose expression should refer
+// only to the fields of the given entity type.
+func compileRule(r Rule, fields map[string]FieldDefn) (rule, error) {
+	if err := validName(r.Name); err != nil {
+		return rule{}, err
+	}
+	ex, err := expr.Compile(r.Expr)
+	if err != nil {
+		return rule{}, fmt.Errorf("%s: %s", r.Name, err)
+	}
+	for _, v := range ex.Vars() {
+		if _, ok := fields[v]; !ok {
+			return rule{}, fmt.Errorf("%s: %s: %s", r.Name, ErrNameUnknown, v)
+		}
+	}
+
+	return rule{Rule: r, ex: ex}, nil
+}
+
+// AddRule adds the given validation rule to this entity type.  Rules
+// are evaluated in the order in which they are added, whenever an
+// instance is stored.  Unlike fields, rules can be removed.
+func (ed *EntityTypeDefn) AddRule(r Rule) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	for _, el := range ed.rules {
+		if el.Name == r.Name {
+			return ErrNameExists
+		}
+	}
+	cr, err := compileRule(r, ed.fields)
+	if err != nil {
+		return err
+	}
+
+	ed.rules = append(ed.rules, cr)
+	return nil
+}
+
+// RemoveRule removes the validation rule having the given name.
+func (ed *EntityTypeDefn) RemoveRule(name string) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	for i, el := range ed.rules {
+		if el.Name == name {
+			ed.rules = append(ed.rules[:i:i], ed.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNameUnknown
+}
+
+// Rules answers the validation rules of this entity type, in the
+// order of their evaluation.
+func (ed *EntityTypeDefn) Rules() []Rule {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	res := make([]Rule, len(ed.rules))
+	for i, el := range ed.rules {
+		res[i] = el.Rule
+	}
+	return res
+}
+
+// Violation describes a validation rule that an entity does not
+// satisfy.
+type Violation struct {
+	Rule    string   // name of the rule
+	Message string   // message of the rule, or the evaluation error
+	Fields  []string // names of the fields that the rule refers to
+}
+
+// ValidationError is answered when an entity that violates one or more
+// validation rules of its entity type is stored.  It lists all the
+// violations.
+type ValidationError struct {
+	Violations []Violation
+}
+
+// Is answers `true` for `ErrValidation`.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Fields answers the names of the fields that the violated rules
+// refer to, without repetitions, in the order of the violations.
+func (e *ValidationError) Fields() []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, v := range e.Violations {
+		for _, f := range v.Fields {
+			if !seen[f] {
+				res = append(res, f)
+				seen[f] = true
+			}
+		}
+	}
+	return res
+}
+
+// Error conforms to `error`.
+func (e *ValidationError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("validation failed: ")
+	for i, v := range e.Violations {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(v.Rule)
+		if v.Message != "" {
+			buf.WriteString(": ")
+			buf.WriteString(v.Message)
+		}
+	}
+	return buf.String()
+}
+
+// Validate evaluates the validation rules of this document's entity
+// type, answering a `*ValidationError` if any is violated.  Documents
+// are validated when they are stored; applications can also validate
+// them beforehand, say, to report problems in forms.
+func (d *Document) Validate() error {
+	d.defn.mutex.RLock()
+	rules := d.defn.rules
+	d.defn.mutex.RUnlock()
+
+	var vs []Violation
+	env := documentEnv{d}
+	for _, r := range rules {
+		ok, err := r.ex.EvalBool(env)
+		if err == nil && ok {
+			continue
+		}
+
+		v := Violation{Rule: r.Name, Message: r.Message, Fields: r.ex.Vars()}
+		if err != nil {
+			v.Message = err.Error()
+		}
+		vs = append(vs, v)
+	}
+	if vs != nil {
+		return &ValidationError{Violations: vs}
+	}
+
+	return nil
+}
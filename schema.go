@@ -0,0 +1,251 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of documents migrated per transaction.
+const migrateChunk = 1024
+
+// MigrationFn upgrades the given document, read at the preceding
+// schema version, to the schema version for which it is registered.
+// Since documents whose schema version is unknown are upgraded from
+// version `0`, migrations should be idempotent.
+type MigrationFn func(*Document) error
+
+// SchemaVersion answers the schema version of this entity type.
+// Documents are stored at this version.
+func (ed *EntityTypeDefn) SchemaVersion() uint32 {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.schema
+}
+
+// SetSchemaVersion sets the schema version of this entity type, which
+// can not decrease.  Applications bump it when the meaning or the
+// shape of the fields changes, and register migrations to upgrade the
+// documents stored at earlier versions using `AddMigration`.
+func (ed *EntityTypeDefn) SetSchemaVersion(v uint32) error {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	if v < ed.schema {
+		return ErrSchemaVersion
+	}
+	ed.schema = v
+	return nil
+}
+
+// AddMigration registers the given function to upgrade documents to
+// the given schema version from the preceding one.  Migrations are
+// applied lazily: whenever documents stored at earlier versions are
+// read, all the applicable migrations are applied in order.  Upgraded
+// documents are stored at the current version when they are next
+// stored; see `DB.Migrate` to complete a migration.
+//
+// Migrations are not saved in the system catalogue; applications
+// should register them each time they load the definition.  Versions
+// having no migrations need none, say, because they only add fields.
+func (ed *EntityTypeDefn) AddMigration(to uint32, fn MigrationFn) error {
+	if to == 0 {
+		return ErrSchemaVersion
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	if _, ok := ed.migrations[to]; ok {
+		return ErrSchemaVersion
+	}
+	if ed.migrations == nil {
+		ed.migrations = make(map[uint32]MigrationFn)
+	}
+	ed.migrations[to] = fn
+	return nil
+}
+
+// upgrade applies the migrations from the schema version of the given
+// document to the current one.  The schema version of the document is
+// not changed, since it is that of its stored version.
+func (ed *EntityTypeDefn) upgrade(d *Document) error {
+	ed.mutex.RLock()
+	cur, ms := ed.schema, ed.migrations
+	ed.mutex.RUnlock()
+
+	for v := d.schema + 1; v <= cur && len(ms) > 0; v++ {
+		ed.mutex.RLock()
+		fn, ok := ms[v]
+		ed.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		err := fn(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersions answers the number of documents of the given entity
+// type in the given namespace, by the schema version at which they are
+// stored.  This tracks the progress of a lazily-applied migration.
+func (db *DB) SchemaVersions(ns *Namespace, ed *EntityTypeDefn) (map[uint32]uint64, error) {
+	res := make(map[uint32]uint64)
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		u, err := tx.BucketUsage(ns.Name(), ed.Name())
+		if err != nil {
+			return err
+		}
+
+		n := uint64(u.Keys)
+		err = tx.ForEachSchemaVersion(ns.Name(), ed.Name(), func(_ uint64, v uint32) (bool, error) {
+			res[v]++
+			n--
+			return true, nil
+		})
+		if n > 0 {
+			res[0] = n
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// SchemaStragglers answers the IDs of the documents of the given
+// entity type in the given namespace that are stored at schema
+// versions earlier than its current one, in ascending order.
+func (db *DB) SchemaStragglers(ns *Namespace, ed *EntityTypeDefn) ([]uint64, error) {
+	cur := ed.SchemaVersion()
+	var res []uint64
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, _ []byte) (bool, error) {
+			id := binary.BigEndian.Uint64(k)
+			if tx.SchemaVersion(ns.Name(), ed.Name(), id) < cur {
+				res = append(res, id)
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Migrate completes a lazily-applied migration: it upgrades the
+// documents of the given entity type in the given namespace that are
+// stored at earlier schema versions, and stores them at the current
+// one.  Their versions are incremented.  Documents are migrated in
+// chunks, each in its own transaction; an interrupted `Migrate` can
+// simply be run again.  It answers the number of documents migrated.
+//
+// Migrations are recorded in the administrative event log.  See
+// `AdminLog`.
+func (db *DB) Migrate(ns *Namespace, ed *EntityTypeDefn) (uint64, error) {
+	return db.MigrateContext(context.Background(), ns, ed)
+}
+
+// MigrateContext is like `Migrate`, but stops when the given context
+// is done, between chunks, answering its error.
+func (db *DB) MigrateContext(ctx context.Context, ns *Namespace, ed *EntityTypeDefn) (uint64, error) {
+	start := time.Now()
+	n, err := db.migrate(ctx, ns, ed)
+	params := map[string]interface{}{"schema_version": ed.SchemaVersion(), "migrated": n}
+	db.logAdmin(ctx, AdminMigrate, ns.Name(), ed.Name(), params, start, err)
+	return n, err
+}
+
+// migrate upgrades the documents of the given entity type in the given
+// namespace that are stored at earlier schema versions, chunk by
+// chunk, until done or until the given context is done.
+func (db *DB) migrate(ctx context.Context, ns *Namespace, ed *EntityTypeDefn) (uint64, error) {
+	et := &entityType{db: db, ns: ns, defn: ed}
+	var n uint64
+	var start []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		next, cnt, err := et.migrateChunk(start)
+		n += cnt
+		if err != nil || next == nil {
+			return n, err
+		}
+		start = next
+	}
+}
+
+// migrateChunk migrates up to `migrateChunk` documents, beginning at
+// the given key.  It answers the key at which to resume, if any, and
+// the number of documents migrated.
+func (et *entityType) migrateChunk(start []byte) ([]byte, uint64, error) {
+	cur := et.defn.SchemaVersion()
+	var next []byte
+	var n uint64
+
+	err := et.db.sdb.Update(func(tx *storage.Tx) error {
+		var ids []uint64
+		err := tx.ForEach(et.ns.Name(), et.Name(), start, func(k, _ []byte) (bool, error) {
+			if len(ids) == migrateChunk {
+				next = append([]byte(nil), k...)
+				return false, nil
+			}
+			id := binary.BigEndian.Uint64(k)
+			if tx.SchemaVersion(et.ns.Name(), et.Name(), id) < cur {
+				ids = append(ids, id)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		now := et.db.now().UnixNano()
+		for _, id := range ids {
+			d, err := et.get(tx, id)
+			if err != nil {
+				return err
+			}
+			by, err := et.encode(d)
+			if err != nil {
+				return err
+			}
+			d.schema = cur
+			_, err = et.store(tx, id, by, d, now, "")
+			if err != nil {
+				return err
+			}
+		}
+		n = uint64(len(ids))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return next, n, nil
+}
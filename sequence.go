@@ -0,0 +1,227 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// SequenceOpts holds the settings of a `Sequence`.
+type SequenceOpts struct {
+	// Cache is the number of values allocated from the database at a
+	// time, and answered from memory thereafter; `1` if not positive.
+	// Larger blocks need fewer writes, but the values of a block that
+	// are not answered before the `Sequence` is discarded are skipped.
+	Cache uint64
+}
+
+// Sequence is a named, persistent sequence of positive integers,
+// independent of entities - for numbering invoices, say.  Its values
+// are answered in increasing order, and none is answered twice,
+// though values cached by a `Sequence` that is discarded are skipped.
+// It is safe for concurrent use.
+type Sequence struct {
+	db    *DB
+	ns    string
+	name  string
+	cache uint64
+
+	mu    sync.Mutex
+	next  uint64 // next value cached; `0` if none is
+	limit uint64 // last value cached
+	last  uint64 // last value answered by `Next`
+}
+
+// Sequence answers the sequence having the given name in the given
+// namespace, which is created when a value is first allocated from
+// it.  Every `Sequence` allocates blocks of values of its own; those of
+// the same sequence, answered by different calls, therefore answer
+// values that interleave.
+func (db *DB) Sequence(ns *Namespace, name string, opts *SequenceOpts) (*Sequence, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	s := &Sequence{db: db, ns: ns.Name(), name: name, cache: 1}
+	if opts != nil && opts.Cache > 0 {
+		s.cache = opts.Cache
+	}
+	return s, nil
+}
+
+// Name answers the name of this sequence.
+func (s *Sequence) Name() string {
+	return s.name
+}
+
+// Next answers the next value of this sequence, allocating a block of
+// values from the database if none is cached.  It answers
+// `ErrSequenceExhausted` once the values representable in `uint64`
+// are exhausted.
+func (s *Sequence) Next() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next == 0 {
+		var first uint64
+		err := s.db.update(context.Background(), func(tx *storage.Tx) error {
+			cur, err := tx.SequenceValue(s.ns, s.name)
+			if err != nil {
+				return err
+			}
+			if cur == math.MaxUint64 {
+				return ErrSequenceExhausted
+			}
+			first = cur + 1
+			limit := math.MaxUint64 - cur
+			if limit > s.cache {
+				limit = s.cache
+			}
+			s.limit = cur + limit
+			return tx.SetSequenceValue(s.ns, s.name, s.limit)
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.next = first
+	}
+
+	n := s.next
+	s.next++
+	if n == s.limit {
+		s.next = 0
+	}
+	s.last = n
+	return n, nil
+}
+
+// Current answers the last value answered by `Next` of this
+// `Sequence`.  Before it answers any, it answers the last value
+// allocated from the sequence in the database - `0` if none has been -
+// which may be cached, and not yet answered, by another `Sequence`.
+func (s *Sequence) Current() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last != 0 {
+		return s.last, nil
+	}
+	var cur uint64
+	err := s.db.view(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		cur, err = tx.SequenceValue(s.ns, s.name)
+		return err
+	})
+	return cur, err
+}
+
+// SetStart sets the sequence so that the next value allocated from it
+// is the given one, which should be positive.  Values cached by this
+// `Sequence` are discarded; those cached by others are not, and are
+// answered by them regardless.  Setting a start below the values
+// already answered, therefore, lets them be answered again.
+func (s *Sequence) SetStart(n uint64) error {
+	if n == 0 {
+		return ErrSequenceStart
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.db.update(context.Background(), func(tx *storage.Tx) error {
+		return tx.SetSequenceValue(s.ns, s.name, n-1)
+	})
+	if err != nil {
+		return err
+	}
+	s.next, s.limit, s.last = 0, 0, 0
+	return nil
+}
+
+// Counter is a named, persistent `int64` counter, independent of
+// entities - for counting requests, say.  Its updates are serialised,
+// and so none is lost.  It is safe for concurrent use.
+type Counter struct {
+	db   *DB
+	ns   string
+	name string
+}
+
+// Counter answers the counter having the given name in the given
+// namespace.  Counters are zero until they are first updated.
+func (db *DB) Counter(ns *Namespace, name string) (*Counter, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	return &Counter{db: db, ns: ns.Name(), name: name}, nil
+}
+
+// Name answers the name of this counter.
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Add adds the given delta, which may be negative, to this counter,
+// and answers its new value.  If the new value would overflow `int64`,
+// `ErrCounterRange` is answered, and the counter is not changed.
+func (c *Counter) Add(delta int64) (int64, error) {
+	var n int64
+	err := c.db.update(context.Background(), func(tx *storage.Tx) error {
+		cur, err := tx.CounterValue(c.ns, c.name)
+		if err != nil {
+			return err
+		}
+		if delta > 0 && cur > math.MaxInt64-delta || delta < 0 && cur < math.MinInt64-delta {
+			return ErrCounterRange
+		}
+		n = cur + delta
+		return tx.SetCounterValue(c.ns, c.name, n)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Value answers the current value of this counter.
+func (c *Counter) Value() (int64, error) {
+	var n int64
+	err := c.db.view(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		n, err = tx.CounterValue(c.ns, c.name)
+		return err
+	})
+	return n, err
+}
+
+// Reset sets this counter to zero, and answers the value that it had,
+// atomically - so that, say, rates can be computed from the counts of
+// successive intervals without losing any.
+func (c *Counter) Reset() (int64, error) {
+	var n int64
+	err := c.db.update(context.Background(), func(tx *storage.Tx) error {
+		var err error
+		n, err = tx.CounterValue(c.ns, c.name)
+		if err != nil || n == 0 {
+			return err
+		}
+		return tx.SetCounterValue(c.ns, c.name, 0)
+	})
+	return n, err
+}
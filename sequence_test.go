@@ -0,0 +1,152 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestSequence(t *testing.T) {
+	ns := testNamespace(t, "seq_basic")
+	if _, err := testDB.Sequence(ns, "", nil); err == nil {
+		t.Error("empty name accepted")
+	}
+
+	s1, err := testDB.Sequence(ns, "invoice", &SequenceOpts{Cache: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s1.Current(); c != 0 || err != nil {
+		t.Fatalf("current before allocation: %d, %v", c, err)
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if n, err := s1.Next(); n != want || err != nil {
+			t.Fatalf("next: %d, %v; want %d", n, err, want)
+		}
+	}
+
+	// Another `Sequence` allocates after the block cached by the first.
+	s2, _ := testDB.Sequence(ns, "invoice", nil)
+	if c, _ := s2.Current(); c != 10 {
+		t.Errorf("current of another: %d", c)
+	}
+	if n, _ := s2.Next(); n != 11 {
+		t.Errorf("next of another: %d", n)
+	}
+	if c, _ := s1.Current(); c != 3 {
+		t.Errorf("current: %d", c)
+	}
+
+	if err := s1.SetStart(0); !errors.Is(err, ErrSequenceStart) {
+		t.Errorf("start at zero: %v", err)
+	}
+	if err := s1.SetStart(100); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s1.Next(); n != 100 {
+		t.Errorf("next after start: %d", n)
+	}
+}
+
+func TestSequenceConcurrent(t *testing.T) {
+	ns := testNamespace(t, "seq_conc")
+	const workers, each = 4, 50
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[uint64]bool)
+	for i := 0; i < workers; i++ {
+		s, err := testDB.Sequence(ns, "shared", &SequenceOpts{Cache: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				n, err := s.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[n] {
+					t.Errorf("%d answered twice", n)
+				}
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != workers*each {
+		t.Errorf("%d distinct values", len(seen))
+	}
+}
+
+func TestSequenceExhausted(t *testing.T) {
+	ns := testNamespace(t, "seq_exh")
+	s, _ := testDB.Sequence(ns, "last", &SequenceOpts{Cache: 5})
+	if err := s.SetStart(math.MaxUint64 - 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint64{math.MaxUint64 - 1, math.MaxUint64} {
+		if n, err := s.Next(); n != want || err != nil {
+			t.Fatalf("next: %d, %v; want %d", n, err, want)
+		}
+	}
+	if _, err := s.Next(); !errors.Is(err, ErrSequenceExhausted) {
+		t.Errorf("next when exhausted: %v", err)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	ns := testNamespace(t, "seq_ctr")
+	c, err := testDB.Counter(ns, "hits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Value(); v != 0 {
+		t.Errorf("initial value: %d", v)
+	}
+	if _, err := c.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Add(-2); v != 3 {
+		t.Errorf("after adding: %d", v)
+	}
+	if v, _ := c.Reset(); v != 3 {
+		t.Errorf("reset answered %d", v)
+	}
+	if v, _ := c.Value(); v != 0 {
+		t.Errorf("after reset: %d", v)
+	}
+
+	if _, err := c.Add(math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Add(1); !errors.Is(err, ErrCounterRange) {
+		t.Errorf("overflow: %v", err)
+	}
+	if _, err := c.Add(math.MinInt64); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Value(); v != -1 {
+		t.Errorf("after overflow: %d", v)
+	}
+}
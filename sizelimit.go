@@ -0,0 +1,129 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+)
+
+// MaxSize answers the maximum size in bytes of the stored payloads of
+// instances of this entity type; `0` if their size is not limited.
+func (ed *EntityTypeDefn) MaxSize() int {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.maxsz
+}
+
+// SetMaxSize limits the size of the stored payloads of instances of
+// this entity type - after compression and encryption, if any - to
+// the given number of bytes.  Storing a larger instance answers an
+// `*EntitySizeError`.  `0` removes the limit.
+//
+// Payloads that do not fit in a page of the database spill into
+// overflow pages, which make writes slower and fragment the file; a
+// limit somewhat below the page size - commonly 4 KiB - keeps
+// instances growing past it from going unnoticed.  Existing instances
+// are not affected until they are next stored.
+func (ed *EntityTypeDefn) SetMaxSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.maxsz = n
+}
+
+// FieldSize is the size in bytes of the value of a field, as
+// serialised before compression.
+type FieldSize struct {
+	Name string
+	Size int
+}
+
+// EntitySizeError is answered when an entity whose stored payload
+// exceeds the maximum size of its entity type is stored.  It lists the
+// largest fields of the entity, largest first, that together account
+// for the excess.  See `EntityTypeDefn.SetMaxSize`.
+type EntitySizeError struct {
+	Size   int // size of the stored payload
+	Max    int // maximum size of the entity type
+	Fields []FieldSize
+}
+
+// Is answers `true` for `ErrValidation`.
+func (e *EntitySizeError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Error conforms to `error`.
+func (e *EntitySizeError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("entity size ")
+	buf.WriteString(strconv.Itoa(e.Size))
+	buf.WriteString(" exceeds maximum of ")
+	buf.WriteString(strconv.Itoa(e.Max))
+	for i, f := range e.Fields {
+		if i == 0 {
+			buf.WriteString(": ")
+		} else {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(f.Name)
+		buf.WriteString(" (")
+		buf.WriteString(strconv.Itoa(f.Size))
+		buf.WriteString(" bytes)")
+	}
+	return buf.String()
+}
+
+// checkSize answers an `*EntitySizeError` if the given stored payload
+// of the given document exceeds the maximum size of this entity type.
+func (et *entityType) checkSize(d *Document, by []byte) error {
+	max := et.defn.MaxSize()
+	if max <= 0 || len(by) <= max {
+		return nil
+	}
+
+	fs := make([]FieldSize, 0, len(d.fields))
+	for id, f := range d.fields {
+		if fd, ok := et.defn.fieldByID(id); ok {
+			fs = append(fs, FieldSize{Name: fd.Name, Size: fieldSize(f)})
+		}
+	}
+	sort.Sort(fieldSizesBySize(fs))
+
+	n := 0
+	for excess := len(by) - max; n < len(fs) && excess > 0; n++ {
+		excess -= fs[n].Size
+	}
+	return &EntitySizeError{Size: len(by), Max: max, Fields: fs[:n]}
+}
+
+// fieldSizesBySize sorts field sizes in the descending order of their
+// sizes, and then in the ascending order of their names.
+type fieldSizesBySize []FieldSize
+
+func (s fieldSizesBySize) Len() int { return len(s) }
+func (s fieldSizesBySize) Less(i, j int) bool {
+	if s[i].Size != s[j].Size {
+		return s[i].Size > s[j].Size
+	}
+	return s[i].Name < s[j].Name
+}
+func (s fieldSizesBySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
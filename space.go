@@ -0,0 +1,195 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Maximum number of space usage samples retained in the database.
+const maxSpaceSamples = 1024
+
+// SpaceStats is a sample of the space usage of the database.
+//
+// Deleting entities does not shrink the database file; the pages they
+// occupied become free pages, which are reused by later writes, but
+// can only be returned to the file system by compaction.
+type SpaceStats struct {
+	Time      time.Time `json:"time"`       // when this sample was taken
+	FileBytes int64     `json:"file_bytes"` // size of the database file
+	UsedBytes int64     `json:"used_bytes"` // bytes in use by live data
+	FreeBytes int64     `json:"free_bytes"` // bytes in free pages
+	DiskFree  int64     `json:"disk_free"`  // free bytes in the file system; `-1` if unknown
+}
+
+// GarbageRatio answers the fraction of the database file that is
+// occupied by free pages.
+func (s SpaceStats) GarbageRatio() float64 {
+	if s.FileBytes == 0 {
+		return 0
+	}
+	return float64(s.FreeBytes) / float64(s.FileBytes)
+}
+
+// SpaceStats answers the current space usage of the database.
+func (db *DB) SpaceStats() (SpaceStats, error) {
+	su, err := db.sdb.SpaceUsage()
+	if err != nil {
+		return SpaceStats{}, err
+	}
+
+	return SpaceStats{
+		Time:      db.now().UTC(),
+		FileBytes: su.FileBytes,
+		UsedBytes: su.UsedBytes,
+		FreeBytes: su.FreeBytes,
+		DiskFree:  su.DiskFree,
+	}, nil
+}
+
+// RecordSpaceStats samples the current space usage of the database,
+// and stores the sample in the database, for use by `ForecastSpace`.
+// Applications should call this periodically; forecasts are only as
+// good as the history they are based on.
+func (db *DB) RecordSpaceStats() (SpaceStats, error) {
+	s, err := db.SpaceStats()
+	if err != nil {
+		return SpaceStats{}, err
+	}
+
+	by, err := json.Marshal(s)
+	if err != nil {
+		return SpaceStats{}, err
+	}
+	err = db.sdb.PutSpaceSample(s.Time.UnixNano(), by, maxSpaceSamples)
+	if err != nil {
+		return SpaceStats{}, err
+	}
+
+	return s, nil
+}
+
+// SpaceHistory answers the recorded space usage samples, oldest
+// first.
+func (db *DB) SpaceHistory() ([]SpaceStats, error) {
+	bys, err := db.sdb.SpaceSamples()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]SpaceStats, 0, len(bys))
+	for _, by := range bys {
+		var s SpaceStats
+		err = json.Unmarshal(by, &s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+// SpaceForecast estimates the future space usage of the database,
+// extrapolating the recorded history linearly.
+//
+// Durations are `-1` when the corresponding event is not expected
+// at current rates, or can not be estimated.
+type SpaceForecast struct {
+	Current SpaceStats // the latest sample
+
+	UsedGrowth float64 // growth of live data, in bytes per second
+	FreeGrowth float64 // growth of free pages, in bytes per second
+
+	// Compaction is advised when the garbage ratio reaches the
+	// threshold given to `ForecastSpace`.
+	CompactionAdvised bool
+	CompactionIn      time.Duration
+
+	// Live data exhausts the free pages and the free space in the
+	// file system after this duration.
+	DiskFullIn time.Duration
+}
+
+// ForecastSpace records a new space usage sample, and answers a
+// forecast based on all the recorded samples.  Compaction is advised
+// once free pages occupy the given fraction of the database file.
+func (db *DB) ForecastSpace(garbageThreshold float64) (SpaceForecast, error) {
+	cur, err := db.RecordSpaceStats()
+	if err != nil {
+		return SpaceForecast{}, err
+	}
+	ss, err := db.SpaceHistory()
+	if err != nil {
+		return SpaceForecast{}, err
+	}
+
+	f := SpaceForecast{Current: cur, CompactionIn: -1, DiskFullIn: -1}
+	f.UsedGrowth = growthRate(ss, func(s SpaceStats) int64 { return s.UsedBytes })
+	f.FreeGrowth = growthRate(ss, func(s SpaceStats) int64 { return s.FreeBytes })
+
+	if cur.GarbageRatio() >= garbageThreshold {
+		f.CompactionAdvised = true
+		f.CompactionIn = 0
+	} else if f.FreeGrowth > 0 && garbageThreshold < 1 {
+		// Free bytes needed, assuming that the file grows by the
+		// same amount as the free pages do.
+		need := (garbageThreshold*float64(cur.FileBytes) - float64(cur.FreeBytes)) / (1 - garbageThreshold)
+		f.CompactionIn = seconds(need / f.FreeGrowth)
+	}
+
+	if f.UsedGrowth > 0 && cur.DiskFree >= 0 {
+		avail := float64(cur.DiskFree + cur.FreeBytes)
+		f.DiskFullIn = seconds(avail / f.UsedGrowth)
+	}
+
+	return f, nil
+}
+
+// growthRate answers the least-squares slope, in units per second,
+// of the given quantity over the given samples.
+func growthRate(ss []SpaceStats, q func(SpaceStats) int64) float64 {
+	if len(ss) < 2 {
+		return 0
+	}
+
+	t0 := ss[0].Time
+	var n, sx, sy, sxx, sxy float64
+	for _, s := range ss {
+		x := s.Time.Sub(t0).Seconds()
+		y := float64(q(s))
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+// seconds converts the given number of seconds into a duration,
+// saturating at the maximum representable duration.
+func seconds(s float64) time.Duration {
+	if s >= float64(1<<63-1)/float64(time.Second) {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(s * float64(time.Second))
+}
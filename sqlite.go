@@ -0,0 +1,621 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-ojus/flagon/expr"
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// SQLite exports let analysts query the entities of a database using
+// SQL tools.  An export materialises an entity type as a table of the
+// same shape, either in a SQLite database file of its own, written by
+// `ExportSQLite`, or as a SQL script, in the dialect of SQLite, written
+// by `WriteSQLiteScript`.  Analysts pipe scripts through `sqlite3` to
+// create or refresh a database of their own:
+//
+//	sqlite3 analysis.db < export.sql
+//
+// The table has a column `id`, which is its primary key, and a column
+// per field: integers, booleans and references are stored as
+// `INTEGER`s, floating point numbers as `REAL`s, and strings as
+// `TEXT`.  Times are stored as `TEXT`, in RFC 3339 form, in UTC, which
+// the date and time functions of SQLite understand.  Null fields are
+// stored as `NULL`s.
+//
+// The table `flagon_sync` of the SQLite database records the position
+// in the change log that each exported table corresponds to.
+
+// sqliteSyncTable is the name of the table that records the positions
+// of exported tables.
+const sqliteSyncTable = "flagon_sync"
+
+// sqliteSyncCreate is the statement creating the table that records
+// the positions of exported tables, in database files.  It has no
+// primary key, whose index would have to be written as well.
+const sqliteSyncCreate = `CREATE TABLE "flagon_sync" ("tbl" TEXT, "namespace" TEXT, "type" TEXT, "position" INTEGER)`
+
+// sqliteChangesBatch is the number of entries read from the change
+// log at a time, when refreshing an export.
+const sqliteChangesBatch = 1024
+
+// SQLiteOpts holds the optional settings of `ExportSQLite` and
+// `WriteSQLiteScript`.
+type SQLiteOpts struct {
+	// Table is the name of the table; the name of the entity type, by
+	// default.
+	Table string
+
+	// Since is the position in the change log that the table currently
+	// corresponds to, as answered by a previous export.  If non-zero,
+	// only the entities changed since then are written.  It is ignored
+	// by `ExportSQLite`, which reads it from the file.
+	Since uint64
+}
+
+// WriteSQLiteScript writes a SQL script to the given writer that
+// materialises the entities of the given entity type in the given
+// namespace as a table in a SQLite database, once piped through
+// `sqlite3`; it does not write the database file itself.  Soft-deleted
+// and expired entities are not written.  It answers the position in
+// the change log that the table corresponds to, once the script is
+// run; it is also recorded in the table `flagon_sync`.
+//
+// A full export drops and creates the table afresh.  With a non-zero
+// `SQLiteOpts.Since`, the script refreshes the table incrementally
+// instead: the entities changed since that position - according to
+// the change log - are replaced, or deleted if they no longer exist.
+// When the entity type has been redefined since then, or the change
+// log has been trimmed past that position, a full export is written
+// in its place.  Incremental refreshes hence need the change log to be
+// recorded; see `Options.ChangeLog`.  Without it, the position
+// answered is `0`, and every export is a full one.  Since the change
+// log does not record soft deletions, restorations and expiry, these
+// are reflected only once the entities change again, or by a full
+// export.
+//
+// The script runs in a single SQLite transaction.
+func (db *DB) WriteSQLiteScript(ns *Namespace, ed *EntityTypeDefn, w io.Writer, opts *SQLiteOpts) (uint64, error) {
+	o, fds, err := sqliteSetup(ed, opts)
+	if err != nil {
+		return 0, err
+	}
+	x := &sqliteExport{
+		et:    &entityType{db: db, ns: ns, defn: ed},
+		table: sqliteIdent(o.Table),
+		fds:   fds,
+		bw:    bufio.NewWriter(w),
+	}
+
+	ids, pos, full, err := db.sqliteChanges(ns, ed, o.Since)
+	if err != nil {
+		return 0, err
+	}
+	if full {
+		pos, err = x.full(ns, ed)
+	} else {
+		err = x.refresh(ids)
+	}
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(x.bw, "CREATE TABLE IF NOT EXISTS %s (\"tbl\" TEXT PRIMARY KEY, \"namespace\" TEXT, \"type\" TEXT, \"position\" INTEGER);\n", sqliteSyncTable)
+	fmt.Fprintf(x.bw, "INSERT OR REPLACE INTO %s VALUES (%s, %s, %s, %d);\n", sqliteSyncTable,
+		sqliteString(o.Table), sqliteString(ns.Name()), sqliteString(ed.Name()), pos)
+	x.bw.WriteString("COMMIT;\n")
+	return pos, x.bw.Flush()
+}
+
+// ExportSQLite writes the entities of the given entity type in the
+// given namespace as a table in the SQLite database file at the given
+// path, creating it if necessary.  Soft-deleted and expired entities
+// are not written.  It answers the position in the change log that the
+// table corresponds to, which is also recorded in the table
+// `flagon_sync` of the file.
+//
+// When the file already holds the table, exported from the same entity
+// type, having the same definition, it is refreshed incrementally: the
+// entities changed since the position recorded are replaced, or
+// deleted if they no longer exist, and the rest of the table is copied
+// as is.  As with `WriteSQLiteScript`, incremental refreshes need the
+// change log to be recorded; otherwise, every export is a full one.
+//
+// The file is written afresh, to a temporary file alongside, which is
+// renamed into place once complete; readers hence see either the
+// previous export or the new one.  The other tables exported to it are
+// kept, but objects that analysts create in it - tables, indexes, views
+// and such - are not.  Analysts should hence keep their own objects in
+// a database of their own, to which they attach the export:
+//
+//	ATTACH DATABASE 'export.db' AS flagon;
+//
+// The file must not be in use by SQLite while it is being refreshed.
+// Refreshing a file that was not written by `ExportSQLite` fails with
+// `ErrSQLiteFile`.
+func (db *DB) ExportSQLite(ns *Namespace, ed *EntityTypeDefn, path string, opts *SQLiteOpts) (uint64, error) {
+	o, fds, err := sqliteSetup(ed, opts)
+	if err != nil {
+		return 0, err
+	}
+	create := sqliteCreate(sqliteIdent(o.Table), fds)
+
+	var sr *sqliteReader
+	var objs map[string]sqliteObject
+	var syncs []sqliteSync
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, err
+	default:
+		defer f.Close()
+		if sr, err = openSQLite(f); err == nil {
+			objs, err = sr.objects()
+		}
+		if err == nil {
+			syncs, err = sr.syncs(objs)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The table is refreshed incrementally if it was exported from the
+	// same entity type, and has the same columns.
+	var since uint64
+	for _, sy := range syncs {
+		if sy.table == o.Table && sy.ns == ns.Name() && sy.typ == ed.Name() &&
+			objs[o.Table].sql == create {
+			since = sy.pos
+		}
+	}
+	ids, pos, full, err := db.sqliteChanges(ns, ed, since)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := path + ".export"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	x := &sqliteFileExport{
+		et:   &entityType{db: db, ns: ns, defn: ed},
+		fds:  fds,
+		sr:   sr,
+		sw:   newSQLiteWriter(out),
+		objs: objs,
+	}
+	if full {
+		pos, err = x.full(o.Table, create)
+	} else {
+		err = x.refresh(o.Table, ids)
+	}
+	if err == nil {
+		err = x.finish(syncs, sqliteSync{table: o.Table, ns: ns.Name(), typ: ed.Name(), pos: pos})
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if f != nil {
+		f.Close()
+	}
+	return pos, os.Rename(tmp, path)
+}
+
+// sqliteSetup answers the given options, with their defaults filled
+// in, and the fields of the given entity type, in the order of their
+// columns.
+func sqliteSetup(ed *EntityTypeDefn, opts *SQLiteOpts) (SQLiteOpts, []FieldDefn, error) {
+	var o SQLiteOpts
+	if opts != nil {
+		o = *opts
+	}
+	if o.Table == "" {
+		o.Table = ed.Name()
+	}
+	fds := ed.Fields()
+	sort.Sort(fieldDefnsByID(fds))
+	for _, fd := range fds {
+		if sqliteType(fd.Ftype) == "" {
+			return o, nil, ErrFieldTypeUnsupported
+		}
+	}
+	return o, fds, nil
+}
+
+// sqliteChanges answers the IDs of the entities of the given type in
+// the given namespace changed since the given position in the change
+// log, in ascending order, and the position that they bring the table
+// to.  It answers `true` instead when a full export is needed: when
+// the position is `0`, the entity type has been redefined since then,
+// or the change log has been trimmed past it.
+func (db *DB) sqliteChanges(ns *Namespace, ed *EntityTypeDefn, since uint64) ([]uint64, uint64, bool, error) {
+	var ids []uint64
+	pos := since
+	for since > 0 {
+		cs, err := db.Changes(pos, sqliteChangesBatch)
+		if err == ErrChangesTrimmed {
+			return nil, 0, true, nil
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if len(cs) == 0 {
+			break
+		}
+		for _, c := range cs {
+			switch {
+			case c.Kind == ChangeRecordDefn && c.Type == ed.Name():
+				return nil, 0, true, nil
+			case c.Namespace == ns.Name() && c.Type == ed.Name() && len(c.Key) == 8:
+				ids = append(ids, binary.BigEndian.Uint64(c.Key))
+			}
+		}
+		pos = cs[len(cs)-1].Seq
+	}
+	if since == 0 {
+		return nil, 0, true, nil
+	}
+
+	sort.Sort(uint64s(ids))
+	res := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			res = append(res, id)
+		}
+	}
+	return res, pos, false, nil
+}
+
+// sqliteCreate answers the statement creating the given table, quoted,
+// having columns for the given fields.
+func sqliteCreate(table string, fds []FieldDefn) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CREATE TABLE %s (\"id\" INTEGER PRIMARY KEY", table)
+	for _, fd := range fds {
+		fmt.Fprintf(&sb, ", %s %s", sqliteIdent(fd.Name), sqliteType(fd.Ftype))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// sqliteExport holds the state of an export in progress.
+type sqliteExport struct {
+	et    *entityType
+	table string      // quoted name of the table
+	fds   []FieldDefn // fields, in the order of the columns
+	bw    *bufio.Writer
+}
+
+// full writes the script that creates the table afresh, and answers
+// the position in the change log that it corresponds to.
+func (x *sqliteExport) full(ns *Namespace, ed *EntityTypeDefn) (uint64, error) {
+	x.bw.WriteString("BEGIN;\n")
+	fmt.Fprintf(x.bw, "DROP TABLE IF EXISTS %s;\n", x.table)
+	x.bw.WriteString(sqliteCreate(x.table, x.fds) + ";\n")
+
+	var pos uint64
+	now := x.et.db.now().UnixNano()
+	err := x.et.db.view(context.Background(), func(tx *storage.Tx) error {
+		pos = tx.ChangeLogPosition()
+		return tx.ForEach(ns.Name(), ed.Name(), nil, func(k, v []byte) (bool, error) {
+			d, err := x.et.searchDoc(tx, binary.BigEndian.Uint64(k), v, SearchOpts{}, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			x.insert("INSERT", d)
+			return true, nil
+		})
+	})
+	return pos, err
+}
+
+// refresh writes the script that replaces or deletes the entities
+// having the given IDs.
+func (x *sqliteExport) refresh(ids []uint64) error {
+	x.bw.WriteString("BEGIN;\n")
+	now := x.et.db.now().UnixNano()
+	return x.et.db.view(context.Background(), func(tx *storage.Tx) error {
+		for _, id := range ids {
+			d, err := x.et.sqliteDoc(tx, id, now)
+			if err != nil {
+				return err
+			}
+			if d == nil {
+				fmt.Fprintf(x.bw, "DELETE FROM %s WHERE \"id\" = %d;\n", x.table, id)
+				continue
+			}
+			x.insert("INSERT OR REPLACE", d)
+		}
+		return nil
+	})
+}
+
+// sqliteDoc answers the document having the given ID, if it exists,
+// and has neither been soft-deleted nor expired; `nil` otherwise.
+func (et *entityType) sqliteDoc(tx *storage.Tx, id uint64, now int64) (*Document, error) {
+	v, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err == storage.ErrKeyUnknown {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return et.searchDoc(tx, id, v, SearchOpts{}, now)
+}
+
+// insert writes the given statement inserting the given document.
+func (x *sqliteExport) insert(stmt string, d *Document) {
+	fmt.Fprintf(x.bw, "%s INTO %s VALUES (%d", stmt, x.table, d.ID())
+	for _, fd := range x.fds {
+		x.bw.WriteString(", ")
+		f, ok := d.fields[fd.ID]
+		if !ok {
+			x.bw.WriteString("NULL")
+			continue
+		}
+		x.bw.WriteString(sqliteValue(f))
+	}
+	x.bw.WriteString(");\n")
+}
+
+// sqliteFileExport holds the state of an export to a database file in
+// progress.
+type sqliteFileExport struct {
+	et    *entityType
+	fds   []FieldDefn             // fields, in the order of the columns
+	sr    *sqliteReader           // previous export; nil if none
+	objs  map[string]sqliteObject // tables of the previous export
+	sw    *sqliteWriter
+	table sqliteObject // table written
+}
+
+// full writes the table afresh, and answers the position in the change
+// log that it corresponds to.
+func (x *sqliteFileExport) full(table, create string) (uint64, error) {
+	t := &sqliteTree{sw: x.sw}
+	var pos uint64
+	now := x.et.db.now().UnixNano()
+	err := x.et.db.view(context.Background(), func(tx *storage.Tx) error {
+		pos = tx.ChangeLogPosition()
+		return tx.ForEach(x.et.ns.Name(), x.et.Name(), nil, func(k, v []byte) (bool, error) {
+			d, err := x.et.searchDoc(tx, binary.BigEndian.Uint64(k), v, SearchOpts{}, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			return true, t.add(int64(d.ID()), x.record(d))
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	root, err := t.finish()
+	x.table = sqliteObject{name: table, root: root, sql: create}
+	return pos, err
+}
+
+// refresh writes the table of the previous export, with the entities
+// having the given IDs replaced or deleted.
+func (x *sqliteFileExport) refresh(table string, ids []uint64) error {
+	t := &sqliteTree{sw: x.sw}
+	now := x.et.db.now().UnixNano()
+	err := x.et.db.view(context.Background(), func(tx *storage.Tx) error {
+		// fresh adds the row of the entity having the given ID, unless
+		// it no longer exists.
+		fresh := func(id uint64) error {
+			d, err := x.et.sqliteDoc(tx, id, now)
+			if err != nil || d == nil {
+				return err
+			}
+			return t.add(int64(id), x.record(d))
+		}
+
+		// Both the rows and the IDs are in ascending order.
+		err := x.sr.walk(x.objs[table].root, func(rowid int64, rec []byte) error {
+			for len(ids) > 0 && int64(ids[0]) < rowid {
+				if err := fresh(ids[0]); err != nil {
+					return err
+				}
+				ids = ids[1:]
+			}
+			if len(ids) > 0 && int64(ids[0]) == rowid {
+				ids = ids[1:]
+				return fresh(uint64(rowid))
+			}
+			return t.add(rowid, rec)
+		})
+		for ; err == nil && len(ids) > 0; ids = ids[1:] {
+			err = fresh(ids[0])
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	root, err := t.finish()
+	x.table = x.objs[table]
+	x.table.root = root
+	return err
+}
+
+// record answers the record of the row of the given document.  Its
+// ID is the row ID, which its column aliases.
+func (x *sqliteFileExport) record(d *Document) []byte {
+	vals := make([]interface{}, 1, len(x.fds)+1)
+	for _, fd := range x.fds {
+		f, ok := d.fields[fd.ID]
+		if !ok {
+			vals = append(vals, nil)
+			continue
+		}
+		vals = append(vals, sqliteColumn(f))
+	}
+	return sqliteRecord(vals)
+}
+
+// finish copies the other tables of the previous export listed in the
+// given positions, writes the given position of the table written
+// along with theirs, and completes the file.
+func (x *sqliteFileExport) finish(syncs []sqliteSync, sy sqliteSync) error {
+	var tables []sqliteObject
+	var res []sqliteSync
+	for _, s := range syncs {
+		if s.table == sy.table {
+			continue
+		}
+		obj, ok := x.objs[s.table]
+		if !ok {
+			continue
+		}
+		t := &sqliteTree{sw: x.sw}
+		if err := x.sr.walk(obj.root, t.add); err != nil {
+			return err
+		}
+		root, err := t.finish()
+		if err != nil {
+			return err
+		}
+		obj.root = root
+		tables = append(tables, obj)
+		res = append(res, s)
+	}
+	tables = append(tables, x.table)
+	res = append(res, sy)
+
+	t := &sqliteTree{sw: x.sw}
+	for i, s := range res {
+		rec := sqliteRecord([]interface{}{s.table, s.ns, s.typ, int64(s.pos)})
+		if err := t.add(int64(i+1), rec); err != nil {
+			return err
+		}
+	}
+	root, err := t.finish()
+	if err != nil {
+		return err
+	}
+	tables = append(tables, sqliteObject{name: sqliteSyncTable, root: root, sql: sqliteSyncCreate})
+	return x.sw.finish(tables)
+}
+
+// sqliteType answers the SQLite type of the columns holding fields of
+// the given type; empty if they can not be exported.
+func sqliteType(t FieldType) string {
+	switch t {
+	case FieldTypeBool, FieldTypeInt8, FieldTypeInt16, FieldTypeInt32, FieldTypeInt64,
+		FieldTypeUint8, FieldTypeUint16, FieldTypeUint32, FieldTypeUint64, FieldTypeReference:
+		return "INTEGER"
+	case FieldTypeFloat32, FieldTypeFloat64:
+		return "REAL"
+	case FieldTypeTime, FieldTypeString:
+		return "TEXT"
+	default:
+		return ""
+	}
+}
+
+// sqliteColumn answers the SQLite value of the given field: `nil`, an
+// `int64`, a `float64` or a `string`.  Unsigned integers beyond the
+// range of SQLite's integers are stored as `REAL`s, as are 32-bit
+// floating point numbers, by their shortest decimal forms.  SQLite
+// stores NaN as `NULL`.
+func sqliteColumn(f Field) interface{} {
+	switch v := fieldValue(f).(type) {
+	case nil:
+		return nil
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case float32:
+		x, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return sqliteColumnFloat(x)
+	case float64:
+		return sqliteColumnFloat(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return expr.Normalise(v)
+	}
+}
+
+// sqliteColumnFloat answers the SQLite value of the given floating
+// point number.
+func sqliteColumnFloat(x float64) interface{} {
+	if math.IsNaN(x) {
+		return nil
+	}
+	return x
+}
+
+// sqliteValue answers the SQL literal of the value of the given field.
+func sqliteValue(f Field) string {
+	switch v := sqliteColumn(f).(type) {
+	case nil:
+		return "NULL"
+	case float64:
+		return sqliteFloat(v)
+	case string:
+		return sqliteString(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// sqliteFloat answers the SQL literal of the given floating point
+// number, other than NaN, which SQLite has no literal for.
+func sqliteFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "1e999"
+	case math.IsInf(x, -1):
+		return "-1e999"
+	}
+	s := strconv.FormatFloat(x, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
+// sqliteString answers the SQL literal of the given string.
+func sqliteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sqliteIdent answers the given identifier, quoted.
+func sqliteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
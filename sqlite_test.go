@@ -0,0 +1,172 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteRecord(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<56 - 1, 1 << 56, math.MaxUint64} {
+		by := sqliteVarint(nil, v)
+		if got, n := readSQLiteVarint(by); got != v || n != len(by) {
+			t.Errorf("varint %d: %d, %d of %d", v, got, n, len(by))
+		}
+	}
+
+	vals := []interface{}{nil, int64(0), int64(1), int64(-1), int64(200), int64(-40000),
+		int64(1 << 40), int64(math.MinInt64), 2.5, "", "text", strings.Repeat("y", 300), []byte{1, 2}}
+	got, err := sqliteValues(sqliteRecord(vals))
+	if err != nil || !reflect.DeepEqual(got, vals) {
+		t.Errorf("record: %v, %v", got, err)
+	}
+}
+
+// sqliteRows answers the rows of the given table of the SQLite database
+// file at the given path, by their IDs.
+func sqliteRows(t *testing.T, path, table string) map[int64][]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sr, err := openSQLite(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := sr.objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, ok := objs[table]
+	if !ok {
+		t.Fatalf("table %q missing", table)
+	}
+	rows := make(map[int64][]interface{})
+	last := int64(math.MinInt64)
+	err = sr.walk(obj.root, func(rowid int64, rec []byte) error {
+		if rowid <= last {
+			t.Errorf("row %d after %d", rowid, last)
+		}
+		last = rowid
+		vals, err := sqliteValues(rec)
+		rows[rowid] = vals
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestExportSQLite(t *testing.T) {
+	db := changeLogDB(t)
+	ns := testNamespace(t, "sqlite_ns")
+	ed := testDefn(t, "sqlite_item", []testField{
+		{"label", FieldTypeString}, {"count", FieldTypeInt32}, {"ratio", FieldTypeFloat32},
+		{"big", FieldTypeUint64}, {"flag", FieldTypeBool},
+	}, nil)
+	et := db.EntityType(ns, ed)
+
+	// Enough entities, some of them large, to need interior pages and
+	// overflow pages.
+	for id := uint64(1); id <= 400; id++ {
+		d := testDoc(t, ed, id, map[string]interface{}{"label": strings.Repeat("z", int(id)), "count": int32(id)})
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := testDoc(t, ed, 401, map[string]interface{}{
+		"label": strings.Repeat("long", 5000), "ratio": float32(0.1), "big": uint64(math.MaxUint64), "flag": true,
+	})
+	if err := et.Put(d); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "export.db")
+	pos, err := db.ExportSQLite(ns, ed, path, nil)
+	if err != nil || pos == 0 {
+		t.Fatalf("export: %d, %v", pos, err)
+	}
+	rows := sqliteRows(t, path, "sqlite_item")
+	if len(rows) != 401 {
+		t.Fatalf("rows: %d", len(rows))
+	}
+	want := []interface{}{nil, strings.Repeat("long", 5000), nil, 0.1, float64(math.MaxUint64), int64(1)}
+	if !reflect.DeepEqual(rows[401], want) {
+		t.Errorf("row 401: %v", rows[401][2:])
+	}
+
+	// Another table exported to the same file is kept.
+	other := testDefn(t, "sqlite_other", []testField{{"label", FieldTypeString}}, nil)
+	if err := db.EntityType(ns, other).Put(testDoc(t, other, 1, map[string]interface{}{"label": "kept"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExportSQLite(ns, other, path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshes replace and delete the entities changed since.
+	e, err := et.Get(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := e.(*Document).Field("label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setFieldValue(f, "seven"); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.Put(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.Delete(8); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.Put(testDoc(t, ed, 500, nil)); err != nil {
+		t.Fatal(err)
+	}
+	npos, err := db.ExportSQLite(ns, ed, path, nil)
+	if err != nil || npos <= pos {
+		t.Fatalf("refresh: %d after %d, %v", npos, pos, err)
+	}
+	rows = sqliteRows(t, path, "sqlite_item")
+	if len(rows) != 401 || rows[7][1] != "seven" || rows[8] != nil || rows[500] == nil || rows[9][1] != strings.Repeat("z", 9) {
+		t.Errorf("refreshed: %d rows, %v", len(rows), rows[7][1])
+	}
+	if rows := sqliteRows(t, path, "sqlite_other"); len(rows) != 1 || rows[1][1] != "kept" {
+		t.Errorf("other table: %v", rows)
+	}
+	syncs := sqliteRows(t, path, sqliteSyncTable)
+	if len(syncs) != 2 || syncs[2][0] != "sqlite_item" || syncs[2][3] != int64(npos) {
+		t.Errorf("positions: %v", syncs)
+	}
+
+	// Files not written by exports are left alone.
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", 200)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExportSQLite(ns, ed, path, nil); !errors.Is(err, ErrSQLiteFile) {
+		t.Errorf("foreign file: %v", err)
+	}
+}
@@ -0,0 +1,671 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+// SQLite database files are written, and read back, by hand, in the
+// file format of SQLite 3 (see https://www.sqlite.org/fileformat.html).
+// Only the part of the format that exports need is supported: tables,
+// without indexes, views or triggers, in UTF-8.  Each table is a table
+// b-tree, built bottom-up from its rows in the ascending order of
+// their row IDs; the schema table, whose root is page 1, lists them.
+
+const (
+	// sqlitePageSize is the size of the pages written, none of whose
+	// bytes are reserved.
+	sqlitePageSize = 4096
+
+	// sqliteAppID is the application ID of the files written, which
+	// identifies them as exports: "flag".
+	sqliteAppID = 0x666c6167
+
+	// sqliteVersion is the SQLite version number recorded in the files
+	// written, as that of the last library to modify them.
+	sqliteVersion = 3040000
+
+	// The types of b-tree pages.
+	sqliteInterior = 0x05
+	sqliteLeaf     = 0x0d
+
+	// sqliteMaxDepth is the greatest depth of the b-trees read.
+	sqliteMaxDepth = 32
+)
+
+// sqliteVarint appends the given SQLite variable-length integer to the
+// given bytes.  Unlike Go's, these are big-endian; the ninth byte, if
+// needed, holds eight bits.
+func sqliteVarint(by []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(by, buf[:]...)
+	}
+
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(by, buf[i:]...)
+}
+
+// readSQLiteVarint answers the SQLite variable-length integer at the
+// beginning of the given bytes, and its length; `0` if it is
+// incomplete.
+func readSQLiteVarint(by []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8 && i < len(by); i++ {
+		v = v<<7 | uint64(by[i]&0x7f)
+		if by[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	if len(by) < 9 {
+		return 0, 0
+	}
+	return v<<8 | uint64(by[8]), 9
+}
+
+// sqliteLocal answers the number of bytes of a payload of the given
+// size stored in its table leaf cell, on pages having the given usable
+// size; the rest is stored in overflow pages.
+func sqliteLocal(size, usable int) int {
+	max := usable - 35
+	if size <= max {
+		return size
+	}
+	min := (usable-12)*32/255 - 23
+	k := min + (size-min)%(usable-4)
+	if k <= max {
+		return k
+	}
+	return min
+}
+
+// sqliteRecord answers the record holding the given values, each of
+// which is `nil`, an `int64`, a `float64`, a `string` or a `[]byte`.
+func sqliteRecord(vals []interface{}) []byte {
+	var types, body []byte
+	for _, v := range vals {
+		var st uint64
+		switch v := v.(type) {
+		case int64:
+			switch {
+			case v == 0:
+				st = 8
+			case v == 1:
+				st = 9
+			default:
+				n := 8
+				for _, c := range []struct {
+					st   uint64
+					size int
+				}{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6}} {
+					if lim := int64(1) << (8*c.size - 1); v >= -lim && v < lim {
+						st, n = c.st, c.size
+						break
+					}
+				}
+				if n == 8 {
+					st = 6
+				}
+				var buf [8]byte
+				binary.BigEndian.PutUint64(buf[:], uint64(v))
+				body = append(body, buf[8-n:]...)
+			}
+		case float64:
+			st = 7
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+			body = append(body, buf[:]...)
+		case string:
+			st = uint64(len(v))*2 + 13
+			body = append(body, v...)
+		case []byte:
+			st = uint64(len(v))*2 + 12
+			body = append(body, v...)
+		}
+		types = sqliteVarint(types, st)
+	}
+
+	// The size of the header includes that of its own varint.
+	n := len(types) + 1
+	for len(sqliteVarint(nil, uint64(n))) > n-len(types) {
+		n++
+	}
+	rec := sqliteVarint(make([]byte, 0, n+len(body)), uint64(n))
+	return append(append(rec, types...), body...)
+}
+
+// sqliteValues answers the values held by the given record, as
+// `sqliteRecord` takes them.
+func sqliteValues(rec []byte) ([]interface{}, error) {
+	hsize, n := readSQLiteVarint(rec)
+	if n == 0 || hsize > uint64(len(rec)) {
+		return nil, ErrSQLiteFile
+	}
+	hdr, body := rec[n:hsize], rec[hsize:]
+
+	var res []interface{}
+	for len(hdr) > 0 {
+		st, n := readSQLiteVarint(hdr)
+		if n == 0 {
+			return nil, ErrSQLiteFile
+		}
+		hdr = hdr[n:]
+
+		var size int
+		switch {
+		case st == 0 || st == 8 || st == 9:
+		case st <= 4:
+			size = int(st)
+		case st == 5:
+			size = 6
+		case st <= 7:
+			size = 8
+		case st >= 12 && st < 1<<31:
+			size = int(st-12) / 2
+		default:
+			return nil, ErrSQLiteFile
+		}
+		if size > len(body) {
+			return nil, ErrSQLiteFile
+		}
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case st == 0:
+			res = append(res, nil)
+		case st == 8 || st == 9:
+			res = append(res, int64(st-8))
+		case st == 7:
+			res = append(res, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case st <= 6:
+			i := int64(int8(v[0]))
+			for _, b := range v[1:] {
+				i = i<<8 | int64(b)
+			}
+			res = append(res, i)
+		case st%2 == 1:
+			res = append(res, string(v))
+		default:
+			res = append(res, append([]byte(nil), v...))
+		}
+	}
+	return res, nil
+}
+
+// sqliteWriter writes a SQLite database file, a page at a time.  Page
+// 1, which holds the header and the root of the schema table, is
+// written last.
+type sqliteWriter struct {
+	w     io.WriterAt
+	pages uint32 // number of pages allocated
+}
+
+// newSQLiteWriter answers a writer of a database file to the given
+// destination, with page 1 allocated.
+func newSQLiteWriter(w io.WriterAt) *sqliteWriter {
+	return &sqliteWriter{w: w, pages: 1}
+}
+
+// alloc allocates the given number of consecutive pages, answering the
+// number of the first.
+func (sw *sqliteWriter) alloc(n int) uint32 {
+	no := sw.pages + 1
+	sw.pages += uint32(n)
+	return no
+}
+
+// put writes the page having the given number.
+func (sw *sqliteWriter) put(no uint32, pg []byte) error {
+	_, err := sw.w.WriteAt(pg, int64(no-1)*sqlitePageSize)
+	return err
+}
+
+// overflow writes the given part of a payload that does not fit in its
+// cell to a chain of overflow pages, answering the number of the first.
+func (sw *sqliteWriter) overflow(by []byte) (uint32, error) {
+	const chunk = sqlitePageSize - 4
+	n := (len(by) + chunk - 1) / chunk
+	first := sw.alloc(n)
+	for i := 0; i < n; i++ {
+		pg := make([]byte, sqlitePageSize)
+		if i < n-1 {
+			binary.BigEndian.PutUint32(pg, first+uint32(i)+1)
+		}
+		by = by[copy(pg[4:], by):]
+		if err := sw.put(first+uint32(i), pg); err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+// leafCell answers the table leaf cell holding the given row, writing
+// the part of its payload that does not fit to overflow pages.
+func (sw *sqliteWriter) leafCell(rowid int64, payload []byte) ([]byte, error) {
+	local := sqliteLocal(len(payload), sqlitePageSize)
+	cell := sqliteVarint(nil, uint64(len(payload)))
+	cell = sqliteVarint(cell, uint64(rowid))
+	cell = append(cell, payload[:local]...)
+	if local < len(payload) {
+		first, err := sw.overflow(payload[local:])
+		if err != nil {
+			return nil, err
+		}
+		cell = append(cell, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(cell[len(cell)-4:], first)
+	}
+	return cell, nil
+}
+
+// sqliteChild is a child of an interior b-tree page.
+type sqliteChild struct {
+	page uint32
+	key  int64 // largest row ID in its subtree
+}
+
+// interiorCell answers the table interior cell of the given child.
+func interiorCell(c sqliteChild) []byte {
+	cell := make([]byte, 4, 13)
+	binary.BigEndian.PutUint32(cell, c.page)
+	return sqliteVarint(cell, uint64(c.key))
+}
+
+// sqliteInteriorFanout is the number of children that an interior page
+// surely holds: those of the cells of the greatest size, and its
+// right-most child.
+const sqliteInteriorFanout = (sqlitePageSize-12)/(4+9+2) + 1
+
+// sqlitePage answers a b-tree page of the given type holding the given
+// cells, whose header begins at the given offset: 100 on page 1, after
+// the database header.  The right-most child is that of interior
+// pages.
+func sqlitePage(typ byte, cells [][]byte, right uint32, off int) []byte {
+	pg := make([]byte, sqlitePageSize)
+	ptr := off + 8
+	if typ == sqliteInterior {
+		ptr = off + 12
+		binary.BigEndian.PutUint32(pg[off+8:], right)
+	}
+	end := sqlitePageSize
+	for _, c := range cells {
+		end -= len(c)
+		copy(pg[end:], c)
+		binary.BigEndian.PutUint16(pg[ptr:], uint16(end))
+		ptr += 2
+	}
+	pg[off] = typ
+	binary.BigEndian.PutUint16(pg[off+3:], uint16(len(cells)))
+	binary.BigEndian.PutUint16(pg[off+5:], uint16(end))
+	return pg
+}
+
+// sqliteTree builds a table b-tree from rows added in the ascending
+// order of their row IDs.
+type sqliteTree struct {
+	sw       *sqliteWriter
+	cells    [][]byte      // cells of the leaf being filled
+	size     int           // space that they take in the leaf
+	last     int64         // row ID of the last row added
+	children []sqliteChild // leaves written
+}
+
+// add adds the row having the given ID and record.
+func (t *sqliteTree) add(rowid int64, rec []byte) error {
+	cell, err := t.sw.leafCell(rowid, rec)
+	if err != nil {
+		return err
+	}
+	if len(t.cells) > 0 && t.size+len(cell)+2 > sqlitePageSize-8 {
+		if err = t.flush(); err != nil {
+			return err
+		}
+	}
+	t.cells = append(t.cells, cell)
+	t.size += len(cell) + 2
+	t.last = rowid
+	return nil
+}
+
+// flush writes the leaf being filled.
+func (t *sqliteTree) flush() error {
+	no := t.sw.alloc(1)
+	err := t.sw.put(no, sqlitePage(sqliteLeaf, t.cells, 0, 0))
+	if err != nil {
+		return err
+	}
+	t.children = append(t.children, sqliteChild{page: no, key: t.last})
+	t.cells, t.size = nil, 0
+	return nil
+}
+
+// finish writes the rest of the tree, answering the number of its root
+// page.
+func (t *sqliteTree) finish() (uint32, error) {
+	if len(t.cells) > 0 || len(t.children) == 0 {
+		if err := t.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	level := t.children
+	for len(level) > 1 {
+		// Children are spread evenly, so that every page has at least
+		// two of them: a cell, and its right-most child.
+		n := (len(level) + sqliteInteriorFanout - 1) / sqliteInteriorFanout
+		var next []sqliteChild
+		for i := 0; i < n; i++ {
+			cs := level[:len(level)/(n-i)]
+			level = level[len(cs):]
+
+			cells := make([][]byte, 0, len(cs)-1)
+			for _, c := range cs[:len(cs)-1] {
+				cells = append(cells, interiorCell(c))
+			}
+			no := t.sw.alloc(1)
+			err := t.sw.put(no, sqlitePage(sqliteInterior, cells, cs[len(cs)-1].page, 0))
+			if err != nil {
+				return 0, err
+			}
+			next = append(next, sqliteChild{page: no, key: cs[len(cs)-1].key})
+		}
+		level = next
+	}
+	return level[0].page, nil
+}
+
+// sqliteObject is a table listed in the schema table.
+type sqliteObject struct {
+	name string
+	root uint32
+	sql  string
+}
+
+// finish writes the schema table listing the given tables, and the
+// header of the database.
+func (sw *sqliteWriter) finish(tables []sqliteObject) error {
+	var cells [][]byte
+	size := 0
+	for i, tbl := range tables {
+		rec := sqliteRecord([]interface{}{"table", tbl.name, tbl.name, int64(tbl.root), tbl.sql})
+		cell, err := sw.leafCell(int64(i+1), rec)
+		if err != nil {
+			return err
+		}
+		cells = append(cells, cell)
+		size += len(cell) + 2
+	}
+
+	// Page 1 holds the schema table, if it fits; otherwise, its rows
+	// are in leaves of their own, and page 1 is their parent.
+	var pg []byte
+	if size <= sqlitePageSize-100-8 {
+		pg = sqlitePage(sqliteLeaf, cells, 0, 100)
+	} else {
+		var ics [][]byte
+		var right uint32
+		for i, c := range cells {
+			right = sw.alloc(1)
+			err := sw.put(right, sqlitePage(sqliteLeaf, [][]byte{c}, 0, 0))
+			if err != nil {
+				return err
+			}
+			if i < len(cells)-1 {
+				ics = append(ics, interiorCell(sqliteChild{page: right, key: int64(i + 1)}))
+			}
+		}
+		pg = sqlitePage(sqliteInterior, ics, right, 100)
+	}
+
+	copy(pg, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(pg[16:], sqlitePageSize)
+	pg[18], pg[19] = 1, 1                  // rollback journalling
+	pg[21], pg[22], pg[23] = 64, 32, 32    // payload fractions
+	binary.BigEndian.PutUint32(pg[24:], 1) // change counter
+	binary.BigEndian.PutUint32(pg[28:], sw.pages)
+	binary.BigEndian.PutUint32(pg[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(pg[44:], 4) // schema format
+	binary.BigEndian.PutUint32(pg[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(pg[68:], sqliteAppID)
+	binary.BigEndian.PutUint32(pg[92:], 1) // version valid for
+	binary.BigEndian.PutUint32(pg[96:], sqliteVersion)
+	return sw.put(1, pg)
+}
+
+// sqliteReader reads the tables of a SQLite database file written by
+// `sqliteWriter`, or by SQLite since.
+type sqliteReader struct {
+	r      io.ReaderAt
+	size   int    // page size
+	usable int    // usable size of pages
+	pages  uint32 // number of pages
+}
+
+// openSQLite answers a reader of the given database file, verifying
+// that it is an export.
+func openSQLite(f *os.File) (*sqliteReader, error) {
+	var hdr [100]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrSQLiteFile
+		}
+		return nil, err
+	}
+	if string(hdr[:16]) != "SQLite format 3\x00" || hdr[18] != 1 || hdr[19] != 1 ||
+		binary.BigEndian.Uint32(hdr[56:]) != 1 || binary.BigEndian.Uint32(hdr[68:]) != sqliteAppID {
+		return nil, ErrSQLiteFile
+	}
+
+	sr := &sqliteReader{r: f, size: int(binary.BigEndian.Uint16(hdr[16:]))}
+	if sr.size == 1 {
+		sr.size = 65536
+	}
+	sr.usable = sr.size - int(hdr[20])
+	if sr.size < 512 || sr.size&(sr.size-1) != 0 || sr.usable < 480 {
+		return nil, ErrSQLiteFile
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sr.pages = uint32(fi.Size() / int64(sr.size))
+	return sr, nil
+}
+
+// page answers the page having the given number.
+func (sr *sqliteReader) page(no uint32) ([]byte, error) {
+	if no == 0 || no > sr.pages {
+		return nil, ErrSQLiteFile
+	}
+	pg := make([]byte, sr.size)
+	_, err := sr.r.ReadAt(pg, int64(no-1)*int64(sr.size))
+	return pg, err
+}
+
+// walk calls the given function with the row ID and record of each row
+// of the table b-tree whose root is the given page, in the ascending
+// order of their row IDs.
+func (sr *sqliteReader) walk(root uint32, fn func(int64, []byte) error) error {
+	return sr.walkPage(root, 0, fn)
+}
+
+// walkPage implements `walk` for the subtree at the given depth, whose
+// root is the given page.
+func (sr *sqliteReader) walkPage(no uint32, depth int, fn func(int64, []byte) error) error {
+	if depth > sqliteMaxDepth {
+		return ErrSQLiteFile
+	}
+	pg, err := sr.page(no)
+	if err != nil {
+		return err
+	}
+	off := 0
+	if no == 1 {
+		off = 100
+	}
+	typ, n := pg[off], int(binary.BigEndian.Uint16(pg[off+3:]))
+	ptrs := off + 8
+	if typ == sqliteInterior {
+		ptrs = off + 12
+	}
+	if typ != sqliteInterior && typ != sqliteLeaf || ptrs+2*n > sr.usable {
+		return ErrSQLiteFile
+	}
+
+	for i := 0; i < n; i++ {
+		cp := int(binary.BigEndian.Uint16(pg[ptrs+2*i:]))
+		if cp < ptrs+2*n || cp+4 > sr.usable {
+			return ErrSQLiteFile
+		}
+		cell := pg[cp:sr.usable]
+
+		if typ == sqliteInterior {
+			err = sr.walkPage(binary.BigEndian.Uint32(cell), depth+1, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		size, n1 := readSQLiteVarint(cell)
+		rowid, n2 := readSQLiteVarint(cell[n1:])
+		if n1 == 0 || n2 == 0 || size > math.MaxInt32 {
+			return ErrSQLiteFile
+		}
+		rec, err := sr.payload(cell[n1+n2:], int(size))
+		if err != nil {
+			return err
+		}
+		err = fn(int64(rowid), rec)
+		if err != nil {
+			return err
+		}
+	}
+	if typ == sqliteInterior {
+		return sr.walkPage(binary.BigEndian.Uint32(pg[off+8:]), depth+1, fn)
+	}
+	return nil
+}
+
+// payload answers the payload of the given size that begins at the
+// beginning of the given bytes of a leaf cell, and continues in
+// overflow pages, if necessary.
+func (sr *sqliteReader) payload(by []byte, size int) ([]byte, error) {
+	local := sqliteLocal(size, sr.usable)
+	if local == size {
+		if size > len(by) {
+			return nil, ErrSQLiteFile
+		}
+		return by[:size], nil
+	}
+	if local+4 > len(by) {
+		return nil, ErrSQLiteFile
+	}
+
+	rec := make([]byte, 0, size)
+	rec = append(rec, by[:local]...)
+	next := binary.BigEndian.Uint32(by[local:])
+	for len(rec) < size {
+		pg, err := sr.page(next)
+		if err != nil {
+			return nil, err
+		}
+		n := size - len(rec)
+		if n > sr.usable-4 {
+			n = sr.usable - 4
+		}
+		rec = append(rec, pg[4:4+n]...)
+		next = binary.BigEndian.Uint32(pg)
+	}
+	return rec, nil
+}
+
+// objects answers the tables listed in the schema table, by their
+// names.  Other objects, such as indexes, are ignored.
+func (sr *sqliteReader) objects() (map[string]sqliteObject, error) {
+	res := make(map[string]sqliteObject)
+	err := sr.walk(1, func(_ int64, rec []byte) error {
+		vals, err := sqliteValues(rec)
+		if err != nil {
+			return err
+		}
+		if len(vals) != 5 || vals[0] != "table" {
+			return nil
+		}
+		name, _ := vals[1].(string)
+		root, _ := vals[3].(int64)
+		sql, _ := vals[4].(string)
+		if root <= 0 || root > math.MaxUint32 {
+			return ErrSQLiteFile
+		}
+		res[name] = sqliteObject{name: name, root: uint32(root), sql: sql}
+		return nil
+	})
+	return res, err
+}
+
+// sqliteSync is a row of the table that records the positions of
+// exported tables.
+type sqliteSync struct {
+	table string
+	ns    string
+	typ   string
+	pos   uint64
+}
+
+// syncs answers the rows of the table that records the positions of
+// exported tables, given the tables listed in the schema table.
+func (sr *sqliteReader) syncs(objs map[string]sqliteObject) ([]sqliteSync, error) {
+	obj, ok := objs[sqliteSyncTable]
+	if !ok {
+		return nil, ErrSQLiteFile
+	}
+	var res []sqliteSync
+	err := sr.walk(obj.root, func(_ int64, rec []byte) error {
+		vals, err := sqliteValues(rec)
+		if err != nil {
+			return err
+		}
+		if len(vals) < 4 {
+			return ErrSQLiteFile
+		}
+		var sy sqliteSync
+		sy.table, _ = vals[0].(string)
+		sy.ns, _ = vals[1].(string)
+		sy.typ, _ = vals[2].(string)
+		pos, _ := vals[3].(int64)
+		if pos > 0 {
+			sy.pos = uint64(pos)
+		}
+		res = append(res, sy)
+		return nil
+	})
+	return res, err
+}
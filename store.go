@@ -0,0 +1,792 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of entities scanned by a search between checks of its
+// context.
+const searchCheckEvery = 256
+
+// entityType is `flagon`'s implementation of `EntityType`.  It stores
+// documents of a given entity type in that entity type's bucket in a
+// given namespace.
+type entityType struct {
+	db   *DB             // database holding the instances
+	ns   *Namespace      // namespace of the instances
+	defn *EntityTypeDefn // definition of the instances
+	rtx  *storage.Tx     // read transaction of a snapshot, if bound to one
+}
+
+// EntityType answers a handle to the instances of the given entity
+// type in the given namespace.  Instances are `*Document`s.  The
+// bucket of the entity type is created when its first instance is
+// stored.  The answered handle is also a `VersionedEntityType`, a
+// `ProvenanceRecorder`, a `SoftDeleter`, an `ExpiringEntityType`, a
+// `Labeller`, a `ContextEntityType`, a `HistoryEntityType`, a
+// `Freezer`, a `Paginator`, an `Indexer`, an `Aggregator`, a
+// `ParallelSearcher`, an `EntitySearcher`, a `KeyScanner`, a
+// `ReferrerFinder`, a `Walker`, a `Duplicator`, an `AtomicWriter`, a
+// `Patcher`, an `Incrementer`, a `ZeroCopySearcher` and a
+// `MultiGetter`.  See `DB.NewAsyncWriter` for buffering puts.
+func (db *DB) EntityType(ns *Namespace, ed *EntityTypeDefn) EntityType {
+	return &entityType{db: db, ns: ns, defn: ed}
+}
+
+// Name answers the name of this entity type.
+func (et *entityType) Name() string {
+	return et.defn.Name()
+}
+
+// Get answers the document having the given ID.  Soft-deleted and
+// expired documents are not answered.  Documents stored at earlier
+// schema versions are upgraded, and may be read-repaired; see
+// `Options.ReadRepair`.  Documents may be answered from an in-process
+// cache; see `EntityTypeDefn.SetCacheSize`.
+func (et *entityType) Get(id uint64) (Entity, error) {
+	return et.getContext(context.Background(), id)
+}
+
+// getContext implements `Get` and `GetContext`, in a span.
+func (et *entityType) getContext(ctx context.Context, id uint64) (Entity, error) {
+	if id == 0 {
+		return nil, ErrIdentifierZero
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, sp := et.startSpan(ctx, spanGet)
+	sp.SetAttribute(attrID, id)
+	d, err := et.getDoc(ctx, id)
+	endSpan(sp, err)
+	if err != nil {
+		return nil, et.entityError(opGet, id, err)
+	}
+	return d, nil
+}
+
+// getDoc answers the document having the given ID, as `Get` does.
+func (et *entityType) getDoc(ctx context.Context, id uint64) (*Document, error) {
+	var d *Document
+	now := et.db.now().UnixNano()
+	c := et.cache()
+	err := et.view(ctx, func(tx *storage.Tx) error {
+		var err error
+		d, err = et.getLive(tx, c, id, now)
+		return err
+	})
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil, ErrIdentifierUnknown
+		}
+		return nil, err
+	}
+
+	if et.needsRepair(d) {
+		et.readRepair([]uint64{id})
+	}
+	return d, nil
+}
+
+// getLive answers the document having the given ID, within the given
+// transaction, using the given cache, if any.  Soft-deleted documents,
+// and those expired at the given time, are answered as
+// `storage.ErrKeyUnknown`.
+func (et *entityType) getLive(tx *storage.Tx, c *entityCache, id uint64, now int64) (*Document, error) {
+	var d *Document
+	var err error
+	if c != nil {
+		d, err = et.getCached(tx, c, id)
+	} else {
+		d, err = et.get(tx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.deleted != 0 || d.expired(now) {
+		return nil, storage.ErrKeyUnknown
+	}
+	return d, nil
+}
+
+// Put stores the given document, replacing its previous version, if
+// any.  A document having a zero ID is assigned a new unique ID when
+// it is stored: its time, for time series (see
+// `EntityTypeDefn.SetTimeSeries`).  The index of references is updated
+// to match the reference fields of the document.  The document's
+// version is incremented, and its expiry time, if any, is removed.  A
+// document violating the validation rules of its entity type is not
+// stored; a `*ValidationError` is answered.  Nor is one changing an
+// immutable field; an `*ImmutableFieldError` is answered.
+func (et *entityType) Put(e Entity) error {
+	return et.put(e, putOpts{})
+}
+
+// PutIfVersion is like `Put`, but stores the given document only if
+// its stored version is the given one; `0` if it should not exist.
+// Otherwise, it answers `ErrVersionConflict`, and the caller should
+// read the document again and retry.
+//
+// Typically, the expected version is the `Version()` of the document
+// as read.  This enables safe read-modify-write cycles from concurrent
+// goroutines or processes.
+func (et *entityType) PutIfVersion(e Entity, expected uint64) error {
+	return et.put(e, putOpts{expected: &expected})
+}
+
+// PutWithProvenance is like `Put`, but records the given provenance
+// for the stored version of the document.  A zero time in the
+// provenance is replaced by the current time.
+func (et *entityType) PutWithProvenance(e Entity, p Provenance) error {
+	return et.put(e, putOpts{prov: &p})
+}
+
+// putOpts holds the optional settings of `put`.
+type putOpts struct {
+	expected *uint64     // version that should be stored, if given
+	prov     *Provenance // provenance to record, if given
+	expires  int64       // expiry time; 0 = never
+	at       int64       // time of a new time-series document; 0 = now
+
+	// ctx, if given, is that of the operation.  It is checked before
+	// the operation begins, and carries the actor to record in the
+	// audit log.
+	ctx context.Context
+}
+
+// put implements `Put` and its variants, in a span.
+func (et *entityType) put(e Entity, o putOpts) error {
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, sp := et.startSpan(ctx, spanPut)
+	o.ctx = ctx
+	err := et.putDoc(e, o)
+	if err == nil {
+		sp.SetAttribute(attrID, e.ID())
+	}
+	endSpan(sp, err)
+	return et.entityError(opPut, e.ID(), err)
+}
+
+// putDoc stores the given document, as `put` does.  The stored version is
+// verified only if an expected version is given.  The recorded
+// provenance and expiry time of the document are replaced by the given
+// ones, or are removed if none are given.
+func (et *entityType) putDoc(e Entity, o putOpts) error {
+	d, ok := e.(*Document)
+	if !ok || d.defn.Name() != et.Name() {
+		return ErrEntityTypeMismatch
+	}
+	ctx := o.ctx
+	by, err := et.prepare(ctx, d)
+	if err != nil {
+		return err
+	}
+	id := d.ID()
+	var rev uint64
+	now := et.db.now().UnixNano()
+	expected, prov := o.expected, o.prov
+	if prov != nil {
+		if prov.Time.IsZero() {
+			prov.Time = time.Unix(0, now)
+		}
+		err = prov.validate()
+		if err != nil {
+			return err
+		}
+	}
+	schema := d.schema
+	d.schema = et.defn.SchemaVersion()
+	err = et.db.update(ctx, func(tx *storage.Tx) error {
+		prior := storage.Prior{Known: true}
+		if id == 0 {
+			if expected != nil && *expected != 0 {
+				return ErrVersionConflict
+			}
+			at := o.at
+			if at == 0 {
+				at = now
+			}
+			var err error
+			id, err = et.newID(tx, at, nil)
+			if err != nil {
+				return err
+			}
+		} else {
+			if expected != nil {
+				cur, err := et.revision(tx, id)
+				if err != nil {
+					return err
+				}
+				if cur != *expected {
+					return ErrVersionConflict
+				}
+			}
+			err := et.checkImmutable(tx, id, d)
+			if err != nil {
+				return err
+			}
+			if prov != nil {
+				prior, err = tx.PriorVersion(et.ns.Name(), et.Name(), id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		var err error
+		rev, err = et.store(tx, id, by, d, now, ActorFrom(ctx))
+		if err != nil {
+			return err
+		}
+		err = et.outbox(ctx, tx, ChangePut, id, rev, now)
+		if err != nil {
+			return err
+		}
+		err = tx.SetExpiry(et.ns.Name(), et.Name(), id, o.expires)
+		if err != nil {
+			return err
+		}
+		if prov != nil {
+			return tx.SetProvenance(et.ns.Name(), et.Name(), id, prov.stamp(rev), prior)
+		}
+		return tx.ClearProvenance(et.ns.Name(), et.Name(), id)
+	})
+	if err != nil {
+		d.schema = schema
+		return err
+	}
+
+	d.id = id
+	d.version = rev
+	d.prov = prov
+	d.expires = o.expires
+	et.runHooks(ctx, AfterPut, id, d)
+	return nil
+}
+
+// prepare calls the `BeforePut` hooks for the given document, computes
+// its derived fields and validates it, for an operation having the
+// given context, and answers its stored form.
+func (et *entityType) prepare(ctx context.Context, d *Document) ([]byte, error) {
+	err := et.runHooks(ctx, BeforePut, d.ID(), d)
+	if err != nil {
+		return nil, err
+	}
+	return et.encodeValid(d)
+}
+
+// encodeValid computes the derived fields of the given document,
+// validates it, and answers its stored form, after verifying its size.
+func (et *entityType) encodeValid(d *Document) ([]byte, error) {
+	err := et.defn.compute(d)
+	if err != nil {
+		return nil, err
+	}
+	err = d.Validate()
+	if err != nil {
+		return nil, err
+	}
+	by, err := et.encode(d)
+	if err != nil {
+		return nil, err
+	}
+	err = et.checkSize(d, by)
+	if err != nil {
+		return nil, err
+	}
+	return by, nil
+}
+
+// Delete removes the document having the given ID.  It answers
+// `ErrIdentifierUnknown`, which is an `ErrNotFound`, if the document
+// does not exist; soft-deleted and expired documents exist until they
+// are removed.  See `DeleteIfExists`.  The references that it makes
+// are removed from the index of references.  References to it are
+// treated as their fields' `OnDelete` behaviours specify: by default,
+// they are retained.  Documents deleted by cascades do not run hooks.
+// The entries of the batch log, if any, are retained.
+func (et *entityType) Delete(id uint64) error {
+	return et.delete(context.Background(), id)
+}
+
+// delete implements `Delete` and `DeleteContext`, in a span.
+func (et *entityType) delete(ctx context.Context, id uint64) error {
+	if id == 0 {
+		return ErrIdentifierZero
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, sp := et.startSpan(ctx, spanDelete)
+	sp.SetAttribute(attrID, id)
+	err := et.deleteDoc(ctx, id, nil)
+	endSpan(sp, err)
+	return et.entityError(opDelete, id, err)
+}
+
+// deleteDoc removes the document having the given ID, as `Delete`
+// does, recording the actor in the given context in the audit log.
+// The stored version is verified only if an expected version is given.
+// The `BeforeDelete` hooks are called only if the document exists, and
+// has the expected version; both are verified again in the
+// transaction of the deletion.
+func (et *entityType) deleteDoc(ctx context.Context, id uint64, expected *uint64) error {
+	err := et.db.view(ctx, func(tx *storage.Tx) error {
+		return et.deletable(tx, id, expected)
+	})
+	if err != nil {
+		return err
+	}
+	err = et.runHooks(ctx, BeforeDelete, id, nil)
+	if err != nil {
+		return err
+	}
+
+	now := et.db.now().UnixNano()
+	err = et.db.update(ctx, func(tx *storage.Tx) error {
+		err := et.deletable(tx, id, expected)
+		if err != nil {
+			return err
+		}
+		err = et.enforceRefs(tx, id, now, ActorFrom(ctx), make(map[ref]bool))
+		if err != nil {
+			return err
+		}
+		rev := tx.Revision(et.ns.Name(), et.Name(), id)
+		err = et.remove(tx, id, now, ActorFrom(ctx))
+		if err != nil {
+			return err
+		}
+		err = et.outbox(ctx, tx, ChangeDelete, id, rev, now)
+		if err != nil {
+			return err
+		}
+		return tx.ClearProvenance(et.ns.Name(), et.Name(), id)
+	})
+	if err != nil {
+		return err
+	}
+
+	et.runHooks(ctx, AfterDelete, id, nil)
+	return nil
+}
+
+// deletable answers `ErrIdentifierUnknown` if the document having the
+// given ID does not exist, and `ErrVersionConflict` if an expected
+// version is given, and is not its stored version.
+func (et *entityType) deletable(tx *storage.Tx, id uint64, expected *uint64) error {
+	_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return ErrIdentifierUnknown
+		}
+		return err
+	}
+	if expected != nil {
+		cur, err := et.revision(tx, id)
+		if err != nil {
+			return err
+		}
+		if cur != *expected {
+			return ErrVersionConflict
+		}
+	}
+	return nil
+}
+
+// store stores the given stored form of the given document, under the
+// given ID, within the given transaction, restoring it if it is
+// soft-deleted.  It answers the new version of the document.  The
+// document is needed only to update the index of references, if its
+// entity type has reference fields; its schema version is recorded, if
+// it is given.  The given actor is recorded in the audit log, if
+// enabled; the new version is recorded in the history of the document,
+// if retained.  The indexes of its entity type, if any, are updated
+// from the stored form.
+func (et *entityType) store(tx *storage.Tx, id uint64, by []byte, d *Document, now int64, actor string) (uint64, error) {
+	if err := et.checkQuota(tx, id, by); err != nil {
+		return 0, err
+	}
+	et.invalidate(tx, id)
+	var old *Document
+	watched := et.watched()
+	if watched || et.defn.hasReferences() {
+		var err error
+		old, err = et.get(tx, id)
+		if err != nil && err != storage.ErrKeyUnknown {
+			return 0, err
+		}
+	}
+	indexed, err := et.indexed(tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Put(et.ns.Name(), et.Name(), EntityKey{id: id}.Key(), by)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Untrash(et.ns.Name(), et.Name(), id)
+	if err != nil {
+		return 0, err
+	}
+	rev, err := tx.NextRevision(et.ns.Name(), et.Name(), id)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.TouchRefCount(et.ns.Name(), et.Name(), id, now)
+	if err != nil {
+		return 0, err
+	}
+	var schema uint32
+	if d != nil {
+		schema = d.schema
+	}
+	err = tx.SetSchemaVersion(et.ns.Name(), et.Name(), id, schema)
+	if err != nil {
+		return 0, err
+	}
+	err = et.audit(tx, ChangePut, id, rev, now, actor)
+	if err != nil {
+		return 0, err
+	}
+	if et.defn.KeepsHistory() {
+		err = tx.AppendHistory(et.ns.Name(), et.Name(), id, storage.HistoryRecord{Time: now, Rev: rev, Record: by})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if watched {
+		cur := NewDocument(et.defn, id)
+		err = et.decode(by, cur)
+		if err != nil {
+			return 0, err
+		}
+		cur.version = rev
+		et.notify(tx, ChangeEvent{Op: ChangePut, ID: id, Version: rev, Old: old, New: cur})
+	}
+	if et.defn.hasIndexes() {
+		cur := NewDocument(et.defn, id)
+		err = et.decode(by, cur)
+		if err == nil {
+			err = et.updateIndexes(tx, id, indexed, cur)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rev, et.updateRefs(tx, id, old, d, now)
+}
+
+// remove removes the document having the given ID, within the given
+// transaction, updating the index of references and the indexes of
+// its entity type.  The given actor is recorded in the audit log, if
+// enabled; the deletion is recorded in the history of the document, if
+// retained.
+func (et *entityType) remove(tx *storage.Tx, id uint64, now int64, actor string) error {
+	if err := et.releaseQuota(tx, id); err != nil {
+		return err
+	}
+	et.invalidate(tx, id)
+	watched := et.watched()
+	if watched || et.defn.hasReferences() {
+		old, err := et.get(tx, id)
+		if err != nil && err != storage.ErrKeyUnknown {
+			return err
+		}
+		err = et.updateRefs(tx, id, old, nil, now)
+		if err != nil {
+			return err
+		}
+		if watched && old != nil {
+			et.notify(tx, ChangeEvent{Op: ChangeDelete, ID: id, Version: old.version, Old: old})
+		}
+	}
+
+	if et.db.opts.Audit || et.defn.KeepsHistory() {
+		_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+		if err == nil {
+			rev := tx.Revision(et.ns.Name(), et.Name(), id)
+			err = et.audit(tx, ChangeDelete, id, rev, now, actor)
+			if err == nil && et.defn.KeepsHistory() {
+				err = tx.AppendHistory(et.ns.Name(), et.Name(), id, storage.HistoryRecord{Time: now, Rev: rev})
+			}
+		}
+		if err != nil && err != storage.ErrKeyUnknown {
+			return err
+		}
+	}
+
+	indexed, err := et.indexed(tx, id)
+	if err == nil && indexed != nil {
+		err = et.updateIndexes(tx, id, indexed, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.DropRefCount(et.ns.Name(), et.Name(), id)
+	if err != nil {
+		return err
+	}
+	err = tx.Untrash(et.ns.Name(), et.Name(), id)
+	if err != nil {
+		return err
+	}
+	err = tx.SetExpiry(et.ns.Name(), et.Name(), id, 0)
+	if err != nil {
+		return err
+	}
+	err = tx.SetLabels(et.ns.Name(), et.Name(), id, nil)
+	if err != nil {
+		return err
+	}
+	err = tx.SetSchemaVersion(et.ns.Name(), et.Name(), id, 0)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+}
+
+// get answers the stored document having the given ID, within the
+// given transaction, upgraded to the current schema version.
+func (et *entityType) get(tx *storage.Tx, id uint64) (*Document, error) {
+	d := NewDocument(et.defn, id)
+	by, err := tx.Get(et.ns.Name(), et.Name(), d.Key())
+	if err != nil {
+		return nil, err
+	}
+	err = et.decode(by, d)
+	if err != nil {
+		return nil, err
+	}
+	et.readMeta(tx, d)
+	err = et.defn.upgrade(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readMeta reads the version, the provenance, the soft-deletion time,
+// the expiry time, the labels and the schema version of the given
+// document, within the given transaction.
+func (et *entityType) readMeta(tx *storage.Tx, d *Document) {
+	d.version = tx.Revision(et.ns.Name(), et.Name(), d.ID())
+	d.deleted, _ = tx.Trashed(et.ns.Name(), et.Name(), d.ID())
+	d.expires, _ = tx.Expiry(et.ns.Name(), et.Name(), d.ID())
+	d.labels = tx.Labels(et.ns.Name(), et.Name(), d.ID())
+	d.schema = tx.SchemaVersion(et.ns.Name(), et.Name(), d.ID())
+	if s, ok := tx.Provenance(et.ns.Name(), et.Name(), d.ID()); ok {
+		d.prov = provenanceOf(s)
+	}
+}
+
+// revision answers the stored version of the document having the
+// given ID, within the given transaction; `0` if it does not exist.
+func (et *entityType) revision(tx *storage.Tx, id uint64) (uint64, error) {
+	_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return tx.Revision(et.ns.Name(), et.Name(), id), nil
+}
+
+// Search iterates through the documents of this entity type in the
+// ascending order of their IDs, beginning at `opts.StartAt`, and
+// answers the IDs of those that satisfy the given predicate.  The
+// predicate receives only the fields listed in `opts.Fields`, if
+// given.  Expired documents are skipped; so are soft-deleted ones,
+// unless `opts.IncludeDeleted` is set.  `opts.Operator` is not used; the
+// predicate is expected to perform its own comparisons.
+//
+// Results are answered in the order of the values of a field instead,
+// if requested using `SearchOpts.OrderBy`.
+func (et *entityType) Search(opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	return et.search(context.Background(), opts, fn)
+}
+
+// search implements `Search` and `SearchContext`, in a span.
+func (et *entityType) search(ctx context.Context, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, sp := et.startSpan(ctx, spanSearch)
+	res, err := et.searchDocs(ctx, opts, fn)
+	sp.SetAttribute(attrResults, len(res))
+	endSpan(sp, err)
+	return res, err
+}
+
+// searchDocs passes the documents to the given predicate, as `Search`
+// does.  The given context is checked every `searchCheckEvery`
+// entities scanned.
+func (et *entityType) searchDocs(ctx context.Context, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	if opts.orderBy != "" {
+		return et.searchOrdered(ctx, opts, fn)
+	}
+
+	var scanned uint64
+	res, repairs, err := et.scanRange(ctx, opts, fn, 0, &scanned)
+	if err != nil {
+		return nil, err
+	}
+
+	et.readRepair(repairs)
+	return res, nil
+}
+
+// scanRange passes the documents whose IDs are equal to or greater
+// than `opts.StartAt`, and less than the given ID - unbounded if it is
+// `0` - to the given predicate, as `Search` does.  It answers the IDs
+// of those that satisfy the predicate, and of those that need
+// read-repair.  Scanned documents are counted in the given counter,
+// atomically, so that concurrent scans share `opts.MaxScanned`.
+func (et *entityType) scanRange(ctx context.Context, opts SearchOpts, fn SearchFn, end uint64, scanned *uint64) ([]uint64, []uint64, error) {
+	res := make([]uint64, 0, 8)
+	start := EntityKey{id: opts.StartAt}.Key()
+	var repairs []uint64
+	now := et.db.now().UnixNano()
+
+	err := et.view(ctx, func(tx *storage.Tx) error {
+		return tx.ForEach(et.ns.Name(), et.Name(), start, func(k, v []byte) (bool, error) {
+			id := binary.BigEndian.Uint64(k)
+			if end > 0 && id >= end {
+				return false, nil
+			}
+			n := atomic.AddUint64(scanned, 1)
+			if opts.MaxScanned > 0 && n > opts.MaxScanned {
+				return false, ErrScanLimit
+			}
+			if n%searchCheckEvery == 0 {
+				if err := ctx.Err(); err != nil {
+					return false, err
+				}
+			}
+			d, err := et.searchDoc(tx, id, v, opts, now)
+			if err != nil || d == nil {
+				return err == nil, err
+			}
+			if et.needsRepair(d) {
+				repairs = append(repairs, id)
+			}
+
+			if fn(id, d) {
+				res = append(res, id)
+			}
+			if opts.stop != nil && *opts.stop {
+				return false, nil
+			}
+			return opts.Limit == 0 || uint64(len(res)) < opts.Limit, nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, repairs, nil
+}
+
+// searchDoc answers the document having the given ID and stored form,
+// holding the fields listed in `opts.Fields`, if given, within the
+// given transaction, for a search using the given options; `nil` if it
+// is to be skipped.  It is counted in `opts.Stats`, if given.
+func (et *entityType) searchDoc(tx *storage.Tx, id uint64, v []byte, opts SearchOpts, now int64) (*Document, error) {
+	if opts.Stats != nil {
+		opts.Stats.Scanned++
+		opts.Stats.last = id
+	}
+	if _, ok := tx.Trashed(et.ns.Name(), et.Name(), id); ok && !opts.IncludeDeleted {
+		return nil, nil
+	}
+	if t, ok := tx.Expiry(et.ns.Name(), et.Name(), id); ok && t <= now {
+		return nil, nil
+	}
+	if opts.Stats != nil {
+		opts.Stats.BytesDecoded += uint64(len(v))
+	}
+
+	var d *Document
+	var err error
+	if opts.noCopy {
+		d = AcquireDocument(et.defn, id)
+		err = et.decodeView(v, d, opts.Fields)
+	} else {
+		d = NewDocument(et.defn, id)
+		err = et.decodeFields(v, d, opts.Fields)
+	}
+	if err != nil {
+		return nil, err
+	}
+	et.readMeta(tx, d)
+	err = et.defn.upgrade(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// encode answers the stored form of the given document.
+func (et *entityType) encode(d *Document) ([]byte, error) {
+	by, err := d.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return et.db.seal(et.ns.Name(), et.Name(), by)
+}
+
+// decode reads the given stored form into the given document.
+func (et *entityType) decode(by []byte, d *Document) error {
+	return et.decodeFields(by, d, nil)
+}
+
+// decodeFields reads the fields having the given IDs from the given
+// stored form into the given document; all fields if none are given.
+func (et *entityType) decodeFields(by []byte, d *Document, ids []int) error {
+	by, err := et.db.open(et.ns.Name(), et.Name(), by)
+	if err != nil {
+		return err
+	}
+	return d.unmarshalFields(by, ids, false)
+}
+
+// decodeView is like `decodeFields`, but the strings read refer to the
+// given stored form, rather than to copies of it.  See `SearchNoCopy`.
+func (et *entityType) decodeView(by []byte, d *Document, ids []int) error {
+	by, err := et.db.open(et.ns.Name(), et.Name(), by)
+	if err != nil {
+		return err
+	}
+	return d.unmarshalFields(by, ids, true)
+}
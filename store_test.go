@@ -0,0 +1,92 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteNotFound(t *testing.T) {
+	ns := testNamespace(t, "store_del")
+	ed := testDefn(t, "store_del", []testField{{"label", FieldTypeString}}, nil)
+	et := testDB.EntityType(ns, ed)
+	put := func() uint64 {
+		d := testDoc(t, ed, 0, map[string]interface{}{"label": "x"})
+		if err := et.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID()
+	}
+
+	// Hooks are not called for documents that do not exist.
+	hooked := 0
+	remove, err := testDB.RegisterHook(ed, BeforeDelete, func(HookEvent) error {
+		hooked++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+
+	if err := et.Delete(0); err != ErrIdentifierZero {
+		t.Errorf("delete of zero: %v", err)
+	}
+	err = et.Delete(1 << 40)
+	if !errors.Is(err, ErrIdentifierUnknown) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete of unknown: %v", err)
+	}
+	if ok, err := et.(AtomicWriter).DeleteIfExists(1 << 40); ok || err != nil {
+		t.Errorf("delete of unknown, if exists: %v, %v", ok, err)
+	}
+	if hooked != 0 {
+		t.Errorf("hooks called for unknown: %d", hooked)
+	}
+
+	id := put()
+	if err := et.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.Delete(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete twice: %v", err)
+	}
+	if hooked != 1 {
+		t.Errorf("hooks called: %d", hooked)
+	}
+
+	id = put()
+	if ok, err := et.(AtomicWriter).DeleteIfExists(id); !ok || err != nil {
+		t.Errorf("delete if exists: %v, %v", ok, err)
+	}
+	if ok, err := et.(AtomicWriter).DeleteIfExists(id); ok || err != nil {
+		t.Errorf("delete if exists, twice: %v, %v", ok, err)
+	}
+
+	// Soft-deleted documents exist until they are removed.
+	id = put()
+	if err := et.(SoftDeleter).DeleteSoft(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.Get(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get when soft-deleted: %v", err)
+	}
+	if err := et.Delete(id); err != nil {
+		t.Errorf("delete when soft-deleted: %v", err)
+	}
+	if err := et.(SoftDeleter).Restore(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restore when deleted: %v", err)
+	}
+}
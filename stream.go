@@ -0,0 +1,88 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// EntitySearcher is implemented by entity types that can answer the
+// matching entities of a search themselves, rather than their IDs.
+type EntitySearcher interface {
+	// SearchEntities is like `Search`, but calls the given function
+	// with each matching entity, until it answers `false`.
+	SearchEntities(SearchOpts, SearchFn, func(Entity) bool) error
+}
+
+// SearchEntities is like `Search`, but calls the given function with
+// each matching document, in order, until it answers `false`, rather
+// than answering their IDs; hence, the documents need not be read
+// again.  The documents hold only the fields listed in `opts.Fields`,
+// if given.
+//
+// The function is called within the read transaction of the search;
+// it should not modify the database, and should return promptly.
+// Searches ordered using `SearchOpts.OrderBy` find the matching IDs
+// first, and then read their documents in a second transaction,
+// skipping those removed meanwhile.
+func (et *entityType) SearchEntities(opts SearchOpts, fn SearchFn, each func(Entity) bool) error {
+	if opts.orderBy != "" {
+		return et.streamOrdered(opts, fn, each)
+	}
+
+	var stop bool
+	opts.stop = &stop
+	_, err := et.search(context.Background(), opts, func(id uint64, e Entity) bool {
+		if stop || !fn(id, e) {
+			return false
+		}
+		stop = !each(e)
+		return true
+	})
+	return err
+}
+
+// streamOrdered implements `SearchEntities` for ordered searches.
+func (et *entityType) streamOrdered(opts SearchOpts, fn SearchFn, each func(Entity) bool) error {
+	ctx := context.Background()
+	ids, err := et.search(ctx, opts, fn)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	opts.Stats = nil
+	now := et.db.now().UnixNano()
+	return et.view(ctx, func(tx *storage.Tx) error {
+		for _, id := range ids {
+			v, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+			if err != nil {
+				if err == storage.ErrKeyUnknown {
+					continue
+				}
+				return err
+			}
+			d, err := et.searchDoc(tx, id, v, opts, now)
+			if err != nil {
+				return err
+			}
+			if d != nil && !each(d) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,187 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// tenantKey is the context key of the tenant.
+type tenantKey struct{}
+
+// WithTenant answers a copy of the given context carrying the given
+// tenant, whose namespace the operations using it resolve to.  See
+// `Tenancy`.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom answers the tenant carried by the given context, and
+// `true` if it carries one.
+func TenantFrom(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(string)
+	return t, ok
+}
+
+// Tenancy isolates the data of tenants in namespaces of their own, all
+// laid out by the same template schema.  The namespace of a tenant is
+// named by the tenant, following a common prefix; hence, tenant names
+// should be valid suffixes of namespace names.
+//
+// Tenants are provisioned explicitly, using `Provision`, and are
+// resolved to their namespaces when their entity types are requested.
+type Tenancy struct {
+	db       *DB
+	template *Schema
+	prefix   string
+
+	mutex sync.RWMutex
+	ready map[string]*Namespace // provisioned namespaces, by tenant
+}
+
+// NewTenancy answers a tenancy of the given database, whose tenants
+// have namespaces named by the given prefix followed by their names,
+// laid out by the given template schema.  The prefix, if not empty,
+// should be the beginning of a valid name.  See `NamePolicy`.
+func NewTenancy(db *DB, template *Schema, prefix string) (*Tenancy, error) {
+	if prefix != "" && validName(prefix+"a") != nil {
+		return nil, ErrNameInvalid
+	}
+
+	return &Tenancy{db: db, template: template, prefix: prefix, ready: make(map[string]*Namespace)}, nil
+}
+
+// Provision brings the namespace of the given tenant in line with the
+// template schema, idempotently: its entity types are saved, their
+// buckets are created, and the seed rows are upserted, as by
+// `EnsureSchema`.  Provisioning an existing tenant, hence, upgrades it
+// to the current template.  It answers the namespace of the tenant.
+func (t *Tenancy) Provision(tenant string) (*Namespace, error) {
+	ns, err := NewNamespace(t.prefix + tenant)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.db.EnsureSchema(ns, t.template)
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range t.template.EntityTypes {
+		err = ns.CreateEntityType(ed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mutex.Lock()
+	t.ready[tenant] = ns
+	t.mutex.Unlock()
+	return ns, nil
+}
+
+// Deprovision deletes the namespace of the given tenant.  Unless
+// `force` is `true`, it answers `ErrNamespaceNotEmpty` if the tenant
+// has entities.  See `DB.DeleteNamespace`.
+func (t *Tenancy) Deprovision(tenant string, force bool) error {
+	err := t.db.DeleteNamespace(t.prefix+tenant, force)
+	if err == nil {
+		t.mutex.Lock()
+		delete(t.ready, tenant)
+		t.mutex.Unlock()
+	}
+	if err == ErrNameUnknown {
+		return ErrTenantUnknown
+	}
+	return err
+}
+
+// Namespace answers the namespace of the given tenant.  It answers
+// `ErrTenantUnknown` if the tenant has not been provisioned.
+func (t *Tenancy) Namespace(tenant string) (*Namespace, error) {
+	t.mutex.RLock()
+	ns, ok := t.ready[tenant]
+	t.mutex.RUnlock()
+	if ok {
+		return ns, nil
+	}
+
+	ns, err := NewNamespace(t.prefix + tenant)
+	if err != nil {
+		return nil, err
+	}
+	err = t.db.sdb.View(func(tx *storage.Tx) error {
+		for _, ed := range t.template.EntityTypes {
+			if !tx.HasEntityType(ns.Name(), ed.Name()) {
+				return ErrTenantUnknown
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	t.ready[tenant] = ns
+	t.mutex.Unlock()
+	return ns, nil
+}
+
+// EntityType answers a handle to the instances of the entity type of
+// the template schema having the given name, in the namespace of the
+// tenant carried by the given context.  It answers `ErrTenantMissing`
+// if the context carries no tenant, and `ErrNameUnknown` if the
+// template has no such entity type.
+func (t *Tenancy) EntityType(ctx context.Context, name string) (EntityType, error) {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return nil, ErrTenantMissing
+	}
+	var ed *EntityTypeDefn
+	for _, d := range t.template.EntityTypes {
+		if d.Name() == name {
+			ed = d
+			break
+		}
+	}
+	if ed == nil {
+		return nil, ErrNameUnknown
+	}
+
+	ns, err := t.Namespace(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return t.db.EntityType(ns, ed), nil
+}
+
+// Tenants answers the names of the tenants whose namespaces exist in
+// the database, in ascending order.  With an empty prefix, every
+// namespace is taken to be that of a tenant.
+func (t *Tenancy) Tenants() ([]string, error) {
+	var res []string
+	err := t.db.sdb.View(func(tx *storage.Tx) error {
+		for _, name := range tx.Namespaces() {
+			if strings.HasPrefix(name, t.prefix) && name[0] != '_' {
+				res = append(res, name[len(t.prefix):])
+			}
+		}
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,395 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// TimeSeries answers `true` if the IDs of new instances of this entity
+// type are their times.  See `SetTimeSeries`.
+func (ed *EntityTypeDefn) TimeSeries() bool {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.ts
+}
+
+// SetTimeSeries makes this entity type a time series - of metrics or
+// log entries, say - or an ordinary one.  New instances of a time
+// series are assigned as IDs their times, in nanoseconds since the
+// epoch: the times given to `PutAt`, or the times at which they are
+// stored.  Since IDs are unique, an instance whose time is that of
+// another is assigned the next free nanosecond.  Instances are thus
+// stored in the order of their times, so that those in a window of
+// time are read by a range scan; see `TimeSeriesEntityType`.
+//
+// It should be set before any instance is stored: the IDs of existing
+// instances are not their times, and are treated as times shortly
+// after the epoch.
+func (ed *EntityTypeDefn) SetTimeSeries(on bool) {
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.ts = on
+}
+
+// Retention answers the age at which instances of this time series are
+// removed; `0` if they are retained.  See `SetRetention`.
+func (ed *EntityTypeDefn) Retention() time.Duration {
+	ed.mutex.RLock()
+	defer ed.mutex.RUnlock()
+
+	return ed.retain
+}
+
+// SetRetention sets the age at which instances of this time series are
+// removed, by `EnforceRetention` or by `RetentionJob`; `0` retains
+// them.  Until they are removed, older instances remain visible.  It
+// has no effect on entity types that are not time series.
+func (ed *EntityTypeDefn) SetRetention(d time.Duration) error {
+	if d < 0 {
+		return ErrRetentionInvalid
+	}
+	ed.mutex.Lock()
+	defer ed.mutex.Unlock()
+
+	ed.retain = d
+	return nil
+}
+
+// TimeOf answers the time of the instance of a time series having the
+// given ID.
+func TimeOf(id uint64) time.Time {
+	return time.Unix(0, int64(id))
+}
+
+// TimeSeriesEntityType is implemented by entity types that can be time
+// series.  Their operations answer `ErrNotTimeSeries` for entity types
+// that are not.  See `EntityTypeDefn.SetTimeSeries`.
+type TimeSeriesEntityType interface {
+	// PutAt is like `Put`, but a new entity is stored at the given
+	// time.
+	PutAt(Entity, time.Time) error
+	// Window is like `Search`, over the entities whose times are in
+	// the given window.
+	Window(time.Time, time.Time, SearchOpts, SearchFn) ([]uint64, error)
+	// Downsample computes the given aggregations over the entities in
+	// the given window, in intervals of the given duration.
+	Downsample(time.Time, time.Time, time.Duration, []Aggregation) ([]TimeBucket, error)
+	// EnforceRetention removes the entities older than the retention
+	// period, answering their number.
+	EnforceRetention() (uint64, error)
+}
+
+// TimeBucket is the result of the aggregations over the entities of a
+// time series in an interval of time.
+type TimeBucket struct {
+	Start time.Time // beginning of the interval
+	Count uint64    // number of entities in the interval
+	// Values holds the results of the aggregations, in order, as in
+	// `AggregateGroup`.
+	Values []interface{}
+}
+
+// timeID answers the ID of a new instance of this time series stored
+// at the given time, in nanoseconds since the epoch: the time itself,
+// or the first one following it that is neither the ID of another
+// instance nor in the given set of IDs already assigned, if any.  The
+// sequence of this entity type is raised to it.
+func (et *entityType) timeID(tx *storage.Tx, at int64, taken map[uint64]bool) (uint64, error) {
+	if at <= 0 {
+		return 0, ErrTimeInvalid
+	}
+
+	id := uint64(at)
+	for {
+		_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+		if err == storage.ErrKeyUnknown && !taken[id] {
+			break
+		}
+		if err != nil && err != storage.ErrKeyUnknown {
+			return 0, err
+		}
+		id++
+	}
+	return id, tx.ReserveSequence(et.ns.Name(), et.Name(), id)
+}
+
+// newID answers the ID of a new instance of this entity type stored at
+// the given time, within the given transaction: its time, for time
+// series (see `timeID`), and the next in its sequence, otherwise.
+func (et *entityType) newID(tx *storage.Tx, at int64, taken map[uint64]bool) (uint64, error) {
+	if et.defn.TimeSeries() {
+		return et.timeID(tx, at, taken)
+	}
+	return tx.NextSequence(et.ns.Name(), et.Name())
+}
+
+// PutAt is like `Put`, but a document having a zero ID is stored at
+// the given time, which should not be before the epoch; a zero time
+// stores it at the current time.  Documents having IDs are stored
+// under them, as by `Put`.
+func (et *entityType) PutAt(e Entity, at time.Time) error {
+	if !et.defn.TimeSeries() {
+		return ErrNotTimeSeries
+	}
+	var t int64
+	if !at.IsZero() {
+		t = at.UnixNano()
+		if t <= 0 {
+			return ErrTimeInvalid
+		}
+	}
+	return et.put(e, putOpts{at: t})
+}
+
+// windowBounds answers the IDs bounding the given window of time: the
+// first in it, and the first after it; `0` if it is unbounded.  Zero
+// times leave the window open at that end.
+func windowBounds(from, to time.Time) (uint64, uint64) {
+	var start, end uint64
+	if !from.IsZero() && from.UnixNano() > 0 {
+		start = uint64(from.UnixNano())
+	}
+	if !to.IsZero() {
+		end = 1
+		if to.UnixNano() > 0 {
+			end = uint64(to.UnixNano())
+		}
+	}
+	return start, end
+}
+
+// Window is like `Search`, but iterates through only the documents
+// whose times are equal to or after `from`, and before `to`, in the
+// order of their times.  A zero `from` or `to` leaves the window open
+// at that end.  `opts.StartAt` and ordering are ignored.  A `nil`
+// predicate matches all the documents.
+func (et *entityType) Window(from, to time.Time, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	if !et.defn.TimeSeries() {
+		return nil, ErrNotTimeSeries
+	}
+	if fn == nil {
+		fn = func(uint64, Entity) bool { return true }
+	}
+
+	ctx, sp := et.startSpan(context.Background(), spanSearch)
+	res, err := et.window(ctx, from, to, opts, fn)
+	sp.SetAttribute(attrResults, len(res))
+	endSpan(sp, err)
+	return res, err
+}
+
+// window implements `Window`.
+func (et *entityType) window(ctx context.Context, from, to time.Time, opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	var end uint64
+	opts.StartAt, end = windowBounds(from, to)
+	opts.orderBy = ""
+	if end == 1 || end != 0 && end <= opts.StartAt {
+		return []uint64{}, nil
+	}
+
+	var scanned uint64
+	res, repairs, err := et.scanRange(ctx, opts, fn, end, &scanned)
+	if err != nil {
+		return nil, err
+	}
+
+	et.readRepair(repairs)
+	return res, nil
+}
+
+// Downsample computes the given aggregations over the documents whose
+// times are in the given window, as `Window` selects them, in
+// intervals of the given duration, aligned to the epoch - so that
+// hourly intervals begin on the hour, say.  It answers a bucket per
+// interval having documents, in order; intervals having none are
+// omitted.  Only the aggregated fields are decoded.
+func (et *entityType) Downsample(from, to time.Time, step time.Duration, aggs []Aggregation) ([]TimeBucket, error) {
+	if !et.defn.TimeSeries() {
+		return nil, ErrNotTimeSeries
+	}
+	if step <= 0 {
+		return nil, ErrTimeInvalid
+	}
+	fds, ids, err := aggregatedFields(et.defn, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []TimeBucket
+	var cur []aggregator
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		b := &res[len(res)-1]
+		b.Values = make([]interface{}, len(aggs))
+		for i, a := range aggs {
+			b.Values[i] = cur[i].result(a.Op)
+		}
+	}
+	opts := SearchOpts{Fields: append([]int{}, ids...)}
+	_, err = et.window(context.Background(), from, to, opts, func(id uint64, e Entity) bool {
+		start := id - id%uint64(step)
+		if len(res) == 0 || uint64(res[len(res)-1].Start.UnixNano()) != start {
+			flush()
+			res = append(res, TimeBucket{Start: TimeOf(start)})
+			cur = make([]aggregator, len(aggs))
+			for i := range cur {
+				cur[i].fd = fds[i]
+			}
+		}
+		res[len(res)-1].Count++
+		for i, a := range aggs {
+			cur[i].add(a.Op, e.(*Document))
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+
+	return res, nil
+}
+
+// EnforceRetention removes the documents of this time series that are
+// older than its retention period, as of the clock of the database, as
+// `Delete` does.  Documents are removed in chunks, each in its own
+// transaction.  It answers the number of documents removed.  The
+// documents of a frozen entity type are removed once it is unfrozen.
+// Those whose removal is restricted by references to them (see
+// `OnDeleteRestrict`) are kept.
+func (et *entityType) EnforceRetention() (uint64, error) {
+	if !et.defn.TimeSeries() {
+		return 0, ErrNotTimeSeries
+	}
+	retain := et.defn.Retention()
+	if retain == 0 {
+		return 0, nil
+	}
+
+	var n uint64
+	kept := make(map[uint64]bool)
+	for {
+		now := et.db.now().UnixNano()
+		cnt, err := et.retainChunk(now-int64(retain), now, kept)
+		n += cnt
+		if err != nil || cnt < expireChunk {
+			return n, err
+		}
+	}
+}
+
+// retainChunk removes up to `expireChunk` documents whose times are
+// before the given cutoff, answering their number.  Those in the given
+// set are skipped; those whose removal is restricted are added to it.
+func (et *entityType) retainChunk(cutoff, now int64, kept map[uint64]bool) (uint64, error) {
+	if cutoff <= 0 {
+		return 0, nil
+	}
+
+	for {
+		var n, refd uint64
+		err := et.db.sdb.Update(func(tx *storage.Tx) error {
+			if _, ok := tx.Frozen(et.ns.Name(), et.Name()); ok {
+				return nil
+			}
+			var ids []uint64
+			err := tx.ForEachKey(et.ns.Name(), et.Name(), nil, func(k []byte) (bool, error) {
+				id := binary.BigEndian.Uint64(k)
+				if id >= uint64(cutoff) {
+					return false, nil
+				}
+				if !kept[id] {
+					ids = append(ids, id)
+				}
+				return len(ids) < expireChunk, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			refd, err = et.removeAll(tx, ids, now)
+			if err != nil {
+				return err
+			}
+			n = uint64(len(ids))
+			return nil
+		})
+		if refd != 0 {
+			kept[refd] = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return n, nil
+	}
+}
+
+// EnforceRetention removes the entities of all the time series having
+// retention periods, in all the namespaces, that are older than their
+// retention periods, answering their number.  The definitions of the
+// entity types are looked up in the system catalogue.  See
+// `EntityTypeDefn.SetRetention`.
+func (db *DB) EnforceRetention() (uint64, error) {
+	ets := make(map[string][]string)
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		for _, ns := range tx.Namespaces() {
+			ets[ns] = tx.EntityTypes(ns)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defns, err := db.defnsByName()
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for name, names := range ets {
+		if name[0] == '_' {
+			continue
+		}
+		ns, err := NewNamespace(name)
+		if err != nil {
+			return n, err
+		}
+		for _, etn := range names {
+			ed, ok := defns[etn]
+			if !ok || !ed.TimeSeries() || ed.Retention() == 0 {
+				continue
+			}
+			et := &entityType{db: db, ns: ns, defn: ed}
+			cnt, err := et.EnforceRetention()
+			n += cnt
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
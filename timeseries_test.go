@@ -0,0 +1,239 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// tsBase is the time shown by the clocks of the time-series tests.
+var tsBase = time.Unix(3000000, 0)
+
+// tsDefn answers a time-series entity type having the given name.
+func tsDefn(t *testing.T, name string) *EntityTypeDefn {
+	return testDefn(t, name, []testField{{"val", FieldTypeFloat64}, {"host", FieldTypeString}}, func(ed *EntityTypeDefn) {
+		ed.SetTimeSeries(true)
+		if err := ed.SetRetention(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTimeSeriesDefnJSON(t *testing.T) {
+	ed := tsDefn(t, "ts_json")
+	if err := ed.SetRetention(-1); !errors.Is(err, ErrRetentionInvalid) {
+		t.Fatalf("negative retention: %v", err)
+	}
+
+	by, err := json.Marshal(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ed2 EntityTypeDefn
+	if err := json.Unmarshal(by, &ed2); err != nil {
+		t.Fatal(err)
+	}
+	if !ed2.TimeSeries() || ed2.Retention() != time.Hour {
+		t.Fatalf("round trip: %s", by)
+	}
+}
+
+func TestTimeSeriesIDs(t *testing.T) {
+	db, _ := clockDB(tsBase)
+	ns := testNamespace(t, "ts_ids")
+	ed := tsDefn(t, "ts_ids")
+	et := db.EntityType(ns, ed)
+	ts := et.(TimeSeriesEntityType)
+
+	at := tsBase.Add(-time.Minute)
+	d1 := testDoc(t, ed, 0, map[string]interface{}{"val": 1.0})
+	if err := ts.PutAt(d1, at); err != nil {
+		t.Fatal(err)
+	}
+	if !TimeOf(d1.ID()).Equal(at) {
+		t.Fatalf("PutAt: time %v, want %v", TimeOf(d1.ID()), at)
+	}
+	d2 := testDoc(t, ed, 0, map[string]interface{}{"val": 2.0})
+	if err := ts.PutAt(d2, at); err != nil {
+		t.Fatal(err)
+	}
+	if d2.ID() != d1.ID()+1 {
+		t.Fatalf("colliding time: ID %d, want %d", d2.ID(), d1.ID()+1)
+	}
+
+	d3 := testDoc(t, ed, 0, nil)
+	if err := et.Put(d3); err != nil {
+		t.Fatal(err)
+	}
+	if !TimeOf(d3.ID()).Equal(tsBase) {
+		t.Fatalf("Put: time %v, want %v", TimeOf(d3.ID()), tsBase)
+	}
+	if err := ts.PutAt(testDoc(t, ed, 0, nil), time.Unix(-5, 0)); !errors.Is(err, ErrTimeInvalid) {
+		t.Fatalf("time before the epoch: %v", err)
+	}
+
+	plain := testDefn(t, "ts_plain", []testField{{"val", FieldTypeFloat64}}, nil)
+	pts := db.EntityType(ns, plain).(TimeSeriesEntityType)
+	if err := pts.PutAt(testDoc(t, plain, 0, nil), tsBase); !errors.Is(err, ErrNotTimeSeries) {
+		t.Fatalf("PutAt on a plain type: %v", err)
+	}
+	if _, err := pts.Window(time.Time{}, time.Time{}, SearchOpts{}, nil); !errors.Is(err, ErrNotTimeSeries) {
+		t.Fatalf("Window on a plain type: %v", err)
+	}
+}
+
+func TestTimeSeriesAsyncIDs(t *testing.T) {
+	db, _ := clockDB(tsBase)
+	ns := testNamespace(t, "ts_async")
+	ed := tsDefn(t, "ts_async")
+	et := db.EntityType(ns, ed)
+
+	w := db.NewAsyncWriter(AsyncOpts{})
+	p1 := w.Put(et, testDoc(t, ed, 0, nil))
+	p2 := w.Put(et, testDoc(t, ed, 0, nil))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id1, err := p1.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := p2.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !TimeOf(id1).Equal(tsBase) || id2 != id1+1 {
+		t.Fatalf("async IDs %d, %d; want times from %v", id1, id2, tsBase)
+	}
+
+	// Freshly written entities survive retention.
+	if n, err := et.(TimeSeriesEntityType).EnforceRetention(); err != nil || n != 0 {
+		t.Fatalf("retention removed %d: %v", n, err)
+	}
+}
+
+func TestTimeSeriesCloneAndTransferIDs(t *testing.T) {
+	db, _ := clockDB(tsBase)
+	ns := testNamespace(t, "ts_clone")
+	ed := tsDefn(t, "ts_clone")
+	et := db.EntityType(ns, ed)
+
+	at := tsBase.Add(-time.Minute)
+	d := testDoc(t, ed, 0, map[string]interface{}{"val": 1.0})
+	if err := et.(TimeSeriesEntityType).PutAt(d, at); err != nil {
+		t.Fatal(err)
+	}
+	cid, _, err := et.(Duplicator).CloneEntity(d.ID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != d.ID()+1 {
+		t.Fatalf("clone ID %d, want %d", cid, d.ID()+1)
+	}
+
+	dst := testNamespace(t, "ts_clone_dst")
+	ids, err := db.CopyEntityType(ns, dst, ed, &TransferOpts{Remap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, nid := range ids {
+		if nid != id {
+			t.Fatalf("remapped %d to %d; want its time", id, nid)
+		}
+	}
+}
+
+func TestTimeSeriesWindowDownsampleRetention(t *testing.T) {
+	db, clk := clockDB(tsBase)
+	ns := testNamespace(t, "ts_window")
+	ed := tsDefn(t, "ts_window")
+	ts := db.EntityType(ns, ed).(TimeSeriesEntityType)
+
+	points := []struct {
+		ago time.Duration
+		val float64
+	}{
+		{90 * time.Minute, 1},
+		{90 * time.Minute, 2},
+		{30 * time.Minute, 3},
+		{29 * time.Minute, 5},
+		{5 * time.Minute, 10},
+		{0, 7},
+	}
+	for _, p := range points {
+		if err := ts.PutAt(testDoc(t, ed, 0, map[string]interface{}{"val": p.val}), tsBase.Add(-p.ago)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	windows := []struct {
+		from, to time.Time
+		want     int
+	}{
+		{time.Time{}, time.Time{}, 6},
+		{tsBase.Add(-31 * time.Minute), tsBase.Add(-5 * time.Minute), 2},
+		{tsBase.Add(-5 * time.Minute), time.Time{}, 2},
+		{tsBase, tsBase.Add(-time.Hour), 0},
+	}
+	for _, w := range windows {
+		ids, err := ts.Window(w.from, w.to, SearchOpts{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != w.want {
+			t.Errorf("Window(%v, %v): %d entities, want %d", w.from, w.to, len(ids), w.want)
+		}
+	}
+
+	bs, err := ts.Downsample(time.Time{}, time.Time{}, time.Hour, []Aggregation{{Op: AggCount}, {Op: AggAvg, Field: "val"}, {Op: AggMax, Field: "val"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		count    uint64
+		avg, max float64
+	}{{2, 1.5, 2}, {2, 4, 5}, {2, 8.5, 10}}
+	if len(bs) != len(want) {
+		t.Fatalf("Downsample: %d buckets, want %d", len(bs), len(want))
+	}
+	for i, b := range bs {
+		if b.Start.UnixNano()%int64(time.Hour) != 0 {
+			t.Errorf("bucket %d starts at %v; not on the hour", i, b.Start)
+		}
+		if b.Count != want[i].count || b.Values[1] != want[i].avg || b.Values[2] != want[i].max {
+			t.Errorf("bucket %d: %d %v; want %+v", i, b.Count, b.Values, want[i])
+		}
+	}
+	if _, err := ts.Downsample(time.Time{}, time.Time{}, 0, nil); !errors.Is(err, ErrTimeInvalid) {
+		t.Fatalf("zero interval: %v", err)
+	}
+	if _, err := ts.Downsample(time.Time{}, time.Time{}, time.Minute, []Aggregation{{Op: AggSum, Field: "host"}}); !errors.Is(err, ErrFieldValueType) {
+		t.Fatalf("sum of strings: %v", err)
+	}
+
+	if n, err := ts.EnforceRetention(); err != nil || n != 2 {
+		t.Fatalf("retention removed %d, want 2: %v", n, err)
+	}
+	clk.Advance(31 * time.Minute)
+	if n, err := ts.EnforceRetention(); err != nil || n != 1 {
+		t.Fatalf("retention removed %d, want 1: %v", n, err)
+	}
+	if ids, _ := ts.Window(time.Time{}, time.Time{}, SearchOpts{}, nil); len(ids) != 3 {
+		t.Fatalf("%d entities retained, want 3", len(ids))
+	}
+}
@@ -0,0 +1,135 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Tracer starts the spans that a database handle emits around the
+// operations on entities, and the transactions that they run.  It is
+// shaped after the tracers of OpenTelemetry; an adapter from a
+// `TracerProvider` needs only to convert attributes.  See
+// `Options.Tracer`.
+//
+// Spans are named `flagon.Get`, `flagon.Put`, `flagon.Delete` and
+// `flagon.Search` for operations, and `flagon.View` and `flagon.Update`
+// for transactions, which are children of their operations.
+// Operation spans carry the attributes `flagon.namespace` and
+// `flagon.entity_type`; those of `Get`, `Put` and `Delete` also carry
+// `flagon.id`, and those of `Search`, `flagon.results`.
+type Tracer interface {
+	// Start starts a span having the given name, as a child of the
+	// span in the given context, if any.  It answers a context
+	// carrying the new span, and the span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a `Tracer`.
+type Span interface {
+	// SetAttribute sets the given attribute of this span.  Values are
+	// strings, integers or booleans.
+	SetAttribute(key string, value interface{})
+	// RecordError records the given error as the outcome of this
+	// span.
+	RecordError(err error)
+	// End ends this span.
+	End()
+}
+
+// Names of spans.
+const (
+	spanGet     = "flagon.Get"
+	spanGetMany = "flagon.GetMany"
+	spanPut     = "flagon.Put"
+	spanDelete  = "flagon.Delete"
+	spanSearch  = "flagon.Search"
+	spanView    = "flagon.View"
+	spanUpdate  = "flagon.Update"
+)
+
+// Names of span attributes.
+const (
+	attrNamespace = "flagon.namespace"
+	attrType      = "flagon.entity_type"
+	attrID        = "flagon.id"
+	attrResults   = "flagon.results"
+)
+
+// nopSpan is the span of handles without a tracer.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) RecordError(error)                {}
+func (nopSpan) End()                             {}
+
+// startSpan starts a span having the given name, using the tracer of
+// this handle, if any.
+func (db *DB) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if db.opts.Tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return db.opts.Tracer.Start(ctx, name)
+}
+
+// startSpan starts a span of an operation on this entity type, having
+// the given name.
+func (et *entityType) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	ctx, sp := et.db.startSpan(ctx, name)
+	sp.SetAttribute(attrNamespace, et.ns.Name())
+	sp.SetAttribute(attrType, et.Name())
+	return ctx, sp
+}
+
+// endSpan ends the given span, recording the given error, if any.
+func endSpan(sp Span, err error) {
+	if err != nil {
+		sp.RecordError(err)
+	}
+	sp.End()
+}
+
+// view runs the given function in a read-only transaction, in a span.
+func (db *DB) view(ctx context.Context, fn func(*storage.Tx) error) error {
+	_, sp := db.startSpan(ctx, spanView)
+	err := db.sdb.View(fn)
+	endSpan(sp, err)
+	return err
+}
+
+// update runs the given function in a read-write transaction, in a
+// span.
+func (db *DB) update(ctx context.Context, fn func(*storage.Tx) error) error {
+	_, sp := db.startSpan(ctx, spanUpdate)
+	var err error
+	if d, ok := durabilityFrom(ctx); ok {
+		err = db.sdb.UpdateSync(d == DurabilityFull, fn)
+	} else {
+		err = db.sdb.Update(fn)
+	}
+	endSpan(sp, err)
+	return err
+}
+
+// batch runs the given function in a read-write transaction that may be
+// shared with concurrent calls, in a span.  See `storage.DB.Batch`.
+func (db *DB) batch(ctx context.Context, fn func(*storage.Tx) error) error {
+	_, sp := db.startSpan(ctx, spanUpdate)
+	err := db.sdb.Batch(fn)
+	endSpan(sp, err)
+	return err
+}
@@ -0,0 +1,194 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// TransferOpts holds the optional settings of `CopyEntityType` and
+// `MoveEntities`.
+type TransferOpts struct {
+	// Remap, if `true`, assigns new IDs to the entities in the
+	// destination namespace, in the ascending order of their original
+	// IDs - the times of the originals, or the first free ones
+	// following them, for time series.  Otherwise, their IDs are
+	// preserved; entities of the destination namespace having the same
+	// IDs are replaced.
+	Remap bool
+}
+
+// CopyEntityType copies the entities of the given entity type from the
+// source namespace into the destination namespace, in a single
+// transaction.  Soft-deleted and expired entities are not copied.  It
+// answers the IDs of the copies, by the IDs of the originals.
+//
+// Copies are stored afresh: they are encrypted using the key of the
+// destination namespace, their versions begin anew, and their labels,
+// expiry times and references are carried over; their provenance,
+// histories and audit logs are not.  Reference fields are copied as
+// they are, even when IDs are remapped.  Hooks do not run, but change
+// watchers are notified.  See `TransferOpts`.
+func (db *DB) CopyEntityType(src, dst *Namespace, ed *EntityTypeDefn, opts *TransferOpts) (map[uint64]uint64, error) {
+	return db.transfer(src, dst, ed, SearchOpts{}, nil, opts, false)
+}
+
+// MoveEntities moves the entities of the given entity type in the
+// source namespace, that the given predicate accepts, into the
+// destination namespace, in a single transaction.  `sopts` select the
+// entities passed to the predicate, as in `Search`; a `nil` predicate
+// accepts all of them.  Moved entities are copied as by
+// `CopyEntityType`, and are then deleted from the source namespace.
+// With `sopts.IncludeDeleted`, soft-deleted entities are moved too, and
+// remain soft-deleted.  It answers the new IDs of the moved entities,
+// by their old IDs.
+//
+// The `OnDelete` behaviours of the references to the moved entities
+// in the source namespace are applied, as by `Delete`, other than
+// those of references from entities moved along.  If a reference
+// restricts the move, nothing is moved, and a `ReferencedError` is
+// answered.
+func (db *DB) MoveEntities(src *Namespace, ed *EntityTypeDefn, sopts SearchOpts, fn SearchFn, dst *Namespace, opts *TransferOpts) (map[uint64]uint64, error) {
+	return db.transfer(src, dst, ed, sopts, fn, opts, true)
+}
+
+// transfer implements `CopyEntityType` and `MoveEntities`.
+func (db *DB) transfer(src, dst *Namespace, ed *EntityTypeDefn, sopts SearchOpts, fn SearchFn, opts *TransferOpts, move bool) (map[uint64]uint64, error) {
+	if src.Name() == dst.Name() {
+		return nil, ErrNamespaceSame
+	}
+	var o TransferOpts
+	if opts != nil {
+		o = *opts
+	}
+	from := &entityType{db: db, ns: src, defn: ed}
+	to := &entityType{db: db, ns: dst, defn: ed}
+	ctx := context.Background()
+	now := db.now().UnixNano()
+
+	res := make(map[uint64]uint64)
+	err := db.update(ctx, func(tx *storage.Tx) error {
+		docs, err := from.matching(tx, sopts, fn, now)
+		if err != nil {
+			return err
+		}
+		deleting := make(map[ref]bool)
+		if move {
+			for _, d := range docs {
+				deleting[ref{target: ed.Name(), id: d.ID()}] = true
+			}
+		}
+
+		for _, d := range docs {
+			id := d.ID()
+			nid := id
+			if o.Remap {
+				nid, err = to.newID(tx, int64(id), nil)
+			} else {
+				err = tx.ReserveSequence(dst.Name(), ed.Name(), id)
+			}
+			if err != nil {
+				return err
+			}
+			err = to.transferDoc(tx, nid, d, now)
+			if err != nil {
+				return err
+			}
+			if move {
+				err = from.enforceRefs(tx, id, now, "", deleting)
+				if err == nil {
+					err = from.remove(tx, id, now, "")
+				}
+				if err == nil {
+					err = tx.ClearProvenance(src.Name(), ed.Name(), id)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			res[id] = nid
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// matching answers the documents of this entity type that the given
+// predicate accepts, within the given transaction, as `Search` would
+// pass them to it.  A `nil` predicate accepts all of them.
+func (et *entityType) matching(tx *storage.Tx, opts SearchOpts, fn SearchFn, now int64) ([]*Document, error) {
+	var res []*Document
+	start := EntityKey{id: opts.StartAt}.Key()
+	err := tx.ForEach(et.ns.Name(), et.Name(), start, func(k, v []byte) (bool, error) {
+		id := binary.BigEndian.Uint64(k)
+		if _, ok := tx.Trashed(et.ns.Name(), et.Name(), id); ok && !opts.IncludeDeleted {
+			return true, nil
+		}
+		if t, ok := tx.Expiry(et.ns.Name(), et.Name(), id); ok && t <= now {
+			return true, nil
+		}
+
+		d := NewDocument(et.defn, id)
+		err := et.decode(v, d)
+		if err != nil {
+			return false, err
+		}
+		et.readMeta(tx, d)
+		err = et.defn.upgrade(d)
+		if err != nil {
+			return false, err
+		}
+		if fn == nil || fn(id, d) {
+			res = append(res, d)
+		}
+		return opts.Limit == 0 || uint64(len(res)) < opts.Limit, nil
+	})
+	return res, err
+}
+
+// transferDoc stores the given document, read from another namespace,
+// under the given ID within the given transaction, together with its
+// labels, expiry time and soft-deletion mark.
+func (et *entityType) transferDoc(tx *storage.Tx, id uint64, d *Document, now int64) error {
+	d.schema = et.defn.SchemaVersion()
+	by, err := et.encode(d)
+	if err != nil {
+		return err
+	}
+	_, err = et.store(tx, id, by, d, now, "")
+	if err != nil {
+		return err
+	}
+
+	ns := et.ns.Name()
+	err = tx.SetLabels(ns, et.Name(), id, d.labels)
+	if err == nil {
+		err = tx.SetExpiry(ns, et.Name(), id, d.expires)
+	}
+	if err == nil {
+		err = tx.ClearProvenance(ns, et.Name(), id)
+	}
+	if err == nil && d.deleted != 0 {
+		err = tx.Trash(ns, et.Name(), id, d.deleted)
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of soft-deleted entities purged per transaction.
+const purgeChunk = 1024
+
+// SoftDeleter is implemented by entity types that support soft
+// deletion.  Soft-deleted entities are hidden from `Get` and `Search`,
+// but remain stored - and can be restored - until purged.  This gives
+// applications undo, and retention windows.
+//
+// Storing a soft-deleted entity restores it.
+type SoftDeleter interface {
+	// DeleteSoft marks the entity having the given ID as deleted.
+	DeleteSoft(uint64) error
+	// Restore reverses `DeleteSoft`.
+	Restore(uint64) error
+	// PurgeDeleted permanently deletes the entities soft-deleted at
+	// least the given duration ago, answering their number.
+	PurgeDeleted(time.Duration) (uint64, error)
+	// Deleted answers the soft-deleted entities.
+	Deleted() ([]DeletedEntity, error)
+}
+
+// DeletedEntity describes a soft-deleted entity.
+type DeletedEntity struct {
+	ID uint64    // ID of the entity
+	At time.Time // time of its soft deletion
+}
+
+// DeleteSoft marks the document having the given ID as deleted,
+// incrementing its version.  Deleting a soft-deleted document again
+// has no effect.
+func (et *entityType) DeleteSoft(id uint64) error {
+	return et.setTrashed(id, true)
+}
+
+// Restore restores the soft-deleted document having the given ID,
+// incrementing its version.  Restoring a document that is not deleted
+// has no effect.
+func (et *entityType) Restore(id uint64) error {
+	return et.setTrashed(id, false)
+}
+
+// setTrashed implements `DeleteSoft` and `Restore`.
+func (et *entityType) setTrashed(id uint64, trash bool) error {
+	if id == 0 {
+		return ErrIdentifierZero
+	}
+
+	now := et.db.now().UnixNano()
+	err := et.db.sdb.Update(func(tx *storage.Tx) error {
+		_, err := tx.Get(et.ns.Name(), et.Name(), EntityKey{id: id}.Key())
+		if err != nil {
+			return err
+		}
+		if _, ok := tx.Trashed(et.ns.Name(), et.Name(), id); ok == trash {
+			return nil
+		}
+
+		if trash {
+			err = tx.Trash(et.ns.Name(), et.Name(), id, now)
+		} else {
+			err = tx.Untrash(et.ns.Name(), et.Name(), id)
+		}
+		if err != nil {
+			return err
+		}
+		rev, err := tx.NextRevision(et.ns.Name(), et.Name(), id)
+		if err != nil || !et.watched() {
+			return err
+		}
+
+		d, err := et.get(tx, id)
+		if err != nil {
+			return err
+		}
+		e := ChangeEvent{Op: ChangePut, ID: id, Version: rev, New: d, Soft: true}
+		if trash {
+			e = ChangeEvent{Op: ChangeDelete, ID: id, Version: rev, Old: d, Soft: true}
+		}
+		et.notify(tx, e)
+		return nil
+	})
+	if err == storage.ErrKeyUnknown {
+		return ErrIdentifierUnknown
+	}
+	return err
+}
+
+// PurgeDeleted permanently deletes the documents soft-deleted at least
+// the given duration ago, as `Delete` does.  Documents are purged in
+// chunks, each in its own transaction.  It answers the number of
+// documents purged.  Those whose removal is restricted by references to
+// them (see `OnDeleteRestrict`) are kept.
+func (et *entityType) PurgeDeleted(olderThan time.Duration) (uint64, error) {
+	cutoff := et.db.now().Add(-olderThan).UnixNano()
+	var n uint64
+	var start uint64
+	kept := make(map[uint64]bool)
+
+	for {
+		var ids []uint64
+		var refd uint64
+		next := uint64(0)
+		err := et.db.sdb.Update(func(tx *storage.Tx) error {
+			err := tx.ForEachTrashed(et.ns.Name(), et.Name(), start, func(id uint64, t int64) (bool, error) {
+				if len(ids) == purgeChunk {
+					next = id
+					return false, nil
+				}
+				if t <= cutoff && !kept[id] {
+					ids = append(ids, id)
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			refd, err = et.removeAll(tx, ids, et.db.now().UnixNano())
+			return err
+		})
+		if refd != 0 {
+			kept[refd] = true
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n += uint64(len(ids))
+		if next == 0 {
+			return n, nil
+		}
+		start = next
+	}
+}
+
+// Deleted answers the soft-deleted documents, in the ascending order of
+// their IDs.
+func (et *entityType) Deleted() ([]DeletedEntity, error) {
+	var res []DeletedEntity
+	err := et.db.sdb.View(func(tx *storage.Tx) error {
+		return tx.ForEachTrashed(et.ns.Name(), et.Name(), 0, func(id uint64, t int64) (bool, error) {
+			res = append(res, DeletedEntity{ID: id, At: time.Unix(0, t)})
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
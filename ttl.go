@@ -0,0 +1,173 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"time"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// Number of expired entities removed per transaction.
+const expireChunk = 1024
+
+// ExpiringEntityType is implemented by entity types whose instances
+// can expire, such as sessions, cached values and tokens.  Expired
+// entities are hidden from `Get` and `Search` at once, and are removed
+// by `ExpireNow`, or by the background sweeper of a database opened
+// with `Options.SweepInterval`.
+type ExpiringEntityType interface {
+	// PutWithExpiry is like `Put`, but the stored entity expires at
+	// the given time.
+	PutWithExpiry(Entity, time.Time) error
+	// ExpireNow removes the expired entities, answering their
+	// number.
+	ExpireNow() (uint64, error)
+}
+
+// PutWithExpiry is like `Put`, but the stored document expires at the
+// given time.  A zero time stores the document without an expiry time.
+func (et *entityType) PutWithExpiry(e Entity, at time.Time) error {
+	var t int64
+	if !at.IsZero() {
+		t = at.UnixNano()
+		if t <= 0 {
+			return ErrExpiryInvalid
+		}
+	}
+	return et.put(e, putOpts{expires: t})
+}
+
+// ExpireNow removes the expired documents, as `Delete` does.  Documents
+// are removed in chunks, each in its own transaction.  It answers the
+// number of documents removed.  The expired documents of a frozen
+// entity type remain hidden, and are removed once it is unfrozen.
+// Those whose removal is restricted by references to them (see
+// `OnDeleteRestrict`) are kept, until the references are removed.
+func (et *entityType) ExpireNow() (uint64, error) {
+	var n uint64
+	kept := make(map[uint64]bool)
+	for {
+		cnt, err := et.expireChunk(et.db.now().UnixNano(), kept)
+		n += cnt
+		if err != nil || cnt < expireChunk {
+			return n, err
+		}
+	}
+}
+
+// expireChunk removes up to `expireChunk` documents that have expired
+// as of the given time, answering their number.  Those in the given
+// set are skipped; those whose removal is restricted are added to it.
+func (et *entityType) expireChunk(now int64, kept map[uint64]bool) (uint64, error) {
+	for {
+		var n, refd uint64
+		err := et.db.sdb.Update(func(tx *storage.Tx) error {
+			if _, ok := tx.Frozen(et.ns.Name(), et.Name()); ok {
+				return nil
+			}
+			var ids []uint64
+			err := tx.ForEachExpired(et.ns.Name(), et.Name(), now, func(id uint64, _ int64) (bool, error) {
+				if !kept[id] {
+					ids = append(ids, id)
+				}
+				return len(ids) < expireChunk, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			refd, err = et.removeAll(tx, ids, now)
+			if err != nil {
+				return err
+			}
+			n = uint64(len(ids))
+			return nil
+		})
+		if refd != 0 {
+			kept[refd] = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return n, nil
+	}
+}
+
+// ExpireNow removes the expired entities of all the entity types in
+// all the namespaces, answering their number.  The definitions of the
+// entity types are looked up in the system catalogue, so that the
+// index of references can be maintained.  Reserved namespaces, such as
+// that of the administrative event log, are skipped.
+func (db *DB) ExpireNow() (uint64, error) {
+	ets := make(map[string][]string)
+	err := db.sdb.View(func(tx *storage.Tx) error {
+		for _, ns := range tx.Namespaces() {
+			ets[ns] = tx.EntityTypes(ns)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defns, err := db.defnsByName()
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for name, names := range ets {
+		if name[0] == '_' {
+			continue
+		}
+		ns, err := NewNamespace(name)
+		if err != nil {
+			return n, err
+		}
+		for _, etn := range names {
+			et, err := db.catalogueType(ns, etn, defns)
+			if err != nil {
+				return n, err
+			}
+			cnt, err := et.ExpireNow()
+			n += cnt
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// sweep calls `ExpireNow` at the given interval, until the given
+// channel is closed.  Errors are ignored; the next sweep retries.
+func (db *DB) sweep(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			_, err := db.ExpireNow()
+			if err != nil {
+				logMsg(LogWarn, "removing expired entities failed", LogField{"error", err})
+			}
+		}
+	}
+}
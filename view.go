@@ -0,0 +1,99 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// ReadTx is a consistent, read-only snapshot of the database.  All
+// reads made through the entity types answered by a snapshot observe
+// the database as it was when the snapshot began, regardless of
+// concurrent writes.  See `DB.View`.
+type ReadTx struct {
+	db *DB
+	tx *storage.Tx
+}
+
+// View runs the given function with a snapshot of the database, so
+// that reads of several entities - of one or more entity types - do
+// not observe interleaved writes.  It answers the error answered by
+// the function.
+//
+// The snapshot is valid only until the function returns; neither it
+// nor the entity types obtained through it should be used thereafter.
+// The documents read remain valid.  The function must not modify the database, using
+// this or any other handle: writers wait for the snapshot's read
+// transaction if the database file has to grow, and would deadlock.
+// Long-running snapshots also prevent the reuse of the space freed by
+// concurrent writes.
+func (db *DB) View(fn func(*ReadTx) error) error {
+	return db.view(context.Background(), func(tx *storage.Tx) error {
+		return fn(&ReadTx{db: db, tx: tx})
+	})
+}
+
+// EntityType answers a read-only handle to the instances of the given
+// entity type in the given namespace, as they are in this snapshot.
+// `Get` and `Search` behave as those of `DB.EntityType`, except that
+// documents stored at earlier schema versions are not read-repaired;
+// `Put` and `Delete` answer `ErrReadOnly`.
+func (rt *ReadTx) EntityType(ns *Namespace, ed *EntityTypeDefn) EntityType {
+	return &snapshotType{et: &entityType{db: rt.db, ns: ns, defn: ed, rtx: rt.tx}}
+}
+
+// snapshotType is a read-only entity type bound to a snapshot.
+type snapshotType struct {
+	et *entityType
+}
+
+// Name answers the name of the underlying entity type.
+func (s *snapshotType) Name() string {
+	return s.et.Name()
+}
+
+// Get answers the document having the given ID, as it is in the
+// snapshot.
+func (s *snapshotType) Get(id uint64) (Entity, error) {
+	return s.et.Get(id)
+}
+
+// Put answers `ErrReadOnly`.
+func (s *snapshotType) Put(Entity) error {
+	return ErrReadOnly
+}
+
+// Delete answers `ErrReadOnly`.
+func (s *snapshotType) Delete(uint64) error {
+	return ErrReadOnly
+}
+
+// Search passes the documents, as they are in the snapshot, to the
+// given predicate.  See `EntityType.Search`.
+func (s *snapshotType) Search(opts SearchOpts, fn SearchFn) ([]uint64, error) {
+	return s.et.Search(opts, fn)
+}
+
+// view runs the given function in the read transaction of the
+// snapshot that this handle is bound to, if any; otherwise, in a new
+// read-only transaction.
+func (et *entityType) view(ctx context.Context, fn func(*storage.Tx) error) error {
+	if et.rtx != nil {
+		return fn(et.rtx)
+	}
+	return et.db.view(ctx, fn)
+}
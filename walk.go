@@ -0,0 +1,133 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"sort"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// WalkFn is called with each entity reached by a walk, and its depth:
+// the number of references followed to reach it.  It answers `false`
+// if the references of the entity should not be followed.
+type WalkFn func(Entity, int) bool
+
+// Walker is implemented by entity types that can walk the graph formed
+// by the references of their entities.
+type Walker interface {
+	// Walk visits the entities reachable from the entity having the
+	// given ID, breadth-first, up to the given depth, following the
+	// reference fields having the given names.
+	Walk(uint64, int, []string, WalkFn) error
+}
+
+// walkStep is an entity to be visited by a walk.
+type walkStep struct {
+	et    *entityType // entity type of the entity
+	id    uint64      // ID of the entity
+	depth int         // number of references followed to reach it
+}
+
+// Walk visits the document having the given ID, and those reachable
+// from it by following references, breadth-first, calling the given
+// function with each of them exactly once - hence, cycles terminate.
+// References are followed up to the given depth; without limit, if it
+// is negative.  Only the reference fields having the given names are
+// followed, in whichever entity types they occur; all of them, if no
+// names are given.  The definitions of the other entity types reached
+// are looked up in the system catalogue.
+//
+// The walk reads a consistent snapshot, in a single read transaction;
+// the function should not modify the database.  Soft-deleted and
+// expired documents are neither visited nor followed, and nor are
+// dangling references.  Documents are answered upgraded to the current
+// schema versions of their entity types.
+func (et *entityType) Walk(start uint64, depth int, fields []string, fn WalkFn) error {
+	if start == 0 {
+		return ErrIdentifierZero
+	}
+	fields = append([]string(nil), fields...)
+	sort.Strings(fields)
+	follows := func(name string) bool {
+		if len(fields) == 0 {
+			return true
+		}
+		i := sort.SearchStrings(fields, name)
+		return i < len(fields) && fields[i] == name
+	}
+
+	now := et.db.now().UnixNano()
+	return et.view(context.Background(), func(tx *storage.Tx) error {
+		types := map[string]*entityType{et.Name(): et}
+		seen := map[ref]bool{{target: et.Name(), id: start}: true}
+		queue := []walkStep{{et: et, id: start}}
+		for len(queue) > 0 {
+			st := queue[0]
+			queue = queue[1:]
+
+			d, err := st.et.walkDoc(tx, st.id, now)
+			if err != nil {
+				return err
+			}
+			if d == nil || !fn(d, st.depth) || st.depth == depth {
+				continue
+			}
+
+			rs := references(d)
+			for _, fid := range refFieldIDs(rs) {
+				fd, _ := st.et.defn.fieldByID(fid)
+				r := rs[fid]
+				if !follows(fd.Name) || seen[r] {
+					continue
+				}
+				seen[r] = true
+
+				tet, ok := types[r.target]
+				if !ok {
+					ed, err := catalogueDefn(tx, r.target)
+					if err != nil {
+						return err
+					}
+					tet = &entityType{db: et.db, ns: et.ns, defn: ed, rtx: et.rtx}
+					types[r.target] = tet
+				}
+				queue = append(queue, walkStep{et: tet, id: r.id, depth: st.depth + 1})
+			}
+		}
+		return nil
+	})
+}
+
+// walkDoc answers the document having the given ID, within the given
+// transaction, if it is neither soft-deleted nor expired as of the
+// given time; `nil` otherwise, or if it does not exist.
+func (et *entityType) walkDoc(tx *storage.Tx, id uint64, now int64) (*Document, error) {
+	if _, ok := tx.Trashed(et.ns.Name(), et.Name(), id); ok {
+		return nil, nil
+	}
+	if t, ok := tx.Expiry(et.ns.Name(), et.Name(), id); ok && t <= now {
+		return nil, nil
+	}
+	d, err := et.get(tx, id)
+	if err != nil {
+		if err == storage.ErrKeyUnknown {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return d, nil
+}
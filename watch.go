@@ -0,0 +1,326 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/js-ojus/flagon/internal/storage"
+)
+
+// watchBatch is the number of entries read from the change log at a
+// time, by watches.
+const watchBatch = 256
+
+// WatchOpts holds the settings of `Watch`.  Events satisfy all the
+// filters given.
+type WatchOpts struct {
+	// After is the position in the change log following which events
+	// are delivered: `0` to replay the log from its beginning, or the
+	// position of the last event processed, to resume a watch.
+	After uint64
+
+	// Namespace, if given, limits events to those of the namespace.
+	Namespace string
+
+	// Types, if given, limits events to those of the named entity
+	// types.
+	Types []string
+
+	// MinID and MaxID, if non-zero, limit events to those of the
+	// entities whose IDs are in the range, inclusive.
+	MinID, MaxID uint64
+
+	// Where, if given, is a `Filter` expression that the entities
+	// stored should satisfy; it should refer to fields defined by all
+	// the entity types watched.  Since the change log does not record
+	// the prior states of entities, deletions are delivered
+	// regardless.
+	Where string
+}
+
+// WatchEvent is a change delivered by `Watch`.
+type WatchEvent struct {
+	Seq       uint64   // position in the change log
+	Op        ChangeOp // `ChangePut` or `ChangeDelete`
+	Namespace string   // name of the namespace of the entity
+	Type      string   // name of the entity type of the entity
+	ID        uint64   // ID of the entity
+
+	// Doc is the entity as stored by the change; `nil` for deletions.
+	// Its fields are those stored; it carries no other metadata.
+	Doc *Document
+}
+
+// WatchFn receives the events of a watch.  If it answers an error, the
+// watch ends with it.
+type WatchFn func(WatchEvent) error
+
+// Watch delivers the changes to entities recorded in the change log -
+// following the position given in `opts`, and satisfying its filters
+// - to the given function, in order, and then waits for more, until
+// the given context is done.  Changes made by `Import`,
+// `ImportBatch` and `ApplyChanges` are not recorded, and are hence not
+// delivered.  It answers the position in the change log up to which
+// events have been delivered, along with the error that ended the
+// watch: that of the context, or of the function, or
+// `ErrChangesTrimmed` if the changes following the position have been
+// trimmed already.
+//
+// Unlike subscriptions (see `Subscribe`), watches are reliable, and
+// resumable: a consumer that records the position of each event
+// processed - say, alongside its effects - can resume from it after a
+// restart, without missing events; consumer groups record the
+// position for it (see `ChangeFeed`).  Watching needs the change log to
+// be recorded; it answers `ErrChangeLogDisabled` otherwise.  See
+// `Options.ChangeLog`.
+func (db *DB) Watch(ctx context.Context, opts WatchOpts, fn WatchFn) (uint64, error) {
+	w, err := db.newWatch(opts)
+	if err != nil {
+		return opts.After, err
+	}
+
+	pos := opts.After
+	for {
+		// Obtained first, lest changes logged meanwhile be missed.
+		logged := db.sdb.ChangesLogged()
+		cs, err := db.sdb.ReadChanges(pos, watchBatch)
+		if err != nil {
+			return pos, err
+		}
+		for _, c := range cs {
+			ev, ok, err := w.event(c)
+			if err == nil && ok {
+				err = fn(ev)
+			}
+			if err != nil {
+				return pos, err
+			}
+			pos = c.Seq
+		}
+
+		if len(cs) == watchBatch {
+			if err = ctx.Err(); err != nil {
+				return pos, err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return pos, ctx.Err()
+		case <-logged:
+		}
+	}
+}
+
+// watch holds the state of a watch in progress.
+type watch struct {
+	db     *DB
+	opts   WatchOpts
+	types  map[string]bool // entity types watched; `nil` for all
+	filter *Filter
+
+	defns map[string]*EntityTypeDefn // current definitions, by name
+	nss   map[string]*Namespace      // namespaces seen, by name
+}
+
+// newWatch answers a watch having the given settings.
+func (db *DB) newWatch(opts WatchOpts) (*watch, error) {
+	if !db.ChangeLog() {
+		return nil, ErrChangeLogDisabled
+	}
+	w := &watch{db: db, opts: opts, defns: make(map[string]*EntityTypeDefn), nss: make(map[string]*Namespace)}
+	if opts.Where != "" {
+		var err error
+		w.filter, err = NewFilter(opts.Where)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Types) > 0 {
+		w.types = make(map[string]bool, len(opts.Types))
+		for _, t := range opts.Types {
+			w.types[t] = true
+		}
+	}
+	defns, err := db.EntityTypeDefns()
+	if err != nil {
+		return nil, err
+	}
+	for _, ed := range defns {
+		w.defns[ed.Name()] = ed
+	}
+	return w, nil
+}
+
+// event answers the event of the given change, and `true` if it
+// satisfies the filters of this watch.  Changes of definitions are
+// not delivered, but are applied to those that decode entities.
+func (w *watch) event(c storage.Change) (WatchEvent, bool, error) {
+	ev := WatchEvent{Seq: c.Seq, Namespace: c.NS, Type: c.ET}
+	switch c.Kind {
+	case storage.ChangeDefn:
+		ed := &EntityTypeDefn{}
+		err := json.Unmarshal(c.Value, ed)
+		if err != nil {
+			return ev, false, err
+		}
+		w.defns[c.ET] = ed
+		return ev, false, nil
+
+	case storage.ChangePut:
+		ev.Op = ChangePut
+
+	case storage.ChangeDelete:
+		ev.Op = ChangeDelete
+
+	default:
+		return ev, false, nil
+	}
+
+	if len(c.Key) != 8 || w.opts.Namespace != "" && c.NS != w.opts.Namespace || w.types != nil && !w.types[c.ET] {
+		return ev, false, nil
+	}
+	ev.ID = binary.BigEndian.Uint64(c.Key)
+	if w.opts.MinID != 0 && ev.ID < w.opts.MinID || w.opts.MaxID != 0 && ev.ID > w.opts.MaxID {
+		return ev, false, nil
+	}
+	if ev.Op == ChangeDelete {
+		return ev, true, nil
+	}
+
+	d, err := w.document(c, ev.ID)
+	if err != nil {
+		return ev, false, err
+	}
+	ev.Doc = d
+	if w.filter != nil && !w.filter.Match(ev.ID, d) {
+		return ev, false, w.filter.Err()
+	}
+	return ev, true, nil
+}
+
+// document decodes the entity stored by the given change.
+func (w *watch) document(c storage.Change, id uint64) (*Document, error) {
+	ed := w.defns[c.ET]
+	if ed == nil {
+		return nil, ErrNameUnknown
+	}
+	ns := w.nss[c.NS]
+	if ns == nil {
+		var err error
+		ns, err = NewNamespace(c.NS)
+		if err != nil {
+			return nil, err
+		}
+		w.nss[c.NS] = ns
+	}
+
+	by, err := c.Record()
+	if err != nil {
+		return nil, err
+	}
+	et := &entityType{db: w.db, ns: ns, defn: ed}
+	d := NewDocument(ed, id)
+	err = et.decode(by, d)
+	if err != nil {
+		return nil, err
+	}
+	err = ed.upgrade(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ChangeFeed answers a feed of the changes recorded in the change log
+// that satisfy the filters of the given settings, for consumer groups
+// (see `JoinGroup`).  Its positions are those of the change log, and
+// the values of its events are `WatchEvent`s; `opts.After` is ignored,
+// since groups read from their own positions.  The change log is not
+// trimmed past the positions acknowledged by the groups reading it.
+// It answers `ErrChangeLogDisabled` unless this handle records the
+// change log.
+func (db *DB) ChangeFeed(opts WatchOpts) (Feed, error) {
+	w, err := db.newWatch(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &changeFeed{w: w}, nil
+}
+
+// changeFeed is a feed of the change log.  Since changes that do not
+// satisfy its filters are not answered, it remembers how far it has
+// read past the last event answered, lest they be read again.
+type changeFeed struct {
+	mu   sync.Mutex
+	w    *watch
+	last uint64 // position of the last event answered
+	read uint64 // position of the last change read after it
+}
+
+// Read conforms to `Feed`.
+func (f *changeFeed) Read(ctx context.Context, after uint64, max int) ([]FeedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pos := after
+	if after == f.last && f.read > after {
+		pos = f.read
+	}
+	for {
+		// Obtained first, lest changes logged meanwhile be missed.
+		logged := f.w.db.sdb.ChangesLogged()
+		cs, err := f.w.db.sdb.ReadChanges(pos, watchBatch)
+		if err != nil {
+			return nil, err
+		}
+
+		var evs []FeedEvent
+		for _, c := range cs {
+			ev, ok, err := f.w.event(c)
+			if err != nil {
+				return nil, err
+			}
+			pos = c.Seq
+			if ok {
+				evs = append(evs, FeedEvent{Pos: c.Seq, Value: ev})
+				if len(evs) == max {
+					break
+				}
+			}
+		}
+		if len(evs) > 0 {
+			f.last, f.read = evs[len(evs)-1].Pos, pos
+			return evs, nil
+		}
+		f.last, f.read = after, pos
+
+		if len(cs) == watchBatch {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-logged:
+		}
+	}
+}
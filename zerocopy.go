@@ -0,0 +1,110 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"unsafe"
+)
+
+// ZeroCopySearcher is implemented by entity types that can pass the
+// matching entities of a search to the caller without copying their
+// values out of the database.
+type ZeroCopySearcher interface {
+	// SearchNoCopy is like `EntitySearcher.SearchEntities`, but the
+	// entities passed are valid only until the given function
+	// returns.
+	SearchNoCopy(SearchOpts, SearchFn, func(Entity) bool) error
+}
+
+// SearchNoCopy is like `SearchEntities`, but decodes the string fields
+// of the documents directly from the database's memory map, rather
+// than copying them, for scan-heavy analytical code, where copying
+// dominates.  The documents passed to both functions, their fields and
+// the strings read from them are valid only until the functions
+// return: the documents are reused, and the memory that the strings
+// refer to may be unmapped once the search ends.  Values that are
+// needed later should be copied, say, using `strings.Clone` or
+// `string([]byte(s))`.  Retaining them is undefined behaviour, which
+// may crash the process.
+//
+// Only string fields of documents that are stored uncompressed and
+// unencrypted refer to the memory map; the others are decoded from
+// private buffers.  Ordered searches copy their values, as
+// `SearchEntities` does.
+func (et *entityType) SearchNoCopy(opts SearchOpts, fn SearchFn, each func(Entity) bool) error {
+	if opts.orderBy != "" {
+		return et.streamOrdered(opts, fn, each)
+	}
+
+	var stop bool
+	opts.stop = &stop
+	opts.noCopy = true
+	_, err := et.search(context.Background(), opts, func(id uint64, e Entity) bool {
+		d := e.(*Document)
+		defer d.Release()
+		if !stop && fn(id, d) {
+			stop = !each(d)
+		}
+		return false
+	})
+	return err
+}
+
+// fieldReader reads the fields of a serialised entity.  In its no-copy
+// mode, strings read refer to the serialised data itself, rather than
+// to copies of it.
+type fieldReader struct {
+	*bytes.Reader
+	data   []byte // serialised data being read
+	noCopy bool   // answer strings that refer to the data?
+}
+
+// newFieldReader answers a reader of the given data.
+func newFieldReader(data []byte, noCopy bool) *fieldReader {
+	return &fieldReader{Reader: bytes.NewReader(data), data: data, noCopy: noCopy}
+}
+
+// next answers the next given number of bytes, without copying them,
+// and advances past them.
+func (r *fieldReader) next(n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pos := len(r.data) - r.Len()
+	r.Seek(int64(n), io.SeekCurrent)
+	return r.data[pos : pos+n : pos+n], nil
+}
+
+// limit answers a reader of the next given number of bytes, in the
+// same mode as this one, and advances past them.
+func (r *fieldReader) limit(n int) (*fieldReader, error) {
+	by, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return newFieldReader(by, r.noCopy), nil
+}
+
+// string answers the given bytes, read from this reader, as a string:
+// in the no-copy mode, one that refers to them.
+func (r *fieldReader) string(by []byte) string {
+	if r.noCopy && len(by) > 0 {
+		return *(*string)(unsafe.Pointer(&by))
+	}
+	return string(by)
+}